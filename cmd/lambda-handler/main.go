@@ -1,23 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/lambdaadapter"
 	"github.com/kokes/smda/src/web"
 )
 
@@ -25,144 +18,48 @@ var invocations int
 
 var db *database.Database
 
-var dummyStatusCode int = -1
+// routes are set up once per cold start, so that query caches and history survive across invocations
+var handler http.Handler
 
-type recordingResponseWriter struct {
-	headers http.Header
-	buffer  bytes.Buffer
-	status  int
-}
-
-func newRecordingResponseWriter() *recordingResponseWriter {
-	return &recordingResponseWriter{
-		headers: make(http.Header),
-		status:  dummyStatusCode,
-	}
-}
-
-func (rw *recordingResponseWriter) Header() http.Header {
-	return rw.headers
-}
-
-func (rw *recordingResponseWriter) WriteHeader(statusCode int) {
-	rw.status = statusCode
-}
-
-func (rw *recordingResponseWriter) Write(s []byte) (int, error) {
-	if rw.status == dummyStatusCode {
-		rw.status = http.StatusOK
-	}
-
-	// TODO: detect MIME via http.DetectContentType?
-
-	return rw.buffer.Write(s)
-}
-
-func lambdaRequestToNative(req events.LambdaFunctionURLRequest) *http.Request {
-	header := make(http.Header, len(req.Headers))
-	for k, v := range req.Headers {
-		header.Set(k, v) // `Add` would've done the same
-	}
-	ret := http.Request{
-		Method:        req.RequestContext.HTTP.Method,
-		Proto:         req.RequestContext.HTTP.Protocol,
-		RemoteAddr:    req.RequestContext.HTTP.SourceIP,
-		Body:          io.NopCloser(strings.NewReader(req.Body)),
-		ContentLength: int64(len(req.Body)),
-		Header:        header,
-		URL: &url.URL{
-			Scheme:   "https",
-			Host:     req.RequestContext.DomainName,
-			Path:     req.RequestContext.HTTP.Path,
-			RawPath:  req.RawPath,
-			RawQuery: req.RawQueryString,
-		},
-	}
-	// TODO: check if we need to parse cookies from req.Cookies or if they're extracted
-	// from headers automatically
-	return &ret
+func HandleRequest(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	invocations += 1
+	return lambdaadapter.Handler(handler)(ctx, req)
 }
 
-// TODO: err if we don't have status set? (in case of no writes)
-func (rw *recordingResponseWriter) toLambdaFunctionResponse() events.LambdaFunctionURLResponse {
-	headers := make(map[string]string)
-	for h, v := range rw.headers {
-		headers[h] = strings.Join(v, ",")
-	}
-	ret := events.LambdaFunctionURLResponse{
-		StatusCode:      rw.status,
-		Body:            rw.buffer.String(),
-		IsBase64Encoded: false,
-		Headers:         headers,
-		// Cookies: , // TODO?
+// setup runs during the Lambda init phase, before our first request is fetched
+func setup() error {
+	t := time.Now()
+	var err error
+	// no disk I/O, stripes go to S3 and metadata stay in memory
+	// TODO: manifests are lost with each cold start, persist them in the bucket as well
+	db, err = database.NewDatabase("", &database.Config{
+		StorageBucket: os.Getenv("SMDA_DATA_BUCKET"),
+		StoragePrefix: "data",
+		// lambda payloads are limited in size, so larger files need to be uploaded
+		// via /upload/presigned
+		UploadBucket: os.Getenv("SMDA_DATA_BUCKET"),
+		UploadPrefix: "ingest",
+	}, database.InMemory(), database.Lazy())
+	if err != nil {
+		return err
 	}
-
-	return ret
-}
-
-func HandleRequest(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
-	invocations += 1
-	if db == nil {
+	// S3 clients get set up in the background, requests that need them wait for them
+	go func() {
 		t := time.Now()
-		var err error
-		// TODO: remove all disk I/O from db creation
-		// TODO: add s3/aws client to the constructor?
-		db, err = database.NewDatabase("", nil)
-		if err != nil {
-			// TODO: write a wrapper to return this as a 500
-			panic(err.Error())
+		if err := db.WarmUp(); err != nil {
+			log.Printf("failed to warm up the database: %v", err)
+			return
 		}
-		log.Printf("db init took %v", time.Since(t)) // TODO: remove
-	}
-
-	// TODO: move elsewhere?
-	if req.RawPath == "/upload/pre-signed" {
-		// TODO: do this in the NewDatabase constructor
-		cfg, err := config.LoadDefaultConfig(
-			context.TODO(),
-			config.WithRegion("eu-central-1"), // TODO: flag
-		)
-		if err != nil {
-			panic(err) // TODO: remove all panics
-		}
-		log.Println("about to pre-sign")
-		client := s3.NewFromConfig(cfg)
-		presigner := s3.NewPresignClient(client)
-		log.Println("config set up")
-		signed, err := presigner.PresignPutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket: aws.String(os.Getenv("SMDA_DATA_BUCKET")), // TODO: move elsewhere
-			Key:    aws.String("ingest/my-testing-dataset"),
-		})
-		if err != nil {
-			panic(err)
-		}
-		ret, err := json.Marshal(signed)
-		if err != nil {
-			panic(err)
-		}
-		return events.LambdaFunctionURLResponse{
-			StatusCode: 200,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-			Body: string(ret), // this is a bit crude, but works for now
-		}, nil
-	}
-
-	// what happens now is:
-	// 1) convert a lambdaFunctionURL request to net/http.Request
-	// 2) initialise a recording responsewriter
-	// 3) run our smda.router.ServeHTTP(mockWriter, convertedRequest)
-	// 4) convert mockWriter response into a lambdaFunctionURL response
-
-	handler := web.SetupRoutes(db)
-	rw := newRecordingResponseWriter()
-	httpReq := lambdaRequestToNative(req)
-	handler.ServeHTTP(rw, httpReq)
-
-	return rw.toLambdaFunctionResponse(), nil
+		log.Printf("db warm up took %v", time.Since(t))
+	}()
+	handler = web.SetupRoutes(db)
+	log.Printf("db init took %v", time.Since(t))
+	return nil
 }
 
 func main() {
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
 	lambda.Start(HandleRequest)
 }
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options cover everything our server can be configured with, either via command line flags
+// or via a config file (see parseFlags), the first group is shared by all the subcommands working
+// with a database (see storageFlags)
+type options struct {
+	configPath    string
+	wdir          string
+	storageBucket string
+	storagePrefix string
+
+	expose       bool
+	portHTTP     int
+	portHTTPS    int
+	portPostgres int
+	loadSamples  bool
+	useTLS       bool
+	tlsCert      string
+	tlsKey       string
+	gracePeriod  time.Duration
+	externalDir  string
+
+	// these can be reloaded while the server is running (see database.Database.Reload)
+	authTokens        []string
+	readOnlyTokens    []string
+	readOnly          bool
+	queryCacheSize    int
+	chunkCacheSize    int
+	maxRowsPerStripe  int
+	maxBytesPerStripe int
+	maxBytesScanned   int
+	queryTimeout      time.Duration
+}
+
+// keys of our config file and the flags they correspond to, config files are in TOML, e.g.
+//
+//	wdir = "/data/smda"
+//	auth_tokens = ["secret"]
+//
+//	[ports]
+//	http = 8080
+//
+// All the subcommands share the same config file, each only reads keys it has flags for.
+// ARCH: we only support a subset of TOML - tables, comments, strings, integers, booleans and
+// single line arrays of these (no inline tables, floats, dates or multiline strings)
+var configKeys = map[string]string{
+	"expose":                    "expose",
+	"wdir":                      "wdir",
+	"samples":                   "samples",
+	"shutdown_grace_period":     "shutdown-grace-period",
+	"external_dir":              "external-dir",
+	"auth_tokens":               "auth-tokens",
+	"read_only_tokens":          "read-only-tokens",
+	"read_only":                 "read-only",
+	"ports.http":                "port-http",
+	"ports.https":               "port-https",
+	"ports.postgres":            "port-postgres",
+	"tls.enabled":               "tls",
+	"tls.cert":                  "tls-cert",
+	"tls.key":                   "tls-key",
+	"storage.bucket":            "storage-bucket",
+	"storage.prefix":            "storage-prefix",
+	"cache.query_results":       "query-cache-size",
+	"cache.chunk_bytes":         "chunk-cache-size",
+	"stripes.max_rows":          "max-rows-per-stripe",
+	"stripes.max_bytes":         "max-bytes-per-stripe",
+	"queries.max_bytes_scanned": "max-bytes-scanned",
+	"queries.timeout":           "query-timeout",
+}
+
+var errInvalidConfig = errors.New("invalid config file")
+
+// stringList is a comma separated list of values (e.g. auth tokens)
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = nil
+	for _, val := range strings.Split(value, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			*sl = append(*sl, val)
+		}
+	}
+	return nil
+}
+
+// storageFlags registers flags locating a database (and our config file)
+func (opts *options) storageFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.configPath, "config", "", "TOML config file, flags passed explicitly take precedence over it")
+	fs.StringVar(&opts.wdir, "wdir", "", "working directory for the database (smda_db in the home directory if empty)")
+	fs.StringVar(&opts.storageBucket, "storage-bucket", "", "S3 bucket to store data in (local working directory is used if empty)")
+	fs.StringVar(&opts.storagePrefix, "storage-prefix", "", "prefix to use for all data stored in the S3 bucket")
+}
+
+// parseOptions parses arguments of our server (see runServe)
+func parseOptions(args []string) (*options, error) {
+	opts := &options{}
+	fs := flag.NewFlagSet("smda serve", flag.ContinueOnError)
+	opts.storageFlags(fs)
+	fs.BoolVar(&opts.expose, "expose", false, "expose the server on the network, do not run it just locally")
+	fs.IntVar(&opts.portHTTP, "port-http", 8822, "port to listen on for http traffic")
+	fs.IntVar(&opts.portHTTPS, "port-https", 8823, "port to listen on for https traffic")
+	fs.IntVar(&opts.portPostgres, "port-postgres", 0, "port to listen on for Postgres clients (disabled if zero), they use auth tokens as passwords")
+	fs.StringVar(&opts.externalDir, "external-dir", "", "directory with local files that can be queried as external datasets (disabled if empty)")
+	fs.BoolVar(&opts.loadSamples, "samples", false, "load sample datasets")
+	fs.BoolVar(&opts.useTLS, "tls", false, "use TLS when hosting the server")
+	fs.StringVar(&opts.tlsCert, "tls-cert", "", "TLS certificate to use")
+	fs.StringVar(&opts.tlsKey, "tls-key", "", "TLS key to use")
+	fs.DurationVar(&opts.gracePeriod, "shutdown-grace-period", 30*time.Second, "how long to wait for in-flight requests when shutting down")
+	fs.Var((*stringList)(&opts.authTokens), "auth-tokens", "comma separated tokens HTTP clients need to present (no authentication if empty)")
+	fs.Var((*stringList)(&opts.readOnlyTokens), "read-only-tokens", "comma separated tokens that only grant read access (they are accepted along with auth tokens)")
+	fs.BoolVar(&opts.readOnly, "read-only", false, "reject all HTTP requests modifying data (uploads, drops, materialisations etc.), only reading and querying is allowed")
+	fs.IntVar(&opts.queryCacheSize, "query-cache-size", 0, "number of query results to cache (database default if zero, disabled if negative)")
+	fs.IntVar(&opts.chunkCacheSize, "chunk-cache-size", 0, "bytes of column data to cache (database default if zero, disabled if negative)")
+	fs.IntVar(&opts.maxRowsPerStripe, "max-rows-per-stripe", 0, "maximum number of rows in a stripe of newly loaded data (database default if zero)")
+	fs.IntVar(&opts.maxBytesPerStripe, "max-bytes-per-stripe", 0, "maximum size (in bytes) of a stripe of newly loaded data (database default if zero)")
+	fs.IntVar(&opts.maxBytesScanned, "max-bytes-scanned", 0, "abort queries reading more than this many bytes, unless they set their own limit (no limit if zero)")
+	fs.DurationVar(&opts.queryTimeout, "query-timeout", 0, "abort queries running for longer than this, unless they set their own timeout (no timeout if zero)")
+	if err := parseFlags(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", strings.Join(fs.Args(), " "))
+	}
+	return opts, nil
+}
+
+// parseFlags parses command line arguments, if they point to a config file (via -config), it gets
+// read as well - flags passed explicitly take precedence over values in the file. Keys of flags
+// not defined in a given flag set are skipped, they belong to other subcommands.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	configPath := ""
+	if cf := fs.Lookup("config"); cf != nil {
+		configPath = cf.Value.String()
+	}
+	if configPath == "" {
+		return nil
+	}
+
+	f, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	values, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%v: %w", configPath, err)
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for key, value := range values {
+		name, ok := configKeys[key]
+		if !ok {
+			return fmt.Errorf("%w: %v: unknown key %v", errInvalidConfig, configPath, key)
+		}
+		if explicit[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%w: %v: invalid value of %v: %v", errInvalidConfig, configPath, key, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig reads a TOML file (see configKeys for what we support) into a map of keys (prefixed
+// by their tables, e.g. `ports.http`) and their values, formatted in a way flags accept them
+// (arrays are comma separated)
+func parseConfig(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	table := ""
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, err := stripComment(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %v: %v", errInvalidConfig, lineno, err)
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("%w: line %v: invalid table header %v", errInvalidConfig, lineno, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("%w: line %v: expecting key = value, got %v", errInvalidConfig, lineno, line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("%w: line %v: duplicate key %v", errInvalidConfig, lineno, key)
+		}
+		value, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %v: %v", errInvalidConfig, lineno, err)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripComment removes comments, unless they are within strings, and surrounding whitespace
+func stripComment(line string) (string, error) {
+	var quote byte
+	for j := 0; j < len(line); j++ {
+		switch c := line[j]; {
+		case quote == 0 && c == '#':
+			return strings.TrimSpace(line[:j]), nil
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			j++ // skip whatever is escaped
+		case c == quote:
+			quote = 0
+		}
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated string")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func parseValue(value string) (string, error) {
+	if strings.HasPrefix(value, "[") {
+		if !strings.HasSuffix(value, "]") {
+			return "", fmt.Errorf("unterminated array %v", value)
+		}
+		var items []string
+		for _, item := range splitArray(value[1 : len(value)-1]) {
+			if item == "" {
+				continue // TOML allows trailing commas
+			}
+			parsed, err := parseValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(parsed, ",") {
+				return "", fmt.Errorf("array items cannot contain commas: %v", item)
+			}
+			items = append(items, parsed)
+		}
+		return strings.Join(items, ","), nil
+	}
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		// literal strings have no escaping
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid string %v", value)
+		}
+		return value[1 : len(value)-1], nil
+	case value == "true" || value == "false":
+		return value, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 10, 64); err != nil {
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+	return strings.ReplaceAll(value, "_", ""), nil
+}
+
+// splitArray splits array items by commas outside of strings
+func splitArray(items string) []string {
+	var ret []string
+	var quote byte
+	start := 0
+	for j := 0; j < len(items); j++ {
+		switch c := items[j]; {
+		case quote == 0 && c == ',':
+			ret = append(ret, strings.TrimSpace(items[start:j]))
+			start = j + 1
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			j++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return append(ret, strings.TrimSpace(items[start:]))
+}
+
+// changedStatic lists options that differ from those currently in use, but which cannot be
+// applied without a restart
+func (opts *options) changedStatic(updated *options) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("expose", opts.expose != updated.expose)
+	check("port-http", opts.portHTTP != updated.portHTTP)
+	check("port-https", opts.portHTTPS != updated.portHTTPS)
+	check("port-postgres", opts.portPostgres != updated.portPostgres)
+	check("wdir", opts.wdir != updated.wdir)
+	check("samples", opts.loadSamples != updated.loadSamples)
+	check("tls", opts.useTLS != updated.useTLS)
+	check("tls-cert", opts.tlsCert != updated.tlsCert)
+	check("tls-key", opts.tlsKey != updated.tlsKey)
+	check("shutdown-grace-period", opts.gracePeriod != updated.gracePeriod)
+	check("storage-bucket", opts.storageBucket != updated.storageBucket)
+	check("storage-prefix", opts.storagePrefix != updated.storagePrefix)
+	check("external-dir", opts.externalDir != updated.externalDir)
+	return changed
+}
@@ -1,15 +1,16 @@
-// This is an ad-hoc script to set up all the necessary AWS
-// services. In case this Lambda approach is viable, maybe
-// include some CloudFormation templates, perhaps Terraform,
-// Pulumi etc.
 package main
 
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -21,12 +22,6 @@ import (
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func main() {
-	if err := run(); err != nil {
-		log.Fatal(err)
-	}
-}
-
 // TODO: allow s3?
 var iamPolicy string = `{
     "Version": "2012-10-17",
@@ -43,22 +38,78 @@ var attachRoles []string = []string{
 	"arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole", // basic logging permissions
 }
 
-func run() error {
-	if len(os.Args) != 2 {
+// the custom runtime expects an executable called `bootstrap` in the root of the bundle
+const handlerName = "bootstrap"
+
+// smokeTest checks that a deployed function responds, it retries for a while, because fresh
+// functions (and their URLs) take a moment to become available
+func smokeTest(functionURL string, attempts int) error {
+	endpoint := strings.TrimSuffix(functionURL, "/") + "/status"
+	client := &http.Client{Timeout: 30 * time.Second}
+	var lastErr error
+	for j := 0; j < attempts; j++ {
+		if j > 0 {
+			time.Sleep(5 * time.Second)
+		}
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("unexpected status code %v: %s", resp.StatusCode, body)
+			continue
+		}
+		log.Printf("smoke test passed: %v responded with %s", endpoint, body)
+		return nil
+	}
+	return fmt.Errorf("smoke test of %v failed: %w", endpoint, lastErr)
+}
+
+// runDeployLambda is an ad-hoc way to set up all the necessary AWS services. In case this Lambda
+// approach is viable, maybe include some CloudFormation templates, perhaps Terraform, Pulumi etc.
+func runDeployLambda(args []string) error {
+	fs := flag.NewFlagSet("smda deploy-lambda", flag.ContinueOnError)
+	region := fs.String("region", "eu-central-1", "AWS region to deploy to")
+	profile := fs.String("profile", "personal", "shared config profile to use for AWS credentials")
+	roleName := fs.String("role", "smda_execution_role", "name of the IAM role the function executes as")
+	arch := fs.String("arch", "arm64", "architecture of the function (arm64 or amd64), must match the bundle's binary")
+	memory := fs.Int("memory", 1024, "memory (in MB) allocated to the function")
+	timeout := fs.Int("timeout", 30, "function timeout (in seconds)")
+	smokeAttempts := fs.Int("smoke-attempts", 12, "how many times to try reaching the deployed function (0 to skip the smoke test)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
 		return errors.New("need to supply the lambda zip bundle as the first and only argument")
 	}
-	lambdaPkg := os.Args[1]
+	var architecture lambdaTypes.Architecture
+	switch *arch {
+	case "arm64":
+		architecture = lambdaTypes.ArchitectureArm64
+	case "amd64", "x86_64":
+		architecture = lambdaTypes.ArchitectureX8664
+	default:
+		return fmt.Errorf("unsupported architecture: %v", *arch)
+	}
+	lambdaPkg := fs.Arg(0)
 	zipData, err := os.ReadFile(lambdaPkg)
 	if err != nil {
 		return err
 	}
 
 	// 1) setup config
-	region := "eu-central-1" // TODO: flag
 	cfg, err := config.LoadDefaultConfig(
 		context.TODO(),
-		config.WithRegion(region),
-		config.WithSharedConfigProfile("personal"), // TODO: flag
+		config.WithRegion(*region),
+		config.WithSharedConfigProfile(*profile),
 	)
 	if err != nil {
 		return err
@@ -79,7 +130,7 @@ func run() error {
 		_, err := s3client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
 			Bucket: &bucket_name,
 			CreateBucketConfiguration: &s3Types.CreateBucketConfiguration{
-				LocationConstraint: s3Types.BucketLocationConstraint(region),
+				LocationConstraint: s3Types.BucketLocationConstraint(*region),
 			},
 		})
 		if err != nil {
@@ -103,11 +154,10 @@ func run() error {
 	}
 
 	// 2) create an iam role (TODO: func getOrCreateRole())
-	roleName := "smda_execution_role" // TODO: flag
 	var role *iamTypes.Role
 	iamClient := iam.NewFromConfig(cfg)
-	log.Printf("getting role %v", roleName)
-	getRole, err := iamClient.GetRole(context.TODO(), &iam.GetRoleInput{RoleName: &roleName})
+	log.Printf("getting role %v", *roleName)
+	getRole, err := iamClient.GetRole(context.TODO(), &iam.GetRoleInput{RoleName: roleName})
 	if err == nil {
 		log.Printf("role exists")
 		// TODO: unescape and load *getRole.Role.AssumeRolePolicyDocument and compare to iamPolicy
@@ -121,7 +171,7 @@ func run() error {
 		}
 		log.Printf("role does not exist, creating")
 		roleInputs := &iam.CreateRoleInput{
-			RoleName:                 aws.String(roleName),
+			RoleName:                 roleName,
 			AssumeRolePolicyDocument: &iamPolicy,
 		}
 		createRole, err := iamClient.CreateRole(context.TODO(), roleInputs)
@@ -161,7 +211,7 @@ func run() error {
 
 	for _, arole := range attachRoles {
 		if _, err := iamClient.AttachRolePolicy(context.TODO(), &iam.AttachRolePolicyInput{
-			RoleName:  &roleName,
+			RoleName:  roleName,
 			PolicyArn: &arole,
 		}); err != nil {
 			return err
@@ -182,10 +232,32 @@ func run() error {
 
 	if err == nil {
 		log.Printf("function exists, updating function code")
-		lambdaClient.UpdateFunctionCode(context.TODO(), &lambda.UpdateFunctionCodeInput{
+		if _, err := lambdaClient.UpdateFunctionCode(context.TODO(), &lambda.UpdateFunctionCodeInput{
+			FunctionName:  &functionName,
+			ZipFile:       zipData,
+			Architectures: []lambdaTypes.Architecture{architecture},
+		}); err != nil {
+			return err
+		}
+		// a function cannot be reconfigured while its code is still being updated
+		waiter := lambda.NewFunctionUpdatedV2Waiter(lambdaClient)
+		if err := waiter.Wait(context.TODO(), &lambda.GetFunctionInput{FunctionName: &functionName}, 5*time.Minute); err != nil {
+			return err
+		}
+		// this migrates functions created with the (deprecated) go1.x runtime as well
+		log.Printf("updating function configuration")
+		if _, err := lambdaClient.UpdateFunctionConfiguration(context.TODO(), &lambda.UpdateFunctionConfigurationInput{
 			FunctionName: &functionName,
-			ZipFile:      zipData,
-		})
+			Runtime:      lambdaTypes.RuntimeProvidedal2,
+			Handler:      aws.String(handlerName),
+			Timeout:      aws.Int32(int32(*timeout)),
+			MemorySize:   aws.Int32(int32(*memory)),
+		}); err != nil {
+			return err
+		}
+		if err := waiter.Wait(context.TODO(), &lambda.GetFunctionInput{FunctionName: &functionName}, 5*time.Minute); err != nil {
+			return err
+		}
 	}
 
 	var lexists *lambdaTypes.ResourceNotFoundException
@@ -194,18 +266,17 @@ func run() error {
 			return err
 		}
 		log.Printf("lambda does not exist, creating")
-		// TODO: these don't get overriden in case the function already exists
-		// maybe add some "--recreate" mode
 		lambdaInputs := &lambda.CreateFunctionInput{
-			FunctionName: &functionName,
-			Role:         role.Arn,
-			Runtime:      lambdaTypes.RuntimeGo1x,
-			Handler:      aws.String("main"), // TODO: param/global
+			FunctionName:  &functionName,
+			Role:          role.Arn,
+			Runtime:       lambdaTypes.RuntimeProvidedal2,
+			Handler:       aws.String(handlerName),
+			Architectures: []lambdaTypes.Architecture{architecture},
 			Code: &lambdaTypes.FunctionCode{
 				ZipFile: zipData,
 			},
-			Timeout: aws.Int32(30), // TODO
-			// MemorySize: aws.Int32(1024), // TODO
+			Timeout:    aws.Int32(int32(*timeout)),
+			MemorySize: aws.Int32(int32(*memory)),
 			// EphemeralStorage: &lambdaTypes.EphemeralStorage{Size: aws.Int32(512)}, // TODO
 			// TODO: environment
 			Environment: &lambdaTypes.Environment{
@@ -219,6 +290,10 @@ func run() error {
 			return err
 		}
 		log.Printf("function created: %v", *fn.FunctionArn)
+		// new functions are pending for a while, they cannot be invoked until they're active
+		if err := lambda.NewFunctionActiveV2Waiter(lambdaClient).Wait(context.TODO(), &lambda.GetFunctionInput{FunctionName: &functionName}, 5*time.Minute); err != nil {
+			return err
+		}
 
 		fu, err := lambdaClient.CreateFunctionUrlConfig(context.TODO(), &lambda.CreateFunctionUrlConfigInput{
 			FunctionName: &functionName,
@@ -253,7 +328,11 @@ func run() error {
 	}
 	log.Printf("lambda URL: %v", *urlc.FunctionUrl)
 
-	// TODO: test that the URL works now
+	if *smokeAttempts > 0 {
+		if err := smokeTest(*urlc.FunctionUrl, *smokeAttempts); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
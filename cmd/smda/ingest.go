@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+)
+
+// runIngest uploads files (or standard input) to a running server, its port can be read from our
+// config file (see parseFlags)
+func runIngest(args []string) error {
+	fs := flag.NewFlagSet("smda ingest", flag.ContinueOnError)
+	fs.String("config", "", "TOML config file, flags passed explicitly take precedence over it")
+	port := fs.Int("port-http", 8822, "port where the smda server is running")
+	// CSV dialect overrides, the server infers these otherwise
+	delimiter := fs.String("delimiter", "", "field delimiter, either a character or its name (comma, semicolon, tab, space, pipe)")
+	quote := fs.String("quote", "", "quote character (defaults to \"), use none to disable quoting")
+	header := fs.Bool("header", true, "whether the first row contains column names")
+	nulls := fs.String("null", "", "comma separated values to be loaded as nulls (e.g. NA,\\N)")
+	sortKey := fs.String("sort-key", "", "comma separated columns the data are sorted by (loading fails if they are not)")
+	schema := fs.String("schema", "", "JSON file with column types overriding inferred ones (e.g. {\"id\": \"string\", \"price\": {\"dtype\": \"float\", \"nullable\": true}})")
+	verify := fs.Bool("verify", false, "compare row counts and column aggregates of uploaded data to those of their sources")
+	// unbounded streams get uploaded in chunks, see ingestStream
+	chunkRows := fs.Int("chunk-rows", 0, "upload standard input in chunks of this many rows, appending each to the dataset created by the first one (zero uploads it all at once)")
+	chunkInterval := fs.Duration("chunk-interval", 0, "upload incomplete chunks once their first row is this old (e.g. 10s), so that slow streams get loaded as well")
+	retries := fs.Int("retries", 5, "number of retries of chunks that fail to upload due to network or server errors")
+	retryBackoff := fs.Duration("retry-backoff", 500*time.Millisecond, "wait before the first retry of a chunk, it doubles with each retry")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	arg := fs.Arg(0)
+
+	// the server gets these as URL parameters, but we need them to load data locally for verification
+	opts := database.LoadOptions{Delimiter: *delimiter, Quote: *quote, NoHeader: !*header}
+	params := url.Values{}
+	if *delimiter != "" {
+		params.Set("delimiter", *delimiter)
+	}
+	if *quote != "" {
+		params.Set("quote", *quote)
+	}
+	if !*header {
+		params.Set("has_header", "false")
+	}
+	if *nulls != "" {
+		opts.NullTokens = strings.Split(*nulls, ",")
+		for _, token := range opts.NullTokens {
+			params.Add("null", token)
+		}
+	}
+	if *sortKey != "" {
+		opts.SortKey = strings.Split(*sortKey, ",")
+		for _, col := range opts.SortKey {
+			params.Add("sort_key", col)
+		}
+	}
+	if *schema != "" {
+		hints, err := os.ReadFile(*schema)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(hints, &opts.SchemaHints); err != nil {
+			return fmt.Errorf("schema hints in %v are not valid: %w", *schema, err)
+		}
+		params.Set("schema", string(hints))
+	}
+
+	// check if there's anything on standard in
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return err
+	}
+	if (stat.Mode() & os.ModeCharDevice) == 0 {
+		if *chunkRows > 0 {
+			if *verify || !*header {
+				return errors.New("chunked ingest cannot be verified and it needs a header (it's repeated in each chunk)")
+			}
+			// appended data are not checked against the existing ones, so datasets lose their sort keys
+			if *sortKey != "" {
+				return errors.New("chunked ingest cannot have a sort key")
+			}
+			ss := streamSettings{chunkRows: *chunkRows, interval: *chunkInterval, retries: *retries, backoff: *retryBackoff}
+			_, err := ingestStream(os.Stdin, "standard_input_data", *port, params, ss)
+			return err
+		}
+		if !*verify {
+			_, err := publish(os.Stdin, "standard_input_data", *port, params)
+			return err
+		}
+		// we can't read standard input twice, so we keep a copy for verification
+		tmp, err := os.CreateTemp("", "smda_ingest")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		ds, err := publish(io.TeeReader(os.Stdin, tmp), "standard_input_data", *port, params)
+		if err != nil {
+			return err
+		}
+		return checkUpload(tmp.Name(), ds, *port, opts)
+	}
+
+	// otherwise ingest a given file
+	if arg == "" {
+		return errors.New("need to supply a file to ingest")
+	}
+	stat, err = os.Stat(arg)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		files, err := os.ReadDir(arg)
+		if err != nil {
+			return err
+		}
+
+		// all the files become visible at once (or not at all, if any of them fails to load)
+		txid, err := transaction(*port, http.MethodPost, "")
+		if err != nil {
+			return err
+		}
+		params.Set("transaction", txid)
+		uploaded := make([]*database.Dataset, len(files))
+		for j, file := range files {
+			path := filepath.Join(arg, file.Name())
+			if uploaded[j], err = publishFile(path, *port, params); err != nil {
+				if _, rerr := transaction(*port, http.MethodDelete, txid); rerr != nil {
+					log.Printf("failed to roll back transaction %v: %v", txid, rerr)
+				}
+				return err
+			}
+		}
+		if _, err := transaction(*port, http.MethodPost, txid+"/commit"); err != nil || !*verify {
+			return err
+		}
+		// datasets only become queryable once committed, so we can only verify them now
+		for j, file := range files {
+			if err := checkUpload(filepath.Join(arg, file.Name()), uploaded[j], *port, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ds, err := publishFile(arg, *port, params)
+	if err != nil || !*verify {
+		return err
+	}
+	return checkUpload(arg, ds, *port, opts)
+}
+
+func publishFile(path string, port int, params url.Values) (*database.Dataset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return publish(f, filepath.Base(path), port, params)
+}
+
+// checkUpload verifies an uploaded dataset (see verifyUpload) and logs all the discrepancies found
+func checkUpload(path string, ds *database.Dataset, port int, opts database.LoadOptions) error {
+	discrepancies, err := verifyUpload(path, ds, port, opts)
+	if err != nil {
+		return fmt.Errorf("cannot verify %v: %w", path, err)
+	}
+	for _, discrepancy := range discrepancies {
+		log.Printf("%v: %v", path, discrepancy)
+	}
+	if len(discrepancies) > 0 {
+		return fmt.Errorf("verification of %v failed, found %v discrepancies", path, len(discrepancies))
+	}
+	log.Printf("verified %v (%v rows)", path, ds.NRows)
+	return nil
+}
+
+// transaction calls a given transaction endpoint (see /api/transactions) and returns the
+// transaction's ID
+func transaction(port int, method, path string) (string, error) {
+	turl := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort("localhost", strconv.Itoa(port)),
+		Path:   "/api/transactions",
+	}
+	if path != "" {
+		turl.Path += "/" + path
+	}
+	req, err := http.NewRequest(method, turl.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("unexpected status when calling %v: %v (%s)", turl.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	var tx struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tx); err != nil {
+		return "", err
+	}
+	return tx.ID, nil
+}
+
+// publish uploads data to a running server, params get passed along (e.g. CSV dialect settings),
+// the resulting dataset gets printed (and returned)
+func publish(r io.Reader, name string, port int, params url.Values) (*database.Dataset, error) {
+	kv := url.Values{}
+	for key, vals := range params {
+		kv[key] = vals
+	}
+	kv.Set("name", name)
+	turl := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort("localhost", strconv.Itoa(port)),
+		Path:     "/upload/auto",
+		RawQuery: kv.Encode(),
+	}
+	br := bufio.NewReader(r)
+
+	resp, err := http.Post(turl.String(), "encoding/csv", br)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stdout.Write(body); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status when submitting %v: %v", name, resp.Status)
+	}
+	var ds database.Dataset
+	if err := json.Unmarshal(body, &ds); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
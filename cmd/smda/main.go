@@ -0,0 +1,82 @@
+// smda is a single binary for running and operating smda - hosting its server (serve), loading
+// data into a running server (ingest), maintaining a database offline (compact, fsck) and
+// deploying it to AWS Lambda (deploy-lambda).
+// ARCH: the Lambda handler is not a subcommand, it gets built separately (cmd/lambda-handler),
+// because the Lambda runtime needs a binary built for its own platform and named `bootstrap`
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+)
+
+// subcommand is a single action of our CLI, it gets arguments that follow its name
+type subcommand struct {
+	description string
+	run         func(args []string) error
+}
+
+var subcommands = map[string]subcommand{
+	"serve":         {"run the smda server (HTTP, HTTPS and Postgres)", runServe},
+	"ingest":        {"upload files or standard input to a running server", runIngest},
+	"compact":       {"rewrite datasets into fewer, larger stripes (the server must not be running)", runCompact},
+	"fsck":          {"verify all the data in a database", runFsck},
+	"deploy-lambda": {"deploy a Lambda bundle (see cmd/lambda-handler) to AWS", runDeployLambda},
+	"version":       {"print the binary's build information", runVersion},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: smda <command> [flags] [arguments]")
+	fmt.Fprintln(w, "\ncommands:")
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-14s %v\n", name, subcommands[name].description)
+	}
+	fmt.Fprintln(w, "\nrun `smda <command> -h` for flags of a given command")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "help" {
+		usage(os.Stdout)
+		os.Exit(0)
+	}
+	cmd, ok := subcommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %v\n\n", name)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatal(err)
+	}
+}
+
+// TODO: embed smda version from some place
+func runVersion(args []string) error {
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Println("No build information embedded into the binary")
+		return nil
+	}
+	fmt.Println("Build information")
+	fmt.Println(buildInfo)
+	return nil
+}
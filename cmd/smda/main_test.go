@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+)
+
+// ARCH: many of these tests duplicate what's in router_test.go - maybe move some of the
+// router logic to `handlers` (setupRoutes) and the rest to this main.go?
+
+func TestRunningServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	port := 10000 + rand.Intn(1000)
+	go func() {
+		defer wg.Done()
+		if err := run(ctx, &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: port, portHTTPS: port + 1}, nil); err != nil {
+			panic(err)
+		}
+	}()
+
+	cancel()
+	wg.Wait()
+	// ARCH: all this waiting everywhere is not quite right
+	time.Sleep(50 * time.Millisecond)
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("the port should be free, we should have shut down the server, got %v instead", err)
+	}
+	listener.Close()
+}
+
+func TestLoadingSamples(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := run(ctx, &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: 1236, portHTTPS: 1237, loadSamples: true}, nil); err != nil {
+			panic(err)
+		}
+	}()
+
+	cancel()
+	wg.Wait()
+}
+
+func TestBusyPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:1235")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if err := run(context.Background(), &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: 1235, portHTTPS: 1236}, nil); err == nil {
+		t.Fatal("expecting launching with a port busy errs, it did not")
+	}
+}
+
+func TestCheckingDatabase(t *testing.T) {
+	wdir := filepath.Join(t.TempDir(), "tmp")
+	db, err := database.NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := db.LoadDatasetFromMap("foo", map[string][]string{"id": {"1", "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDatabase(&options{wdir: wdir}); err != nil {
+		t.Errorf("expecting a fresh database to pass checks, got %v", err)
+	}
+
+	// stripes are content addressed, so they are not stored alongside their datasets
+	if err := os.RemoveAll(filepath.Join(wdir, "data", "blobs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDatabase(&options{wdir: wdir}); err == nil {
+		t.Error("expecting a database with missing data to fail checks")
+	}
+}
+
+func TestCompactingDatasets(t *testing.T) {
+	wdir := filepath.Join(t.TempDir(), "tmp")
+	db, err := database.NewDatabase(wdir, &database.Config{MaxRowsPerStripe: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := db.LoadDatasetFromMap("foo", map[string][]string{"id": {"1", "2", "3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCompact([]string{"-wdir", wdir, "foo", "bar"}); err == nil {
+		t.Error("expecting compaction of a nonexistent dataset to fail")
+	}
+	if err := runCompact([]string{"-wdir", wdir}); err == nil {
+		t.Error("expecting compaction without any datasets to fail")
+	}
+	if err := runCompact([]string{"-wdir", wdir, "-max-rows-per-stripe", "10", "foo@v" + ds.ID.String()}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = database.NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := db.GetDataset("foo", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.ID == ds.ID || len(compacted.Stripes) != 1 {
+		t.Errorf("expecting a new version in a single stripe, got %v stripes", len(compacted.Stripes))
+	}
+	if err := checkDatabase(&options{wdir: wdir}); err != nil {
+		t.Errorf("expecting a compacted database to pass checks, got %v", err)
+	}
+}
+
+func TestVerifyingUploads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	port := 10000 + rand.Intn(1000)
+	go func() {
+		defer wg.Done()
+		// small stripes, so that floats get summed in a different order than locally
+		if err := run(ctx, &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: port, portHTTPS: port + 1, maxRowsPerStripe: 2}, nil); err != nil {
+			panic(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	source := write("foo.csv", "id,price,name,amount\n1,0.1,a,1.50\n2,0.2,,2.25\n3,,c,\n4,1e-3,d,3")
+	ds, err := publishFile(source, port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discrepancies, err := verifyUpload(source, ds, port, database.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discrepancies) > 0 {
+		t.Errorf("expecting an upload to match its source, got %v", discrepancies)
+	}
+
+	tests := []struct {
+		contents      string
+		discrepancies int
+	}{
+		{"id,price,name,amount\n1,0.1,a,1.50\n2,0.2,,2.25\n3,,c,\n4,1e-3,d,4", 1},
+		{"id,price,name,amount\n1,0.1,a,1.50\n2,0.2,b,2.25\n3,,c,\n4,1e-3,d,3\n5,1,e,1", 8},
+		{"id,price,name\n1,0.1,a", 1},
+	}
+	for _, test := range tests {
+		path := write("altered.csv", test.contents)
+		discrepancies, err := verifyUpload(path, ds, port, database.LoadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(discrepancies) != test.discrepancies {
+			t.Errorf("expecting %v to result in %v discrepancies, got %v", test.contents, test.discrepancies, discrepancies)
+		}
+	}
+	if err := checkUpload(write("altered.csv", "id\n1"), ds, port, database.LoadOptions{}); err == nil {
+		t.Error("expecting a verification with discrepancies to fail")
+	}
+}
+
+func TestRunningHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	port := 10000 + rand.Intn(1000)
+	go func() {
+		defer wg.Done()
+		if err := run(ctx, &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: port, portHTTPS: port + 1}, nil); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	for _, path := range []string{"/", "/status", "/datasets"} {
+		turl := url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort("localhost", strconv.Itoa(port)),
+			Path:   path,
+		}
+		resp, err := http.Get(turl.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: expected status OK, got %v", turl.String(), resp.StatusCode)
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// certs generated using mkcert
+func TestRunningHTTPS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	port := 10000 + rand.Intn(1000)
+	portHttps := port + 1
+
+	tlsKeyPath := "testdata/localhost-key.pem"
+	tlsCertPath := "testdata/localhost.pem"
+
+	go func() {
+		defer wg.Done()
+		if err := run(ctx, &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: port, portHTTPS: portHttps, useTLS: true, tlsCert: tlsCertPath, tlsKey: tlsKeyPath}, nil); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	cert, err := os.ReadFile(tlsCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(cert); !ok {
+		t.Fatalf("unable to add a certificate for making https requests")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: certPool,
+			},
+		},
+	}
+
+	for _, path := range []string{"/", "/status", "/datasets"} {
+		// perform requests to both http:// and https://, the former should redirect us automatically
+		for _, scheme := range []string{"http", "https"} {
+			host := net.JoinHostPort("localhost", strconv.Itoa(port))
+			if scheme == "https" {
+				host = net.JoinHostPort("localhost", strconv.Itoa(portHttps))
+			}
+			turl := url.URL{
+				Scheme: scheme,
+				Host:   host,
+				Path:   path,
+			}
+			resp, err := client.Get(turl.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%v: expected status OK, got %v", turl.String(), resp.StatusCode)
+			}
+			if resp.Request.URL.Scheme != "https" {
+				t.Fatalf("expecting automatic http -> https redirects, got this new URL instead: %s", resp.Request.URL.String())
+			}
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// test exposure (it will trigger the macOS firewall)
+
+func TestParsingConfig(t *testing.T) {
+	config := `
+# comments are ignored
+wdir = "/data/smda" # even trailing ones
+auth_tokens = ["foo", 'b#r',]
+read_only = true
+
+[ports]
+http = 8_080
+
+[tls]
+enabled = true
+
+[stripes]
+max_rows = 1000
+
+[queries]
+max_bytes_scanned = 1_000_000
+timeout = "30s"
+`
+	path := filepath.Join(t.TempDir(), "smda.toml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := parseOptions([]string{"-config", path, "-port-http", "9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &options{
+		configPath:       path,
+		wdir:             "/data/smda",
+		authTokens:       []string{"foo", "b#r"},
+		readOnly:         true,
+		portHTTP:         9000, // explicit flags take precedence
+		portHTTPS:        8823,
+		useTLS:           true,
+		maxRowsPerStripe: 1000,
+		maxBytesScanned:  1_000_000,
+		queryTimeout:     30 * time.Second,
+		gracePeriod:      30 * time.Second,
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expecting %+v, got %+v", expected, opts)
+	}
+	if changed := expected.changedStatic(opts); len(changed) != 0 {
+		t.Errorf("not expecting any changes, got %v", changed)
+	}
+	opts.portHTTPS = 1234
+	opts.queryCacheSize = 10
+	if changed := expected.changedStatic(opts); !reflect.DeepEqual(changed, []string{"port-https"}) {
+		t.Errorf("expecting only a static option to be reported, got %v", changed)
+	}
+
+	// other subcommands share the config file, but they only read what they have flags for
+	fopts := &options{}
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fopts.storageFlags(fs)
+	if err := parseFlags(fs, []string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fopts, &options{configPath: path, wdir: "/data/smda"}) {
+		t.Errorf("expecting only storage options to be parsed, got %+v", fopts)
+	}
+	if _, err := parseOptions([]string{"-config", path, "foo"}); err == nil {
+		t.Error("expecting positional arguments to be rejected")
+	}
+
+	invalid := []string{
+		"foo = 1",
+		"[ports]\nhttp = \"foo\"",
+		"wdir = \"unterminated",
+		"wdir",
+		"expose = true\nexpose = false",
+		"[[tls]]",
+		"ports.http = 1.5",
+	}
+	for _, config := range invalid {
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseOptions([]string{"-config", path}); !errors.Is(err, errInvalidConfig) {
+			t.Errorf("expecting %q to be an invalid config, got %v", config, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/kokes/smda/src/database"
+)
+
+// openDatabase opens an existing database, or initialises a new one, for maintenance tasks - none
+// of the server settings apply here
+func openDatabase(opts *options) (*database.Database, error) {
+	wdir, err := workingDirectory(opts.wdir)
+	if err != nil {
+		return nil, err
+	}
+	return database.NewDatabase(wdir, &database.Config{
+		StorageBucket: opts.storageBucket,
+		StoragePrefix: opts.storagePrefix,
+	})
+}
+
+func runFsck(args []string) error {
+	opts := &options{}
+	fs := flag.NewFlagSet("smda fsck", flag.ContinueOnError)
+	opts.storageFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return checkDatabase(opts)
+}
+
+// checkDatabase verifies all the data in a database (see database.Fsck), each problem found gets logged
+func checkDatabase(opts *options) error {
+	d, err := openDatabase(opts)
+	if err != nil {
+		return err
+	}
+	errs := d.Fsck()
+	for _, err := range errs {
+		log.Print(err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("found %v problems in %v", len(errs), d.Config.WorkingDirectory)
+	}
+	log.Printf("all data in %v verified", d.Config.WorkingDirectory)
+	return nil
+}
+
+func runCompact(args []string) error {
+	opts := &options{}
+	var copts database.CompactOptions
+	fs := flag.NewFlagSet("smda compact", flag.ContinueOnError)
+	opts.storageFlags(fs)
+	fs.IntVar(&copts.MaxRows, "max-rows-per-stripe", 0, "maximum number of rows in a compacted stripe (database default if zero)")
+	fs.IntVar(&copts.MaxBytes, "max-bytes-per-stripe", 0, "maximum size (in bytes) of a compacted stripe (database default if zero)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smda compact [flags] dataset [dataset...]")
+		fmt.Fprintln(fs.Output(), "datasets are referred to by their (qualified) names, e.g. sales.orders, or by versions, e.g. foo@v<version>")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("need to supply datasets to compact")
+	}
+	if copts.MaxRows < 0 || copts.MaxBytes < 0 {
+		return errors.New("stripe sizes cannot be negative")
+	}
+	d, err := openDatabase(opts)
+	if err != nil {
+		return err
+	}
+	return compactDatasets(d, fs.Args(), copts)
+}
+
+// compactDatasets compacts given datasets (see database.Compact), each into a new version of itself
+// ARCH: we don't coordinate with a server running off the same database, it wouldn't see the new
+// versions until restarted, it could even remove data we are writing
+func compactDatasets(d *database.Database, names []string, copts database.CompactOptions) error {
+	for _, ref := range names {
+		name, version, _ := strings.Cut(ref, "@v")
+		ds, err := d.GetDataset(name, version, version == "")
+		if err != nil {
+			return fmt.Errorf("cannot compact %v: %w", ref, err)
+		}
+		compacted, err := d.Compact(ds, copts)
+		if err != nil {
+			return fmt.Errorf("failed to compact %v: %w", ref, err)
+		}
+		log.Printf("compacted %v from %v stripes into %v (version %v)", ref, len(ds.Stripes), len(compacted.Stripes), compacted.ID)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/pgserver"
+	"github.com/kokes/smda/src/web"
+)
+
+//go:embed samples/*.csv
+var sampleDir embed.FS
+
+// runServe hosts our server until interrupted, config files (see parseFlags) get reloaded upon SIGHUP
+func runServe(args []string) error {
+	opts, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("starting up process %v", os.Getpid())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan *options)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGHUP)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case s := <-signals:
+				if s != syscall.SIGHUP {
+					log.Printf("signal %v received, shutting down", s)
+					cancel()
+					return
+				}
+				// flags get parsed again as well, so that they still take precedence
+				updated, err := parseOptions(args)
+				if err != nil {
+					log.Printf("cannot reload config: %v", err)
+					continue
+				}
+				select {
+				case reloads <- updated:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return run(ctx, opts, reloads)
+}
+
+func run(ctx context.Context, opts *options, reloads <-chan *options) error {
+	wdir, err := workingDirectory(opts.wdir)
+	if err != nil {
+		return err
+	}
+	d, err := database.NewDatabase(wdir, &database.Config{
+		UseTLS:    opts.useTLS,
+		PortHTTP:  opts.portHTTP,
+		PortHTTPS: opts.portHTTPS,
+
+		PortPostgres: opts.portPostgres,
+		// a zero value would get replaced by the default, negative values abort requests right away
+		ShutdownGracePeriod: int(opts.gracePeriod.Milliseconds()),
+
+		StorageBucket: opts.storageBucket,
+		StoragePrefix: opts.storagePrefix,
+
+		ExternalDirectory: opts.externalDir,
+
+		AuthTokens:        opts.authTokens,
+		ReadOnlyTokens:    opts.readOnlyTokens,
+		ReadOnly:          opts.readOnly,
+		QueryCacheSize:    opts.queryCacheSize,
+		ChunkCacheSize:    opts.chunkCacheSize,
+		MaxRowsPerStripe:  opts.maxRowsPerStripe,
+		MaxBytesPerStripe: opts.maxBytesPerStripe,
+		MaxBytesScanned:   opts.maxBytesScanned,
+		QueryTimeout:      int(opts.queryTimeout.Milliseconds()),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("used/initialised a database in path %s", wdir)
+	go func() {
+		for {
+			select {
+			case updated := <-reloads:
+				reload(d, opts, updated)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// for now, this is blocking, which means as soon as the site is ready, all the sample data are in there
+	// it also means that if our sample data are large, the server takes that much longer to load
+	// it's a tradeoff we need to keep in mind
+	// once we implement automatic fetching of new datasets from the frontend, we should change this to be async
+	if opts.loadSamples {
+		samplefs, err := fs.Sub(sampleDir, "samples")
+		if err != nil {
+			return err
+		}
+		if err := d.LoadSampleData(samplefs); err != nil {
+			return err
+		}
+	}
+
+	if opts.portPostgres > 0 {
+		host := "localhost"
+		if opts.expose {
+			host = ""
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(opts.portPostgres))
+		go func() {
+			// ARCH: the webserver keeps running even if this fails (e.g. when the port is taken)
+			if err := pgserver.ListenAndServe(ctx, d, address); err != nil {
+				log.Printf("postgres server failed: %v", err)
+			}
+		}()
+	}
+
+	return web.RunWebserver(ctx, d, opts.expose, opts.tlsCert, opts.tlsKey)
+}
+
+// reload applies the reloadable subset of our options (see database.Database.Reload), changes
+// to the rest only get logged, they need a restart
+func reload(d *database.Database, current, updated *options) {
+	if changed := current.changedStatic(updated); len(changed) > 0 {
+		log.Printf("these options need a restart to be applied: %v", strings.Join(changed, ", "))
+	}
+	err := d.Reload(database.Config{
+		AuthTokens:        updated.authTokens,
+		ReadOnlyTokens:    updated.readOnlyTokens,
+		ReadOnly:          updated.readOnly,
+		QueryCacheSize:    updated.queryCacheSize,
+		ChunkCacheSize:    updated.chunkCacheSize,
+		MaxRowsPerStripe:  updated.maxRowsPerStripe,
+		MaxBytesPerStripe: updated.maxBytesPerStripe,
+		MaxBytesScanned:   updated.maxBytesScanned,
+		QueryTimeout:      int(updated.queryTimeout.Milliseconds()),
+	})
+	if err != nil {
+		log.Printf("failed to reload config: %v", err)
+		return
+	}
+	log.Printf("config reloaded")
+}
+
+// workingDirectory defaults to a directory in the user's home
+func workingDirectory(wdir string) (string, error) {
+	if wdir != "" {
+		return wdir, nil
+	}
+	hdir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(hdir, "smda_db"), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+)
+
+// streamSettings determine how streams get split into chunks and how failed uploads of these
+// chunks get retried (see ingestStream)
+type streamSettings struct {
+	chunkRows int           // upload a chunk once it has this many rows...
+	interval  time.Duration // ...or once its first row is this old (zero to only go by rows)
+	retries   int
+	backoff   time.Duration // wait before the first retry, it doubles with each attempt
+}
+
+// errRetryable marks failed uploads that may succeed if tried again (network issues, overloaded
+// or restarting servers), other failures (e.g. data not matching a dataset's schema) are final
+var errRetryable = errors.New("temporary failure")
+
+// ingestStream uploads a stream of CSV lines in chunks, so that unbounded streams (e.g. from
+// kafka-console-consumer) become queryable as they arrive. The first chunk creates a dataset and
+// all the following ones get appended to it (see /upload/append), each repeating the stream's
+// header and its loading parameters (dialect and schema hints). Chunks are uploaded one at a time
+// and we don't read past a full chunk until it's been uploaded, so a slow server slows down our
+// reading (and whoever writes to us) instead of us buffering the stream in memory.
+// ARCH: chunks are split on newlines, so quoted values spanning multiple lines are not supported
+func ingestStream(r io.Reader, name string, port int, params url.Values, ss streamSettings) (*database.Dataset, error) {
+	lines := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			// lines cut short by read errors are not to be loaded
+			if (err == nil || err == io.EOF) && len(bytes.TrimSpace(line)) > 0 {
+				if line[len(line)-1] != '\n' {
+					line = append(line, '\n')
+				}
+				select {
+				case lines <- line:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var (
+		ds        *database.Dataset
+		header    []byte
+		chunk     bytes.Buffer
+		rows      int
+		total     int
+		nchunks   int
+		chunkDone <-chan time.Time
+	)
+	flush := func() error {
+		chunkDone = nil
+		if rows == 0 {
+			return nil
+		}
+		body := append(append([]byte(nil), header...), chunk.Bytes()...)
+		// all chunks share the same dialect and schema hints
+		kv := url.Values{}
+		for key, vals := range params {
+			kv[key] = vals
+		}
+		var err error
+		if ds == nil {
+			kv.Set("name", name)
+			ds, err = uploadChunk(serverURL(port, "/upload/auto", kv), body, ss)
+		} else {
+			// streams are loaded bit by bit, so later values may need wider types than earlier ones
+			kv.Set("widen", "true")
+			ds, err = uploadChunk(serverURL(port, "/upload/append/"+ds.QualifiedName(), kv), body, ss)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot upload rows %v-%v of %v: %w", total+1, total+rows, name, err)
+		}
+		nchunks++
+		total += rows
+		log.Printf("uploaded chunk %v of %v (%v rows), %v rows in total", nchunks, ds.Name, rows, total)
+		chunk.Reset()
+		rows = 0
+		return nil
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if err := flush(); err != nil {
+					return ds, err
+				}
+				if err := <-readErr; err != nil {
+					return ds, err
+				}
+				if ds == nil {
+					return nil, errors.New("no data to ingest")
+				}
+				return ds, json.NewEncoder(os.Stdout).Encode(ds)
+			}
+			if header == nil {
+				header = line
+				continue
+			}
+			chunk.Write(line)
+			rows++
+			if rows == 1 && ss.interval > 0 {
+				chunkDone = time.After(ss.interval)
+			}
+			if rows >= ss.chunkRows {
+				if err := flush(); err != nil {
+					return ds, err
+				}
+			}
+		case <-chunkDone:
+			if err := flush(); err != nil {
+				return ds, err
+			}
+		}
+	}
+}
+
+func serverURL(port int, path string, params url.Values) string {
+	turl := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort("localhost", strconv.Itoa(port)),
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+	return turl.String()
+}
+
+// uploadChunk posts a chunk of data, retrying temporary failures with exponential backoff
+// ARCH: a chunk that got loaded, but whose response got lost, gets loaded twice
+func uploadChunk(turl string, body []byte, ss streamSettings) (*database.Dataset, error) {
+	wait := ss.backoff
+	for attempt := 0; ; attempt++ {
+		ds, err := postChunk(turl, body)
+		if err == nil || !errors.Is(err, errRetryable) || attempt >= ss.retries {
+			return ds, err
+		}
+		log.Printf("failed to upload a chunk, retrying in %v: %v", wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func postChunk(turl string, body []byte) (*database.Dataset, error) {
+	resp, err := http.Post(turl, "encoding/csv", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	rbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRetryable, err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, fmt.Errorf("%w: unexpected status %v (%s)", errRetryable, resp.Status, bytes.TrimSpace(rbody))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v (%s)", resp.Status, bytes.TrimSpace(rbody))
+	}
+	var ds database.Dataset
+	if err := json.Unmarshal(rbody, &ds); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
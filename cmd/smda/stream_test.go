@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestIngestingStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	port := 10000 + rand.Intn(1000)
+	go func() {
+		defer wg.Done()
+		if err := run(ctx, &options{wdir: filepath.Join(t.TempDir(), "tmp"), portHTTP: port, portHTTPS: port + 1}, nil); err != nil {
+			panic(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ss := streamSettings{chunkRows: 2, retries: 1, backoff: time.Millisecond}
+	tests := []struct {
+		stream string
+		nrows  int
+		dtype  column.Dtype
+	}{
+		{"a,b\n1,2\n3,4\n5,6", 3, column.DtypeInt},
+		{"a,b\n1,2\n3,4\n", 2, column.DtypeInt},
+		// blank lines are skipped, later chunks may widen types
+		{"a,b\n1,2\n\n3,4\n5.5,6\n\n7,8\r\n9,", 5, column.DtypeFloat},
+	}
+	for j, test := range tests {
+		name := fmt.Sprintf("stream%v", j)
+		ds, err := ingestStream(strings.NewReader(test.stream), name, port, nil, ss)
+		if err != nil {
+			t.Errorf("failed to ingest %q: %v", test.stream, err)
+			continue
+		}
+		if ds.Name != name || int(ds.NRows) != test.nrows {
+			t.Errorf("expecting %q to result in %v rows, got %v", test.stream, test.nrows, ds.NRows)
+		}
+		if dtype := ds.Schema[0].Dtype; dtype != test.dtype {
+			t.Errorf("expecting %q to be loaded as %v, got %v", test.stream, test.dtype, dtype)
+		}
+	}
+
+	// dialects and schema hints apply to all the chunks, not just the first one
+	params := url.Values{
+		"null":   []string{"NA"},
+		"quote":  []string{"'"},
+		"schema": []string{`{"total": {"expression": "a + b"}, "currency": {"default": "EUR"}}`},
+	}
+	stream := "a,b,label\n1,2,'x,y'\n3,NA,z\nNA,4,'w,v'\n5,6,u\n7,8,NA"
+	ds, err := ingestStream(strings.NewReader(stream), "hinted", port, params, ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := column.TableSchema{
+		{Name: "a", Dtype: column.DtypeInt, Nullable: true},
+		{Name: "b", Dtype: column.DtypeInt, Nullable: true},
+		{Name: "label", Dtype: column.DtypeString, Nullable: true},
+		{Name: "currency", Dtype: column.DtypeString},
+		{Name: "total", Dtype: column.DtypeInt, Nullable: true},
+	}
+	if ds.NRows != 5 || !reflect.DeepEqual(ds.Schema, expected) {
+		t.Errorf("expecting a hinted stream to load as %+v, got %+v (%v rows)", expected, ds.Schema, ds.NRows)
+	}
+
+	if _, err := ingestStream(strings.NewReader("a,b\n"), "empty", port, nil, ss); err == nil {
+		t.Error("expecting a stream without data to fail")
+	}
+	// data not fitting the dataset created by the first chunk fail without retries
+	if _, err := ingestStream(strings.NewReader("a,b\n1,2\n3,4\nfoo,bar"), "mismatch", port, nil, ss); err == nil || errors.Is(err, errRetryable) {
+		t.Errorf("expecting an incompatible chunk to fail for good, got %v", err)
+	}
+}
+
+func TestRetryingChunks(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Query().Get("status") != "":
+			http.Error(w, "no", http.StatusBadRequest)
+		case requests < 3:
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"name": "foo"}`))
+		}
+	}))
+	defer srv.Close()
+
+	ss := streamSettings{retries: 2, backoff: time.Millisecond}
+	ds, err := uploadChunk(srv.URL, []byte("a\n1"), ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Name != "foo" || requests != 3 {
+		t.Errorf("expecting a chunk to be uploaded after two retries, got %v after %v requests", ds, requests)
+	}
+
+	requests = 0
+	ss.retries = 1
+	if _, err := uploadChunk(srv.URL, []byte("a\n1"), ss); !errors.Is(err, errRetryable) || requests != 2 {
+		t.Errorf("expecting retries to run out after %v requests, got %v (%v)", 2, requests, err)
+	}
+	requests = 0
+	if _, err := uploadChunk(srv.URL+"?status=400", []byte("a\n1"), ss); err == nil || errors.Is(err, errRetryable) || requests != 1 {
+		t.Errorf("expecting bad requests not to be retried, got %v after %v requests", err, requests)
+	}
+}
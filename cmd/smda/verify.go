@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query"
+)
+
+// verifyUpload spot checks that a dataset uploaded to a server holds the same data as its source
+// file - it compares its schema, row count, non-null counts of all columns and sums of numeric
+// columns, as queried via the server's API, to those computed locally. It returns a list of
+// discrepancies (if any).
+// ARCH: the source gets loaded locally (in memory) using the same loader and options, so this
+// cannot catch issues in parsing itself, only data lost or altered in transit or on the server
+func verifyUpload(path string, uploaded *database.Dataset, port int, opts database.LoadOptions) ([]string, error) {
+	db, err := database.NewDatabase("", nil, database.InMemory())
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opts.Namespace = ""
+	source, err := db.LoadDatasetFromReaderAutoWithOptions("source", f, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %v locally: %w", path, err)
+	}
+	if err := db.AddDataset(source); err != nil {
+		return nil, err
+	}
+
+	var discrepancies []string
+	if !schemasMatch(source.Schema, uploaded.Schema) {
+		// there's no point in comparing columns that don't correspond
+		return append(discrepancies, fmt.Sprintf("schema differs: %v locally, %v uploaded", source.Schema, uploaded.Schema)), nil
+	}
+
+	checks := []string{"count()"}
+	for _, col := range source.Schema {
+		checks = append(checks, fmt.Sprintf("count(%v)", col.Name))
+		switch col.Dtype {
+		case column.DtypeInt, column.DtypeFloat, column.DtypeDecimal:
+			checks = append(checks, fmt.Sprintf("sum(%v)", col.Name))
+		}
+	}
+	projections := strings.Join(checks, ", ")
+
+	res, err := query.RunSQL(context.Background(), db, fmt.Sprintf("SELECT %v FROM source", projections))
+	if err != nil {
+		return nil, err
+	}
+	remote, err := queryServer(port, fmt.Sprintf("SELECT %v FROM %v@v%v", projections, uploaded.QualifiedName(), uploaded.ID))
+	if err != nil {
+		return nil, err
+	}
+	if len(remote) != len(checks) {
+		return nil, fmt.Errorf("unexpected results of verification queries: %v", remote)
+	}
+	for j, check := range checks {
+		expected, ok := res.Data[j].JSONLiteral(0)
+		if !ok {
+			expected = "null"
+		}
+		if got := string(remote[j]); !sameValues(expected, got) {
+			discrepancies = append(discrepancies, fmt.Sprintf("%v differs: %v locally, %v uploaded", check, expected, got))
+		}
+	}
+	return discrepancies, nil
+}
+
+func schemasMatch(a, b column.TableSchema) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for j := range a {
+		if a[j].Name != b[j].Name || a[j].Dtype != b[j].Dtype {
+			return false
+		}
+	}
+	return true
+}
+
+// sameValues compares two JSON literals, floats only need to be close, because they may get summed
+// in a different order (e.g. if the server splits data into stripes differently)
+func sameValues(a, b string) bool {
+	if a == b {
+		return true
+	}
+	fa, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	fb, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return false
+	}
+	return math.Abs(fa-fb) <= 1e-9*math.Max(math.Abs(fa), math.Abs(fb))
+}
+
+// queryServer runs a query returning a single row on a running server and returns its values
+func queryServer(port int, sql string) ([]json.RawMessage, error) {
+	turl := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort("localhost", strconv.Itoa(port)),
+		Path:   "/api/query",
+	}
+	body, err := json.Marshal(struct {
+		SQL string `json:"sql"`
+	}{sql})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(turl.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status when querying %v: %v (%s)", turl.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	var res struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Data) != 1 {
+		return nil, fmt.Errorf("expecting a single row, got %v", len(res.Data))
+	}
+	return res.Data[0], nil
+}
@@ -0,0 +1,66 @@
+package smda_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/kokes/smda"
+)
+
+func Example() {
+	db, err := smda.Open("") // in-memory, pass a directory to persist data
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	raw := "name,city,age\nJoe,Prague,32\nJane,Brno,41\nJim,Prague,\n"
+	if _, err := db.Ingest("people", strings.NewReader(raw), smda.IngestOptions{}); err != nil {
+		log.Fatal(err)
+	}
+
+	rows, err := db.Query(context.Background(), "SELECT city, count() AS n, max(age) AS oldest FROM people GROUP BY city ORDER BY city")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var city string
+		var n int
+		var oldest *int64 // nullable
+		if err := rows.Scan(&city, &n, &oldest); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(city, n, *oldest)
+	}
+	// Output:
+	// Brno 1 41
+	// Prague 2 32
+}
+
+func ExampleDB_Query_params() {
+	db, err := smda.Open("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	raw := "id,score\n1,3.5\n2,\n3,1.25\n"
+	if _, err := db.Ingest("scores", strings.NewReader(raw), smda.IngestOptions{}); err != nil {
+		log.Fatal(err)
+	}
+
+	rows, err := db.Query(context.Background(), "SELECT id, score FROM scores WHERE id >= ? ORDER BY id", 2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(rows.Columns())
+	for rows.Next() {
+		fmt.Println(rows.Values()...)
+	}
+	// Output:
+	// [id score]
+	// 2 <nil>
+	// 3 1.25
+}
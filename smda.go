@@ -0,0 +1,233 @@
+// Package smda exposes smda as a library, so that it can be embedded in Go programs without
+// running its HTTP server. A database gets opened (or created) in a directory, datasets get
+// ingested from CSV/JSON readers and queried using SQL, results are iterated row by row.
+//
+// This is a thin layer over the database and query packages, it's meant to stay stable even as
+// those change. Programs needing more (e.g. S3 storage or the web UI) can use them directly.
+package smda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query"
+)
+
+var errNotTabular = errors.New("query does not return rows")
+var errScanNoRow = errors.New("Scan called without a row, call Next first")
+var errScanArgCount = errors.New("need a destination for each column")
+var errScanInvalidDest = errors.New("destinations need to be non-nil pointers")
+var errScanIncompatible = errors.New("cannot scan a value into a destination")
+
+// Config configures a new or reopened database (see database.Config for all the options)
+type Config = database.Config
+
+// IngestOptions determine how data are loaded - CSV dialect, null tokens, schema hints etc.
+// (see database.LoadOptions), the zero value infers all of these
+type IngestOptions = database.LoadOptions
+
+// Dataset is an immutable version of a named dataset, ingesting data into an existing name
+// creates a new version, queries refer to the latest one (unless pinned by `name@v...`)
+type Dataset = database.Dataset
+
+// DB is a database of datasets, it's safe for concurrent use
+type DB struct {
+	db       *database.Database
+	inMemory bool
+}
+
+// Open opens a database in a given directory, creating it if needed. An empty path opens an
+// in-memory database, nothing in it gets persisted.
+func Open(path string) (*DB, error) {
+	return OpenWithConfig(path, nil)
+}
+
+// OpenWithConfig is like Open, but it allows for configuring the database (stripe sizes,
+// compression, caching etc.), a nil config uses the defaults
+func OpenWithConfig(path string, config *Config) (*DB, error) {
+	var opts []database.Option
+	if path == "" {
+		opts = append(opts, database.InMemory())
+	}
+	db, err := database.NewDatabase(path, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db, inMemory: path == ""}, nil
+}
+
+// Database returns the underlying database, so that functionality not exposed here can be used
+func (db *DB) Database() *database.Database {
+	return db.db
+}
+
+// Close releases the data of in-memory databases, persisted databases stay on disk (and can be
+// reopened), including any rows still buffered for insertion
+func (db *DB) Close() error {
+	if db.inMemory {
+		return db.db.Drop()
+	}
+	return db.db.FlushAllInserts()
+}
+
+// Ingest loads data from a reader (CSV or JSON lines, optionally compressed) and stores them
+// as a new version of a dataset of a given name
+func (db *DB) Ingest(name string, r io.Reader, opts IngestOptions) (*Dataset, error) {
+	ds, err := db.db.LoadDatasetFromReaderAutoWithOptions(name, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.db.AddDataset(ds); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Query runs a SQL query, placeholders (`?`) get bound to given parameters, in order. All the
+// results are computed upfront, they are then iterated using Rows.
+func (db *DB) Query(ctx context.Context, sql string, params ...interface{}) (*Rows, error) {
+	res, err := query.RunSQLWithParams(ctx, db.db, sql, params...)
+	if err != nil {
+		return nil, err
+	}
+	if res.Plan != nil {
+		return nil, fmt.Errorf("%w: %v", errNotTabular, sql)
+	}
+	res.Materialise()
+	return &Rows{schema: res.Schema, data: res.Data, length: res.Length, pos: -1}, nil
+}
+
+// Rows is an iterator over the results of a query, it's not safe for concurrent use
+//
+//	rows, err := db.Query(ctx, "SELECT name, count() FROM people GROUP BY name")
+//	for rows.Next() {
+//		var name string
+//		var count int64
+//		if err := rows.Scan(&name, &count); err != nil { ... }
+//	}
+type Rows struct {
+	schema column.TableSchema
+	data   []*column.Chunk
+	length int
+	pos    int
+}
+
+// Columns returns the names of our columns
+func (rows *Rows) Columns() []string {
+	names := make([]string, 0, len(rows.schema))
+	for _, col := range rows.schema {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+// Schema returns the names, types and nullability of our columns
+func (rows *Rows) Schema() column.TableSchema {
+	return rows.schema
+}
+
+// Len returns the number of rows, regardless of how many have been iterated
+func (rows *Rows) Len() int {
+	return rows.length
+}
+
+// Next advances to the next row, it returns false once there are no more rows
+func (rows *Rows) Next() bool {
+	if rows.pos < rows.length {
+		rows.pos++
+	}
+	return rows.pos < rows.length
+}
+
+// Values returns all the values of the current row, as native Go types (see column.Chunk.Value),
+// nulls are nil
+func (rows *Rows) Values() []interface{} {
+	if rows.pos < 0 || rows.pos >= rows.length {
+		return nil
+	}
+	vals := make([]interface{}, len(rows.data))
+	for j, col := range rows.data {
+		vals[j], _ = col.Value(rows.pos)
+	}
+	return vals
+}
+
+// Scan copies the values of the current row into given pointers, one per column. A value can be
+// scanned into a pointer of its own type (see column.Chunk.Value), of a type it converts to (e.g.
+// an int64 into an int) or into an *interface{}. Nulls can only be scanned into pointers of
+// pointers (e.g. **int64, which then gets set to nil) or into *interface{}.
+func (rows *Rows) Scan(dest ...interface{}) error {
+	if rows.pos < 0 || rows.pos >= rows.length {
+		return errScanNoRow
+	}
+	if len(dest) != len(rows.data) {
+		return fmt.Errorf("%w: expected %v, got %v", errScanArgCount, len(rows.data), len(dest))
+	}
+	for j, col := range rows.data {
+		val, _ := col.Value(rows.pos)
+		if err := scanValue(val, dest[j]); err != nil {
+			return fmt.Errorf("column %v: %w", rows.schema[j].Name, err)
+		}
+	}
+	return nil
+}
+
+func scanValue(val interface{}, dest interface{}) error {
+	ptr := reflect.ValueOf(dest)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("%w: got %T", errScanInvalidDest, dest)
+	}
+	target := ptr.Elem()
+	if target.Kind() == reflect.Interface && target.NumMethod() == 0 {
+		if val == nil {
+			target.Set(reflect.Zero(target.Type()))
+		} else {
+			target.Set(reflect.ValueOf(val))
+		}
+		return nil
+	}
+	if target.Kind() == reflect.Ptr {
+		if val == nil {
+			target.Set(reflect.Zero(target.Type()))
+			return nil
+		}
+		target.Set(reflect.New(target.Type().Elem()))
+		target = target.Elem()
+	}
+	if val == nil {
+		return fmt.Errorf("%w: null into %T", errScanIncompatible, dest)
+	}
+	rval := reflect.ValueOf(val)
+	switch {
+	case rval.Type().AssignableTo(target.Type()):
+		target.Set(rval)
+	// only allow lossless numeric conversions, so that e.g. ints don't get converted to strings
+	// (as runes) and floats don't get truncated
+	case isInt(rval.Kind()) && isInt(target.Kind()) && !target.OverflowInt(rval.Int()):
+		target.SetInt(rval.Int())
+	case isInt(rval.Kind()) && isFloat(target.Kind()):
+		target.SetFloat(float64(rval.Int()))
+	case isFloat(rval.Kind()) && isFloat(target.Kind()):
+		target.SetFloat(rval.Float())
+	default:
+		return fmt.Errorf("%w: %T into %T", errScanIncompatible, val, dest)
+	}
+	return nil
+}
+
+func isInt(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isFloat(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
@@ -0,0 +1,137 @@
+package smda
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersistedDatabases(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := db.Ingest("foo", strings.NewReader("a;b\n1;x\n2;y"), IngestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Name != "foo" || ds.NRows != 2 {
+		t.Fatalf("unexpected dataset: %+v", ds)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query(context.Background(), "SELECT b FROM foo WHERE a = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() || rows.Values()[0] != "y" || rows.Next() {
+		t.Errorf("expecting a single row of a reopened database, got %v rows", rows.Len())
+	}
+}
+
+func TestIngestionErrors(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Ingest("foo", strings.NewReader("a,b\n1,2"), IngestOptions{SortKey: []string{"c"}})
+	if err == nil {
+		t.Error("expecting ingestion to fail for an invalid sort key")
+	}
+	if _, err := db.Query(context.Background(), "SELECT * FROM foo"); err == nil {
+		t.Error("expecting a failed ingestion not to create a dataset")
+	}
+}
+
+func TestScanningRows(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	raw := "id,name,score,born,ok\n1,Joe,1.5,2020-02-20,true\n2,Jane,,2021-03-04,false\n"
+	if _, err := db.Ingest("foo", strings.NewReader(raw), IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query(context.Background(), "SELECT id, name, score, born, ok FROM foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Scan(new(int)); !errors.Is(err, errScanNoRow) {
+		t.Errorf("expecting scanning before Next to fail, got %v", err)
+	}
+
+	var (
+		id    int32
+		name  string
+		score *float64
+		born  time.Time
+		ok    interface{}
+	)
+	if !rows.Next() {
+		t.Fatal("expecting a row")
+	}
+	if err := rows.Scan(&id, &name, &score, &born, &ok); err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || name != "Joe" || score == nil || *score != 1.5 || born != time.Date(2020, 2, 20, 0, 0, 0, 0, time.UTC) || ok != true {
+		t.Errorf("unexpected values scanned: %v, %v, %v, %v, %v", id, name, score, born, ok)
+	}
+	if !rows.Next() {
+		t.Fatal("expecting a second row")
+	}
+	if err := rows.Scan(&id, &name, &score, &born, &ok); err != nil {
+		t.Fatal(err)
+	}
+	if score != nil || ok != false {
+		t.Errorf("expecting a null to be scanned as a nil pointer, got %v", score)
+	}
+
+	var fscore float64
+	var sid string
+	var iscore int
+	failing := [][]interface{}{
+		{&id, &name},                              // too few destinations
+		{id, &name, &score, &born, &ok},           // not a pointer
+		{&id, &name, &fscore, &born, &ok},         // a null into a non-nullable destination
+		{&sid, &name, &score, &born, &ok},         // an int into a string
+		{&id, &name, &iscore, &born, &ok},         // a float into an int
+		{&id, &name, &score, &born, (*bool)(nil)}, // a nil pointer
+	}
+	for _, dest := range failing {
+		if err := rows.Scan(dest...); err == nil {
+			t.Errorf("expecting scanning into %T to fail", dest)
+		}
+	}
+	if rows.Next() || rows.Values() != nil {
+		t.Error("expecting rows to be exhausted")
+	}
+}
+
+func TestQueriesWithoutRows(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Ingest("foo", strings.NewReader("a\n1"), IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Query(context.Background(), "EXPLAIN SELECT a FROM foo"); !errors.Is(err, errNotTabular) {
+		t.Errorf("expecting query plans not to be iterable, got %v", err)
+	}
+	if _, err := db.Query(context.Background(), "SELECT b FROM foo"); err == nil {
+		t.Error("expecting a query of an unknown column to fail")
+	}
+}
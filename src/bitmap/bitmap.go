@@ -6,20 +6,34 @@ import (
 	"math/bits"
 )
 
-// Bitmap holds a series of boolean values, efficiently encoded as bits of uint64s
+// Bitmap holds a series of boolean values, efficiently encoded as bits of uint64s. There are always
+// just enough uint64s to hold `length` bits and bits beyond the length are always cleared, all
+// operations (including deserialisation) maintain this, so that callers can operate on whole words
+// (see Data) without masking the last one.
 type Bitmap struct {
-	data []uint64
-	cap  int
+	data   []uint64
+	length int
 }
 
-// Data returns a slice of the underlying bitmap data
+// Data returns a slice of the underlying bitmap data, bits beyond Len are guaranteed to be zero
 func (bm *Bitmap) Data() []uint64 {
 	return bm.data
 }
 
-// Cap returns the length of this bitmap (because the storage uints can have a higher capacity)
-func (bm *Bitmap) Cap() int {
-	return bm.cap
+// Len returns the number of bits in this bitmap (the storage uints can hold more)
+func (bm *Bitmap) Len() int {
+	return bm.length
+}
+
+func nwords(length int) int {
+	return (length + 63) / 64
+}
+
+// clearTail resets bits beyond our length (e.g. after inverting whole words)
+func (bm *Bitmap) clearTail() {
+	if rem := bm.length % 64; rem != 0 && bm.data[len(bm.data)-1]>>rem != 0 {
+		bm.data[len(bm.data)-1] &= (1 << rem) - 1
+	}
 }
 
 // Count returns the number of true values in a bitmap
@@ -31,40 +45,93 @@ func (bm *Bitmap) Count() int {
 	return ret
 }
 
-// KeepFirstN leaves only the first n bits set, resets the rest to zeroes
-// does not truncate the underlying storage - the cap is still the same - perhaps we should do this?
-// once we hit the n == count condition, we can discard the rest and lower the cap? will require a fair bit
+// Iterator walks over positions of set bits in a bitmap, see Bitmap.Iterator
+type Iterator struct {
+	data []uint64
+	word uint64 // bits of the current word we haven't visited yet
+	n    int    // index of the current word
+}
+
+// Iterator returns an iterator over positions of all the set bits (in ascending order). It scans
+// whole words and locates set bits by counting trailing zeroes, so sparse bitmaps get iterated
+// over in a fraction of the time it would take to Get each bit.
+func (bm *Bitmap) Iterator() Iterator {
+	return Iterator{data: bm.data, n: -1}
+}
+
+// Next returns the position of the next set bit, or -1 once there are none left
+func (it *Iterator) Next() int {
+	for it.word == 0 {
+		it.n++
+		if it.n >= len(it.data) {
+			return -1
+		}
+		it.word = it.data[it.n]
+	}
+	pos := 64*it.n + bits.TrailingZeros64(it.word)
+	it.word &= it.word - 1 // clears the lowest set bit
+	return pos
+}
+
+// KeepFirstN leaves only the first n bits set, resets the rest to zeroes, and returns the number
+// of bits left set (n at most), all in one pass - so callers need not Count beforehand
+// does not truncate the underlying storage - the length is still the same - perhaps we should do this?
+// once we hit the n == count condition, we can discard the rest and lower the length? will require a fair bit
 // of testing, but should be doable
-func (bm *Bitmap) KeepFirstN(n int) {
+func (bm *Bitmap) KeepFirstN(n int) int {
 	if n < 0 {
 		panic("disallowed value")
 	}
-	if n >= bm.Count() {
-		return
-	}
+	kept := 0
 	for j, el := range bm.data {
-		if n <= 0 {
+		if kept == n {
 			bm.data[j] = 0
 			continue
 		}
 		count := bits.OnesCount64(el)
-		if count > n {
-			for b := 63; b > 0; b-- {
-				bm.data[j] &= (1 << b) - 1
-				if bits.OnesCount64(bm.data[j]) == n {
-					break
-				}
+		if kept+count > n {
+			// clear the highest set bits until we only have as many as we need
+			for extra := kept + count - n; extra > 0; extra-- {
+				el &^= 1 << (63 - bits.LeadingZeros64(el))
 			}
+			bm.data[j] = el
+			count = n - kept
+		}
+		kept += count
+	}
+	return kept
+}
+
+// SetRange sets all the bits in [start, end), word by word, the bitmap grows if need be
+func (bm *Bitmap) SetRange(start, end int) {
+	if start >= end {
+		return
+	}
+	bm.Ensure(end)
+	first, last := start/64, (end-1)/64
+	for j := first; j <= last; j++ {
+		word := ^uint64(0)
+		if j == first {
+			word &^= (1 << (start % 64)) - 1
 		}
-		n -= count
+		if j == last && end%64 != 0 {
+			word &= (1 << (end % 64)) - 1
+		}
+		bm.data[j] |= word
 	}
 }
 
 // Append adds data from an incoming bitmap to this bitmap (in place modification)
 func (bm *Bitmap) Append(obm *Bitmap) {
-	cap := bm.cap
-	for j := 0; j < obm.cap; j++ {
-		bm.Set(cap+j, obm.Get(j))
+	offset := bm.length
+	bm.Ensure(offset + obm.length)
+	shift := offset % 64
+	// the other bitmap's words get shifted into place, our tail is clear, so we can just OR them in
+	for j, word := range obm.data {
+		bm.data[offset/64+j] |= word << shift
+		if shift > 0 && offset/64+j+1 < len(bm.data) {
+			bm.data[offset/64+j+1] |= word >> (64 - shift)
+		}
 	}
 }
 
@@ -73,8 +140,8 @@ func (bm *Bitmap) Clone() *Bitmap {
 	data := make([]uint64, len(bm.data))
 	copy(data, bm.data)
 	return &Bitmap{
-		data: data,
-		cap:  bm.cap,
+		data:   data,
+		length: bm.length,
 	}
 }
 
@@ -87,7 +154,7 @@ func Clone(bm *Bitmap) *Bitmap {
 
 // AndNot modified this bitmap in place by executing &^ on each element
 func (bm *Bitmap) AndNot(obm *Bitmap) {
-	if bm.cap != obm.cap {
+	if bm.length != obm.length {
 		panic("cannot &^ two not aligned bitmaps")
 	}
 
@@ -101,7 +168,7 @@ func (bm *Bitmap) Or(obm *Bitmap) {
 	if obm == nil {
 		return
 	}
-	if bm.cap != obm.cap {
+	if bm.length != obm.length {
 		panic("cannot OR two not aligned bitmaps")
 	}
 
@@ -126,17 +193,34 @@ func Or(bm1 *Bitmap, bm2 *Bitmap) *Bitmap {
 	return bm
 }
 
-// Ensure makes sure we have at least n capacity in this bitmap (e.g. so that .Get works)
+// AndNotCount returns a copy of bm1 without the bits set in bm2 (a &^ b, a nil bm2 clears nothing)
+// along with the number of bits left set, in a single pass - unlike cloning, subtracting and
+// counting, which traverses the data three times
+func AndNotCount(bm1 *Bitmap, bm2 *Bitmap) (*Bitmap, int) {
+	if bm2 != nil && bm1.length != bm2.length {
+		panic("cannot &^ two not aligned bitmaps")
+	}
+	data := make([]uint64, len(bm1.data))
+	count := 0
+	for j, el := range bm1.data {
+		if bm2 != nil {
+			el &^= bm2.data[j]
+		}
+		data[j] = el
+		count += bits.OnesCount64(el)
+	}
+	return &Bitmap{data: data, length: bm1.length}, count
+}
+
+// Ensure makes sure this bitmap is at least n bits long, new bits are all zeroes
 func (bm *Bitmap) Ensure(n int) {
-	if bm.data != nil && n <= bm.cap {
+	if bm.data != nil && n <= bm.length {
 		return
 	}
-	if n > bm.cap {
-		bm.cap = n
+	if n > bm.length {
+		bm.length = n
 	}
-	nvals := (n + 63) / 64
-	nvals -= len(bm.data)
-	bm.data = append(bm.data, make([]uint64, nvals)...)
+	bm.data = append(bm.data, make([]uint64, nwords(bm.length)-len(bm.data))...)
 }
 
 // NewBitmap allocates a bitmap to hold at least n values
@@ -156,11 +240,16 @@ func NewBitmapFromBools(data []bool) *Bitmap {
 }
 
 // NewBitmapFromBits leverages a pre-existing bitmap (usually from a file or a reader) and moves
-// it into a new bitmap (does NOT copy)
+// it into a new bitmap (does NOT copy), words beyond `length` get dropped or added (if there are
+// too few of them) and bits beyond it cleared
 func NewBitmapFromBits(data []uint64, length int) *Bitmap {
-	bm := &Bitmap{}
-	bm.cap = length
-	bm.data = data
+	if n := nwords(length); len(data) > n {
+		data = data[:n]
+	} else if len(data) < n {
+		data = append(data, make([]uint64, n-len(data))...)
+	}
+	bm := &Bitmap{data: data, length: length}
+	bm.clearTail()
 	return bm
 }
 
@@ -174,38 +263,37 @@ func (bm *Bitmap) Set(n int, val bool) {
 	}
 }
 
-// Get returns nth bit as a boolean (true for 1, false for 0)
+// Get returns nth bit as a boolean (true for 1, false for 0), bits beyond our length are all false
+// (the bitmap doesn't grow, so that concurrent reads are safe)
 func (bm *Bitmap) Get(n int) bool {
-	// OPTIM: this will always escape to the heap, so it's an inlining blocker
-	//        maybe make sure the bitmap is long enough some other place and leave this to be just a return
-	bm.Ensure(n + 1) // to avoid panics?
+	if n >= bm.length {
+		return false
+	}
 	return (bm.data[n/64] & uint64(1<<(n%64))) > 0
 }
 
-// Invert flips all the bits in this bitmap
+// Invert flips all the bits in this bitmap (but not those beyond its length)
 func (bm *Bitmap) Invert() {
 	for j, el := range bm.data {
 		bm.data[j] = ^el
 	}
-	// not sure about the bm.cap > 0 - what if we invert an empty bitmap?
-	if bm.cap > 0 && bm.cap%64 != 0 {
-		bm.data[len(bm.data)-1] &= (1 << (bm.cap % 64)) - 1
-	}
+	bm.clearTail()
 }
 
 // Serialize writes this bitmap into a writer, so that it can be deserialised later
 func Serialize(w io.Writer, bm *Bitmap) (int, error) {
-	if bm == nil {
+	// empty bitmaps get deserialised as nils, so they are serialised as such
+	if bm == nil || bm.length == 0 {
 		if err := binary.Write(w, binary.LittleEndian, uint32(0)); err != nil {
 			return 0, err
 		}
 		return 4, nil
 	}
-	cap := uint32(bm.cap)
-	if err := binary.Write(w, binary.LittleEndian, cap); err != nil {
+	length := uint32(bm.length)
+	if err := binary.Write(w, binary.LittleEndian, length); err != nil {
 		return 0, err
 	}
-	// OPTIM: we could calculate nelements from the cap (integer division and modulo)
+	// OPTIM: we could calculate nelements from the length (integer division and modulo)
 	nelements := uint32(len(bm.data))
 	if err := binary.Write(w, binary.LittleEndian, nelements); err != nil {
 		return 0, err
@@ -215,11 +303,11 @@ func Serialize(w io.Writer, bm *Bitmap) (int, error) {
 
 // DeserializeBitmapFromReader is the inverse of Serialize
 func DeserializeBitmapFromReader(r io.Reader) (*Bitmap, error) {
-	var cap uint32
-	if err := binary.Read(r, binary.LittleEndian, &cap); err != nil {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return nil, err
 	}
-	if cap == 0 {
+	if length == 0 {
 		return nil, nil
 	}
 	var nelements uint32
@@ -231,6 +319,7 @@ func DeserializeBitmapFromReader(r io.Reader) (*Bitmap, error) {
 	if err := binary.Read(r, binary.LittleEndian, &data); err != nil {
 		return nil, err
 	}
-	bitmap := NewBitmapFromBits(data, int(cap))
+	// older files may have bits set beyond the length (or extra words), these get cleaned up here
+	bitmap := NewBitmapFromBits(data, int(length))
 	return bitmap, nil
 }
@@ -2,6 +2,9 @@ package bitmap
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
 	"math/bits"
 	"math/rand"
 	"reflect"
@@ -63,10 +66,10 @@ func TestBitmapData(t *testing.T) {
 	}
 }
 
-func TestBitmapCap(t *testing.T) {
+func TestBitmapLen(t *testing.T) {
 	tests := []struct {
 		bm     *Bitmap
-		expCap int
+		expLen int
 	}{
 		{NewBitmap(0), 0},
 		{NewBitmap(10), 10},
@@ -74,19 +77,19 @@ func TestBitmapCap(t *testing.T) {
 	}
 
 	for j, test := range tests {
-		if test.bm.Cap() != test.expCap {
-			t.Errorf("expecting bitmap %d to have capacity of %d, got %d instead", j, test.expCap, test.bm.Cap())
+		if test.bm.Len() != test.expLen {
+			t.Errorf("expecting bitmap %d to have length of %d, got %d instead", j, test.expLen, test.bm.Len())
 		}
 	}
 }
 
-func TestBitmapCapSet(t *testing.T) {
+func TestBitmapLenSet(t *testing.T) {
 	bm := NewBitmap(0)
 
 	for _, newpos := range []int{10, 64, 65, 100, 128, 1000, 10000} {
 		bm.Set(newpos, true)
-		if bm.Cap() != newpos+1 {
-			t.Errorf("after setting position %d, we'd expect the cap to be the same, but got %d instead", newpos, bm.Cap())
+		if bm.Len() != newpos+1 {
+			t.Errorf("after setting position %d, we'd expect the length to be the same, but got %d instead", newpos, bm.Len())
 		}
 	}
 }
@@ -142,14 +145,14 @@ func TestBitmapCloning(t *testing.T) {
 	rand.Seed(0)
 
 	for j := 0; j < 100; j++ {
-		bm1.Set(rand.Intn(bm1.Cap()), true)
+		bm1.Set(rand.Intn(bm1.Len()), true)
 	}
 	bm2 = bm1.Clone()
 	bm3 = Clone(bm1)
 	c2 := bm2.Count()
 	c3 := bm3.Count()
 	for j := 0; j < 100; j++ {
-		bm1.Set(rand.Intn(bm1.Cap()), true)
+		bm1.Set(rand.Intn(bm1.Len()), true)
 	}
 	if bm2.Count() != c2 {
 		t.Errorf("expecting a cloned bitmap not to be affected by changes to the original bitmap")
@@ -210,23 +213,21 @@ func TestKeepingFirstN(t *testing.T) {
 	raw := []bool{true, true, false, true, false, true}
 	for j := 0; j < NewBitmapFromBools(raw).Count(); j++ {
 		bm := NewBitmapFromBools(raw)
-		bm.KeepFirstN(j)
-		if bm.Count() != j {
-			t.Errorf("expecting truncating to %+v to keep that many values, got %+v", j, bm.Count())
+		if kept := bm.KeepFirstN(j); kept != j || bm.Count() != j {
+			t.Errorf("expecting truncating to %+v to keep that many values, got %+v (reported %v)", j, bm.Count(), kept)
 		}
-		if len(raw) != bm.cap {
-			t.Errorf("not expecting the length of the bitmap to change after KeepFirstN, got %+v from %+v", bm.cap, len(raw))
+		if len(raw) != bm.length {
+			t.Errorf("not expecting the length of the bitmap to change after KeepFirstN, got %+v from %+v", bm.length, len(raw))
 		}
 	}
 	// if we tell it to keep more values then there are, it will just keep them all
 	for j := NewBitmapFromBools(raw).Count(); j < NewBitmapFromBools(raw).Count()*2; j++ {
 		bm := NewBitmapFromBools(raw)
-		bm.KeepFirstN(j)
-		if bm.Count() > j {
-			t.Errorf("expecting truncating to %+v to keep that many values, got %+v", j, bm.Count())
+		if kept := bm.KeepFirstN(j); kept != bm.Count() || bm.Count() > j {
+			t.Errorf("expecting truncating to %+v to keep that many values, got %+v (reported %v)", j, bm.Count(), kept)
 		}
-		if len(raw) != bm.cap {
-			t.Errorf("not expecting the length of the bitmap to change after KeepFirstN, got %+v from %+v", bm.cap, len(raw))
+		if len(raw) != bm.length {
+			t.Errorf("not expecting the length of the bitmap to change after KeepFirstN, got %+v from %+v", bm.length, len(raw))
 		}
 	}
 }
@@ -244,6 +245,60 @@ func TestKeepingFirstNBurning(t *testing.T) {
 	}
 }
 
+// bits get cleared from the top of each word, so this crosses word boundaries
+func TestKeepingFirstNWords(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	raw := make([]bool, 300)
+	for j := range raw {
+		raw[j] = rnd.Intn(3) > 0
+	}
+	for n := 0; n < len(raw); n += 7 {
+		bm := NewBitmapFromBools(raw)
+		kept := bm.KeepFirstN(n)
+		seen := 0
+		for j, val := range raw {
+			expected := val && seen < n
+			if val {
+				seen++
+			}
+			if bm.Get(j) != expected {
+				t.Errorf("keeping first %v bits, expecting bit %v to be %v", n, j, expected)
+			}
+		}
+		if kept != bm.Count() {
+			t.Errorf("keeping first %v bits, reported %v kept, got %v", n, kept, bm.Count())
+		}
+	}
+}
+
+func TestSettingRanges(t *testing.T) {
+	tests := []struct {
+		length, start, end int
+	}{
+		{10, 0, 0},
+		{10, 3, 2},
+		{10, 0, 10},
+		{10, 2, 5},
+		{64, 0, 64},
+		{64, 63, 64},
+		{200, 60, 70},
+		{200, 64, 128},
+		{200, 1, 199},
+		{0, 5, 130}, // grows the bitmap
+	}
+	for _, test := range tests {
+		bm := NewBitmap(test.length)
+		bm.SetRange(test.start, test.end)
+		expected := NewBitmap(test.length)
+		for j := test.start; j < test.end; j++ {
+			expected.Set(j, true)
+		}
+		if !reflect.DeepEqual(bm, expected) {
+			t.Errorf("setting [%v, %v) in %v bits, expecting %+v, got %+v", test.start, test.end, test.length, expected, bm)
+		}
+	}
+}
+
 func TestBitmapAppending(t *testing.T) {
 	tests := []struct {
 		a, b, res []bool
@@ -266,6 +321,81 @@ func TestBitmapAppending(t *testing.T) {
 	}
 }
 
+func TestBitmapAppendingUnaligned(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	for _, lengths := range [][2]int{{0, 1}, {1, 63}, {63, 2}, {64, 64}, {65, 130}, {100, 1}, {127, 1000}} {
+		a := make([]bool, lengths[0])
+		b := make([]bool, lengths[1])
+		for j := range a {
+			a[j] = rnd.Intn(2) == 0
+		}
+		for j := range b {
+			b[j] = rnd.Intn(2) == 0
+		}
+		bm := NewBitmapFromBools(a)
+		bm.Append(NewBitmapFromBools(b))
+		expected := NewBitmapFromBools(append(a, b...))
+		if !reflect.DeepEqual(bm, expected) {
+			t.Errorf("could not append %v bits to %v bits", lengths[1], lengths[0])
+		}
+	}
+}
+
+// bits beyond a bitmap's length are cleared after all operations, so that whole words can be
+// compared and counted
+func TestBitmapTrailingBits(t *testing.T) {
+	clean := func(bm *Bitmap) bool {
+		if len(bm.data) != (bm.length+63)/64 {
+			return false
+		}
+		rem := bm.length % 64
+		return rem == 0 || bm.data[len(bm.data)-1]>>rem == 0
+	}
+	inverted := NewBitmap(70)
+	inverted.Invert()
+	appended := NewBitmap(3)
+	appended.Invert()
+	appended.Append(inverted)
+	truncated := NewBitmapFromBits([]uint64{math.MaxUint64, math.MaxUint64, math.MaxUint64}, 65)
+	extended := NewBitmapFromBits([]uint64{math.MaxUint64}, 130)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, []uint32{10, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, []uint64{math.MaxUint64, math.MaxUint64}); err != nil {
+		t.Fatal(err)
+	}
+	deserialised, err := DeserializeBitmapFromReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		bm    *Bitmap
+		count int
+	}{
+		{"inverted", inverted, 70},
+		{"appended", appended, 73},
+		{"truncated", truncated, 65},
+		{"extended", extended, 64},
+		{"deserialised", deserialised, 10},
+	} {
+		if !clean(test.bm) {
+			t.Errorf("expecting a %v bitmap to have its trailing bits cleared, got %b (length %v)", test.name, test.bm.data, test.bm.length)
+		}
+		if test.bm.Count() != test.count {
+			t.Errorf("expecting a %v bitmap to have %v bits set, got %v", test.name, test.count, test.bm.Count())
+		}
+	}
+
+	// reading beyond the length doesn't grow the bitmap
+	if inverted.Get(1000) || inverted.Len() != 70 {
+		t.Errorf("not expecting reads beyond the length to be true or to change it, got %v", inverted.Len())
+	}
+}
+
 func TestOr(t *testing.T) {
 	tests := []struct {
 		a, b, exp []bool
@@ -308,6 +438,31 @@ func TestOr(t *testing.T) {
 	}
 }
 
+func TestAndNotCount(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	for _, length := range []int{0, 1, 63, 64, 65, 300} {
+		a, b := make([]bool, length), make([]bool, length)
+		for j := 0; j < length; j++ {
+			a[j], b[j] = rnd.Intn(2) > 0, rnd.Intn(2) > 0
+		}
+		ba, bb := NewBitmapFromBools(a), NewBitmapFromBools(b)
+		expected := ba.Clone()
+		expected.AndNot(bb)
+
+		got, count := AndNotCount(ba, bb)
+		if !reflect.DeepEqual(got, expected) || count != expected.Count() {
+			t.Errorf("expecting %+v &^ %+v to result in %+v (%v set), got %+v (%v)", a, b, expected, expected.Count(), got, count)
+		}
+		if !reflect.DeepEqual(ba, NewBitmapFromBools(a)) {
+			t.Errorf("not expecting AndNotCount to modify its inputs")
+		}
+		got, count = AndNotCount(ba, nil)
+		if !reflect.DeepEqual(got, ba.Clone()) || count != ba.Count() {
+			t.Errorf("expecting AndNotCount without a subtrahend to clone %+v, got %+v (%v)", ba, got, count)
+		}
+	}
+}
+
 // func NewBitmap(n int) *bitmap {
 // func NewBitmapFromBools(data []bool) *bitmap {
 // func (bm *Bitmap) Count() int {
@@ -319,3 +474,81 @@ func TestOr(t *testing.T) {
 // invert - testing inverting an empty bitmap
 // AndNot
 // Or - both receiver and function
+
+func TestBitmapIterator(t *testing.T) {
+	tests := []struct {
+		positions []int
+		cap       int
+	}{
+		{nil, 0},
+		{nil, 1000},
+		{[]int{0}, 1},
+		{[]int{63, 64, 65}, 100},
+		{[]int{0, 1, 2, 127, 128, 999}, 1000},
+	}
+	for _, test := range tests {
+		bm := NewBitmap(test.cap)
+		for _, pos := range test.positions {
+			bm.Set(pos, true)
+		}
+		var got []int
+		it := bm.Iterator()
+		for j := it.Next(); j != -1; j = it.Next() {
+			got = append(got, j)
+		}
+		if !reflect.DeepEqual(got, test.positions) {
+			t.Errorf("expecting to iterate over %v, got %v", test.positions, got)
+		}
+		if j := it.Next(); j != -1 {
+			t.Errorf("expecting an exhausted iterator to stay exhausted, got %v", j)
+		}
+	}
+
+	// bits beyond the bitmap's length get cleared, so they don't get iterated over
+	bm := NewBitmapFromBits([]uint64{1<<2 | 1<<40}, 10)
+	it := bm.Iterator()
+	if j1, j2 := it.Next(), it.Next(); j1 != 2 || j2 != -1 {
+		t.Errorf("expecting only bits within the bitmap's length to be iterated over, got %v and %v", j1, j2)
+	}
+
+	// all set bits get visited, including full words
+	for _, n := range []int{1, 63, 64, 65, 1000} {
+		bm := NewBitmap(n)
+		bm.Invert()
+		count := 0
+		it := bm.Iterator()
+		for j := it.Next(); j != -1; j = it.Next() {
+			if j != count {
+				t.Fatalf("expecting position %v, got %v", count, j)
+			}
+			count++
+		}
+		if count != n {
+			t.Errorf("expecting %v set bits to be visited, got %v", n, count)
+		}
+	}
+}
+
+func BenchmarkBitmapIterator(b *testing.B) {
+	n := 100_000
+	for _, density := range []int{10, 1000} {
+		bm := NewBitmap(n)
+		for j := 0; j < n; j += n / density {
+			bm.Set(j, true)
+		}
+		b.Run(fmt.Sprintf("iterator-%v", density), func(b *testing.B) {
+			for k := 0; k < b.N; k++ {
+				it := bm.Iterator()
+				for j := it.Next(); j != -1; j = it.Next() {
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("gets-%v", density), func(b *testing.B) {
+			for k := 0; k < b.N; k++ {
+				for j := 0; j < n; j++ {
+					_ = bm.Get(j)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errInvalidFilter = errors.New("invalid bloom filter data")
+
+// bits per item and the number of hash functions, these give us a false positive rate of about 1%
+const (
+	bitsPerItem = 10
+	numHashes   = 7
+)
+
+// Filter is a bloom filter of 64-bit hashes, it can tell us that a value was definitely not
+// added to it, but it may wrongly report that a value was added (a false positive)
+// Hashes need to be well distributed, since we derive all the bit positions from a single hash
+// (see Kirsch and Mitzenmacher, Less Hashing, Same Performance)
+type Filter struct {
+	data []uint64
+	k    int
+}
+
+// NewFilter creates a filter sized for a given number of items
+func NewFilter(nitems int) *Filter {
+	nwords := (nitems*bitsPerItem + 63) / 64
+	if nwords == 0 {
+		nwords = 1
+	}
+	return &Filter{data: make([]uint64, nwords), k: numHashes}
+}
+
+func (f *Filter) positions(hash uint64, fn func(pos uint64)) {
+	nbits := uint64(64 * len(f.data))
+	h1, h2 := hash&(1<<32-1), hash>>32
+	for j := 0; j < f.k; j++ {
+		fn((h1 + uint64(j)*h2) % nbits)
+	}
+}
+
+// Add adds a hash of a value to the filter
+func (f *Filter) Add(hash uint64) {
+	f.positions(hash, func(pos uint64) {
+		f.data[pos/64] |= 1 << (pos % 64)
+	})
+}
+
+// MayContain reports if a hash may have been added to the filter, false means it definitely
+// has not been added
+func (f *Filter) MayContain(hash uint64) bool {
+	contains := true
+	f.positions(hash, func(pos uint64) {
+		contains = contains && f.data[pos/64]&(1<<(pos%64)) > 0
+	})
+	return contains
+}
+
+// Bytes serialises the filter (the number of hash functions followed by its bits)
+func (f *Filter) Bytes() []byte {
+	ret := make([]byte, 1+8*len(f.data))
+	ret[0] = byte(f.k)
+	for j, word := range f.data {
+		binary.LittleEndian.PutUint64(ret[1+8*j:], word)
+	}
+	return ret
+}
+
+// FromBytes deserialises a filter serialised by Bytes
+func FromBytes(data []byte) (*Filter, error) {
+	if len(data) < 9 || (len(data)-1)%8 != 0 || data[0] == 0 {
+		return nil, errInvalidFilter
+	}
+	f := &Filter{data: make([]uint64, (len(data)-1)/8), k: int(data[0])}
+	for j := range f.data {
+		f.data[j] = binary.LittleEndian.Uint64(data[1+8*j:])
+	}
+	return f, nil
+}
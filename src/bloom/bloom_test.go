@@ -0,0 +1,51 @@
+package bloom
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"testing"
+)
+
+func hashOf(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func TestFilters(t *testing.T) {
+	for _, nitems := range []int{0, 1, 10, 1000, 100_000} {
+		f := NewFilter(nitems)
+		for j := 0; j < nitems; j++ {
+			f.Add(hashOf(strconv.Itoa(j)))
+		}
+		roundtrip, err := FromBytes(f.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// no false negatives
+		for j := 0; j < nitems; j++ {
+			if !roundtrip.MayContain(hashOf(strconv.Itoa(j))) {
+				t.Fatalf("expecting %v to be in a filter of %v items", j, nitems)
+			}
+		}
+		falsePositives := 0
+		for j := 0; j < 10_000; j++ {
+			if roundtrip.MayContain(hashOf("x" + strconv.Itoa(j))) {
+				falsePositives++
+			}
+		}
+		if nitems > 0 && falsePositives > 300 {
+			t.Errorf("expecting a false positive rate of about 1%% for %v items, got %v/10000", nitems, falsePositives)
+		}
+	}
+}
+
+func TestInvalidFilters(t *testing.T) {
+	tests := [][]byte{nil, {7}, {7, 1, 2, 3}, make([]byte, 9)}
+	for _, test := range tests {
+		if _, err := FromBytes(test); !errors.Is(err, errInvalidFilter) {
+			t.Errorf("expecting %v not to deserialise, got %v", test, err)
+		}
+	}
+}
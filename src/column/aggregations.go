@@ -1,28 +1,48 @@
 package column
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"math"
 
 	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errInvalidAggregation = errors.New("aggregation does not exist")
+var errInvalidAggregation = errs.New(errs.ErrBadRequest, "aggregation does not exist")
+var errInvalidQuantile = errs.New(errs.ErrBadRequest, "quantiles need to be between 0 and 1")
+var errCannotMerge = errors.New("partial states of this aggregation cannot be merged")
+var errMergeMismatch = errors.New("cannot merge states of different aggregations")
+var errNotSerialisable = errors.New("only states of approximate distinct counts can be serialised")
+var errInvalidState = errors.New("invalid serialisation of an aggregation state")
 
+// AggState is the state of an aggregating function - it gets updated by chunks of data (AddChunk),
+// partial states (e.g. of different stripes) can be combined (Merge) and the final values resolved
+// (Resolve). Values are aggregated into groups, which are identified by their positions (buckets).
 type AggState struct {
+	function  string
 	inputType Dtype
 	ints      []int64
 	floats    []float64
 	strings   []string
 	dates     []date
 	datetimes []datetime
+	decimals  []decimal
 	counts    []int64
 	distinct  bool
 	seen      []map[uint64]bool
+	moments   []moments // variances and standard deviations
+	digests   []*digest // percentiles
+	sketches  []*Sketch // approximate distinct counts
+	quantile  float64
+	err       error // updaters cannot return errors (e.g. decimal overflows), so we collect them here
+	mergeable bool
 	AddChunk  func(buckets []uint64, ndistinct int, data *Chunk)
-	Resolve   func() (*Chunk, error)
+	// Merge folds another state of the same aggregation into this one, group by group, the other
+	// state must not be used afterwards (see Mergeable)
+	Merge   func(other *AggState) error
+	Resolve func() (*Chunk, error)
 }
 
 // how will we update the state given a value
@@ -31,6 +51,7 @@ type updateFuncs struct {
 	floats    func(state *AggState, value float64, position uint64)
 	dates     func(state *AggState, value date, position uint64)
 	datetimes func(state *AggState, value datetime, position uint64)
+	decimals  func(state *AggState, value decimal, position uint64)
 	strings   func(state *AggState, value string, position uint64)
 }
 
@@ -43,6 +64,7 @@ type resolveFuncs struct {
 	floats    resolveFunc
 	dates     resolveFunc
 	datetimes resolveFunc
+	decimals  resolveFunc
 	strings   resolveFunc
 }
 
@@ -73,6 +95,15 @@ var genericResolvers = resolveFuncs{
 			return newChunkDatetimesFromSlice(agg.datetimes, bm), nil
 		}
 	},
+	decimals: func(agg *AggState) func() (*Chunk, error) {
+		return func() (*Chunk, error) {
+			if agg.err != nil {
+				return nil, agg.err
+			}
+			bm := bitmapFromCounts(agg.counts)
+			return newChunkDecimalsFromSlice(agg.decimals, bm), nil
+		}
+	},
 	strings: func(agg *AggState) func() (*Chunk, error) {
 		return func() (*Chunk, error) {
 			bm := bitmapFromCounts(agg.counts)
@@ -81,22 +112,394 @@ var genericResolvers = resolveFuncs{
 	},
 }
 
+func nullResolver(agg *AggState) func() (*Chunk, error) {
+	return func() (*Chunk, error) {
+		return NewChunkLiteralTyped("", DtypeNull, len(agg.counts))
+	}
+}
+
+func decimalSummer(agg *AggState, val decimal, pos uint64) {
+	// a zero value has a zero scale, so it's a valid starting point for our sums
+	sum, ok := decimalsAdd(agg.decimals[pos], val)
+	if !ok {
+		agg.err = errDecimalOverflow
+		return
+	}
+	agg.decimals[pos] = sum
+}
+
+// moments are running statistics of a group of values, updated using Welford's algorithm,
+// which is numerically stable (unlike summing squares and squaring sums)
+type moments struct {
+	n    float64
+	mean float64
+	m2   float64 // sum of squared deviations from the mean
+}
+
+func (m *moments) add(val float64) {
+	m.n++
+	delta := val - m.mean
+	m.mean += delta / m.n
+	m.m2 += delta * (val - m.mean)
+}
+
+// merge combines two partial states (Chan et al.), so that we can aggregate chunks independently
+func (m *moments) merge(other moments) {
+	if other.n == 0 {
+		return
+	}
+	if m.n == 0 {
+		*m = other
+		return
+	}
+	n := m.n + other.n
+	delta := other.mean - m.mean
+	m.mean += delta * other.n / n
+	m.m2 += other.m2 + delta*delta*m.n*other.n/n
+	m.n = n
+}
+
+// statisticsUpdaters feed numeric values into moments or digests, these always go into partial states
+// (see twoPhaseAdder), which are presized, so we don't need to ensure their lengths here
+func statisticsUpdaters(update func(agg *AggState, val float64, pos uint64)) updateFuncs {
+	return updateFuncs{
+		ints: func(agg *AggState, val int64, pos uint64) {
+			update(agg, float64(val), pos)
+		},
+		floats: update,
+		decimals: func(agg *AggState, val decimal, pos uint64) {
+			update(agg, val.Float(), pos)
+		},
+	}
+}
+
+func updateMoments(agg *AggState, val float64, pos uint64) {
+	agg.moments[pos].add(val)
+}
+
+func updateDigests(agg *AggState, val float64, pos uint64) {
+	if agg.digests[pos] == nil {
+		agg.digests[pos] = &digest{}
+	}
+	agg.digests[pos].add(val)
+}
+
+// statisticsResolvers produce floats for all numeric inputs, a NULL is returned wherever
+// the resolver can't produce a value (e.g. sample variance of a single value)
+func statisticsResolvers(resolve func(agg *AggState, pos int) (float64, bool)) resolveFuncs {
+	resolver := func(agg *AggState) func() (*Chunk, error) {
+		return func() (*Chunk, error) {
+			vals := make([]float64, len(agg.counts))
+			var bm *bitmap.Bitmap
+			for j := range vals {
+				val, ok := resolve(agg, j)
+				if !ok {
+					if bm == nil {
+						bm = bitmap.NewBitmap(len(vals))
+					}
+					bm.Set(j, true)
+					continue
+				}
+				vals[j] = val
+			}
+			return NewChunkFloatsFromSlice(vals, bm), nil
+		}
+	}
+	return resolveFuncs{ints: resolver, floats: resolver, decimals: resolver}
+}
+
+func varianceResolver(sample, root bool) resolveFuncs {
+	return statisticsResolvers(func(agg *AggState, pos int) (float64, bool) {
+		m := agg.moments[pos]
+		denom := m.n
+		if sample {
+			denom--
+		}
+		if denom <= 0 {
+			return 0, false
+		}
+		if root {
+			return math.Sqrt(m.m2 / denom), true
+		}
+		return m.m2 / denom, true
+	})
+}
+
+var percentileResolvers = statisticsResolvers(func(agg *AggState, pos int) (float64, bool) {
+	if agg.digests[pos] == nil {
+		return 0, false
+	}
+	return agg.digests[pos].quantile(agg.quantile), true
+})
+
+// twoPhaseAdder aggregates each chunk into a fresh partial state, which then gets merged into
+// the overall state. This is how statistical aggregations get updated (their states merge well).
+// The same merging is used to combine partial states of whole aggregations (see merger).
+func twoPhaseAdder(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk), error) {
+	partial := &AggState{inputType: agg.inputType, distinct: agg.distinct}
+	adder, err := adderFactory(partial, upd)
+	if err != nil {
+		return nil, err
+	}
+	return func(buckets []uint64, ndistinct int, data *Chunk) {
+		partial.counts = nil
+		partial.moments = make([]moments, ndistinct)
+		partial.digests = make([]*digest, ndistinct)
+		// DISTINCT needs to know about values seen in all previous chunks
+		partial.seen = agg.seen
+		adder(buckets, ndistinct, data)
+		agg.seen = partial.seen
+
+		mergeStatistics(agg, partial, ndistinct)
+	}, nil
+}
+
+// mergeStatistics folds the first n groups of a partial state of a statistical aggregation
+// (moments or digests) into an overall state
+func mergeStatistics(agg, partial *AggState, n int) {
+	agg.counts = ensureLengthInts(agg.counts, n)
+	for len(agg.moments) < n {
+		agg.moments = append(agg.moments, moments{})
+	}
+	for len(agg.digests) < n {
+		agg.digests = append(agg.digests, nil)
+	}
+	for j := 0; j < n; j++ {
+		agg.counts[j] += partial.counts[j]
+		agg.moments[j].merge(partial.moments[j])
+		if partial.digests[j] == nil {
+			continue
+		}
+		if agg.digests[j] == nil {
+			agg.digests[j] = partial.digests[j]
+			continue
+		}
+		agg.digests[j].merge(partial.digests[j])
+	}
+}
+
+// sketchAdder feeds hashes of incoming values into sketches, one per group, these are approximate
+// distinct counts, so the DISTINCT keyword doesn't change anything here
+func sketchAdder(agg *AggState, _ updateFuncs) (func([]uint64, int, *Chunk), error) {
+	return func(buckets []uint64, ndistinct int, data *Chunk) {
+		agg.counts = ensureLengthInts(agg.counts, ndistinct)
+		agg.sketches = ensureLengthSketches(agg.sketches, ndistinct)
+		if data.dtype == DtypeNull {
+			return
+		}
+		hashes := make([]uint64, len(buckets))
+		data.Hash(0, hashes)
+		for j, hash := range hashes {
+			if data.Nullability != nil && data.Nullability.Get(j) {
+				continue
+			}
+			pos := buckets[j]
+			if agg.sketches[pos] == nil {
+				agg.sketches[pos] = NewSketch()
+			}
+			agg.sketches[pos].Add(hash)
+			agg.counts[pos]++
+		}
+	}, nil
+}
+
+func sketchResolver(agg *AggState) func() (*Chunk, error) {
+	return func() (*Chunk, error) {
+		estimates := make([]int64, len(agg.counts))
+		for j, sketch := range agg.sketches {
+			if sketch != nil {
+				estimates[j] = sketch.Estimate()
+			}
+		}
+		return NewChunkIntsFromSlice(estimates, nil), nil
+	}
+}
+
+// merger combines partial states the same way values get added - a partial sum gets added to
+// our sum, a partial minimum gets compared to our minimum etc. Partial states of DISTINCT
+// aggregations only merge if duplicates don't affect them (min, max) or if we can tell from
+// their seen sets (count), other DISTINCT aggregations would count values seen in both states
+// twice.
+func merger(agg *AggState, upd updateFuncs, twoPhase bool) func(*AggState) error {
+	return func(other *AggState) error {
+		if !agg.mergeable {
+			return fmt.Errorf("%w: %v", errCannotMerge, agg.function)
+		}
+		if other.function != agg.function || other.inputType != agg.inputType || other.distinct != agg.distinct || other.quantile != agg.quantile {
+			return fmt.Errorf("%w: %v(%v) and %v(%v)", errMergeMismatch, agg.function, agg.inputType, other.function, other.inputType)
+		}
+		if other.err != nil {
+			return other.err
+		}
+		n := len(other.counts)
+		if agg.function == "approx_count_distinct" {
+			agg.counts = ensureLengthInts(agg.counts, n)
+			agg.sketches = ensureLengthSketches(agg.sketches, n)
+			for j := 0; j < n; j++ {
+				agg.counts[j] += other.counts[j]
+				if other.sketches[j] == nil {
+					continue
+				}
+				if agg.sketches[j] == nil {
+					agg.sketches[j] = other.sketches[j]
+					continue
+				}
+				agg.sketches[j].Merge(other.sketches[j])
+			}
+			return nil
+		}
+		if twoPhase {
+			mergeStatistics(agg, other, n)
+			return nil
+		}
+		agg.counts = ensureLengthInts(agg.counts, n)
+		agg.seen = ensureLengthSeenMaps(agg.seen, n)
+		switch agg.inputType {
+		case DtypeInt:
+			agg.ints = ensureLengthInts(agg.ints, n)
+		case DtypeFloat:
+			agg.floats = ensureLengthFloats(agg.floats, n)
+		case DtypeDate:
+			agg.dates = ensureLengthDates(agg.dates, n)
+		case DtypeDatetime:
+			agg.datetimes = ensureLengthDatetimes(agg.datetimes, n)
+		case DtypeDecimal:
+			agg.decimals = ensureLengthDecimals(agg.decimals, n)
+		case DtypeString:
+			agg.strings = ensurelengthStrings(agg.strings, n)
+		}
+		for j := 0; j < n; j++ {
+			if other.counts[j] == 0 {
+				continue
+			}
+			pos := uint64(j)
+			// updaters rely on our counts (e.g. min and max), so these go first
+			switch {
+			case agg.inputType == DtypeInt && upd.ints != nil:
+				upd.ints(agg, other.ints[j], pos)
+			case agg.inputType == DtypeFloat && upd.floats != nil:
+				upd.floats(agg, other.floats[j], pos)
+			case agg.inputType == DtypeDate && upd.dates != nil:
+				upd.dates(agg, other.dates[j], pos)
+			case agg.inputType == DtypeDatetime && upd.datetimes != nil:
+				upd.datetimes(agg, other.datetimes[j], pos)
+			case agg.inputType == DtypeDecimal && upd.decimals != nil:
+				upd.decimals(agg, other.decimals[j], pos)
+			case agg.inputType == DtypeString && upd.strings != nil:
+				upd.strings(agg, other.strings[j], pos)
+			}
+			if agg.distinct {
+				for hash := range other.seen[j] {
+					agg.seenBefore(pos, hash)
+				}
+				agg.counts[j] = int64(len(agg.seen[j]))
+				continue
+			}
+			agg.counts[j] += other.counts[j]
+		}
+		return nil
+	}
+}
+
+// Mergeable reports whether partial states of this aggregation can be merged (see Merge)
+func (agg *AggState) Mergeable() bool {
+	return agg.mergeable
+}
+
+// MarshalBinary serialises the state of an approximate distinct count (its sketches), so that
+// partial states (e.g. of individual stripes) can be stored and merged later on (see Merge and
+// UnmarshalBinary). States of other aggregations cannot be serialised.
+func (agg *AggState) MarshalBinary() ([]byte, error) {
+	if agg.function != "approx_count_distinct" {
+		return nil, fmt.Errorf("%w: %v", errNotSerialisable, agg.function)
+	}
+	buf := appendUvarint(nil, uint64(len(agg.counts)))
+	for j, count := range agg.counts {
+		buf = appendUvarint(buf, uint64(count))
+		var sketch []byte
+		if agg.sketches[j] != nil {
+			var err error
+			sketch, err = agg.sketches[j].MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf = appendUvarint(buf, uint64(len(sketch)))
+		buf = append(buf, sketch...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary restores a state serialised by MarshalBinary into a state of the same
+// aggregation (as created by NewAggregator), it replaces whatever was aggregated in it so far
+func (agg *AggState) UnmarshalBinary(data []byte) error {
+	if agg.function != "approx_count_distinct" {
+		return fmt.Errorf("%w: %v", errNotSerialisable, agg.function)
+	}
+	ngroups, n := binary.Uvarint(data)
+	if n <= 0 || ngroups > uint64(len(data)) {
+		return fmt.Errorf("%w: invalid number of groups", errInvalidState)
+	}
+	data = data[n:]
+	counts := make([]int64, ngroups)
+	sketches := make([]*Sketch, ngroups)
+	for j := range counts {
+		count, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: truncated counts", errInvalidState)
+		}
+		data = data[n:]
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return fmt.Errorf("%w: truncated sketches", errInvalidState)
+		}
+		data = data[n:]
+		counts[j] = int64(count)
+		if length > 0 {
+			sketches[j] = NewSketch()
+			if err := sketches[j].UnmarshalBinary(data[:length]); err != nil {
+				return err
+			}
+		}
+		data = data[length:]
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("%w: trailing data", errInvalidState)
+	}
+	agg.counts, agg.sketches = counts, sketches
+	return nil
+}
+
+// SetQuantile determines which quantile a percentile aggregation resolves to, it's
+// a parameter of the aggregation, not one of its inputs
+func (agg *AggState) SetQuantile(quantile float64) error {
+	if quantile < 0 || quantile > 1 || math.IsNaN(quantile) {
+		return fmt.Errorf("%w: got %v", errInvalidQuantile, quantile)
+	}
+	agg.quantile = quantile
+	return nil
+}
+
 // NewAggregator implements a constructor for various aggregating functions.
 // We got inspired by Postgres' functions https://www.postgresql.org/docs/12/functions-aggregate.html
 //   - not implemented: xml/json functions (don't have the data types), array_agg (no arrays),
 //					    every (just an alias), bit_and/bit_or (doesn't seem useful for us)
-//   - implemented: min, max, sum, avg, count
+//   - implemented: min, max, sum, avg, count, var_samp (alias variance), var_pop, stddev_samp (alias stddev),
+//                  stddev_pop, and approximate median and percentile(expr, quantile) (using t-digests)
+//   - implemented, but not in Postgres: approx_count_distinct (using HyperLogLog sketches)
 //   - planned: bool_and, bool_or, string_agg
-//   - thinking: countDistinct, sketch-based approxCountDistinct
+//   - all of the above support DISTINCT (e.g. count(distinct foo)), which deduplicates exact values (strings and JSON by their hashes)
 // ARCH: function string -> uint8 const?
 // dtypes are types of inputs - rename?
 // TODO: check for function existence
 // OPTIM: the switch(function) could be hoisted outside the closure (would work as a function existence validator)
 func NewAggregator(function string, distinct bool) (func(...Dtype) (*AggState, error), error) {
 	return func(dtypes ...Dtype) (*AggState, error) {
-		state := &AggState{distinct: distinct}
+		state := &AggState{function: function, distinct: distinct}
 		updaters := updateFuncs{}
 		resolvers := resolveFuncs{}
+		twoPhase := false
+		sketched := false
 		switch function {
 		case "count":
 			if len(dtypes) == 0 {
@@ -135,6 +538,11 @@ func NewAggregator(function string, distinct bool) (func(...Dtype) (*AggState, e
 					agg.datetimes[pos] = val
 				}
 			}
+			updaters.decimals = func(agg *AggState, val decimal, pos uint64) {
+				if agg.counts[pos] == 0 || DecimalsLessThan(val, agg.decimals[pos]) {
+					agg.decimals[pos] = val
+				}
+			}
 			updaters.strings = func(agg *AggState, val string, pos uint64) {
 				if agg.counts[pos] == 0 || val < agg.strings[pos] {
 					agg.strings[pos] = val
@@ -163,6 +571,11 @@ func NewAggregator(function string, distinct bool) (func(...Dtype) (*AggState, e
 					agg.datetimes[pos] = val
 				}
 			}
+			updaters.decimals = func(agg *AggState, val decimal, pos uint64) {
+				if agg.counts[pos] == 0 || DecimalsGreaterThan(val, agg.decimals[pos]) {
+					agg.decimals[pos] = val
+				}
+			}
 			updaters.strings = func(agg *AggState, val string, pos uint64) {
 				if agg.counts[pos] == 0 || val > agg.strings[pos] {
 					agg.strings[pos] = val
@@ -177,6 +590,7 @@ func NewAggregator(function string, distinct bool) (func(...Dtype) (*AggState, e
 			updaters.floats = func(agg *AggState, val float64, pos uint64) {
 				agg.floats[pos] += val
 			}
+			updaters.decimals = decimalSummer
 			resolvers = genericResolvers
 		case "avg":
 			state.inputType = dtypes[0]
@@ -187,6 +601,7 @@ func NewAggregator(function string, distinct bool) (func(...Dtype) (*AggState, e
 			updaters.floats = func(agg *AggState, val float64, pos uint64) {
 				agg.floats[pos] += val
 			}
+			updaters.decimals = decimalSummer
 			// so far it's the same as sums, so we might share the codebase somehow (fallthrough and overwrite resolvers?)
 			resolvers = resolveFuncs{
 				ints: func(agg *AggState) func() (*Chunk, error) {
@@ -209,15 +624,55 @@ func NewAggregator(function string, distinct bool) (func(...Dtype) (*AggState, e
 						return genericResolvers.floats(agg)()
 					}
 				},
+				// ARCH: we could return decimals here, but we'd have to pick a scale
+				decimals: func(agg *AggState) func() (*Chunk, error) {
+					return func() (*Chunk, error) {
+						if agg.err != nil {
+							return nil, agg.err
+						}
+						agg.floats = ensureLengthFloats(agg.floats, len(agg.decimals))
+						for j, el := range agg.decimals {
+							agg.floats[j] = el.Float() / float64(agg.counts[j])
+						}
+						return genericResolvers.floats(agg)()
+					}
+				},
 			}
+		case "var_samp", "variance", "var_pop", "stddev_samp", "stddev", "stddev_pop":
+			state.inputType = dtypes[0]
+			updaters = statisticsUpdaters(updateMoments)
+			sample := !(function == "var_pop" || function == "stddev_pop")
+			root := function == "stddev_samp" || function == "stddev" || function == "stddev_pop"
+			resolvers = varianceResolver(sample, root)
+			twoPhase = true
+		case "median", "percentile":
+			state.inputType = dtypes[0]
+			// percentile's quantile is set via SetQuantile once the aggregator is created
+			state.quantile = 0.5
+			updaters = statisticsUpdaters(updateDigests)
+			resolvers = percentileResolvers
+			twoPhase = true
+		case "approx_count_distinct":
+			state.inputType = dtypes[0]
+			resolvers = resolveFuncs{any: sketchResolver}
+			sketched = true
 		default:
 			return nil, fmt.Errorf("%w: %v", errInvalidAggregation, function)
 		}
-		adder, err := adderFactory(state, updaters)
+		state.mergeable = !distinct || function == "count" || function == "min" || function == "max" || sketched
+		addFactory := adderFactory
+		switch {
+		case twoPhase:
+			addFactory = twoPhaseAdder
+		case sketched:
+			addFactory = sketchAdder
+		}
+		adder, err := addFactory(state, updaters)
 		if err != nil {
 			return nil, err
 		}
 		state.AddChunk = adder
+		state.Merge = merger(state, updaters, twoPhase)
 		resolver, err := resolverFactory(state, resolvers)
 		if err != nil {
 			return nil, err
@@ -261,6 +716,15 @@ func ensureLengthDatetimes(data []datetime, length int) []datetime {
 	return data
 }
 
+func ensureLengthDecimals(data []decimal, length int) []decimal {
+	currentLength := len(data)
+	if currentLength >= length {
+		return data
+	}
+	data = append(data, make([]decimal, length-currentLength)...)
+	return data
+}
+
 func ensurelengthStrings(data []string, length int) []string {
 	currentLength := len(data)
 	if currentLength >= length {
@@ -281,6 +745,15 @@ func ensureLengthSeenMaps(data []map[uint64]bool, length int) []map[uint64]bool
 	return data
 }
 
+func ensureLengthSketches(data []*Sketch, length int) []*Sketch {
+	currentLength := len(data)
+	if currentLength >= length {
+		return data
+	}
+	data = append(data, make([]*Sketch, length-currentLength)...)
+	return data
+}
+
 // used to convert a counts slice (how many rows are there for a given bucket) to a nullability
 // bitmap - so a NULL (1) for each zero value
 func bitmapFromCounts(counts []int64) *bitmap.Bitmap {
@@ -296,6 +769,63 @@ func bitmapFromCounts(counts []int64) *bitmap.Bitmap {
 	return bm
 }
 
+// distinctKeys identifies incoming values, so that DISTINCT aggregations can deduplicate them
+// (within a stripe as well as across stripes, our `seen` sets persist). Fixed width values are
+// keyed by their exact 64-bit representations, normalised so that equal values get equal keys
+// (1.2 and 1.20 in decimals, 0 and -0 or all NaNs in floats), only strings and JSON get hashed.
+// ARCH: we only keep hashes of strings, so collisions may lead to undercounting (the same
+// tradeoff we make in GROUP BY)
+func (agg *AggState) distinctKeys(data *Chunk) []uint64 {
+	if !agg.distinct {
+		return nil
+	}
+	keys := make([]uint64, data.Len())
+	switch data.dtype {
+	case DtypeInt:
+		for j := range keys {
+			keys[j] = uint64(data.storage.ints[data.valueIndex(j)])
+		}
+	case DtypeFloat:
+		for j := range keys {
+			keys[j] = canonicalFloatBits(data.storage.floats[data.valueIndex(j)])
+		}
+	case DtypeDate:
+		for j := range keys {
+			keys[j] = uint64(data.storage.dates[data.valueIndex(j)])
+		}
+	case DtypeDatetime:
+		for j := range keys {
+			keys[j] = uint64(data.storage.datetimes[data.valueIndex(j)])
+		}
+	case DtypeDecimal:
+		for j := range keys {
+			keys[j] = uint64(data.storage.decimals[data.valueIndex(j)].normalise())
+		}
+	case DtypeBool:
+		for j := range keys {
+			if data.storage.bools.Get(data.valueIndex(j)) {
+				keys[j] = 1
+			}
+		}
+	default:
+		data.Hash(0, keys)
+	}
+	return keys
+}
+
+// seenBefore reports if a value (its key, see distinctKeys) has already been observed in a given
+// group, it records it if it hasn't
+func (agg *AggState) seenBefore(pos uint64, key uint64) bool {
+	if agg.seen[pos][key] {
+		return true
+	}
+	if agg.seen[pos] == nil {
+		agg.seen[pos] = make(map[uint64]bool)
+	}
+	agg.seen[pos][key] = true
+	return false
+}
+
 // OPTIM/ARCH: this might be abstracted away thanks to generics (though... we don't have nthvalue for all chunk types)
 func adderFactory(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk), error) {
 	switch agg.inputType {
@@ -313,22 +843,16 @@ func adderFactory(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk),
 				}
 				return
 			}
-			for j, val := range data.storage.ints {
+			keys := agg.distinctKeys(data)
+			for j := 0; j < data.Len(); j++ {
+				val := data.storage.ints[data.valueIndex(j)]
 				if data.Nullability != nil && data.Nullability.Get(j) {
 					continue
 				}
 				pos := buckets[j]
 
-				// TODO(next)/ARCH: perhaps wrap this whole thing into some kind of agg.observe(pos int, hash uint64) (skip bool)?
-				if agg.distinct {
-					if agg.seen[pos][uint64(val)] {
-						continue
-					}
-
-					if agg.seen[pos] == nil {
-						agg.seen[pos] = make(map[uint64]bool)
-					}
-					agg.seen[pos][uint64(val)] = true
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
 				}
 				// we don't always have updaters (e.g. for counters)
 				// OPTIM: can we hoist this outside the loop?
@@ -343,23 +867,17 @@ func adderFactory(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk),
 			agg.counts = ensureLengthInts(agg.counts, ndistinct)
 			agg.floats = ensureLengthFloats(agg.floats, ndistinct)
 			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+			keys := agg.distinctKeys(data)
 
-			for j, val := range data.storage.floats {
+			for j := 0; j < data.Len(); j++ {
+				val := data.storage.floats[data.valueIndex(j)]
 				if data.Nullability != nil && data.Nullability.Get(j) {
 					continue
 				}
 				pos := buckets[j]
 
-				if agg.distinct {
-					hval := math.Float64bits(val)
-					if agg.seen[pos][hval] {
-						continue
-					}
-
-					if agg.seen[pos] == nil {
-						agg.seen[pos] = make(map[uint64]bool)
-					}
-					agg.seen[pos][hval] = true
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
 				}
 
 				if upd.floats != nil {
@@ -373,23 +891,18 @@ func adderFactory(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk),
 			agg.counts = ensureLengthInts(agg.counts, ndistinct)
 			agg.dates = ensureLengthDates(agg.dates, ndistinct)
 			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+			keys := agg.distinctKeys(data)
 
-			for j, val := range data.storage.dates {
+			for j := 0; j < data.Len(); j++ {
+				val := data.storage.dates[data.valueIndex(j)]
 				if data.Nullability != nil && data.Nullability.Get(j) {
 					continue
 				}
 				pos := buckets[j]
-				if agg.distinct {
-					if agg.seen[pos][uint64(val)] {
-						continue
-					}
-
-					if agg.seen[pos] == nil {
-						agg.seen[pos] = make(map[uint64]bool)
-					}
-					agg.seen[pos][uint64(val)] = true
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
 				}
-				if upd.floats != nil {
+				if upd.dates != nil {
 					upd.dates(agg, val, pos)
 				}
 				agg.counts[pos]++
@@ -400,55 +913,60 @@ func adderFactory(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk),
 			agg.counts = ensureLengthInts(agg.counts, ndistinct)
 			agg.datetimes = ensureLengthDatetimes(agg.datetimes, ndistinct)
 			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+			keys := agg.distinctKeys(data)
 
-			for j, val := range data.storage.datetimes {
+			for j := 0; j < data.Len(); j++ {
+				val := data.storage.datetimes[data.valueIndex(j)]
 				if data.Nullability != nil && data.Nullability.Get(j) {
 					continue
 				}
 				pos := buckets[j]
-				if agg.distinct {
-					if agg.seen[pos][uint64(val)] {
-						continue
-					}
-
-					if agg.seen[pos] == nil {
-						agg.seen[pos] = make(map[uint64]bool)
-					}
-					agg.seen[pos][uint64(val)] = true
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
 				}
-				if upd.floats != nil {
+				if upd.datetimes != nil {
 					upd.datetimes(agg, val, pos)
 				}
 				agg.counts[pos]++
 			}
 		}, nil
+	case DtypeDecimal:
+		return func(buckets []uint64, ndistinct int, data *Chunk) {
+			agg.counts = ensureLengthInts(agg.counts, ndistinct)
+			agg.decimals = ensureLengthDecimals(agg.decimals, ndistinct)
+			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+			keys := agg.distinctKeys(data)
+
+			for j := 0; j < data.Len(); j++ {
+				val := data.storage.decimals[data.valueIndex(j)]
+				if data.Nullability != nil && data.Nullability.Get(j) {
+					continue
+				}
+				pos := buckets[j]
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
+				}
+				if upd.decimals != nil {
+					upd.decimals(agg, val, pos)
+				}
+				agg.counts[pos]++
+			}
+		}, nil
 	case DtypeString:
 		return func(buckets []uint64, ndistinct int, data *Chunk) {
 			agg.counts = ensureLengthInts(agg.counts, ndistinct)
 			agg.strings = ensurelengthStrings(agg.strings, ndistinct)
 			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+			keys := agg.distinctKeys(data)
 
-			hasher := fnv.New64() // TODO/ARCH: should we abstract this out some place?
 			for j := 0; j < data.Len(); j++ {
 				if data.Nullability != nil && data.Nullability.Get(j) {
 					continue
 				}
 				val := data.nthValue(j)
 				pos := buckets[j]
-				if agg.distinct {
-					if _, err := hasher.Write([]byte(val)); err != nil {
-						panic(err)
-					}
-					hval := hasher.Sum64()
-					hasher.Reset()
-					if agg.seen[pos][hval] {
-						continue
-					}
-
-					if agg.seen[pos] == nil {
-						agg.seen[pos] = make(map[uint64]bool)
-					}
-					agg.seen[pos][hval] = true
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
 				}
 				// TODO: if we have a function that "accepts" strings (or other types) but doesn't have an updater for them...
 				// this will silently ignore the mismatch (e.g. we didn't have type restrictions on SUM in return_types and we
@@ -459,6 +977,30 @@ func adderFactory(agg *AggState, upd updateFuncs) (func([]uint64, int, *Chunk),
 				agg.counts[pos]++
 			}
 		}, nil
+	case DtypeBool:
+		// there are no updaters for bools (yet), so we only support counting them
+		return func(buckets []uint64, ndistinct int, data *Chunk) {
+			agg.counts = ensureLengthInts(agg.counts, ndistinct)
+			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+			keys := agg.distinctKeys(data)
+
+			for j := 0; j < data.Len(); j++ {
+				if data.Nullability != nil && data.Nullability.Get(j) {
+					continue
+				}
+				pos := buckets[j]
+				if agg.distinct && agg.seenBefore(pos, keys[j]) {
+					continue
+				}
+				agg.counts[pos]++
+			}
+		}, nil
+	case DtypeNull:
+		// nulls are skipped by all aggregations, so there's nothing to add, we only keep track of our groups
+		return func(buckets []uint64, ndistinct int, data *Chunk) {
+			agg.counts = ensureLengthInts(agg.counts, ndistinct)
+			agg.seen = ensureLengthSeenMaps(agg.seen, ndistinct)
+		}, nil
 	default:
 		return nil, fmt.Errorf("adder factory not supported for %v", agg.inputType)
 	}
@@ -479,8 +1021,13 @@ func resolverFactory(agg *AggState, resfuncs resolveFuncs) (func() (*Chunk, erro
 		rfunc = resfuncs.dates
 	case DtypeDatetime:
 		rfunc = resfuncs.datetimes
+	case DtypeDecimal:
+		rfunc = resfuncs.decimals
 	case DtypeString:
 		rfunc = resfuncs.strings
+	case DtypeNull:
+		// there were no values to aggregate, whatever the function
+		rfunc = nullResolver
 	}
 	// we hit this branch if either the type is not in the switch (there's no way we can
 	// resolve this type), OR if the function in the struct is nil (undefined)
@@ -1 +1,385 @@
 package column
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/kokes/smda/src/bitmap"
+)
+
+func TestMomentsMerging(t *testing.T) {
+	vals := []float64{1, 2, 3, 4, 5, 10, -3.5, 1e6}
+	var whole moments
+	for _, val := range vals {
+		whole.add(val)
+	}
+	for split := 0; split <= len(vals); split++ {
+		var left, right moments
+		for _, val := range vals[:split] {
+			left.add(val)
+		}
+		for _, val := range vals[split:] {
+			right.add(val)
+		}
+		left.merge(right)
+		if left.n != whole.n || math.Abs(left.mean-whole.mean) > 1e-9 || math.Abs(left.m2-whole.m2)/whole.m2 > 1e-12 {
+			t.Errorf("merging at %v: expecting %+v, got %+v", split, whole, left)
+		}
+	}
+}
+
+func TestDigestQuantiles(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	tests := []struct {
+		n       int
+		parts   int
+		exact   bool
+		sampler func() float64
+	}{
+		{1, 1, true, rnd.Float64},
+		{7, 3, true, rnd.Float64},
+		{50, 5, true, rnd.NormFloat64},
+		{100_000, 1, false, rnd.Float64},
+		{100_000, 20, false, rnd.NormFloat64},
+		{100_000, 100, false, rnd.ExpFloat64},
+	}
+	for _, test := range tests {
+		vals := make([]float64, test.n)
+		digests := make([]*digest, test.parts)
+		for j := range digests {
+			digests[j] = &digest{}
+		}
+		for j := range vals {
+			vals[j] = test.sampler()
+			digests[j%test.parts].add(vals[j])
+		}
+		for _, part := range digests[1:] {
+			digests[0].merge(part)
+		}
+		dg := digests[0]
+		sort.Float64s(vals)
+		if !test.exact && len(dg.centroids) > 2*digestCompression {
+			t.Errorf("expecting a digest of %v values to be compressed, got %v centroids", test.n, len(dg.centroids))
+		}
+		for _, q := range []float64{0, 0.001, 0.01, 0.25, 0.5, 0.75, 0.99, 0.999, 1} {
+			// percentile_cont
+			pos := q * float64(test.n-1)
+			lower := vals[int(math.Floor(pos))]
+			upper := vals[int(math.Ceil(pos))]
+			expected := lower + (upper-lower)*(pos-math.Floor(pos))
+
+			got := dg.quantile(q)
+			if test.exact {
+				if math.Abs(got-expected) > 1e-9 {
+					t.Errorf("expecting quantile %v of %v values to be %v, got %v", q, test.n, expected, got)
+				}
+				continue
+			}
+			// approximate digests are checked by ranks, not values
+			rank := float64(sort.SearchFloat64s(vals, got)) / float64(test.n)
+			if math.Abs(rank-q) > 0.01 {
+				t.Errorf("expecting quantile %v of %v values to be close to %v, got %v (quantile %v)", q, test.n, expected, got, rank)
+			}
+		}
+	}
+}
+
+func TestSketchEstimates(t *testing.T) {
+	for _, test := range []struct {
+		n     int
+		parts int
+	}{
+		{0, 1},
+		{1, 1},
+		{100, 3},
+		{10_000, 1},
+		{1_000_000, 10},
+	} {
+		sketches := make([]*Sketch, test.parts)
+		for j := range sketches {
+			sketches[j] = NewSketch()
+		}
+		vals := make([]int64, test.n)
+		for j := range vals {
+			vals[j] = int64(j)
+		}
+		hashes := make([]uint64, test.n)
+		NewChunkIntsFromSlice(vals, nil).Hash(0, hashes)
+		// every value is added twice (into different sketches), duplicates don't count
+		for j := 0; j < 2*test.n; j++ {
+			sketches[j%test.parts].Add(hashes[j%test.n])
+		}
+		for _, part := range sketches[1:] {
+			sketches[0].Merge(part)
+		}
+		got := sketches[0].Estimate()
+		// small cardinalities are (close to) exact
+		if err := math.Abs(float64(got-int64(test.n))) / math.Max(float64(test.n), 1); err > 0.02 {
+			t.Errorf("expecting a sketch of %v values to estimate their count within 2%%, got %v", test.n, got)
+		}
+
+		raw, err := sketches[0].MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.n <= 100 && len(raw) > 4*test.n+8 {
+			t.Errorf("expecting a sketch of %v values to be serialised sparsely, got %v bytes", test.n, len(raw))
+		}
+		restored := NewSketch()
+		if err := restored.UnmarshalBinary(raw); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Estimate() != got {
+			t.Errorf("expecting a restored sketch to estimate %v, got %v", got, restored.Estimate())
+		}
+	}
+}
+
+func TestInvalidSketches(t *testing.T) {
+	sketch := NewSketch()
+	sketch.Add(123)
+	raw, err := sketch.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range [][]byte{
+		nil,
+		{sketchVersion},
+		{sketchVersion + 1, sketchPrecision, sketchSparse, 0},
+		{sketchVersion, sketchPrecision + 1, sketchSparse, 0},
+		{sketchVersion, sketchPrecision, sketchDense, 1, 2, 3},
+		{sketchVersion, sketchPrecision, 5},
+		raw[:len(raw)-1],
+		append(append([]byte{}, raw...), 1),
+	} {
+		if err := NewSketch().UnmarshalBinary(corrupt); !errors.Is(err, errInvalidSketch) {
+			t.Errorf("expecting %v not to deserialise, got %v", corrupt, err)
+		}
+	}
+}
+
+func TestDistinctKeys(t *testing.T) {
+	tests := []struct {
+		dtype  Dtype
+		vals   []string
+		unique int
+	}{
+		{DtypeInt, []string{"1", "2", "1", "-1", "9223372036854775807"}, 4},
+		{DtypeFloat, []string{"0", "-0", "1.5", "2", "1.50"}, 3},
+		{DtypeDecimal, []string{"1.2", "1.20", "1.3", "-1.2"}, 3},
+		{DtypeDate, []string{"2020-01-01", "2020-01-02", "2020-01-01"}, 2},
+		{DtypeDatetime, []string{"2020-01-01 12:00:00", "2020-01-01 12:00:01", "2020-01-01 12:00:00"}, 2},
+		{DtypeBool, []string{"true", "false", "true"}, 2},
+		{DtypeString, []string{"a", "b", "a", ""}, 3},
+	}
+	for _, test := range tests {
+		chunk := NewChunk(test.dtype)
+		if err := chunk.AddValues(test.vals); err != nil {
+			t.Fatal(err)
+		}
+		state, err := NewAggregator("count", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg, err := state(test.dtype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unique := make(map[uint64]bool)
+		for _, key := range agg.distinctKeys(chunk) {
+			unique[key] = true
+		}
+		if len(unique) != test.unique {
+			t.Errorf("expecting %v (%v) to have %v distinct keys, got %v", test.vals, test.dtype, test.unique, len(unique))
+		}
+	}
+
+	// fixed width values are keyed exactly, not by their hashes
+	vals := []int64{0, 1, -1, 1 << 62}
+	agg := &AggState{distinct: true}
+	for j, key := range agg.distinctKeys(NewChunkIntsFromSlice(vals, nil)) {
+		if key != uint64(vals[j]) {
+			t.Errorf("expecting %v to be keyed as %v, got %v", vals[j], uint64(vals[j]), key)
+		}
+	}
+	// NaNs with different payloads are still the same value
+	nans := agg.distinctKeys(NewChunkFloatsFromSlice([]float64{math.NaN(), math.Float64frombits(0x7ff8000000000abc)}, nil))
+	if nans[0] != nans[1] {
+		t.Errorf("expecting all NaNs to have the same key, got %v", nans)
+	}
+}
+
+func TestSerialisingAggregations(t *testing.T) {
+	factory, err := NewAggregator("approx_count_distinct", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := factory(DtypeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := NewChunk(DtypeInt)
+	if err := data.AddValues([]string{"1", "2", "", "2", "3", "4"}); err != nil {
+		t.Fatal(err)
+	}
+	state.AddChunk([]uint64{0, 0, 0, 0, 1, 2}, 4, data)
+	expected, err := state.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := state.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := factory(DtypeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	got, err := restored.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ChunksEqual(got, expected) {
+		t.Errorf("expecting a restored state to resolve into %v, got %v", expected, got)
+	}
+	if err := restored.UnmarshalBinary(raw[:len(raw)-1]); err == nil {
+		t.Error("expecting truncated states not to deserialise")
+	}
+
+	sum, err := NewAggregator("sum", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums, err := sum(DtypeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sums.MarshalBinary(); !errors.Is(err, errNotSerialisable) {
+		t.Errorf("expecting exact aggregations not to be serialisable, got %v", err)
+	}
+}
+
+func TestMergingAggregations(t *testing.T) {
+	tests := []struct {
+		function  string
+		distinct  bool
+		dtype     Dtype
+		values    []string
+		mergeable bool
+	}{
+		{"count", false, DtypeInt, []string{"1", "", "3", "3", "5"}, true},
+		{"count", true, DtypeInt, []string{"1", "", "3", "3", "1"}, true},
+		{"min", false, DtypeInt, []string{"4", "", "3", "-2", "5"}, true},
+		{"min", true, DtypeString, []string{"b", "a", "c", "a", "d"}, true},
+		{"max", false, DtypeDate, []string{"2020-01-01", "", "2021-03-04", "2019-12-31", "2020-05-05"}, true},
+		{"max", false, DtypeDatetime, []string{"2020-01-01 12:00:00", "", "2020-01-01 12:00:01", "2019-12-31 00:00:00", ""}, true},
+		{"sum", false, DtypeFloat, []string{"1.5", "", "3", "-2.25", "5"}, true},
+		{"sum", false, DtypeDecimal, []string{"1.50", "", "3.25", "-2.00", "5"}, true},
+		{"sum", true, DtypeInt, []string{"1", "2", "1", "2", "3"}, false},
+		{"avg", false, DtypeInt, []string{"1", "", "3", "4", "5"}, true},
+		{"var_samp", false, DtypeFloat, []string{"2", "", "4", "6", "5"}, true},
+		{"median", false, DtypeInt, []string{"1", "", "3", "4", "5"}, true},
+		{"stddev", true, DtypeInt, []string{"1", "1", "3", "4", "5"}, false},
+		{"approx_count_distinct", false, DtypeString, []string{"a", "", "b", "a", "c"}, true},
+		{"approx_count_distinct", true, DtypeFloat, []string{"1", "1", "", "2", "2"}, true},
+	}
+	for _, test := range tests {
+		factory, err := NewAggregator(test.function, test.distinct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole, err := factory(test.dtype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := NewChunk(test.dtype)
+		if err := data.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		// all values go in a single group, except for the last one
+		buckets := []uint64{0, 0, 0, 0, 1}
+		whole.AddChunk(buckets, 2, data)
+		expected, err := whole.Resolve()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for split := 0; split <= len(test.values); split++ {
+			left, err := factory(test.dtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			right, err := factory(test.dtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left.Mergeable() != test.mergeable {
+				t.Errorf("expecting %v (distinct: %v) to be mergeable: %v", test.function, test.distinct, test.mergeable)
+			}
+			bm := bitmap.NewBitmap(len(test.values))
+			for j := 0; j < split; j++ {
+				bm.Set(j, true)
+			}
+			// partial states don't need to know about all the groups
+			ngroups := 1
+			if split == len(test.values) {
+				ngroups = 2
+			}
+			left.AddChunk(buckets[:split], ngroups, data.Prune(bm))
+			bm.Invert()
+			right.AddChunk(buckets[split:], 2, data.Prune(bm))
+
+			err = left.Merge(right)
+			if !test.mergeable {
+				if !errors.Is(err, errCannotMerge) {
+					t.Errorf("expecting merging %v (distinct: %v) to fail, got %v", test.function, test.distinct, err)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := left.Resolve()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ChunksEqual(got, expected) {
+				t.Errorf("expecting %v of %v split at %v to merge into %v, got %v", test.function, test.values, split, expected, got)
+			}
+		}
+	}
+}
+
+func TestMergingMismatchedAggregations(t *testing.T) {
+	sum, err := NewAggregator("sum", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, err := NewAggregator("min", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ints, err := sum(DtypeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	floats, err := sum(DtypeFloat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mins, err := min(DtypeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*AggState{floats, mins} {
+		if err := ints.Merge(other); !errors.Is(err, errMergeMismatch) {
+			t.Errorf("expecting a mismatched merge to fail with %v, got %v", errMergeMismatch, err)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package column
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+var errArrowUnsupportedType = errors.New("type not supported in Arrow exports")
+var errArrowMisaligned = errors.New("data do not align with their schema")
+
+// This implements (parts of) the Arrow IPC streaming format, as described in
+// https://arrow.apache.org/docs/format/Columnar.html#serialization-and-interprocess-communication-ipc
+// A stream consists of a schema message, record batches and an end-of-stream marker. Each
+// message is a flatbuffer (see Message.fbs/Schema.fbs in the Arrow repo) followed by a body.
+// ARCH: we only write, we don't need to read Arrow data (yet)
+
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeNull          = 1
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+	arrowTypeDecimal       = 7
+	arrowTypeDate          = 8
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble  = 2
+	arrowDateUnitDay      = 0
+	arrowTimeUnitMicrosec = 2
+
+	arrowDecimalPrecision = 38
+)
+
+// arrowContinuation precedes each message
+const arrowContinuation = 0xFFFFFFFF
+
+// WriteArrow writes chunks as a single record batch in the Arrow IPC streaming format.
+// All chunks need to be of the same length and none of them can be a literal.
+// OPTIM: we could split large results into multiple batches, so that readers can stream them
+func WriteArrow(w io.Writer, schema TableSchema, data []*Chunk) error {
+	if len(schema) != len(data) {
+		return fmt.Errorf("%w: schema has %v columns, got %v", errArrowMisaligned, len(schema), len(data))
+	}
+	length := 0
+	if len(data) > 0 {
+		length = data[0].Len()
+	}
+	decimalScales := make([]int, len(data))
+	for j, col := range data {
+		if col.IsLiteral {
+			return errLiteralsCannotBeSerialised
+		}
+		if col.Len() != length {
+			return fmt.Errorf("%w: column %v", errArrowMisaligned, schema[j].Name)
+		}
+		if col.dtype == DtypeDecimal {
+			decimalScales[j] = col.maxDecimalScale()
+		}
+	}
+
+	meta, err := arrowSchemaMessage(schema, decimalScales)
+	if err != nil {
+		return err
+	}
+	if err := writeArrowMessage(w, meta, nil); err != nil {
+		return err
+	}
+
+	nodes := make([][2]int64, 0, len(data))
+	buffers := make([][]byte, 0, 3*len(data))
+	for j, col := range data {
+		nullCount := 0
+		if col.Nullability != nil {
+			nullCount = col.Nullability.Count()
+		}
+		if col.dtype == DtypeNull {
+			nullCount = col.Len()
+		}
+		nodes = append(nodes, [2]int64{int64(col.Len()), int64(nullCount)})
+		buffers = append(buffers, col.arrowBuffers(decimalScales[j])...)
+	}
+
+	meta, body := arrowRecordBatchMessage(length, nodes, buffers)
+	if err := writeArrowMessage(w, meta, body); err != nil {
+		return err
+	}
+
+	// end of stream marker
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[:], arrowContinuation)
+	_, err = w.Write(eos[:])
+	return err
+}
+
+// all decimals in an Arrow column share a single scale, so we take the largest one
+func (rc *Chunk) maxDecimalScale() int {
+	scale := 0
+	for j, val := range rc.storage.decimals {
+		if rc.Nullability != nil && rc.Nullability.Get(j) {
+			continue
+		}
+		if val.scale() > scale {
+			scale = val.scale()
+		}
+	}
+	return scale
+}
+
+func padTo8(n int) int {
+	return (n + 7) &^ 7
+}
+
+func writeArrowMessage(w io.Writer, meta []byte, body []byte) error {
+	metaLength := padTo8(len(meta))
+	header := make([]byte, 8, 8+metaLength)
+	binary.LittleEndian.PutUint32(header, arrowContinuation)
+	binary.LittleEndian.PutUint32(header[4:], uint32(metaLength))
+	header = append(header, meta...)
+	header = append(header, make([]byte, metaLength-len(meta))...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func arrowMessage(b *fbBuilder, headerType uint8, header int, bodyLength int) []byte {
+	b.startTable(5)
+	b.addInt64(3, int64(bodyLength))
+	b.addOffset(2, header)
+	b.addInt16(0, arrowMetadataV5)
+	b.addUint8(1, headerType)
+	return b.finish(b.endTable())
+}
+
+func arrowSchemaMessage(schema TableSchema, decimalScales []int) ([]byte, error) {
+	b := newFbBuilder(1024)
+	fields := make([]int, 0, len(schema))
+	for j, col := range schema {
+		typeType, typeOffset, err := arrowType(b, col.Dtype, decimalScales[j])
+		if err != nil {
+			return nil, err
+		}
+		name := b.createString(col.Name)
+		// some readers require the children vector to be present, even if empty
+		children := b.createOffsetVector(nil)
+
+		b.startTable(7)
+		b.addOffset(0, name)
+		b.addOffset(3, typeOffset)
+		b.addOffset(5, children)
+		b.addBool(1, col.Nullable || col.Dtype == DtypeNull)
+		b.addUint8(2, typeType)
+		fields = append(fields, b.endTable())
+	}
+	fieldsOffset := b.createOffsetVector(fields)
+
+	b.startTable(4)
+	b.addOffset(1, fieldsOffset)
+	b.addInt16(0, 0) // little endian
+	return arrowMessage(b, arrowHeaderSchema, b.endTable(), 0), nil
+}
+
+// arrowType writes a type table and returns its union type and offset
+func arrowType(b *fbBuilder, dtype Dtype, decimalScale int) (uint8, int, error) {
+	switch dtype {
+	case DtypeNull:
+		b.startTable(0)
+		return arrowTypeNull, b.endTable(), nil
+	case DtypeInt:
+		b.startTable(2)
+		b.addInt32(0, 64)
+		b.addBool(1, true)
+		return arrowTypeInt, b.endTable(), nil
+	case DtypeFloat:
+		b.startTable(1)
+		b.addInt16(0, arrowPrecisionDouble)
+		return arrowTypeFloatingPoint, b.endTable(), nil
+	case DtypeString, DtypeJSON:
+		// ARCH: JSON could be marked using the arrow.json extension type (in field metadata)
+		b.startTable(0)
+		return arrowTypeUtf8, b.endTable(), nil
+	case DtypeBool:
+		b.startTable(0)
+		return arrowTypeBool, b.endTable(), nil
+	case DtypeDecimal:
+		b.startTable(3)
+		b.addInt32(0, arrowDecimalPrecision)
+		b.addInt32(1, int32(decimalScale))
+		b.addInt32(2, 128)
+		return arrowTypeDecimal, b.endTable(), nil
+	case DtypeDate:
+		b.startTable(1)
+		b.addInt16(0, arrowDateUnitDay)
+		return arrowTypeDate, b.endTable(), nil
+	case DtypeDatetime:
+		// no timezone, our datetimes are naive
+		b.startTable(2)
+		b.addInt16(0, arrowTimeUnitMicrosec)
+		return arrowTypeTimestamp, b.endTable(), nil
+	}
+	return 0, 0, fmt.Errorf("%w: %v", errArrowUnsupportedType, dtype)
+}
+
+func arrowRecordBatchMessage(length int, nodes [][2]int64, buffers [][]byte) ([]byte, []byte) {
+	bodyLength := 0
+	for _, buf := range buffers {
+		bodyLength += padTo8(len(buf))
+	}
+	body := make([]byte, 0, bodyLength)
+	locations := make([][2]int64, 0, len(buffers))
+	for _, buf := range buffers {
+		locations = append(locations, [2]int64{int64(len(body)), int64(len(buf))})
+		body = append(body, buf...)
+		body = append(body, make([]byte, padTo8(len(buf))-len(buf))...)
+	}
+
+	b := newFbBuilder(1024)
+	// both FieldNode and Buffer are structs of two longs
+	structVector := func(vals [][2]int64) int {
+		b.startVector(16, len(vals), 8)
+		for j := len(vals) - 1; j >= 0; j-- {
+			b.prep(8, 16)
+			b.prependUint64(uint64(vals[j][1]))
+			b.prependUint64(uint64(vals[j][0]))
+		}
+		return b.endVector(len(vals))
+	}
+	nodesOffset := structVector(nodes)
+	buffersOffset := structVector(locations)
+
+	b.startTable(4)
+	b.addInt64(0, int64(length))
+	b.addOffset(1, nodesOffset)
+	b.addOffset(2, buffersOffset)
+	return arrowMessage(b, arrowHeaderRecordBatch, b.endTable(), len(body)), body
+}
+
+// arrowValidity returns a validity bitmap (set bits denote valid values, it's the inverse of our
+// nullability), it's empty if there are no nulls
+func (rc *Chunk) arrowValidity() []byte {
+	if rc.Nullability == nil || rc.Nullability.Count() == 0 {
+		return nil
+	}
+	nulls := rc.Nullability.Clone()
+	nulls.Ensure(rc.Len())
+	nulls.Invert()
+	return bitsToBytes(nulls.Data(), rc.Len())
+}
+
+// both us and Arrow use LSB bit numbering, so we only need to lay out our words in little endian
+func bitsToBytes(data []uint64, length int) []byte {
+	ret := make([]byte, 8*len(data))
+	for j, word := range data {
+		binary.LittleEndian.PutUint64(ret[8*j:], word)
+	}
+	return ret[:(length+7)/8]
+}
+
+func (rc *Chunk) arrowBuffers(decimalScale int) [][]byte {
+	validity := rc.arrowValidity()
+	switch rc.dtype {
+	case DtypeNull:
+		// null arrays have no buffers at all
+		return nil
+	case DtypeInt:
+		data := make([]byte, 8*rc.Len())
+		for j, val := range rc.storage.ints {
+			binary.LittleEndian.PutUint64(data[8*j:], uint64(val))
+		}
+		return [][]byte{validity, data}
+	case DtypeFloat:
+		data := make([]byte, 8*rc.Len())
+		for j, val := range rc.storage.floats {
+			binary.LittleEndian.PutUint64(data[8*j:], math.Float64bits(val))
+		}
+		return [][]byte{validity, data}
+	case DtypeString, DtypeJSON:
+		offsets := make([]byte, 4*len(rc.storage.offsets))
+		for j, val := range rc.storage.offsets {
+			binary.LittleEndian.PutUint32(offsets[4*j:], val)
+		}
+		return [][]byte{validity, offsets, rc.storage.strings}
+	case DtypeBool:
+		bools := rc.storage.bools.Clone()
+		bools.Ensure(rc.Len())
+		return [][]byte{validity, bitsToBytes(bools.Data(), rc.Len())}
+	case DtypeDate:
+		// days since the unix epoch
+		data := make([]byte, 4*rc.Len())
+		for j, val := range rc.storage.dates {
+			days := time.Date(val.Year(), time.Month(val.Month()), val.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+			binary.LittleEndian.PutUint32(data[4*j:], uint32(int32(days)))
+		}
+		return [][]byte{validity, data}
+	case DtypeDatetime:
+		// microseconds since the unix epoch
+		data := make([]byte, 8*rc.Len())
+		for j, val := range rc.storage.datetimes {
+			ts := time.Date(val.Year(), time.Month(val.Month()), val.Day(), val.Hour(), val.Minute(), val.Second(), 1000*val.Microsecond(), time.UTC)
+			binary.LittleEndian.PutUint64(data[8*j:], uint64(ts.UnixMicro()))
+		}
+		return [][]byte{validity, data}
+	case DtypeDecimal:
+		// 128-bit two's complement integers, all at the same scale
+		data := make([]byte, 16*rc.Len())
+		for j, val := range rc.storage.decimals {
+			if rc.Nullability != nil && rc.Nullability.Get(j) {
+				continue
+			}
+			hi, lo := val.int128(decimalScale)
+			binary.LittleEndian.PutUint64(data[16*j:], lo)
+			binary.LittleEndian.PutUint64(data[16*j+8:], hi)
+		}
+		return [][]byte{validity, data}
+	}
+	panic(fmt.Sprintf("unsupported dtype for Arrow exports: %v", rc.dtype))
+}
@@ -0,0 +1,94 @@
+package column
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// we don't have an Arrow reader, so we only check the framing of the stream (messages, alignment,
+// end of stream marker) - the contents have been validated against the official implementation
+func TestArrowStreamFraming(t *testing.T) {
+	schema := TableSchema{
+		{Name: "foo", Dtype: DtypeInt, Nullable: true},
+		{Name: "bar", Dtype: DtypeString},
+		{Name: "baz", Dtype: DtypeDecimal},
+		{Name: "bak", Dtype: DtypeNull, Nullable: true},
+	}
+	data := []*Chunk{
+		NewChunk(DtypeInt),
+		NewChunk(DtypeString),
+		NewChunk(DtypeDecimal),
+		NewChunk(DtypeNull),
+	}
+	vals := [][]string{{"1", "", "3"}, {"a", "bb", "ccc"}, {"1.5", "-0.25", "3"}, {"", "", ""}}
+	for j, col := range data {
+		if err := col.AddValues(vals[j]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteArrow(buf, schema, data); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+	if len(stream)%8 != 0 {
+		t.Errorf("expecting the stream to be 8-byte aligned, got %v bytes", len(stream))
+	}
+	var bodyLengths []int
+	for len(stream) > 0 {
+		if len(stream) < 8 || binary.LittleEndian.Uint32(stream) != arrowContinuation {
+			t.Fatalf("expecting a continuation marker at each message")
+		}
+		metaLength := int(binary.LittleEndian.Uint32(stream[4:]))
+		if metaLength == 0 {
+			if len(stream) != 8 {
+				t.Errorf("expecting the end of stream marker to be at the very end, %v bytes remain", len(stream))
+			}
+			break
+		}
+		if metaLength%8 != 0 {
+			t.Errorf("expecting metadata to be padded to 8 bytes, got %v", metaLength)
+		}
+		meta := stream[8 : 8+metaLength]
+		// Message.bodyLength is the last field we write, so it's at the very end of the shallowest table,
+		// we can find it via the root offset and the vtable
+		root := int(binary.LittleEndian.Uint32(meta))
+		vtable := root - int(int32(binary.LittleEndian.Uint32(meta[root:])))
+		bodyLength := 0
+		if int(binary.LittleEndian.Uint16(meta[vtable:])) > 4+2*3 {
+			if fieldOffset := int(binary.LittleEndian.Uint16(meta[vtable+4+2*3:])); fieldOffset > 0 {
+				bodyLength = int(binary.LittleEndian.Uint64(meta[root+fieldOffset:]))
+			}
+		}
+		bodyLengths = append(bodyLengths, bodyLength)
+		stream = stream[8+metaLength+bodyLength:]
+	}
+	// a schema without a body and a record batch with
+	// validity (8) + ints (24) + offsets (16) + strings (8) + decimals (48)
+	expected := []int{0, 104}
+	if len(bodyLengths) != len(expected) || bodyLengths[0] != expected[0] || bodyLengths[1] != expected[1] {
+		t.Errorf("expecting messages with bodies of %v bytes, got %v", expected, bodyLengths)
+	}
+}
+
+func TestArrowInvalidInputs(t *testing.T) {
+	ints := NewChunkIntsFromSlice([]int64{1, 2, 3}, nil)
+	tests := []struct {
+		schema TableSchema
+		data   []*Chunk
+		err    error
+	}{
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}}, nil, errArrowMisaligned},
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}, {Name: "bar", Dtype: DtypeInt}}, []*Chunk{ints, NewChunkIntsFromSlice([]int64{1}, nil)}, errArrowMisaligned},
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}}, []*Chunk{NewChunkLiteralInts(1, 3)}, errLiteralsCannotBeSerialised},
+		{TableSchema{{Name: "foo", Dtype: DtypeInvalid}}, []*Chunk{ints}, errArrowUnsupportedType},
+	}
+	for _, test := range tests {
+		if err := WriteArrow(new(bytes.Buffer), test.schema, test.data); !errors.Is(err, test.err) {
+			t.Errorf("expecting %+v to fail with %v, got %v", test.schema, test.err, err)
+		}
+	}
+}
@@ -1,23 +1,82 @@
 package column
 
 import (
-	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errCannotCastType = errors.New("cannot cast from this type")
-var errCannotCastToType = errors.New("cannot cast to this type")
+var errCannotCastType = errs.New(errs.ErrBadRequest, "cannot cast from this type")
+var errCannotCastToType = errs.New(errs.ErrBadRequest, "cannot cast to this type")
 
 func (rc *Chunk) cast(dtype Dtype) (*Chunk, error) {
-	if rc.dtype != DtypeInt {
+	if rc.dtype == dtype {
+		return rc, nil // 1) noop, 2) NOT copying, issue?
+	}
+	switch rc.dtype {
+	case DtypeNull:
+		return rc.castNulls(dtype)
+	case DtypeInt:
+		return rc.castInts(dtype)
+	case DtypeDecimal:
+		return rc.castDecimals(dtype)
+	default:
 		// TODO(next): test this
 		return nil, errCannotCastType
 	}
+}
+
+// WidenType finds a type that can hold values of both types without losing information (we
+// use this when appending data that don't fit existing columns), e.g. ints widen into floats
+func WidenType(a, b Dtype) (Dtype, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case a == DtypeNull:
+		return b, true
+	case b == DtypeNull:
+		return a, true
+	}
+	// ints < decimals < floats (decimals are exact, but floats hold a wider range of values)
+	ranks := map[Dtype]int{DtypeInt: 1, DtypeDecimal: 2, DtypeFloat: 3}
+	ra, rb := ranks[a], ranks[b]
+	if ra == 0 || rb == 0 {
+		return DtypeInvalid, false
+	}
+	if ra > rb {
+		return a, true
+	}
+	return b, true
+}
+
+// Widen converts a chunk into a wider type (see WidenType)
+func (rc *Chunk) Widen(dtype Dtype) (*Chunk, error) {
+	if wider, ok := WidenType(rc.dtype, dtype); !ok || wider != dtype {
+		return nil, fmt.Errorf("%w: cannot widen %v to %v", errCannotCastToType, rc.dtype, dtype)
+	}
+	return rc.cast(dtype)
+}
+
+// nulls can be cast into anything, we just need to keep their nullability (strings are an
+// exception, since they cannot be null, we load nulls as empty strings)
+func (rc *Chunk) castNulls(dtype Dtype) (*Chunk, error) {
+	if rc.IsLiteral {
+		return nil, fmt.Errorf("%w: literal %v to %v", errCannotCastToType, rc.dtype, dtype)
+	}
+	ret := NewChunk(dtype)
+	for j := 0; j < rc.Len(); j++ {
+		if err := ret.AddValue(""); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (rc *Chunk) castInts(dtype Dtype) (*Chunk, error) {
 	switch dtype {
-	case DtypeInt:
-		return rc, nil // 1) noop, 2) NOT copying, issue?
 	case DtypeFloat:
 		if rc.IsLiteral {
 			val := float64(rc.storage.ints[0])
@@ -29,7 +88,221 @@ func (rc *Chunk) cast(dtype Dtype) (*Chunk, error) {
 		}
 		nulls := bitmap.Clone(rc.Nullability)
 		return NewChunkFloatsFromSlice(data, nulls), nil
+	case DtypeDecimal:
+		if rc.IsLiteral {
+			val, err := decimalFromInt(rc.storage.ints[0])
+			if err != nil {
+				return nil, err
+			}
+			return NewChunkLiteralDecimals(val, rc.Len()), nil
+		}
+		data := make([]decimal, rc.Len())
+		for j := 0; j < rc.Len(); j++ {
+			if rc.Nullability != nil && rc.Nullability.Get(j) {
+				continue
+			}
+			val, err := decimalFromInt(rc.storage.ints[j])
+			if err != nil {
+				return nil, err
+			}
+			data[j] = val
+		}
+		nulls := bitmap.Clone(rc.Nullability)
+		return newChunkDecimalsFromSlice(data, nulls), nil
+	default:
+		return nil, fmt.Errorf("%w: %v to %v", errCannotCastToType, rc.dtype, dtype)
+	}
+}
+
+func (rc *Chunk) castDecimals(dtype Dtype) (*Chunk, error) {
+	switch dtype {
+	case DtypeFloat:
+		if rc.IsLiteral {
+			return NewChunkLiteralFloats(rc.storage.decimals[0].Float(), rc.Len()), nil
+		}
+		data := make([]float64, rc.Len())
+		for j := 0; j < rc.Len(); j++ {
+			data[j] = rc.storage.decimals[j].Float()
+		}
+		nulls := bitmap.Clone(rc.Nullability)
+		return NewChunkFloatsFromSlice(data, nulls), nil
 	default:
 		return nil, fmt.Errorf("%w: %v to %v", errCannotCastToType, rc.dtype, dtype)
 	}
 }
+
+// Convert converts a chunk into an arbitrary type, unlike Widen, it can lose information or
+// fail altogether. Values get formatted as text and parsed back in the target type, the same way
+// they'd be parsed when loading data, so e.g. strings only convert into ints if they all look like
+// ints (empty strings become nulls), ints convert into strings, but floats don't convert into ints.
+// Nulls stay nulls, except for strings, which cannot be null (we load nulls as empty strings).
+func (rc *Chunk) Convert(dtype Dtype, floats FloatPolicy) (*Chunk, error) {
+	if wider, ok := WidenType(rc.dtype, dtype); ok && wider == dtype {
+		return rc.cast(dtype)
+	}
+	if rc.IsLiteral || dtype == DtypeInvalid || dtype == DtypeNull {
+		return nil, fmt.Errorf("%w: %v to %v", errCannotCastToType, rc.dtype, dtype)
+	}
+	ret := NewChunk(dtype)
+	for j := 0; j < rc.Len(); j++ {
+		if err := ret.AddValueWithPolicy(rc.textValue(j), floats); err != nil {
+			return nil, fmt.Errorf("%w: %v to %v: %v", errCannotCastToType, rc.dtype, dtype, err)
+		}
+	}
+	return ret, nil
+}
+
+// ConversionConflict is a value that could not be converted into a given type (see ConvertLenient)
+type ConversionConflict struct {
+	Row   int    `json:"row"`
+	Value string `json:"value"`
+}
+
+// ConvertLenient converts a chunk just like Convert, but values that cannot be converted become
+// nulls instead of failing the conversion, these get reported as conflicts (by their positions
+// within this chunk)
+func (rc *Chunk) ConvertLenient(dtype Dtype, floats FloatPolicy) (*Chunk, []ConversionConflict, error) {
+	if wider, ok := WidenType(rc.dtype, dtype); ok && wider == dtype {
+		ret, err := rc.cast(dtype)
+		return ret, nil, err
+	}
+	if rc.IsLiteral || dtype == DtypeInvalid || dtype == DtypeNull {
+		return nil, nil, fmt.Errorf("%w: %v to %v", errCannotCastToType, rc.dtype, dtype)
+	}
+	var conflicts []ConversionConflict
+	ret := NewChunk(dtype)
+	for j := 0; j < rc.Len(); j++ {
+		val := rc.textValue(j)
+		if err := ret.AddValueWithPolicy(val, floats); err == nil {
+			continue
+		}
+		conflicts = append(conflicts, ConversionConflict{Row: j, Value: val})
+		if err := ret.AddValue(""); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ret, conflicts, nil
+}
+
+// textValue formats the nth value the way it would appear in an input file, nulls are empty
+func (rc *Chunk) textValue(n int) string {
+	if rc.Nullability != nil && rc.Nullability.Get(n) {
+		return ""
+	}
+	switch rc.dtype {
+	case DtypeString:
+		return rc.nthValue(n)
+	case DtypeJSON:
+		return jsonText(rc.nthValue(n))
+	case DtypeFloat:
+		return strconv.FormatFloat(rc.storage.floats[n], 'g', -1, 64)
+	case DtypeDate:
+		return rc.storage.dates[n].String()
+	case DtypeDatetime:
+		return rc.storage.datetimes[n].String()
+	}
+	val, _ := rc.JSONLiteral(n)
+	return val
+}
+
+// castTypes maps type names used in CAST expressions onto our types, we accept some aliases
+// common in other engines
+var castTypes = map[string]Dtype{
+	"int": DtypeInt, "integer": DtypeInt, "bigint": DtypeInt,
+	"float": DtypeFloat, "double": DtypeFloat, "real": DtypeFloat,
+	"decimal": DtypeDecimal, "numeric": DtypeDecimal,
+	"string": DtypeString, "text": DtypeString, "varchar": DtypeString,
+	"bool": DtypeBool, "boolean": DtypeBool,
+	"date":     DtypeDate,
+	"datetime": DtypeDatetime, "timestamp": DtypeDatetime,
+	"json": DtypeJSON,
+}
+
+// CastType resolves a (case insensitive) type name used in CAST expressions
+func CastType(name string) (Dtype, error) {
+	dtype, ok := castTypes[strings.ToLower(name)]
+	if !ok {
+		return DtypeInvalid, fmt.Errorf("%w: %v", errCannotCastToType, name)
+	}
+	return dtype, nil
+}
+
+// CAST(foo AS int) is strict, values that cannot be converted fail the whole expression
+func evalCast(cs ...*Chunk) (*Chunk, error) {
+	dtype, err := CastType(cs[1].nthValue(0))
+	if err != nil {
+		return nil, err
+	}
+	return cs[0].castValues(dtype, true)
+}
+
+// toint(foo) and friends are lenient casts, values that cannot be converted become nulls
+func castFunc(dtype Dtype) func(...*Chunk) (*Chunk, error) {
+	return func(cs ...*Chunk) (*Chunk, error) {
+		return cs[0].castValues(dtype, false)
+	}
+}
+
+// castValues converts values into a given type, much like Convert, but nulls stay nulls in all
+// types (strings included) and empty strings become nulls in all other types. Values that cannot
+// be converted either fail the conversion (if strict) or become nulls.
+// Dates convert into datetimes at midnight, datetimes into dates get truncated.
+func (rc *Chunk) castValues(dtype Dtype, strict bool) (*Chunk, error) {
+	if rc.dtype == dtype {
+		return rc, nil
+	}
+	if wider, ok := WidenType(rc.dtype, dtype); ok && wider == dtype && rc.dtype != DtypeNull {
+		return rc.cast(dtype)
+	}
+	if dtype == DtypeInvalid || dtype == DtypeNull {
+		return nil, fmt.Errorf("%w: %v to %v", errCannotCastToType, rc.dtype, dtype)
+	}
+	length := rc.Len()
+	if rc.IsLiteral {
+		length = 1
+	}
+	ret := NewChunk(dtype)
+	nulls := bitmap.NewBitmap(length)
+	for j := 0; j < length; j++ {
+		if rc.dtype != DtypeNull && !(rc.Nullability != nil && rc.Nullability.Get(j)) {
+			val := rc.textValue(j)
+			switch {
+			case rc.dtype == DtypeDatetime && dtype == DtypeDate:
+				val = val[:10]
+			case rc.dtype == DtypeDate && dtype == DtypeDatetime:
+				val += " 00:00:00"
+			}
+			if dtype == DtypeString || !isNull(val) {
+				err := ret.AddValue(val)
+				if err == nil {
+					continue
+				}
+				if strict {
+					return nil, fmt.Errorf("%w: %v to %v: %q", errCannotCastToType, rc.dtype, dtype, val)
+				}
+			}
+		}
+		nulls.Set(j, true)
+		if err := ret.AddValue(""); err != nil {
+			return nil, err
+		}
+	}
+	if nulls.Count() == 0 {
+		if rc.IsLiteral {
+			return NewChunkLiteralTyped(ret.textValue(0), dtype, rc.Len())
+		}
+		return ret, nil
+	}
+	// ARCH: literals cannot be null, so we expand null literals into full chunks
+	if rc.IsLiteral {
+		for j := 1; j < rc.Len(); j++ {
+			if err := ret.AddValue(""); err != nil {
+				return nil, err
+			}
+		}
+		nulls = bitmap.NewBitmap(rc.Len())
+		nulls.Invert()
+	}
+	ret.Nullify(nulls)
+	return ret, nil
+}
@@ -1 +1,226 @@
 package column
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/kokes/smda/src/bitmap"
+)
+
+func TestWideningTypes(t *testing.T) {
+	tests := []struct {
+		a, b     Dtype
+		expected Dtype
+		ok       bool
+	}{
+		{DtypeInt, DtypeInt, DtypeInt, true},
+		{DtypeInt, DtypeFloat, DtypeFloat, true},
+		{DtypeFloat, DtypeInt, DtypeFloat, true},
+		{DtypeInt, DtypeDecimal, DtypeDecimal, true},
+		{DtypeDecimal, DtypeFloat, DtypeFloat, true},
+		{DtypeNull, DtypeDate, DtypeDate, true},
+		{DtypeString, DtypeNull, DtypeString, true},
+		{DtypeInt, DtypeString, DtypeInvalid, false},
+		{DtypeBool, DtypeInt, DtypeInvalid, false},
+	}
+	for _, test := range tests {
+		dtype, ok := WidenType(test.a, test.b)
+		if dtype != test.expected || ok != test.ok {
+			t.Errorf("expecting %v and %v to widen into %v (%v), got %v (%v)", test.a, test.b, test.expected, test.ok, dtype, ok)
+		}
+	}
+}
+
+func TestWideningChunks(t *testing.T) {
+	ints := NewChunkIntsFromSlice([]int64{1, 2}, nil)
+	floats, err := ints.Widen(DtypeFloat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ChunksEqual(floats, NewChunkFloatsFromSlice([]float64{1, 2}, nil)) {
+		t.Errorf("expecting ints to widen into floats, got %v", floats)
+	}
+	if _, err := floats.Widen(DtypeInt); !errors.Is(err, errCannotCastToType) {
+		t.Errorf("expecting floats not to be narrowed into ints, got %v", err)
+	}
+
+	nulls := NewChunk(DtypeNull)
+	if err := nulls.AddValues([]string{"", ""}); err != nil {
+		t.Fatal(err)
+	}
+	dates, err := nulls.Widen(DtypeDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dates.Dtype() != DtypeDate || dates.Len() != 2 || dates.Nullability.Count() != 2 {
+		t.Errorf("expecting nulls to widen into two null dates, got %+v", dates)
+	}
+}
+
+func TestConvertingChunks(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		values   []string
+		target   Dtype
+		expected []string
+	}{
+		{DtypeInt, []string{"1", "", "-3"}, DtypeString, []string{"1", "", "-3"}},
+		{DtypeInt, []string{"1", "2"}, DtypeFloat, []string{"1", "2"}},
+		{DtypeString, []string{"1", "", "02"}, DtypeInt, []string{"1", "", "2"}},
+		{DtypeString, []string{"1.5", "2"}, DtypeDecimal, []string{"1.5", "2"}},
+		{DtypeString, []string{"t", "false"}, DtypeBool, []string{"true", "false"}},
+		{DtypeFloat, []string{"1.5", "1e30", ""}, DtypeString, []string{"1.5", "1e+30", ""}},
+		{DtypeDate, []string{"2020-02-20", ""}, DtypeString, []string{"2020-02-20", ""}},
+		{DtypeString, []string{"2020-02-20 12:34:56"}, DtypeDatetime, []string{"2020-02-20 12:34:56"}},
+		{DtypeDatetime, []string{"2020-02-20 12:34:56.123456"}, DtypeString, []string{"2020-02-20 12:34:56.123456"}},
+		{DtypeBool, []string{"true", ""}, DtypeString, []string{"true", ""}},
+		{DtypeDecimal, []string{"1.23"}, DtypeString, []string{"1.23"}},
+		{DtypeNull, []string{"", ""}, DtypeInt, []string{"", ""}},
+	}
+	for _, test := range tests {
+		chunk := NewChunk(test.dtype)
+		if err := chunk.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		converted, err := chunk.Convert(test.target, FloatSpecialsAsNulls)
+		if err != nil {
+			t.Errorf("cannot convert %v into %v: %v", test.values, test.target, err)
+			continue
+		}
+		expected := NewChunk(test.target)
+		if err := expected.AddValues(test.expected); err != nil {
+			t.Fatal(err)
+		}
+		if !ChunksEqual(converted, expected) {
+			t.Errorf("expecting %v to convert into %v, got %v", test.values, expected, converted)
+		}
+	}
+
+	failing := []struct {
+		dtype  Dtype
+		values []string
+		target Dtype
+	}{
+		{DtypeString, []string{"1", "abc"}, DtypeInt},
+		{DtypeFloat, []string{"1.5"}, DtypeInt},
+		{DtypeInt, []string{"1"}, DtypeDate},
+		{DtypeInt, []string{"1"}, DtypeNull},
+		{DtypeInt, []string{"1"}, DtypeInvalid},
+	}
+	for _, test := range failing {
+		chunk := NewChunk(test.dtype)
+		if err := chunk.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chunk.Convert(test.target, FloatSpecialsAsNulls); !errors.Is(err, errCannotCastToType) {
+			t.Errorf("expecting %v not to convert into %v, got %v", test.values, test.target, err)
+		}
+	}
+}
+
+func TestConvertingChunksLeniently(t *testing.T) {
+	tests := []struct {
+		values    []string
+		target    Dtype
+		expected  []string
+		conflicts []ConversionConflict
+	}{
+		{[]string{"1", "abc", "", "3"}, DtypeInt, []string{"1", "", "", "3"}, []ConversionConflict{{1, "abc"}}},
+		{[]string{"1.5", "n/a", "foo"}, DtypeFloat, []string{"1.5", "", ""}, []ConversionConflict{{1, "n/a"}, {2, "foo"}}},
+		{[]string{"2020-02-20", "2020-02-30"}, DtypeDate, []string{"2020-02-20", ""}, []ConversionConflict{{1, "2020-02-30"}}},
+		{[]string{"1", "2"}, DtypeInt, []string{"1", "2"}, nil},
+		{[]string{"foo"}, DtypeString, []string{"foo"}, nil},
+	}
+	for _, test := range tests {
+		chunk := NewChunk(DtypeString)
+		if err := chunk.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		converted, conflicts, err := chunk.ConvertLenient(test.target, FloatSpecialsAsNulls)
+		if err != nil {
+			t.Errorf("cannot convert %v into %v: %v", test.values, test.target, err)
+			continue
+		}
+		expected := NewChunk(test.target)
+		if err := expected.AddValues(test.expected); err != nil {
+			t.Fatal(err)
+		}
+		if !ChunksEqual(converted, expected) {
+			t.Errorf("expecting %v to convert into %v, got %v", test.values, expected, converted)
+		}
+		if !reflect.DeepEqual(conflicts, test.conflicts) {
+			t.Errorf("expecting %v to conflict with %v in %+v, got %+v", test.values, test.target, test.conflicts, conflicts)
+		}
+	}
+
+	chunk := NewChunk(DtypeInt)
+	if err := chunk.AddValues([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := chunk.ConvertLenient(DtypeNull, FloatSpecialsAsNulls); !errors.Is(err, errCannotCastToType) {
+		t.Errorf("expecting ints not to convert into nulls, got %v", err)
+	}
+}
+
+func TestCastingValues(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		values   []string
+		target   Dtype
+		strict   bool
+		expected []string
+	}{
+		{DtypeString, []string{"1", "", "02"}, DtypeInt, true, []string{"1", "", "2"}},
+		{DtypeString, []string{"1", "foo", "1.5"}, DtypeInt, false, []string{"1", "", ""}},
+		{DtypeFloat, []string{"1.5", "2", ""}, DtypeInt, false, []string{"", "2", ""}},
+		{DtypeInt, []string{"1", "2"}, DtypeFloat, true, []string{"1", "2"}},
+		{DtypeDatetime, []string{"2020-02-20 12:34:56", ""}, DtypeDate, true, []string{"2020-02-20", ""}},
+		{DtypeDate, []string{"2020-02-20"}, DtypeDatetime, true, []string{"2020-02-20 00:00:00"}},
+		{DtypeString, []string{"2020-02-20", "2020-02-30"}, DtypeDate, false, []string{"2020-02-20", ""}},
+		{DtypeNull, []string{"", ""}, DtypeString, true, []string{"", ""}},
+	}
+	for _, test := range tests {
+		chunk := NewChunk(test.dtype)
+		if err := chunk.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		cast, err := chunk.castValues(test.target, test.strict)
+		if err != nil {
+			t.Errorf("cannot cast %v into %v: %v", test.values, test.target, err)
+			continue
+		}
+		expected := NewChunk(test.target)
+		if err := expected.AddValues(test.expected); err != nil {
+			t.Fatal(err)
+		}
+		if test.target == DtypeString {
+			// null strings cannot be loaded (they load as empty strings), so we need to nullify them
+			expected.Nullify(bitmap.NewBitmapFromBools([]bool{true, true}))
+		}
+		if !ChunksEqual(cast, expected) {
+			t.Errorf("expecting %v to cast into %v, got %v", test.values, expected, cast)
+		}
+	}
+
+	strs := newChunkStringsFromSlice([]string{"1", "foo"}, nil)
+	if _, err := strs.castValues(DtypeInt, true); !errors.Is(err, errCannotCastToType) {
+		t.Errorf("expecting a strict cast of invalid values to fail with %v, got %v", errCannotCastToType, err)
+	}
+
+	// literals stay literals, unless they cannot be converted
+	lit, err := NewChunkLiteralStrings("123", 3).castValues(DtypeInt, true)
+	if err != nil || !ChunksEqual(lit, NewChunkLiteralInts(123, 3)) {
+		t.Errorf("expecting a literal to cast into a literal, got %v (%v)", lit, err)
+	}
+	nulls, err := NewChunkLiteralStrings("foo", 3).castValues(DtypeInt, false)
+	if err != nil || nulls.IsLiteral || nulls.Nullability.Count() != 3 {
+		t.Errorf("expecting an invalid literal to cast into nulls, got %v (%v)", nulls, err)
+	}
+	if _, err := NewChunkLiteralStrings("foo", 3).castValues(DtypeInt, true); !errors.Is(err, errCannotCastToType) {
+		t.Errorf("expecting a strict cast of an invalid literal to fail with %v, got %v", errCannotCastToType, err)
+	}
+	if _, err := CastType("blob"); !errors.Is(err, errCannotCastToType) {
+		t.Errorf("expecting an unknown type to fail with %v, got %v", errCannotCastToType, err)
+	}
+}
@@ -5,18 +5,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"math"
 	"reflect"
+	"strconv"
 
 	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
 )
 
 var errAppendTypeMismatch = errors.New("cannot append chunks of differing types")
 var errNoAddToLiterals = errors.New("literal chunks are not meant to be added values to")
 var errLiteralsCannotBeSerialised = errors.New("cannot serialise literal columns")
 var errInvalidTypedLiteral = errors.New("invalid data supplied to a literal constructor")
+var errNotStrings = errors.New("only string chunks can be split into offsets and contents")
+var errInvalidStringOffsets = errors.New("string offsets do not match string contents")
+var errInvalidJSON = errs.New(errs.ErrBadRequest, "invalid JSON document")
 
 // Chunk defines a part of a column - constant type, stored contiguously
 type Chunk struct {
@@ -29,10 +33,13 @@ type Chunk struct {
 		floats    []float64
 		dates     []date
 		datetimes []datetime
+		decimals  []decimal
 		bools     *bitmap.Bitmap
 
 		strings []byte
 		offsets []uint32
+		// string chunks may be loaded without their contents (see DeserializeOffsets)
+		offsetsOnly bool
 	}
 }
 
@@ -44,7 +51,7 @@ func NewChunk(dtype Dtype) *Chunk {
 		dtype: dtype,
 	}
 	switch dtype {
-	case DtypeString:
+	case DtypeString, DtypeJSON:
 		ch.storage.offsets = make([]uint32, 1, defaultChunkCap)
 		ch.storage.strings = make([]byte, 0, defaultChunkCap)
 	case DtypeInt:
@@ -55,6 +62,8 @@ func NewChunk(dtype Dtype) *Chunk {
 		ch.storage.dates = make([]date, 0, defaultChunkCap)
 	case DtypeDatetime:
 		ch.storage.datetimes = make([]datetime, 0, defaultChunkCap)
+	case DtypeDecimal:
+		ch.storage.decimals = make([]decimal, 0, defaultChunkCap)
 	case DtypeBool:
 		ch.storage.bools = bitmap.NewBitmap(0)
 	}
@@ -71,12 +80,61 @@ func (ch *Chunk) Len() int {
 	return int(ch.length)
 }
 
+// MemoryUsage approximates how many bytes this chunk has allocated (including the spare capacity
+// of its underlying slices)
+func (ch *Chunk) MemoryUsage() int {
+	size := 0
+	if ch.Nullability != nil {
+		size += 8 * cap(ch.Nullability.Data())
+	}
+	if ch.storage.bools != nil {
+		size += 8 * cap(ch.storage.bools.Data())
+	}
+	size += 8*cap(ch.storage.ints) + 8*cap(ch.storage.floats) + 8*cap(ch.storage.decimals)
+	size += 4*cap(ch.storage.dates) + 8*cap(ch.storage.datetimes)
+	size += cap(ch.storage.strings) + 4*cap(ch.storage.offsets)
+	return size
+}
+
 // ARCH: Nullify does NOT switch the data values to be nulls/empty as well
 func (ch *Chunk) Nullify(bm *bitmap.Bitmap) {
 	// OPTIM: this copies, but it covers all the cases
 	ch.Nullability = bitmap.Or(ch.Nullability, bm)
 }
 
+// FloatPolicy determines how we treat special float values (NaN and infinities)
+type FloatPolicy uint8
+
+const (
+	// FloatSpecialsAsNulls loads special values as nulls (and renders them as nulls when they emerge
+	// in expressions, e.g. in divisions by zero)
+	FloatSpecialsAsNulls FloatPolicy = iota
+	// FloatSpecialsPreserved keeps special values as they are, they are rendered as strings in JSON
+	// ("NaN", "Infinity", "-Infinity"), because JSON has no notion of them
+	FloatSpecialsPreserved
+)
+
+// AddValueWithPolicy is like AddValue, but it can preserve special float values, which we'd
+// otherwise load as nulls
+func (rc *Chunk) AddValueWithPolicy(s string, floats FloatPolicy) error {
+	if rc.dtype != DtypeFloat || floats == FloatSpecialsAsNulls || isNull(s) {
+		return rc.AddValue(s)
+	}
+	if rc.IsLiteral {
+		return fmt.Errorf("cannot add values to literal chunks: %w", errNoAddToLiterals)
+	}
+	val, err := parseFloat(s)
+	if err != nil {
+		return err
+	}
+	rc.storage.floats = append(rc.storage.floats, val)
+	rc.length++
+	if rc.Nullability != nil {
+		rc.Nullability.Ensure(int(rc.length))
+	}
+	return nil
+}
+
 // OPTIM: consider using closures in Chunk { adders [ChunkMax]func(string) error }
 func (rc *Chunk) AddValue(s string) error {
 	if rc.IsLiteral {
@@ -92,6 +150,27 @@ func (rc *Chunk) AddValue(s string) error {
 		rc.storage.offsets = append(rc.storage.offsets, valLen)
 		rc.length++
 
+		if rc.Nullability != nil {
+			rc.Nullability.Ensure(int(rc.length))
+		}
+	case DtypeJSON:
+		// we store raw JSON documents (unlike strings, they can be null)
+		if isNull(s) {
+			if rc.Nullability == nil {
+				rc.Nullability = bitmap.NewBitmap(rc.Len() + 1)
+			}
+			rc.Nullability.Set(rc.Len(), true)
+			rc.storage.offsets = append(rc.storage.offsets, rc.storage.offsets[len(rc.storage.offsets)-1])
+			rc.length++
+			return nil
+		}
+		if !json.Valid([]byte(s)) {
+			return fmt.Errorf("%w: %v", errInvalidJSON, s)
+		}
+		rc.storage.strings = append(rc.storage.strings, []byte(s)...)
+		rc.storage.offsets = append(rc.storage.offsets, rc.storage.offsets[len(rc.storage.offsets)-1]+uint32(len(s)))
+		rc.length++
+
 		if rc.Nullability != nil {
 			rc.Nullability.Ensure(int(rc.length))
 		}
@@ -204,6 +283,27 @@ func (rc *Chunk) AddValue(s string) error {
 		rc.storage.datetimes = append(rc.storage.datetimes, val)
 		rc.length++
 
+		if rc.Nullability != nil {
+			rc.Nullability.Ensure(int(rc.length))
+		}
+	case DtypeDecimal:
+		if isNull(s) {
+			if rc.Nullability == nil {
+				rc.Nullability = bitmap.NewBitmap(rc.Len() + 1)
+			}
+			rc.Nullability.Set(rc.Len(), true)
+			rc.storage.decimals = append(rc.storage.decimals, 0) // this value is not meant to be read
+			rc.length++
+			return nil
+		}
+
+		val, err := parseDecimal(s)
+		if err != nil {
+			return err
+		}
+		rc.storage.decimals = append(rc.storage.decimals, val)
+		rc.length++
+
 		if rc.Nullability != nil {
 			rc.Nullability.Ensure(int(rc.length))
 		}
@@ -245,14 +345,14 @@ func ChunksEqual(c1 *Chunk, c2 *Chunk) bool {
 		return false
 	}
 
-	if c1.Nullability == nil && c2.Nullability == nil {
+	// NaNs are equal to each other here (like in Compare), DeepEqual would consider them different
+	if c1.Nullability == nil && c2.Nullability == nil && c1.dtype != DtypeFloat {
 		return reflect.DeepEqual(c1, c2)
 	}
 
 	switch c1.dtype {
 	case DtypeBool:
-		// compare only the valid bits in data
-		// ARCH: what about the bits beyond the cap?
+		// compare only the valid bits in data (bits beyond the bitmaps' lengths are always cleared)
 		// OPTIM: we don't have to clone here - we can easily iterate and check by blocks
 		// data1[j] & ~nullability1[j] == data2[j] & ~nullability2[j] or something like that
 		c1d := c1.storage.bools.Clone()
@@ -271,16 +371,20 @@ func ChunksEqual(c1 *Chunk, c2 *Chunk) bool {
 		}
 		return true
 	case DtypeFloat:
-		for j := 0; j < c1.Len(); j++ {
-			if c1.Nullability.Get(j) {
+		if c1.IsLiteral != c2.IsLiteral {
+			return false
+		}
+		for j, v1 := range c1.storage.floats {
+			if c1.Nullability != nil && c1.Nullability.Get(j) {
 				continue
 			}
-			if c1.storage.floats[j] != c2.storage.floats[j] {
+			v2 := c2.storage.floats[j]
+			if v1 != v2 && !(math.IsNaN(v1) && math.IsNaN(v2)) {
 				return false
 			}
 		}
 		return true
-	case DtypeString:
+	case DtypeString, DtypeJSON:
 		for j := 0; j < c1.Len(); j++ {
 			if c1.Nullability.Get(j) {
 				continue
@@ -310,6 +414,16 @@ func ChunksEqual(c1 *Chunk, c2 *Chunk) bool {
 			}
 		}
 		return true
+	case DtypeDecimal:
+		for j := 0; j < c1.Len(); j++ {
+			if c1.Nullability.Get(j) {
+				continue
+			}
+			if c1.storage.decimals[j] != c2.storage.decimals[j] {
+				return false
+			}
+		}
+		return true
 	case DtypeNull:
 		return c1.length == c2.length
 	default:
@@ -351,7 +465,10 @@ func NewChunkLiteralTyped(s string, dtype Dtype, length int) (*Chunk, error) {
 		}
 		ch.storage.bools = bm
 		return ch, nil
-	case DtypeString:
+	case DtypeString, DtypeJSON:
+		if dtype == DtypeJSON && !json.Valid([]byte(s)) {
+			return nil, fmt.Errorf("%w: invalid typed literal: %v", errInvalidTypedLiteral, s)
+		}
 		ch.storage.strings = []byte(s)
 		ch.storage.offsets = []uint32{0, uint32(len(s))}
 
@@ -371,6 +488,13 @@ func NewChunkLiteralTyped(s string, dtype Dtype, length int) (*Chunk, error) {
 		}
 		ch.storage.datetimes = []datetime{val}
 		return ch, nil
+	case DtypeDecimal:
+		val, err := parseDecimal(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid typed literal: %v", errInvalidTypedLiteral, s)
+		}
+		ch.storage.decimals = []decimal{val}
+		return ch, nil
 	case DtypeNull:
 		return ch, nil
 	default:
@@ -446,6 +570,26 @@ func NewChunkLiteralDatetimes(value datetime, length int) *Chunk {
 	return ch
 }
 
+func NewChunkLiteralDecimals(value decimal, length int) *Chunk {
+	ch := NewChunk(DtypeDecimal)
+	ch.IsLiteral = true
+	ch.length = uint32(length)
+	ch.storage.decimals = []decimal{value}
+
+	return ch
+}
+
+// LiteralOfLength returns a copy of a literal chunk, but of a given length (literals only hold
+// a single value, so this is cheap)
+func (rc *Chunk) LiteralOfLength(length int) *Chunk {
+	if !rc.IsLiteral {
+		panic("can only run LiteralOfLength() on literal chunks")
+	}
+	ch := rc.Clone()
+	ch.length = uint32(length)
+	return ch
+}
+
 // TODO/ARCH: consider removing this in favour of NewChunkBoolsFromBitmap
 func newChunkBoolsFromBits(data []uint64, length int) *Chunk {
 	ch := NewChunk(DtypeBool)
@@ -459,7 +603,7 @@ func newChunkBoolsFromBits(data []uint64, length int) *Chunk {
 // it uses it as is - the caller might want to clone it aims to mutate it in the future
 func NewChunkBoolsFromBitmap(bm *bitmap.Bitmap) *Chunk {
 	ch := NewChunk(DtypeBool)
-	ch.length = uint32(bm.Cap())
+	ch.length = uint32(bm.Len())
 	ch.storage.bools = bm
 
 	return ch
@@ -498,6 +642,14 @@ func newChunkDatetimesFromSlice(data []datetime, nulls *bitmap.Bitmap) *Chunk {
 
 	return ch
 }
+func newChunkDecimalsFromSlice(data []decimal, nulls *bitmap.Bitmap) *Chunk {
+	ch := NewChunk(DtypeDecimal)
+	ch.Nullability = nulls
+	ch.length = uint32(len(data))
+	ch.storage.decimals = data
+
+	return ch
+}
 func newChunkStringsFromSlice(data []string, nulls *bitmap.Bitmap) *Chunk {
 	rc := NewChunk(DtypeString)
 	if err := rc.AddValues(data); err != nil {
@@ -511,6 +663,13 @@ func newChunkStringsFromSlice(data []string, nulls *bitmap.Bitmap) *Chunk {
 // that are null - we use this for filtering, when we're interested in non-null
 // true values (to select given rows)
 func (rc *Chunk) Truths() *bitmap.Bitmap {
+	bm, _ := rc.TruthsCount()
+	return bm
+}
+
+// TruthsCount is Truths, it also returns the number of true values, which gets counted
+// while the bitmap is being built (filters need both)
+func (rc *Chunk) TruthsCount() (*bitmap.Bitmap, int) {
 	if rc.dtype != DtypeBool {
 		panic("can only run Truths() on bool chunks")
 	}
@@ -518,19 +677,15 @@ func (rc *Chunk) Truths() *bitmap.Bitmap {
 		// ARCH: still assuming literals are not nullable
 		value := rc.storage.bools.Get(0)
 		bm := bitmap.NewBitmap(rc.Len())
-		if value {
-			bm.Invert()
+		if !value {
+			return bm, 0
 		}
-		return bm
-	}
-	bm := rc.storage.bools.Clone()
-	if rc.Nullability == nil || rc.Nullability.Count() == 0 {
-		return bm
+		bm.Invert()
+		return bm, rc.Len()
 	}
-	// cloning was necessary as AndNot mutates (and we're cloning for good measure - we
-	// don't expect to mutate this downstream, but...)
-	bm.AndNot(rc.Nullability)
-	return bm
+	// we always return a copy, even if there are no nulls (we don't expect to mutate this
+	// downstream, but...)
+	return bitmap.AndNotCount(rc.storage.bools, rc.Nullability)
 }
 
 // TODO: does not support nullability, we should probably get rid of the whole thing anyway (only used for testing now)
@@ -547,10 +702,21 @@ func (rc *Chunk) nthValue(n int) string {
 	return string(rc.storage.strings[offsetStart:offsetEnd])
 }
 
+// valueIndex locates the nth row's value in fixed width storage (literals only store one value)
+func (rc *Chunk) valueIndex(n int) int {
+	if rc.IsLiteral {
+		return 0
+	}
+	return n
+}
+
 const hashNull = uint64(0xe96766e0d6221951)
 const hashBoolTrue = uint64(0x5a320fa8dfcfe3a7)
 const hashBoolFalse = uint64(0x1549571b97ff2995)
 
+// the bit pattern of math.NaN()
+const canonicalNaN = uint64(0x7ff8000000000001)
+
 // Since XOR is commutative, we can't group (a, b, c) by hashing
 // each separately and xoring, because that will hash to the same
 // value as (c, b, a). So we'll multiply each hash by a large odd
@@ -561,24 +727,40 @@ func positionMultiplier(position int) uint64 {
 	return mul * mul * mul * mul * mul * mul * mul * mul // math.pow is for floats only :shrug:
 }
 
+// canonicalFloatBits maps floats that are equal as far as grouping goes to the same bits - negative
+// zero is zero and all NaNs (they come in many bit patterns) are the same value (like in Compare)
+func canonicalFloatBits(val float64) uint64 {
+	switch {
+	case val == 0:
+		return 0
+	case math.IsNaN(val):
+		return canonicalNaN
+	}
+	return math.Float64bits(val)
+}
+
 // TODO(generics): type Hasher[T] struct {...}, Sum[T] -> uint64
 
-// Hash hashes this chunk's values into a provded container
-// OPTIM/TODO(next): do we need a fnv hasher for ints/floats/dates? We can just take the uint64 representation
-// of these values... or not?
-// Hash hashes this chunk's values into a provded container
-// OPTIM: maphash might be faster than fnv or maphash? test it and if it is so, implement
-// everywhere, but be careful about the seed (needs to be the same for all chunks)
-// careful about maphash: "The hash value of a given byte sequence is consistent within a single process, but will be different in different processes."
-// oh and I rebenchmarked maphash and fnv and found maphash to be much slower (despite no allocs)
-// also, check this https://github.com/segmentio/fasthash/ (via https://segment.com/blog/allocation-efficiency-in-high-performance-go-services/)
-// they reimplement fnv using stack allocation only
-//   - we tested it and got a 90% speedup (no allocs, shorter code) - so let's consider it, it's in the fasthash branch
+// hashLiteral xors a literal's hash into all the hashes
+func hashLiteral(hashes []uint64, hash uint64) {
+	for j := range hashes {
+		hashes[j] ^= hash
+	}
+}
+
+// Hash hashes this chunk's values into a provded container, values equal across chunks (and
+// stripes) hash the same, hashes of values in different positions (see positionMultiplier) are
+// combined using XOR, so that we get a hash of a whole row
+// Fixed width values get hashed by their uint64 representation, strings by their bytes, both using
+// FNV-1 (see fnvUint64), which doesn't allocate
+// ARCH: maphash would be an option, but it's slower and its hashes differ across processes
 // OPTIM: use closures [DtypeMax]func(...) within the Chunk struct instead of this big switch
+// OPTIM: we might want to check rc.Nullability just once and have two separate loops - see if it
+// helps - it may bloat the code too much
 func (rc *Chunk) Hash(position int, hashes []uint64) {
 	mul := positionMultiplier(position)
-	var buf [8]byte
-	hasher := fnv.New64()
+	nulls := rc.Nullability
+	nullHash := hashNull * mul
 
 	switch rc.dtype {
 	case DtypeBool:
@@ -588,9 +770,7 @@ func (rc *Chunk) Hash(position int, hashes []uint64) {
 			if rc.storage.bools.Get(0) {
 				hashVal = hashBoolTrue
 			}
-			for j := range hashes {
-				hashes[j] ^= hashVal * mul
-			}
+			hashLiteral(hashes, hashVal*mul)
 			return
 		}
 		for j := 0; j < rc.Len(); j++ {
@@ -600,8 +780,8 @@ func (rc *Chunk) Hash(position int, hashes []uint64) {
 			// 	val := uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
 			// 	fmt.Printf("%x, %v\n", val, bits.OnesCount64(val))
 			// }
-			if rc.Nullability != nil && rc.Nullability.Get(j) {
-				hashes[j] ^= hashNull * mul
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
 				continue
 			}
 			if rc.storage.bools.Get(j) {
@@ -612,126 +792,149 @@ func (rc *Chunk) Hash(position int, hashes []uint64) {
 		}
 	case DtypeFloat:
 		if rc.IsLiteral {
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(rc.storage.floats[0]))
-			hasher.Write(buf[:])
-			sum := hasher.Sum64() * mul
-
-			for j := range hashes {
-				hashes[j] ^= sum
-			}
+			hashLiteral(hashes, fnvUint64(canonicalFloatBits(rc.storage.floats[0]))*mul)
 			return
 		}
 		for j, el := range rc.storage.floats {
-			if rc.Nullability != nil && rc.Nullability.Get(j) {
-				hashes[j] ^= hashNull * mul
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
 				continue
 			}
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(el))
-			hasher.Write(buf[:])
-			hashes[j] ^= hasher.Sum64() * mul
-			hasher.Reset()
+			hashes[j] ^= fnvUint64(canonicalFloatBits(el)) * mul
 		}
 	case DtypeInt:
 		// ARCH: literal chunks don't have nullability support... should we check for that?
 		if rc.IsLiteral {
-			binary.LittleEndian.PutUint64(buf[:], uint64(rc.storage.ints[0]))
-			hasher.Write(buf[:])
-			sum := hasher.Sum64() * mul
-
-			for j := range hashes {
-				hashes[j] ^= sum
-			}
+			hashLiteral(hashes, fnvUint64(uint64(rc.storage.ints[0]))*mul)
 			return
 		}
 		for j, el := range rc.storage.ints {
-			// OPTIM: not just here, in all of these Hash implementations - we might want to check rc.nullability
-			// just once and have two separate loops - see if it helps - it may bloat the code too much (and avoid inlining,
-			// but that's probably a lost cause already)
-			if rc.Nullability != nil && rc.Nullability.Get(j) {
-				hashes[j] ^= hashNull * mul
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
 				continue
 			}
-			binary.LittleEndian.PutUint64(buf[:], uint64(el)) // int64 always maps to a uint64 value (negatives underflow)
-			hasher.Write(buf[:])
-			hashes[j] ^= hasher.Sum64() * mul
-			hasher.Reset()
+			hashes[j] ^= fnvUint64(uint64(el)) * mul // int64 always maps to a uint64 value (negatives underflow)
 		}
 	case DtypeNull:
-		for j := range hashes {
-			hashes[j] ^= hashNull * mul
-		}
+		hashLiteral(hashes, nullHash)
 	case DtypeDate:
-		// ARCH: literal chunks don't have nullability support... should we check for that?
 		if rc.IsLiteral {
-			binary.LittleEndian.PutUint64(buf[:], uint64(rc.storage.dates[0]))
-			hasher.Write(buf[:])
-			sum := hasher.Sum64() * mul
-
-			for j := range hashes {
-				hashes[j] ^= sum
-			}
+			hashLiteral(hashes, fnvUint64(uint64(rc.storage.dates[0]))*mul)
 			return
 		}
 		for j, el := range rc.storage.dates {
-			if rc.Nullability != nil && rc.Nullability.Get(j) {
-				hashes[j] ^= hashNull * mul
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
 				continue
 			}
-			binary.LittleEndian.PutUint64(buf[:], uint64(el))
-			hasher.Write(buf[:])
-			hashes[j] ^= hasher.Sum64() * mul
-			hasher.Reset()
+			hashes[j] ^= fnvUint64(uint64(el)) * mul
 		}
 	case DtypeDatetime:
-		// ARCH: literal chunks don't have nullability support... should we check for that?
 		if rc.IsLiteral {
-			binary.LittleEndian.PutUint64(buf[:], uint64(rc.storage.datetimes[0]))
-			hasher.Write(buf[:])
-			sum := hasher.Sum64() * mul
-
-			for j := range hashes {
-				hashes[j] ^= sum
-			}
+			hashLiteral(hashes, fnvUint64(uint64(rc.storage.datetimes[0]))*mul)
 			return
 		}
 		for j, el := range rc.storage.datetimes {
-			if rc.Nullability != nil && rc.Nullability.Get(j) {
-				hashes[j] ^= hashNull * mul
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
 				continue
 			}
-			binary.LittleEndian.PutUint64(buf[:], uint64(el))
-			hasher.Write(buf[:])
-			hashes[j] ^= hasher.Sum64() * mul
-			hasher.Reset()
+			hashes[j] ^= fnvUint64(uint64(el)) * mul
 		}
-	case DtypeString:
+	case DtypeDecimal:
+		// decimals carry their own scale, but 12.3 and 12.30 need to hash the same, so we
+		// normalise them first
 		if rc.IsLiteral {
-			offsetStart, offsetEnd := rc.storage.offsets[0], rc.storage.offsets[1]
-			hasher.Write(rc.storage.strings[offsetStart:offsetEnd])
-			sum := hasher.Sum64() * mul
-
-			for j := range hashes {
-				hashes[j] ^= sum
+			hashLiteral(hashes, fnvUint64(uint64(rc.storage.decimals[0].normalise()))*mul)
+			return
+		}
+		for j, el := range rc.storage.decimals {
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
+				continue
 			}
+			hashes[j] ^= fnvUint64(uint64(el.normalise())) * mul
+		}
+	case DtypeString, DtypeJSON:
+		offsets, data := rc.storage.offsets, rc.storage.strings
+		if rc.IsLiteral {
+			hashLiteral(hashes, fnvBytes(data[offsets[0]:offsets[1]])*mul)
 			return
 		}
-
 		for j := 0; j < rc.Len(); j++ {
-			if rc.Nullability != nil && rc.Nullability.Get(j) {
-				hashes[j] ^= hashNull * mul
+			if nulls != nil && nulls.Get(j) {
+				hashes[j] ^= nullHash
 				continue
 			}
-			offsetStart := rc.storage.offsets[j]
-			offsetEnd := rc.storage.offsets[j+1]
-			hasher.Write(rc.storage.strings[offsetStart:offsetEnd])
-			hashes[j] ^= hasher.Sum64() * mul
-			hasher.Reset()
+			hashes[j] ^= fnvBytes(data[offsets[j]:offsets[j+1]]) * mul
 		}
 	default:
 		panic(fmt.Sprintf("no support for hashing for dtype %v", rc.dtype))
 	}
 }
 
+// StableHash hashes the nth value of an int or a string chunk, unlike Hash, this hash is persisted
+// (in bloom filters), so it must not change across versions. It returns false for nulls and for
+// other types.
+func (rc *Chunk) StableHash(n int) (uint64, bool) {
+	if rc.IsLiteral {
+		n = 0
+	}
+	if rc.Nullability != nil && rc.Nullability.Get(n) {
+		return 0, false
+	}
+	var hash uint64
+	switch rc.dtype {
+	case DtypeInt:
+		hash = fnv1aUint64(uint64(rc.storage.ints[n]))
+	case DtypeString, DtypeJSON:
+		hash = fnv1aBytes(rc.storage.strings[rc.storage.offsets[n]:rc.storage.offsets[n+1]])
+	default:
+		return 0, false
+	}
+	// fnv doesn't mix its upper bits well, so we finalise it the same way splitmix64 does
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	return hash ^ (hash >> 31), true
+}
+
+// Grow reserves room for n more values, so that appending them (e.g. when combining many stripes,
+// see Append) doesn't keep reallocating our storage. This is a no-op if there's enough room already.
+// ARCH: we don't know how long strings will be, so we only reserve their offsets, their contents
+// (and bitmaps - bools and nullability) grow as usual
+func (rc *Chunk) Grow(n int) {
+	if rc.IsLiteral || n <= 0 {
+		return
+	}
+	// appending a freshly made slice doesn't allocate it, it only extends our own slice
+	switch rc.dtype {
+	case DtypeString, DtypeJSON:
+		if cap(rc.storage.offsets)-len(rc.storage.offsets) < n {
+			rc.storage.offsets = append(rc.storage.offsets, make([]uint32, n)...)[:len(rc.storage.offsets)]
+		}
+	case DtypeInt:
+		if cap(rc.storage.ints)-len(rc.storage.ints) < n {
+			rc.storage.ints = append(rc.storage.ints, make([]int64, n)...)[:len(rc.storage.ints)]
+		}
+	case DtypeFloat:
+		if cap(rc.storage.floats)-len(rc.storage.floats) < n {
+			rc.storage.floats = append(rc.storage.floats, make([]float64, n)...)[:len(rc.storage.floats)]
+		}
+	case DtypeDate:
+		if cap(rc.storage.dates)-len(rc.storage.dates) < n {
+			rc.storage.dates = append(rc.storage.dates, make([]date, n)...)[:len(rc.storage.dates)]
+		}
+	case DtypeDatetime:
+		if cap(rc.storage.datetimes)-len(rc.storage.datetimes) < n {
+			rc.storage.datetimes = append(rc.storage.datetimes, make([]datetime, n)...)[:len(rc.storage.datetimes)]
+		}
+	case DtypeDecimal:
+		if cap(rc.storage.decimals)-len(rc.storage.decimals) < n {
+			rc.storage.decimals = append(rc.storage.decimals, make([]decimal, n)...)[:len(rc.storage.decimals)]
+		}
+	}
+}
+
 func (rc *Chunk) Append(nrc *Chunk) error {
 	if rc.IsLiteral {
 		return fmt.Errorf("cannot add values to literal chunks: %w", errNoAddToLiterals)
@@ -743,15 +946,17 @@ func (rc *Chunk) Append(nrc *Chunk) error {
 	if rc.Nullability == nil && nrc.Nullability != nil {
 		rc.Nullability = bitmap.NewBitmap(rc.Len())
 	}
-	if nrc.Nullability == nil && rc.Nullability != nil {
-		nrc.Nullability = bitmap.NewBitmap(nrc.Len())
+	// the appended chunk may be shared (e.g. cached), so we don't touch its nullability
+	nullability := nrc.Nullability
+	if nullability == nil && rc.Nullability != nil {
+		nullability = bitmap.NewBitmap(nrc.Len())
 	}
 	if rc.Nullability != nil {
-		rc.Nullability.Append(nrc.Nullability)
+		rc.Nullability.Append(nullability)
 	}
 
 	switch rc.dtype {
-	case DtypeString:
+	case DtypeString, DtypeJSON:
 		off := uint32(0)
 		if rc.length > 0 {
 			off = rc.storage.offsets[len(rc.storage.offsets)-1]
@@ -814,6 +1019,15 @@ func (rc *Chunk) Append(nrc *Chunk) error {
 		} else {
 			rc.storage.datetimes = append(rc.storage.datetimes, nrc.storage.datetimes...)
 		}
+	case DtypeDecimal:
+		if nrc.IsLiteral {
+			value := nrc.storage.decimals[0]
+			for j := 0; j < nrc.Len(); j++ {
+				rc.storage.decimals = append(rc.storage.decimals, value)
+			}
+		} else {
+			rc.storage.decimals = append(rc.storage.decimals, nrc.storage.decimals...)
+		}
 	case DtypeNull:
 		// we only need to increase its length, and that's already done
 	default:
@@ -828,39 +1042,118 @@ func (rc *Chunk) Append(nrc *Chunk) error {
 // Prune filter this chunk and only preserves values for which the bitmap is set
 func (rc *Chunk) Prune(bm *bitmap.Bitmap) *Chunk {
 	if rc.IsLiteral {
-		// TODO: pruning could be implemented by hydrating this chunk (disabling isLiteral)
-		panic("pruning not supported in literal chunks")
+		// all the values are the same, so we only need to shorten the literal
+		nc := rc.Clone()
+		nc.length = 0
+		if bm != nil {
+			nc.length = uint32(bm.Count())
+		}
+		return nc
 	}
 	nc := NewChunk(rc.dtype)
 	if bm == nil {
 		return nc
 	}
-	if bm.Cap() != rc.Len() {
+	if bm.Len() != rc.Len() {
 		panic("pruning bitmap does not align with the dataset")
 	}
 
 	// if we're not pruning anything, we might just return ourselves
 	// we don't need to clone anything, since the Chunk itself is immutable, right?
 	// well... appends?
-	if bm.Count() == rc.Len() {
+	count := bm.Count()
+	if count == rc.Len() {
 		return rc
 	}
 
 	// we can short-circuit null-chunks
 	if rc.dtype == DtypeNull {
-		nc.length = uint32(bm.Count())
+		nc.length = uint32(count)
 		return nc
 	}
 
-	// OPTIM: nthValue is not the fastest, just iterate over offsets directly
-	// OR, just iterate over positive bits in our Bitmap - this will be super fast for sparse bitmaps
-	// the bitmap iteration could be implemented in all the typed chunks
-	index := 0
-	for j := 0; j < rc.Len(); j++ {
-		if !bm.Get(j) {
-			continue
+	// we only visit rows that survive the pruning, so sparse bitmaps (selective filters) are cheap
+	it := bm.Iterator()
+	switch rc.dtype {
+	case DtypeInt:
+		nc.storage.ints = make([]int64, 0, count)
+		for j := it.Next(); j != -1; j = it.Next() {
+			nc.storage.ints = append(nc.storage.ints, rc.storage.ints[j])
+		}
+	case DtypeFloat:
+		nc.storage.floats = make([]float64, 0, count)
+		for j := it.Next(); j != -1; j = it.Next() {
+			nc.storage.floats = append(nc.storage.floats, rc.storage.floats[j])
+		}
+	case DtypeDate:
+		nc.storage.dates = make([]date, 0, count)
+		for j := it.Next(); j != -1; j = it.Next() {
+			nc.storage.dates = append(nc.storage.dates, rc.storage.dates[j])
+		}
+	case DtypeDatetime:
+		nc.storage.datetimes = make([]datetime, 0, count)
+		for j := it.Next(); j != -1; j = it.Next() {
+			nc.storage.datetimes = append(nc.storage.datetimes, rc.storage.datetimes[j])
+		}
+	case DtypeDecimal:
+		nc.storage.decimals = make([]decimal, 0, count)
+		for j := it.Next(); j != -1; j = it.Next() {
+			nc.storage.decimals = append(nc.storage.decimals, rc.storage.decimals[j])
+		}
+	case DtypeBool:
+		// false values are already set as zeroes
+		nc.storage.bools = bitmap.NewBitmap(count)
+		for index, j := 0, it.Next(); j != -1; index, j = index+1, it.Next() {
+			if rc.storage.bools.Get(j) {
+				nc.storage.bools.Set(index, true)
+			}
+		}
+	case DtypeString, DtypeJSON:
+		// when we don't have the contents (offsetsOnly), we can still keep track of lengths
+		offsetsOnly := rc.storage.offsetsOnly
+		nc.storage.offsets = make([]uint32, 1, count+1)
+		nc.storage.offsetsOnly = offsetsOnly
+		for j := it.Next(); j != -1; j = it.Next() {
+			start, end := rc.storage.offsets[j], rc.storage.offsets[j+1]
+			if !offsetsOnly {
+				nc.storage.strings = append(nc.storage.strings, rc.storage.strings[start:end]...)
+			}
+			nc.storage.offsets = append(nc.storage.offsets, nc.storage.offsets[len(nc.storage.offsets)-1]+end-start)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported dtype for pruning: %v", rc.dtype))
+	}
+	nc.length = uint32(count)
+
+	if rc.Nullability != nil {
+		it := bm.Iterator()
+		for index, j := 0, it.Next(); j != -1; index, j = index+1, it.Next() {
+			if !rc.Nullability.Get(j) {
+				continue
+			}
+			// ARCH: consider making Set a package function (bitmap.Set) to handle nilness
+			if nc.Nullability == nil {
+				nc.Nullability = bitmap.NewBitmap(count)
+			}
+			nc.Nullability.Set(index, true)
+		}
+	}
+
+	return nc
+}
+
+// Reorder creates a new chunk with values at given positions (in the order of said positions),
+// positions can be repeated or omitted. Literal chunks get hydrated in the process.
+func (rc *Chunk) Reorder(positions []int) *Chunk {
+	nc := NewChunk(rc.dtype)
+	for index, position := range positions {
+		j := position
+		if rc.IsLiteral {
+			j = 0
 		}
 		switch rc.dtype {
+		case DtypeNull:
+			nc.length++
 		case DtypeInt:
 			nc.storage.ints = append(nc.storage.ints, rc.storage.ints[j])
 			nc.length++
@@ -873,31 +1166,28 @@ func (rc *Chunk) Prune(bm *bitmap.Bitmap) *Chunk {
 		case DtypeDatetime:
 			nc.storage.datetimes = append(nc.storage.datetimes, rc.storage.datetimes[j])
 			nc.length++
+		case DtypeDecimal:
+			nc.storage.decimals = append(nc.storage.decimals, rc.storage.decimals[j])
+			nc.length++
 		case DtypeBool:
-			// OPTIM: not need to set false values, we already have them set as zero
 			nc.storage.bools.Set(index, rc.storage.bools.Get(j))
 			nc.length++
-		case DtypeString:
-			// be careful here, AddValue has its own nullability logic and we don't want to mess with that
+		case DtypeString, DtypeJSON:
 			if err := nc.AddValue(rc.nthValue(j)); err != nil {
 				panic(err)
 			}
 		default:
-			panic(fmt.Sprintf("unsupported dtype for pruning: %v", rc.dtype))
+			panic(fmt.Sprintf("unsupported dtype for reordering: %v", rc.dtype))
 		}
 
 		if rc.Nullability != nil && rc.Nullability.Get(j) {
-			// ARCH: consider making Set a package function (bitmap.Set) to handle nilness
 			if nc.Nullability == nil {
 				nc.Nullability = bitmap.NewBitmap(index)
 			}
 			nc.Nullability.Set(index, true)
 		}
-		// nc.length++ // once we remove AddValue, we'll need this
-		index++
 	}
 
-	// make sure the nullability vector aligns with the data
 	if nc.Nullability != nil {
 		nc.Nullability.Ensure(nc.Len())
 	}
@@ -923,7 +1213,7 @@ func Deserialize(r io.Reader, Dtype Dtype) (*Chunk, error) {
 	// OPTIM/ARCH: if we dump ch.length for strings as well, we can move this deserilisation from the switch
 	// and remove all the repetition
 	switch Dtype {
-	case DtypeString:
+	case DtypeString, DtypeJSON:
 		var lenOffsets uint32
 		if err := binary.Read(r, binary.LittleEndian, &lenOffsets); err != nil {
 			return nil, err
@@ -983,6 +1273,15 @@ func Deserialize(r io.Reader, Dtype Dtype) (*Chunk, error) {
 			return nil, err
 		}
 		return ch, nil
+	case DtypeDecimal:
+		if err := binary.Read(r, binary.LittleEndian, &ch.length); err != nil {
+			return nil, err
+		}
+		ch.storage.decimals = make([]decimal, ch.length)
+		if err := binary.Read(r, binary.LittleEndian, &ch.storage.decimals); err != nil {
+			return nil, err
+		}
+		return ch, nil
 	case DtypeBool:
 		if err := binary.Read(r, binary.LittleEndian, &ch.length); err != nil {
 			return nil, err
@@ -1021,7 +1320,7 @@ func (rc *Chunk) WriteTo(w io.Writer) (int64, error) {
 	}
 
 	switch rc.dtype {
-	case DtypeString:
+	case DtypeString, DtypeJSON:
 		if err := binary.Write(w, binary.LittleEndian, uint32(len(rc.storage.offsets))); err != nil {
 			return 0, err
 		}
@@ -1076,6 +1375,12 @@ func (rc *Chunk) WriteTo(w io.Writer) (int64, error) {
 		}
 		err = binary.Write(w, binary.LittleEndian, rc.storage.datetimes)
 		return int64(nb + 4 + DATETIME_BYTE_SIZE*len(rc.storage.datetimes)), err
+	case DtypeDecimal:
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(rc.storage.decimals))); err != nil {
+			return 0, err
+		}
+		err = binary.Write(w, binary.LittleEndian, rc.storage.decimals)
+		return int64(nb + 4 + DECIMAL_BYTE_SIZE*len(rc.storage.decimals)), err
 	case DtypeNull:
 		length := rc.length
 		if err := binary.Write(w, binary.LittleEndian, length); err != nil {
@@ -1087,6 +1392,108 @@ func (rc *Chunk) WriteTo(w io.Writer) (int64, error) {
 	}
 }
 
+// String chunks can also be serialised in two parts - their offsets (along with nullability) and their
+// contents - so that the two can be stored separately and we can read just the offsets when the
+// contents are not needed, e.g. when evaluating `length(foo)` or `foo IS NULL` (see DeserializeOffsets)
+
+// WriteOffsetsTo writes the first part of a string chunk, it also notes whether its contents have any
+// multi-byte characters, because if they don't, offsets alone tell us lengths of all the strings
+func (rc *Chunk) WriteOffsetsTo(w io.Writer) (int64, error) {
+	if rc.IsLiteral {
+		return 0, errLiteralsCannotBeSerialised
+	}
+	if rc.dtype != DtypeString {
+		return 0, fmt.Errorf("%w: got %v", errNotStrings, rc.dtype)
+	}
+	nb, err := bitmap.Serialize(w, rc.Nullability)
+	if err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(rc.storage.offsets))); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, rc.storage.offsets); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, hasRunes(rc.storage.strings)); err != nil {
+		return 0, err
+	}
+	return int64(nb + 4 + len(rc.storage.offsets)*4 + 1), nil
+}
+
+// WriteStringsTo writes the second part of a string chunk, its contents
+func (rc *Chunk) WriteStringsTo(w io.Writer) (int64, error) {
+	if rc.IsLiteral {
+		return 0, errLiteralsCannotBeSerialised
+	}
+	if rc.dtype != DtypeString {
+		return 0, fmt.Errorf("%w: got %v", errNotStrings, rc.dtype)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(rc.storage.strings))); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(rc.storage.strings); err != nil {
+		return 0, err
+	}
+	return int64(4 + len(rc.storage.strings)), nil
+}
+
+// DeserializeOffsets reads a string chunk without its contents (as written by WriteOffsetsTo), these
+// can be loaded later on using LoadStrings. Until then, the chunk can only be used for things that
+// don't need its contents - its nullability can be checked, it can be pruned and, unless its contents
+// have multi-byte characters (reported here as `runes`), lengths of its strings can be measured.
+func DeserializeOffsets(r io.Reader) (ch *Chunk, runes bool, err error) {
+	ch = NewChunk(DtypeString)
+	bm, err := bitmap.DeserializeBitmapFromReader(r)
+	if err != nil {
+		return nil, false, err
+	}
+	ch.Nullability = bm
+
+	var lenOffsets uint32
+	if err := binary.Read(r, binary.LittleEndian, &lenOffsets); err != nil {
+		return nil, false, err
+	}
+	if lenOffsets == 0 {
+		return nil, false, fmt.Errorf("%w: no offsets", errInvalidStringOffsets)
+	}
+	offsets := make([]uint32, lenOffsets)
+	if err := binary.Read(r, binary.LittleEndian, &offsets); err != nil {
+		return nil, false, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &runes); err != nil {
+		return nil, false, err
+	}
+	ch.length = lenOffsets - 1
+	ch.storage.offsets = offsets
+	ch.storage.strings = nil
+	ch.storage.offsetsOnly = true
+	return ch, runes, nil
+}
+
+// LoadStrings loads contents of a string chunk read using DeserializeOffsets
+func (rc *Chunk) LoadStrings(r io.Reader) error {
+	var lenData uint32
+	if err := binary.Read(r, binary.LittleEndian, &lenData); err != nil {
+		return err
+	}
+	if lenData != rc.storage.offsets[len(rc.storage.offsets)-1] {
+		return fmt.Errorf("%w: expecting %v bytes of strings, got %v", errInvalidStringOffsets, rc.storage.offsets[len(rc.storage.offsets)-1], lenData)
+	}
+	data := make([]byte, lenData)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	rc.storage.strings = data
+	rc.storage.offsetsOnly = false
+	return nil
+}
+
+// OffsetsOnly reports whether a string chunk was loaded without its contents (see DeserializeOffsets)
+func (rc *Chunk) OffsetsOnly() bool {
+	return rc.storage.offsetsOnly
+}
+
 func (rc *Chunk) Clone() *Chunk {
 	var nulls *bitmap.Bitmap
 	if rc.Nullability != nil {
@@ -1104,7 +1511,7 @@ func (rc *Chunk) Clone() *Chunk {
 		}
 	case DtypeNull:
 		// nothing to be done here
-	case DtypeString:
+	case DtypeString, DtypeJSON:
 		ch.storage.offsets = append(rc.storage.offsets[:0:0], rc.storage.offsets...)
 		ch.storage.strings = append(rc.storage.strings[:0:0], rc.storage.strings...)
 	case DtypeFloat:
@@ -1115,14 +1522,29 @@ func (rc *Chunk) Clone() *Chunk {
 		ch.storage.dates = append(rc.storage.dates[:0:0], rc.storage.dates...)
 	case DtypeDatetime:
 		ch.storage.datetimes = append(rc.storage.datetimes[:0:0], rc.storage.datetimes...)
+	case DtypeDecimal:
+		ch.storage.decimals = append(rc.storage.decimals[:0:0], rc.storage.decimals...)
 	}
 
 	return ch
 }
 
 func (rc *Chunk) JSONLiteral(n int) (string, bool) {
+	return rc.JSONLiteralWithPolicy(n, FloatSpecialsAsNulls)
+}
+
+// JSONLiteralWithPolicy is like JSONLiteral, but it can render special float values as strings
+func (rc *Chunk) JSONLiteralWithPolicy(n int, floats FloatPolicy) (string, bool) {
+	ret, ok := rc.AppendJSONLiteral(nil, n, floats)
+	return string(ret), ok
+}
+
+// AppendJSONLiteral appends the nth value (as a JSON literal, see JSONLiteralWithPolicy) to a given
+// buffer, so that serialising lots of values doesn't need to allocate for each of them. Nulls
+// don't get appended, they are only reported by the second return value.
+func (rc *Chunk) AppendJSONLiteral(dst []byte, n int, floats FloatPolicy) ([]byte, bool) {
 	if rc.Nullability != nil && rc.Nullability.Get(n) {
-		return "", false
+		return dst, false
 	}
 
 	switch rc.dtype {
@@ -1133,13 +1555,16 @@ func (rc *Chunk) JSONLiteral(n int) (string, bool) {
 			panic(err)
 		}
 
-		return string(ret), true
+		return append(dst, ret...), true
+	case DtypeJSON:
+		// JSON documents are valid JSON literals on their own
+		return append(dst, rc.nthValue(n)...), true
 	case DtypeInt:
 		if rc.IsLiteral {
-			return fmt.Sprintf("%v", rc.storage.ints[0]), true
+			return strconv.AppendInt(dst, rc.storage.ints[0], 10), true
 		}
 
-		return fmt.Sprintf("%v", rc.storage.ints[n]), true
+		return strconv.AppendInt(dst, rc.storage.ints[n], 10), true
 	case DtypeFloat:
 		val := rc.storage.floats[0]
 		if !rc.IsLiteral {
@@ -1147,16 +1572,27 @@ func (rc *Chunk) JSONLiteral(n int) (string, bool) {
 		}
 		// ARCH: this shouldn't happen? (it used to happen in division by zero... can it happen anywhere else?)
 		if math.IsNaN(val) || math.IsInf(val, 0) {
-			return "", false
+			if floats == FloatSpecialsAsNulls {
+				return dst, false
+			}
+			switch {
+			case math.IsNaN(val):
+				return append(dst, `"NaN"`...), true
+			case val > 0:
+				return append(dst, `"Infinity"`...), true
+			default:
+				return append(dst, `"-Infinity"`...), true
+			}
 		}
 
-		return fmt.Sprintf("%v", val), true
+		// the shortest representation, just like fmt's %v
+		return strconv.AppendFloat(dst, val, 'g', -1, 64), true
 	case DtypeBool:
 		if rc.IsLiteral {
-			return fmt.Sprintf("%v", rc.storage.bools.Get(0)), true
+			return strconv.AppendBool(dst, rc.storage.bools.Get(0)), true
 		}
 
-		return fmt.Sprintf("%v", rc.storage.bools.Get(n)), true
+		return strconv.AppendBool(dst, rc.storage.bools.Get(n)), true
 	case DtypeDate:
 		val := rc.storage.dates[0]
 		if !rc.IsLiteral {
@@ -1166,7 +1602,7 @@ func (rc *Chunk) JSONLiteral(n int) (string, bool) {
 		if err != nil {
 			panic(err)
 		}
-		return string(ret), true
+		return append(dst, ret...), true
 	case DtypeDatetime:
 		val := rc.storage.datetimes[0]
 		if !rc.IsLiteral {
@@ -1176,19 +1612,27 @@ func (rc *Chunk) JSONLiteral(n int) (string, bool) {
 		if err != nil {
 			panic(err)
 		}
-		return string(ret), true
+		return append(dst, ret...), true
+	case DtypeDecimal:
+		val := rc.storage.decimals[0]
+		if !rc.IsLiteral {
+			val = rc.storage.decimals[n]
+		}
+		return append(dst, val.String()...), true
 	case DtypeNull:
-		return "", false
+		return dst, false
 	default:
 		panic(fmt.Sprintf("no support for JSONLiteral for Dtype %v", rc.dtype))
 	}
 }
 
-func compareOneNull(ltv int, nullsFirst bool, null1, null2 bool) int {
+// compareOneNull places nulls before or after all the other values, regardless of the direction
+// of the ordering (so that e.g. DESC NULLS LAST puts nulls at the very end)
+func compareOneNull(nullsFirst bool, null1, null2 bool) int {
 	if (null1 && nullsFirst) || (null2 && !nullsFirst) {
-		return ltv
+		return -1
 	}
-	return -ltv
+	return 1
 }
 
 func compareValues(ltv int, lt, eq bool) int {
@@ -1213,15 +1657,21 @@ func comparisonFactory(asc, nullsFirst, isLiteral, isNullable, lt, eq, n1, n2 bo
 		if n1 && n2 {
 			return 0
 		}
-		return compareOneNull(ltv, nullsFirst, n1, n2)
+		return compareOneNull(nullsFirst, n1, n2)
 	}
 	return compareValues(ltv, lt, eq)
 }
 
-// TODO(next): docs
+// Compare compares the i-th and j-th value of a chunk, returning -1 if the former sorts first
+// (in a given direction and with nulls placed first or last), 1 if it sorts last and 0 if they are
+// equal - two nulls are equal to each other
 // ARCH: this could be made entirely generic by allowing an interface `nthValue(int) T` to genericise v1/v2
 //       EXCEPT for bools :-( (not comparable)
 func (rc *Chunk) Compare(asc, nullsFirst bool, i, j int) int {
+	// all the values of a literal are the same (and literals cannot be null)
+	if rc.IsLiteral {
+		return 0
+	}
 	var n1, n2 bool
 	if rc.Nullability != nil {
 		n1, n2 = rc.Nullability.Get(i), rc.Nullability.Get(j)
@@ -1234,11 +1684,15 @@ func (rc *Chunk) Compare(asc, nullsFirst bool, i, j int) int {
 
 		return comparisonFactory(asc, nullsFirst, rc.IsLiteral, rc.Nullability != nil, v1 < v2, v1 == v2, n1, n2)
 	case DtypeFloat:
-		// TODO: do we have to worry about inf/nans? I thought we eliminated them from the .data slice
+		// NaNs are only present if preserved while loading (see FloatPolicy), they sort after all
+		// the other values, infinities sort naturally
 		v1, v2 := rc.storage.floats[i], rc.storage.floats[j]
+		nan1, nan2 := math.IsNaN(v1), math.IsNaN(v2)
+		lt := v1 < v2 || (!nan1 && nan2)
+		eq := v1 == v2 || (nan1 && nan2)
 
-		return comparisonFactory(asc, nullsFirst, rc.IsLiteral, rc.Nullability != nil, v1 < v2, v1 == v2, n1, n2)
-	case DtypeString:
+		return comparisonFactory(asc, nullsFirst, rc.IsLiteral, rc.Nullability != nil, lt, eq, n1, n2)
+	case DtypeString, DtypeJSON:
 		v1, v2 := rc.nthValue(i), rc.nthValue(j)
 
 		return comparisonFactory(asc, nullsFirst, rc.IsLiteral, rc.Nullability != nil, v1 < v2, v1 == v2, n1, n2)
@@ -1255,6 +1709,10 @@ func (rc *Chunk) Compare(asc, nullsFirst bool, i, j int) int {
 		v1, v2 := rc.storage.datetimes[i], rc.storage.datetimes[j]
 
 		return comparisonFactory(asc, nullsFirst, rc.IsLiteral, rc.Nullability != nil, v1 < v2, v1 == v2, n1, n2)
+	case DtypeDecimal:
+		cmp := compareDecimals(rc.storage.decimals[i], rc.storage.decimals[j])
+
+		return comparisonFactory(asc, nullsFirst, rc.IsLiteral, rc.Nullability != nil, cmp < 0, cmp == 0, n1, n2)
 	case DtypeNull:
 		return 0
 	default:
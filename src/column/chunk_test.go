@@ -237,6 +237,31 @@ func TestColumnLength(t *testing.T) {
 	}
 }
 
+func TestMemoryUsage(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		val      string
+		minBytes int
+	}{
+		{DtypeInt, "12", 8 * 1000},
+		{DtypeFloat, "1.23", 8 * 1000},
+		{DtypeString, "hello", 4*1000 + 5*1000},
+		{DtypeDate, "2020-02-22", 4 * 1000},
+		{DtypeBool, "true", 1000 / 8},
+	}
+	for _, test := range tests {
+		rc := NewChunk(test.dtype)
+		for j := 0; j < 1000; j++ {
+			if err := rc.AddValue(test.val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if size := rc.MemoryUsage(); size < test.minBytes {
+			t.Errorf("expecting %v values of %v to take up at least %v bytes, got %v", rc.Len(), test.dtype, test.minBytes, size)
+		}
+	}
+}
+
 func TestSerialisationRoundtrip(t *testing.T) {
 	tests := []struct {
 		dtype Dtype
@@ -264,6 +289,7 @@ func TestSerialisationRoundtrip(t *testing.T) {
 		{DtypeBool, []string{"t", "", "f"}},
 		{DtypeDate, []string{"2020-02-22", "", "2030-12-31"}},
 		{DtypeDatetime, []string{"2020-02-22 12:34:45", "", "2030-12-31 11:12:00.012"}},
+		{DtypeDecimal, []string{"12.30", "", "-0.05"}},
 	}
 	for j, test := range tests {
 		col := NewChunk(test.dtype)
@@ -286,6 +312,129 @@ func TestSerialisationRoundtrip(t *testing.T) {
 	}
 }
 
+func TestSplitStringSerialisation(t *testing.T) {
+	tests := []struct {
+		vals    []string
+		runes   bool
+		lengths []int64
+	}{
+		{[]string{"foo", "", "bazz"}, false, []int64{3, 0, 4}},
+		{[]string{}, false, []int64{}},
+		{[]string{"čau", "x"}, true, nil},
+	}
+	for _, test := range tests {
+		col := NewChunk(DtypeString)
+		if err := col.AddValues(test.vals); err != nil {
+			t.Fatal(err)
+		}
+		offsets, contents := new(bytes.Buffer), new(bytes.Buffer)
+		if _, err := col.WriteOffsetsTo(offsets); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := col.WriteStringsTo(contents); err != nil {
+			t.Fatal(err)
+		}
+		lazy, runes, err := DeserializeOffsets(offsets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lazy.OffsetsOnly() || lazy.Len() != col.Len() || runes != test.runes {
+			t.Errorf("expecting %+v to be read without contents, got %+v (runes: %v)", test.vals, lazy, runes)
+		}
+		if test.lengths != nil {
+			lengths, err := evalLength(lazy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ChunksEqual(lengths, NewChunkIntsFromSlice(test.lengths, nil)) {
+				t.Errorf("expecting lengths of %+v to be %v, got %+v", test.vals, test.lengths, lengths)
+			}
+		}
+		if len(test.vals) > 1 {
+			bm := bitmap.NewBitmap(col.Len())
+			bm.Set(1, true)
+			if pruned := lazy.Prune(bm); !pruned.OffsetsOnly() || pruned.Len() != 1 {
+				t.Errorf("expecting pruned chunks to stay without contents, got %+v", pruned)
+			}
+		}
+		if err := lazy.LoadStrings(contents); err != nil {
+			t.Fatal(err)
+		}
+		if lazy.OffsetsOnly() || !ChunksEqual(lazy, col) {
+			t.Errorf("expecting %+v, got %+v", col, lazy)
+		}
+	}
+
+	if _, err := NewChunkIntsFromSlice([]int64{1}, nil).WriteOffsetsTo(new(bytes.Buffer)); !errors.Is(err, errNotStrings) {
+		t.Errorf("expecting ints not to be split, got %v", err)
+	}
+}
+
+func TestSpecialFloats(t *testing.T) {
+	vals := []string{"1.5", "NaN", "inf", "-Infinity", "", "-2"}
+	tests := []struct {
+		floats FloatPolicy
+		json   []string
+	}{
+		{FloatSpecialsAsNulls, []string{"1.5", "null", "null", "null", "null", "-2"}},
+		{FloatSpecialsPreserved, []string{"1.5", `"NaN"`, `"Infinity"`, `"-Infinity"`, "null", "-2"}},
+	}
+	for _, test := range tests {
+		col := NewChunk(DtypeFloat)
+		for _, val := range vals {
+			if err := col.AddValueWithPolicy(val, test.floats); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// special values need to survive serialisation
+		buf := new(bytes.Buffer)
+		if _, err := col.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		col, err := Deserialize(buf, DtypeFloat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, expected := range test.json {
+			val, ok := col.JSONLiteralWithPolicy(j, test.floats)
+			if !ok {
+				val = "null"
+			}
+			if val != expected {
+				t.Errorf("expecting %v to be rendered as %v, got %v", vals[j], expected, val)
+			}
+		}
+		// plain JSON literals never render special values
+		if val, ok := col.JSONLiteral(1); ok {
+			t.Errorf("expecting special floats to be rendered as nulls by default, got %v", val)
+		}
+	}
+
+	// NaNs sort after all the other values, including infinities
+	col := NewChunk(DtypeFloat)
+	for _, val := range []string{"NaN", "inf", "1", "NaN", "-inf"} {
+		if err := col.AddValueWithPolicy(val, FloatSpecialsPreserved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comparisons := []struct {
+		i, j     int
+		expected int
+	}{
+		{0, 1, 1},
+		{1, 0, -1},
+		{0, 3, 0},
+		{2, 0, -1},
+		{4, 1, -1},
+		{1, 2, 1},
+	}
+	for _, test := range comparisons {
+		if cmp := col.Compare(true, false, test.i, test.j); cmp != test.expected {
+			t.Errorf("expecting comparison of rows %v and %v to be %v, got %v", test.i, test.j, test.expected, cmp)
+		}
+	}
+}
+
 // TODO: due to a new structure in Deserialize (moving from ifaces to structs), we now
 // fail on EOF when trying to deserialize the nullability bitmap in this case, fix it
 // func TestSerialisationUnsupportedTypes(t *testing.T) {
@@ -330,6 +479,7 @@ func TestJSONMarshaling(t *testing.T) {
 		{DtypeString, []string{"foo", "bar"}, "[\"foo\",\"bar\"]"},
 		{DtypeNull, []string{""}, "[null]"},
 		{DtypeNull, []string{"", "", ""}, "[null,null,null]"},
+		{DtypeDecimal, []string{"12.30", "", "-0.05"}, "[12.30,null,-0.05]"},
 
 		// we don't really have nullable strings at this point
 		// {newColumnStrings(), []string{"", "bar", ""}, "[null,\"bar\",null]"},
@@ -377,6 +527,8 @@ func TestBasicPruning(t *testing.T) {
 		{DtypeBool, true, []string{"true", "", "true"}, []bool{true, true, false}, []string{"t", ""}},
 		{DtypeFloat, true, []string{"1.23", "+0", ""}, []bool{false, true, false}, []string{"0"}},
 		{DtypeString, true, []string{"foo", "", ""}, []bool{true, true, true}, []string{"foo", "", ""}},
+		{DtypeJSON, true, []string{`{"foo": 1}`, "", "[2]"}, []bool{true, false, true}, []string{`{"foo": 1}`, "[2]"}},
+		{DtypeJSON, true, []string{`{"foo": 1}`, "", "[2]"}, []bool{false, true, true}, []string{"", "[2]"}},
 		{DtypeDate, true, []string{"2020-02-22", "", "1922-12-31"}, []bool{true, true, false}, []string{"2020-02-22", ""}},
 		{DtypeDatetime, true, []string{"2020-02-22 12:45:55", "", "1922-12-31 04:44:12"}, []bool{true, true, false}, []string{"2020-02-22 12:45:55", ""}},
 
@@ -414,6 +566,50 @@ func TestBasicPruning(t *testing.T) {
 	}
 }
 
+func TestReordering(t *testing.T) {
+	tests := []struct {
+		Dtype     Dtype
+		values    []string
+		positions []int
+		expected  []string
+	}{
+		{DtypeInt, []string{"1", "2", "3"}, []int{2, 0, 1}, []string{"3", "1", "2"}},
+		{DtypeInt, []string{"1", "", "3"}, []int{1, 1, 2}, []string{"", "", "3"}},
+		{DtypeInt, []string{"1", "2", "3"}, []int{}, []string{}},
+		{DtypeFloat, []string{"1.23", "", "1e3"}, []int{2, 1}, []string{"1e3", ""}},
+		{DtypeBool, []string{"true", "false", ""}, []int{1, 2, 0}, []string{"false", "", "true"}},
+		{DtypeString, []string{"foo", "bar", "baz"}, []int{2, 0}, []string{"baz", "foo"}},
+		{DtypeDate, []string{"2020-02-22", "", "1922-12-31"}, []int{2, 1, 0}, []string{"1922-12-31", "", "2020-02-22"}},
+		{DtypeDatetime, []string{"2020-02-22 12:45:55", "1942-04-11 11:00:04"}, []int{1}, []string{"1942-04-11 11:00:04"}},
+		{DtypeDecimal, []string{"1.20", "", "0.05"}, []int{2, 1}, []string{"0.05", ""}},
+		{DtypeNull, []string{"", "", ""}, []int{0, 1}, []string{"", ""}},
+	}
+	for _, test := range tests {
+		rc := NewChunk(test.Dtype)
+		if err := rc.AddValues(test.values); err != nil {
+			t.Error(err)
+			continue
+		}
+		expected := NewChunk(test.Dtype)
+		if err := expected.AddValues(test.expected); err != nil {
+			t.Error(err)
+			continue
+		}
+		reordered := rc.Reorder(test.positions)
+		if !ChunksEqual(reordered, expected) {
+			t.Errorf("expected that reordering %+v using %+v would result in %+v, got %+v instead", test.values, test.positions, test.expected, reordered)
+		}
+	}
+
+	// literals get hydrated
+	lit := NewChunkLiteralInts(42, 10)
+	reordered := lit.Reorder([]int{3, 4})
+	expected := NewChunkIntsFromSlice([]int64{42, 42}, nil)
+	if !ChunksEqual(reordered, expected) {
+		t.Errorf("expected a reordered literal to result in %+v, got %+v instead", expected, reordered)
+	}
+}
+
 func TestPruningFailureMisalignment(t *testing.T) {
 	tests := []struct {
 		Dtype    Dtype
@@ -518,6 +714,78 @@ func TestAppending(t *testing.T) {
 	}
 }
 
+func TestGrowingChunks(t *testing.T) {
+	tests := []struct {
+		dtype  Dtype
+		values []string
+	}{
+		{DtypeString, []string{"foo", "", "bar"}},
+		{DtypeJSON, []string{"{}", "[1, 2]"}},
+		{DtypeInt, []string{"1", "", "3"}},
+		{DtypeFloat, []string{"1.5", "2", ""}},
+		{DtypeBool, []string{"t", "f", ""}},
+		{DtypeDate, []string{"2020-02-22", ""}},
+		{DtypeDatetime, []string{"2020-02-22 12:34:56", ""}},
+		{DtypeDecimal, []string{"1.23", "", "4.56"}},
+		{DtypeNull, []string{"", ""}},
+	}
+	for _, test := range tests {
+		part := NewChunk(test.dtype)
+		if err := part.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		// each part gets appended many times over, exceeding our default capacity
+		nparts := 2 * defaultChunkCap
+		grown, expected := NewChunk(test.dtype), NewChunk(test.dtype)
+		grown.Grow(nparts * len(test.values))
+		grown.Grow(1) // there's enough room already, this doesn't change anything
+		before := grown.storageCap()
+		for j := 0; j < nparts; j++ {
+			if err := grown.Append(part); err != nil {
+				t.Fatal(err)
+			}
+			if err := expected.AddValues(test.values); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !ChunksEqual(grown, expected) {
+			t.Errorf("expecting grown %v chunks to hold the same values as those that weren't grown", test.dtype)
+		}
+		if after := grown.storageCap(); after != before {
+			t.Errorf("expecting %v chunks not to reallocate after growing, capacity changed from %v to %v", test.dtype, before, after)
+		}
+	}
+
+	lit, err := NewChunkLiteralTyped("foo", DtypeString, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lit.Grow(100)
+	if lit.Len() != 3 || lit.storage.offsets[1] != 3 {
+		t.Errorf("expecting growing literals not to affect them, got %v", lit)
+	}
+}
+
+// storageCap is the capacity of a chunk's values (or of string offsets), zero for types without
+// slices of values
+func (rc *Chunk) storageCap() int {
+	switch rc.dtype {
+	case DtypeString, DtypeJSON:
+		return cap(rc.storage.offsets)
+	case DtypeInt:
+		return cap(rc.storage.ints)
+	case DtypeFloat:
+		return cap(rc.storage.floats)
+	case DtypeDate:
+		return cap(rc.storage.dates)
+	case DtypeDatetime:
+		return cap(rc.storage.datetimes)
+	case DtypeDecimal:
+		return cap(rc.storage.decimals)
+	}
+	return 0
+}
+
 func TestAppendTypeMismatch(t *testing.T) {
 	Dtypes := []Dtype{DtypeString, DtypeInt, DtypeFloat, DtypeBool, DtypeNull}
 
@@ -587,6 +855,7 @@ func TestHashing(t *testing.T) {
 		{DtypeInt, []string{"1", "2", ""}},
 		{DtypeFloat, []string{"1", "2", ""}},
 		{DtypeBool, []string{"t", "f", ""}},
+		{DtypeDecimal, []string{"1.20", "1.2", ""}},
 	}
 
 	for _, test := range tests {
@@ -605,6 +874,120 @@ func TestHashing(t *testing.T) {
 	}
 }
 
+// floats that compare equal (and all NaNs) need to hash the same, so that they form a single group
+func TestHashingFloats(t *testing.T) {
+	otherNaN := math.Float64frombits(0x7ff0000000000abc)
+	tests := []struct {
+		a, b  float64
+		equal bool
+	}{
+		{0, math.Copysign(0, -1), true},
+		{math.NaN(), otherNaN, true},
+		{math.NaN(), -math.NaN(), true},
+		{math.Inf(1), math.Inf(1), true},
+		{1.5, 1.5, true},
+		{math.Inf(1), math.Inf(-1), false},
+		{math.NaN(), 0, false},
+		{math.NaN(), math.Inf(1), false},
+		{1, -1, false},
+	}
+	for _, test := range tests {
+		rc := NewChunkFloatsFromSlice([]float64{test.a, test.b}, nil)
+		hashes := make([]uint64, 2)
+		rc.Hash(0, hashes)
+		if (hashes[0] == hashes[1]) != test.equal {
+			t.Errorf("expecting %v and %v to hash the same: %v, got %x and %x", test.a, test.b, test.equal, hashes[0], hashes[1])
+		}
+		// literals hash the same way
+		literal := make([]uint64, 1)
+		NewChunkLiteralFloats(test.b, 1).Hash(0, literal)
+		if (literal[0] == hashes[0]) != test.equal {
+			t.Errorf("expecting a literal %v to hash like %v: %v", test.b, test.a, test.equal)
+		}
+		if ChunksEqual(NewChunkFloatsFromSlice([]float64{test.a}, nil), NewChunkFloatsFromSlice([]float64{test.b}, nil)) != test.equal {
+			t.Errorf("expecting %v and %v to be equal: %v", test.a, test.b, test.equal)
+		}
+	}
+
+	nulls := bitmap.NewBitmap(2)
+	nulls.Set(1, true)
+	withNulls := NewChunkFloatsFromSlice([]float64{math.NaN(), 0}, nulls)
+	if !ChunksEqual(withNulls, NewChunkFloatsFromSlice([]float64{otherNaN, 123}, nulls.Clone())) {
+		t.Error("expecting nullable chunks with NaNs to be equal")
+	}
+}
+
+// stable hashes get persisted, so they must not change
+func TestStableHashes(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		value    string
+		expected uint64
+		ok       bool
+	}{
+		{DtypeInt, "0", 0x813f0174a2367c13, true},
+		{DtypeInt, "1", 0x5ca6bbcbb1e85355, true},
+		{DtypeInt, "-5", 0x8123f9b4d1f2306f, true},
+		{DtypeInt, "", 0, false},
+		{DtypeString, "", 0xf52a15e9a9b5e89b, true},
+		{DtypeString, "foo", 0x6c2fe7703e1b0bca, true},
+		{DtypeString, "user_123", 0x32d073cf10b43d37, true},
+		{DtypeFloat, "1", 0, false},
+		{DtypeBool, "true", 0, false},
+	}
+	for _, test := range tests {
+		rc := NewChunk(test.dtype)
+		if err := rc.AddValues([]string{test.value, test.value}); err != nil {
+			t.Fatal(err)
+		}
+		hash, ok := rc.StableHash(1)
+		if hash != test.expected || ok != test.ok {
+			t.Errorf("expecting %v (%v) to hash into %x (%v), got %x (%v)", test.value, test.dtype, test.expected, test.ok, hash, ok)
+		}
+	}
+	if hash, _ := NewChunkLiteralInts(1, 10).StableHash(5); hash != 0x5ca6bbcbb1e85355 {
+		t.Errorf("expecting literals to hash the same way as other chunks, got %x", hash)
+	}
+}
+
+// appending values yields the same literals as fmt used to, without overwriting what's been there
+func TestAppendingJSONLiterals(t *testing.T) {
+	floats := []float64{0, math.Copysign(0, -1), 1.5, -2, 1e21, 1e-7, 123456789, 0.1 + 0.2, math.MaxFloat64}
+	ints := []int64{0, -1, math.MaxInt64, math.MinInt64}
+	cols := []*Chunk{
+		NewChunkFloatsFromSlice(floats, nil),
+		NewChunkIntsFromSlice(ints, nil),
+		NewChunkLiteralFloats(1e21, 3),
+		NewChunkLiteralInts(-42, 3),
+	}
+	expected := [][]string{nil, nil, {"1e+21", "1e+21", "1e+21"}, {"-42", "-42", "-42"}}
+	for _, val := range floats {
+		expected[0] = append(expected[0], fmt.Sprintf("%v", val))
+	}
+	for _, val := range ints {
+		expected[1] = append(expected[1], fmt.Sprintf("%v", val))
+	}
+	for j, col := range cols {
+		for k, exp := range expected[j] {
+			got, ok := col.AppendJSONLiteral([]byte("prefix "), k, FloatSpecialsAsNulls)
+			if !ok || string(got) != "prefix "+exp {
+				t.Errorf("expecting %v to be appended as %q, got %q", exp, exp, got)
+			}
+		}
+	}
+
+	bools := NewChunk(DtypeBool)
+	if err := bools.AddValues([]string{"true", "", "false"}); err != nil {
+		t.Fatal(err)
+	}
+	for j, exp := range []string{"true", "", "false"} {
+		got, ok := bools.AppendJSONLiteral([]byte("x"), j, FloatSpecialsAsNulls)
+		if ok != (exp != "") || string(got) != "x"+exp {
+			t.Errorf("expecting %q to be appended as %q (%v), got %q (%v)", exp, exp, exp != "", got, ok)
+		}
+	}
+}
+
 // this used to be a thing not just in tests, so reimplementing it now for testing purposes
 func jsonLiteral(c *Chunk) string {
 	buf := new(bytes.Buffer)
@@ -666,7 +1049,13 @@ func TestNewLiterals(t *testing.T) {
 			if err := chunk.AddValues([]string{test.val}); !errors.Is(err, errNoAddToLiterals) {
 				t.Errorf("should not be able to add values to literal chunks, expecting errNoAddToLiterals, got %+v instead", err)
 			}
-			// if err := chunk.Prune(new(bitmap.Bitmap)); !errors.Is(err, ...) // currently panics (TODO)
+			if test.length > 0 {
+				bm := bitmap.NewBitmap(test.length)
+				bm.Set(0, true)
+				if pruned := chunk.Prune(bm); !(pruned.IsLiteral && pruned.Len() == 1) {
+					t.Errorf("expecting pruning a literal to result in a literal of length 1, got %+v", pruned)
+				}
+			}
 			// if err := chunk.MarshalBinary(); !errors.Is(err, ...) // not implemented yet (TODO)
 			if err := chunk.Append(chunk); !errors.Is(err, errNoAddToLiterals) {
 				t.Errorf("should not be able to append values to literal chunks, expecting errNoAddToLiterals, got %+v instead", err)
@@ -787,6 +1176,13 @@ func TestCompare(t *testing.T) {
 		{3, DtypeString, "a,b,c", 1, 2, true, true, -1},
 		{3, DtypeString, "a,b,c", 1, 2, false, true, 1},
 		{3, DtypeString, "1,2,10", 1, 2, true, true, 1},
+		// nulls go first or last regardless of the direction
+		{3, DtypeInt, "1,,3", 1, 0, true, true, -1},
+		{3, DtypeInt, "1,,3", 1, 0, false, true, -1},
+		{3, DtypeInt, "1,,3", 1, 0, true, false, 1},
+		{3, DtypeInt, "1,,3", 1, 0, false, false, 1},
+		{3, DtypeInt, "1,,3", 0, 1, false, true, 1},
+		{3, DtypeFloat, ",,3", 0, 1, false, true, 0},
 	}
 
 	for _, test := range tests {
@@ -803,6 +1199,58 @@ func TestCompare(t *testing.T) {
 	}
 }
 
+// for random chunks of all types (with nulls and plenty of duplicates), the comparison needs to be
+// a strict weak ordering, otherwise sorting by it is not well defined
+func TestCompareOrdersConsistently(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	generators := map[Dtype]func() string{
+		DtypeInt:      func() string { return strconv.Itoa(rng.Intn(5) - 2) },
+		DtypeFloat:    func() string { return []string{"-1.5", "0", "2.25", "inf", "-inf", "NaN"}[rng.Intn(6)] },
+		DtypeString:   func() string { return []string{"a", "ab", "b", "B", "ž"}[rng.Intn(5)] },
+		DtypeBool:     func() string { return []string{"true", "false"}[rng.Intn(2)] },
+		DtypeDate:     func() string { return fmt.Sprintf("2020-0%d-1%d", 1+rng.Intn(3), rng.Intn(3)) },
+		DtypeDatetime: func() string { return fmt.Sprintf("2020-01-01 1%d:00:0%d", rng.Intn(3), rng.Intn(3)) },
+		DtypeDecimal:  func() string { return []string{"1.10", "1.1", "-0.5", "12.01"}[rng.Intn(4)] },
+	}
+	for dtype, gen := range generators {
+		for iter := 0; iter < 20; iter++ {
+			n := 1 + rng.Intn(30)
+			vals := make([]string, n)
+			for j := range vals {
+				if rng.Intn(4) > 0 {
+					vals[j] = gen()
+				}
+			}
+			rc := NewChunk(dtype)
+			if err := rc.AddValues(vals); err != nil {
+				t.Fatal(err)
+			}
+			for _, asc := range []bool{true, false} {
+				for _, nullsFirst := range []bool{true, false} {
+					for i := 0; i < n; i++ {
+						for j := 0; j < n; j++ {
+							cij, cji := rc.Compare(asc, nullsFirst, i, j), rc.Compare(asc, nullsFirst, j, i)
+							if cij != -cji || (i == j && cij != 0) {
+								t.Fatalf("%v: comparing %q and %q is not antisymmetric (%v, %v)", dtype, vals[i], vals[j], cij, cji)
+							}
+							for k := 0; k < n; k++ {
+								if cij <= 0 && rc.Compare(asc, nullsFirst, j, k) <= 0 && rc.Compare(asc, nullsFirst, i, k) > 0 {
+									t.Fatalf("%v: comparing %q, %q and %q is not transitive", dtype, vals[i], vals[j], vals[k])
+								}
+							}
+							// special floats may get loaded as nulls, so we can't just look at our values
+							null1, null2 := rc.Nullability != nil && rc.Nullability.Get(i), rc.Nullability != nil && rc.Nullability.Get(j)
+							if null1 != null2 && (cij < 0) != (null1 == nullsFirst) {
+								t.Fatalf("%v: expecting nulls first (%v) regardless of direction, got %v for %q vs. %q", dtype, nullsFirst, cij, vals[i], vals[j])
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
 func BenchmarkHashingInts(b *testing.B) {
 	n := 10000
 	col := NewChunk(DtypeInt)
@@ -833,6 +1281,85 @@ func BenchmarkHashingFloats(b *testing.B) {
 	b.SetBytes(int64(8 * n))
 }
 
+func BenchmarkHashingNullableInts(b *testing.B) {
+	n := 10000
+	col := NewChunk(DtypeInt)
+	for j := 0; j < n; j++ {
+		if j%10 == 0 {
+			col.AddValue("")
+			continue
+		}
+		col.AddValue(strconv.Itoa(j))
+	}
+	hashes := make([]uint64, col.Len())
+	b.ResetTimer()
+
+	for j := 0; j < b.N; j++ {
+		col.Hash(0, hashes)
+	}
+	b.SetBytes(int64(8 * n))
+}
+
+func BenchmarkHashingStrings(b *testing.B) {
+	n := 10000
+	col := NewChunk(DtypeString)
+	var size int
+	for j := 0; j < n; j++ {
+		val := fmt.Sprintf("user-%v", j)
+		size += len(val)
+		col.AddValue(val)
+	}
+	hashes := make([]uint64, col.Len())
+	b.ResetTimer()
+
+	for j := 0; j < b.N; j++ {
+		col.Hash(0, hashes)
+	}
+	b.SetBytes(int64(size))
+}
+
+func BenchmarkPruningSparse(b *testing.B) {
+	n := 100000
+	col := NewChunk(DtypeInt)
+	for j := 0; j < n; j++ {
+		col.AddValue(strconv.Itoa(j))
+	}
+	bm := bitmap.NewBitmap(n)
+	for j := 0; j < n; j += 1000 {
+		bm.Set(j, true)
+	}
+	b.ResetTimer()
+
+	for j := 0; j < b.N; j++ {
+		col.Prune(bm)
+	}
+	b.SetBytes(int64(8 * n))
+}
+
+func BenchmarkAppendingChunks(b *testing.B) {
+	part := NewChunk(DtypeInt)
+	for j := 0; j < 1000; j++ {
+		part.AddValue(strconv.Itoa(j))
+	}
+	nparts := 1000
+	for _, grow := range []bool{false, true} {
+		b.Run(fmt.Sprintf("grow=%v", grow), func(b *testing.B) {
+			b.ReportAllocs()
+			for j := 0; j < b.N; j++ {
+				col := NewChunk(DtypeInt)
+				if grow {
+					col.Grow(nparts * part.Len())
+				}
+				for k := 0; k < nparts; k++ {
+					if err := col.Append(part); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
 // tests for .Dtype()
 // TestFilterAndPrune
 // chunksequal
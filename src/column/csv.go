@@ -0,0 +1,59 @@
+package column
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errCSVMisaligned = errors.New("data do not align with their schema")
+
+// WriteCSV writes chunks as a CSV file with a header, values are formatted the way we'd expect
+// them in input files, so exported data can be loaded back in. Nulls are written as empty values
+// (which is how we load them), quoting is handled by encoding/csv.
+// All chunks need to be of the same length and none of them can be a literal.
+func WriteCSV(w io.Writer, schema TableSchema, data []*Chunk) error {
+	if len(schema) != len(data) {
+		return fmt.Errorf("%w: schema has %v columns, got %v", errCSVMisaligned, len(schema), len(data))
+	}
+	length := 0
+	if len(data) > 0 {
+		length = data[0].Len()
+	}
+	for j, col := range data {
+		if col.IsLiteral {
+			return errLiteralsCannotBeSerialised
+		}
+		if col.Len() != length {
+			return fmt.Errorf("%w: column %v", errCSVMisaligned, schema[j].Name)
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	row := make([]string, len(schema))
+	for j, col := range schema {
+		row[j] = col.Name
+	}
+	if err := cw.Write(row); err != nil {
+		return err
+	}
+	for rownum := 0; rownum < length; rownum++ {
+		for j, col := range data {
+			row[j] = col.textValue(rownum)
+		}
+		// a lone empty value would result in an empty line, which CSV readers (ours included) skip
+		if len(row) == 1 && row[0] == "" {
+			cw.Flush()
+			if _, err := io.WriteString(w, "\"\"\n"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
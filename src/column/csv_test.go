@@ -0,0 +1,47 @@
+package column
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWritingCSV(t *testing.T) {
+	tests := []struct {
+		schema   TableSchema
+		values   [][]string
+		expected string
+	}{
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}, {Name: "bar", Dtype: DtypeString}}, [][]string{{"1", "", "3"}, {"a", "b,c", "d\"e"}}, "foo,bar\n1,a\n,\"b,c\"\n3,\"d\"\"e\"\n"},
+		{TableSchema{{Name: "foo", Dtype: DtypeFloat}, {Name: "bar", Dtype: DtypeBool}}, [][]string{{"1.5", "1e30"}, {"t", ""}}, "foo,bar\n1.5,true\n1e+30,\n"},
+		{TableSchema{{Name: "foo", Dtype: DtypeDate}, {Name: "bar", Dtype: DtypeDecimal}}, [][]string{{"2020-02-20"}, {"1.50"}}, "foo,bar\n2020-02-20,1.50\n"},
+		{TableSchema{{Name: "foo bar", Dtype: DtypeString}}, [][]string{{"multi\nline"}}, "foo bar\n\"multi\nline\"\n"},
+		// empty lines would get skipped when loading data back in
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}}, [][]string{{"1", "", "2"}}, "foo\n1\n\"\"\n2\n"},
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}}, [][]string{{}}, "foo\n"},
+	}
+	for _, test := range tests {
+		data := make([]*Chunk, 0, len(test.schema))
+		for j, col := range test.schema {
+			chunk := NewChunk(col.Dtype)
+			if err := chunk.AddValues(test.values[j]); err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, chunk)
+		}
+		buf := new(bytes.Buffer)
+		if err := WriteCSV(buf, test.schema, data); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("expecting %v to be written as %q, got %q", test.values, test.expected, buf.String())
+		}
+	}
+
+	if err := WriteCSV(new(bytes.Buffer), TableSchema{{Name: "foo", Dtype: DtypeInt}}, nil); !errors.Is(err, errCSVMisaligned) {
+		t.Errorf("expecting misaligned data to fail with %v, got %v", errCSVMisaligned, err)
+	}
+	if err := WriteCSV(new(bytes.Buffer), TableSchema{{Name: "foo", Dtype: DtypeInt}}, []*Chunk{NewChunkLiteralInts(1, 3)}); err != errLiteralsCannotBeSerialised {
+		t.Errorf("expecting literals to fail with %v, got %v", errLiteralsCannotBeSerialised, err)
+	}
+}
@@ -1,14 +1,18 @@
 package column
 
 import (
-	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/kokes/smda/src/errs"
 )
 
-var errInvalidDate = errors.New("date is not valid")
-var errInvalidDatetime = errors.New("datetime is not valid")
+var errInvalidDate = errs.New(errs.ErrBadRequest, "date is not valid")
+var errInvalidDatetime = errs.New(errs.ErrBadRequest, "datetime is not valid")
+var errInvalidInterval = errs.New(errs.ErrBadRequest, "interval is not valid")
+var errInvalidDatePart = errs.New(errs.ErrBadRequest, "unsupported date part")
 
 var dayLimit [12]int = [12]int{31, 28, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
 
@@ -53,10 +57,19 @@ func newDatetimeFromNative(t time.Time) (datetime, error) {
 	return newDatetime(t.Year(), int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1000)
 }
 
+// ARCH: this drops the hour part of a date, which we only use in datetimes
+func newDateFromNative(t time.Time) (date, error) {
+	return newDate(t.Year(), int(t.Month()), t.Day(), 0)
+}
+
 func (d date) Year() int  { return int(d >> 14) }
 func (d date) Month() int { return int(d >> 10 & (1<<4 - 1)) }
 func (d date) Day() int   { return int(d >> 5 & (1<<5 - 1)) }
 
+func (d date) toNative() time.Time {
+	return time.Date(d.Year(), time.Month(d.Month()), d.Day(), 0, 0, 0, 0, time.UTC)
+}
+
 func (d date) String() string {
 	return fmt.Sprintf("%04d-%02d-%02d", d.Year(), d.Month(), d.Day())
 }
@@ -75,6 +88,10 @@ func (dt datetime) Minute() int      { return int(dt&(1<<32-1)/1e6) / 60 }
 func (dt datetime) Second() int      { return int(dt&(1<<32-1)/1e6) % 60 }
 func (dt datetime) Microsecond() int { return int(dt&(1<<32-1)) % 1e6 }
 
+func (dt datetime) toNative() time.Time {
+	return time.Date(dt.Year(), time.Month(dt.Month()), dt.Day(), dt.Hour(), dt.Minute(), dt.Second(), 1000*dt.Microsecond(), time.UTC)
+}
+
 func (dt datetime) String() string {
 	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second(), dt.Microsecond())
 }
@@ -84,9 +101,10 @@ func (dt datetime) MarshalJSON() ([]byte, error) {
 	return []byte(val), nil
 }
 
-// TODO: just like with isNull, support alternative formats via loadSettings
+// parseDate parses dates in our canonical format (2006-01-02), years can also be separated by
+// slashes (2006/01/02), other formats need to be declared upfront (see DateFormat)
 func parseDate(s string) (date, error) {
-	if !(len(s) == 10 && s[4] == '-' && s[7] == '-') {
+	if !(len(s) == 10 && (s[4] == '-' || s[4] == '/') && s[7] == s[4]) {
 		return 0, errInvalidDate
 	}
 	year, err := strconv.ParseInt(s[:4], 10, 64)
@@ -105,11 +123,20 @@ func parseDate(s string) (date, error) {
 	return newDate(int(year), int(month), int(day), 0)
 }
 
+// parseDatetime parses datetimes without time zones (in our canonical format, with an optional
+// `T` separator) and RFC 3339 timestamps, which get converted to UTC
 func parseDatetime(s string) (datetime, error) {
 	var (
 		us  int
 		err error
 	)
+	if hasTimezone(s) {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, errInvalidDatetime
+		}
+		return newDatetimeFromNative(t.UTC())
+	}
 	switch len(s) {
 	case 23, 26:
 		if s[19] != '.' {
@@ -150,6 +177,18 @@ func parseDatetime(s string) (datetime, error) {
 	}
 }
 
+// hasTimezone reports whether a datetime ends with a time zone designator (Z or e.g. +02:00)
+func hasTimezone(s string) bool {
+	if len(s) <= 19 {
+		return false
+	}
+	if s[len(s)-1] == 'Z' {
+		return true
+	}
+	offset := s[len(s)-6:]
+	return (offset[0] == '+' || offset[0] == '-') && offset[3] == ':'
+}
+
 func DatesEqual(a, b date) bool {
 	return a == b
 }
@@ -187,3 +226,165 @@ func DatetimesLessThan(a, b datetime) bool {
 func DatetimesLessThanEqual(a, b datetime) bool {
 	return DatetimesGreaterThanEqual(b, a)
 }
+
+// Interval is a calendar aware duration - like in Postgres, we keep months and days separate
+// from the rest, because they don't have a fixed length (2020-01-31 + 1 month is 2020-02-29)
+type Interval struct {
+	Months       int
+	Days         int
+	Microseconds int64
+}
+
+// ParseInterval parses intervals like `7 days` or `1 year -2 months 3 hours`
+func ParseInterval(s string) (Interval, error) {
+	var iv Interval
+	parts := strings.Fields(s)
+	if len(parts) == 0 || len(parts)%2 != 0 {
+		return iv, fmt.Errorf("%w: %v", errInvalidInterval, s)
+	}
+	for j := 0; j < len(parts); j += 2 {
+		val, err := strconv.Atoi(parts[j])
+		if err != nil {
+			return iv, fmt.Errorf("%w: %v", errInvalidInterval, s)
+		}
+		switch strings.TrimSuffix(strings.ToLower(parts[j+1]), "s") {
+		case "year":
+			iv.Months += 12 * val
+		case "month":
+			iv.Months += val
+		case "week":
+			iv.Days += 7 * val
+		case "day":
+			iv.Days += val
+		case "hour":
+			iv.Microseconds += int64(val) * int64(time.Hour/time.Microsecond)
+		case "minute":
+			iv.Microseconds += int64(val) * int64(time.Minute/time.Microsecond)
+		case "second":
+			iv.Microseconds += int64(val) * int64(time.Second/time.Microsecond)
+		case "millisecond":
+			iv.Microseconds += int64(val) * int64(time.Millisecond/time.Microsecond)
+		case "microsecond":
+			iv.Microseconds += int64(val)
+		default:
+			return iv, fmt.Errorf("%w: unknown unit %v", errInvalidInterval, parts[j+1])
+		}
+	}
+	return iv, nil
+}
+
+func (iv Interval) Negate() Interval {
+	return Interval{Months: -iv.Months, Days: -iv.Days, Microseconds: -iv.Microseconds}
+}
+
+// months get added first, then days, then the rest - and unlike time.AddDate, we clamp days
+// to the end of a month instead of overflowing into the next one
+func (iv Interval) addTo(t time.Time) time.Time {
+	if iv.Months != 0 {
+		months := 12*t.Year() + int(t.Month()) - 1 + iv.Months
+		year, month := months/12, time.Month(months%12+1)
+		day := t.Day()
+		// day zero of the following month is the last day of this one
+		if lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day(); day > lastDay {
+			day = lastDay
+		}
+		t = time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	}
+	return t.AddDate(0, 0, iv.Days).Add(time.Duration(iv.Microseconds) * time.Microsecond)
+}
+
+// truncateNative truncates a timestamp to a given precision (e.g. `month` gets us the first
+// of a given month), weeks start on Mondays (as per ISO 8601)
+func truncateNative(t time.Time, unit string) (time.Time, error) {
+	switch unit {
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC), nil
+	case "quarter":
+		return time.Date(t.Year(), (t.Month()-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC), nil
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	case "week":
+		monday := t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+		return time.Date(monday.Year(), monday.Month(), monday.Day(), 0, 0, 0, 0, time.UTC), nil
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	case "hour":
+		return t.Truncate(time.Hour), nil
+	case "minute":
+		return t.Truncate(time.Minute), nil
+	case "second":
+		return t.Truncate(time.Second), nil
+	}
+	return t, fmt.Errorf("%w: %v", errInvalidDatePart, unit)
+}
+
+// datePartNative extracts a given field from a timestamp, days of week start with zero on Sundays
+// (like in Postgres), weeks are ISO 8601 weeks
+func datePartNative(t time.Time, field string) (int64, error) {
+	switch field {
+	case "year":
+		return int64(t.Year()), nil
+	case "quarter":
+		return int64(t.Month()-1)/3 + 1, nil
+	case "month":
+		return int64(t.Month()), nil
+	case "week":
+		_, week := t.ISOWeek()
+		return int64(week), nil
+	case "day":
+		return int64(t.Day()), nil
+	case "dow":
+		return int64(t.Weekday()), nil
+	case "doy":
+		return int64(t.YearDay()), nil
+	case "hour":
+		return int64(t.Hour()), nil
+	case "minute":
+		return int64(t.Minute()), nil
+	case "second":
+		return int64(t.Second()), nil
+	case "microsecond":
+		return int64(t.Nanosecond() / 1000), nil
+	case "epoch":
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("%w: %v", errInvalidDatePart, field)
+}
+
+// dateDiffNative counts the number of whole units elapsed between two timestamps, it's negative
+// if `end` precedes `start`
+func dateDiffNative(start, end time.Time, unit string) (int64, error) {
+	switch unit {
+	case "year", "quarter", "month":
+		months := 12*(end.Year()-start.Year()) + int(end.Month()) - int(start.Month())
+		// we don't count incomplete months (2020-01-15 to 2020-02-14 is zero months), but we
+		// clamp days the same way addTo does (2020-01-31 to 2020-02-29 is one month)
+		if months > 0 && (Interval{Months: months}).addTo(start).After(end) {
+			months--
+		}
+		if months < 0 && (Interval{Months: months}).addTo(start).Before(end) {
+			months++
+		}
+		switch unit {
+		case "year":
+			return int64(months / 12), nil
+		case "quarter":
+			return int64(months / 3), nil
+		}
+		return int64(months), nil
+	// ARCH: durations saturate at about 292 years, so larger differences get capped
+	case "week":
+		return int64(end.Sub(start) / (7 * 24 * time.Hour)), nil
+	case "day":
+		return int64(end.Sub(start) / (24 * time.Hour)), nil
+	case "hour":
+		return int64(end.Sub(start) / time.Hour), nil
+	case "minute":
+		return int64(end.Sub(start) / time.Minute), nil
+	case "second":
+		return int64(end.Sub(start) / time.Second), nil
+	case "microsecond":
+		return int64(end.Sub(start) / time.Microsecond), nil
+	}
+	return 0, fmt.Errorf("%w: %v", errInvalidDatePart, unit)
+}
@@ -1,6 +1,7 @@
 package column
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -78,6 +79,12 @@ func TestBasicDatetimes(t *testing.T) {
 		{"2020-12-31T12:34:56.000789", 2020, 12, 31, 12, 34, 56, 789, false, nil},
 		{"2020-12-31T12:34:56.789", 2020, 12, 31, 12, 34, 56, 789, false, nil},
 		{"2020-12-31T12:34:56", 2020, 12, 31, 12, 34, 56, 0, false, nil},
+		{"2020/12/31 12:34:56", 2020, 12, 31, 12, 34, 56, 0, false, nil},
+		// RFC 3339 timestamps get converted to UTC
+		{"2020-12-31T12:34:56Z", 2020, 12, 31, 12, 34, 56, 0, false, nil},
+		{"2020-12-31T12:34:56.789Z", 2020, 12, 31, 12, 34, 56, 789000, false, nil},
+		{"2020-12-31T12:34:56+02:00", 2020, 12, 31, 10, 34, 56, 0, false, nil},
+		{"2020-12-31T23:34:56.000001-01:30", 2021, 1, 1, 1, 4, 56, 1, false, nil},
 		// leap years
 		{"1600-02-29 00:01:03", 1600, 2, 29, 0, 1, 3, 0, false, nil},
 		{"2000-02-29 00:01:03", 2000, 2, 29, 0, 1, 3, 0, false, nil},
@@ -134,6 +141,112 @@ func TestNativeConversion(t *testing.T) {
 	}
 }
 
+func TestParsingIntervals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Interval
+		err      error
+	}{
+		{"7 days", Interval{Days: 7}, nil},
+		{"1 day", Interval{Days: 1}, nil},
+		{"1 DAY", Interval{Days: 1}, nil},
+		{"2 weeks", Interval{Days: 14}, nil},
+		{"1 year -2 months", Interval{Months: 10}, nil},
+		{"3 hours 2 minutes", Interval{Microseconds: 3*3600e6 + 2*60e6}, nil},
+		{"1 second 5 milliseconds 3 microseconds", Interval{Microseconds: 1005003}, nil},
+		{"", Interval{}, errInvalidInterval},
+		{"7", Interval{}, errInvalidInterval},
+		{"days 7", Interval{}, errInvalidInterval},
+		{"7 parsecs", Interval{}, errInvalidInterval},
+		{"1.5 days", Interval{}, errInvalidInterval},
+	}
+	for _, test := range tests {
+		iv, err := ParseInterval(test.input)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %v to result in %v, got %v instead", test.input, test.err, err)
+			continue
+		}
+		if iv != test.expected {
+			t.Errorf("expecting %v to parse into %+v, got %+v instead", test.input, test.expected, iv)
+		}
+	}
+}
+
+func TestIntervalArithmetic(t *testing.T) {
+	tests := []struct {
+		input    string
+		interval string
+		expected string
+	}{
+		{"2020-01-01 00:00:00", "7 days", "2020-01-08 00:00:00.000000"},
+		{"2020-01-31 12:00:00", "1 month", "2020-02-29 12:00:00.000000"}, // clamping to the end of a month
+		{"2021-01-31 12:00:00", "1 month", "2021-02-28 12:00:00.000000"},
+		{"2020-02-29 00:00:00", "1 year", "2021-02-28 00:00:00.000000"},
+		{"2020-03-01 00:00:00", "-1 day", "2020-02-29 00:00:00.000000"},
+		{"2020-01-15 00:00:00", "-13 months", "2018-12-15 00:00:00.000000"},
+		{"2020-12-31 23:59:59", "1 second", "2021-01-01 00:00:00.000000"},
+	}
+	for _, test := range tests {
+		dt, err := parseDatetime(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iv, err := ParseInterval(test.interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shifted, err := newDatetimeFromNative(iv.addTo(dt.toNative()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shifted.String() != test.expected {
+			t.Errorf("expecting %v + %v to be %v, got %v instead", test.input, test.interval, test.expected, shifted)
+		}
+	}
+}
+
+func TestDateDiffs(t *testing.T) {
+	tests := []struct {
+		start, end string
+		unit       string
+		expected   int64
+	}{
+		{"2020-01-01 00:00:00", "2020-01-08 00:00:00", "day", 7},
+		{"2020-01-08 00:00:00", "2020-01-01 00:00:00", "day", -7},
+		{"2020-01-01 00:00:00", "2020-01-08 00:00:00", "week", 1},
+		{"2020-01-01 00:00:00", "2020-01-01 23:59:59", "day", 0},
+		{"2020-01-01 00:00:00", "2020-01-01 23:59:59", "hour", 23},
+		{"2020-01-15 00:00:00", "2020-02-14 00:00:00", "month", 0},
+		{"2020-01-31 00:00:00", "2020-02-29 00:00:00", "month", 1},
+		{"2020-01-31 00:00:00", "2020-02-28 00:00:00", "month", 0},
+		{"2020-01-31 00:00:00", "2020-03-31 00:00:00", "month", 2},
+		{"2020-03-31 00:00:00", "2020-01-31 00:00:00", "month", -2},
+		{"2020-03-31 00:00:00", "2020-02-01 00:00:00", "month", -1},
+		{"2019-06-01 00:00:00", "2021-05-31 00:00:00", "year", 1},
+		{"2019-06-01 00:00:00", "2021-05-31 00:00:00", "quarter", 7},
+	}
+	for _, test := range tests {
+		start, err := parseDatetime(test.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end, err := parseDatetime(test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, err := dateDiffNative(start.toNative(), end.toNative(), test.unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff != test.expected {
+			t.Errorf("expecting date_diff('%v', %v, %v) to be %v, got %v instead", test.unit, test.start, test.end, test.expected, diff)
+		}
+	}
+	if _, err := dateDiffNative(time.Time{}, time.Time{}, "fortnight"); !errors.Is(err, errInvalidDatePart) {
+		t.Errorf("expecting an unknown unit to result in %v, got %v instead", errInvalidDatePart, err)
+	}
+}
+
 func BenchmarkDateParsing(b *testing.B) {
 	data := []string{"2020-01-01", "2020-12-12", "1950-04-30"}
 	var nbytes int64
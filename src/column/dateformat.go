@@ -0,0 +1,168 @@
+package column
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidDateFormat = errs.New(errs.ErrBadRequest, "invalid date format")
+var errNotFormattedDate = errs.New(errs.ErrBadRequest, "date not formatted according to its format")
+
+// DateFormat describes how dates (and datetimes) are written in a given column, it's needed for
+// formats we don't detect automatically - either because they are ambiguous (is 01/02/2006 the
+// first of February or January the second?) or because they would be mistaken for other types
+// (epoch timestamps are just ints). The zero value is our canonical format (see parseDate and
+// parseDatetime), which needs no normalisation.
+type DateFormat struct {
+	layout string // e.g. DD/MM/YYYY, as declared
+	order  string // positions of years, months and days, e.g. dmy
+	sep    byte
+	epoch  time.Duration // unit of epoch timestamps, zero for calendar dates
+}
+
+// dates separated by these can be declared, e.g. DD.MM.YYYY
+const dateSeparators = "-/."
+
+// NewDateFormat validates a date format, which is either a layout of days (DD), months (MM) and
+// four digit years (YYYY), years being either first or last, separated by one of dateSeparators,
+// or a unix epoch timestamp, in seconds (`epoch`) or milliseconds (`epoch_ms`). Layouts apply to
+// dates and to date parts of datetimes (e.g. `31.12.2020 12:34:56`), epoch timestamps load as
+// datetimes (in UTC). An empty format is our canonical one.
+func NewDateFormat(layout string) (DateFormat, error) {
+	df := DateFormat{layout: layout}
+	switch layout {
+	case "", "YYYY-MM-DD":
+		return DateFormat{}, nil
+	case "epoch":
+		df.epoch = time.Second
+		return df, nil
+	case "epoch_ms":
+		df.epoch = time.Millisecond
+		return df, nil
+	}
+	if len(layout) != len("DD/MM/YYYY") {
+		return df, fmt.Errorf("%w: %q", errInvalidDateFormat, layout)
+	}
+	sep := layout[2]
+	if layout[0] == 'Y' {
+		sep = layout[4]
+	}
+	if !strings.ContainsRune(dateSeparators, rune(sep)) {
+		return df, fmt.Errorf("%w: dates can only be separated by one of %q (got %q)", errInvalidDateFormat, dateSeparators, layout)
+	}
+	parts := strings.Split(layout, string(sep))
+	if len(parts) != 3 {
+		return df, fmt.Errorf("%w: %q", errInvalidDateFormat, layout)
+	}
+	if parts[1] == "YYYY" {
+		return df, fmt.Errorf("%w: years need to be either first or last (got %q)", errInvalidDateFormat, layout)
+	}
+	df.sep = sep
+	for _, part := range parts {
+		switch part {
+		case "YYYY", "MM", "DD":
+			if strings.ContainsRune(df.order, rune(part[0]+'a'-'A')) {
+				return df, fmt.Errorf("%w: %q contains %v twice", errInvalidDateFormat, layout, part)
+			}
+			df.order += string(part[0] + 'a' - 'A')
+		default:
+			return df, fmt.Errorf("%w: %q needs to consist of YYYY, MM and DD", errInvalidDateFormat, layout)
+		}
+	}
+	return df, nil
+}
+
+func (df DateFormat) String() string {
+	if df.layout == "" {
+		return "YYYY-MM-DD"
+	}
+	return df.layout
+}
+
+// IsCanonical reports whether dates in this format need no normalisation
+func (df DateFormat) IsCanonical() bool {
+	return df.order == "" && df.epoch == 0
+}
+
+// Dtype is the type of values written in this format, datetimes can only be told apart from
+// dates by their values (except for epoch timestamps, which are always datetimes)
+func (df DateFormat) Dtype() Dtype {
+	if df.epoch > 0 {
+		return DtypeDatetime
+	}
+	return DtypeDate
+}
+
+// MarshalText makes date formats serialise as their layouts (e.g. in schema hints)
+func (df DateFormat) MarshalText() ([]byte, error) {
+	return []byte(df.String()), nil
+}
+
+func (df *DateFormat) UnmarshalText(data []byte) error {
+	parsed, err := NewDateFormat(string(data))
+	if err != nil {
+		return err
+	}
+	*df = parsed
+	return nil
+}
+
+// Normalise rewrites a date (or a datetime) written in this format into our canonical format
+// (e.g. `31/12/2020` into `2020-12-31`), so that it can be parsed as a date or a datetime. Days
+// and months may omit their leading zeroes (`1/2/2020`), time parts of datetimes are kept as
+// they are. Nulls stay as they are.
+func (df DateFormat) Normalise(s string) (string, error) {
+	if df.IsCanonical() || isNull(s) {
+		return s, nil
+	}
+	if df.epoch > 0 {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q is not a %v timestamp", errNotFormattedDate, s, df)
+		}
+		var t time.Time
+		if df.epoch == time.Millisecond {
+			t = time.UnixMilli(ts)
+		} else {
+			t = time.Unix(ts, 0)
+		}
+		return t.UTC().Format("2006-01-02 15:04:05.000000"), nil
+	}
+	datePart, timePart := s, ""
+	if idx := strings.IndexAny(s, " T"); idx > -1 {
+		datePart, timePart = s[:idx], s[idx:]
+	}
+	parts := strings.Split(datePart, string(df.sep))
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: %q is not in the %v format", errNotFormattedDate, s, df)
+	}
+	var year, month, day string
+	for j, part := range parts {
+		maxDigits := 2
+		if df.order[j] == 'y' {
+			maxDigits = 4
+		}
+		if len(part) == 0 || len(part) > maxDigits || strings.Trim(part, "0123456789") != "" {
+			return "", fmt.Errorf("%w: %q is not in the %v format", errNotFormattedDate, s, df)
+		}
+		if len(part) == 1 {
+			part = "0" + part
+		}
+		switch df.order[j] {
+		case 'y':
+			year = part
+		case 'm':
+			month = part
+		case 'd':
+			day = part
+		}
+	}
+	if len(year) != 4 {
+		return "", fmt.Errorf("%w: %q is not in the %v format", errNotFormattedDate, s, df)
+	}
+	return year + "-" + month + "-" + day + timePart, nil
+}
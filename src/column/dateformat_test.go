@@ -0,0 +1,84 @@
+package column
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDateFormats(t *testing.T) {
+	tests := []struct {
+		layout   string
+		expected DateFormat
+		err      error
+	}{
+		{"", DateFormat{}, nil},
+		{"YYYY-MM-DD", DateFormat{}, nil},
+		{"DD/MM/YYYY", DateFormat{layout: "DD/MM/YYYY", order: "dmy", sep: '/'}, nil},
+		{"MM/DD/YYYY", DateFormat{layout: "MM/DD/YYYY", order: "mdy", sep: '/'}, nil},
+		{"DD.MM.YYYY", DateFormat{layout: "DD.MM.YYYY", order: "dmy", sep: '.'}, nil},
+		{"YYYY.DD.MM", DateFormat{layout: "YYYY.DD.MM", order: "ydm", sep: '.'}, nil},
+		{"epoch", DateFormat{layout: "epoch", epoch: time.Second}, nil},
+		{"epoch_ms", DateFormat{layout: "epoch_ms", epoch: time.Millisecond}, nil},
+		{"DD/MM/YY", DateFormat{}, errInvalidDateFormat},
+		{"DD MM YYYY", DateFormat{}, errInvalidDateFormat},
+		{"DD/MM-YYYY", DateFormat{}, errInvalidDateFormat},
+		{"DD/DD/YYYY", DateFormat{}, errInvalidDateFormat},
+		{"MM/YYYY/DD", DateFormat{}, errInvalidDateFormat},
+		{"epoch_us", DateFormat{}, errInvalidDateFormat},
+	}
+	for _, test := range tests {
+		df, err := NewDateFormat(test.layout)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q to result in %v, got %v", test.layout, test.err, err)
+			continue
+		}
+		if err == nil && df != test.expected {
+			t.Errorf("expecting %q to result in %+v, got %+v", test.layout, test.expected, df)
+		}
+	}
+}
+
+func TestNormalisingDates(t *testing.T) {
+	tests := []struct {
+		layout, input, expected string
+		err                     error
+	}{
+		{"", "2020-12-31", "2020-12-31", nil},
+		{"", "31/12/2020", "31/12/2020", nil}, // canonical formats don't normalise anything
+		{"DD/MM/YYYY", "", "", nil},
+		{"DD/MM/YYYY", "31/12/2020", "2020-12-31", nil},
+		{"DD/MM/YYYY", "1/2/2020", "2020-02-01", nil},
+		{"MM/DD/YYYY", "1/2/2020", "2020-01-02", nil},
+		{"DD.MM.YYYY", "31.12.2020 12:34:56", "2020-12-31 12:34:56", nil},
+		{"MM-DD-YYYY", "12-31-2020T12:34:56.123456", "2020-12-31T12:34:56.123456", nil},
+		{"YYYY/DD/MM", "2020/31/12", "2020-12-31", nil},
+		{"epoch", "0", "1970-01-01 00:00:00.000000", nil},
+		{"epoch", "1609459200", "2021-01-01 00:00:00.000000", nil},
+		{"epoch", "-86400", "1969-12-31 00:00:00.000000", nil},
+		{"epoch_ms", "1609459200123", "2021-01-01 00:00:00.123000", nil},
+		// validity of dates is only checked as they get parsed
+		{"MM/DD/YYYY", "31/12/2020", "2020-31-12", nil},
+		{"DD/MM/YYYY", "2020-12-31", "", errNotFormattedDate},
+		{"DD/MM/YYYY", "31/12/20", "", errNotFormattedDate},
+		{"DD/MM/YYYY", "031/12/2020", "", errNotFormattedDate},
+		{"DD/MM/YYYY", "3a/12/2020", "", errNotFormattedDate},
+		{"DD/MM/YYYY", "31//2020", "", errNotFormattedDate},
+		{"epoch", "1609459200.5", "", errNotFormattedDate},
+		{"epoch", "2020-12-31", "", errNotFormattedDate},
+	}
+	for _, test := range tests {
+		df, err := NewDateFormat(test.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		normalised, err := df.Normalise(test.input)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q in %v to result in %v, got %v", test.input, df, test.err, err)
+			continue
+		}
+		if normalised != test.expected {
+			t.Errorf("expecting %q in %v to be normalised as %q, got %q", test.input, df, test.expected, normalised)
+		}
+	}
+}
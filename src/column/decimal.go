@@ -0,0 +1,281 @@
+package column
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidDecimal = errs.New(errs.ErrBadRequest, "decimal is not valid")
+var errDecimalOverflow = errs.New(errs.ErrBadRequest, "decimal value out of range")
+
+const DECIMAL_BYTE_SIZE = 8
+
+// decimals are fixed-point numbers, we pack both the mantissa and the scale (number of
+// digits after the decimal point) into a single uint64 - the lowest four bits hold
+// the scale, the rest is a signed mantissa. So `12.30` is stored as (1230, 2).
+// Each value carries its own scale, so that we can roundtrip inputs exactly, but all the
+// comparisons, hashing etc. are scale agnostic (`12.30` == `12.3`).
+// ARCH: 60 bits give us about 17 significant digits, which should be plenty for financial data
+type decimal uint64
+
+const decimalScaleBits = 4
+const decimalMaxScale = 1<<decimalScaleBits - 1
+const decimalMaxMantissa = 1<<(63-decimalScaleBits) - 1
+const decimalMinMantissa = -decimalMaxMantissa - 1
+
+var decimalPowers [decimalMaxScale + 1]int64
+
+func init() {
+	decimalPowers[0] = 1
+	for j := 1; j < len(decimalPowers); j++ {
+		decimalPowers[j] = decimalPowers[j-1] * 10
+	}
+}
+
+func newDecimal(mantissa int64, scale int) (decimal, error) {
+	if scale < 0 || scale > decimalMaxScale {
+		return 0, errDecimalOverflow
+	}
+	if mantissa > decimalMaxMantissa || mantissa < decimalMinMantissa {
+		return 0, errDecimalOverflow
+	}
+	return decimal(uint64(mantissa)<<decimalScaleBits | uint64(scale)), nil
+}
+
+func (d decimal) mantissa() int64 { return int64(d) >> decimalScaleBits }
+func (d decimal) scale() int      { return int(d & decimalMaxScale) }
+
+func (d decimal) String() string {
+	mantissa, scale := d.mantissa(), d.scale()
+	neg := mantissa < 0
+	digits := strconv.FormatUint(uint64(mantissa), 10)
+	if neg {
+		digits = strconv.FormatUint(uint64(-mantissa), 10)
+	}
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if neg {
+		return "-" + digits
+	}
+	return digits
+}
+
+// decimals are serialised as JSON numbers (they are valid ones), not strings
+func (d decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d decimal) Float() float64 {
+	return float64(d.mantissa()) / float64(decimalPowers[d.scale()])
+}
+
+// normalise strips trailing zeros, so that equal values have equal representations
+// (we need this for hashing)
+func (d decimal) normalise() decimal {
+	mantissa, scale := d.mantissa(), d.scale()
+	for scale > 0 && mantissa%10 == 0 {
+		mantissa /= 10
+		scale--
+	}
+	// cannot overflow, we're only making the mantissa smaller
+	nd, _ := newDecimal(mantissa, scale)
+	return nd
+}
+
+// round rounds a decimal to a given number of decimal places (half away from zero), negative
+// values round to tens, hundreds etc.
+func (d decimal) round(places int) decimal {
+	mantissa, scale := d.mantissa(), d.scale()
+	if places >= scale {
+		return d
+	}
+	diff := scale - places
+	if diff > 18 || places < -decimalMaxScale {
+		return 0
+	}
+	pow := int64(math.Pow10(diff))
+	rem := mantissa % pow
+	mantissa /= pow
+	if 2*rem >= pow {
+		mantissa++
+	} else if 2*rem <= -pow {
+		mantissa--
+	}
+	if places < 0 {
+		mantissa *= decimalPowers[-places]
+		places = 0
+	}
+	// rounding only makes the mantissa smaller, with the exception of negative places, which
+	// can overflow for extremely large values, we'll ignore that
+	ret, _ := newDecimal(mantissa, places)
+	return ret
+}
+
+// rescale changes the scale of a decimal, but only upwards (so we don't lose precision)
+func (d decimal) rescale(scale int) (int64, bool) {
+	diff := scale - d.scale()
+	if diff < 0 || diff > decimalMaxScale {
+		return 0, false
+	}
+	mantissa := d.mantissa()
+	pow := decimalPowers[diff]
+	if mantissa > decimalMaxMantissa/pow || mantissa < decimalMinMantissa/pow {
+		return 0, false
+	}
+	return mantissa * pow, true
+}
+
+// int128 returns the mantissa of a decimal at a given (larger) scale as a 128-bit two's complement
+// integer, this is how decimals get exported (our scale is at most 15, so this never overflows)
+func (d decimal) int128(scale int) (hi, lo uint64) {
+	mantissa := d.mantissa()
+	abs := uint64(mantissa)
+	if mantissa < 0 {
+		abs = uint64(-mantissa)
+	}
+	hi, lo = bits.Mul64(abs, uint64(decimalPowers[scale-d.scale()]))
+	if mantissa < 0 {
+		lo, hi = ^lo+1, ^hi
+		if lo == 0 {
+			hi++
+		}
+	}
+	return hi, lo
+}
+
+// align returns mantissas of two decimals at a common (larger) scale
+func decimalsAlign(a, b decimal) (ma, mb int64, scale int, ok bool) {
+	scale = a.scale()
+	if b.scale() > scale {
+		scale = b.scale()
+	}
+	ma, oka := a.rescale(scale)
+	mb, okb := b.rescale(scale)
+	return ma, mb, scale, oka && okb
+}
+
+// we only support plain notation - no exponents, no infinities - since we want to be exact
+func parseDecimal(s string) (decimal, error) {
+	if len(s) == 0 {
+		return 0, errInvalidDecimal
+	}
+	digits := s
+	if digits[0] == '-' || digits[0] == '+' {
+		digits = digits[1:]
+	}
+	intPart, fracPart := digits, ""
+	if pos := strings.IndexByte(digits, '.'); pos > -1 {
+		intPart, fracPart = digits[:pos], digits[pos+1:]
+	}
+	if len(intPart)+len(fracPart) == 0 || len(fracPart) > decimalMaxScale {
+		return 0, errInvalidDecimal
+	}
+	for _, part := range []string{intPart, fracPart} {
+		for j := 0; j < len(part); j++ {
+			if part[j] < '0' || part[j] > '9' {
+				return 0, errInvalidDecimal
+			}
+		}
+	}
+	mantissa, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return 0, errDecimalOverflow
+	}
+	if s[0] == '-' {
+		mantissa = -mantissa
+	}
+	return newDecimal(mantissa, len(fracPart))
+}
+
+func decimalFromInt(val int64) (decimal, error) {
+	return newDecimal(val, 0)
+}
+
+// compareDecimals returns -1, 0, 1 (like strings.Compare and others)
+func compareDecimals(a, b decimal) int {
+	ma, mb, _, ok := decimalsAlign(a, b)
+	if !ok {
+		// OPTIM: this is slow, but it only happens in extreme cases (large values at large scales)
+		ba := new(big.Int).Mul(big.NewInt(a.mantissa()), big.NewInt(decimalPowers[b.scale()]))
+		bb := new(big.Int).Mul(big.NewInt(b.mantissa()), big.NewInt(decimalPowers[a.scale()]))
+		return ba.Cmp(bb)
+	}
+	switch {
+	case ma < mb:
+		return -1
+	case ma > mb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func DecimalsEqual(a, b decimal) bool {
+	return compareDecimals(a, b) == 0
+}
+func DecimalsNotEqual(a, b decimal) bool {
+	return !DecimalsEqual(a, b)
+}
+func DecimalsGreaterThan(a, b decimal) bool {
+	return compareDecimals(a, b) > 0
+}
+func DecimalsGreaterThanEqual(a, b decimal) bool {
+	return compareDecimals(a, b) >= 0
+}
+func DecimalsLessThan(a, b decimal) bool {
+	return DecimalsGreaterThan(b, a)
+}
+func DecimalsLessThanEqual(a, b decimal) bool {
+	return DecimalsGreaterThanEqual(b, a)
+}
+
+func decimalsAdd(a, b decimal) (decimal, bool) {
+	ma, mb, scale, ok := decimalsAlign(a, b)
+	if !ok {
+		return 0, false
+	}
+	// both mantissas fit in 60 bits, so their sum cannot overflow an int64
+	ret, err := newDecimal(ma+mb, scale)
+	return ret, err == nil
+}
+
+func decimalsSubtract(a, b decimal) (decimal, bool) {
+	ma, mb, scale, ok := decimalsAlign(a, b)
+	if !ok {
+		return 0, false
+	}
+	ret, err := newDecimal(ma-mb, scale)
+	return ret, err == nil
+}
+
+// scales add up in multiplication, if we exceed our maximum scale, we round the result
+func decimalsMultiply(a, b decimal) (decimal, bool) {
+	ma, mb := a.mantissa(), b.mantissa()
+	scale := a.scale() + b.scale()
+	if ma != 0 && (ma*mb/ma != mb || ma == -1 && mb == math.MinInt64) {
+		return 0, false
+	}
+	mantissa := ma * mb
+	if scale > decimalMaxScale {
+		pow := decimalPowers[scale-decimalMaxScale]
+		rem := mantissa % pow
+		mantissa /= pow
+		if 2*rem >= pow {
+			mantissa++
+		} else if 2*rem <= -pow {
+			mantissa--
+		}
+		scale = decimalMaxScale
+	}
+	ret, err := newDecimal(mantissa, scale)
+	return ret, err == nil
+}
@@ -0,0 +1,161 @@
+package column
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecimalParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		mantissa int64
+		scale    int
+		output   string
+		err      error
+	}{
+		{"0", 0, 0, "0", nil},
+		{"12.30", 1230, 2, "12.30", nil},
+		{"-12.30", -1230, 2, "-12.30", nil},
+		{"+12.30", 1230, 2, "12.30", nil},
+		{"0.05", 5, 2, "0.05", nil},
+		{"-0.05", -5, 2, "-0.05", nil},
+		{".5", 5, 1, "0.5", nil},
+		{"5.", 5, 0, "5", nil},
+		{"123456789.123456", 123456789123456, 6, "123456789.123456", nil},
+		{"", 0, 0, "", errInvalidDecimal},
+		{"-", 0, 0, "", errInvalidDecimal},
+		{".", 0, 0, "", errInvalidDecimal},
+		{"1e3", 0, 0, "", errInvalidDecimal},
+		{"inf", 0, 0, "", errInvalidDecimal},
+		{"1.2.3", 0, 0, "", errInvalidDecimal},
+		{"1.1234567890123456", 0, 0, "", errInvalidDecimal}, // scale too large
+		{"99999999999999999999", 0, 0, "", errDecimalOverflow},
+		{"999999999999999999", 0, 0, "", errDecimalOverflow}, // fits in int64, but not in our mantissa
+	}
+	for _, test := range tests {
+		val, err := parseDecimal(test.input)
+		if err != test.err {
+			t.Errorf("expecting %v to parse with %v, got %v", test.input, test.err, err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		if val.mantissa() != test.mantissa || val.scale() != test.scale {
+			t.Errorf("expecting %v to parse into (%v, %v), got (%v, %v)", test.input, test.mantissa, test.scale, val.mantissa(), val.scale())
+		}
+		if val.String() != test.output {
+			t.Errorf("expecting %v to stringify as %v, got %v", test.input, test.output, val.String())
+		}
+		marshaled, err := json.Marshal(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(marshaled) != test.output {
+			t.Errorf("expecting %v to marshal as %v, got %v", test.input, test.output, string(marshaled))
+		}
+	}
+}
+
+func TestDecimalComparisons(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1", "1", 0},
+		{"1.0", "1", 0},
+		{"12.30", "12.3", 0},
+		{"-12.30", "-12.3", 0},
+		{"12.31", "12.3", 1},
+		{"-12.31", "-12.3", -1},
+		{"0.001", "0", 1},
+		{"576460752303423487", "0.000000000000001", 1}, // cannot be aligned, falls back to big ints
+		{"-576460752303423488", "0.000000000000001", -1},
+	}
+	for _, test := range tests {
+		a, err := parseDecimal(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseDecimal(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := compareDecimals(a, b); got != test.expected {
+			t.Errorf("expecting %v and %v to compare as %v, got %v", test.a, test.b, test.expected, got)
+		}
+		if got := compareDecimals(b, a); got != -test.expected {
+			t.Errorf("expecting %v and %v to compare as %v, got %v", test.b, test.a, -test.expected, got)
+		}
+		if DecimalsEqual(a, b) != (test.expected == 0) {
+			t.Errorf("expecting %v and %v to be equal: %v", test.a, test.b, test.expected == 0)
+		}
+		if test.expected == 0 && a.normalise() != b.normalise() {
+			t.Errorf("expecting %v and %v to normalise into the same value", test.a, test.b)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	tests := []struct {
+		fnc      func(decimal, decimal) (decimal, bool)
+		a, b     string
+		expected string
+		ok       bool
+	}{
+		{decimalsAdd, "1.10", "2.205", "3.305", true},
+		{decimalsAdd, "0.1", "0.2", "0.3", true},
+		{decimalsAdd, "-1.5", "1.5", "0.0", true},
+		{decimalsAdd, "576460752303423487", "1", "", false},
+		{decimalsSubtract, "1.10", "2.205", "-1.105", true},
+		{decimalsSubtract, "-288230376151711744", "288230376151711745", "", false},
+		{decimalsMultiply, "1.10", "2.5", "2.750", true},
+		{decimalsMultiply, "-0.5", "0.5", "-0.25", true},
+		{decimalsMultiply, "0.00000001", "0.00000005", "0.000000000000001", true}, // scale capped and rounded
+		{decimalsMultiply, "10000000000", "10000000000", "", false},
+	}
+	for _, test := range tests {
+		a, err := parseDecimal(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseDecimal(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, ok := test.fnc(a, b)
+		if ok != test.ok {
+			t.Errorf("expecting %v and %v to result in ok=%v, got %v", test.a, test.b, test.ok, ok)
+			continue
+		}
+		if ok && res.String() != test.expected {
+			t.Errorf("expecting %v and %v to result in %v, got %v", test.a, test.b, test.expected, res)
+		}
+	}
+}
+
+func TestDecimalRounding(t *testing.T) {
+	tests := []struct {
+		input    string
+		places   int
+		expected string
+	}{
+		{"12.345", 2, "12.35"},
+		{"12.344", 2, "12.34"},
+		{"-12.345", 2, "-12.35"},
+		{"12.345", 5, "12.345"},
+		{"12.5", 0, "13"},
+		{"-12.5", 0, "-13"},
+		{"1234.5", -2, "1200"},
+		{"1250", -2, "1300"},
+	}
+	for _, test := range tests {
+		val, err := parseDecimal(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := val.round(test.places).String(); got != test.expected {
+			t.Errorf("expecting %v rounded to %v places to be %v, got %v", test.input, test.places, test.expected, got)
+		}
+	}
+}
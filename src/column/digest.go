@@ -0,0 +1,110 @@
+package column
+
+import (
+	"math"
+	"sort"
+)
+
+// how many centroids (roughly) a digest keeps, higher values mean better accuracy and larger state
+const digestCompression = 100
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// digest is a merging t-digest (Dunning & Ertl), it approximates quantiles in bounded memory.
+// Centroids near the tails are kept small, so extreme quantiles are more accurate than those in
+// the middle of a distribution. Small inputs don't get compressed at all, so their quantiles are exact.
+type digest struct {
+	centroids []centroid // sorted by their means (after compression)
+	buffer    []centroid // values yet to be merged into centroids
+	count     float64
+	min, max  float64
+}
+
+func (d *digest) add(val float64) {
+	if d.count == 0 || val < d.min {
+		d.min = val
+	}
+	if d.count == 0 || val > d.max {
+		d.max = val
+	}
+	d.count++
+	d.buffer = append(d.buffer, centroid{val, 1})
+	if len(d.buffer) > 5*digestCompression {
+		d.compress()
+	}
+}
+
+// merge folds another digest into this one, this is how we combine partial states
+func (d *digest) merge(other *digest) {
+	if other == nil || other.count == 0 {
+		return
+	}
+	if d.count == 0 || other.min < d.min {
+		d.min = other.min
+	}
+	if d.count == 0 || other.max > d.max {
+		d.max = other.max
+	}
+	d.count += other.count
+	d.buffer = append(d.buffer, other.centroids...)
+	d.buffer = append(d.buffer, other.buffer...)
+	d.compress()
+}
+
+// the k1 scale function, a centroid may only span a unit of k (that's small near q=0 and q=1)
+func digestScale(q float64) float64 {
+	return digestCompression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (d *digest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := all[:1]
+	before := 0.0 // weight of all the centroids preceding the last merged one
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		proposed := last.weight + c.weight
+		if digestScale((before+proposed)/d.count)-digestScale(before/d.count) <= 1 {
+			last.mean += (c.mean - last.mean) * c.weight / proposed
+			last.weight = proposed
+			continue
+		}
+		before += last.weight
+		merged = append(merged, c)
+	}
+	d.centroids = merged
+	d.buffer = nil
+}
+
+func interpolate(x0, y0, x1, y1, x float64) float64 {
+	if x1 == x0 {
+		return y1
+	}
+	return y0 + (y1-y0)*(x-x0)/(x1-x0)
+}
+
+// quantile estimates a given quantile (0-1), it interpolates between centroids the same way
+// percentile_cont interpolates between values (so that small inputs yield exact results)
+func (d *digest) quantile(q float64) float64 {
+	d.compress()
+	// each centroid is positioned in the middle of its weight, singletons thus sit at 0.5, 1.5, ...
+	target := q*(d.count-1) + 0.5
+	prevPos, prevVal := 0.5, d.min
+	cumulative := 0.0
+	for _, c := range d.centroids {
+		pos := cumulative + c.weight/2
+		if target <= pos {
+			return interpolate(prevPos, prevVal, pos, c.mean, target)
+		}
+		prevPos, prevVal = pos, c.mean
+		cumulative += c.weight
+	}
+	return interpolate(prevPos, prevVal, d.count-0.5, d.max, target)
+}
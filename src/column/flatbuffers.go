@@ -0,0 +1,204 @@
+package column
+
+import "encoding/binary"
+
+// fbBuilder is a minimal flatbuffers builder, it only implements what we need to write Arrow
+// IPC metadata (see arrow.go). It mirrors the official implementation - buffers get built
+// back to front, so children need to be written before their parents.
+// ARCH: no vtable deduplication, our messages are tiny
+type fbBuilder struct {
+	buf       []byte
+	head      int
+	minalign  int
+	vtable    []int
+	objectEnd int
+}
+
+func newFbBuilder(size int) *fbBuilder {
+	return &fbBuilder{
+		buf:      make([]byte, size),
+		head:     size,
+		minalign: 1,
+	}
+}
+
+// offset is measured from the end of the buffer, because that's the only stable point
+func (b *fbBuilder) offset() int {
+	return len(b.buf) - b.head
+}
+
+func (b *fbBuilder) grow() {
+	size := 2 * len(b.buf)
+	if size == 0 {
+		size = 64
+	}
+	nbuf := make([]byte, size)
+	copy(nbuf[size-len(b.buf):], b.buf)
+	b.head += size - len(b.buf)
+	b.buf = nbuf
+}
+
+// prep aligns the head, so that after writing `additional` bytes, we can write `size` bytes aligned
+func (b *fbBuilder) prep(size, additional int) {
+	if size > b.minalign {
+		b.minalign = size
+	}
+	alignSize := (^(b.offset() + additional) + 1) & (size - 1)
+	for b.head < alignSize+size+additional {
+		b.grow()
+	}
+	for j := 0; j < alignSize; j++ {
+		b.head--
+		b.buf[b.head] = 0
+	}
+}
+
+func (b *fbBuilder) placeUint16(val uint16) {
+	b.head -= 2
+	binary.LittleEndian.PutUint16(b.buf[b.head:], val)
+}
+
+func (b *fbBuilder) placeUint32(val uint32) {
+	b.head -= 4
+	binary.LittleEndian.PutUint32(b.buf[b.head:], val)
+}
+
+func (b *fbBuilder) prependUint8(val uint8) {
+	b.prep(1, 0)
+	b.head--
+	b.buf[b.head] = val
+}
+
+func (b *fbBuilder) prependUint16(val uint16) {
+	b.prep(2, 0)
+	b.placeUint16(val)
+}
+
+func (b *fbBuilder) prependUint32(val uint32) {
+	b.prep(4, 0)
+	b.placeUint32(val)
+}
+
+func (b *fbBuilder) prependUint64(val uint64) {
+	b.prep(8, 0)
+	b.head -= 8
+	binary.LittleEndian.PutUint64(b.buf[b.head:], val)
+}
+
+// offsets are relative to the position they are written at
+func (b *fbBuilder) prependOffset(off int) {
+	b.prep(4, 0)
+	b.placeUint32(uint32(b.offset() - off + 4))
+}
+
+func (b *fbBuilder) createString(s string) int {
+	b.prep(4, len(s)+1)
+	b.head--
+	b.buf[b.head] = 0
+	b.head -= len(s)
+	copy(b.buf[b.head:], s)
+	b.placeUint32(uint32(len(s)))
+	return b.offset()
+}
+
+func (b *fbBuilder) startVector(elemSize, numElems, alignment int) {
+	b.prep(4, elemSize*numElems)
+	b.prep(alignment, elemSize*numElems)
+}
+
+func (b *fbBuilder) endVector(numElems int) int {
+	// alignment is guaranteed by startVector
+	b.placeUint32(uint32(numElems))
+	return b.offset()
+}
+
+func (b *fbBuilder) createOffsetVector(offsets []int) int {
+	b.startVector(4, len(offsets), 4)
+	for j := len(offsets) - 1; j >= 0; j-- {
+		b.prependOffset(offsets[j])
+	}
+	return b.endVector(len(offsets))
+}
+
+func (b *fbBuilder) startTable(numFields int) {
+	b.vtable = make([]int, numFields)
+	b.objectEnd = b.offset()
+}
+
+// the add* methods write table fields, defaults are omitted (readers fill them in)
+func (b *fbBuilder) addBool(field int, val bool) {
+	if !val {
+		return
+	}
+	b.prependUint8(1)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint8(field int, val uint8) {
+	if val == 0 {
+		return
+	}
+	b.prependUint8(val)
+	b.vtable[field] = b.offset()
+}
+
+// int16 fields are always written, because some of them have non-zero defaults
+func (b *fbBuilder) addInt16(field int, val int16) {
+	b.prependUint16(uint16(val))
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addInt32(field int, val int32) {
+	if val == 0 {
+		return
+	}
+	b.prependUint32(uint32(val))
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addInt64(field int, val int64) {
+	if val == 0 {
+		return
+	}
+	b.prependUint64(uint64(val))
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addOffset(field int, off int) {
+	if off == 0 {
+		return
+	}
+	b.prependOffset(off)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) endTable() int {
+	// placeholder for the vtable offset, we'll patch it once we know where our vtable is
+	b.prependUint32(0)
+	objOffset := b.offset()
+
+	nfields := len(b.vtable)
+	for nfields > 0 && b.vtable[nfields-1] == 0 {
+		nfields--
+	}
+	for j := nfields - 1; j >= 0; j-- {
+		off := 0
+		if b.vtable[j] != 0 {
+			off = objOffset - b.vtable[j]
+		}
+		b.prependUint16(uint16(off))
+	}
+	b.prependUint16(uint16(objOffset - b.objectEnd))
+	b.prependUint16(uint16((nfields + 2) * 2))
+
+	pos := len(b.buf) - objOffset
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(b.offset()-objOffset)))
+	b.vtable = nil
+	return objOffset
+}
+
+func (b *fbBuilder) finish(root int) []byte {
+	b.prep(b.minalign, 4)
+	b.prependOffset(root)
+	return b.buf[b.head:]
+}
@@ -13,9 +13,11 @@ import (
 	"unicode/utf8"
 
 	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errTypeNotSupported = errors.New("type not supported in this function")
+var errTypeNotSupported = errs.New(errs.ErrBadRequest, "type not supported in this function")
+var errNegativeLength = errs.New(errs.ErrBadRequest, "negative substring length not allowed")
 
 // TODO: this will be hard to cover properly, so let's make sure we test everything explicitly
 // ARCH: we're not treating literals any differently, but since they share the same backing store
@@ -49,11 +51,28 @@ var FuncProj = map[string]func(...*Chunk) (*Chunk, error){
 	"upper":      stringFunc(strings.ToUpper),
 	"left":       evalLeft,
 	"split_part": evalSplitPart,
+	"concat":     evalConcat,
+	"replace":    evalReplace,
+	"length":     evalLength,
+	"substr":     evalSubstr,
+	"date_trunc": evalDateTrunc,
+	"date_part":  evalDatePart,
+	"date_diff":  evalDateDiff,
+	"cast":       evalCast,
+	"toint":      castFunc(DtypeInt),
+	"tofloat":    castFunc(DtypeFloat),
+	"tostring":   castFunc(DtypeString),
+	"todate":     castFunc(DtypeDate),
+
+	// regexp_matches gets its own matcher in each expression, so that its pattern is only compiled once
+	"regexp_matches": evalRegexpMatches,
+	"json_extract":   evalJSONExtract,
 	// TODO(next): all those useful string functions - hashing, mid, right, position, ...
 }
 
+// now() is in UTC, like all our datetimes (see TimezoneFunc)
 func evalNow(cs ...*Chunk) (*Chunk, error) {
-	dt, err := newDatetimeFromNative(time.Now())
+	dt, err := newDatetimeFromNative(time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -98,8 +117,8 @@ func evalNullIf(cs ...*Chunk) (*Chunk, error) {
 	if err != nil {
 		return nil, err
 	}
-	truths := eq.Truths()
-	if truths.Count() == 0 {
+	truths, count := eq.TruthsCount()
+	if count == 0 {
 		return cs[0], nil
 	}
 	cb := cs[0].Clone()
@@ -109,7 +128,6 @@ func evalNullIf(cs ...*Chunk) (*Chunk, error) {
 
 // ARCH: this could be generalised using numFunc, we just have to pass in a closure
 // with our power
-// ARCH: should this return decimals (which we don't support)?
 func evalRound(cs ...*Chunk) (*Chunk, error) {
 	var factor int
 	if len(cs) == 2 {
@@ -135,6 +153,13 @@ func evalRound(cs ...*Chunk) (*Chunk, error) {
 			ctr.storage.floats[j] = math.Round(pow*el) / pow
 		}
 		return ctr, nil
+	case DtypeDecimal:
+		// decimals get rounded exactly and stay decimals
+		ctr := cs[0].Clone()
+		for j, el := range ctr.storage.decimals {
+			ctr.storage.decimals[j] = el.round(factor)
+		}
+		return ctr, nil
 	default:
 		return nil, fmt.Errorf("%w: round(%v)", errTypeNotSupported, cs[0].dtype)
 	}
@@ -198,11 +223,312 @@ func evalSplitPart(cs ...*Chunk) (*Chunk, error) {
 	return ret, nil
 }
 
+func allLiterals(cs []*Chunk) bool {
+	for _, c := range cs {
+		if !c.IsLiteral {
+			return false
+		}
+	}
+	return true
+}
+
+// like in Postgres, NULLs are ignored (treated as empty strings), so the result is never null
+func evalConcat(cs ...*Chunk) (*Chunk, error) {
+	var args []*Chunk
+	for _, c := range cs {
+		switch c.dtype {
+		case DtypeNull:
+			continue
+		case DtypeString:
+			args = append(args, c)
+		default:
+			return nil, fmt.Errorf("%w: concat(%v)", errTypeNotSupported, c.dtype)
+		}
+	}
+	length := cs[0].Len()
+	if allLiterals(args) {
+		var sb strings.Builder
+		for _, c := range args {
+			sb.WriteString(c.nthValue(0))
+		}
+		return NewChunkLiteralStrings(sb.String(), length), nil
+	}
+	ret := NewChunk(DtypeString)
+	var sb strings.Builder
+	for j := 0; j < length; j++ {
+		// null values are stored as empty strings, so we don't need to check nullability here
+		for _, c := range args {
+			sb.WriteString(c.nthValue(j))
+		}
+		if err := ret.AddValue(sb.String()); err != nil {
+			return nil, err
+		}
+		sb.Reset()
+	}
+	return ret, nil
+}
+
+// replace(haystack, from, to) replaces all occurences of `from` by `to`
+func evalReplace(cs ...*Chunk) (*Chunk, error) {
+	if allLiterals(cs) {
+		newValue := strings.ReplaceAll(cs[0].nthValue(0), cs[1].nthValue(0), cs[2].nthValue(0))
+		return NewChunkLiteralStrings(newValue, cs[0].Len()), nil
+	}
+	ret := NewChunk(DtypeString)
+	if cs[0].Nullability != nil {
+		ret.Nullability = cs[0].Nullability.Clone()
+	}
+	for j := 0; j < cs[0].Len(); j++ {
+		newValue := strings.ReplaceAll(cs[0].nthValue(j), cs[1].nthValue(j), cs[2].nthValue(j))
+		if err := ret.AddValue(newValue); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// a standalone regexp_matches compiles its pattern in each call, see RegexpMatcher for a reusable one
+func evalRegexpMatches(cs ...*Chunk) (*Chunk, error) {
+	return new(RegexpMatcher).Eval(cs...)
+}
+
+// length is measured in characters, not bytes
+func evalLength(cs ...*Chunk) (*Chunk, error) {
+	if cs[0].IsLiteral {
+		return NewChunkLiteralInts(int64(utf8.RuneCountInString(cs[0].nthValue(0))), cs[0].Len()), nil
+	}
+	// chunks without their contents (see DeserializeOffsets) only get here if they have no multi-byte
+	// characters, so their byte lengths are all we need
+	runes := hasRunes(cs[0].storage.strings)
+	lengths := make([]int64, cs[0].Len())
+	for j := range lengths {
+		if !runes {
+			lengths[j] = int64(cs[0].storage.offsets[j+1] - cs[0].storage.offsets[j])
+			continue
+		}
+		lengths[j] = int64(utf8.RuneCountInString(cs[0].nthValue(j)))
+	}
+	var nulls *bitmap.Bitmap
+	if cs[0].Nullability != nil {
+		nulls = cs[0].Nullability.Clone()
+	}
+	return NewChunkIntsFromSlice(lengths, nulls), nil
+}
+
+// substr(s, start[, count]) follows Postgres' semantics - `start` is one-based and positions
+// before the start of a string still count towards `count` (so substr('foo', 0, 2) is 'f')
+// ARCH: like in `left`, we only support literal integer arguments
+func evalSubstr(cs ...*Chunk) (*Chunk, error) {
+	start := int(cs[1].storage.ints[0])
+	count := -1 // till the end of each string
+	if len(cs) == 3 {
+		count = int(cs[2].storage.ints[0])
+		if count < 0 {
+			return nil, fmt.Errorf("%w: %v", errNegativeLength, count)
+		}
+	}
+	substr := func(val string) string {
+		runes := []rune(val)
+		// zero-based positions, the end is exclusive
+		from, to := start-1, len(runes)
+		if count > -1 && from+count < to {
+			to = from + count
+		}
+		if from < 0 {
+			from = 0
+		}
+		if from >= to {
+			return ""
+		}
+		return string(runes[from:to])
+	}
+	if cs[0].IsLiteral {
+		return NewChunkLiteralStrings(substr(cs[0].nthValue(0)), cs[0].Len()), nil
+	}
+	ret := NewChunk(DtypeString)
+	if cs[0].Nullability != nil {
+		ret.Nullability = cs[0].Nullability.Clone()
+	}
+	for j := 0; j < cs[0].Len(); j++ {
+		if err := ret.AddValue(substr(cs[0].nthValue(j))); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// nativeTimes converts dates and datetimes into native timestamps, so that we can leverage Go's
+// calendar arithmetic (literals yield a single value)
+// OPTIM: this is fairly slow, we could operate on our packed representations directly
+func nativeTimes(c *Chunk) ([]time.Time, error) {
+	switch c.dtype {
+	case DtypeDate:
+		ret := make([]time.Time, len(c.storage.dates))
+		for j, val := range c.storage.dates {
+			ret[j] = val.toNative()
+		}
+		return ret, nil
+	case DtypeDatetime:
+		ret := make([]time.Time, len(c.storage.datetimes))
+		for j, val := range c.storage.datetimes {
+			ret[j] = val.toNative()
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("%w: %v", errTypeNotSupported, c.dtype)
+}
+
+// mapTimes applies a function to each date/datetime in a chunk, yielding dates or datetimes
+func mapTimes(c *Chunk, dtype Dtype, fnc func(time.Time) (time.Time, error)) (*Chunk, error) {
+	times, err := nativeTimes(c)
+	if err != nil {
+		return nil, err
+	}
+	var nulls *bitmap.Bitmap
+	if c.Nullability != nil {
+		nulls = c.Nullability.Clone()
+	}
+	switch dtype {
+	case DtypeDate:
+		dates := make([]date, len(times))
+		for j, t := range times {
+			if nulls != nil && nulls.Get(j) {
+				continue
+			}
+			nt, err := fnc(t)
+			if err != nil {
+				return nil, err
+			}
+			dates[j], err = newDateFromNative(nt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if c.IsLiteral {
+			return NewChunkLiteralDates(dates[0], c.Len()), nil
+		}
+		return newChunkDatesFromSlice(dates, nulls), nil
+	case DtypeDatetime:
+		datetimes := make([]datetime, len(times))
+		for j, t := range times {
+			if nulls != nil && nulls.Get(j) {
+				continue
+			}
+			nt, err := fnc(t)
+			if err != nil {
+				return nil, err
+			}
+			datetimes[j], err = newDatetimeFromNative(nt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if c.IsLiteral {
+			return NewChunkLiteralDatetimes(datetimes[0], c.Len()), nil
+		}
+		return newChunkDatetimesFromSlice(datetimes, nulls), nil
+	}
+	return nil, fmt.Errorf("%w: %v", errTypeNotSupported, dtype)
+}
+
+// EvalAddInterval shifts dates or datetimes by a given interval, dates stay dates unless
+// the interval has a time component (hours, minutes etc.)
+func EvalAddInterval(c *Chunk, iv Interval) (*Chunk, error) {
+	dtype := c.dtype
+	if dtype == DtypeDate && iv.Microseconds != 0 {
+		dtype = DtypeDatetime
+	}
+	return mapTimes(c, dtype, func(t time.Time) (time.Time, error) {
+		return iv.addTo(t), nil
+	})
+}
+
+// date_trunc('month', d) keeps the input type, so truncating a datetime to a day still
+// yields a datetime (like in Postgres)
+func evalDateTrunc(cs ...*Chunk) (*Chunk, error) {
+	unit := strings.ToLower(cs[0].nthValue(0))
+	// validate the unit even if there are no values to truncate
+	if _, err := truncateNative(time.Time{}, unit); err != nil {
+		return nil, err
+	}
+	return mapTimes(cs[1], cs[1].dtype, func(t time.Time) (time.Time, error) {
+		return truncateNative(t, unit)
+	})
+}
+
+// date_part('year', d) is what `EXTRACT(year FROM d)` gets parsed into
+func evalDatePart(cs ...*Chunk) (*Chunk, error) {
+	field := strings.ToLower(cs[0].nthValue(0))
+	if _, err := datePartNative(time.Time{}, field); err != nil {
+		return nil, err
+	}
+	times, err := nativeTimes(cs[1])
+	if err != nil {
+		return nil, err
+	}
+	nulls := bitmap.Clone(cs[1].Nullability)
+	parts := make([]int64, len(times))
+	for j, t := range times {
+		if nulls != nil && nulls.Get(j) {
+			continue
+		}
+		if parts[j], err = datePartNative(t, field); err != nil {
+			return nil, err
+		}
+	}
+	if cs[1].IsLiteral {
+		return NewChunkLiteralInts(parts[0], cs[1].Len()), nil
+	}
+	return NewChunkIntsFromSlice(parts, nulls), nil
+}
+
+// date_diff('day', start, end) counts whole units between two dates/datetimes (they can be mixed)
+func evalDateDiff(cs ...*Chunk) (*Chunk, error) {
+	unit := strings.ToLower(cs[0].nthValue(0))
+	if _, err := dateDiffNative(time.Time{}, time.Time{}, unit); err != nil {
+		return nil, err
+	}
+	starts, err := nativeTimes(cs[1])
+	if err != nil {
+		return nil, err
+	}
+	ends, err := nativeTimes(cs[2])
+	if err != nil {
+		return nil, err
+	}
+	if cs[1].IsLiteral && cs[2].IsLiteral {
+		diff, err := dateDiffNative(starts[0], ends[0], unit)
+		if err != nil {
+			return nil, err
+		}
+		return NewChunkLiteralInts(diff, cs[1].Len()), nil
+	}
+	length := cs[1].Len()
+	nulls := bitmap.Or(cs[1].Nullability, cs[2].Nullability)
+	diffs := make([]int64, length)
+	for j := range diffs {
+		if nulls != nil && nulls.Get(j) {
+			continue
+		}
+		start, end := starts[0], ends[0]
+		if !cs[1].IsLiteral {
+			start = starts[j]
+		}
+		if !cs[2].IsLiteral {
+			end = ends[j]
+		}
+		if diffs[j], err = dateDiffNative(start, end, unit); err != nil {
+			return nil, err
+		}
+	}
+	return NewChunkIntsFromSlice(diffs, nulls), nil
+}
+
 func numFunc(fnc func(float64) float64) func(...*Chunk) (*Chunk, error) {
 	return func(cs ...*Chunk) (*Chunk, error) {
 		ct := cs[0]
 		switch ct.dtype {
-		case DtypeInt:
+		case DtypeInt, DtypeDecimal:
 			rc, err := ct.cast(DtypeFloat)
 			if err != nil {
 				return nil, err
@@ -1,8 +1,36 @@
 package column
 
+import (
+	"errors"
+	"testing"
+)
+
 // EvalNullIf
 // test literals
 // test cross types (won't work for now due to EvalEq)
 
 // EvalRound - 1st arg: int, floats, 2nd arg: literals, non-literals, floats/ints
 // in numFuncs test that NaN/+-Inf result in NULLs
+
+func TestSubstrNegativeLength(t *testing.T) {
+	strs := newChunkStringsFromSlice([]string{"foo", "bar"}, nil)
+	if _, err := evalSubstr(strs, NewChunkLiteralInts(1, 2), NewChunkLiteralInts(-1, 2)); !errors.Is(err, errNegativeLength) {
+		t.Errorf("expecting a negative length in substr to result in %v, got %v", errNegativeLength, err)
+	}
+}
+
+func TestInvalidDateParts(t *testing.T) {
+	dates := newChunkDatesFromSlice(nil, nil)
+	unit := NewChunkLiteralStrings("fortnight", 0)
+	for name, fnc := range map[string]func(...*Chunk) (*Chunk, error){
+		"date_trunc": evalDateTrunc,
+		"date_part":  evalDatePart,
+	} {
+		if _, err := fnc(unit, dates); !errors.Is(err, errInvalidDatePart) {
+			t.Errorf("expecting an invalid unit in %v to result in %v, got %v", name, errInvalidDatePart, err)
+		}
+	}
+	if _, err := evalDateDiff(unit, dates, dates); !errors.Is(err, errInvalidDatePart) {
+		t.Errorf("expecting an invalid unit in date_diff to result in %v, got %v", errInvalidDatePart, err)
+	}
+}
@@ -0,0 +1,53 @@
+package column
+
+// Stack only implementations of FNV-1 and FNV-1a (see hash/fnv), inspired by segmentio/fasthash.
+// They produce the very same hashes as hash/fnv with values written in little endian, so hashes
+// of values (and everything built on them, e.g. sketches) don't change, but we don't need to
+// allocate a hasher and go through its io.Writer interface for each value.
+
+const (
+	fnvOffset64 = uint64(14695981039346656037)
+	fnvPrime64  = uint64(1099511628211)
+)
+
+// fnvUint64 hashes the eight bytes of a value (as fnv.New64 would after binary.LittleEndian.PutUint64)
+func fnvUint64(val uint64) uint64 {
+	hash := fnvOffset64
+	hash = (hash * fnvPrime64) ^ (val & 0xff)
+	hash = (hash * fnvPrime64) ^ ((val >> 8) & 0xff)
+	hash = (hash * fnvPrime64) ^ ((val >> 16) & 0xff)
+	hash = (hash * fnvPrime64) ^ ((val >> 24) & 0xff)
+	hash = (hash * fnvPrime64) ^ ((val >> 32) & 0xff)
+	hash = (hash * fnvPrime64) ^ ((val >> 40) & 0xff)
+	hash = (hash * fnvPrime64) ^ ((val >> 48) & 0xff)
+	return (hash * fnvPrime64) ^ (val >> 56)
+}
+
+func fnvBytes(data []byte) uint64 {
+	hash := fnvOffset64
+	for _, c := range data {
+		hash *= fnvPrime64
+		hash ^= uint64(c)
+	}
+	return hash
+}
+
+// FNV-1a only differs in the order of operations, we use it in StableHash
+func fnv1aUint64(val uint64) uint64 {
+	hash := fnvOffset64
+	for j := 0; j < 8; j++ {
+		hash ^= val & 0xff
+		hash *= fnvPrime64
+		val >>= 8
+	}
+	return hash
+}
+
+func fnv1aBytes(data []byte) uint64 {
+	hash := fnvOffset64
+	for _, c := range data {
+		hash ^= uint64(c)
+		hash *= fnvPrime64
+	}
+	return hash
+}
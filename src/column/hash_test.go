@@ -0,0 +1,93 @@
+package column
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// our hashes get persisted (e.g. in sketches or bloom filters), so they need to match hash/fnv
+func TestHashesMatchFnv(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	vals := []uint64{0, 1, math.MaxUint64, 1 << 63}
+	for j := 0; j < 100; j++ {
+		vals = append(vals, rng.Uint64())
+	}
+	var buf [8]byte
+	for _, val := range vals {
+		binary.LittleEndian.PutUint64(buf[:], val)
+		h1, h1a := fnv.New64(), fnv.New64a()
+		h1.Write(buf[:])
+		h1a.Write(buf[:])
+		if hash := fnvUint64(val); hash != h1.Sum64() {
+			t.Errorf("expecting %v to hash into %x, got %x", val, h1.Sum64(), hash)
+		}
+		if hash := fnv1aUint64(val); hash != h1a.Sum64() {
+			t.Errorf("expecting %v to hash into %x (1a), got %x", val, h1a.Sum64(), hash)
+		}
+	}
+
+	for j := 0; j < 100; j++ {
+		data := make([]byte, rng.Intn(50))
+		rng.Read(data)
+		h1, h1a := fnv.New64(), fnv.New64a()
+		h1.Write(data)
+		h1a.Write(data)
+		if hash := fnvBytes(data); hash != h1.Sum64() {
+			t.Errorf("expecting %v to hash into %x, got %x", data, h1.Sum64(), hash)
+		}
+		if hash := fnv1aBytes(data); hash != h1a.Sum64() {
+			t.Errorf("expecting %v to hash into %x (1a), got %x", data, h1a.Sum64(), hash)
+		}
+	}
+}
+
+// values hash the same regardless of which chunk (or stripe) they are in and whether they are
+// literals or not
+func TestHashesAcrossChunks(t *testing.T) {
+	tests := []struct {
+		dtype  Dtype
+		values []string
+	}{
+		{DtypeInt, []string{"1", "", "-3", "1"}},
+		{DtypeFloat, []string{"1.5", "", "-0", "0"}},
+		{DtypeString, []string{"foo", "", "bar", "foo"}},
+		{DtypeDate, []string{"2020-01-01", "", "1999-12-31"}},
+		{DtypeDatetime, []string{"2020-01-01 12:00:00", "", "1999-12-31 00:00:00"}},
+		{DtypeDecimal, []string{"1.20", "", "1.2"}},
+		{DtypeBool, []string{"true", "", "false"}},
+	}
+	for _, test := range tests {
+		rc := NewChunk(test.dtype)
+		if err := rc.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		hashes := make([]uint64, len(test.values))
+		rc.Hash(1, hashes)
+		for j, val := range test.values {
+			single := NewChunk(test.dtype)
+			if err := single.AddValue(val); err != nil {
+				t.Fatal(err)
+			}
+			hash := make([]uint64, 1)
+			single.Hash(1, hash)
+			if hash[0] != hashes[j] {
+				t.Errorf("%v: expecting %q to hash the same in different chunks, got %x and %x", test.dtype, val, hash[0], hashes[j])
+			}
+			if val == "" {
+				continue
+			}
+			literal, err := NewChunkLiteralTyped(val, test.dtype, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash[0] = 0
+			literal.Hash(1, hash)
+			if hash[0] != hashes[j] {
+				t.Errorf("%v: expecting a literal %q to hash the same as in a chunk, got %x and %x", test.dtype, val, hash[0], hashes[j])
+			}
+		}
+	}
+}
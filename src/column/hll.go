@@ -0,0 +1,187 @@
+package column
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// sketches have 2^sketchPrecision registers, their standard error is 1.04/sqrt(2^sketchPrecision),
+// so about 0.8%
+const sketchPrecision = 14
+const sketchRegisters = 1 << sketchPrecision
+
+const sketchVersion = 1
+
+const (
+	sketchDense  = 0
+	sketchSparse = 1
+)
+
+var errInvalidSketch = errors.New("invalid sketch serialisation")
+
+// Sketch is a HyperLogLog (Flajolet et al., with small range corrections), it estimates the number
+// of distinct values it's been fed (their hashes) in constant memory. Sketches can be merged, so
+// that partial states (e.g. of individual stripes) can be combined, and serialised, so that these
+// partial states can be stored.
+// ARCH: registers are allocated upon the first value added, but they are dense from then on, so
+// GROUP BYs with lots of small groups need 16 KB per group (sparse representations would help here)
+type Sketch struct {
+	registers []uint8
+}
+
+// NewSketch creates an empty sketch
+func NewSketch() *Sketch {
+	return &Sketch{}
+}
+
+// mixHash is a finaliser of murmur3, our hashes (see Chunk.Hash) don't have their high bits
+// distributed well enough for register selection
+func mixHash(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// appendUvarint is binary.AppendUvarint, which we cannot use just yet (it's Go 1.19+)
+func appendUvarint(buf []byte, val uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], val)
+	return append(buf, varint[:n]...)
+}
+
+// Add records a value by its hash
+func (s *Sketch) Add(hash uint64) {
+	if s.registers == nil {
+		s.registers = make([]uint8, sketchRegisters)
+	}
+	hash = mixHash(hash)
+	idx := hash >> (64 - sketchPrecision)
+	// the guard bit caps ranks at 64-sketchPrecision+1
+	rank := uint8(bits.LeadingZeros64(hash<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge folds another sketch into this one, the result is the same as if this sketch was fed all
+// the values of the other one
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil || other.registers == nil {
+		return
+	}
+	if s.registers == nil {
+		s.registers = append([]uint8(nil), other.registers...)
+		return
+	}
+	for j, val := range other.registers {
+		if val > s.registers[j] {
+			s.registers[j] = val
+		}
+	}
+}
+
+// Estimate approximates the number of distinct values added to this sketch
+func (s *Sketch) Estimate() int64 {
+	if s.registers == nil {
+		return 0
+	}
+	m := float64(sketchRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, val := range s.registers {
+		sum += 1 / float64(uint64(1)<<val)
+		if val == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// small cardinalities are better estimated by linear counting (we don't need large range
+	// corrections, our hashes are 64 bits wide)
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// MarshalBinary serialises a sketch, sketches with few non-empty registers are encoded sparsely
+// (as pairs of register positions and their values)
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	buf := []byte{sketchVersion, sketchPrecision}
+	nonempty := 0
+	for _, val := range s.registers {
+		if val > 0 {
+			nonempty++
+		}
+	}
+	// a sparse entry takes up to four bytes (a varint delta and a value), empty sketches are sparse
+	if s.registers != nil && nonempty*4 >= len(s.registers) {
+		buf = append(buf, sketchDense)
+		return append(buf, s.registers...), nil
+	}
+	buf = append(buf, sketchSparse)
+	buf = appendUvarint(buf, uint64(nonempty))
+	last := 0
+	for j, val := range s.registers {
+		if val == 0 {
+			continue
+		}
+		buf = appendUvarint(buf, uint64(j-last))
+		buf = append(buf, val)
+		last = j
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary restores a sketch serialised by MarshalBinary
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 {
+		return fmt.Errorf("%w: too short", errInvalidSketch)
+	}
+	if data[0] != sketchVersion || data[1] != sketchPrecision {
+		return fmt.Errorf("%w: unsupported version %v (precision %v)", errInvalidSketch, data[0], data[1])
+	}
+	encoding, data := data[2], data[3:]
+	switch encoding {
+	case sketchDense:
+		if len(data) != sketchRegisters {
+			return fmt.Errorf("%w: expecting %v registers, got %v", errInvalidSketch, sketchRegisters, len(data))
+		}
+		s.registers = append([]uint8(nil), data...)
+	case sketchSparse:
+		nonempty, n := binary.Uvarint(data)
+		if n <= 0 || nonempty > sketchRegisters {
+			return fmt.Errorf("%w: invalid number of registers", errInvalidSketch)
+		}
+		data = data[n:]
+		s.registers = nil
+		if nonempty > 0 {
+			s.registers = make([]uint8, sketchRegisters)
+		}
+		pos := uint64(0)
+		for j := uint64(0); j < nonempty; j++ {
+			delta, n := binary.Uvarint(data)
+			if n <= 0 || len(data) < n+1 {
+				return fmt.Errorf("%w: truncated registers", errInvalidSketch)
+			}
+			pos += delta
+			if pos >= sketchRegisters {
+				return fmt.Errorf("%w: register %v out of range", errInvalidSketch, pos)
+			}
+			s.registers[pos] = data[n]
+			data = data[n+1:]
+		}
+		if len(data) > 0 {
+			return fmt.Errorf("%w: trailing data", errInvalidSketch)
+		}
+	default:
+		return fmt.Errorf("%w: unknown encoding %v", errInvalidSketch, encoding)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package column
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidJSONPath = errs.New(errs.ErrBadRequest, "invalid JSON path")
+
+// jsonPathStep selects either an object's member (by its key) or an array's element (by its index)
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses a subset of JSONPath - `$` is the document itself, `.key` (or `["key"]`)
+// selects a member of an object and `[n]` selects an element of an array (zero based),
+// e.g. `$.items[0].name`
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("%w: %q needs to start with $", errInvalidJSONPath, path)
+	}
+	var steps []jsonPathStep
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w: %q has an empty key", errInvalidJSONPath, path)
+			}
+			steps = append(steps, jsonPathStep{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("%w: %q has an unterminated bracket", errInvalidJSONPath, path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if strings.HasPrefix(inner, "\"") {
+				var key string
+				if err := json.Unmarshal([]byte(inner), &key); err != nil {
+					return nil, fmt.Errorf("%w: %q has an invalid key: %v", errInvalidJSONPath, path, inner)
+				}
+				steps = append(steps, jsonPathStep{key: key})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("%w: %q has an invalid index: %v", errInvalidJSONPath, path, inner)
+			}
+			steps = append(steps, jsonPathStep{index: index, isIndex: true})
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q in %q", errInvalidJSONPath, rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// extractJSON walks a document along a given path, it reports false if there's nothing at the end
+// of it (missing keys, indexes out of range, values of other types along the way or a JSON null)
+// OPTIM: we decode each level of the document just to get to the next one, a streaming decoder
+// (json.Decoder.Token or a hand rolled scanner) could skip over the rest without allocations
+func extractJSON(doc []byte, path []jsonPathStep) ([]byte, bool) {
+	if len(path) == 0 && !json.Valid(doc) {
+		return nil, false
+	}
+	for _, step := range path {
+		if step.isIndex {
+			var arr []json.RawMessage
+			if err := json.Unmarshal(doc, &arr); err != nil || step.index >= len(arr) {
+				return nil, false
+			}
+			doc = arr[step.index]
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(doc, &obj); err != nil {
+			return nil, false
+		}
+		value, ok := obj[step.key]
+		if !ok {
+			return nil, false
+		}
+		doc = value
+	}
+	doc = bytes.TrimSpace(doc)
+	if bytes.Equal(doc, []byte("null")) {
+		return nil, false
+	}
+	return doc, true
+}
+
+// jsonText unwraps JSON scalars - strings get unquoted and nulls become empty (our nulls), so that
+// JSON values can be cast into other types, objects and arrays stay as they are
+func jsonText(doc string) string {
+	doc = strings.TrimSpace(doc)
+	switch {
+	case doc == "null":
+		return ""
+	case strings.HasPrefix(doc, "\""):
+		var val string
+		if err := json.Unmarshal([]byte(doc), &val); err == nil {
+			return val
+		}
+	}
+	return doc
+}
+
+// json_extract(doc, path[, type]) extracts values from JSON documents (or strings containing them),
+// see parseJSONPath for the path syntax. Values missing in a given document (or documents that are
+// not valid JSON) yield nulls. The result is a JSON chunk, unless a type (as in CAST) is given, in which
+// case values get converted into this type, those that cannot be converted become nulls.
+func evalJSONExtract(cs ...*Chunk) (*Chunk, error) {
+	if cs[1].dtype != DtypeString || !cs[1].IsLiteral {
+		return nil, fmt.Errorf("%w: paths need to be string literals", errInvalidJSONPath)
+	}
+	path, err := parseJSONPath(cs[1].nthValue(0))
+	if err != nil {
+		return nil, err
+	}
+	dtype := DtypeJSON
+	if len(cs) > 2 {
+		if cs[2].dtype != DtypeString || !cs[2].IsLiteral {
+			return nil, fmt.Errorf("%w: json_extract types need to be string literals", errTypeNotSupported)
+		}
+		dtype, err = CastType(cs[2].nthValue(0))
+		if err != nil {
+			return nil, err
+		}
+	}
+	doc := cs[0]
+	switch doc.dtype {
+	case DtypeJSON, DtypeString:
+	case DtypeNull:
+		return NewChunkLiteralTyped("", DtypeNull, doc.Len())
+	default:
+		return nil, fmt.Errorf("%w: json_extract(%v)", errTypeNotSupported, doc.dtype)
+	}
+
+	length := doc.Len()
+	if doc.IsLiteral {
+		length = 1
+	}
+	ret := NewChunk(DtypeJSON)
+	for j := 0; j < length; j++ {
+		value := "" // null
+		if !(doc.Nullability != nil && doc.Nullability.Get(j)) {
+			if raw, ok := extractJSON([]byte(doc.nthValue(j)), path); ok {
+				value = string(raw)
+			}
+		}
+		if err := ret.AddValue(value); err != nil {
+			return nil, err
+		}
+	}
+	if doc.IsLiteral {
+		if ret.Nullability == nil {
+			ret, err = NewChunkLiteralTyped(ret.nthValue(0), DtypeJSON, doc.Len())
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// ARCH: literals cannot be null, so we expand null literals into full chunks
+			for j := 1; j < doc.Len(); j++ {
+				if err := ret.AddValue(""); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if dtype == DtypeJSON {
+		return ret, nil
+	}
+	return ret.castValues(dtype, false)
+}
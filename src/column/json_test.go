@@ -0,0 +1,114 @@
+package column
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/kokes/smda/src/bitmap"
+)
+
+func TestJSONPaths(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []jsonPathStep
+		err      error
+	}{
+		{"$", nil, nil},
+		{"$.foo", []jsonPathStep{{key: "foo"}}, nil},
+		{"$.foo.bar", []jsonPathStep{{key: "foo"}, {key: "bar"}}, nil},
+		{"$.items[2].name", []jsonPathStep{{key: "items"}, {index: 2, isIndex: true}, {key: "name"}}, nil},
+		{"$[0][1]", []jsonPathStep{{index: 0, isIndex: true}, {index: 1, isIndex: true}}, nil},
+		{`$["foo.bar"]`, []jsonPathStep{{key: "foo.bar"}}, nil},
+		{"", nil, errInvalidJSONPath},
+		{"foo", nil, errInvalidJSONPath},
+		{"$.", nil, errInvalidJSONPath},
+		{"$..foo", nil, errInvalidJSONPath},
+		{"$[1", nil, errInvalidJSONPath},
+		{"$[-1]", nil, errInvalidJSONPath},
+		{"$[foo]", nil, errInvalidJSONPath},
+		{"$foo", nil, errInvalidJSONPath},
+	}
+	for _, test := range tests {
+		steps, err := parseJSONPath(test.path)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q to fail with %v, got %v", test.path, test.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(steps, test.expected) {
+			t.Errorf("expecting %q to be parsed as %+v, got %+v", test.path, test.expected, steps)
+		}
+	}
+}
+
+func TestJSONChunks(t *testing.T) {
+	rc := NewChunk(DtypeJSON)
+	if err := rc.AddValues([]string{`{"foo": 1}`, "", "[1, 2]"}); err != nil {
+		t.Fatal(err)
+	}
+	if !(rc.Len() == 3 && rc.Nullability != nil && rc.Nullability.Get(1) && !rc.Nullability.Get(2)) {
+		t.Errorf("expecting empty values to be nulls, got %+v", rc)
+	}
+	if val, ok := rc.JSONLiteral(0); !ok || val != `{"foo": 1}` {
+		t.Errorf("expecting JSON documents to be their own JSON literals, got %v", val)
+	}
+	if err := rc.AddValue("{foo"); !errors.Is(err, errInvalidJSON) {
+		t.Errorf("expecting invalid documents to fail with %v, got %v", errInvalidJSON, err)
+	}
+}
+
+func TestJSONExtract(t *testing.T) {
+	docs := []string{
+		`{"name": "Joe", "age": 32, "tags": ["a", "b"], "address": {"city": "Prague"}}`,
+		`{"name": "Jane", "age": null, "tags": []}`,
+		"",
+		`[1, 2, 3]`,
+	}
+	tests := []struct {
+		path, dtype string
+		expected    []string
+	}{
+		{"$.name", "", []string{`"Joe"`, `"Jane"`, "", ""}},
+		{"$.name", "string", []string{"Joe", "Jane", "", ""}},
+		{"$.age", "int", []string{"32", "", "", ""}},
+		{"$.tags[1]", "", []string{`"b"`, "", "", ""}},
+		{"$.address.city", "string", []string{"Prague", "", "", ""}},
+		{"$.address", "", []string{`{"city": "Prague"}`, "", "", ""}},
+		{"$[2]", "int", []string{"", "", "", "3"}},
+		{"$.name", "int", []string{"", "", "", ""}}, // values that cannot be converted become nulls
+	}
+	for _, test := range tests {
+		for _, dtype := range []Dtype{DtypeJSON, DtypeString} {
+			rc := NewChunk(dtype)
+			if err := rc.AddValues(docs); err != nil {
+				t.Fatal(err)
+			}
+			args := []*Chunk{rc, NewChunkLiteralStrings(test.path, rc.Len())}
+			rdtype := DtypeJSON
+			if test.dtype != "" {
+				args = append(args, NewChunkLiteralStrings(test.dtype, rc.Len()))
+				rdtype, _ = CastType(test.dtype)
+			}
+			res, err := evalJSONExtract(args...)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			expected := NewChunk(rdtype)
+			if err := expected.AddValues(test.expected); err != nil {
+				t.Fatal(err)
+			}
+			if rdtype == DtypeString {
+				// strings cannot be loaded as nulls, but missing values are nulls
+				nulls := bitmap.NewBitmap(len(test.expected))
+				for j, val := range test.expected {
+					nulls.Set(j, val == "")
+				}
+				expected.Nullify(nulls)
+			}
+			if !ChunksEqual(res, expected) {
+				t.Errorf("expecting json_extract(%v, %q, %q) to result in %+v, got %+v", dtype, test.path, test.dtype, expected, res)
+			}
+		}
+	}
+}
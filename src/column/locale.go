@@ -0,0 +1,123 @@
+package column
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidNumberFormat = errs.New(errs.ErrBadRequest, "invalid number format")
+var errNotLocalNumber = errs.New(errs.ErrBadRequest, "number not formatted according to its locale")
+
+// NumberFormat describes how numbers are written in a given locale - e.g. `1.234,56` has a decimal
+// comma and dots separate its thousands. The zero value is our canonical format (`1234.56`).
+// ARCH: separators are single bytes, so non-breaking spaces (used in e.g. French) are not supported
+type NumberFormat struct {
+	Decimal   byte // a decimal point if empty
+	Thousands byte // no separators if empty
+}
+
+// these can separate thousands, the last two can also separate decimals
+const thousandsSeparators = " '_.,"
+
+// NewNumberFormat validates separators of a number format, either may be empty (a decimal point
+// and no thousands separators, respectively)
+func NewNumberFormat(decimal, thousands string) (NumberFormat, error) {
+	var nf NumberFormat
+	switch decimal {
+	case "", ".":
+	case ",":
+		nf.Decimal = ','
+	default:
+		return nf, fmt.Errorf("%w: decimal separator needs to be either . or , (got %q)", errInvalidNumberFormat, decimal)
+	}
+	if thousands != "" {
+		if len(thousands) != 1 || !strings.Contains(thousandsSeparators, thousands) {
+			return nf, fmt.Errorf("%w: thousands can only be separated by one of %q (got %q)", errInvalidNumberFormat, thousandsSeparators, thousands)
+		}
+		nf.Thousands = thousands[0]
+	}
+	if nf.Thousands == nf.decimal() {
+		return nf, fmt.Errorf("%w: decimals and thousands need different separators", errInvalidNumberFormat)
+	}
+	return nf, nil
+}
+
+func (nf NumberFormat) decimal() byte {
+	if nf.Decimal == 0 {
+		return '.'
+	}
+	return nf.Decimal
+}
+
+// IsCanonical reports whether numbers in this format need no normalisation
+func (nf NumberFormat) IsCanonical() bool {
+	return nf.decimal() == '.' && nf.Thousands == 0
+}
+
+// Normalise rewrites a number formatted in this locale into our canonical format (e.g. `1.234,5`
+// into `1234.5`), so that it can be parsed as an int, a float or a decimal. Nulls and special
+// float values (e.g. NaN) stay as they are, all the other values fail to normalise - including
+// those that are numbers only in our canonical format (e.g. `1.5` given a decimal comma).
+// Thousands separators need to separate groups of three digits.
+func (nf NumberFormat) Normalise(s string) (string, error) {
+	if nf.IsCanonical() || isNull(s) {
+		return s, nil
+	}
+	// nan, inf etc. have no separators to speak of
+	if _, err := parseFloat(s); err == nil && !strings.ContainsAny(s, "0123456789") {
+		return s, nil
+	}
+	ret := make([]byte, 0, len(s))
+	j := 0
+	if s[0] == '+' || s[0] == '-' {
+		ret = append(ret, s[0])
+		j++
+	}
+	// the integer part, digits in groups of three (if separated), the first group may be shorter
+	group, ngroups := 0, 0
+	for ; j < len(s); j++ {
+		char := s[j]
+		if char >= '0' && char <= '9' {
+			ret = append(ret, char)
+			group++
+			continue
+		}
+		if char == nf.Thousands && nf.Thousands != 0 {
+			if group == 0 || group > 3 || (ngroups > 0 && group != 3) {
+				return "", fmt.Errorf("%w: %v", errNotLocalNumber, s)
+			}
+			group = 0
+			ngroups++
+			continue
+		}
+		break
+	}
+	if group == 0 || (ngroups > 0 && group != 3) {
+		return "", fmt.Errorf("%w: %v", errNotLocalNumber, s)
+	}
+	// the fractional part, an optional exponent, no separators allowed
+	if j < len(s) && s[j] == nf.decimal() {
+		ret = append(ret, '.')
+		j++
+		start := j
+		for ; j < len(s) && s[j] >= '0' && s[j] <= '9'; j++ {
+			ret = append(ret, s[j])
+		}
+		if j == start {
+			return "", fmt.Errorf("%w: %v", errNotLocalNumber, s)
+		}
+	}
+	if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+		ret = append(ret, s[j:]...)
+		if _, err := parseFloat(string(ret)); err != nil {
+			return "", fmt.Errorf("%w: %v", errNotLocalNumber, s)
+		}
+		j = len(s)
+	}
+	if j != len(s) {
+		return "", fmt.Errorf("%w: %v", errNotLocalNumber, s)
+	}
+	return string(ret), nil
+}
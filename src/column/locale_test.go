@@ -0,0 +1,120 @@
+package column
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNumberFormats(t *testing.T) {
+	tests := []struct {
+		decimal, thousands string
+		expected           NumberFormat
+		err                error
+	}{
+		{"", "", NumberFormat{}, nil},
+		{".", "", NumberFormat{}, nil},
+		{".", ",", NumberFormat{Thousands: ','}, nil},
+		{",", ".", NumberFormat{Decimal: ',', Thousands: '.'}, nil},
+		{",", " ", NumberFormat{Decimal: ',', Thousands: ' '}, nil},
+		{"", "'", NumberFormat{Thousands: '\''}, nil},
+		{";", "", NumberFormat{}, errInvalidNumberFormat},
+		{",,", "", NumberFormat{}, errInvalidNumberFormat},
+		{"", "x", NumberFormat{}, errInvalidNumberFormat},
+		{"", "..", NumberFormat{}, errInvalidNumberFormat},
+		{"", ".", NumberFormat{}, errInvalidNumberFormat},
+		{",", ",", NumberFormat{}, errInvalidNumberFormat},
+	}
+	for _, test := range tests {
+		nf, err := NewNumberFormat(test.decimal, test.thousands)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q and %q to result in %v, got %v", test.decimal, test.thousands, test.err, err)
+			continue
+		}
+		if err == nil && nf != test.expected {
+			t.Errorf("expecting %q and %q to result in %+v, got %+v", test.decimal, test.thousands, test.expected, nf)
+		}
+	}
+}
+
+func TestNormalisingNumbers(t *testing.T) {
+	german := NumberFormat{Decimal: ',', Thousands: '.'}
+	swiss := NumberFormat{Thousands: '\''}
+	czech := NumberFormat{Decimal: ',', Thousands: ' '}
+	tests := []struct {
+		nf       NumberFormat
+		input    string
+		expected string
+		ok       bool
+	}{
+		{NumberFormat{}, "1,234.5", "1,234.5", true}, // canonical formats don't get touched
+		{german, "", "", true},
+		{german, "1", "1", true},
+		{german, "-12", "-12", true},
+		{german, "+1.234", "+1234", true},
+		{german, "1.234.567", "1234567", true},
+		{german, "1234567", "1234567", true},
+		{german, "1.234,56", "1234.56", true},
+		{german, "0,5", "0.5", true},
+		{german, "1,5e3", "1.5e3", true},
+		{german, "1E-2", "1E-2", true},
+		{german, "NaN", "NaN", true},
+		{german, "-inf", "-inf", true},
+		{german, "1.5", "", false},
+		{german, "1.23", "", false},
+		{german, "1.2345", "", false},
+		{german, "12345.678", "", false},
+		{german, ".123", "", false},
+		{german, "1.", "", false},
+		{german, "1,", "", false},
+		{german, ",5", "", false},
+		{german, "1,2,3", "", false},
+		{german, "1,234.5", "", false},
+		{german, "1e", "", false},
+		{german, "-", "", false},
+		{german, "foo", "", false},
+		{german, "2020-01-01", "", false},
+		{swiss, "1'234'567.8", "1234567.8", true},
+		{swiss, "1234.5", "1234.5", true},
+		{swiss, "1'23", "", false},
+		{czech, "1 234,5", "1234.5", true},
+		{czech, "1 234 ", "", false},
+	}
+	for _, test := range tests {
+		got, err := test.nf.Normalise(test.input)
+		if (err == nil) != test.ok {
+			t.Errorf("expecting %q (%+v) to normalise: %v, got %v", test.input, test.nf, test.ok, err)
+			continue
+		}
+		if err != nil && !errors.Is(err, errNotLocalNumber) {
+			t.Errorf("unexpected error normalising %q: %v", test.input, err)
+		}
+		if got != test.expected {
+			t.Errorf("expecting %q (%+v) to normalise into %q, got %q", test.input, test.nf, test.expected, got)
+		}
+	}
+}
+
+func TestGuessingLocalTypes(t *testing.T) {
+	german := NumberFormat{Decimal: ',', Thousands: '.'}
+	tests := []struct {
+		vals     []string
+		expected Schema
+	}{
+		{[]string{"1", "1.234", "-12.345.678"}, Schema{Dtype: DtypeInt}},
+		{[]string{"1", "1,5", "-12.345,678"}, Schema{Dtype: DtypeFloat}},
+		{[]string{"1,50", "", "2,25"}, Schema{Dtype: DtypeDecimal, Nullable: true}},
+		{[]string{"1,5", "1.5"}, Schema{Dtype: DtypeString}},
+		{[]string{"1.5"}, Schema{Dtype: DtypeString}},
+		{[]string{"t", "f"}, Schema{Dtype: DtypeBool}},
+		{[]string{"2020-01-01"}, Schema{Dtype: DtypeDate}},
+	}
+	for _, test := range tests {
+		tg := NewTypeGuesserWithFormat(german)
+		for _, val := range test.vals {
+			tg.AddValue(val)
+		}
+		if got := tg.InferredType(); got != test.expected {
+			t.Errorf("expecting %q to be inferred as %+v, got %+v", test.vals, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package column
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/golang/snappy"
+)
+
+var errParquetUnsupportedType = errors.New("type not supported in Parquet exports")
+var errParquetMisaligned = errors.New("data do not align with their schema")
+
+// This implements (parts of) the Parquet file format, as described in
+// https://github.com/apache/parquet-format (the metadata are defined in parquet.thrift)
+// A file consists of a magic number, column chunks and a footer with all the metadata (schema,
+// locations of column chunks etc.), followed by its length and the magic number again.
+// We write a single row group with a single (v1) data page per column, all plain encoded
+// and compressed using snappy. Reading is implemented in parquet_reader.go.
+
+const parquetMagic = "PAR1"
+
+const (
+	parquetTypeBoolean   = 0
+	parquetTypeInt32     = 1
+	parquetTypeInt64     = 2
+	parquetTypeDouble    = 5
+	parquetTypeByteArray = 6
+	parquetTypeFixedLen  = 7
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetConvertedUTF8    = 0
+	parquetConvertedDecimal = 5
+	parquetConvertedDate    = 6
+	parquetConvertedJSON    = 19
+
+	// field IDs of the LogicalType union
+	parquetLogicalString    = 1
+	parquetLogicalDecimal   = 5
+	parquetLogicalDate      = 6
+	parquetLogicalTimestamp = 8
+	parquetLogicalNull      = 11 // called UNKNOWN in the spec
+	parquetLogicalJSON      = 12
+	// field ID of the TimeUnit union
+	parquetTimeUnitMicros = 2
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetCodecSnappy   = 1
+	parquetPageData      = 0
+
+	// decimals are stored as 16-byte two's complement integers (like in Arrow)
+	parquetDecimalPrecision = 38
+	parquetDecimalLength    = 16
+)
+
+// WriteParquet writes chunks as a Parquet file with a single row group.
+// All chunks need to be of the same length and none of them can be a literal.
+// OPTIM: we could split large results into multiple row groups (and pages), so that readers
+// don't need to hold it all in memory
+func WriteParquet(w io.Writer, schema TableSchema, data []*Chunk) error {
+	if len(schema) != len(data) {
+		return fmt.Errorf("%w: schema has %v columns, got %v", errParquetMisaligned, len(schema), len(data))
+	}
+	length := 0
+	if len(data) > 0 {
+		length = data[0].Len()
+	}
+	for j, col := range data {
+		if col.IsLiteral {
+			return errLiteralsCannotBeSerialised
+		}
+		if col.Len() != length {
+			return fmt.Errorf("%w: column %v", errParquetMisaligned, schema[j].Name)
+		}
+		if _, err := parquetPhysicalType(schema[j].Dtype); err != nil {
+			return err
+		}
+		if col.dtype != schema[j].Dtype {
+			return fmt.Errorf("%w: column %v is of type %v, not %v", errParquetMisaligned, schema[j].Name, col.dtype, schema[j].Dtype)
+		}
+	}
+
+	if _, err := io.WriteString(w, parquetMagic); err != nil {
+		return err
+	}
+	offset := int64(len(parquetMagic))
+	chunks := make([]parquetColumnChunk, 0, len(data))
+	for j, col := range data {
+		chunk := parquetColumnChunk{
+			name:     schema[j].Name,
+			optional: schema[j].Nullable || col.dtype == DtypeNull || (col.Nullability != nil && col.Nullability.Count() > 0),
+			offset:   offset,
+			values:   int64(length),
+		}
+		if col.dtype == DtypeDecimal {
+			chunk.decimalScale = col.maxDecimalScale()
+		}
+		chunk.dtype = col.dtype
+		page, uncompressed := col.parquetPage(chunk.optional, chunk.decimalScale)
+		n, err := w.Write(page)
+		if err != nil {
+			return err
+		}
+		chunk.compressedSize = int64(n)
+		chunk.uncompressedSize = int64(uncompressed)
+		offset += int64(n)
+		chunks = append(chunks, chunk)
+	}
+
+	footer := parquetFooter(chunks, length)
+	if _, err := w.Write(footer); err != nil {
+		return err
+	}
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(footer)))
+	if _, err := w.Write(trailer[:]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, parquetMagic)
+	return err
+}
+
+// parquetColumnChunk is what we need to know about a written column to describe it in the footer
+type parquetColumnChunk struct {
+	name         string
+	dtype        Dtype
+	optional     bool
+	decimalScale int
+	offset       int64
+	values       int64
+	// sizes include page headers
+	compressedSize   int64
+	uncompressedSize int64
+}
+
+func parquetPhysicalType(dtype Dtype) (int32, error) {
+	switch dtype {
+	case DtypeNull, DtypeDate:
+		return parquetTypeInt32, nil
+	case DtypeInt, DtypeDatetime:
+		return parquetTypeInt64, nil
+	case DtypeFloat:
+		return parquetTypeDouble, nil
+	case DtypeString, DtypeJSON:
+		return parquetTypeByteArray, nil
+	case DtypeBool:
+		return parquetTypeBoolean, nil
+	case DtypeDecimal:
+		return parquetTypeFixedLen, nil
+	}
+	return 0, fmt.Errorf("%w: %v", errParquetUnsupportedType, dtype)
+}
+
+// parquetFooter serialises FileMetaData
+func parquetFooter(chunks []parquetColumnChunk, length int) []byte {
+	tw := newThriftWriter()
+	tw.i32(1, 1) // version
+	tw.beginList(2, thriftTypeStruct, 1+len(chunks))
+	// the root of our schema tree, all columns are its children
+	tw.listElementStruct()
+	tw.binary(4, "schema")
+	tw.i32(5, int32(len(chunks)))
+	tw.endStruct()
+	for _, chunk := range chunks {
+		ptype, _ := parquetPhysicalType(chunk.dtype)
+		tw.listElementStruct()
+		tw.i32(1, ptype)
+		if chunk.dtype == DtypeDecimal {
+			tw.i32(2, parquetDecimalLength)
+		}
+		repetition := int32(parquetRequired)
+		if chunk.optional {
+			repetition = parquetOptional
+		}
+		tw.i32(3, repetition)
+		tw.binary(4, chunk.name)
+		switch chunk.dtype {
+		case DtypeString:
+			tw.i32(6, parquetConvertedUTF8)
+			tw.beginStruct(10)
+			tw.beginStruct(parquetLogicalString)
+			tw.endStruct()
+			tw.endStruct()
+		case DtypeJSON:
+			tw.i32(6, parquetConvertedJSON)
+			tw.beginStruct(10)
+			tw.beginStruct(parquetLogicalJSON)
+			tw.endStruct()
+			tw.endStruct()
+		case DtypeDecimal:
+			tw.i32(6, parquetConvertedDecimal)
+			tw.i32(7, int32(chunk.decimalScale))
+			tw.i32(8, parquetDecimalPrecision)
+			tw.beginStruct(10)
+			tw.beginStruct(parquetLogicalDecimal)
+			tw.i32(1, int32(chunk.decimalScale))
+			tw.i32(2, parquetDecimalPrecision)
+			tw.endStruct()
+			tw.endStruct()
+		case DtypeDate:
+			tw.i32(6, parquetConvertedDate)
+			tw.beginStruct(10)
+			tw.beginStruct(parquetLogicalDate)
+			tw.endStruct()
+			tw.endStruct()
+		case DtypeDatetime:
+			// no converted type, TIMESTAMP_MICROS implies UTC, but our datetimes are naive
+			tw.beginStruct(10)
+			tw.beginStruct(parquetLogicalTimestamp)
+			tw.boolean(1, false) // isAdjustedToUTC
+			tw.beginStruct(2)
+			tw.beginStruct(parquetTimeUnitMicros)
+			tw.endStruct()
+			tw.endStruct()
+			tw.endStruct()
+			tw.endStruct()
+		case DtypeNull:
+			tw.beginStruct(10)
+			tw.beginStruct(parquetLogicalNull)
+			tw.endStruct()
+			tw.endStruct()
+		}
+		tw.endStruct()
+	}
+	tw.i64(3, int64(length))
+
+	// a single row group
+	tw.beginList(4, thriftTypeStruct, 1)
+	tw.listElementStruct()
+	tw.beginList(1, thriftTypeStruct, len(chunks))
+	var totalSize int64
+	for _, chunk := range chunks {
+		ptype, _ := parquetPhysicalType(chunk.dtype)
+		totalSize += chunk.uncompressedSize
+		tw.listElementStruct()
+		tw.i64(2, chunk.offset) // file_offset
+		tw.beginStruct(3)       // ColumnMetaData
+		tw.i32(1, ptype)
+		tw.beginList(2, thriftTypeI32, 2)
+		tw.listElementI32(parquetEncodingPlain)
+		tw.listElementI32(parquetEncodingRLE)
+		tw.beginList(3, thriftTypeBinary, 1)
+		tw.listElementBinary(chunk.name)
+		tw.i32(4, parquetCodecSnappy)
+		tw.i64(5, chunk.values)
+		tw.i64(6, chunk.uncompressedSize)
+		tw.i64(7, chunk.compressedSize)
+		tw.i64(9, chunk.offset) // data_page_offset
+		tw.endStruct()
+		tw.endStruct()
+	}
+	tw.i64(2, totalSize)
+	tw.i64(3, int64(length))
+	tw.endStruct()
+
+	tw.binary(6, "smda")
+	return tw.finish()
+}
+
+// parquetPage returns a data page (a header followed by compressed definition levels and values)
+// and its uncompressed size (including the header)
+func (rc *Chunk) parquetPage(optional bool, decimalScale int) ([]byte, int) {
+	var body []byte
+	if optional {
+		levels := rc.parquetDefinitionLevels()
+		body = appendUint32(body, uint32(len(levels)))
+		body = append(body, levels...)
+	}
+	body = append(body, rc.parquetValues(decimalScale)...)
+	compressed := snappy.Encode(nil, body)
+
+	tw := newThriftWriter()
+	tw.i32(1, parquetPageData)
+	tw.i32(2, int32(len(body)))
+	tw.i32(3, int32(len(compressed)))
+	tw.beginStruct(5)
+	tw.i32(1, int32(rc.Len()))
+	tw.i32(2, parquetEncodingPlain)
+	tw.i32(3, parquetEncodingRLE) // definition levels
+	tw.i32(4, parquetEncodingRLE) // repetition levels
+	tw.endStruct()
+	header := tw.finish()
+
+	return append(header, compressed...), len(header) + len(body)
+}
+
+// parquetDefinitionLevels encodes which values are present (1) and which are null (0), using
+// the RLE/bit-packing hybrid encoding - we only use its run length encoded runs, each consisting
+// of a varint header (the run's length shifted by one bit) and the repeated value
+func (rc *Chunk) parquetDefinitionLevels() []byte {
+	var ret []byte
+	var varint [binary.MaxVarintLen64]byte
+	for start := 0; start < rc.Len(); {
+		null := rc.dtype == DtypeNull || (rc.Nullability != nil && rc.Nullability.Get(start))
+		end := start + 1
+		for end < rc.Len() && null == (rc.dtype == DtypeNull || (rc.Nullability != nil && rc.Nullability.Get(end))) {
+			end++
+		}
+		n := binary.PutUvarint(varint[:], uint64(end-start)<<1)
+		ret = append(ret, varint[:n]...)
+		if null {
+			ret = append(ret, 0)
+		} else {
+			ret = append(ret, 1)
+		}
+		start = end
+	}
+	return ret
+}
+
+// ARCH: binary.AppendByteOrder would do, but it's not available in go 1.18
+func appendUint32(buf []byte, val uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], val)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(order binary.ByteOrder, buf []byte, val uint64) []byte {
+	var tmp [8]byte
+	order.PutUint64(tmp[:], val)
+	return append(buf, tmp[:]...)
+}
+
+// parquetValues returns plain encoded non-null values
+func (rc *Chunk) parquetValues(decimalScale int) []byte {
+	isNull := func(j int) bool {
+		return rc.Nullability != nil && rc.Nullability.Get(j)
+	}
+	var ret []byte
+	switch rc.dtype {
+	case DtypeNull:
+		return nil
+	case DtypeInt:
+		ret = make([]byte, 0, 8*rc.Len())
+		for j, val := range rc.storage.ints {
+			if !isNull(j) {
+				ret = appendUint64(binary.LittleEndian, ret, uint64(val))
+			}
+		}
+	case DtypeFloat:
+		ret = make([]byte, 0, 8*rc.Len())
+		for j, val := range rc.storage.floats {
+			if !isNull(j) {
+				ret = appendUint64(binary.LittleEndian, ret, math.Float64bits(val))
+			}
+		}
+	case DtypeString, DtypeJSON:
+		ret = make([]byte, 0, 4*rc.Len()+len(rc.storage.strings))
+		for j := 0; j < rc.Len(); j++ {
+			if isNull(j) {
+				continue
+			}
+			val := rc.nthValue(j)
+			ret = appendUint32(ret, uint32(len(val)))
+			ret = append(ret, val...)
+		}
+	case DtypeBool:
+		// bit-packed, LSB first
+		ret = make([]byte, 0, (rc.Len()+7)/8)
+		nvals := 0
+		for j := 0; j < rc.Len(); j++ {
+			if isNull(j) {
+				continue
+			}
+			if nvals%8 == 0 {
+				ret = append(ret, 0)
+			}
+			if rc.storage.bools.Get(j) {
+				ret[len(ret)-1] |= 1 << (nvals % 8)
+			}
+			nvals++
+		}
+	case DtypeDate:
+		// days since the unix epoch
+		ret = make([]byte, 0, 4*rc.Len())
+		for j, val := range rc.storage.dates {
+			if !isNull(j) {
+				ret = appendUint32(ret, uint32(int32(val.toNative().Unix()/86400)))
+			}
+		}
+	case DtypeDatetime:
+		// microseconds since the unix epoch
+		ret = make([]byte, 0, 8*rc.Len())
+		for j, val := range rc.storage.datetimes {
+			if !isNull(j) {
+				ret = appendUint64(binary.LittleEndian, ret, uint64(val.toNative().UnixMicro()))
+			}
+		}
+	case DtypeDecimal:
+		// unlike everything else, these are big endian
+		ret = make([]byte, 0, parquetDecimalLength*rc.Len())
+		for j, val := range rc.storage.decimals {
+			if !isNull(j) {
+				hi, lo := val.int128(decimalScale)
+				ret = appendUint64(binary.BigEndian, ret, hi)
+				ret = appendUint64(binary.BigEndian, ret, lo)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unsupported dtype for Parquet exports: %v", rc.dtype))
+	}
+	return ret
+}
@@ -0,0 +1,713 @@
+package column
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errParquetInvalid = errs.New(errs.ErrBadRequest, "invalid Parquet data")
+var errParquetUnsupported = errs.New(errs.ErrBadRequest, "unsupported Parquet data")
+
+// We can read flat Parquet files (no nested or repeated columns) with plain and dictionary encoded
+// (v1 and v2) data pages, compressed using snappy, gzip or zstd (or not at all). This covers files
+// written by common tools with their default settings (e.g. pyarrow, Spark, DuckDB), as well as
+// those we write ourselves (see WriteParquet).
+// ARCH: delta encodings, INT96 timestamps and LZ4/Brotli compression are not supported
+
+const (
+	parquetTypeInt96 = 3
+	parquetTypeFloat = 4
+
+	parquetRepeated = 2
+
+	parquetConvertedTimestampMillis = 9
+	parquetConvertedTimestampMicros = 10
+	parquetTimeUnitMillis           = 1
+	parquetTimeUnitNanos            = 3
+
+	parquetEncodingPlainDictionary = 2
+	parquetEncodingRLEDictionary   = 8
+
+	parquetCodecNone = 0
+	parquetCodecGzip = 2
+	parquetCodecZstd = 6
+
+	parquetPageDictionary = 2
+	parquetPageDataV2     = 3
+)
+
+// ParquetFile describes a Parquet file as read from its footer (see ReadParquetFile), its columns
+// can then be read one row group at a time (see ReadColumn)
+type ParquetFile struct {
+	Schema TableSchema
+	// number of rows in each row group
+	RowGroups []int
+	columns   []parquetColumn
+	chunks    [][]parquetChunk // a chunk for each row group and column
+}
+
+// parquetColumn is what we need to know about a column to convert its values into our types
+type parquetColumn struct {
+	name       string
+	ptype      int64
+	typeLength int
+	optional   bool
+	dtype      Dtype
+	scale      int   // decimals only
+	unit       int64 // timestamps only, see parquetTimeUnit*
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+	codec  int64
+}
+
+// ReadParquetFile reads the metadata of a Parquet file of a given size
+func ReadParquetFile(r io.ReaderAt, size int64) (*ParquetFile, error) {
+	if size < int64(2*len(parquetMagic)+4) {
+		return nil, fmt.Errorf("%w: file too small", errParquetInvalid)
+	}
+	trailer := make([]byte, 8)
+	if err := readFullAt(r, trailer, size-8); err != nil {
+		return nil, err
+	}
+	if string(trailer[4:]) != parquetMagic {
+		return nil, fmt.Errorf("%w: not a Parquet file", errParquetInvalid)
+	}
+	footerLength := int64(binary.LittleEndian.Uint32(trailer))
+	if footerLength > size-8-int64(len(parquetMagic)) {
+		return nil, fmt.Errorf("%w: footer of %v bytes does not fit", errParquetInvalid, footerLength)
+	}
+	footer := make([]byte, footerLength)
+	if err := readFullAt(r, footer, size-8-footerLength); err != nil {
+		return nil, err
+	}
+	meta, _, err := readThriftStruct(footer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first schema element is the root, flat files have all the other elements as its children
+	elements := meta.list(2)
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("%w: no schema", errParquetInvalid)
+	}
+	root, ok := elements[0].(thriftStruct)
+	if nchildren, _ := root.int(5); !ok || int(nchildren) != len(elements)-1 {
+		return nil, fmt.Errorf("%w: nested columns", errParquetUnsupported)
+	}
+	pf := &ParquetFile{}
+	for _, element := range elements[1:] {
+		element, ok := element.(thriftStruct)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid schema", errParquetInvalid)
+		}
+		col, err := newParquetColumn(element)
+		if err != nil {
+			return nil, err
+		}
+		pf.columns = append(pf.columns, col)
+		pf.Schema = append(pf.Schema, Schema{Name: col.name, Dtype: col.dtype, Nullable: col.optional})
+	}
+
+	for _, rg := range meta.list(4) {
+		rg, ok := rg.(thriftStruct)
+		columns := rg.list(1)
+		nrows, _ := rg.int(3)
+		if !ok || len(columns) != len(pf.columns) || nrows < 0 || nrows > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: invalid row group", errParquetInvalid)
+		}
+		chunks := make([]parquetChunk, len(columns))
+		for j, cc := range columns {
+			cc, _ := cc.(thriftStruct)
+			if cc.bytes(1) != nil {
+				return nil, fmt.Errorf("%w: column %v stored in another file", errParquetUnsupported, pf.columns[j].name)
+			}
+			md := cc.strct(3)
+			codec, _ := md.int(4)
+			csize, _ := md.int(7)
+			offset, ok := md.int(9)
+			// dictionaries precede data pages
+			if dict, hasDict := md.int(11); hasDict && dict > 0 && dict < offset {
+				offset = dict
+			}
+			if !ok || offset < 0 || csize < 0 || offset+csize > size {
+				return nil, fmt.Errorf("%w: invalid column chunk of %v", errParquetInvalid, pf.columns[j].name)
+			}
+			chunks[j] = parquetChunk{offset: offset, size: csize, codec: codec}
+		}
+		pf.RowGroups = append(pf.RowGroups, int(nrows))
+		pf.chunks = append(pf.chunks, chunks)
+	}
+	return pf, nil
+}
+
+func readFullAt(r io.ReaderAt, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// newParquetColumn maps a column's physical and logical (or converted) types onto our types
+func newParquetColumn(element thriftStruct) (parquetColumn, error) {
+	col := parquetColumn{name: string(element.bytes(4))}
+	ptype, ok := element.int(1)
+	if nchildren, _ := element.int(5); !ok || nchildren > 0 {
+		return col, fmt.Errorf("%w: nested column %v", errParquetUnsupported, col.name)
+	}
+	repetition, _ := element.int(3)
+	if repetition == parquetRepeated {
+		return col, fmt.Errorf("%w: repeated column %v", errParquetUnsupported, col.name)
+	}
+	col.ptype = ptype
+	col.optional = repetition == parquetOptional
+	typeLength, _ := element.int(2)
+	col.typeLength = int(typeLength)
+	logical := element.strct(10)
+	converted, hasConverted := element.int(6)
+
+	switch {
+	case logical[parquetLogicalNull] != nil:
+		col.dtype = DtypeNull
+	case logical[parquetLogicalDecimal] != nil || (hasConverted && converted == parquetConvertedDecimal):
+		scale, ok := logical.strct(parquetLogicalDecimal).int(1)
+		if !ok {
+			scale, _ = element.int(7)
+		}
+		if scale < 0 || scale > decimalMaxScale || ptype == parquetTypeBoolean || ptype == parquetTypeFloat || ptype == parquetTypeDouble || ptype == parquetTypeInt96 {
+			return col, fmt.Errorf("%w: decimal column %v", errParquetUnsupported, col.name)
+		}
+		col.dtype = DtypeDecimal
+		col.scale = int(scale)
+	case ptype == parquetTypeBoolean:
+		col.dtype = DtypeBool
+	case ptype == parquetTypeInt32:
+		col.dtype = DtypeInt
+		if logical[parquetLogicalDate] != nil || (hasConverted && converted == parquetConvertedDate) {
+			col.dtype = DtypeDate
+		}
+	case ptype == parquetTypeInt64:
+		col.dtype = DtypeInt
+		if ts := logical.strct(parquetLogicalTimestamp); ts != nil {
+			col.dtype = DtypeDatetime
+			for unit := range ts.strct(2) {
+				col.unit = int64(unit)
+			}
+		} else if hasConverted && (converted == parquetConvertedTimestampMillis || converted == parquetConvertedTimestampMicros) {
+			col.dtype = DtypeDatetime
+			col.unit = parquetTimeUnitMillis
+			if converted == parquetConvertedTimestampMicros {
+				col.unit = parquetTimeUnitMicros
+			}
+		}
+		if col.dtype == DtypeDatetime && col.unit != parquetTimeUnitMillis && col.unit != parquetTimeUnitMicros && col.unit != parquetTimeUnitNanos {
+			return col, fmt.Errorf("%w: time unit of column %v", errParquetUnsupported, col.name)
+		}
+	case ptype == parquetTypeFloat || ptype == parquetTypeDouble:
+		col.dtype = DtypeFloat
+	case ptype == parquetTypeByteArray:
+		col.dtype = DtypeString
+		if logical[parquetLogicalJSON] != nil || (hasConverted && converted == parquetConvertedJSON) {
+			col.dtype = DtypeJSON
+		}
+	case ptype == parquetTypeFixedLen:
+		// e.g. UUIDs, we don't have a binary type, so we load them as they are
+		col.dtype = DtypeString
+	default:
+		return col, fmt.Errorf("%w: physical type %v of column %v", errParquetUnsupported, ptype, col.name)
+	}
+	return col, nil
+}
+
+// ReadColumn reads a column chunk of a given row group
+// OPTIM: we read whole column chunks into memory, we could read (and decompress) them page by page
+func (pf *ParquetFile) ReadColumn(r io.ReaderAt, rowGroup, nthColumn int) (*Chunk, error) {
+	if rowGroup < 0 || rowGroup >= len(pf.RowGroups) || nthColumn < 0 || nthColumn >= len(pf.columns) {
+		return nil, fmt.Errorf("%w: no column %v in row group %v", errParquetInvalid, nthColumn, rowGroup)
+	}
+	col := pf.columns[nthColumn]
+	meta := pf.chunks[rowGroup][nthColumn]
+	length := pf.RowGroups[rowGroup]
+	buf := make([]byte, meta.size)
+	if err := readFullAt(r, buf, meta.offset); err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*Chunk, error) {
+		return nil, fmt.Errorf("column %v: %w", col.name, err)
+	}
+
+	nulls := bitmap.NewBitmap(length)
+	var values, dict *parquetValues
+	values = &parquetValues{}
+	for rows := 0; rows < length; {
+		header, n, err := readThriftStruct(buf)
+		if err != nil {
+			return fail(err)
+		}
+		buf = buf[n:]
+		csize, _ := header.int(3)
+		usize, _ := header.int(2)
+		if csize < 0 || csize > int64(len(buf)) || usize < 0 {
+			return fail(fmt.Errorf("%w: invalid page size", errParquetInvalid))
+		}
+		page := buf[:csize]
+		buf = buf[csize:]
+
+		var nvals int64
+		var levels, data []byte
+		var encoding int64
+		switch ptype, _ := header.int(1); ptype {
+		case parquetPageDictionary:
+			data, err := parquetDecompress(page, meta.codec, usize)
+			if err != nil {
+				return fail(err)
+			}
+			ndict, _ := header.strct(7).int(1)
+			dict = &parquetValues{}
+			if err := dict.appendPlain(data, col, int(ndict)); err != nil {
+				return fail(err)
+			}
+			continue
+		case parquetPageData:
+			dh := header.strct(5)
+			nvals, _ = dh.int(1)
+			encoding, _ = dh.int(2)
+			if data, err = parquetDecompress(page, meta.codec, usize); err != nil {
+				return fail(err)
+			}
+			// definition levels are prefixed by their length in v1 pages
+			if col.optional {
+				if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+					return fail(fmt.Errorf("%w: invalid definition levels", errParquetInvalid))
+				}
+				end := 4 + int(binary.LittleEndian.Uint32(data))
+				levels, data = data[4:end], data[end:]
+			}
+		case parquetPageDataV2:
+			dh := header.strct(8)
+			nvals, _ = dh.int(1)
+			encoding, _ = dh.int(4)
+			defLength, _ := dh.int(5)
+			repLength, _ := dh.int(6)
+			if defLength < 0 || repLength < 0 || defLength+repLength > csize {
+				return fail(fmt.Errorf("%w: invalid levels", errParquetInvalid))
+			}
+			// levels are never compressed in v2 pages, values are unless stated otherwise
+			levels, data = page[repLength:repLength+defLength], page[repLength+defLength:]
+			if compressed, ok := dh.boolean(7); !ok || compressed {
+				if data, err = parquetDecompress(data, meta.codec, usize-defLength-repLength); err != nil {
+					return fail(err)
+				}
+			}
+		default:
+			// index pages carry no data
+			continue
+		}
+
+		if nvals < 0 || nvals > int64(length-rows) {
+			return fail(fmt.Errorf("%w: page of %v values does not fit its row group", errParquetInvalid, nvals))
+		}
+		present := int(nvals)
+		if col.optional {
+			defined, err := decodeHybrid(levels, 1, int(nvals))
+			if err != nil {
+				return fail(err)
+			}
+			for j, level := range defined {
+				if level == 0 {
+					nulls.Set(rows+j, true)
+					present--
+				}
+			}
+		}
+		if err := values.decode(data, encoding, col, dict, present); err != nil {
+			return fail(err)
+		}
+		rows += int(nvals)
+	}
+	chunk, err := col.chunk(values, nulls, length)
+	if err != nil {
+		return fail(err)
+	}
+	return chunk, nil
+}
+
+var zstdDecoder struct {
+	sync.Once
+	*zstd.Decoder
+	err error
+}
+
+func parquetDecompress(data []byte, codec, size int64) ([]byte, error) {
+	var ret []byte
+	var err error
+	switch codec {
+	case parquetCodecNone:
+		ret = data
+	case parquetCodecSnappy:
+		ret, err = snappy.Decode(nil, data)
+	case parquetCodecGzip:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			ret, err = io.ReadAll(gr)
+		}
+	case parquetCodecZstd:
+		zstdDecoder.Do(func() {
+			zstdDecoder.Decoder, zstdDecoder.err = zstd.NewReader(nil)
+		})
+		if err = zstdDecoder.err; err == nil {
+			ret, err = zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+		}
+	default:
+		return nil, fmt.Errorf("%w: compression codec %v", errParquetUnsupported, codec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errParquetInvalid, err)
+	}
+	if int64(len(ret)) != size {
+		return nil, fmt.Errorf("%w: page decompressed into %v bytes, expecting %v", errParquetInvalid, len(ret), size)
+	}
+	return ret, nil
+}
+
+// decodeHybrid decodes n values encoded using the RLE/bit-packing hybrid encoding (used for
+// definition levels, dictionary indices and booleans). It consists of runs, each starting with
+// a varint header, its lowest bit determines whether it's a run of a repeated value or a run of
+// bit-packed values (in groups of eight)
+func decodeHybrid(data []byte, bitWidth, n int) ([]uint32, error) {
+	if bitWidth > 32 {
+		return nil, fmt.Errorf("%w: bit width of %v", errParquetInvalid, bitWidth)
+	}
+	ret := make([]uint32, 0, n)
+	byteWidth := (bitWidth + 7) / 8
+	for len(ret) < n {
+		header, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, fmt.Errorf("%w: expecting %v values, got %v", errParquetInvalid, n, len(ret))
+		}
+		data = data[k:]
+		if header&1 == 0 {
+			if len(data) < byteWidth {
+				return nil, fmt.Errorf("%w: truncated run", errParquetInvalid)
+			}
+			var val uint32
+			for j := 0; j < byteWidth; j++ {
+				val |= uint32(data[j]) << (8 * j)
+			}
+			data = data[byteWidth:]
+			for count := header >> 1; count > 0 && len(ret) < n; count-- {
+				ret = append(ret, val)
+			}
+			continue
+		}
+		groups := header >> 1
+		if groups > uint64(len(data)) || groups*uint64(bitWidth) > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: truncated run", errParquetInvalid)
+		}
+		packed := data[:groups*uint64(bitWidth)]
+		data = data[len(packed):]
+		for j := 0; j < int(groups)*8 && len(ret) < n; j++ {
+			var val uint32
+			for b := 0; b < bitWidth; b++ {
+				pos := j*bitWidth + b
+				val |= uint32(packed[pos/8]>>(pos%8)&1) << b
+			}
+			ret = append(ret, val)
+		}
+	}
+	return ret, nil
+}
+
+// parquetValues hold decoded non-null values of a column chunk (or of its dictionary), only one
+// of these is used, depending on the column's physical type
+type parquetValues struct {
+	bools  []bool
+	ints   []int64 // INT32 and INT64
+	floats []float64
+	bytes  [][]byte // BYTE_ARRAY and FIXED_LEN_BYTE_ARRAY
+}
+
+func (pv *parquetValues) len() int {
+	return len(pv.bools) + len(pv.ints) + len(pv.floats) + len(pv.bytes)
+}
+
+func (pv *parquetValues) decode(data []byte, encoding int64, col parquetColumn, dict *parquetValues, n int) error {
+	switch encoding {
+	case parquetEncodingPlain:
+		return pv.appendPlain(data, col, n)
+	case parquetEncodingPlainDictionary, parquetEncodingRLEDictionary:
+		if dict == nil {
+			return fmt.Errorf("%w: dictionary encoded page without a dictionary", errParquetInvalid)
+		}
+		if n == 0 {
+			return nil
+		}
+		// indices are prefixed by their bit width
+		if len(data) == 0 {
+			return fmt.Errorf("%w: no dictionary indices", errParquetInvalid)
+		}
+		indices, err := decodeHybrid(data[1:], int(data[0]), n)
+		if err != nil {
+			return err
+		}
+		return pv.appendIndexed(dict, indices)
+	case parquetEncodingRLE:
+		if col.ptype != parquetTypeBoolean {
+			break
+		}
+		if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+			return fmt.Errorf("%w: invalid run length encoded booleans", errParquetInvalid)
+		}
+		bits, err := decodeHybrid(data[4:4+binary.LittleEndian.Uint32(data)], 1, n)
+		if err != nil {
+			return err
+		}
+		for _, bit := range bits {
+			pv.bools = append(pv.bools, bit == 1)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: encoding %v", errParquetUnsupported, encoding)
+}
+
+func (pv *parquetValues) appendPlain(data []byte, col parquetColumn, n int) error {
+	width := map[int64]int{parquetTypeInt32: 4, parquetTypeInt64: 8, parquetTypeFloat: 4, parquetTypeDouble: 8, parquetTypeFixedLen: col.typeLength}[col.ptype]
+	if n < 0 || (width > 0 && len(data)/width < n) || (col.ptype == parquetTypeBoolean && len(data) < (n+7)/8) {
+		return fmt.Errorf("%w: expecting %v values", errParquetInvalid, n)
+	}
+	switch col.ptype {
+	case parquetTypeBoolean:
+		for j := 0; j < n; j++ {
+			pv.bools = append(pv.bools, data[j/8]>>(j%8)&1 == 1)
+		}
+	case parquetTypeInt32:
+		for j := 0; j < n; j++ {
+			pv.ints = append(pv.ints, int64(int32(binary.LittleEndian.Uint32(data[4*j:]))))
+		}
+	case parquetTypeInt64:
+		for j := 0; j < n; j++ {
+			pv.ints = append(pv.ints, int64(binary.LittleEndian.Uint64(data[8*j:])))
+		}
+	case parquetTypeFloat:
+		for j := 0; j < n; j++ {
+			pv.floats = append(pv.floats, float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*j:]))))
+		}
+	case parquetTypeDouble:
+		for j := 0; j < n; j++ {
+			pv.floats = append(pv.floats, math.Float64frombits(binary.LittleEndian.Uint64(data[8*j:])))
+		}
+	case parquetTypeByteArray:
+		for j := 0; j < n; j++ {
+			if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+				return fmt.Errorf("%w: truncated byte array", errParquetInvalid)
+			}
+			end := 4 + int(binary.LittleEndian.Uint32(data))
+			pv.bytes = append(pv.bytes, data[4:end])
+			data = data[end:]
+		}
+	case parquetTypeFixedLen:
+		for j := 0; j < n; j++ {
+			pv.bytes = append(pv.bytes, data[j*width:(j+1)*width])
+		}
+	default:
+		return fmt.Errorf("%w: physical type %v", errParquetUnsupported, col.ptype)
+	}
+	return nil
+}
+
+func (pv *parquetValues) appendIndexed(dict *parquetValues, indices []uint32) error {
+	size := dict.len()
+	for _, idx := range indices {
+		if int(idx) >= size {
+			return fmt.Errorf("%w: dictionary index %v out of range", errParquetInvalid, idx)
+		}
+	}
+	for _, idx := range indices {
+		switch {
+		case dict.bools != nil:
+			pv.bools = append(pv.bools, dict.bools[idx])
+		case dict.ints != nil:
+			pv.ints = append(pv.ints, dict.ints[idx])
+		case dict.floats != nil:
+			pv.floats = append(pv.floats, dict.floats[idx])
+		default:
+			pv.bytes = append(pv.bytes, dict.bytes[idx])
+		}
+	}
+	return nil
+}
+
+// chunk converts decoded values into a chunk of our type, nulls mark rows with no values
+func (col parquetColumn) chunk(pv *parquetValues, nulls *bitmap.Bitmap, length int) (*Chunk, error) {
+	nnulls := nulls.Count()
+	if col.dtype != DtypeNull && pv.len() != length-nnulls {
+		return nil, fmt.Errorf("%w: expecting %v values, got %v", errParquetInvalid, length-nnulls, pv.len())
+	}
+	var nullability *bitmap.Bitmap
+	if nnulls > 0 {
+		nullability = nulls
+	}
+	// positions of values of non-null rows
+	positions := make([]int, length)
+	k := 0
+	for j := range positions {
+		positions[j] = -1
+		if nnulls == 0 || !nulls.Get(j) {
+			positions[j] = k
+			k++
+		}
+	}
+
+	switch col.dtype {
+	case DtypeNull:
+		ch := NewChunk(DtypeNull)
+		ch.length = uint32(length)
+		return ch, nil
+	case DtypeBool:
+		bools := bitmap.NewBitmap(length)
+		for j, pos := range positions {
+			if pos >= 0 {
+				bools.Set(j, pv.bools[pos])
+			}
+		}
+		ch := NewChunkBoolsFromBitmap(bools)
+		ch.Nullability = nullability
+		return ch, nil
+	case DtypeInt:
+		ints := make([]int64, length)
+		for j, pos := range positions {
+			if pos >= 0 {
+				ints[j] = pv.ints[pos]
+			}
+		}
+		return NewChunkIntsFromSlice(ints, nullability), nil
+	case DtypeFloat:
+		floats := make([]float64, length)
+		for j, pos := range positions {
+			if pos >= 0 {
+				floats[j] = pv.floats[pos]
+			}
+		}
+		return NewChunkFloatsFromSlice(floats, nullability), nil
+	case DtypeDate:
+		dates := make([]date, length)
+		for j, pos := range positions {
+			if pos < 0 {
+				continue
+			}
+			// days since the unix epoch
+			val, err := newDateFromNative(time.Unix(pv.ints[pos]*86400, 0).UTC())
+			if err != nil {
+				return nil, err
+			}
+			dates[j] = val
+		}
+		return newChunkDatesFromSlice(dates, nullability), nil
+	case DtypeDatetime:
+		datetimes := make([]datetime, length)
+		for j, pos := range positions {
+			if pos < 0 {
+				continue
+			}
+			micros := pv.ints[pos]
+			switch col.unit {
+			case parquetTimeUnitMillis:
+				micros *= 1000
+			case parquetTimeUnitNanos:
+				micros /= 1000
+			}
+			val, err := newDatetimeFromNative(time.UnixMicro(micros).UTC())
+			if err != nil {
+				return nil, err
+			}
+			datetimes[j] = val
+		}
+		return newChunkDatetimesFromSlice(datetimes, nullability), nil
+	case DtypeDecimal:
+		decimals := make([]decimal, length)
+		for j, pos := range positions {
+			if pos < 0 {
+				continue
+			}
+			var mantissa int64
+			if pv.ints != nil {
+				mantissa = pv.ints[pos]
+			} else {
+				var ok bool
+				if mantissa, ok = parquetMantissa(pv.bytes[pos]); !ok {
+					return nil, errDecimalOverflow
+				}
+			}
+			val, err := newDecimal(mantissa, col.scale)
+			if err != nil {
+				return nil, err
+			}
+			decimals[j] = val
+		}
+		return newChunkDecimalsFromSlice(decimals, nullability), nil
+	case DtypeString, DtypeJSON:
+		ch := NewChunk(col.dtype)
+		for _, pos := range positions {
+			if pos >= 0 {
+				val := pv.bytes[pos]
+				if col.dtype == DtypeJSON && !json.Valid(val) {
+					return nil, fmt.Errorf("%w: %s", errInvalidJSON, val)
+				}
+				ch.storage.strings = append(ch.storage.strings, val...)
+			}
+			ch.storage.offsets = append(ch.storage.offsets, uint32(len(ch.storage.strings)))
+		}
+		ch.length = uint32(length)
+		ch.Nullability = nullability
+		return ch, nil
+	}
+	return nil, fmt.Errorf("%w: type %v", errParquetUnsupported, col.dtype)
+}
+
+// parquetMantissa decodes a big endian two's complement integer (of any length), it fails if
+// the value does not fit into an int64
+func parquetMantissa(data []byte) (int64, bool) {
+	negative := len(data) > 0 && data[0]&0x80 != 0
+	var pad byte
+	if negative {
+		pad = 0xff
+	}
+	if len(data) > 8 {
+		for _, b := range data[:len(data)-8] {
+			if b != pad {
+				return 0, false
+			}
+		}
+		data = data[len(data)-8:]
+		if (data[0]&0x80 != 0) != negative {
+			return 0, false
+		}
+	}
+	var val uint64
+	if negative {
+		val = math.MaxUint64
+	}
+	for _, b := range data {
+		val = val<<8 | uint64(b)
+	}
+	return int64(val), true
+}
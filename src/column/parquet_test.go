@@ -0,0 +1,379 @@
+package column
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestWritingParquet(t *testing.T) {
+	schema := TableSchema{
+		{Name: "foo", Dtype: DtypeInt, Nullable: true},
+		{Name: "bar", Dtype: DtypeString},
+		{Name: "baz", Dtype: DtypeDecimal},
+		{Name: "bak", Dtype: DtypeNull, Nullable: true},
+		{Name: "bal", Dtype: DtypeBool},
+		{Name: "bam", Dtype: DtypeDate, Nullable: true},
+	}
+	data := []*Chunk{
+		NewChunk(DtypeInt),
+		NewChunk(DtypeString),
+		NewChunk(DtypeDecimal),
+		NewChunk(DtypeNull),
+		NewChunk(DtypeBool),
+		NewChunk(DtypeDate),
+	}
+	vals := [][]string{{"1", "", "3"}, {"a", "bb", ""}, {"1.5", "-0.25", "3"}, {"", "", ""}, {"t", "f", "t"}, {"", "1970-01-02", ""}}
+	for j, col := range data {
+		if err := col.AddValues(vals[j]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteParquet(buf, schema, data); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	if !bytes.HasPrefix(file, []byte(parquetMagic)) || !bytes.HasSuffix(file, []byte(parquetMagic)) {
+		t.Fatalf("expecting a Parquet file to start and end with %v", parquetMagic)
+	}
+	footerLength := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-footerLength : len(file)-8]
+	meta, n, err := readThriftStruct(footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(footer) {
+		t.Errorf("expecting the footer to be read in full, %v bytes remain", len(footer)-n)
+	}
+	if meta[3] != int64(3) {
+		t.Errorf("expecting the file to have 3 rows, got %v", meta[3])
+	}
+
+	// the first schema element is the root, the rest are our columns
+	elements := meta[2].([]interface{})
+	if len(elements) != 1+len(schema) {
+		t.Fatalf("expecting %v schema elements, got %v", 1+len(schema), len(elements))
+	}
+	repetitions := []int64{parquetOptional, parquetRequired, parquetRequired, parquetOptional, parquetRequired, parquetOptional}
+	for j, col := range schema {
+		element := elements[j+1].(thriftStruct)
+		if string(element.bytes(4)) != col.Name || element[3] != repetitions[j] {
+			t.Errorf("expecting column %v to be described as such, got %+v", col.Name, element)
+		}
+	}
+	decimal := elements[3].(thriftStruct)
+	if decimal[1] != int64(parquetTypeFixedLen) || decimal[2] != int64(parquetDecimalLength) || decimal[7] != int64(2) {
+		t.Errorf("expecting decimals to be 16-byte integers at the largest scale, got %+v", decimal)
+	}
+
+	// let's decode a few pages
+	rowGroups := meta[4].([]interface{})
+	columns := rowGroups[0].(thriftStruct)[1].([]interface{})
+	page := func(nth int) []byte {
+		colMeta := columns[nth].(thriftStruct)[3].(thriftStruct)
+		offset := colMeta[9].(int64)
+		header, n, err := readThriftStruct(file[offset:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.strct(5)[1] != int64(3) {
+			t.Errorf("expecting pages to contain 3 values, got %+v", header)
+		}
+		compressed := file[offset+int64(n):][:header[3].(int64)]
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(body)) != header[2].(int64) {
+			t.Errorf("expecting page to be %v bytes uncompressed, got %v", header[2], len(body))
+		}
+		return body
+	}
+	int128 := func(hi, lo uint64) []byte {
+		ret := make([]byte, 16)
+		binary.BigEndian.PutUint64(ret, hi)
+		binary.BigEndian.PutUint64(ret[8:], lo)
+		return ret
+	}
+	pages := []struct {
+		column   int
+		expected []byte
+	}{
+		// definition levels (length, a run of one present value, a null, a present value), two ints
+		{0, []byte{6, 0, 0, 0, 2, 1, 2, 0, 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0}},
+		// lengths and values, no nulls, so no definition levels
+		{1, []byte{1, 0, 0, 0, 'a', 2, 0, 0, 0, 'b', 'b', 0, 0, 0, 0}},
+		// big endian 128-bit integers, at the scale of 2
+		{2, bytes.Join([][]byte{int128(0, 150), int128(math.MaxUint64, uint64(1<<64-25)), int128(0, 300)}, nil)},
+		// definition levels only, all nulls
+		{3, []byte{2, 0, 0, 0, 6, 0}},
+		// bit-packed bools
+		{4, []byte{0b101}},
+		{5, []byte{6, 0, 0, 0, 2, 0, 2, 1, 2, 0, 1, 0, 0, 0}},
+	}
+	for _, test := range pages {
+		if body := page(test.column); !reflect.DeepEqual(body, test.expected) {
+			t.Errorf("expecting column %v to be written as %v, got %v", schema[test.column].Name, test.expected, body)
+		}
+	}
+}
+
+func TestParquetInvalidInputs(t *testing.T) {
+	ints := NewChunkIntsFromSlice([]int64{1, 2, 3}, nil)
+	tests := []struct {
+		schema TableSchema
+		data   []*Chunk
+		err    error
+	}{
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}}, nil, errParquetMisaligned},
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}, {Name: "bar", Dtype: DtypeInt}}, []*Chunk{ints, NewChunkIntsFromSlice([]int64{1}, nil)}, errParquetMisaligned},
+		{TableSchema{{Name: "foo", Dtype: DtypeInt}}, []*Chunk{NewChunkLiteralInts(1, 3)}, errLiteralsCannotBeSerialised},
+		{TableSchema{{Name: "foo", Dtype: DtypeInvalid}}, []*Chunk{ints}, errParquetUnsupportedType},
+		{TableSchema{{Name: "foo", Dtype: DtypeFloat}}, []*Chunk{ints}, errParquetMisaligned},
+	}
+	for _, test := range tests {
+		if err := WriteParquet(new(bytes.Buffer), test.schema, test.data); !errors.Is(err, test.err) {
+			t.Errorf("expecting %+v to fail with %v, got %v", test.schema, test.err, err)
+		}
+	}
+}
+
+func TestReadingParquet(t *testing.T) {
+	schema := TableSchema{
+		{Name: "foo", Dtype: DtypeInt, Nullable: true},
+		{Name: "bar", Dtype: DtypeString},
+		{Name: "baz", Dtype: DtypeDecimal, Nullable: true},
+		{Name: "bak", Dtype: DtypeNull, Nullable: true},
+		{Name: "bal", Dtype: DtypeBool, Nullable: true},
+		{Name: "bam", Dtype: DtypeDate, Nullable: true},
+		{Name: "ban", Dtype: DtypeDatetime},
+		{Name: "bao", Dtype: DtypeFloat},
+		{Name: "bap", Dtype: DtypeJSON, Nullable: true},
+	}
+	vals := [][]string{
+		{"1", "", "3", "-4"},
+		{"a", "bb", "", "ččč"},
+		{"1.50", "-0.25", "", "3.00"},
+		{"", "", "", ""},
+		{"t", "f", "", "t"},
+		{"", "1970-01-02", "", "2020-02-29"},
+		{"2020-01-01 12:34:56.789", "1969-12-31 23:59:59", "2020-01-01 00:00:00", "2000-01-01 00:00:00.000001"},
+		{"1.5", "-2", "1e10", "0"},
+		{`{"a": 1}`, "[]", "", "null"},
+	}
+	data := make([]*Chunk, len(schema))
+	for j, col := range schema {
+		data[j] = NewChunk(col.Dtype)
+		if err := data[j].AddValues(vals[j]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteParquet(buf, schema, data); err != nil {
+		t.Fatal(err)
+	}
+	file := bytes.NewReader(buf.Bytes())
+	pf, err := ReadParquetFile(file, int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only columns with nulls get written as nullable
+	expectedSchema := make(TableSchema, len(schema))
+	copy(expectedSchema, schema)
+	expectedSchema[2].Nullable = true
+	if !reflect.DeepEqual(pf.Schema, expectedSchema) {
+		t.Errorf("expecting the schema to be read as %+v, got %+v", expectedSchema, pf.Schema)
+	}
+	if !reflect.DeepEqual(pf.RowGroups, []int{4}) {
+		t.Errorf("expecting a single row group of four rows, got %v", pf.RowGroups)
+	}
+	for j, col := range schema {
+		chunk, err := pf.ReadColumn(file, 0, j)
+		if err != nil {
+			t.Errorf("failed to read column %v: %v", col.Name, err)
+			continue
+		}
+		if chunk.Dtype() != col.Dtype || chunk.Len() != data[j].Len() {
+			t.Errorf("expecting column %v to be read as %v values of %v, got %v of %v", col.Name, data[j].Len(), col.Dtype, chunk.Len(), chunk.Dtype())
+			continue
+		}
+		for k := 0; k < chunk.Len(); k++ {
+			got, _ := chunk.JSONLiteral(k)
+			expected, _ := data[j].JSONLiteral(k)
+			if got != expected {
+				t.Errorf("expecting row %v of column %v to be %v, got %v", k, col.Name, expected, got)
+			}
+		}
+	}
+	if _, err := pf.ReadColumn(file, 1, 0); !errors.Is(err, errParquetInvalid) {
+		t.Errorf("expecting reads of nonexistent row groups to fail, got %v", err)
+	}
+
+	long := append([]byte{}, buf.Bytes()...)
+	binary.LittleEndian.PutUint32(long[len(long)-8:], math.MaxUint32)
+	blank := append([]byte{}, buf.Bytes()...)
+	copy(blank[len(blank)-40:len(blank)-8], make([]byte, 32))
+	for _, corrupt := range [][]byte{nil, []byte("PAR1PAR1"), buf.Bytes()[:buf.Len()-1], long, blank} {
+		if _, err := ReadParquetFile(bytes.NewReader(corrupt), int64(len(corrupt))); err == nil {
+			t.Errorf("expecting a corrupt file of %v bytes to fail", len(corrupt))
+		}
+	}
+}
+
+func TestDecodingHybrid(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		bitWidth int
+		n        int
+		expected []uint32
+		ok       bool
+	}{
+		{nil, 1, 0, []uint32{}, true},
+		{[]byte{6, 1}, 1, 3, []uint32{1, 1, 1}, true},
+		{[]byte{6, 1, 4, 0}, 1, 5, []uint32{1, 1, 1, 0, 0}, true},
+		{[]byte{6, 1}, 1, 2, []uint32{1, 1}, true}, // runs can exceed what we need
+		{[]byte{4, 0x34, 0x12}, 13, 2, []uint32{0x1234, 0x1234}, true},
+		// one group of eight bit-packed values, LSB first
+		{[]byte{3, 0b10110001}, 1, 8, []uint32{1, 0, 0, 0, 1, 1, 0, 1}, true},
+		{[]byte{3, 0b10110001}, 1, 3, []uint32{1, 0, 0}, true},
+		{[]byte{3, 0b11100100, 0b00011011}, 2, 8, []uint32{0, 1, 2, 3, 3, 2, 1, 0}, true},
+		{[]byte{2}, 0, 1, []uint32{0}, true},
+		{[]byte{6, 1}, 1, 4, nil, false},
+		{[]byte{3}, 1, 8, nil, false},
+		{[]byte{4}, 8, 2, nil, false},
+		{[]byte{2, 0}, 33, 1, nil, false},
+	}
+	for _, test := range tests {
+		got, err := decodeHybrid(test.data, test.bitWidth, test.n)
+		if (err == nil) != test.ok {
+			t.Errorf("expecting %v (bit width %v) to decode: %v, got %v", test.data, test.bitWidth, test.ok, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expecting %v (bit width %v) to decode into %v, got %v", test.data, test.bitWidth, test.expected, got)
+		}
+	}
+}
+
+func TestParquetMantissas(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected int64
+		ok       bool
+	}{
+		{nil, 0, true},
+		{[]byte{1}, 1, true},
+		{[]byte{0xff}, -1, true},
+		{[]byte{0x01, 0x00}, 256, true},
+		{[]byte{0xff, 0x00}, -256, true},
+		{append(make([]byte, 8), 0, 0, 0, 0, 0, 0, 0, 150), 150, true},
+		{append(bytes.Repeat([]byte{0xff}, 15), 0xe7), -25, true},
+		{append(make([]byte, 8), 0x80, 0, 0, 0, 0, 0, 0, 0), 0, false},
+		{append([]byte{1}, make([]byte, 8)...), 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parquetMantissa(test.data)
+		if ok != test.ok || (ok && got != test.expected) {
+			t.Errorf("expecting %v to decode into %v (%v), got %v (%v)", test.data, test.expected, test.ok, got, ok)
+		}
+	}
+}
+
+// we don't write dictionaries or v2 pages, so we need to assemble such a file by hand
+func TestReadingDictionaryEncodedParquet(t *testing.T) {
+	page := func(header func(tw *thriftWriter), body []byte) []byte {
+		tw := newThriftWriter()
+		header(tw)
+		return append(tw.finish(), body...)
+	}
+	dictionary := page(func(tw *thriftWriter) {
+		tw.i32(1, parquetPageDictionary)
+		tw.i32(2, 16)
+		tw.i32(3, 16)
+		tw.beginStruct(7)
+		tw.i32(1, 2)
+		tw.i32(2, parquetEncodingPlain)
+		tw.endStruct()
+	}, []byte{10, 0, 0, 0, 0, 0, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0})
+	// definition levels (bit-packed present, null, present, present), then indices (bit width
+	// of one, runs of 1, 0 and 1)
+	data := page(func(tw *thriftWriter) {
+		tw.i32(1, parquetPageDataV2)
+		tw.i32(2, 9)
+		tw.i32(3, 9)
+		tw.beginStruct(8)
+		tw.i32(1, 4)
+		tw.i32(2, 1)
+		tw.i32(3, 4)
+		tw.i32(4, parquetEncodingRLEDictionary)
+		tw.i32(5, 2)
+		tw.i32(6, 0)
+		tw.boolean(7, false)
+		tw.endStruct()
+	}, []byte{3, 0b1101, 1, 2, 1, 2, 0, 2, 1})
+
+	offset := int64(len(parquetMagic))
+	size := int64(len(dictionary) + len(data))
+	tw := newThriftWriter()
+	tw.i32(1, 1)
+	tw.beginList(2, thriftTypeStruct, 2)
+	tw.listElementStruct()
+	tw.binary(4, "schema")
+	tw.i32(5, 1)
+	tw.endStruct()
+	tw.listElementStruct()
+	tw.i32(1, parquetTypeInt64)
+	tw.i32(3, parquetOptional)
+	tw.binary(4, "x")
+	tw.endStruct()
+	tw.i64(3, 4)
+	tw.beginList(4, thriftTypeStruct, 1)
+	tw.listElementStruct()
+	tw.beginList(1, thriftTypeStruct, 1)
+	tw.listElementStruct()
+	tw.i64(2, offset)
+	tw.beginStruct(3)
+	tw.i32(1, parquetTypeInt64)
+	tw.beginList(2, thriftTypeI32, 1)
+	tw.listElementI32(parquetEncodingRLEDictionary)
+	tw.beginList(3, thriftTypeBinary, 1)
+	tw.listElementBinary("x")
+	tw.i32(4, parquetCodecNone)
+	tw.i64(5, 4)
+	tw.i64(6, size)
+	tw.i64(7, size)
+	tw.i64(9, offset+int64(len(dictionary)))
+	tw.i64(11, offset)
+	tw.endStruct()
+	tw.endStruct()
+	tw.i64(2, size)
+	tw.i64(3, 4)
+	tw.endStruct()
+	footer := tw.finish()
+
+	file := bytes.Join([][]byte{[]byte(parquetMagic), dictionary, data, footer}, nil)
+	file = appendUint32(file, uint32(len(footer)))
+	file = append(file, parquetMagic...)
+	pf, err := ReadParquetFile(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := pf.ReadColumn(bytes.NewReader(file), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NewChunk(DtypeInt)
+	if err := expected.AddValues([]string{"20", "", "10", "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if !ChunksEqual(chunk, expected) {
+		t.Errorf("expecting dictionary encoded values to be read as %v, got %v", expected, chunk)
+	}
+}
@@ -0,0 +1,68 @@
+package column
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var errPostgresUnsupportedType = errors.New("type not supported by the Postgres wire protocol")
+
+// Postgres clients (psql, BI tools) get our data in Postgres' text format, each column is described
+// by an OID of its type (see pg_type.dat in the Postgres repo) and the type's size (-1 for variable
+// length types). Our nulls have no type, so they are sent as text, which clients always understand.
+var postgresTypes = map[Dtype]struct {
+	oid  uint32
+	size int16
+}{
+	DtypeNull:     {25, -1},
+	DtypeString:   {25, -1},
+	DtypeInt:      {20, 8},
+	DtypeFloat:    {701, 8},
+	DtypeBool:     {16, 1},
+	DtypeDate:     {1082, 4},
+	DtypeDatetime: {1114, 8},
+	DtypeDecimal:  {1700, -1},
+	DtypeJSON:     {114, -1},
+}
+
+// PostgresType returns the OID and size of the Postgres type we map a given type onto
+func PostgresType(dtype Dtype) (oid uint32, size int16, err error) {
+	pgtype, ok := postgresTypes[dtype]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %v", errPostgresUnsupportedType, dtype)
+	}
+	return pgtype.oid, pgtype.size, nil
+}
+
+// PostgresText formats the nth value of a chunk in Postgres' text format, it returns false for nulls
+func (rc *Chunk) PostgresText(n int) (string, bool) {
+	if rc.IsLiteral {
+		n = 0
+	}
+	if rc.dtype == DtypeNull || (rc.Nullability != nil && rc.Nullability.Get(n)) {
+		return "", false
+	}
+	switch rc.dtype {
+	case DtypeBool:
+		if rc.storage.bools.Get(n) {
+			return "t", true
+		}
+		return "f", true
+	case DtypeFloat:
+		val := rc.storage.floats[n]
+		switch {
+		case math.IsNaN(val):
+			return "NaN", true
+		case math.IsInf(val, 1):
+			return "Infinity", true
+		case math.IsInf(val, -1):
+			return "-Infinity", true
+		}
+		return strconv.FormatFloat(val, 'g', -1, 64), true
+	case DtypeJSON:
+		return rc.nthValue(n), true
+	}
+	return rc.textValue(n), true
+}
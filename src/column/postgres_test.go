@@ -0,0 +1,51 @@
+package column
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPostgresText(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		values   []string
+		expected []string
+	}{
+		{DtypeString, []string{"foo", ""}, []string{"foo", ""}},
+		{DtypeInt, []string{"12", "", "-3"}, []string{"12", "", "-3"}},
+		{DtypeFloat, []string{"1.5", "1e30", "NaN", "-inf"}, []string{"1.5", "1e+30", "NaN", "-Infinity"}},
+		{DtypeBool, []string{"true", "f", ""}, []string{"t", "f", ""}},
+		{DtypeDate, []string{"2020-02-20"}, []string{"2020-02-20"}},
+		{DtypeDatetime, []string{"2020-02-20 12:34:56"}, []string{"2020-02-20 12:34:56.000000"}},
+		{DtypeDecimal, []string{"1.50", "-2"}, []string{"1.50", "-2"}},
+		{DtypeJSON, []string{`"foo"`, "", `{"a": 1}`}, []string{`"foo"`, "", `{"a": 1}`}},
+		{DtypeNull, []string{"", ""}, []string{"", ""}},
+	}
+	for _, test := range tests {
+		chunk := NewChunk(test.dtype)
+		for _, value := range test.values {
+			// Postgres has special float values as well, so we preserve them
+			if err := chunk.AddValueWithPolicy(value, FloatSpecialsPreserved); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j, value := range test.values {
+			got, ok := chunk.PostgresText(j)
+			// nulls are reported as such, they are not empty strings (except for string columns)
+			null := value == "" && test.dtype != DtypeString
+			if ok == null || got != test.expected[j] {
+				t.Errorf("expecting %v (%v) to be formatted as %q, got %q (non-null: %v)", value, test.dtype, test.expected[j], got, ok)
+			}
+		}
+		if _, _, err := PostgresType(test.dtype); err != nil {
+			t.Errorf("expecting %v to have a Postgres type, got %v", test.dtype, err)
+		}
+	}
+
+	if got, ok := NewChunkLiteralInts(42, 3).PostgresText(2); !ok || got != "42" {
+		t.Errorf("expecting literals to be formatted like other values, got %q", got)
+	}
+	if _, _, err := PostgresType(DtypeInvalid); !errors.Is(err, errPostgresUnsupportedType) {
+		t.Errorf("expecting invalid types not to be mapped, got %v", err)
+	}
+}
@@ -1,13 +1,20 @@
 package column
 
 import (
-	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errProjectionNotSupported = errors.New("projection not supported")
+var errProjectionNotSupported = errs.New(errs.ErrBadRequest, "projection not supported")
+var errInvalidRegexp = errs.New(errs.ErrBadRequest, "invalid regular expression")
+var errInvalidRegexpFlags = errs.New(errs.ErrBadRequest, "invalid regular expression flags")
 
 // one thing that might help us with all the implementations of functions with 2+ arguments:
 // sort them by dtypes (if possible!), that way we can implement far fewer cases
@@ -40,10 +47,6 @@ func intChunkFromParts(data []int64, null1, null2 *bitmap.Bitmap) *Chunk {
 	nulls := bitmap.Or(null1, null2)
 	return NewChunkIntsFromSlice(data, nulls)
 }
-func floatChunkFromParts(data []float64, null1, null2 *bitmap.Bitmap) *Chunk {
-	nulls := bitmap.Or(null1, null2)
-	return NewChunkFloatsFromSlice(data, nulls)
-}
 
 func EvalNot(c *Chunk) (*Chunk, error) {
 	if c.dtype != DtypeBool {
@@ -54,10 +57,34 @@ func EvalNot(c *Chunk) (*Chunk, error) {
 	return ret, nil
 }
 
+// EvalIsNull evaluates `IS NULL` (or `IS NOT NULL`, if negated) straight from our nullability
+// bitmap, the result itself is never null
+func EvalIsNull(c *Chunk, negated bool) *Chunk {
+	if c.dtype == DtypeNull {
+		return NewChunkLiteralBools(!negated, c.Len())
+	}
+	if c.Nullability == nil {
+		if c.IsLiteral {
+			return NewChunkLiteralBools(negated, c.Len())
+		}
+		bm := bitmap.NewBitmap(c.Len())
+		if negated {
+			bm.Invert()
+		}
+		return NewChunkBoolsFromBitmap(bm)
+	}
+	bm := c.Nullability.Clone()
+	if negated {
+		bm.Invert()
+	}
+	return NewChunkBoolsFromBitmap(bm)
+}
+
 func compFactoryStrings(c1 *Chunk, c2 *Chunk, compFn func(string, string) bool) (*Chunk, error) {
 	nvals := c1.Len()
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// literals meet when folding constants (see expr.Fold), in dataless queries, or when comparing
+		// columns constant within a stripe (single runs get read as literals, see DeserializeRLE)
 		val := compFn(c1.nthValue(0), c2.nthValue(0))
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 	}
@@ -96,7 +123,7 @@ func compFactoryInts(c1 *Chunk, c2 *Chunk, compFn func(int64, int64) bool) (*Chu
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.ints[0], c2.storage.ints[0])
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 	}
@@ -126,7 +153,7 @@ func compFactoryFloats(c1 *Chunk, c2 *Chunk, compFn func(float64, float64) bool)
 	bm := bitmap.NewBitmap(nvals)
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.floats[0], c2.storage.floats[0])
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 
@@ -157,7 +184,7 @@ func compFactoryIntsFloats(c1 *Chunk, c2 *Chunk, compFn func(int64, float64) boo
 	bm := bitmap.NewBitmap(nvals)
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.ints[0], c2.storage.floats[0])
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 
@@ -188,7 +215,7 @@ func compFactoryFloatsInts(c1 *Chunk, c2 *Chunk, compFn func(float64, int64) boo
 	bm := bitmap.NewBitmap(nvals)
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.floats[0], c2.storage.ints[0])
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 
@@ -220,7 +247,7 @@ func compFactoryBools(c1 *Chunk, c2 *Chunk, compFn func(uint64, uint64) uint64)
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.bools.Data()[0], c2.storage.bools.Data()[0])
 		return NewChunkLiteralBools(val&1 > 0, nvals), nil // TODO: should this be `boolChunkLiteralFromParts`?
 	}
@@ -247,16 +274,7 @@ func compFactoryBools(c1 *Chunk, c2 *Chunk, compFn func(uint64, uint64) uint64)
 		res[j] = eval(j)
 	}
 
-	// we may have flipped some bits that are not relevant (beyond the bitmap's cap)
-	// so we have to reset them
-	// ARCH: technically we don't have to, there's no contract regarding masked bits
-	//       and inaccessible bits
-	if nvals%64 != 0 {
-		rem := nvals % 64
-		mask := uint64(1<<rem - 1)
-		res[len(res)-1] &= mask
-	}
-
+	// we may have flipped bits beyond nvals, these get cleared when we construct the bitmap
 	return boolChunkFromParts(res, nvals, c1.Nullability, c2.Nullability), nil
 }
 
@@ -265,7 +283,7 @@ func compFactoryDates(c1 *Chunk, c2 *Chunk, compFn func(date, date) bool) (*Chun
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.dates[0], c2.storage.dates[0])
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 	}
@@ -293,7 +311,7 @@ func compFactoryDatetimes(c1 *Chunk, c2 *Chunk, compFn func(datetime, datetime)
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see compFactoryStrings
 		val := compFn(c1.storage.datetimes[0], c2.storage.datetimes[0])
 		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
 	}
@@ -317,6 +335,55 @@ func compFactoryDatetimes(c1 *Chunk, c2 *Chunk, compFn func(datetime, datetime)
 	return boolChunkFromParts(bm.Data(), nvals, c1.Nullability, c2.Nullability), nil
 }
 
+func compFactoryDecimals(c1 *Chunk, c2 *Chunk, compFn func(decimal, decimal) bool) (*Chunk, error) {
+	nvals := c1.Len()
+
+	if c1.IsLiteral && c2.IsLiteral {
+		// see compFactoryStrings
+		val := compFn(c1.storage.decimals[0], c2.storage.decimals[0])
+		return boolChunkLiteralFromParts(val, nvals, c1.Nullability, c2.Nullability), nil
+	}
+
+	bm := bitmap.NewBitmap(nvals)
+	eval := func(j int) bool { return compFn(c1.storage.decimals[j], c2.storage.decimals[j]) }
+	if c1.IsLiteral {
+		val := c1.storage.decimals[0]
+		eval = func(j int) bool { return compFn(val, c2.storage.decimals[j]) }
+	}
+	if c2.IsLiteral {
+		val := c2.storage.decimals[0]
+		eval = func(j int) bool { return compFn(c1.storage.decimals[j], val) }
+	}
+	for j := 0; j < nvals; j++ {
+		if eval(j) {
+			bm.Set(j, true)
+		}
+	}
+	return boolChunkFromParts(bm.Data(), nvals, c1.Nullability, c2.Nullability), nil
+}
+
+// decimals can be combined with ints (which get upcast to decimals) and floats (which
+// "win", we don't want to pretend float inputs are exact)
+func alignDecimalOperands(c1, c2 *Chunk) (*Chunk, *Chunk, error) {
+	var err error
+	target := DtypeDecimal
+	if c1.dtype == DtypeFloat || c2.dtype == DtypeFloat {
+		target = DtypeFloat
+	}
+	if c1, err = c1.cast(target); err != nil {
+		return nil, nil, err
+	}
+	if c2, err = c2.cast(target); err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+func isDecimalMix(c1, c2 Dtype) bool {
+	numeric := func(dt Dtype) bool { return dt == DtypeInt || dt == DtypeFloat || dt == DtypeDecimal }
+	return c1 != c2 && (c1 == DtypeDecimal || c2 == DtypeDecimal) && numeric(c1) && numeric(c2)
+}
+
 type compFuncs struct {
 	ints      func(int64, int64) bool
 	floats    func(float64, float64) bool
@@ -326,6 +393,7 @@ type compFuncs struct {
 	bools     func(uint64, uint64) uint64
 	dates     func(date, date) bool
 	datetimes func(datetime, datetime) bool
+	decimals  func(decimal, decimal) bool
 }
 
 // OPTIM: what if c1 === c2? short circuit it with a boolean array (copy in the nullability vector though)
@@ -363,11 +431,24 @@ func compEval(c1 *Chunk, c2 *Chunk, cf compFuncs) (*Chunk, error) {
 				return nil, err
 			}
 			return compFactoryDatetimes(c1, c2, cf.datetimes)
+		case DtypeDecimal:
+			if cf.decimals == nil {
+				return nil, err
+			}
+			return compFactoryDecimals(c1, c2, cf.decimals)
 		default:
 			return nil, err
 		}
 	}
 
+	if isDecimalMix(c1.dtype, c2.dtype) {
+		c1a, c2a, cerr := alignDecimalOperands(c1, c2)
+		if cerr != nil {
+			return nil, cerr
+		}
+		return compEval(c1a, c2a, cf)
+	}
+
 	type dtypes struct{ a, b Dtype }
 	c1d := c1.dtype
 	c2d := c2.dtype
@@ -414,6 +495,7 @@ func EvalEq(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 		bools:     func(a, b uint64) uint64 { return a ^ (^b) },
 		dates:     DatesEqual,
 		datetimes: DatetimesEqual,
+		decimals:  DecimalsEqual,
 	})
 }
 
@@ -428,6 +510,7 @@ func EvalNeq(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 		bools:     func(a, b uint64) uint64 { return a ^ b },
 		dates:     DatesNotEqual,
 		datetimes: DatetimesNotEqual,
+		decimals:  DecimalsNotEqual,
 	})
 }
 
@@ -442,6 +525,7 @@ func EvalGt(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 		bools:     func(a, b uint64) uint64 { return a & (^b) },
 		dates:     DatesGreaterThan,
 		datetimes: DatetimesGreaterThan,
+		decimals:  DecimalsGreaterThan,
 	})
 }
 
@@ -456,6 +540,7 @@ func EvalGte(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 		bools:     func(a, b uint64) uint64 { return (a & (^b)) | (a ^ (^b)) },
 		dates:     DatesGreaterThanEqual,
 		datetimes: DatetimesGreaterThanEqual,
+		decimals:  DecimalsGreaterThanEqual,
 	})
 }
 
@@ -469,45 +554,276 @@ func EvalLte(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 	return EvalGte(c2, c1)
 }
 
+// likeMatcher compiles a LIKE pattern (`%` matches any number of characters, `_` matches exactly
+// one) into a matching function. Patterns with wildcards only at their edges (e.g. `foo%`, `%foo`,
+// `%foo%`) don't need the general matcher, so we use plain string functions for those.
+// ARCH: there is no way to escape wildcards (no ESCAPE clause), so `%` and `_` cannot be matched literally
+func likeMatcher(pattern string) func(string) bool {
+	if !strings.ContainsRune(pattern, '_') {
+		inner := strings.Trim(pattern, "%")
+		if !strings.ContainsRune(inner, '%') {
+			prefixed := len(pattern) > len(inner) && pattern[0] == '%'
+			suffixed := len(pattern) > len(inner) && pattern[len(pattern)-1] == '%'
+			switch {
+			case len(inner) == 0 && len(pattern) > 0: // `%`, `%%` etc.
+				return func(string) bool { return true }
+			case prefixed && suffixed:
+				return func(s string) bool { return strings.Contains(s, inner) }
+			case prefixed:
+				return func(s string) bool { return strings.HasSuffix(s, inner) }
+			case suffixed:
+				return func(s string) bool { return strings.HasPrefix(s, inner) }
+			default:
+				return func(s string) bool { return s == pattern }
+			}
+		}
+	}
+	return func(s string) bool { return likeMatch(s, pattern) }
+}
+
+// likeMatch is a greedy matcher, which backtracks to the last `%` seen upon mismatches,
+// this gives us linear time for most patterns (and quadratic at worst)
+func likeMatch(s, pattern string) bool {
+	var si, pi int
+	starPi, starSi := -1, -1
+	for si < len(s) {
+		if pi < len(pattern) {
+			pc, psize := utf8.DecodeRuneInString(pattern[pi:])
+			sc, ssize := utf8.DecodeRuneInString(s[si:])
+			switch {
+			case pc == '%':
+				starPi, starSi = pi, si
+				pi += psize
+				continue
+			case pc == '_' || pc == sc:
+				pi += psize
+				si += ssize
+				continue
+			}
+		}
+		if starPi == -1 {
+			return false
+		}
+		// let the last `%` consume one more character and try again
+		_, ssize := utf8.DecodeRuneInString(s[starSi:])
+		starSi += ssize
+		si = starSi
+		pi = starPi + 1
+	}
+	for pi < len(pattern) && pattern[pi] == '%' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
+func likeEval(c1 *Chunk, c2 *Chunk, caseInsensitive bool) (*Chunk, error) {
+	if c1.dtype != DtypeString || c2.dtype != DtypeString {
+		return nil, fmt.Errorf("%w: LIKE needs strings, got %v and %v", errProjectionNotSupported, c1.dtype, c2.dtype)
+	}
+	if !c2.IsLiteral {
+		return nil, fmt.Errorf("%w: LIKE patterns need to be literals", errProjectionNotSupported)
+	}
+	pattern := c2.nthValue(0)
+	if caseInsensitive {
+		pattern = strings.ToLower(pattern)
+	}
+	match := likeMatcher(pattern)
+	// OPTIM: we lowercase each value, which allocates, we could fold cases while matching instead
+	value := c1.nthValue
+	if caseInsensitive {
+		value = func(j int) string { return strings.ToLower(c1.nthValue(j)) }
+	}
+
+	nvals := c1.Len()
+	if c1.IsLiteral {
+		return boolChunkLiteralFromParts(match(value(0)), nvals, c1.Nullability, nil), nil
+	}
+	bm := bitmap.NewBitmap(nvals)
+	for j := 0; j < nvals; j++ {
+		if match(value(j)) {
+			bm.Set(j, true)
+		}
+	}
+	return boolChunkFromParts(bm.Data(), nvals, c1.Nullability, nil), nil
+}
+
+// EvalLike matches strings in c1 against a (literal) pattern in c2
+func EvalLike(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
+	return likeEval(c1, c2, false)
+}
+
+// EvalIlike is a case insensitive version of EvalLike
+func EvalIlike(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
+	return likeEval(c1, c2, true)
+}
+
+// RegexpMatcher matches strings against a regular expression (RE2 syntax, see regexp/syntax). The pattern
+// gets compiled upon first use and it's then reused for all subsequent chunks, so a matcher is meant
+// to serve a single expression of a single query (it's safe to use it for stripes in parallel).
+type RegexpMatcher struct {
+	once sync.Once
+	re   *regexp.Regexp
+	err  error
+}
+
+// Match reports which strings in c1 match a (literal) pattern in c2, null values (or a null pattern)
+// yield nulls
+func (rm *RegexpMatcher) Match(c1 *Chunk, c2 *Chunk, caseInsensitive bool) (*Chunk, error) {
+	if !(c1.dtype == DtypeString || c1.dtype == DtypeNull) || !(c2.dtype == DtypeString || c2.dtype == DtypeNull) {
+		return nil, fmt.Errorf("%w: regular expressions need strings, got %v and %v", errProjectionNotSupported, c1.dtype, c2.dtype)
+	}
+	if !c2.IsLiteral {
+		return nil, fmt.Errorf("%w: regular expressions need to be literals", errProjectionNotSupported)
+	}
+	nvals := c1.Len()
+	if c1.dtype == DtypeNull || c2.dtype == DtypeNull {
+		nulls := bitmap.NewBitmap(nvals)
+		nulls.Invert()
+		return boolChunkLiteralFromParts(false, nvals, nulls, nil), nil
+	}
+	rm.once.Do(func() {
+		pattern := c2.nthValue(0)
+		if caseInsensitive {
+			pattern = "(?i)" + pattern
+		}
+		rm.re, rm.err = regexp.Compile(pattern)
+		if rm.err != nil {
+			rm.err = fmt.Errorf("%w: %v", errInvalidRegexp, rm.err)
+		}
+	})
+	if rm.err != nil {
+		return nil, rm.err
+	}
+
+	if c1.IsLiteral {
+		return boolChunkLiteralFromParts(rm.re.MatchString(c1.nthValue(0)), nvals, c1.Nullability, nil), nil
+	}
+	bm := bitmap.NewBitmap(nvals)
+	for j := 0; j < nvals; j++ {
+		if c1.Nullability != nil && c1.Nullability.Get(j) {
+			continue
+		}
+		if rm.re.MatchString(c1.nthValue(j)) {
+			bm.Set(j, true)
+		}
+	}
+	return boolChunkFromParts(bm.Data(), nvals, c1.Nullability, nil), nil
+}
+
+// Eval implements `regexp_matches(value, pattern[, flags])`, flags being a (literal) string of 'i'
+// (case insensitive matching) and 'c' (case sensitive matching, the default), the last one wins
+func (rm *RegexpMatcher) Eval(cs ...*Chunk) (*Chunk, error) {
+	caseInsensitive := false
+	if len(cs) > 2 {
+		if cs[2].dtype != DtypeString || !cs[2].IsLiteral {
+			return nil, fmt.Errorf("%w: flags need to be a string literal", errInvalidRegexpFlags)
+		}
+		for _, flag := range cs[2].nthValue(0) {
+			switch flag {
+			case 'i':
+				caseInsensitive = true
+			case 'c':
+				caseInsensitive = false
+			default:
+				return nil, fmt.Errorf("%w: %q", errInvalidRegexpFlags, flag)
+			}
+		}
+	}
+	return rm.Match(cs[0], cs[1], caseInsensitive)
+}
+
 // ARCH: either get rid of all this via generic, or, better yet, rewrite all the algebraics
 // using functions. We could then, like in Julia (or lisps), have a function -(a, b)
 type algebraFuncs struct {
-	ints     func(int64, int64) int64
+	ints     func(int64, int64) (int64, bool) // false signals a null result (division by zero)
 	floats   func(float64, float64) float64
 	intfloat func(int64, float64) float64
 	floatint func(float64, int64) float64
+	decimals func(decimal, decimal) (decimal, bool) // false signals an overflow
+}
+
+// forNonNull calls fn for each of the first n rows that is not null in a given bitmap - whole
+// 64-row words that are all null get skipped without touching the data, so null-heavy (sparse)
+// columns only cost us their bitmaps
+func forNonNull(nulls *bitmap.Bitmap, n int, fn func(j int)) {
+	if nulls == nil {
+		for j := 0; j < n; j++ {
+			fn(j)
+		}
+		return
+	}
+	words := nulls.Data()
+	for start := 0; start < n; start += 64 {
+		end := start + 64
+		if end > n {
+			end = n
+		}
+		var word uint64
+		if start/64 < len(words) {
+			word = words[start/64]
+		}
+		switch word {
+		case math.MaxUint64:
+			continue
+		case 0:
+			for j := start; j < end; j++ {
+				fn(j)
+			}
+		default:
+			for j := start; j < end; j++ {
+				if word&(1<<(j-start)) == 0 {
+					fn(j)
+				}
+			}
+		}
+	}
 }
 
-func algebraFactoryInts(c1 *Chunk, c2 *Chunk, compFn func(int64, int64) int64) (*Chunk, error) {
+func algebraFactoryInts(c1 *Chunk, c2 *Chunk, compFn func(int64, int64) (int64, bool)) (*Chunk, error) {
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
-		val := compFn(c1.storage.ints[0], c2.storage.ints[0])
-		return NewChunkLiteralInts(val, nvals), nil
+		// literals meet the same way they do in comparisons, see compFactoryStrings
+		val, ok := compFn(c1.storage.ints[0], c2.storage.ints[0])
+		ret := NewChunkLiteralInts(val, nvals)
+		if !ok {
+			ret.Nullability = bitmap.NewBitmap(nvals)
+			ret.Nullability.Invert()
+		}
+		return ret, nil
 	}
-	var eval func(j int) int64
-	eval = func(j int) int64 { return compFn(c1.storage.ints[j], c2.storage.ints[j]) }
+	var eval func(j int) (int64, bool)
+	eval = func(j int) (int64, bool) { return compFn(c1.storage.ints[j], c2.storage.ints[j]) }
 	if c1.IsLiteral {
 		val := c1.storage.ints[0]
-		eval = func(j int) int64 { return compFn(val, c2.storage.ints[j]) }
+		eval = func(j int) (int64, bool) { return compFn(val, c2.storage.ints[j]) }
 	}
 	if c2.IsLiteral {
 		val := c2.storage.ints[0]
-		eval = func(j int) int64 { return compFn(c1.storage.ints[j], val) }
+		eval = func(j int) (int64, bool) { return compFn(c1.storage.ints[j], val) }
 	}
+	nulls := bitmap.Or(c1.Nullability, c2.Nullability)
 	ret := make([]int64, nvals)
-	for j := 0; j < nvals; j++ {
-		ret[j] = eval(j)
-	}
-	return intChunkFromParts(ret, c1.Nullability, c2.Nullability), nil
+	var invalid *bitmap.Bitmap
+	forNonNull(nulls, nvals, func(j int) {
+		val, ok := eval(j)
+		if !ok {
+			if invalid == nil {
+				invalid = bitmap.NewBitmap(nvals)
+			}
+			invalid.Set(j, true)
+			return
+		}
+		ret[j] = val
+	})
+	return intChunkFromParts(ret, nulls, invalid), nil
 }
 
 func algebraFactoryFloats(c1 *Chunk, c2 *Chunk, compFn func(float64, float64) float64) (*Chunk, error) {
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see algebraFactoryInts
 		val := compFn(c1.storage.floats[0], c2.storage.floats[0])
 		return NewChunkLiteralFloats(val, nvals), nil
 	}
@@ -521,11 +837,10 @@ func algebraFactoryFloats(c1 *Chunk, c2 *Chunk, compFn func(float64, float64) fl
 		val := c2.storage.floats[0]
 		eval = func(j int) float64 { return compFn(c1.storage.floats[j], val) }
 	}
+	nulls := bitmap.Or(c1.Nullability, c2.Nullability)
 	ret := make([]float64, nvals)
-	for j := 0; j < nvals; j++ {
-		ret[j] = eval(j)
-	}
-	return floatChunkFromParts(ret, c1.Nullability, c2.Nullability), nil
+	forNonNull(nulls, nvals, func(j int) { ret[j] = eval(j) })
+	return NewChunkFloatsFromSlice(ret, nulls), nil
 }
 
 // ARCH: this is identical to `algebraFactoryFloats` apart from the compFn signature in the argument
@@ -533,7 +848,7 @@ func algebraFactoryIntFloat(c1 *Chunk, c2 *Chunk, compFn func(int64, float64) fl
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see algebraFactoryInts
 		val := compFn(c1.storage.ints[0], c2.storage.floats[0])
 		return NewChunkLiteralFloats(val, nvals), nil
 	}
@@ -547,11 +862,10 @@ func algebraFactoryIntFloat(c1 *Chunk, c2 *Chunk, compFn func(int64, float64) fl
 		val := c2.storage.floats[0]
 		eval = func(j int) float64 { return compFn(c1.storage.ints[j], val) }
 	}
+	nulls := bitmap.Or(c1.Nullability, c2.Nullability)
 	ret := make([]float64, nvals)
-	for j := 0; j < nvals; j++ {
-		ret[j] = eval(j)
-	}
-	return floatChunkFromParts(ret, c1.Nullability, c2.Nullability), nil
+	forNonNull(nulls, nvals, func(j int) { ret[j] = eval(j) })
+	return NewChunkFloatsFromSlice(ret, nulls), nil
 }
 
 // ARCH: this is identical to `algebraFactoryFloats` apart from the compFn signature in the argument
@@ -559,7 +873,7 @@ func algebraFactoryFloatInt(c1 *Chunk, c2 *Chunk, compFn func(float64, int64) fl
 	nvals := c1.Len()
 
 	if c1.IsLiteral && c2.IsLiteral {
-		// OPTIM: this should be a part of constant folding and should never get to this point
+		// see algebraFactoryInts
 		val := compFn(c1.storage.floats[0], c2.storage.ints[0])
 		return NewChunkLiteralFloats(val, nvals), nil
 	}
@@ -573,11 +887,48 @@ func algebraFactoryFloatInt(c1 *Chunk, c2 *Chunk, compFn func(float64, int64) fl
 		val := c2.storage.ints[0]
 		eval = func(j int) float64 { return compFn(c1.storage.floats[j], val) }
 	}
+	nulls := bitmap.Or(c1.Nullability, c2.Nullability)
 	ret := make([]float64, nvals)
-	for j := 0; j < nvals; j++ {
-		ret[j] = eval(j)
+	forNonNull(nulls, nvals, func(j int) { ret[j] = eval(j) })
+	return NewChunkFloatsFromSlice(ret, nulls), nil
+}
+
+func algebraFactoryDecimals(c1 *Chunk, c2 *Chunk, compFn func(decimal, decimal) (decimal, bool)) (*Chunk, error) {
+	nvals := c1.Len()
+
+	if c1.IsLiteral && c2.IsLiteral {
+		// see algebraFactoryInts
+		val, ok := compFn(c1.storage.decimals[0], c2.storage.decimals[0])
+		if !ok {
+			return nil, errDecimalOverflow
+		}
+		return NewChunkLiteralDecimals(val, nvals), nil
+	}
+	var eval func(j int) (decimal, bool)
+	eval = func(j int) (decimal, bool) { return compFn(c1.storage.decimals[j], c2.storage.decimals[j]) }
+	if c1.IsLiteral {
+		val := c1.storage.decimals[0]
+		eval = func(j int) (decimal, bool) { return compFn(val, c2.storage.decimals[j]) }
+	}
+	if c2.IsLiteral {
+		val := c2.storage.decimals[0]
+		eval = func(j int) (decimal, bool) { return compFn(c1.storage.decimals[j], val) }
 	}
-	return floatChunkFromParts(ret, c1.Nullability, c2.Nullability), nil
+	// null rows don't get evaluated, so they cannot overflow
+	nulls := bitmap.Or(c1.Nullability, c2.Nullability)
+	ret := make([]decimal, nvals)
+	overflow := false
+	forNonNull(nulls, nvals, func(j int) {
+		val, ok := eval(j)
+		if !ok {
+			overflow = true
+		}
+		ret[j] = val
+	})
+	if overflow {
+		return nil, errDecimalOverflow
+	}
+	return newChunkDecimalsFromSlice(ret, nulls), nil
 }
 
 func algebraicEval(c1 *Chunk, c2 *Chunk, commutative bool, cf algebraFuncs) (*Chunk, error) {
@@ -592,10 +943,31 @@ func algebraicEval(c1 *Chunk, c2 *Chunk, commutative bool, cf algebraFuncs) (*Ch
 			return algebraFactoryInts(c1, c2, cf.ints)
 		case DtypeFloat:
 			return algebraFactoryFloats(c1, c2, cf.floats)
+		case DtypeDecimal:
+			// some operations (division) don't yield exact results, so we compute them in floats
+			if cf.decimals == nil {
+				c1f, err := c1.cast(DtypeFloat)
+				if err != nil {
+					return nil, err
+				}
+				c2f, err := c2.cast(DtypeFloat)
+				if err != nil {
+					return nil, err
+				}
+				return algebraFactoryFloats(c1f, c2f, cf.floats)
+			}
+			return algebraFactoryDecimals(c1, c2, cf.decimals)
 		default:
 			return nil, errg(c1d, c2d)
 		}
 	}
+	if isDecimalMix(c1d, c2d) {
+		c1a, c2a, err := alignDecimalOperands(c1, c2)
+		if err != nil {
+			return nil, err
+		}
+		return algebraicEval(c1a, c2a, commutative, cf)
+	}
 
 	type dtypes struct{ a, b Dtype }
 	cs := dtypes{c1d, c2d}
@@ -620,26 +992,33 @@ func algebraicEval(c1 *Chunk, c2 *Chunk, commutative bool, cf algebraFuncs) (*Ch
 // a solid case for generics?
 func EvalAdd(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 	return algebraicEval(c1, c2, true, algebraFuncs{
-		ints:     func(a, b int64) int64 { return a + b },
+		ints:     func(a, b int64) (int64, bool) { return a + b, true },
 		floats:   func(a, b float64) float64 { return a + b },
 		intfloat: func(a int64, b float64) float64 { return float64(a) + b }, // commutative
+		decimals: decimalsAdd,
 	})
 }
 
 func EvalSubtract(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 	return algebraicEval(c1, c2, false, algebraFuncs{
-		ints:     func(a, b int64) int64 { return a - b },
+		ints:     func(a, b int64) (int64, bool) { return a - b, true },
 		floats:   func(a, b float64) float64 { return a - b },
 		intfloat: func(a int64, b float64) float64 { return float64(a) - b }, // commutative only with a multiplication
 		floatint: func(a float64, b int64) float64 { return a - float64(b) },
+		decimals: decimalsSubtract,
 	})
 }
 
 // different return type for ints! should we perhaps cast to make this more systematic?
-// check for division by zero (gives +- infty, which will break json?)
+// integer division by zero yields a null, floats follow IEEE 754 (gives +- infty, which will break json?)
 func EvalDivide(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 	return algebraicEval(c1, c2, false, algebraFuncs{
-		ints:     func(a, b int64) int64 { return a / b },
+		ints: func(a, b int64) (int64, bool) {
+			if b == 0 {
+				return 0, false
+			}
+			return a / b, true
+		},
 		floats:   func(a, b float64) float64 { return a / b },
 		intfloat: func(a int64, b float64) float64 { return float64(a) / b }, // not commutative
 		floatint: func(a float64, b int64) float64 { return a / float64(b) },
@@ -648,8 +1027,9 @@ func EvalDivide(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 
 func EvalMultiply(c1 *Chunk, c2 *Chunk) (*Chunk, error) {
 	return algebraicEval(c1, c2, true, algebraFuncs{
-		ints:     func(a, b int64) int64 { return a * b },
+		ints:     func(a, b int64) (int64, bool) { return a * b, true },
 		floats:   func(a, b float64) float64 { return a * b },
 		intfloat: func(a int64, b float64) float64 { return float64(a) * b }, // commutative
+		decimals: decimalsMultiply,
 	})
 }
@@ -2,8 +2,11 @@ package column
 
 import (
 	"errors"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/kokes/smda/src/bitmap"
 )
 
 var litPrefix = "lit:"
@@ -143,6 +146,10 @@ func TestComparisons(t *testing.T) {
 		{DtypeDate, DtypeDate, EvalGte, 3, "2020-02-22,1977-12-31,1901-02-28", "lit:1977-12-31", "t,t,f"},
 		{DtypeDatetime, DtypeDatetime, EvalLt, 2, "1920-02-22 12:34:56,1980-12-22 00:01:02", "1980-12-22 00:01:02,1980-12-22 00:01:02", "t,f"},
 		{DtypeDatetime, DtypeDatetime, EvalLte, 2, "1920-02-22 12:34:56,1980-12-22 00:01:02", "1980-12-22 00:01:02,1980-12-22 00:01:02", "t,t"},
+		{DtypeDecimal, DtypeDecimal, EvalEq, 3, "12.30,1.5,0.05", "12.3,1.50,0.5", "t,t,f"},
+		{DtypeDecimal, DtypeDecimal, EvalGt, 3, "12.30,1.5,0.05", "lit:1.50", "t,f,f"},
+		{DtypeDecimal, DtypeInt, EvalLte, 3, "12.30,1.00,0.05", "lit:1", "f,t,t"},
+		{DtypeInt, DtypeDecimal, EvalNeq, 2, "1,2", "1.00,2.01", "f,t"},
 	}
 	for _, test := range tests {
 		c1, c2, expected, err := prepColumns(test.nrows, test.dtype1, test.dtype2, DtypeBool, test.c1, test.c2, test.expected)
@@ -202,6 +209,10 @@ func TestAlgebraicExpressions(t *testing.T) {
 		{EvalDivide, 2, DtypeFloat, DtypeFloat, DtypeFloat, "1,2.2", ",8.3", ",0.26506024096385544", nil},
 		{EvalDivide, 2, DtypeFloat, DtypeFloat, DtypeFloat, ",2.2", "0,8.3", ",0.26506024096385544", nil},
 		{EvalAdd, 3, DtypeInt, DtypeInt, DtypeInt, "lit:34", "4,,6", "38,,40", nil},
+		// integer division by zero results in nulls
+		{EvalDivide, 3, DtypeInt, DtypeInt, DtypeInt, "1,2,3", "0,2,", ",1,", nil},
+		{EvalDivide, 3, DtypeInt, DtypeInt, DtypeInt, "4,5,6", "lit:0", ",,", nil},
+		{EvalDivide, 3, DtypeInt, DtypeInt, DtypeInt, "lit:4", "0,5,0", ",0,", nil},
 		// TODO: we don't have nullable typed literals (so 4 > NULL will fail)
 		// {EvalAdd, 3, DtypeInt, DtypeInt, DtypeInt, "lit:34", "lit:", "lit:", nil},
 
@@ -237,6 +248,14 @@ func TestAlgebraicExpressions(t *testing.T) {
 		{EvalMultiply, 3, DtypeInt, DtypeFloat, DtypeFloat, "lit:34", "4,5.5,6.2", "136,187,210.8", nil},
 		{EvalMultiply, 3, DtypeFloat, DtypeInt, DtypeFloat, "4,5.5,6.2", "lit:34", "136,187,210.8", nil},
 		{EvalMultiply, 3, DtypeFloat, DtypeFloat, DtypeFloat, "lit:35", "lit:33.5", "lit:1172.5", nil},
+
+		// decimals
+		{EvalAdd, 3, DtypeDecimal, DtypeDecimal, DtypeDecimal, "0.10,1.5,", "0.20,0.25,1", "0.30,1.75,", nil},
+		{EvalAdd, 2, DtypeDecimal, DtypeInt, DtypeDecimal, "0.10,1.5", "lit:2", "2.10,3.5", nil},
+		{EvalSubtract, 2, DtypeInt, DtypeDecimal, DtypeDecimal, "1,2", "0.10,0.25", "0.90,1.75", nil},
+		{EvalMultiply, 2, DtypeDecimal, DtypeDecimal, DtypeDecimal, "1.10,2.5", "2.5,0.5", "2.750,1.25", nil},
+		{EvalAdd, 2, DtypeDecimal, DtypeFloat, DtypeFloat, "0.5,1.25", "0.25,1", "0.75,2.25", nil},
+		{EvalDivide, 2, DtypeDecimal, DtypeDecimal, DtypeFloat, "1.00,2.5", "4,0.5", "0.25,5", nil},
 	}
 	for _, test := range tests {
 		c1, c2, expected, err := prepColumns(test.nrows, test.dt1, test.dt2, test.dte, test.c1, test.c2, test.expected)
@@ -256,6 +275,62 @@ func TestAlgebraicExpressions(t *testing.T) {
 	}
 }
 
+// rows spanning several bitmap words, some of them entirely null, some partially
+func TestSparseAlgebraicExpressions(t *testing.T) {
+	n := 300
+	vals1, vals2, expected := make([]string, n), make([]string, n), make([]string, n)
+	for j := 0; j < n; j++ {
+		vals1[j] = strconv.Itoa(j)
+		vals2[j] = strconv.Itoa(j % 7)
+		switch {
+		case j >= 64 && j < 192, j%5 == 0:
+			vals1[j] = ""
+		case j%7 == 0:
+			// division by zero
+		default:
+			expected[j] = strconv.Itoa(j / (j % 7))
+		}
+	}
+	c1, c2, exp := NewChunk(DtypeInt), NewChunk(DtypeInt), NewChunk(DtypeInt)
+	for _, pair := range []struct {
+		chunk *Chunk
+		vals  []string
+	}{{c1, vals1}, {c2, vals2}, {exp, expected}} {
+		if err := pair.chunk.AddValues(pair.vals); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := EvalDivide(c1, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ChunksEqual(res, exp) {
+		t.Errorf("sparse division resulted in %+v", res)
+	}
+}
+
+func BenchmarkSparseAddition(b *testing.B) {
+	n := 10000
+	c1, c2 := NewChunk(DtypeInt), NewChunk(DtypeInt)
+	for j := 0; j < n; j++ {
+		val := ""
+		// most rows are null, with a few short stretches of values
+		if j%1000 < 50 {
+			val = strconv.Itoa(j)
+		}
+		c1.AddValue(val)
+		c2.AddValue(strconv.Itoa(j))
+	}
+	b.ResetTimer()
+
+	for j := 0; j < b.N; j++ {
+		if _, err := EvalAdd(c1, c2); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(8 * n))
+}
+
 func TestNot(t *testing.T) {
 	tests := []struct {
 		nrows        int
@@ -295,3 +370,205 @@ func TestNot(t *testing.T) {
 		}
 	}
 }
+
+func TestLikeMatching(t *testing.T) {
+	tests := []struct {
+		value, pattern string
+		matches        bool
+	}{
+		{"", "", true},
+		{"foo", "", false},
+		{"", "%", true},
+		{"foo", "%", true},
+		{"foo", "%%", true},
+		{"foo", "foo", true},
+		{"foo", "fo", false},
+		{"foo", "f%", true},
+		{"foo", "fo%", true},
+		{"foo", "foo%", true},
+		{"foo", "o%", false},
+		{"foo", "%o", true},
+		{"foo", "%oo", true},
+		{"foo", "%f", false},
+		{"foo", "%o%", true},
+		{"foo", "%x%", false},
+		{"foo", "f_o", true},
+		{"foo", "f__", true},
+		{"foo", "f_", false},
+		{"foo", "___", true},
+		{"foo", "____", false},
+		{"foo", "_%", true},
+		{"fo", "f%o", true},
+		{"foobar", "f%b%r", true},
+		{"foobar", "f%b%z", false},
+		{"foobar", "%o_a%", true},
+		{"aaab", "%a%ab", true},
+		{"abcabc", "%bc", true},
+		{"mississippi", "m%iss%ppi", true},
+		{"mississippi", "m%iss%iss%iss%", false},
+		// multi-byte characters are single characters for `_`
+		{"čaj", "_aj", true},
+		{"čaj", "__aj", false},
+		{"žluťoučký", "%ť_u%", true},
+	}
+	for _, test := range tests {
+		if matches := likeMatcher(test.pattern)(test.value); matches != test.matches {
+			t.Errorf("expecting %v LIKE %v to be %v, got %v", test.value, test.pattern, test.matches, matches)
+		}
+		// the general matcher needs to agree with our fast paths
+		if matches := likeMatch(test.value, test.pattern); matches != test.matches {
+			t.Errorf("expecting %v LIKE %v to be %v in the general matcher, got %v", test.value, test.pattern, test.matches, matches)
+		}
+	}
+}
+
+func TestLike(t *testing.T) {
+	tests := []struct {
+		fnc              func(*Chunk, *Chunk) (*Chunk, error)
+		nrows            int
+		c1, c2, expected string
+	}{
+		{EvalLike, 3, "foo,bar,baz", "lit:ba%", "f,t,t"},
+		{EvalLike, 3, "foo,bar,baz", "lit:%o", "t,f,f"},
+		{EvalLike, 3, "foo,bar,baz", "lit:%a%", "f,t,t"},
+		{EvalLike, 3, "foo,bar,baz", "lit:b_r", "f,t,f"},
+		{EvalLike, 3, "foo,bar,baz", "lit:Foo", "f,f,f"},
+		{EvalLike, 3, "foo,Bar,BAZ", "lit:ba%", "f,f,f"},
+		{EvalIlike, 3, "foo,Bar,BAZ", "lit:ba%", "f,t,t"},
+		{EvalIlike, 3, "foo,Bar,BAZ", "lit:BA_", "f,t,t"},
+		{EvalIlike, 3, "foo,bar,baz", "lit:FOO", "t,f,f"},
+
+		// literals
+		{EvalLike, 3, "lit:foo", "lit:f%", "lit:t"},
+		{EvalIlike, 3, "lit:foo", "lit:B%", "lit:f"},
+	}
+	for _, test := range tests {
+		c1, c2, expected, err := prepColumns(test.nrows, DtypeString, DtypeString, DtypeBool, test.c1, test.c2, test.expected)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		res, err := test.fnc(c1, c2)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !ChunksEqual(res, expected) {
+			t.Errorf("expected %+v LIKE %+v to result in %+v, got %+v instead", test.c1, test.c2, test.expected, res)
+		}
+	}
+}
+
+func TestRegexpMatching(t *testing.T) {
+	tests := []struct {
+		caseInsensitive  bool
+		c1, c2, expected string
+	}{
+		{false, "foo,bar,baz", "lit:^ba", "f,t,t"},
+		{false, "foo,bar,baz", "lit:o$", "t,f,f"},
+		{false, "foo,bar,baz", "lit:b[aeiou]r", "f,t,f"},
+		{false, "foo,Bar,BAZ", "lit:^ba", "f,f,f"},
+		{true, "foo,Bar,BAZ", "lit:^ba", "f,t,t"},
+		{false, "foo,bar,ondřej", "lit:ř", "f,f,t"},
+		{false, "foo,bar,baz", "lit:", "t,t,t"},
+
+		// literals
+		{false, "lit:foo", "lit:^f", "lit:t"},
+		{true, "lit:foo", "lit:B", "lit:f"},
+	}
+	for _, test := range tests {
+		c1, c2, expected, err := prepColumns(3, DtypeString, DtypeString, DtypeBool, test.c1, test.c2, test.expected)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		res, err := new(RegexpMatcher).Match(c1, c2, test.caseInsensitive)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !ChunksEqual(res, expected) {
+			t.Errorf("expected %+v ~ %+v to result in %+v, got %+v instead", test.c1, test.c2, test.expected, res)
+		}
+	}
+}
+
+func TestRegexpMatchingNulls(t *testing.T) {
+	values, err := prepColumn(3, DtypeString, "foo,bar,baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values.Nullability = bitmap.NewBitmap(3)
+	values.Nullability.Set(1, true)
+	pattern := NewChunkLiteralStrings("^[fb]", 3)
+
+	var rm RegexpMatcher
+	res, err := rm.Match(values, pattern, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(res.Nullability.Get(1) && res.Truths().Count() == 2) {
+		t.Errorf("expecting nulls to stay nulls, got %+v", res)
+	}
+	// the pattern gets compiled upon first use, it doesn't change afterwards
+	res, err = rm.Match(values, NewChunkLiteralStrings("^x", 3), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truths().Count() != 2 {
+		t.Errorf("expecting the pattern to be compiled only once, got %+v", res)
+	}
+
+	nulls, err := NewChunkLiteralTyped("", DtypeNull, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][2]*Chunk{{nulls, pattern}, {values, nulls}} {
+		res, err := new(RegexpMatcher).Match(args[0], args[1], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Dtype() != DtypeBool || res.Nullability == nil || res.Nullability.Count() != 3 {
+			t.Errorf("expecting null inputs to result in nulls, got %+v", res)
+		}
+	}
+}
+
+func TestRegexpMatchingErrors(t *testing.T) {
+	dense, err := prepColumn(3, DtypeString, "foo,bar,baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ints, err := prepColumn(3, DtypeInt, "1,2,3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][2]*Chunk{{ints, NewChunkLiteralStrings("foo", 3)}, {dense, ints}, {dense, dense}} {
+		if _, err := new(RegexpMatcher).Match(args[0], args[1], false); !errors.Is(err, errProjectionNotSupported) {
+			t.Errorf("expecting matching of %v and %v to fail with %v, got %v", args[0].Dtype(), args[1].Dtype(), errProjectionNotSupported, err)
+		}
+	}
+	if _, err := new(RegexpMatcher).Match(dense, NewChunkLiteralStrings("fo(o", 3), false); !errors.Is(err, errInvalidRegexp) {
+		t.Errorf("expecting an invalid pattern to fail with %v, got %v", errInvalidRegexp, err)
+	}
+	if _, err := new(RegexpMatcher).Eval(dense, NewChunkLiteralStrings("foo", 3), NewChunkLiteralStrings("x", 3)); !errors.Is(err, errInvalidRegexpFlags) {
+		t.Errorf("expecting invalid flags to fail with %v, got %v", errInvalidRegexpFlags, err)
+	}
+}
+
+func TestLikeErrors(t *testing.T) {
+	strs := NewChunkLiteralStrings("foo", 3)
+	ints, err := prepColumn(3, DtypeInt, "1,2,3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dense, err := prepColumn(3, DtypeString, "foo,bar,baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][2]*Chunk{{ints, strs}, {dense, ints}, {dense, dense}} {
+		if _, err := EvalLike(args[0], args[1]); !errors.Is(err, errProjectionNotSupported) {
+			t.Errorf("expecting LIKE of %v and %v to fail with %v, got %v", args[0].Dtype(), args[1].Dtype(), errProjectionNotSupported, err)
+		}
+	}
+}
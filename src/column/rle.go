@@ -0,0 +1,166 @@
+package column
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/kokes/smda/src/bitmap"
+)
+
+var errInvalidRuns = errors.New("invalid run-length encoded data")
+
+// Encoding determines how a chunk gets serialised (on top of any compression)
+type Encoding uint8
+
+const (
+	EncodingPlain Encoding = iota
+	// EncodingRLE stores runs of repeated values as (length, value) pairs, it's great for sorted or
+	// low cardinality data, e.g. dates in an event log or constant columns
+	EncodingRLE
+)
+
+// runs need to be this long (on average) for us to prefer RLE over plain encoding
+const rleMinAverageRun = 4
+
+func (enc Encoding) String() string {
+	return []string{"plain", "rle"}[enc]
+}
+
+func (enc Encoding) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", enc.String())), nil
+}
+
+func (enc *Encoding) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"plain"`:
+		*enc = EncodingPlain
+	case `"rle"`:
+		*enc = EncodingRLE
+	default:
+		return fmt.Errorf("unexpected encoding: %s", data)
+	}
+	return nil
+}
+
+// sameValues checks if two rows hold the same value, this is stricter than Compare - it checks
+// for identical representations (e.g. 1.0 and 1.00 are different decimals), so that we can
+// reconstruct the data exactly
+func (rc *Chunk) sameValues(i, j int) bool {
+	if rc.Nullability != nil {
+		ni, nj := rc.Nullability.Get(i), rc.Nullability.Get(j)
+		if ni || nj {
+			return ni == nj
+		}
+	}
+	switch rc.dtype {
+	case DtypeInt:
+		return rc.storage.ints[i] == rc.storage.ints[j]
+	case DtypeFloat:
+		return math.Float64bits(rc.storage.floats[i]) == math.Float64bits(rc.storage.floats[j])
+	case DtypeDate:
+		return rc.storage.dates[i] == rc.storage.dates[j]
+	case DtypeDatetime:
+		return rc.storage.datetimes[i] == rc.storage.datetimes[j]
+	case DtypeDecimal:
+		return rc.storage.decimals[i] == rc.storage.decimals[j]
+	case DtypeString:
+		return rc.nthValue(i) == rc.nthValue(j)
+	}
+	panic(fmt.Sprintf("unsupported dtype for run-length encoding: %v", rc.dtype))
+}
+
+// runs returns lengths of runs of identical values
+func (rc *Chunk) runs() []uint32 {
+	var runs []uint32
+	for j := 0; j < rc.Len(); j++ {
+		if j > 0 && rc.sameValues(j-1, j) {
+			runs[len(runs)-1]++
+			continue
+		}
+		runs = append(runs, 1)
+	}
+	return runs
+}
+
+// PreferredEncoding determines how a chunk should be stored - we only run-length encode chunks
+// that have long runs of identical values on average
+// OPTIM: we calculate all the runs just to count them, we could bail early (and then reuse them in WriteRLETo)
+func (rc *Chunk) PreferredEncoding() Encoding {
+	switch rc.dtype {
+	// bools are already stored as bitmaps and nulls have no data at all
+	case DtypeInt, DtypeFloat, DtypeDate, DtypeDatetime, DtypeDecimal, DtypeString:
+	default:
+		return EncodingPlain
+	}
+	if rc.IsLiteral || rc.Len() == 0 {
+		return EncodingPlain
+	}
+	if len(rc.runs())*rleMinAverageRun > rc.Len() {
+		return EncodingPlain
+	}
+	return EncodingRLE
+}
+
+// WriteRLETo serialises a chunk as runs - first their lengths, then their values (as a plain chunk)
+func (rc *Chunk) WriteRLETo(w io.Writer) (int64, error) {
+	if rc.IsLiteral {
+		return 0, errLiteralsCannotBeSerialised
+	}
+	runs := rc.runs()
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(runs))); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, runs); err != nil {
+		return 0, err
+	}
+	starts := bitmap.NewBitmap(rc.Len())
+	pos := 0
+	for _, run := range runs {
+		starts.Set(pos, true)
+		pos += int(run)
+	}
+	nw, err := rc.Prune(starts).WriteTo(w)
+	if err != nil {
+		return 0, err
+	}
+	return int64(4+4*len(runs)) + nw, nil
+}
+
+// DeserializeRLE reads a chunk written by WriteRLETo. A single run (e.g. a constant column) becomes
+// a literal, so that filters and aggregations evaluate it just once, other chunks get hydrated into
+// plain chunks right away. Literals cannot be nullable, so runs of nulls get hydrated as well.
+// OPTIM: we could operate on runs directly in more cases (filters, aggregations), but all our
+// kernels expect plain chunks or literals at this point
+func DeserializeRLE(r io.Reader, dtype Dtype) (*Chunk, error) {
+	var nruns uint32
+	if err := binary.Read(r, binary.LittleEndian, &nruns); err != nil {
+		return nil, err
+	}
+	runs := make([]uint32, nruns)
+	if err := binary.Read(r, binary.LittleEndian, &runs); err != nil {
+		return nil, err
+	}
+	values, err := Deserialize(r, dtype)
+	if err != nil {
+		return nil, err
+	}
+	if values.Len() != len(runs) {
+		return nil, fmt.Errorf("%w: %v runs, %v values", errInvalidRuns, len(runs), values.Len())
+	}
+	if len(runs) == 1 && (values.Nullability == nil || !values.Nullability.Get(0)) {
+		values.IsLiteral = true
+		values.length = runs[0]
+		values.Nullability = nil
+		return values, nil
+	}
+	var positions []int
+	for j, run := range runs {
+		for k := uint32(0); k < run; k++ {
+			positions = append(positions, j)
+		}
+	}
+	return values.Reorder(positions), nil
+}
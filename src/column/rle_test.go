@@ -0,0 +1,119 @@
+package column
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPreferredEncodings(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		vals     string
+		encoding Encoding
+	}{
+		{DtypeInt, "", EncodingPlain},
+		{DtypeInt, "1,2,3,4", EncodingPlain},
+		{DtypeInt, "1,1,1,1", EncodingRLE},
+		{DtypeInt, "1,1,1,1,2,2,2,2", EncodingRLE},
+		{DtypeInt, "1,1,1,1,2,2,2,3", EncodingPlain},
+		{DtypeInt, ",,,,", EncodingRLE},
+		{DtypeInt, "1,,1,,1,,1,", EncodingPlain},
+		{DtypeFloat, "1.5,1.5,1.5,1.5", EncodingRLE},
+		// different representations of the same value cannot share a run
+		{DtypeDecimal, "1.0,1.00,1.0,1.00", EncodingPlain},
+		{DtypeDecimal, "1.0,1.0,1.0,1.0", EncodingRLE},
+		{DtypeString, "foo,foo,foo,foo", EncodingRLE},
+		{DtypeString, "foo,foo,bar,bar", EncodingPlain},
+		{DtypeDate, "2020-01-01,2020-01-01,2020-01-01,2020-01-01", EncodingRLE},
+		{DtypeDatetime, "2020-01-01 12:00:00,2020-01-01 12:00:00,2020-01-01 12:00:00,2020-01-01 12:00:00", EncodingRLE},
+		// bools and nulls are never run-length encoded
+		{DtypeBool, "t,t,t,t", EncodingPlain},
+		{DtypeNull, ",,,", EncodingPlain},
+	}
+	for _, test := range tests {
+		col := NewChunk(test.dtype)
+		if test.vals != "" {
+			if err := col.AddValues(strings.Split(test.vals, ",")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if encoding := col.PreferredEncoding(); encoding != test.encoding {
+			t.Errorf("expecting %v (%v) to be encoded as %v, got %v", test.vals, test.dtype, test.encoding, encoding)
+		}
+	}
+}
+
+func TestRLESerialisationRoundtrip(t *testing.T) {
+	tests := []struct {
+		dtype   Dtype
+		vals    []string
+		literal bool // single runs get read as literals
+	}{
+		{DtypeInt, []string{"1"}, true},
+		{DtypeInt, []string{"1", "1", "1", "2", "2", "", "", "3"}, false},
+		// literals cannot be nullable
+		{DtypeInt, []string{"", "", "", ""}, false},
+		{DtypeInt, []string{"3", "3", "3", "3"}, true},
+		{DtypeFloat, []string{"1.5", "1.5", "-0", "0", "inf", "inf"}, false},
+		{DtypeFloat, []string{"-0", "-0", "-0"}, true},
+		{DtypeDecimal, []string{"12.30", "12.3", "12.30", "", "-0.05", "-0.05"}, false},
+		{DtypeDecimal, []string{"12.30", "12.30"}, true},
+		{DtypeString, []string{"foo", "foo", "", "", "bar", "baz", "baz"}, false},
+		{DtypeString, []string{"foo", "foo", "foo"}, true},
+		{DtypeString, []string{"", ""}, true},
+		{DtypeDate, []string{"2020-02-22", "2020-02-22", "", "2030-12-31"}, false},
+		{DtypeDate, []string{"2020-02-22", "2020-02-22"}, true},
+		{DtypeDatetime, []string{"2020-02-22 12:34:45", "2020-02-22 12:34:45", "", "2030-12-31 11:12:00.012"}, false},
+		{DtypeDatetime, []string{"2020-02-22 12:34:45", "2020-02-22 12:34:45"}, true},
+	}
+	for _, test := range tests {
+		col := NewChunk(test.dtype)
+		if err := col.AddValues(test.vals); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		nw, err := col.WriteRLETo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(nw) != buf.Len() {
+			t.Errorf("expecting to write %v bytes, reported %v", buf.Len(), nw)
+		}
+		col2, err := DeserializeRLE(buf, test.dtype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if col2.IsLiteral != test.literal {
+			t.Errorf("expecting %v (%v) to be read as a literal: %v, got %v", test.vals, test.dtype, test.literal, col2.IsLiteral)
+		}
+		if col2.IsLiteral {
+			col2 = col2.Reorder(make([]int, col2.Len()))
+		}
+		if !ChunksEqual(col, col2) {
+			t.Errorf("expecting %+v, got %+v", col, col2)
+		}
+	}
+}
+
+func TestEncodingJSONRoundtrip(t *testing.T) {
+	encodings := []Encoding{EncodingPlain, EncodingRLE}
+	data, err := json.Marshal(encodings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `["plain","rle"]` {
+		t.Errorf("unexpected serialisation of encodings: %s", data)
+	}
+	var decoded []Encoding
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !(len(decoded) == 2 && decoded[0] == EncodingPlain && decoded[1] == EncodingRLE) {
+		t.Errorf("expecting %v, got %v", encodings, decoded)
+	}
+	if err := json.Unmarshal([]byte(`["foo"]`), &decoded); err == nil {
+		t.Error("expecting unknown encodings to fail")
+	}
+}
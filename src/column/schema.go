@@ -1,13 +1,16 @@
 package column
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/kokes/smda/src/errs"
 )
 
-var errColumnNotFound = errors.New("column not found in schema")
+var errColumnNotFound = errs.New(errs.ErrNotFound, "column not found in schema")
 
 // Dtype denotes the data type of a given object (e.g. int or string)
 type Dtype uint8
@@ -22,12 +25,14 @@ const (
 	DtypeBool
 	DtypeDate
 	DtypeDatetime
+	DtypeDecimal
+	DtypeJSON // raw JSON documents, see json_extract
 	// more to be added
 	DtypeMax
 )
 
 func (dt Dtype) String() string {
-	return []string{"invalid", "null", "string", "int", "float", "bool", "date", "datetime"}[dt]
+	return []string{"invalid", "null", "string", "int", "float", "bool", "date", "datetime", "decimal", "json"}[dt]
 }
 
 // MarshalJSON returns the JSON representation of a dtype (stringified + json string)
@@ -62,6 +67,10 @@ func (dt *Dtype) UnmarshalJSON(data []byte) error {
 		*dt = DtypeDate
 	case "datetime":
 		*dt = DtypeDatetime
+	case "decimal":
+		*dt = DtypeDecimal
+	case "json":
+		*dt = DtypeJSON
 	default:
 		return fmt.Errorf("unexpected type: %v", sdata)
 	}
@@ -110,7 +119,7 @@ func (schema *TableSchema) LocateColumnCaseInsensitive(s string) (int, Schema, e
 }
 
 func isNull(s string) bool {
-	return s == "" // TODO: add custom null values as options (e.g. NA, N/A etc.)
+	return s == "" // custom null values (e.g. NA) get read as empty strings (see database.LoadOptions)
 }
 
 // OPTIM: could we early exit by checking the input is all digits with a possible leading +-? are there any other constraints?
@@ -189,6 +198,10 @@ func guessType(s string) Dtype {
 	if _, err := parseDatetime(s); err == nil {
 		return DtypeDatetime
 	}
+	// we only detect objects and arrays, JSON scalars are better off as plain values
+	if len(s) > 0 && (s[0] == '{' || s[0] == '[') && json.Valid([]byte(s)) {
+		return DtypeJSON
+	}
 
 	return DtypeString
 }
@@ -198,6 +211,17 @@ type TypeGuesser struct {
 	nullable bool
 	types    [DtypeMax]int
 	nrows    int
+
+	// floats are our default for numbers with decimal points, but we switch to decimals
+	// if all of them have the same number of decimal places and at least some of them have
+	// trailing zeroes (e.g. 12.30) - a float would lose those
+	decimalScale    int
+	decimalInvalid  bool
+	decimalTrailing bool
+
+	numbers NumberFormat
+	// keep counting types even after seeing strings (see DominantType)
+	lenient bool
 }
 
 // NewTypeGuesser creates a new type guesser
@@ -205,6 +229,18 @@ func NewTypeGuesser() *TypeGuesser {
 	return &TypeGuesser{}
 }
 
+// NewTypeGuesserWithFormat creates a type guesser, which only detects numbers formatted according
+// to a given locale (see NumberFormat.Normalise)
+func NewTypeGuesserWithFormat(nf NumberFormat) *TypeGuesser {
+	return &TypeGuesser{numbers: nf}
+}
+
+// NewLenientTypeGuesser creates a type guesser that tolerates values of other types, so that
+// a column can be inferred despite a few bad values (see DominantType)
+func NewLenientTypeGuesser(nf NumberFormat) *TypeGuesser {
+	return &TypeGuesser{numbers: nf, lenient: true}
+}
+
 // AddValue feeds a new value to a type guesser
 func (tg *TypeGuesser) AddValue(s string) {
 	tg.nrows++
@@ -213,11 +249,48 @@ func (tg *TypeGuesser) AddValue(s string) {
 		return
 	}
 	// if we once detected a string, we cannot overturn this
-	if tg.types[DtypeString] > 0 {
+	if tg.types[DtypeString] > 0 && !tg.lenient {
 		return
 	}
 
-	tg.types[guessType(s)]++
+	dtype := guessType(s)
+	if !tg.numbers.IsCanonical() {
+		if canonical, err := tg.numbers.Normalise(s); err == nil {
+			s = canonical
+			dtype = guessType(s)
+		} else if dtype == DtypeInt || dtype == DtypeFloat {
+			// numbers in our canonical format are not numbers in this locale (e.g. 1.5 given a decimal comma)
+			dtype = DtypeString
+		}
+	}
+	tg.types[dtype]++
+	if dtype == DtypeFloat && !tg.decimalInvalid {
+		tg.addDecimalCandidate(s)
+	}
+}
+
+// AddChunk feeds all the values of a chunk to a type guesser, formatted the way they'd appear in
+// an input file, so that we can infer types of data already loaded (nulls stay nulls)
+func (tg *TypeGuesser) AddChunk(rc *Chunk) {
+	for j := 0; j < rc.Len(); j++ {
+		tg.AddValue(rc.textValue(j))
+	}
+}
+
+func (tg *TypeGuesser) addDecimalCandidate(s string) {
+	val, err := parseDecimal(s)
+	if err != nil || val.scale() == 0 || (tg.decimalScale > 0 && val.scale() != tg.decimalScale) {
+		tg.decimalInvalid = true
+		return
+	}
+	tg.decimalScale = val.scale()
+	if s[len(s)-1] == '0' {
+		tg.decimalTrailing = true
+	}
+}
+
+func (tg *TypeGuesser) isDecimal() bool {
+	return !tg.decimalInvalid && tg.decimalTrailing
 }
 
 // InferredType returns the best guess of a type for a given stream of strings
@@ -243,6 +316,9 @@ func (tg *TypeGuesser) InferredType() Schema {
 
 	if len(tgmap) == 1 {
 		for key := range tgmap {
+			if key == DtypeFloat && tg.isDecimal() {
+				key = DtypeDecimal
+			}
 			return Schema{
 				Dtype:    key,
 				Nullable: tg.nullable,
@@ -260,8 +336,46 @@ func (tg *TypeGuesser) InferredType() Schema {
 			}
 		}
 	}
+	dtype := DtypeFloat
+	if tg.isDecimal() {
+		dtype = DtypeDecimal
+	}
 	return Schema{
-		Dtype:    DtypeFloat,
+		Dtype:    dtype,
 		Nullable: tg.nullable,
 	}
 }
+
+// DominantType returns the type most non-null values conform to (see NewLenientTypeGuesser), ints
+// and floats count as one numeric type. Unless a type covers more than half of the values, we settle
+// on strings. Values not conforming to the dominant type will become nulls, so the column becomes
+// nullable if there are any.
+func (tg *TypeGuesser) DominantType() Schema {
+	if !tg.lenient || tg.types[DtypeString] == 0 {
+		return tg.InferredType()
+	}
+	total := 0
+	for _, count := range tg.types {
+		total += count
+	}
+	dtype := DtypeString
+	numeric := tg.types[DtypeInt] + tg.types[DtypeFloat]
+	switch {
+	case 2*numeric > total && tg.types[DtypeFloat] == 0:
+		dtype = DtypeInt
+	case 2*numeric > total && tg.isDecimal():
+		dtype = DtypeDecimal
+	case 2*numeric > total:
+		dtype = DtypeFloat
+	default:
+		for _, candidate := range []Dtype{DtypeBool, DtypeDate, DtypeDatetime, DtypeJSON} {
+			if 2*tg.types[candidate] > total {
+				dtype = candidate
+			}
+		}
+	}
+	return Schema{
+		Dtype:    dtype,
+		Nullable: tg.nullable || dtype != DtypeString,
+	}
+}
@@ -69,6 +69,7 @@ func TestDtypeStringer(t *testing.T) {
 		{DtypeBool, "bool"},
 		{DtypeDate, "date"},
 		{DtypeDatetime, "datetime"},
+		{DtypeDecimal, "decimal"},
 	}
 
 	for _, testCase := range tests {
@@ -87,7 +88,7 @@ func TestDtypeStringer(t *testing.T) {
 }
 
 func TestDtypeJSONRoundtrip(t *testing.T) {
-	for _, dt := range []Dtype{DtypeInvalid, DtypeNull, DtypeInt, DtypeFloat, DtypeBool, DtypeDate, DtypeString} {
+	for _, dt := range []Dtype{DtypeInvalid, DtypeNull, DtypeInt, DtypeFloat, DtypeBool, DtypeDate, DtypeDecimal, DtypeString} {
 		bt, err := json.Marshal(dt)
 		if err != nil {
 			t.Error(err)
@@ -176,6 +177,31 @@ func TestBasicTypeInference(t *testing.T) {
 			DtypeFloat,
 			false,
 		},
+		{
+			[]string{"12.30", "1.50", "-0.25"},
+			DtypeDecimal,
+			false,
+		},
+		{
+			[]string{"12.30", "", "3"},
+			DtypeDecimal,
+			true,
+		},
+		{
+			[]string{"1.5", "2.25"}, // no trailing zeros, no indication of fixed precision
+			DtypeFloat,
+			false,
+		},
+		{
+			[]string{"12.30", "1.5"}, // inconsistent scale
+			DtypeFloat,
+			false,
+		},
+		{
+			[]string{"12.30", "1e3"},
+			DtypeFloat,
+			false,
+		},
 		{
 			[]string{"2020-02-22", "1987-12-31", "3000-01-12"},
 			DtypeDate,
@@ -237,6 +263,34 @@ func TestBasicTypeInference(t *testing.T) {
 	}
 }
 
+func TestDominantTypeInference(t *testing.T) {
+	tests := []struct {
+		values []string
+		schema Schema
+	}{
+		{[]string{"1", "2", "foo"}, Schema{Dtype: DtypeInt, Nullable: true}},
+		{[]string{"1", "2.5", "", "foo"}, Schema{Dtype: DtypeFloat, Nullable: true}},
+		{[]string{"1.50", "2.30", "foo"}, Schema{Dtype: DtypeDecimal, Nullable: true}},
+		{[]string{"2020-01-01", "2020-02-01", "n/a"}, Schema{Dtype: DtypeDate, Nullable: true}},
+		{[]string{"t", "f", "?"}, Schema{Dtype: DtypeBool, Nullable: true}},
+		// no type covers more than half of the values
+		{[]string{"1", "foo"}, Schema{Dtype: DtypeString}},
+		{[]string{"1", "t", "2020-01-01", ""}, Schema{Dtype: DtypeString, Nullable: true}},
+		// without conflicts, this is the same as regular inference
+		{[]string{"1", "2", ""}, Schema{Dtype: DtypeInt, Nullable: true}},
+		{[]string{"foo", "bar"}, Schema{Dtype: DtypeString}},
+	}
+	for _, test := range tests {
+		tg := NewLenientTypeGuesser(NumberFormat{})
+		for _, val := range test.values {
+			tg.AddValue(val)
+		}
+		if schema := tg.DominantType(); schema != test.schema {
+			t.Errorf("expecting %v to be inferred as %+v, got %+v", test.values, test.schema, schema)
+		}
+	}
+}
+
 func TestNullability(t *testing.T) {
 	if !isNull("") {
 		t.Errorf("an empty string should be considered null")
@@ -372,8 +426,18 @@ func TestBasicTypeGuessing(t *testing.T) {
 		{"true", DtypeBool},
 		{"false", DtypeBool},
 		{"2020-02-22", DtypeDate},
+		{"2020/02/22", DtypeDate},
+		{"22/02/2020", DtypeString}, // ambiguous formats need to be declared (see DateFormat)
+		{"2020-02-22T12:34:56+01:00", DtypeDatetime},
+		{"2020-02-22T12:34:56+0100", DtypeString},
+		{"2020-02-22 12:34:56Z", DtypeString},
+		{"1582329600", DtypeInt}, // and so do epoch timestamps
 		{"foo", DtypeString},
-		{"", DtypeString}, // we don't do null inference in guessType
+		{`{"foo": [1, 2]}`, DtypeJSON},
+		{"[]", DtypeJSON},
+		{"{foo}", DtypeString},
+		{`"foo"`, DtypeString}, // JSON scalars are not detected
+		{"", DtypeString},      // we don't do null inference in guessType
 	}
 	for _, test := range tests {
 		if guessType(test.str) != test.Dtype {
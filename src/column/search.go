@@ -0,0 +1,65 @@
+package column
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var errUnsearchableChunk = errors.New("cannot search in this chunk")
+
+// compareToValue compares the nth value of a chunk to the first value of another chunk (of the same
+// type), it returns -1, 0, or 1 (the nth value is smaller, equal, or greater), nulls are not handled here
+func (rc *Chunk) compareToValue(n int, value *Chunk) int {
+	var lt, eq bool
+	switch rc.dtype {
+	case DtypeInt:
+		v1, v2 := rc.storage.ints[n], value.storage.ints[0]
+		lt, eq = v1 < v2, v1 == v2
+	case DtypeFloat:
+		v1, v2 := rc.storage.floats[n], value.storage.floats[0]
+		lt, eq = v1 < v2, v1 == v2
+	case DtypeString:
+		v1, v2 := rc.nthValue(n), value.nthValue(0)
+		lt, eq = v1 < v2, v1 == v2
+	case DtypeDate:
+		v1, v2 := rc.storage.dates[n], value.storage.dates[0]
+		lt, eq = v1 < v2, v1 == v2
+	case DtypeDatetime:
+		v1, v2 := rc.storage.datetimes[n], value.storage.datetimes[0]
+		lt, eq = v1 < v2, v1 == v2
+	case DtypeDecimal:
+		return compareDecimals(rc.storage.decimals[n], value.storage.decimals[0])
+	default:
+		panic(fmt.Sprintf("unsupported Dtype for compareToValue: %v", rc.dtype))
+	}
+	return compareValues(-1, lt, eq)
+}
+
+// SearchSorted finds a position in a chunk sorted in ascending order (with nulls last) at which a given
+// value (the first row of `value`, a chunk of the same type) would be inserted to keep the chunk sorted.
+// That's the first row greater than or equal to the value, or strictly greater, if `after` is set.
+// Rows past the returned position may still be nulls, they are never returned as part of a range.
+// ARCH: NaNs (if preserved) are not handled, they cannot be binary searched for
+func SearchSorted(rc *Chunk, value *Chunk, after bool) (int, error) {
+	switch rc.dtype {
+	case DtypeInt, DtypeFloat, DtypeString, DtypeDate, DtypeDatetime, DtypeDecimal:
+	default:
+		return 0, fmt.Errorf("%w: unsupported type %v", errUnsearchableChunk, rc.dtype)
+	}
+	if value.dtype != rc.dtype || rc.IsLiteral {
+		return 0, fmt.Errorf("%w: cannot search for %v in %v", errUnsearchableChunk, value.dtype, rc.dtype)
+	}
+	// nulls sort last, so the searchable values are all those before the first null
+	length := rc.Len()
+	if rc.Nullability != nil {
+		length = sort.Search(length, rc.Nullability.Get)
+	}
+	return sort.Search(length, func(j int) bool {
+		cmp := rc.compareToValue(j, value)
+		if after {
+			return cmp > 0
+		}
+		return cmp >= 0
+	}), nil
+}
@@ -0,0 +1,57 @@
+package column
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchSorted(t *testing.T) {
+	tests := []struct {
+		dtype  Dtype
+		vals   string
+		value  string
+		after  bool
+		expect int
+	}{
+		{DtypeInt, "1,2,2,3", "2", false, 1},
+		{DtypeInt, "1,2,2,3", "2", true, 3},
+		{DtypeInt, "1,2,2,3", "0", false, 0},
+		{DtypeInt, "1,2,2,3", "4", false, 4},
+		{DtypeInt, "1,2,2,3", "3", true, 4},
+		// nulls are never part of a range
+		{DtypeInt, "1,2,,", "5", false, 2},
+		{DtypeInt, ",,", "5", true, 0},
+		{DtypeFloat, "-inf,1.5,2,inf", "1.5", true, 2},
+		{DtypeDecimal, "1.0,1.50,2.000", "1.5", false, 1},
+		{DtypeDecimal, "1.0,1.50,2.000", "1.5", true, 2},
+		{DtypeString, "bar,baz,foo", "baz", false, 1},
+		{DtypeString, "bar,baz,foo", "c", false, 2},
+		{DtypeDate, "2020-01-01,2020-02-01,2021-01-01", "2020-06-30", false, 2},
+		{DtypeDatetime, "2020-01-01 12:00:00,2020-01-01 12:00:01", "2020-01-01 12:00:00", true, 1},
+	}
+	for _, test := range tests {
+		col := NewChunk(test.dtype)
+		if err := col.AddValues(strings.Split(test.vals, ",")); err != nil {
+			t.Fatal(err)
+		}
+		value, err := NewChunkLiteralTyped(test.value, test.dtype, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos, err := SearchSorted(col, value, test.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != test.expect {
+			t.Errorf("expecting %v in %v (after: %v) to be at %v, got %v", test.value, test.vals, test.after, test.expect, pos)
+		}
+	}
+
+	col := NewChunk(DtypeInt)
+	if err := col.AddValues([]string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SearchSorted(col, NewChunkLiteralFloats(1, 1), false); err == nil {
+		t.Error("expecting a search for a mismatched type to fail")
+	}
+}
@@ -0,0 +1,234 @@
+package column
+
+import (
+	"fmt"
+
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errSetTypeMismatch = errs.New(errs.ErrBadRequest, "cannot look up values of this type in a set")
+
+// ValueSet holds distinct values of a chunk, so that we can test membership of values of other
+// chunks, e.g. in `foo IN (SELECT bar FROM baz)`, where the subquery's results get materialised
+// into a set once and then we look up each value of `foo` in it
+// ARCH: we only keep a single map for a given type, numeric sets keep a float copy of all their
+// values on top of that, so that values of other numeric types can be looked up as well (this is
+// in line with comparisons of ints and floats, these work with floats as well)
+type ValueSet struct {
+	dtype   Dtype
+	length  int
+	hasNull bool
+
+	ints     map[int64]struct{} // ints, dates and datetimes
+	floats   map[float64]struct{}
+	decimals map[decimal]struct{} // normalised, so that 1.2 and 1.20 are the same value
+	strings  map[string]struct{}
+	bools    [2]bool
+}
+
+// NewValueSet collects all the distinct values of a chunk
+func NewValueSet(ch *Chunk) (*ValueSet, error) {
+	set, err := newValueSet(ch.dtype)
+	if err != nil {
+		return nil, err
+	}
+	set.add(ch)
+	return set, nil
+}
+
+// NewValueSetFromLiterals collects values of literals of a given type, e.g. those of a list in
+// `foo IN (1, 2, 3)`. Null literals are allowed as well, so are ints in a set of floats.
+func NewValueSetFromLiterals(dtype Dtype, literals ...*Chunk) (*ValueSet, error) {
+	set, err := newValueSet(dtype)
+	if err != nil {
+		return nil, err
+	}
+	for _, lit := range literals {
+		if lit.dtype != dtype && lit.dtype != DtypeNull && !(lit.dtype == DtypeInt && dtype == DtypeFloat) {
+			return nil, fmt.Errorf("%w: %v in a set of %v", errSetTypeMismatch, lit.dtype, dtype)
+		}
+		set.add(lit)
+	}
+	return set, nil
+}
+
+func newValueSet(dtype Dtype) (*ValueSet, error) {
+	set := &ValueSet{dtype: dtype}
+	switch dtype {
+	case DtypeInt, DtypeDate, DtypeDatetime:
+		set.ints = make(map[int64]struct{})
+	case DtypeDecimal:
+		set.decimals = make(map[decimal]struct{})
+	case DtypeString:
+		set.strings = make(map[string]struct{})
+	case DtypeBool, DtypeFloat, DtypeNull:
+	default:
+		return nil, fmt.Errorf("%w: %v", errSetTypeMismatch, dtype)
+	}
+	if isNumericType(dtype) {
+		set.floats = make(map[float64]struct{})
+	}
+	return set, nil
+}
+
+// add adds all the values of a chunk to a set, the chunk is either of the set's type, or it's
+// a null chunk, or an int chunk to be added to a set of floats
+func (s *ValueSet) add(ch *Chunk) {
+	nrows := ch.Len()
+	if ch.IsLiteral && nrows > 0 {
+		// literals have the same value all over
+		nrows = 1
+	}
+	for j := 0; j < nrows; j++ {
+		if ch.dtype == DtypeNull || (ch.Nullability != nil && ch.Nullability.Get(j)) {
+			s.hasNull = true
+			continue
+		}
+		s.length++
+		switch ch.dtype {
+		case DtypeInt:
+			if s.ints != nil {
+				s.ints[ch.storage.ints[j]] = struct{}{}
+			}
+			s.floats[float64(ch.storage.ints[j])] = struct{}{}
+		case DtypeFloat:
+			s.floats[ch.storage.floats[j]] = struct{}{}
+		case DtypeDecimal:
+			s.decimals[ch.storage.decimals[j].normalise()] = struct{}{}
+			s.floats[ch.storage.decimals[j].Float()] = struct{}{}
+		case DtypeDate:
+			s.ints[int64(ch.storage.dates[j])] = struct{}{}
+		case DtypeDatetime:
+			s.ints[int64(ch.storage.datetimes[j])] = struct{}{}
+		case DtypeString:
+			s.strings[ch.nthValue(j)] = struct{}{}
+		case DtypeBool:
+			if ch.storage.bools.Get(j) {
+				s.bools[1] = true
+			} else {
+				s.bools[0] = true
+			}
+		}
+	}
+}
+
+// Dtype is the type of values held in a set
+func (s *ValueSet) Dtype() Dtype {
+	return s.dtype
+}
+
+// Empty reports whether a set has no values at all, not even nulls
+func (s *ValueSet) Empty() bool {
+	return s.length == 0 && !s.hasNull
+}
+
+func isNumericType(dt Dtype) bool {
+	return dt == DtypeInt || dt == DtypeFloat || dt == DtypeDecimal
+}
+
+// lookupFunc returns a function that determines if the nth value of a given chunk is in a set
+func (s *ValueSet) lookupFunc(c *Chunk) (func(int) bool, error) {
+	err := fmt.Errorf("%w: %v in a set of %v", errSetTypeMismatch, c.dtype, s.dtype)
+	if c.dtype == DtypeNull || s.dtype == DtypeNull {
+		// nothing can be found, nulls are handled by the caller
+		return func(int) bool { return false }, nil
+	}
+	if c.dtype != s.dtype {
+		if !(isNumericType(c.dtype) && isNumericType(s.dtype)) {
+			return nil, err
+		}
+		// ints are exact decimals, so these don't need to go through floats
+		if c.dtype == DtypeInt && s.dtype == DtypeDecimal {
+			return func(n int) bool {
+				val, err := newDecimal(c.storage.ints[n], 0)
+				if err != nil {
+					// too large to be a decimal, so it cannot be in the set
+					return false
+				}
+				_, found := s.decimals[val.normalise()]
+				return found
+			}, nil
+		}
+		return func(n int) bool {
+			var val float64
+			switch c.dtype {
+			case DtypeInt:
+				val = float64(c.storage.ints[n])
+			case DtypeFloat:
+				val = c.storage.floats[n]
+			case DtypeDecimal:
+				val = c.storage.decimals[n].Float()
+			}
+			_, found := s.floats[val]
+			return found
+		}, nil
+	}
+	switch c.dtype {
+	case DtypeInt:
+		return func(n int) bool { _, found := s.ints[c.storage.ints[n]]; return found }, nil
+	case DtypeFloat:
+		return func(n int) bool { _, found := s.floats[c.storage.floats[n]]; return found }, nil
+	case DtypeDecimal:
+		return func(n int) bool { _, found := s.decimals[c.storage.decimals[n].normalise()]; return found }, nil
+	case DtypeDate:
+		return func(n int) bool { _, found := s.ints[int64(c.storage.dates[n])]; return found }, nil
+	case DtypeDatetime:
+		return func(n int) bool { _, found := s.ints[int64(c.storage.datetimes[n])]; return found }, nil
+	case DtypeString:
+		return func(n int) bool { _, found := s.strings[c.nthValue(n)]; return found }, nil
+	case DtypeBool:
+		return func(n int) bool {
+			if c.storage.bools.Get(n) {
+				return s.bools[1]
+			}
+			return s.bools[0]
+		}, nil
+	default:
+		return nil, err
+	}
+}
+
+// EvalIn tests membership of each value of a chunk in a given set, it follows SQL semantics when it
+// comes to nulls: null values result in nulls, values not found in a set containing a null result in
+// nulls as well (we don't know if they are in there or not) - unless the set is entirely empty,
+// then nothing is in it
+func EvalIn(c *Chunk, set *ValueSet) (*Chunk, error) {
+	nrows := c.Len()
+	if set.Empty() {
+		return NewChunkLiteralBools(false, nrows), nil
+	}
+	lookup, err := set.lookupFunc(c)
+	if err != nil {
+		return nil, err
+	}
+	values := bitmap.NewBitmap(nrows)
+	var nulls *bitmap.Bitmap
+	setNull := func(j int) {
+		if nulls == nil {
+			nulls = bitmap.NewBitmap(nrows)
+		}
+		nulls.Set(j, true)
+	}
+	// OPTIM: literals get looked up for each row, we could look them up just once
+	for j := 0; j < nrows; j++ {
+		n := j
+		if c.IsLiteral {
+			n = 0
+		}
+		if c.dtype == DtypeNull || (c.Nullability != nil && c.Nullability.Get(n)) {
+			setNull(j)
+			continue
+		}
+		if lookup(n) {
+			values.Set(j, true)
+			continue
+		}
+		if set.hasNull {
+			setNull(j)
+		}
+	}
+	ret := NewChunkBoolsFromBitmap(values)
+	ret.Nullability = nulls
+	return ret, nil
+}
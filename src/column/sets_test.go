@@ -0,0 +1,156 @@
+package column
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetMembership(t *testing.T) {
+	tests := []struct {
+		dtype1, dtype2        Dtype
+		nrows                 int
+		values, set, expected string
+	}{
+		{DtypeInt, DtypeInt, 4, "1,2,3,4", "4,2,2", "f,t,f,t"},
+		{DtypeInt, DtypeInt, 3, "lit:2", "4,2", "t,t,t"},
+		{DtypeInt, DtypeInt, 3, "1,2,3", "lit:3", "f,f,t"},
+		{DtypeFloat, DtypeFloat, 3, "1.5,2,3e2", "300,1.5", "t,f,t"},
+		{DtypeString, DtypeString, 3, "foo,bar,", "bar,baz,", "f,t,t"},
+		{DtypeBool, DtypeBool, 3, "t,f,t", "t,t", "t,f,t"},
+		{DtypeDate, DtypeDate, 2, "2020-02-22,1977-12-31", "1977-12-31", "f,t"},
+		{DtypeDatetime, DtypeDatetime, 2, "2020-02-22 12:34:56,1980-12-22 00:01:02", "2020-02-22 12:34:56", "t,f"},
+		{DtypeDecimal, DtypeDecimal, 3, "12.30,1.5,0.05", "12.3,0.050", "t,f,t"},
+		// mixed numeric types
+		{DtypeInt, DtypeFloat, 3, "1,2,3", "1.5,2.0", "f,t,f"},
+		{DtypeFloat, DtypeInt, 3, "1.5,2.0,3", "1,2", "f,t,f"},
+		{DtypeInt, DtypeDecimal, 3, "1,2,3", "1.00,2.5", "t,f,f"},
+		{DtypeDecimal, DtypeFloat, 2, "1.25,2.5", "2.5", "f,t"},
+		// nulls are unknown, so are values not found in sets with nulls
+		{DtypeInt, DtypeInt, 3, "1,,3", "1,2", "t,,f"},
+		{DtypeInt, DtypeInt, 3, "1,,3", "1,", "t,,"},
+		{DtypeInt, DtypeNull, 2, "1,2", "", ","},
+		{DtypeNull, DtypeInt, 2, ",", "1", ","},
+	}
+	for _, test := range tests {
+		values, setValues, expected, err := prepColumns(test.nrows, test.dtype1, test.dtype2, DtypeBool, test.values, test.set, test.expected)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		set, err := NewValueSet(setValues)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		res, err := EvalIn(values, set)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !ChunksEqual(res, expected) {
+			t.Errorf("expected %+v in %+v to result in %+v, got %+v instead", test.values, test.set, test.expected, res)
+		}
+	}
+
+	// nothing is in an empty set, not even nulls
+	set, err := NewValueSet(NewChunk(DtypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := prepColumn(2, DtypeInt, "1,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := EvalIn(values, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truths().Count() != 0 || res.Nullability != nil {
+		t.Errorf("expecting no values to be found in an empty set, got %+v", res)
+	}
+
+	words, err := prepColumn(2, DtypeString, "1,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err = NewValueSet(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EvalIn(words, set); !errors.Is(err, errSetTypeMismatch) {
+		t.Errorf("expecting strings not to be looked up in a set of ints, got %v", err)
+	}
+}
+
+func TestSetsFromLiterals(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		literals []string // typed as the set, unless empty (null)
+		nrows    int
+		values   string
+		expected string
+	}{
+		{DtypeInt, []string{"1", "3"}, 3, "1,2,3", "t,f,t"},
+		{DtypeString, []string{"foo", "", "bar"}, 2, "foo,baz", "t,"},
+		{DtypeNull, []string{"", ""}, 2, "1,2", ","},
+	}
+	for _, test := range tests {
+		var literals []*Chunk
+		for _, raw := range test.literals {
+			dtype := test.dtype
+			if raw == "" {
+				dtype = DtypeNull
+			}
+			lit, err := NewChunkLiteralTyped(raw, dtype, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			literals = append(literals, lit)
+		}
+		set, err := NewValueSetFromLiterals(test.dtype, literals...)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		vdtype := test.dtype
+		if vdtype == DtypeNull {
+			vdtype = DtypeInt
+		}
+		values, err := prepColumn(test.nrows, vdtype, test.values)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		expected, err := prepColumn(test.nrows, DtypeBool, test.expected)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		res, err := EvalIn(values, set)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !ChunksEqual(res, expected) {
+			t.Errorf("expected %+v in %+v to result in %+v, got %+v instead", test.values, test.literals, test.expected, res)
+		}
+	}
+
+	// ints can go in a set of floats, but not the other way around
+	one := NewChunkLiteralInts(1, 1)
+	half := NewChunkLiteralFloats(0.5, 1)
+	set, err := NewValueSetFromLiterals(DtypeFloat, one, half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := EvalIn(NewChunkIntsFromSlice([]int64{0, 1}, nil), set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truths().Count() != 1 || !res.Truths().Get(1) {
+		t.Errorf("expecting ints to be found in a set of floats, got %+v", res)
+	}
+	if _, err := NewValueSetFromLiterals(DtypeInt, one, half); !errors.Is(err, errSetTypeMismatch) {
+		t.Errorf("expecting floats not to go in a set of ints, got %v", err)
+	}
+}
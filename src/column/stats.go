@@ -0,0 +1,201 @@
+package column
+
+import (
+	"container/heap"
+	"math"
+	"unicode/utf8"
+)
+
+// number of hashes we keep to estimate distinct counts, the estimate's relative error is
+// about 1/sqrt(distinctSketchSize), so roughly 3%
+const distinctSketchSize = 1024
+
+// ColumnStats profile values of a column, so that we can describe data without querying them
+type ColumnStats struct {
+	NullFraction float64 `json:"null_fraction"`
+	// distinct non-null values, exact for low cardinalities, estimated otherwise
+	Distinct int64 `json:"distinct"`
+	// extremes are formatted the way they'd appear in an input file, they are missing if there
+	// are no non-null values
+	Min *string `json:"min,omitempty"`
+	Max *string `json:"max,omitempty"`
+	// average length (in characters) of string values
+	AvgLength float64 `json:"avg_length,omitempty"`
+}
+
+// StatsCollector gathers stats of a column across chunks (e.g. stripes as they get loaded)
+type StatsCollector struct {
+	dtype    Dtype
+	rows     int64
+	nulls    int64
+	chars    int64
+	extremes *Chunk // min and max, in this order
+	sketch   distinctSketch
+}
+
+// NewStatsCollector initialises a collector for a column of a given type
+func NewStatsCollector(dtype Dtype) *StatsCollector {
+	return &StatsCollector{
+		dtype:  dtype,
+		sketch: distinctSketch{seen: make(map[uint64]struct{})},
+	}
+}
+
+// Add accounts for all the values in a given chunk, it needs to be of the collector's type
+func (sc *StatsCollector) Add(rc *Chunk) error {
+	if rc.dtype != sc.dtype {
+		return errAppendTypeMismatch
+	}
+	length := rc.Len()
+	sc.rows += int64(length)
+	if length == 0 || rc.dtype == DtypeNull {
+		sc.nulls += int64(length)
+		return nil
+	}
+	if rc.IsLiteral {
+		rc = rc.Reorder(make([]int, length))
+	}
+	hashes := make([]uint64, rc.Len())
+	rc.Hash(0, hashes)
+	minPos, maxPos := -1, -1
+	for j := 0; j < rc.Len(); j++ {
+		if rc.Nullability != nil && rc.Nullability.Get(j) {
+			sc.nulls++
+			continue
+		}
+		if minPos == -1 || rc.Compare(true, false, j, minPos) < 0 {
+			minPos = j
+		}
+		if maxPos == -1 || rc.Compare(true, false, j, maxPos) > 0 {
+			maxPos = j
+		}
+		if rc.dtype == DtypeString {
+			sc.chars += int64(utf8.RuneCountInString(rc.nthValue(j)))
+		}
+		sc.sketch.add(hashes[j])
+	}
+	if minPos == -1 {
+		return nil
+	}
+	candidates := rc.Reorder([]int{minPos, maxPos})
+	if sc.extremes != nil {
+		if err := candidates.Append(sc.extremes); err != nil {
+			return err
+		}
+	}
+	minPos, maxPos = 0, 1
+	for j := 0; j < candidates.Len(); j++ {
+		if candidates.Compare(true, false, j, minPos) < 0 {
+			minPos = j
+		}
+		if candidates.Compare(true, false, j, maxPos) > 0 {
+			maxPos = j
+		}
+	}
+	sc.extremes = candidates.Reorder([]int{minPos, maxPos})
+	return nil
+}
+
+// Stats summarises all the values added so far
+func (sc *StatsCollector) Stats() ColumnStats {
+	stats := ColumnStats{Distinct: sc.sketch.estimate()}
+	if sc.rows > 0 {
+		stats.NullFraction = float64(sc.nulls) / float64(sc.rows)
+	}
+	if nonNull := sc.rows - sc.nulls; sc.dtype == DtypeString && nonNull > 0 {
+		stats.AvgLength = float64(sc.chars) / float64(nonNull)
+	}
+	if sc.extremes != nil {
+		lo, hi := sc.extremes.textValue(0), sc.extremes.textValue(1)
+		stats.Min, stats.Max = &lo, &hi
+	}
+	return stats
+}
+
+// MergeStats combines stats of two sets of values (of a given type), e.g. when appending data
+// ARCH: we don't persist our sketches of distinct values, so we cannot combine them, the merged
+// distinct count is just a lower bound (the higher of the two counts)
+func MergeStats(dtype Dtype, a, b ColumnStats, rowsA, rowsB int64) ColumnStats {
+	nullsA, nullsB := a.NullFraction*float64(rowsA), b.NullFraction*float64(rowsB)
+	merged := ColumnStats{Distinct: a.Distinct}
+	if b.Distinct > merged.Distinct {
+		merged.Distinct = b.Distinct
+	}
+	if rows := rowsA + rowsB; rows > 0 {
+		merged.NullFraction = (nullsA + nullsB) / float64(rows)
+	}
+	if nonNull := float64(rowsA+rowsB) - nullsA - nullsB; nonNull > 0 {
+		chars := a.AvgLength*(float64(rowsA)-nullsA) + b.AvgLength*(float64(rowsB)-nullsB)
+		merged.AvgLength = chars / nonNull
+	}
+	merged.Min, merged.Max = a.Min, a.Max
+	if a.Min == nil || b.Min == nil {
+		if a.Min == nil {
+			merged.Min, merged.Max = b.Min, b.Max
+		}
+		return merged
+	}
+	extremes := NewChunk(dtype)
+	if err := extremes.AddValues([]string{*a.Min, *a.Max, *b.Min, *b.Max}); err != nil {
+		// ARCH: extremes may not parse in a given type (if stats were collected before a type change),
+		// we'd rather have no extremes than wrong ones
+		merged.Min, merged.Max = nil, nil
+		return merged
+	}
+	if extremes.Compare(true, false, 2, 0) < 0 {
+		merged.Min = b.Min
+	}
+	if extremes.Compare(true, false, 3, 1) > 0 {
+		merged.Max = b.Max
+	}
+	return merged
+}
+
+// distinctSketch estimates the number of distinct values by keeping the smallest hashes seen
+// (a k-minimum values sketch), it assumes hashes to be uniformly distributed
+type distinctSketch struct {
+	smallest hashHeap
+	seen     map[uint64]struct{}
+}
+
+func (ds *distinctSketch) add(hash uint64) {
+	// fnv doesn't mix its upper bits well, so we finalise it the same way splitmix64 does
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	hash ^= hash >> 31
+	full := len(ds.smallest) == distinctSketchSize
+	if full && hash >= ds.smallest[0] {
+		return
+	}
+	if _, ok := ds.seen[hash]; ok {
+		return
+	}
+	if full {
+		delete(ds.seen, heap.Pop(&ds.smallest).(uint64))
+	}
+	heap.Push(&ds.smallest, hash)
+	ds.seen[hash] = struct{}{}
+}
+
+func (ds *distinctSketch) estimate() int64 {
+	if len(ds.smallest) < distinctSketchSize {
+		return int64(len(ds.smallest))
+	}
+	// the kth smallest of n uniformly distributed hashes is expected at k/n of the hash space
+	kth := float64(ds.smallest[0]) / math.MaxUint64
+	return int64(math.Round(float64(distinctSketchSize-1) / kth))
+}
+
+// hashHeap is a max-heap of hashes (see container/heap)
+type hashHeap []uint64
+
+func (h hashHeap) Len() int            { return len(h) }
+func (h hashHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *hashHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,124 @@
+package column
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func strptr(s string) *string {
+	return &s
+}
+
+func TestCollectingStats(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		chunks   [][]string
+		expected ColumnStats
+	}{
+		{DtypeInt, [][]string{{"3", "1", ""}, {"10", "1"}}, ColumnStats{NullFraction: 0.2, Distinct: 3, Min: strptr("1"), Max: strptr("10")}},
+		{DtypeFloat, [][]string{{"1.5", "-2"}}, ColumnStats{Distinct: 2, Min: strptr("-2"), Max: strptr("1.5")}},
+		{DtypeString, [][]string{{"b", "ab"}, {"", "čau"}}, ColumnStats{Distinct: 4, Min: strptr(""), Max: strptr("čau"), AvgLength: 1.5}},
+		{DtypeBool, [][]string{{"t", "t"}, {"t"}}, ColumnStats{Distinct: 1, Min: strptr("true"), Max: strptr("true")}},
+		{DtypeDate, [][]string{{"2020-02-20", ""}, {"1999-12-31"}}, ColumnStats{NullFraction: 1.0 / 3, Distinct: 2, Min: strptr("1999-12-31"), Max: strptr("2020-02-20")}},
+		{DtypeNull, [][]string{{"", ""}}, ColumnStats{NullFraction: 1}},
+		{DtypeInt, [][]string{{"", ""}}, ColumnStats{NullFraction: 1}},
+		{DtypeInt, nil, ColumnStats{}},
+	}
+	for _, test := range tests {
+		collector := NewStatsCollector(test.dtype)
+		for _, values := range test.chunks {
+			chunk := NewChunk(test.dtype)
+			if err := chunk.AddValues(values); err != nil {
+				t.Fatal(err)
+			}
+			if err := collector.Add(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats := collector.Stats(); !reflect.DeepEqual(stats, test.expected) {
+			t.Errorf("expecting %v to result in stats %+v, got %+v", test.chunks, test.expected, stats)
+		}
+	}
+
+	if err := NewStatsCollector(DtypeInt).Add(NewChunk(DtypeString)); err != errAppendTypeMismatch {
+		t.Errorf("expecting a type mismatch to fail with %v, got %v", errAppendTypeMismatch, err)
+	}
+	collector := NewStatsCollector(DtypeString)
+	if err := collector.Add(NewChunkLiteralStrings("foo", 4)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := collector.Stats(); stats.Distinct != 1 || stats.AvgLength != 3 || *stats.Max != "foo" {
+		t.Errorf("unexpected stats of a literal chunk: %+v", stats)
+	}
+}
+
+func TestEstimatingDistinctValues(t *testing.T) {
+	for _, ndistinct := range []int{10, distinctSketchSize, 10_000, 100_000} {
+		collector := NewStatsCollector(DtypeInt)
+		// every value is there twice, in separate chunks
+		for k := 0; k < 2; k++ {
+			chunk := NewChunk(DtypeInt)
+			for j := 0; j < ndistinct; j++ {
+				if err := chunk.AddValue(strconv.Itoa(j)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := collector.Add(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		estimate := collector.Stats().Distinct
+		if ndistinct < distinctSketchSize && estimate != int64(ndistinct) {
+			t.Errorf("expecting low cardinalities to be counted exactly, expected %v, got %v", ndistinct, estimate)
+		}
+		if relErr := math.Abs(float64(estimate)/float64(ndistinct) - 1); relErr > 0.1 {
+			t.Errorf("expecting an estimate of %v distinct values to be within 10%%, got %v", ndistinct, estimate)
+		}
+	}
+}
+
+func TestMergingStats(t *testing.T) {
+	tests := []struct {
+		dtype        Dtype
+		a, b         ColumnStats
+		rowsA, rowsB int64
+		expected     ColumnStats
+	}{
+		{
+			DtypeInt,
+			ColumnStats{NullFraction: 0.5, Distinct: 3, Min: strptr("2"), Max: strptr("10")},
+			ColumnStats{Distinct: 5, Min: strptr("9"), Max: strptr("11")},
+			10, 30,
+			ColumnStats{NullFraction: 0.125, Distinct: 5, Min: strptr("2"), Max: strptr("11")},
+		},
+		{
+			DtypeString,
+			ColumnStats{Distinct: 1, Min: strptr("b"), Max: strptr("b"), AvgLength: 1},
+			ColumnStats{Distinct: 1, Min: strptr("aaa"), Max: strptr("aaa"), AvgLength: 3},
+			1, 1,
+			ColumnStats{Distinct: 1, Min: strptr("aaa"), Max: strptr("b"), AvgLength: 2},
+		},
+		{
+			DtypeDate,
+			ColumnStats{NullFraction: 1},
+			ColumnStats{Distinct: 1, Min: strptr("2020-01-01"), Max: strptr("2020-01-01")},
+			1, 1,
+			ColumnStats{NullFraction: 0.5, Distinct: 1, Min: strptr("2020-01-01"), Max: strptr("2020-01-01")},
+		},
+		// extremes that don't fit the type get dropped
+		{
+			DtypeInt,
+			ColumnStats{Distinct: 1, Min: strptr("foo"), Max: strptr("foo")},
+			ColumnStats{Distinct: 1, Min: strptr("1"), Max: strptr("1")},
+			1, 1,
+			ColumnStats{Distinct: 1},
+		},
+	}
+	for _, test := range tests {
+		if merged := MergeStats(test.dtype, test.a, test.b, test.rowsA, test.rowsB); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("expecting %+v and %+v to merge into %+v, got %+v", test.a, test.b, test.expected, merged)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package column
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errThriftInvalid = errs.New(errs.ErrBadRequest, "invalid Thrift data")
+
+// thriftWriter is a minimal writer of the Thrift compact protocol, it only implements what we need
+// to write Parquet metadata (see parquet.go). The protocol is described in
+// https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+// Fields are written as they are added, so they need to be added in the order of their IDs
+// (or else we'd have to write full field headers, which we don't bother with).
+type thriftWriter struct {
+	buf []byte
+	// IDs of last written fields, one for each struct we're in (field IDs are delta encoded)
+	lastIDs []int16
+}
+
+const (
+	thriftTypeBoolTrue  = 1
+	thriftTypeBoolFalse = 2
+	thriftTypeByte      = 3
+	thriftTypeI16       = 4
+	thriftTypeI32       = 5
+	thriftTypeI64       = 6
+	thriftTypeDouble    = 7
+	thriftTypeBinary    = 8
+	thriftTypeList      = 9
+	thriftTypeSet       = 10
+	thriftTypeMap       = 11
+	thriftTypeStruct    = 12
+)
+
+func newThriftWriter() *thriftWriter {
+	// we're always in a (top level) struct
+	return &thriftWriter{lastIDs: []int16{0}}
+}
+
+func (tw *thriftWriter) varint(val uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], val)
+	tw.buf = append(tw.buf, buf[:n]...)
+}
+
+func zigzag(val int64) uint64 {
+	return uint64((val << 1) ^ (val >> 63))
+}
+
+func (tw *thriftWriter) fieldHeader(id int16, ttype byte) {
+	last := &tw.lastIDs[len(tw.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		tw.buf = append(tw.buf, byte(delta)<<4|ttype)
+	} else {
+		tw.buf = append(tw.buf, ttype)
+		tw.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (tw *thriftWriter) i32(id int16, val int32) {
+	tw.fieldHeader(id, thriftTypeI32)
+	tw.varint(zigzag(int64(val)))
+}
+
+func (tw *thriftWriter) i64(id int16, val int64) {
+	tw.fieldHeader(id, thriftTypeI64)
+	tw.varint(zigzag(val))
+}
+
+func (tw *thriftWriter) boolean(id int16, val bool) {
+	if val {
+		tw.fieldHeader(id, thriftTypeBoolTrue)
+	} else {
+		tw.fieldHeader(id, thriftTypeBoolFalse)
+	}
+}
+
+func (tw *thriftWriter) binary(id int16, val string) {
+	tw.fieldHeader(id, thriftTypeBinary)
+	tw.listElementBinary(val)
+}
+
+// structs need to be closed using endStruct
+func (tw *thriftWriter) beginStruct(id int16) {
+	tw.fieldHeader(id, thriftTypeStruct)
+	tw.lastIDs = append(tw.lastIDs, 0)
+}
+
+func (tw *thriftWriter) endStruct() {
+	tw.buf = append(tw.buf, 0)
+	tw.lastIDs = tw.lastIDs[:len(tw.lastIDs)-1]
+}
+
+// lists are followed by `size` elements, there's no end marker
+func (tw *thriftWriter) beginList(id int16, elementType byte, size int) {
+	tw.fieldHeader(id, thriftTypeList)
+	if size < 15 {
+		tw.buf = append(tw.buf, byte(size)<<4|elementType)
+		return
+	}
+	tw.buf = append(tw.buf, 0xf0|elementType)
+	tw.varint(uint64(size))
+}
+
+// list elements (structs, just like fields of a struct, are closed using endStruct)
+func (tw *thriftWriter) listElementStruct() {
+	tw.lastIDs = append(tw.lastIDs, 0)
+}
+
+func (tw *thriftWriter) listElementI32(val int32) {
+	tw.varint(zigzag(int64(val)))
+}
+
+func (tw *thriftWriter) listElementBinary(val string) {
+	tw.varint(uint64(len(val)))
+	tw.buf = append(tw.buf, val...)
+}
+
+// finish closes the top level struct and returns the serialised data
+func (tw *thriftWriter) finish() []byte {
+	tw.buf = append(tw.buf, 0)
+	return tw.buf
+}
+
+// thriftStruct is a decoded struct, its fields are keyed by their IDs. Integers of all sizes are
+// decoded as int64, binary fields as []byte, lists (and sets) as []interface{} and nested
+// structs as thriftStruct. Maps are skipped, we don't need any.
+type thriftStruct map[int16]interface{}
+
+func (ts thriftStruct) int(id int16) (int64, bool) {
+	val, ok := ts[id].(int64)
+	return val, ok
+}
+
+func (ts thriftStruct) bytes(id int16) []byte {
+	val, _ := ts[id].([]byte)
+	return val
+}
+
+func (ts thriftStruct) boolean(id int16) (bool, bool) {
+	val, ok := ts[id].(bool)
+	return val, ok
+}
+
+// nil if not present, so that nested lookups are safe
+func (ts thriftStruct) strct(id int16) thriftStruct {
+	val, _ := ts[id].(thriftStruct)
+	return val
+}
+
+func (ts thriftStruct) list(id int16) []interface{} {
+	val, _ := ts[id].([]interface{})
+	return val
+}
+
+// thriftReader is the counterpart of thriftWriter, it decodes the Thrift compact protocol into
+// generic values, so that we can read Parquet metadata without generating any code
+type thriftReader struct {
+	buf   []byte
+	depth int
+}
+
+// structs, lists and maps can be nested this deep, so that malicious inputs cannot exhaust our stack
+const thriftMaxDepth = 64
+
+// readThriftStruct decodes a struct at the beginning of a buffer and returns the number of bytes
+// it took up
+func readThriftStruct(buf []byte) (thriftStruct, int, error) {
+	tr := &thriftReader{buf: buf}
+	ts, err := tr.strct()
+	if err != nil {
+		return nil, 0, err
+	}
+	return ts, len(buf) - len(tr.buf), nil
+}
+
+func (tr *thriftReader) byte() (byte, error) {
+	if len(tr.buf) == 0 {
+		return 0, fmt.Errorf("%w: unexpected end of data", errThriftInvalid)
+	}
+	val := tr.buf[0]
+	tr.buf = tr.buf[1:]
+	return val, nil
+}
+
+func (tr *thriftReader) varint() (uint64, error) {
+	val, n := binary.Uvarint(tr.buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: invalid varint", errThriftInvalid)
+	}
+	tr.buf = tr.buf[n:]
+	return val, nil
+}
+
+func (tr *thriftReader) zigzag() (int64, error) {
+	val, err := tr.varint()
+	return int64(val>>1) ^ -int64(val&1), err
+}
+
+func (tr *thriftReader) strct() (thriftStruct, error) {
+	if tr.depth++; tr.depth > thriftMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deep", errThriftInvalid)
+	}
+	defer func() { tr.depth-- }()
+	ret := make(thriftStruct)
+	var id int16
+	for {
+		header, err := tr.byte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return ret, nil
+		}
+		if delta := int16(header >> 4); delta > 0 {
+			id += delta
+		} else {
+			val, err := tr.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(val)
+		}
+		val, err := tr.value(header & 0x0f)
+		if err != nil {
+			return nil, err
+		}
+		ret[id] = val
+	}
+}
+
+func (tr *thriftReader) value(ttype byte) (interface{}, error) {
+	switch ttype {
+	case thriftTypeBoolTrue:
+		return true, nil
+	case thriftTypeBoolFalse:
+		return false, nil
+	case thriftTypeByte:
+		val, err := tr.byte()
+		return int64(int8(val)), err
+	case thriftTypeI16, thriftTypeI32, thriftTypeI64:
+		return tr.zigzag()
+	case thriftTypeDouble:
+		if len(tr.buf) < 8 {
+			return nil, fmt.Errorf("%w: unexpected end of data", errThriftInvalid)
+		}
+		val := math.Float64frombits(binary.LittleEndian.Uint64(tr.buf))
+		tr.buf = tr.buf[8:]
+		return val, nil
+	case thriftTypeBinary:
+		length, err := tr.varint()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(len(tr.buf)) {
+			return nil, fmt.Errorf("%w: unexpected end of data", errThriftInvalid)
+		}
+		val := tr.buf[:length]
+		tr.buf = tr.buf[length:]
+		return val, nil
+	case thriftTypeList, thriftTypeSet:
+		return tr.list()
+	case thriftTypeMap:
+		return nil, tr.skipMap()
+	case thriftTypeStruct:
+		return tr.strct()
+	}
+	return nil, fmt.Errorf("%w: unknown type %v", errThriftInvalid, ttype)
+}
+
+func (tr *thriftReader) list() ([]interface{}, error) {
+	if tr.depth++; tr.depth > thriftMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deep", errThriftInvalid)
+	}
+	defer func() { tr.depth-- }()
+	header, err := tr.byte()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(header >> 4)
+	if size == 15 {
+		if size, err = tr.varint(); err != nil {
+			return nil, err
+		}
+	}
+	// each element takes up at least a byte, so this guards our allocation
+	if size > uint64(len(tr.buf)) {
+		return nil, fmt.Errorf("%w: list of %v elements is too long", errThriftInvalid, size)
+	}
+	etype := header & 0x0f
+	ret := make([]interface{}, 0, size)
+	for j := uint64(0); j < size; j++ {
+		val, err := tr.element(etype)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, val)
+	}
+	return ret, nil
+}
+
+// element decodes a list (or map) element, these differ from struct fields in that booleans
+// are encoded as bytes (struct fields have them in their headers)
+func (tr *thriftReader) element(etype byte) (interface{}, error) {
+	if etype == thriftTypeBoolTrue || etype == thriftTypeBoolFalse {
+		val, err := tr.byte()
+		return val == thriftTypeBoolTrue, err
+	}
+	return tr.value(etype)
+}
+
+func (tr *thriftReader) skipMap() error {
+	size, err := tr.varint()
+	if err != nil || size == 0 {
+		return err
+	}
+	if size > uint64(len(tr.buf)) {
+		return fmt.Errorf("%w: map of %v elements is too long", errThriftInvalid, size)
+	}
+	types, err := tr.byte()
+	if err != nil {
+		return err
+	}
+	for j := uint64(0); j < size; j++ {
+		if _, err := tr.element(types >> 4); err != nil {
+			return err
+		}
+		if _, err := tr.element(types & 0x0f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package column
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// bundled, so that timezones are available even in environments without tzdata (e.g. lambdas)
+	_ "time/tzdata"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+// Datetimes don't carry timezones, they are stored (and evaluated) in UTC. Queries can be run in
+// other timezones, in which case datetimes get converted into local times wherever it matters - when
+// parsing them from strings, truncating them, extracting their parts and rendering them.
+
+var errUnknownTimezone = errs.New(errs.ErrBadRequest, "unknown timezone")
+
+// LoadTimezone looks up a timezone by its IANA name (e.g. `Europe/Prague`), unlike time.LoadLocation
+// it doesn't accept `Local`, because our server's timezone is not something queries should depend on
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" || strings.EqualFold(name, "local") {
+		return nil, fmt.Errorf("%w: %q", errUnknownTimezone, name)
+	}
+	if strings.EqualFold(name, "utc") {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnknownTimezone, err)
+	}
+	return loc, nil
+}
+
+// DatetimesToUTC takes datetimes to be local times in a given timezone and converts them into UTC,
+// other types are returned as they are
+func DatetimesToUTC(c *Chunk, loc *time.Location) (*Chunk, error) {
+	if c.dtype != DtypeDatetime || loc == time.UTC {
+		return c, nil
+	}
+	return mapTimes(c, DtypeDatetime, func(t time.Time) (time.Time, error) {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc).UTC(), nil
+	})
+}
+
+// DatetimesFromUTC is the inverse of DatetimesToUTC, it converts UTC datetimes into local times
+func DatetimesFromUTC(c *Chunk, loc *time.Location) (*Chunk, error) {
+	if c.dtype != DtypeDatetime || loc == time.UTC {
+		return c, nil
+	}
+	return mapTimes(c, DtypeDatetime, func(t time.Time) (time.Time, error) {
+		return t.In(loc), nil
+	})
+}
+
+// TimezoneFunc returns a variant of a projection function (see FuncProj) that evaluates datetimes
+// in a given timezone, it reports false for functions that don't depend on timezones.
+// Times of day that don't exist in a given timezone (they get skipped when DST starts) are
+// normalised, as in time.Date.
+// ARCH: intervals are added in UTC, so adding a day across a DST change shifts local times by an hour
+func TimezoneFunc(name string, loc *time.Location) (func(...*Chunk) (*Chunk, error), bool) {
+	switch name {
+	case "date_trunc":
+		return func(cs ...*Chunk) (*Chunk, error) {
+			local, err := DatetimesFromUTC(cs[1], loc)
+			if err != nil {
+				return nil, err
+			}
+			ret, err := evalDateTrunc(cs[0], local)
+			if err != nil {
+				return nil, err
+			}
+			return DatetimesToUTC(ret, loc)
+		}, true
+	case "date_part":
+		return func(cs ...*Chunk) (*Chunk, error) {
+			// epochs are the same in all timezones
+			if strings.ToLower(cs[0].nthValue(0)) == "epoch" {
+				return evalDatePart(cs...)
+			}
+			local, err := DatetimesFromUTC(cs[1], loc)
+			if err != nil {
+				return nil, err
+			}
+			return evalDatePart(cs[0], local)
+		}, true
+	case "cast":
+		return func(cs ...*Chunk) (*Chunk, error) {
+			ret, err := evalCast(cs...)
+			if err != nil {
+				return nil, err
+			}
+			// only strings get parsed as local times, dates and datetimes are already in UTC
+			if cs[0].dtype != DtypeString {
+				return ret, nil
+			}
+			return DatetimesToUTC(ret, loc)
+		}, true
+	}
+	return nil, false
+}
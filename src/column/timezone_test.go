@@ -0,0 +1,116 @@
+package column
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoadingTimezones(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"UTC", nil},
+		{"utc", nil},
+		{"Europe/Prague", nil},
+		{"America/New_York", nil},
+		{"", errUnknownTimezone},
+		{"Local", errUnknownTimezone},
+		{"Europe/Atlantis", errUnknownTimezone},
+	}
+	for _, test := range tests {
+		if _, err := LoadTimezone(test.name); !errors.Is(err, test.err) {
+			t.Errorf("expecting timezone %q to result in %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestConvertingTimezones(t *testing.T) {
+	prague, err := LoadTimezone("Europe/Prague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := NewChunk(DtypeDatetime)
+	// winter and summer time (the latter crosses midnight)
+	if err := utc.AddValues([]string{"2020-01-01 12:00:00", "2020-07-01 23:30:00", ""}); err != nil {
+		t.Fatal(err)
+	}
+	local := NewChunk(DtypeDatetime)
+	if err := local.AddValues([]string{"2020-01-01 13:00:00", "2020-07-02 01:30:00", ""}); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := DatetimesFromUTC(utc, prague)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ChunksEqual(converted, local) {
+		t.Errorf("expecting %v to be converted into %v, got %v", utc, local, converted)
+	}
+	back, err := DatetimesToUTC(converted, prague)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ChunksEqual(back, utc) {
+		t.Errorf("expecting %v to be converted back into %v, got %v", converted, utc, back)
+	}
+
+	dates := NewChunk(DtypeDate)
+	if err := dates.AddValues([]string{"2020-01-01"}); err != nil {
+		t.Fatal(err)
+	}
+	if converted, err := DatetimesFromUTC(dates, prague); err != nil || !ChunksEqual(converted, dates) {
+		t.Errorf("expecting dates not to be converted, got %v (%v)", converted, err)
+	}
+}
+
+func TestTimezoneFuncs(t *testing.T) {
+	prague, err := LoadTimezone("Europe/Prague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		args     []*Chunk
+		dtype    Dtype
+		expected string
+	}{
+		// 22:00 UTC is still February in Prague, 23:30 UTC is already March there
+		{"date_trunc", []*Chunk{NewChunkLiteralStrings("month", 2), NewChunkLiteralStrings("2020-02-29 22:00:00", 2)}, DtypeDatetime, "2020-01-31 23:00:00"},
+		{"date_trunc", []*Chunk{NewChunkLiteralStrings("day", 1), NewChunkLiteralStrings("2020-02-29 23:30:00", 1)}, DtypeDatetime, "2020-02-29 23:00:00"},
+		{"date_part", []*Chunk{NewChunkLiteralStrings("hour", 1), NewChunkLiteralStrings("2020-07-01 23:30:00", 1)}, DtypeInt, "1"},
+		{"date_part", []*Chunk{NewChunkLiteralStrings("day", 1), NewChunkLiteralStrings("2020-07-01 23:30:00", 1)}, DtypeInt, "2"},
+		{"date_part", []*Chunk{NewChunkLiteralStrings("epoch", 1), NewChunkLiteralStrings("1970-01-01 00:00:10", 1)}, DtypeInt, "10"},
+		{"cast", []*Chunk{NewChunkLiteralStrings("2020-01-01 12:00:00", 1), NewChunkLiteralStrings("datetime", 1)}, DtypeDatetime, "2020-01-01 11:00:00"},
+		{"cast", []*Chunk{NewChunkLiteralStrings("2020-01-01", 1), NewChunkLiteralStrings("date", 1)}, DtypeDate, "2020-01-01"},
+	}
+	for _, test := range tests {
+		fnc, ok := TimezoneFunc(test.name, prague)
+		if !ok {
+			t.Fatalf("expecting %v to depend on timezones", test.name)
+		}
+		args := test.args
+		// datetimes are passed in as datetimes, not as strings
+		if test.name != "cast" {
+			dts, err := args[1].castValues(DtypeDatetime, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args = []*Chunk{args[0], dts}
+		}
+		res, err := fnc(args...)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		expected, err := NewChunkLiteralTyped(test.expected, test.dtype, args[0].Len())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ChunksEqual(res, expected) {
+			t.Errorf("expecting %v(%v) in Prague to result in %v, got %v", test.name, test.args, expected, res)
+		}
+	}
+	if _, ok := TimezoneFunc("upper", prague); ok {
+		t.Error("not expecting upper() to depend on timezones")
+	}
+}
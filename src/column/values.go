@@ -0,0 +1,37 @@
+package column
+
+import (
+	"encoding/json"
+)
+
+// Value returns the nth value of a chunk as a native Go value, it returns false for nulls. Strings
+// are returned as strings, ints as int64, floats as float64, bools as bools, dates and datetimes
+// as time.Time (in UTC), JSON documents as json.RawMessage. Decimals are returned as strings
+// (e.g. "1.50"), so that they don't lose precision.
+func (rc *Chunk) Value(n int) (interface{}, bool) {
+	if rc.IsLiteral {
+		n = 0
+	}
+	if rc.dtype == DtypeNull || (rc.Nullability != nil && rc.Nullability.Get(n)) {
+		return nil, false
+	}
+	switch rc.dtype {
+	case DtypeString:
+		return rc.nthValue(n), true
+	case DtypeJSON:
+		return json.RawMessage(rc.nthValue(n)), true
+	case DtypeInt:
+		return rc.storage.ints[n], true
+	case DtypeFloat:
+		return rc.storage.floats[n], true
+	case DtypeBool:
+		return rc.storage.bools.Get(n), true
+	case DtypeDate:
+		return rc.storage.dates[n].toNative(), true
+	case DtypeDatetime:
+		return rc.storage.datetimes[n].toNative(), true
+	case DtypeDecimal:
+		return rc.storage.decimals[n].String(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,43 @@
+package column
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNativeValues(t *testing.T) {
+	tests := []struct {
+		dtype    Dtype
+		values   []string
+		expected []interface{} // nil for nulls
+	}{
+		{DtypeString, []string{"foo", ""}, []interface{}{"foo", ""}},
+		{DtypeInt, []string{"12", "", "-3"}, []interface{}{int64(12), nil, int64(-3)}},
+		{DtypeFloat, []string{"1.5", ""}, []interface{}{1.5, nil}},
+		{DtypeBool, []string{"true", "f", ""}, []interface{}{true, false, nil}},
+		{DtypeDate, []string{"2020-02-20", ""}, []interface{}{time.Date(2020, 2, 20, 0, 0, 0, 0, time.UTC), nil}},
+		{DtypeDatetime, []string{"2020-02-20 12:34:56.789000"}, []interface{}{time.Date(2020, 2, 20, 12, 34, 56, 789e6, time.UTC)}},
+		{DtypeDecimal, []string{"1.50", "-2"}, []interface{}{"1.50", "-2"}},
+		{DtypeJSON, []string{`{"a": 1}`, ""}, []interface{}{json.RawMessage(`{"a": 1}`), nil}},
+		{DtypeNull, []string{"", ""}, []interface{}{nil, nil}},
+	}
+	for _, test := range tests {
+		chunk := NewChunk(test.dtype)
+		if err := chunk.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		for j, expected := range test.expected {
+			got, ok := chunk.Value(j)
+			if ok != (expected != nil) || !reflect.DeepEqual(got, expected) {
+				t.Errorf("expecting %v (%v) to be %#v, got %#v (non-null: %v)", test.values[j], test.dtype, expected, got, ok)
+			}
+		}
+	}
+
+	literal := NewChunkLiteralInts(42, 3)
+	if val, ok := literal.Value(2); !ok || val != int64(42) {
+		t.Errorf("expecting literals to have the same value throughout, got %v", val)
+	}
+}
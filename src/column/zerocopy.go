@@ -0,0 +1,78 @@
+package column
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"unsafe"
+
+	"github.com/kokes/smda/src/bitmap"
+)
+
+// we can only reinterpret bytes as numbers if our in-memory representation matches the on-disk
+// one, which is little endian
+var nativeLittleEndian = func() bool {
+	val := uint16(1)
+	return *(*byte)(unsafe.Pointer(&val)) == 1
+}()
+
+// DeserializeBytes is like Deserialize, but it reads a chunk from a byte slice and the values
+// of fixed width types (ints, floats, dates, datetimes, decimals) are not copied - the chunk
+// reinterprets the slice's memory instead. The slice must not be modified (or reused) afterwards.
+// If the values are not properly aligned (e.g. they follow a nullability bitmap of an odd length)
+// or our platform is not little endian, they get copied in bulk instead. Other types get
+// deserialised the usual way.
+func DeserializeBytes(data []byte, dtype Dtype) (*Chunk, error) {
+	var width int
+	switch dtype {
+	case DtypeInt, DtypeFloat, DtypeDatetime, DtypeDecimal:
+		width = 8
+	case DtypeDate:
+		width = 4
+	default:
+		return Deserialize(bytes.NewReader(data), dtype)
+	}
+	br := bytes.NewReader(data)
+	bm, err := bitmap.DeserializeBitmapFromReader(br)
+	if err != nil {
+		return nil, err
+	}
+	rest := data[len(data)-br.Len():]
+	if len(rest) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	size := width * int(length)
+	if len(rest) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if length == 0 || !nativeLittleEndian {
+		return Deserialize(bytes.NewReader(data), dtype)
+	}
+	// cap our values, so that appends to this chunk never write past them
+	values := rest[:size:size]
+	if uintptr(unsafe.Pointer(&values[0]))%uintptr(width) != 0 {
+		// OPTIM: this copy could be avoided if we padded our values when writing them (it would
+		// change our on-disk format though)
+		aligned := make([]uint64, (size+7)/8)
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&aligned[0])), size), values)
+		values = unsafe.Slice((*byte)(unsafe.Pointer(&aligned[0])), size)
+	}
+
+	ch := &Chunk{dtype: dtype, length: length, Nullability: bm}
+	ptr := unsafe.Pointer(&values[0])
+	switch dtype {
+	case DtypeInt:
+		ch.storage.ints = unsafe.Slice((*int64)(ptr), length)
+	case DtypeFloat:
+		ch.storage.floats = unsafe.Slice((*float64)(ptr), length)
+	case DtypeDatetime:
+		ch.storage.datetimes = unsafe.Slice((*datetime)(ptr), length)
+	case DtypeDecimal:
+		ch.storage.decimals = unsafe.Slice((*decimal)(ptr), length)
+	case DtypeDate:
+		ch.storage.dates = unsafe.Slice((*date)(ptr), length)
+	}
+	return ch, nil
+}
@@ -0,0 +1,113 @@
+package column
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+func TestZeroCopyDeserialisation(t *testing.T) {
+	tests := []struct {
+		dtype Dtype
+		vals  []string
+	}{
+		{DtypeInt, []string{}},
+		{DtypeInt, []string{"1", "2", "3"}},
+		{DtypeInt, []string{"1", "", "3"}},
+		{DtypeFloat, []string{"1", "2.5", "-inf"}},
+		{DtypeFloat, []string{"1", "", "3"}},
+		{DtypeDate, []string{"2020-02-22", "2030-12-31", "1999-01-01"}},
+		{DtypeDate, []string{"2020-02-22", "", "2030-12-31"}},
+		{DtypeDatetime, []string{"2020-02-22 12:34:45", "", "2030-12-31 11:12:00.012"}},
+		{DtypeDecimal, []string{"12.30", "", "-0.05"}},
+		// these don't have fixed widths, so they get deserialised the usual way
+		{DtypeString, []string{"foo", "", "baz"}},
+		{DtypeBool, []string{"t", "", "f"}},
+		{DtypeNull, []string{""}},
+	}
+	for _, test := range tests {
+		col := NewChunk(test.dtype)
+		if err := col.AddValues(test.vals); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if _, err := col.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		// shifting the data by one byte makes them misaligned
+		for _, shift := range []int{0, 1} {
+			data := make([]byte, shift+buf.Len())[shift:]
+			copy(data, buf.Bytes())
+			col2, err := DeserializeBytes(data, test.dtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ChunksEqual(col, col2) {
+				t.Errorf("expecting %v (%v, shifted by %v) to deserialise as %+v, got %+v", test.vals, test.dtype, shift, col, col2)
+			}
+			if len(test.vals) == 0 {
+				continue
+			}
+			if _, err := DeserializeBytes(data[:len(data)-1], test.dtype); err == nil {
+				t.Errorf("expecting truncated %v (%v) not to deserialise", test.vals, test.dtype)
+			}
+		}
+	}
+}
+
+func TestZeroCopyAliasing(t *testing.T) {
+	col := NewChunkIntsFromSlice([]int64{1, 2, 3}, nil)
+	buf := new(bytes.Buffer)
+	if _, err := col.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	// trailing data must not get overwritten by appends
+	data := append(buf.Bytes(), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	col2, err := DeserializeBytes(data, DtypeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nativeLittleEndian && uintptr(unsafe.Pointer(&col2.storage.ints[0]))%8 == 0 {
+		start := uintptr(unsafe.Pointer(&data[0]))
+		if ptr := uintptr(unsafe.Pointer(&col2.storage.ints[0])); ptr < start || ptr >= start+uintptr(len(data)) {
+			t.Error("expecting aligned values not to be copied")
+		}
+	}
+	if err := col2.Append(NewChunkIntsFromSlice([]int64{4}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[len(data)-8:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("expecting appends not to overwrite the underlying buffer, got %v", data[len(data)-8:])
+	}
+	if !ChunksEqual(col2, NewChunkIntsFromSlice([]int64{1, 2, 3, 4}, nil)) {
+		t.Errorf("unexpected chunk after an append: %+v", col2)
+	}
+}
+
+func BenchmarkDeserialisingInts(b *testing.B) {
+	vals := make([]int64, 100_000)
+	for j := range vals {
+		vals[j] = int64(j)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := NewChunkIntsFromSlice(vals, nil).WriteTo(buf); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+
+	b.Run("reader", func(b *testing.B) {
+		for j := 0; j < b.N; j++ {
+			if _, err := Deserialize(bytes.NewReader(data), DtypeInt); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("zero-copy", func(b *testing.B) {
+		for j := 0; j < b.N; j++ {
+			if _, err := DeserializeBytes(data, DtypeInt); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
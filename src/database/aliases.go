@@ -0,0 +1,151 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidAlias = errs.New(errs.ErrBadRequest, "invalid alias")
+var errAliasNotFound = errs.New(errs.ErrNotFound, "alias not found")
+
+// Alias is a stable name for a dataset, queries can refer to it just like to a dataset (e.g.
+// `SELECT * FROM orders`). It either follows the latest version of a dataset (if no version is
+// given) or it's pinned to a specific version, so that scripts using it don't break (or change
+// results) when the dataset gets re-uploaded.
+// ARCH: pinned versions may still get removed (e.g. by retention), the alias then fails to resolve
+type Alias struct {
+	Name    string `json:"name"`
+	Dataset string `json:"dataset"` // qualified name, see QualifiedName
+	Version string `json:"version,omitempty"`
+}
+
+func (db *Database) aliasesPath() string {
+	return filepath.Join(db.Config.WorkingDirectory, "aliases.json")
+}
+
+// Aliases lists all the aliases, ordered by their names
+func (db *Database) Aliases() []Alias {
+	db.Lock()
+	defer db.Unlock()
+	return sortedAliases(db.aliases)
+}
+
+func sortedAliases(aliases map[string]Alias) []Alias {
+	ret := make([]Alias, 0, len(aliases))
+	for _, alias := range aliases {
+		ret = append(ret, alias)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// SetAlias creates an alias or repoints an existing one. Aliases cannot take names of existing
+// datasets and they need to point to existing datasets (or their versions).
+func (db *Database) SetAlias(alias Alias) error {
+	if alias.Name == "" || cleanupIdentifier(alias.Name, "alias") != alias.Name {
+		return fmt.Errorf("%w: %q is not a valid name", errInvalidAlias, alias.Name)
+	}
+	db.Lock()
+	defer db.Unlock()
+	if _, err := findLatest(db.Datasets, alias.Name); err == nil {
+		return fmt.Errorf("%w: %v is already a dataset", errInvalidAlias, alias.Name)
+	}
+	var err error
+	if alias.Version == "" {
+		_, err = findLatest(db.Datasets, alias.Dataset)
+	} else {
+		_, err = findVersion(db.Datasets, alias.Dataset, alias.Version)
+	}
+	if err != nil {
+		return err
+	}
+	previous, existed := db.aliases[alias.Name]
+	db.aliases[alias.Name] = alias
+	if err := db.writeAliases(); err != nil {
+		if existed {
+			db.aliases[alias.Name] = previous
+		} else {
+			delete(db.aliases, alias.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveAlias removes an alias, the dataset it points to is not affected
+func (db *Database) RemoveAlias(name string) error {
+	db.Lock()
+	defer db.Unlock()
+	alias, ok := db.aliases[name]
+	if !ok {
+		return fmt.Errorf("%w: %v", errAliasNotFound, name)
+	}
+	delete(db.aliases, name)
+	if err := db.writeAliases(); err != nil {
+		db.aliases[name] = alias
+		return err
+	}
+	return nil
+}
+
+// writeAliases persists all the aliases, it needs to be called with the database locked
+func (db *Database) writeAliases() error {
+	if db.inMemory {
+		return nil
+	}
+	data, err := json.Marshal(sortedAliases(db.aliases))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(db.aliasesPath(), data, os.ModePerm)
+}
+
+func (db *Database) readAliases() error {
+	data, err := os.ReadFile(db.aliasesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var aliases []Alias
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		db.aliases[alias.Name] = alias
+	}
+	return nil
+}
+
+// lookupDataset finds a dataset by its name and version (or its latest version), names that don't
+// belong to any dataset may be aliases - datasets take precedence, in case one gets created with
+// an alias' name
+func lookupDataset(datasets []*Dataset, aliases map[string]Alias, name, version string, latest bool) (*Dataset, error) {
+	if !latest {
+		return findVersion(datasets, name, version)
+	}
+	ds, err := findLatest(datasets, name)
+	if !errors.Is(err, errDatasetNotFound) {
+		return ds, err
+	}
+	alias, ok := aliases[name]
+	if !ok {
+		return nil, err
+	}
+	if alias.Version == "" {
+		ds, err = findLatest(datasets, alias.Dataset)
+	} else {
+		ds, err = findVersion(datasets, alias.Dataset, alias.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve alias %v: %w", name, err)
+	}
+	return ds, nil
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+func TestAliases(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var versions []*Dataset
+	for _, raw := range []string{"a\n1", "a\n1\n2"} {
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, ds)
+	}
+
+	failures := []struct {
+		alias Alias
+		err   error
+	}{
+		{Alias{Name: "", Dataset: "foo"}, errs.ErrBadRequest},
+		{Alias{Name: "Foo bar", Dataset: "foo"}, errs.ErrBadRequest},
+		{Alias{Name: "foo", Dataset: "foo"}, errs.ErrBadRequest},
+		{Alias{Name: "bar", Dataset: "baz"}, errs.ErrNotFound},
+		{Alias{Name: "bar", Dataset: "foo", Version: versions[0].ID.String() + "0"}, errs.ErrNotFound},
+	}
+	for _, test := range failures {
+		if err := db.SetAlias(test.alias); !errors.Is(err, test.err) {
+			t.Errorf("expecting alias %+v to fail with %v, got %v", test.alias, test.err, err)
+		}
+	}
+
+	pinned := Alias{Name: "first_foo", Dataset: "foo", Version: versions[0].ID.String()}
+	following := Alias{Name: "current_foo", Dataset: "foo"}
+	for _, alias := range []Alias{pinned, following} {
+		if err := db.SetAlias(alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolved := func(db *Database, name string) *Dataset {
+		ds, err := db.ResolveDataset(name, "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	}
+	if ds := resolved(db, "first_foo"); ds != versions[0] {
+		t.Errorf("expecting a pinned alias to resolve into its version, got %v", ds.ID)
+	}
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	// new versions only affect aliases following the latest version
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolved(db, "current_foo"); got != ds {
+		t.Errorf("expecting an alias to follow the latest version, got %v", got.ID)
+	}
+	if got := resolved(db, "first_foo"); got != versions[0] {
+		t.Errorf("expecting a pinned alias to stay pinned, got %v", got.ID)
+	}
+	if got, err := snap.GetDataset("current_foo", "", true); err != nil || got != versions[1] {
+		t.Errorf("expecting snapshots to resolve aliases as of their creation, got %v (%v)", got, err)
+	}
+	// aliases don't get resolved outside of queries, nor for specific versions
+	if _, err := db.GetDataset("first_foo", "", true); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expecting aliases not to be resolved by GetDataset, got %v", err)
+	}
+	if _, err := db.ResolveDataset("first_foo", versions[0].ID.String(), false); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expecting aliases not to have versions, got %v", err)
+	}
+
+	// aliases get persisted
+	db2, err := NewDatabase(db.Config.WorkingDirectory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliases := db2.Aliases(); !reflect.DeepEqual(aliases, []Alias{following, pinned}) {
+		t.Errorf("expecting aliases to be persisted, got %+v", aliases)
+	}
+	if got := resolved(db2, "first_foo"); got.ID != versions[0].ID {
+		t.Errorf("expecting a persisted alias to resolve the same way, got %v", got.ID)
+	}
+
+	if err := db.RemoveAlias("first_foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveAlias("first_foo"); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expecting a removed alias not to be found, got %v", err)
+	}
+	// pinned versions may disappear
+	if err := db.SetAlias(pinned); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropDataset("foo", versions[0].ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResolveDataset("first_foo", "", true); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expecting aliases of dropped versions not to resolve, got %v", err)
+	}
+	if aliases := db.Aliases(); len(aliases) != 2 {
+		t.Errorf("expecting aliases to remain after their datasets get dropped, got %+v", aliases)
+	}
+}
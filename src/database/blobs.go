@@ -0,0 +1,274 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+var errBlobHashMismatch = errors.New("stripe contents do not match their hash")
+
+// Stripes are content addressed - they are stored under the hash of their contents (see
+// Stripe.Hash), so identical stripes within a namespace (e.g. the same data uploaded twice or
+// compactions that don't change anything) are only stored once. Stored stripes are reference
+// counted, they only get removed once no dataset refers to them.
+// ARCH: stripes written before we hashed them are stored with their datasets (see stripeKey),
+// they are reference counted all the same
+const blobDir = "blobs"
+
+// blobKey locates a content addressed stripe, these are only shared within namespaces, so that
+// each namespace's data are stored separately
+func blobKey(namespace, hash string) string {
+	return path.Join(namespace, blobDir, hash)
+}
+
+// blobRef tracks a single stored stripe (by its storage key)
+type blobRef struct {
+	refs   int
+	stored bool
+	// closed once an ongoing write or removal of this stripe finishes, nil if there's none
+	busy chan struct{}
+}
+
+// blobRefs counts references to stored stripes, both by datasets in our database (or those removed
+// while there were open snapshots, see Snapshot) and by datasets that are yet to be added to it,
+// these are pending until they get added (see AddDataset) or their stripes removed (see removeStripes)
+// ARCH: datasets pending forever (e.g. due to errors not followed by cleanups) keep their stripes
+// from being removed until a restart, mind that this errs on the side of retaining data
+type blobRefs struct {
+	refs    map[string]*blobRef
+	pending map[UID][]string
+}
+
+func newBlobRefs() *blobRefs {
+	return &blobRefs{
+		refs:    make(map[string]*blobRef),
+		pending: make(map[UID][]string),
+	}
+}
+
+// storedKeys lists storage keys of all the stripes of a dataset that we store ourselves
+func storedKeys(ds *Dataset) []string {
+	if ds.External != nil || ds.memory != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(ds.Stripes))
+	for _, stripe := range ds.Stripes {
+		if stripe.Source == nil {
+			keys = append(keys, stripeKey(ds, stripe))
+		}
+	}
+	return keys
+}
+
+// reference records references of given datasets (their stripes are already stored), any stripes
+// pending for them are no longer pending, this needs to be called with the database locked
+func (br *blobRefs) reference(datasets ...*Dataset) []string {
+	var orphaned []string
+	for _, ds := range datasets {
+		for _, key := range storedKeys(ds) {
+			ref, ok := br.refs[key]
+			if !ok {
+				ref = &blobRef{stored: true}
+				br.refs[key] = ref
+			}
+			ref.refs++
+		}
+		// all the stripes written for a dataset should be in it by now, but there's no harm in checking
+		orphaned = append(orphaned, br.unreference(br.pending[ds.ID])...)
+		delete(br.pending, ds.ID)
+	}
+	return orphaned
+}
+
+// unreference drops a reference for each of the given keys, it returns keys of stripes no longer
+// referenced, these get marked as busy until they are removed (see Database.removeBlobs), this
+// needs to be called with the database locked
+func (br *blobRefs) unreference(keys []string) []string {
+	var orphaned []string
+	for _, key := range keys {
+		ref, ok := br.refs[key]
+		if !ok {
+			continue
+		}
+		ref.refs--
+		if ref.refs > 0 || ref.busy != nil {
+			continue
+		}
+		if !ref.stored {
+			delete(br.refs, key)
+			continue
+		}
+		ref.stored = false
+		ref.busy = make(chan struct{})
+		orphaned = append(orphaned, key)
+	}
+	return orphaned
+}
+
+// dropPending removes given keys from those pending for a dataset, it returns those that were
+// pending (each key only once per its occurrence), this needs to be called with the database locked
+func (br *blobRefs) dropPending(ds *Dataset, keys []string) []string {
+	pending := br.pending[ds.ID]
+	var dropped []string
+	for _, key := range keys {
+		for j, pkey := range pending {
+			if pkey == key {
+				pending = append(pending[:j], pending[j+1:]...)
+				dropped = append(dropped, key)
+				break
+			}
+		}
+	}
+	if len(pending) == 0 {
+		delete(br.pending, ds.ID)
+	} else {
+		br.pending[ds.ID] = pending
+	}
+	return dropped
+}
+
+// removeBlobs removes stripes no longer referenced (see blobRefs.unreference), stripes referenced
+// again in the meantime get written anew
+func (db *Database) removeBlobs(keys []string) error {
+	var err error
+	for _, key := range keys {
+		rerr := db.storage.remove(key)
+		db.Lock()
+		ref := db.blobs.refs[key]
+		close(ref.busy)
+		ref.busy = nil
+		if rerr != nil {
+			// we don't know what state the stripe is in, so it doesn't count as stored
+			ref.stored = false
+		}
+		if ref.refs == 0 {
+			delete(db.blobs.refs, key)
+		}
+		db.Unlock()
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// storeBlob stores a stripe under the hash of its contents, unless we already have the very same
+// stripe stored, it returns the hash. The stripe is pending for a given dataset until it gets added
+// to our database (or until its stripes get removed, see blobRefs).
+func (db *Database) storeBlob(ds *Dataset, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	key := blobKey(ds.Namespace, hash)
+	for {
+		db.Lock()
+		// we can only tell if a stripe is stored once we know of all the references to it
+		if err := db.hydrateAll(); err != nil {
+			db.Unlock()
+			return "", err
+		}
+		ref, ok := db.blobs.refs[key]
+		if !ok {
+			ref = &blobRef{}
+			db.blobs.refs[key] = ref
+		}
+		// there can only be one write or removal of a given stripe at a time, we need to wait for it
+		if busy := ref.busy; busy != nil {
+			db.Unlock()
+			<-busy
+			continue
+		}
+		ref.refs++
+		db.blobs.pending[ds.ID] = append(db.blobs.pending[ds.ID], key)
+		if ref.stored {
+			db.Unlock()
+			return hash, nil
+		}
+		ref.busy = make(chan struct{})
+		db.Unlock()
+
+		err := db.writeBlob(key, data)
+		db.Lock()
+		close(ref.busy)
+		ref.busy = nil
+		if err != nil {
+			db.blobs.dropPending(ds, []string{key})
+			ref.refs--
+			if ref.refs == 0 {
+				delete(db.blobs.refs, key)
+			}
+			db.Unlock()
+			return "", err
+		}
+		ref.stored = true
+		db.Unlock()
+		return hash, nil
+	}
+}
+
+func (db *Database) writeBlob(key string, data []byte) error {
+	w, err := db.storage.create(key)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		db.storage.remove(key)
+		return err
+	}
+	// closing is what persists data in some storage backends, so we cannot just defer it
+	if err := w.Close(); err != nil {
+		db.storage.remove(key)
+		return err
+	}
+	return nil
+}
+
+// blobWriter buffers a stripe as it's being written, it only gets stored once closed (see
+// storeBlob), because we need all of its contents to know where to store it, so we don't need to
+// clean up after a writer that doesn't get closed
+// OPTIM: this holds whole stripes in memory, which we used to stream into our storage
+type blobWriter struct {
+	db   *Database
+	ds   *Dataset
+	buf  bytes.Buffer
+	hash string // known once closed
+}
+
+func (db *Database) newBlobWriter(ds *Dataset) *blobWriter {
+	return &blobWriter{db: db, ds: ds}
+}
+
+func (bw *blobWriter) Write(p []byte) (int, error) {
+	return bw.buf.Write(p)
+}
+
+func (bw *blobWriter) Close() error {
+	hash, err := bw.db.storeBlob(bw.ds, bw.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	bw.hash = hash
+	return nil
+}
+
+// verifyHash checks the contents of a content addressed stripe against its hash
+func (db *Database) verifyHash(ds *Dataset, stripe Stripe) error {
+	obj, err := db.storage.open(stripeKey(ds, stripe))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(obj, 0, stripeSize(stripe))); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != stripe.Hash {
+		return fmt.Errorf("%w: expecting %v, got %v", errBlobHashMismatch, stripe.Hash, got)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestContentAddressedStripes(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	countBlobs := func() int {
+		entries, err := os.ReadDir(filepath.Join(db.dataPath(), blobDir))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	// the same data loaded twice (or loaded as parts of others) share their stripes
+	var datasets []*Dataset
+	for _, raw := range []string{"a,b\n1,x\n2,y\n3,z", "a,b\n1,x\n2,y\n3,z", "a,b\n1,x\n2,y\n4,w"} {
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		datasets = append(datasets, ds)
+	}
+	for _, ds := range datasets {
+		if len(ds.Stripes) != 2 || ds.Stripes[0].Hash != datasets[0].Stripes[0].Hash {
+			t.Fatalf("expecting identical stripes to have the same hash, got %+v", ds.Stripes)
+		}
+	}
+	if datasets[2].Stripes[1].Hash == datasets[0].Stripes[1].Hash {
+		t.Error("not expecting different stripes to have the same hash")
+	}
+	if n := countBlobs(); n != 3 {
+		t.Fatalf("expecting three distinct stripes to be stored, got %v", n)
+	}
+	usage, err := db.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Datasets[1].SharedStripes != 2 || usage.Datasets[2].SharedStripes != 1 {
+		t.Errorf("expecting identical stripes to be counted once, got %+v", usage.Datasets)
+	}
+
+	// references get counted anew upon startup
+	db, err = NewDatabase(db.Config.WorkingDirectory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropDataset("foo", datasets[0].ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(); n != 3 {
+		t.Errorf("expecting stripes referenced by other datasets to be retained, got %v stripes", n)
+	}
+	if err := db.DropDataset("foo", datasets[1].ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(); n != 2 {
+		t.Errorf("expecting only stripes of our last dataset to be retained, got %v stripes", n)
+	}
+
+	// failed loads only remove stripes no one else refers to
+	hints := SchemaHints{"a": {Dtype: column.DtypeInt}}
+	if _, err := db.LoadDatasetFromReaderAutoWithOptions("foo", strings.NewReader("a,b\n1,x\n2,y\nfoo,bar"), LoadOptions{SchemaHints: hints}); !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("expecting invalid data to fail loading, got %v", err)
+	}
+	if n := countBlobs(); n != 2 {
+		t.Errorf("expecting a failed load to retain shared stripes, got %v stripes", n)
+	}
+	if errs := db.Fsck(); len(errs) > 0 {
+		t.Errorf("expecting our remaining dataset to be intact, got %v", errs)
+	}
+
+	if err := db.DropDataset("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(); n != 0 {
+		t.Errorf("expecting all the stripes to be removed, got %v", n)
+	}
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/kokes/smda/src/bloom"
+	"github.com/kokes/smda/src/column"
+)
+
+// columns with few distinct values (relative to their length) tend to contain the same values in
+// all stripes, so their bloom filters would rarely let us skip any stripes
+const bloomMinDistinctRatio = 0.1
+
+// newBloomFilter builds a bloom filter for a given column, it returns nil for columns that don't get
+// them (types other than ints and strings, low cardinality data)
+// OPTIM: we hash all the values twice, first to count them, then to build the filter
+func newBloomFilter(col *column.Chunk) *bloom.Filter {
+	if col.Dtype() != column.DtypeInt && col.Dtype() != column.DtypeString {
+		return nil
+	}
+	distinct := make(map[uint64]struct{})
+	nonNull := 0
+	for j := 0; j < col.Len(); j++ {
+		hash, ok := col.StableHash(j)
+		if !ok {
+			continue
+		}
+		nonNull++
+		distinct[hash] = struct{}{}
+	}
+	if nonNull == 0 || float64(len(distinct)) < bloomMinDistinctRatio*float64(nonNull) {
+		return nil
+	}
+	filter := bloom.NewFilter(len(distinct))
+	for hash := range distinct {
+		filter.Add(hash)
+	}
+	return filter
+}
+
+// writeBloomFilters writes serialised bloom filters (nil for columns without one) after a stripe's columns,
+// each filter is preceded by its checksum. It returns the number of bytes written and the filters'
+// offsets (see Stripe.Blooms), which are nil if there are no filters at all.
+func writeBloomFilters(w io.Writer, start uint32, filters [][]byte) (int64, []uint32, error) {
+	offsets := make([]uint32, 0, len(filters)+1)
+	offsets = append(offsets, start)
+	offset, found := start, false
+	for _, filter := range filters {
+		if filter != nil {
+			found = true
+			if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(filter)); err != nil {
+				return 0, nil, err
+			}
+			if _, err := w.Write(filter); err != nil {
+				return 0, nil, err
+			}
+			offset += 4 + uint32(len(filter))
+		}
+		offsets = append(offsets, offset)
+	}
+	if !found {
+		return 0, nil, nil
+	}
+	return int64(offset - start), offsets, nil
+}
+
+// readBloomFilter reads a column's serialised bloom filter (nil if it doesn't have one)
+func (sr *StripeReader) readBloomFilter(nthColumn int) ([]byte, error) {
+	if sr.blooms == nil || sr.blooms[nthColumn] == sr.blooms[nthColumn+1] {
+		return nil, nil
+	}
+	offsetStart, offsetEnd := sr.blooms[nthColumn], sr.blooms[nthColumn+1]
+	length := int(offsetEnd) - int(offsetStart)
+	if length < 5 {
+		return nil, sr.columnError(nthColumn, fmt.Errorf("%w: bloom filter", errInvalidOffsetData))
+	}
+	raw := make([]byte, length)
+	if n, err := sr.f.ReadAt(raw, int64(offsetStart)); err != nil && !(err == io.EOF && n == length) {
+		return nil, sr.columnError(nthColumn, err)
+	}
+	sr.bytesRead += length
+	if binary.LittleEndian.Uint32(raw[:4]) != crc32.ChecksumIEEE(raw[4:]) {
+		return nil, sr.columnError(nthColumn, fmt.Errorf("%w: bloom filter", errIncorrectChecksum))
+	}
+	return raw[4:], nil
+}
+
+// ReadBloomFilter reads a bloom filter of a given column (nil if there isn't one) and reports
+// the number of bytes read. Filters are built from values as they were written, so stripes that
+// predate a type widening don't have filters compatible with the current type (we return nil).
+func (db *Database) ReadBloomFilter(ds *Dataset, stripe Stripe, name string) (*bloom.Filter, int, error) {
+	idx, col, err := ds.Schema.LocateColumn(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if stripe.Blooms == nil || stripe.Blooms[idx] == stripe.Blooms[idx+1] {
+		return nil, 0, nil
+	}
+	if stripe.Dtypes != nil && stripe.Dtypes[idx] != col.Dtype {
+		return nil, 0, nil
+	}
+	sr, err := NewStripeReader(db, ds, stripe)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer sr.Close()
+	raw, err := sr.readBloomFilter(idx)
+	if err != nil {
+		return nil, 0, err
+	}
+	filter, err := bloom.FromBytes(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	return filter, sr.bytesRead, nil
+}
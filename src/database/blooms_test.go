@@ -0,0 +1,122 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestBloomFilters(t *testing.T) {
+	db, err := NewDatabase("", &Config{BloomFilters: true, MaxRowsPerStripe: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var raw strings.Builder
+	raw.WriteString("id,user,country,score\n")
+	for j := 0; j < 300; j++ {
+		fmt.Fprintf(&raw, "%v,user_%v,%v,%v.5\n", j, j, []string{"cz", "sk"}[j%2], j)
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("events", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.Stripes) != 3 {
+		t.Fatalf("expecting three stripes, got %v", len(ds.Stripes))
+	}
+	lookup := func(ds *Dataset, stripe Stripe, name string, value *column.Chunk) (bool, bool) {
+		filter, _, err := db.ReadBloomFilter(ds, stripe, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filter == nil {
+			return false, false
+		}
+		hash, _ := value.StableHash(0)
+		return filter.MayContain(hash), true
+	}
+	for js, stripe := range ds.Stripes {
+		if stripe.Blooms == nil {
+			t.Fatalf("expecting stripe %v to have bloom filters", js)
+		}
+		// each stripe has a hundred consecutive ids
+		for _, id := range []int64{0, 150, 299} {
+			found, ok := lookup(ds, stripe, "id", column.NewChunkLiteralInts(id, 1))
+			if !ok {
+				t.Fatalf("expecting stripe %v to have a filter for ids", js)
+			}
+			if id/100 == int64(js) && !found {
+				t.Errorf("expecting stripe %v to contain id %v", js, id)
+			}
+		}
+		user := column.NewChunk(column.DtypeString)
+		if err := user.AddValue(fmt.Sprintf("user_%v", 100*js+1)); err != nil {
+			t.Fatal(err)
+		}
+		if found, ok := lookup(ds, stripe, "user", user); !ok || !found {
+			t.Errorf("expecting stripe %v to contain its users", js)
+		}
+		// low cardinality columns and floats don't get filters
+		for _, name := range []string{"country", "score"} {
+			if _, ok := lookup(ds, stripe, name, nil); ok {
+				t.Errorf("not expecting column %v to have a bloom filter", name)
+			}
+		}
+	}
+
+	// filters of untouched columns survive retyping
+	edited, err := db.EditSchema(ds, []SchemaEdit{{Column: "score", Dtype: column.DtypeString}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := lookup(edited, edited.Stripes[1], "id", column.NewChunkLiteralInts(150, 1)); !ok || !found {
+		t.Errorf("expecting retyped datasets to retain bloom filters")
+	}
+	score := column.NewChunk(column.DtypeString)
+	if err := score.AddValue("150.5"); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := lookup(edited, edited.Stripes[1], "score", score); !ok || !found {
+		t.Errorf("expecting retyped columns to get bloom filters")
+	}
+	cols, _, err := db.ReadColumnsFromStripeByNames(edited, edited.Stripes[2], []string{"id", "score"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols["id"].Len() != 100 || cols["score"].Dtype() != column.DtypeString {
+		t.Errorf("unexpected data in a retyped stripe: %v", cols)
+	}
+}
+
+func TestBloomFiltersDisabled(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("id\n1\n2\n3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Stripes[0].Blooms != nil {
+		t.Errorf("not expecting bloom filters by default, got %v", ds.Stripes[0].Blooms)
+	}
+	filter, _, err := db.ReadBloomFilter(ds, ds.Stripes[0], "id")
+	if err != nil || filter != nil {
+		t.Errorf("expecting no filter to be read, got %v (%v)", filter, err)
+	}
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidBundle = errs.New(errs.ErrBadRequest, "invalid dataset bundle")
+var errDatasetExists = errs.New(errs.ErrBadRequest, "dataset version already exists")
+
+// Bundles are tar archives containing a dataset version's manifest (as the first entry) followed by
+// all of its stripes, as they are stored. They are self-contained - stripes shared with other
+// versions (see AppendToDataset) get bundled as well - so that datasets can be moved between
+// databases (and storage backends).
+const (
+	bundleManifest  = "manifest.json"
+	bundleStripeDir = "stripes"
+)
+
+// ExportDataset bundles a given dataset version (see ImportDataset), the bundle gets written as
+// it's being read, errors (e.g. missing stripes) are reported by the reader
+func (db *Database) ExportDataset(ds *Dataset) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.writeBundle(pw, ds))
+	}()
+	return pr
+}
+
+func (db *Database) writeBundle(w io.Writer, ds *Dataset) error {
+	if ds.External != nil {
+		return errExternalReadOnly
+	}
+	// the bundle owns all of its stripes, so any references to other versions are dropped
+	manifest := *ds
+	manifest.Stripes = make([]Stripe, len(ds.Stripes))
+	for j, stripe := range ds.Stripes {
+		stripe.Owner = nil
+		manifest.Stripes[j] = stripe
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	modified := time.Unix(0, ds.Created)
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    bundleManifest,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modified,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	for _, stripe := range ds.Stripes {
+		size := stripeSize(stripe)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    path.Join(bundleStripeDir, stripe.Id.String()),
+			Mode:    0644,
+			Size:    size,
+			ModTime: modified,
+		}); err != nil {
+			return err
+		}
+		if err := db.copyStripe(tw, ds, stripe, size); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (db *Database) copyStripe(w io.Writer, ds *Dataset, stripe Stripe, size int64) error {
+	obj, err := db.storage.open(stripeKey(ds, stripe))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	_, err = io.Copy(w, io.NewSectionReader(obj, 0, size))
+	return err
+}
+
+// ImportDataset loads a bundled dataset version (see ExportDataset), it retains its ID, so
+// it cannot be imported into a database that already contains it. All the stripes imported get
+// verified (see Fsck) before the dataset gets added.
+func (db *Database) ImportDataset(r io.Reader) (*Dataset, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidBundle, err)
+	}
+	if hdr.Name != bundleManifest {
+		return nil, fmt.Errorf("%w: expecting %v first, got %v", errInvalidBundle, bundleManifest, hdr.Name)
+	}
+	var ds Dataset
+	if err := json.NewDecoder(tr).Decode(&ds); err != nil {
+		return nil, fmt.Errorf("%w: cannot read manifest: %v", errInvalidBundle, err)
+	}
+	if ds.Name == "" || len(ds.Schema) == 0 {
+		return nil, fmt.Errorf("%w: manifest is missing a name or a schema", errInvalidBundle)
+	}
+	// names end up in paths in our storage, so we don't accept anything we wouldn't have created
+	if ds.Name != cleanupIdentifier(ds.Name, "dataset") || (ds.Namespace != "" && ds.Namespace != cleanupIdentifier(ds.Namespace, "namespace")) {
+		return nil, fmt.Errorf("%w: invalid dataset name %q or namespace %q", errInvalidBundle, ds.Name, ds.Namespace)
+	}
+	if ds.External != nil {
+		return nil, fmt.Errorf("%w: external datasets cannot be bundled", errInvalidBundle)
+	}
+	if _, err := db.GetDatasetByVersion(ds.QualifiedName(), ds.ID.String()); err == nil {
+		return nil, fmt.Errorf("%w: %v@v%v", errDatasetExists, ds.QualifiedName(), ds.ID)
+	}
+
+	// positions of stripes in our manifest, by their names in the bundle
+	expected := make(map[string]int, len(ds.Stripes))
+	for j, stripe := range ds.Stripes {
+		if len(stripe.Offsets) == 0 {
+			return nil, fmt.Errorf("%w: stripe %v has no offsets", errInvalidBundle, stripe.Id)
+		}
+		stripe.Owner = nil
+		ds.Stripes[j] = stripe
+		expected[path.Join(bundleStripeDir, stripe.Id.String())] = j
+	}
+
+	var written []Stripe
+	if err := db.readBundleStripes(tr, &ds, expected, &written); err != nil {
+		db.removeStripes(&ds, written)
+		return nil, err
+	}
+	for _, stripe := range ds.Stripes {
+		if errs := db.fsckStripe(&ds, stripe); len(errs) > 0 {
+			db.removeStripes(&ds, written)
+			return nil, fmt.Errorf("%w: %v", errInvalidBundle, errs[0])
+		}
+	}
+	if err := db.AddDataset(&ds); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+// readBundleStripes writes all the stripes in a bundle into our storage, recording each one in
+// `written`, so that they can be cleaned up if anything fails. Stripes get stored by their hashes
+// (see blobKey), even if they were bundled before we hashed them, bundled hashes need to match.
+func (db *Database) readBundleStripes(tr *tar.Reader, ds *Dataset, expected map[string]int, written *[]Stripe) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidBundle, err)
+		}
+		pos, ok := expected[hdr.Name]
+		if !ok {
+			return fmt.Errorf("%w: unexpected entry %v", errInvalidBundle, hdr.Name)
+		}
+		stripe := ds.Stripes[pos]
+		delete(expected, hdr.Name)
+		if hdr.Size != stripeSize(stripe) {
+			return fmt.Errorf("%w: stripe %v has %v bytes, expecting %v", errInvalidBundle, stripe.Id, hdr.Size, stripeSize(stripe))
+		}
+		w := db.newBlobWriter(ds)
+		if _, err := io.Copy(w, tr); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		hash := stripe.Hash
+		stripe.Hash = w.hash
+		ds.Stripes[pos] = stripe
+		*written = append(*written, stripe)
+		if hash != "" && hash != w.hash {
+			return fmt.Errorf("%w: stripe %v: %v", errInvalidBundle, stripe.Id, errBlobHashMismatch)
+		}
+	}
+	if len(expected) > 0 {
+		return fmt.Errorf("%w: %v stripes missing", errInvalidBundle, len(expected))
+	}
+	return nil
+}
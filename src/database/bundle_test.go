@@ -0,0 +1,222 @@
+package database
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestBundleRoundtrip(t *testing.T) {
+	for _, opts := range [][]Option{nil, {InMemory()}} {
+		src, err := NewDatabase("", &Config{MaxRowsPerStripe: 2}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := src.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		dst, err := NewDatabase("", nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := dst.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := src.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y\n3,z"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		// shares stripes with the original version, these need to get bundled as well
+		appended, err := src.AppendToDataset(ds, strings.NewReader("a,b\n4,w"), WideningNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bundle, err := io.ReadAll(src.ExportDataset(appended))
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, err := dst.ImportDataset(bytes.NewReader(bundle))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported.ID != appended.ID || imported.NRows != 4 || len(imported.Stripes) != 3 {
+			t.Errorf("expecting the imported dataset to match %+v, got %+v", appended, imported)
+		}
+		for _, stripe := range imported.Stripes {
+			if stripe.Owner != nil {
+				t.Errorf("not expecting imported stripes to be owned by other versions, got %v", stripe.Owner)
+			}
+		}
+		if found, err := dst.GetDatasetLatest("foo"); err != nil || found != imported {
+			t.Errorf("expecting the imported dataset to be registered, got %v (%v)", found, err)
+		}
+		if errs := dst.Fsck(); len(errs) > 0 {
+			t.Errorf("expecting imported data to pass a check, got %v", errs)
+		}
+		col := column.NewChunk(column.DtypeString)
+		for _, stripe := range imported.Stripes {
+			cols, _, err := dst.ReadColumnsFromStripeByNames(imported, stripe, []string{"b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := col.Append(cols["b"]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := column.NewChunk(column.DtypeString)
+		if err := expected.AddValues([]string{"x", "y", "z", "w"}); err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(col, expected) {
+			t.Errorf("expecting imported data to be %v, got %v", expected, col)
+		}
+
+		if _, err := dst.ImportDataset(bytes.NewReader(bundle)); !errors.Is(err, errDatasetExists) {
+			t.Errorf("expecting a repeated import to fail with %v, got %v", errDatasetExists, err)
+		}
+	}
+}
+
+func TestInvalidBundles(t *testing.T) {
+	src, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := src.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := src.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := io.ReadAll(src.ExportDataset(ds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// takes the first `n` entries of a valid bundle, optionally mangling stripe data
+	rebundle := func(n int, mangle bool) []byte {
+		var buf bytes.Buffer
+		tr := tar.NewReader(bytes.NewReader(bundle))
+		tw := tar.NewWriter(&buf)
+		for j := 0; j < n; j++ {
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mangle && j > 0 {
+				data[len(data)/2]++
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// replaces the manifest of a valid bundle with one of a renamed dataset
+	renamed := func(namespace, name string) []byte {
+		var buf bytes.Buffer
+		tr := tar.NewReader(bytes.NewReader(bundle))
+		tw := tar.NewWriter(&buf)
+		for j := 0; ; j++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j == 0 {
+				manifest := *ds
+				manifest.Namespace, manifest.Name = namespace, name
+				if data, err = json.Marshal(manifest); err != nil {
+					t.Fatal(err)
+				}
+				hdr.Size = int64(len(data))
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name   string
+		bundle []byte
+	}{
+		{"empty", nil},
+		{"not a tar", []byte("a,b\n1,2")},
+		{"missing stripes", rebundle(1, false)},
+		{"corrupt stripe", rebundle(2, true)},
+		{"traversing namespace", renamed("../../escaped", "foo")},
+		{"traversing name", renamed("", "../foo")},
+		{"uncleaned namespace", renamed("Foo Bar", "foo")},
+	}
+	for _, test := range tests {
+		db, err := NewDatabase(filepath.Join(t.TempDir(), "db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ImportDataset(bytes.NewReader(test.bundle)); !errors.Is(err, errInvalidBundle) {
+			t.Errorf("expecting a bundle (%v) to fail with %v, got %v", test.name, errInvalidBundle, err)
+		}
+		if len(db.Datasets) != 0 {
+			t.Errorf("not expecting an invalid bundle (%v) to add datasets", test.name)
+		}
+		escaped := filepath.Join(db.Config.WorkingDirectory, "..", "..", "escaped")
+		if _, err := os.Stat(escaped); !os.IsNotExist(err) {
+			t.Errorf("not expecting a bundle (%v) to write outside of our working directory", test.name)
+		}
+		if err := db.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	missing := make([]Stripe, len(ds.Stripes))
+	for j, stripe := range ds.Stripes {
+		stripe.Hash = strings.Repeat("0", 64)
+		missing[j] = stripe
+	}
+	if _, err := io.ReadAll(src.ExportDataset(&Dataset{Name: "bar", Schema: ds.Schema, Stripes: missing})); err == nil {
+		t.Error("expecting an export of a dataset with missing stripes to fail")
+	}
+}
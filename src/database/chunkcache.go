@@ -0,0 +1,156 @@
+package database
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/kokes/smda/src/column"
+)
+
+// chunkCache is an LRU cache of deserialised column chunks, so that repeated queries touching the
+// same columns don't have to read (and decompress and deserialise) them again. Dataset versions
+// are immutable and have unique IDs, so cached chunks cannot go stale. We bound the cache by the
+// memory its chunks hold (see column.Chunk.MemoryUsage), not by their count.
+// ARCH: chunks are shared by all their readers, so nobody can modify them in place (we already
+// rely on this in query.Cache)
+type chunkCache struct {
+	sync.Mutex
+	capacity int // in bytes
+	size     int
+	entries  map[chunkKey]*list.Element
+	lru      *list.List // front = most recently used
+	hits     int
+	misses   int
+}
+
+type chunkKey struct {
+	version     UID // the schema of a version determines how we read its stripes (e.g. retyped columns)
+	stripe      UID
+	column      int
+	offsetsOnly bool // see StripeReader.ReadColumnOffsets
+}
+
+type chunkEntry struct {
+	key   chunkKey
+	chunk *column.Chunk
+	size  int
+}
+
+// ChunkCacheStats describe the state of our chunk cache (see Config.ChunkCacheSize)
+type ChunkCacheStats struct {
+	Capacity int `json:"capacity"`
+	Size     int `json:"size"`
+	Entries  int `json:"entries"`
+	Hits     int `json:"hits"`
+	Misses   int `json:"misses"`
+}
+
+// a non-positive capacity disables caching altogether
+func newChunkCache(capacity int) *chunkCache {
+	return &chunkCache{
+		capacity: capacity,
+		entries:  make(map[chunkKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (cc *chunkCache) enabled() bool {
+	if cc == nil {
+		return false
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.capacity > 0
+}
+
+func (cc *chunkCache) get(key chunkKey) (*column.Chunk, bool) {
+	if cc == nil {
+		return nil, false
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.capacity <= 0 {
+		return nil, false
+	}
+	el, ok := cc.entries[key]
+	if !ok {
+		cc.misses++
+		return nil, false
+	}
+	cc.hits++
+	cc.lru.MoveToFront(el)
+	return el.Value.(*chunkEntry).chunk, true
+}
+
+func (cc *chunkCache) put(key chunkKey, chunk *column.Chunk) {
+	if cc == nil {
+		return
+	}
+	size := chunk.MemoryUsage()
+	cc.Lock()
+	defer cc.Unlock()
+	// a single chunk would flush the whole cache
+	if cc.capacity <= 0 || size > cc.capacity/2 {
+		return
+	}
+	// concurrent readers may have read the same chunk
+	if _, ok := cc.entries[key]; ok {
+		return
+	}
+	cc.entries[key] = cc.lru.PushFront(&chunkEntry{key: key, chunk: chunk, size: size})
+	cc.size += size
+	cc.evict()
+}
+
+func (cc *chunkCache) evict() {
+	for cc.size > cc.capacity && cc.lru.Len() > 0 {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+// resize changes the cache's capacity, evicting chunks if it shrinks (see Database.Reload)
+func (cc *chunkCache) resize(capacity int) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.capacity = capacity
+	cc.evict()
+}
+
+func (cc *chunkCache) remove(el *list.Element) {
+	entry := el.Value.(*chunkEntry)
+	cc.lru.Remove(el)
+	delete(cc.entries, entry.key)
+	cc.size -= entry.size
+}
+
+// invalidate removes all cached chunks of a given dataset version, so that removed datasets don't
+// take up space until they get evicted
+func (cc *chunkCache) invalidate(version UID) {
+	if cc == nil {
+		return
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	for key, el := range cc.entries {
+		if key.version == version {
+			cc.remove(el)
+		}
+	}
+}
+
+// ChunkCacheStats reports how well our chunk cache performs
+func (db *Database) ChunkCacheStats() ChunkCacheStats {
+	cc := db.chunks
+	if cc == nil {
+		return ChunkCacheStats{}
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	return ChunkCacheStats{
+		Capacity: cc.capacity,
+		Size:     cc.size,
+		Entries:  cc.lru.Len(),
+		Hits:     cc.hits,
+		Misses:   cc.misses,
+	}
+}
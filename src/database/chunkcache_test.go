@@ -0,0 +1,108 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestChunkCache(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y\n3,z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	stripe := ds.Stripes[0]
+
+	cold, stats, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHits != 0 || stats.CacheMisses != 2 || stats.BytesRead == 0 {
+		t.Errorf("expecting a cold read to miss our cache, got %+v", stats)
+	}
+	// the same columns, one of them read without its contents (these get cached separately)
+	warm, stats, err := db.ReadColumnsFromStripe(ds, stripe, []string{"a", "b", "a"}, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHits != 1 || stats.CacheMisses != 1 {
+		t.Errorf("expecting a warm read to hit our cache once, got %+v", stats)
+	}
+	if warm["a"] != cold["a"] {
+		t.Error("expecting cached chunks to be served")
+	}
+	hot, stats, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHits != 2 || stats.CacheMisses != 0 || stats.BytesRead != 0 {
+		t.Errorf("expecting a hot read not to touch storage, got %+v", stats)
+	}
+	if !column.ChunksEqual(hot["b"], cold["b"]) {
+		t.Error("expecting cached chunks to be intact")
+	}
+	if cs := db.ChunkCacheStats(); cs.Entries != 3 || cs.Hits != 3 || cs.Misses != 3 || cs.Size == 0 {
+		t.Errorf("unexpected cache stats: %+v", cs)
+	}
+
+	if err := db.DropDataset("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cs := db.ChunkCacheStats(); cs.Entries != 0 || cs.Size != 0 {
+		t.Errorf("expecting dropped datasets to be removed from our cache, got %+v", cs)
+	}
+}
+
+func TestChunkCacheBudget(t *testing.T) {
+	chunks := make([]*column.Chunk, 10)
+	for j := range chunks {
+		chunks[j] = column.NewChunk(column.DtypeInt)
+		for k := 0; k < 100; k++ {
+			if err := chunks[j].AddValue("123"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	size := chunks[0].MemoryUsage()
+
+	cc := newChunkCache(3 * size)
+	for j, chunk := range chunks {
+		cc.put(chunkKey{column: j}, chunk)
+	}
+	if cc.lru.Len() != 3 || cc.size > cc.capacity {
+		t.Errorf("expecting our cache to keep within its budget, it holds %v chunks, %v bytes", cc.lru.Len(), cc.size)
+	}
+	// the most recently used chunks are retained
+	for j, chunk := range chunks {
+		got, ok := cc.get(chunkKey{column: j})
+		if ok != (j >= 7) || (ok && got != chunk) {
+			t.Errorf("unexpected cache state for chunk %v: %v", j, ok)
+		}
+	}
+
+	// chunks taking up more than half the budget are not worth caching
+	small := newChunkCache(size)
+	small.put(chunkKey{}, chunks[0])
+	if _, ok := small.get(chunkKey{}); ok {
+		t.Error("not expecting large chunks to get cached")
+	}
+
+	disabled := newChunkCache(-1)
+	disabled.put(chunkKey{}, chunks[0])
+	if _, ok := disabled.get(chunkKey{}); ok || disabled.misses != 0 {
+		t.Error("not expecting a disabled cache to cache anything")
+	}
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidCompactOptions = errs.New(errs.ErrBadRequest, "invalid compaction options")
+
+// CompactOptions determine the size of stripes written by Compact, zero values fall back to
+// the database's defaults (Config.MaxRowsPerStripe and Config.MaxBytesPerStripe)
+type CompactOptions struct {
+	MaxRows  int `json:"max_rows,omitempty"`
+	MaxBytes int `json:"max_bytes,omitempty"`
+}
+
+// Compact creates (and adds to our database) a new version of a dataset with all its data rewritten
+// into stripes of a target size. This is useful for datasets built up by many small appends, their
+// stripes tend to be tiny, which makes scanning them inefficient. Rows keep their order, so do
+// the dataset's metadata (schema, sort key, stats).
+// ARCH: the target size in bytes is based on the in-memory size of decoded columns, not on the size
+// of raw data (as is the case when loading data), so compacted stripes may differ in size from
+// those of freshly loaded data
+func (db *Database) Compact(ds *Dataset, opts CompactOptions) (*Dataset, error) {
+	if ds.External != nil {
+		return nil, errExternalReadOnly
+	}
+	if opts.MaxRows < 0 || opts.MaxBytes < 0 {
+		return nil, fmt.Errorf("%w: stripe sizes cannot be negative", errInvalidCompactOptions)
+	}
+	maxRows, maxBytes := db.stripeLimits()
+	if opts.MaxRows == 0 {
+		opts.MaxRows = maxRows
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = maxBytes
+	}
+
+	compacted := NewDatasetInNamespace(ds.Namespace, ds.Name)
+	compacted.Schema = ds.Schema
+	compacted.NRows = ds.NRows
+	compacted.SizeRaw = ds.SizeRaw
+	compacted.FloatPolicy = ds.FloatPolicy
+	compacted.SortKey = ds.SortKey
+	compacted.Stats = ds.Stats
+	compacted.Stripes = make([]Stripe, 0)
+
+	// rows get accumulated until there's enough of them to fill a stripe, the number of rows that
+	// fit our byte limit is estimated from the size of all the data read so far
+	var pending []*column.Chunk
+	var bytesRead, rowsRead int
+	for _, stripe := range ds.Stripes {
+		columns, err := db.readStripe(ds, stripe)
+		if err != nil {
+			db.removeStripes(compacted, compacted.Stripes)
+			return nil, err
+		}
+		rowsRead += stripe.Length
+		for _, col := range columns {
+			bytesRead += col.MemoryUsage()
+		}
+		if pending == nil {
+			pending = columns
+		} else {
+			for j, col := range columns {
+				if err := pending[j].Append(col); err != nil {
+					db.removeStripes(compacted, compacted.Stripes)
+					return nil, err
+				}
+			}
+		}
+
+		target := opts.MaxRows
+		if rowsRead > 0 && bytesRead >= rowsRead {
+			if byBytes := opts.MaxBytes / (bytesRead / rowsRead); byBytes < target {
+				target = byBytes
+			}
+		}
+		if target < 1 {
+			target = 1
+		}
+		for pending[0].Len() >= target {
+			if pending, err = db.writeCompactedStripe(compacted, pending, target); err != nil {
+				db.removeStripes(compacted, compacted.Stripes)
+				return nil, err
+			}
+		}
+	}
+	if len(pending) > 0 && pending[0].Len() > 0 {
+		if _, err := db.writeCompactedStripe(compacted, pending, pending[0].Len()); err != nil {
+			db.removeStripes(compacted, compacted.Stripes)
+			return nil, err
+		}
+	}
+
+	if err := db.AddDataset(compacted); err != nil {
+		return nil, err
+	}
+	return compacted, nil
+}
+
+// readStripe reads all the columns of a given stripe
+func (db *Database) readStripe(ds *Dataset, stripe Stripe) ([]*column.Chunk, error) {
+	sr, err := NewStripeReader(db, ds, stripe)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+	columns := make([]*column.Chunk, len(ds.Schema))
+	for j := range ds.Schema {
+		chunk, err := sr.ReadColumn(j)
+		if err != nil {
+			return nil, err
+		}
+		// compacted stripes get appended to, which literals don't support
+		columns[j] = plainChunk(chunk)
+	}
+	return columns, nil
+}
+
+// writeCompactedStripe writes the first `length` rows of given columns as a new stripe of a dataset,
+// it returns the remaining rows
+func (db *Database) writeCompactedStripe(ds *Dataset, columns []*column.Chunk, length int) ([]*column.Chunk, error) {
+	nrows := columns[0].Len()
+	head, tail := make([]int, length), make([]int, nrows-length)
+	for j := range head {
+		head[j] = j
+	}
+	for j := range tail {
+		tail[j] = length + j
+	}
+	stripe := newDataStripe()
+	stripe.meta.Length = length
+	rest := make([]*column.Chunk, 0, len(columns))
+	for _, col := range columns {
+		stripe.columns = append(stripe.columns, col.Reorder(head))
+		rest = append(rest, col.Reorder(tail))
+	}
+	nbytes, err := db.writeStripeToFile(ds, stripe, db.writeCompression)
+	if err != nil {
+		return nil, err
+	}
+	ds.Stripes = append(ds.Stripes, stripe.meta)
+	ds.SizeOnDisk += nbytes
+	return rest, nil
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestCompactingDatasets(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	// many small appends result in many tiny stripes, one of which got widened along the way
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y\n3,z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	for j := 4; j < 10; j++ {
+		ds, err = db.AppendToDataset(ds, strings.NewReader(fmt.Sprintf("a,b\n%v.5,w", j)), WideningAllowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ds.Stripes) != 8 {
+		t.Fatalf("expecting data to be in 8 stripes, got %v", len(ds.Stripes))
+	}
+
+	tests := []struct {
+		opts    CompactOptions
+		lengths []int
+	}{
+		{CompactOptions{}, []int{2, 2, 2, 2, 1}},
+		{CompactOptions{MaxRows: 4}, []int{4, 4, 1}},
+		{CompactOptions{MaxRows: 100}, []int{9}},
+		// each row takes up about 16 bytes in memory (8 for a float, 4 for a string offset, one
+		// for the string itself, plus some overhead), so only a few fit in a stripe
+		{CompactOptions{MaxRows: 100, MaxBytes: 60}, []int{3, 3, 3}},
+	}
+	for _, test := range tests {
+		compacted, err := db.Compact(ds, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths := make([]int, 0, len(compacted.Stripes))
+		for _, stripe := range compacted.Stripes {
+			lengths = append(lengths, stripe.Length)
+			if stripe.Owner != nil || stripe.Dtypes != nil {
+				t.Errorf("expecting compacted stripes to be owned by their dataset and be of its types, got %+v", stripe)
+			}
+		}
+		if fmt.Sprint(lengths) != fmt.Sprint(test.lengths) {
+			t.Errorf("expecting compaction with %+v to result in stripes of lengths %v, got %v", test.opts, test.lengths, lengths)
+		}
+		if compacted.NRows != ds.NRows || compacted.ID == ds.ID {
+			t.Errorf("expecting a new version with %v rows, got %v rows", ds.NRows, compacted.NRows)
+		}
+		latest, err := db.GetDatasetLatest("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest != compacted {
+			t.Errorf("expecting the compacted dataset to be the latest version")
+		}
+
+		// data stay the same, including their order
+		var values []*column.Chunk
+		for _, stripe := range compacted.Stripes {
+			cols, _, err := db.ReadColumnsFromStripeByNames(compacted, stripe, []string{"a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, cols["a"])
+		}
+		for _, chunk := range values[1:] {
+			if err := values[0].Append(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := column.NewChunk(column.DtypeFloat)
+		if err := expected.AddValues([]string{"1", "2", "3", "4.5", "5.5", "6.5", "7.5", "8.5", "9.5"}); err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(values[0], expected) {
+			t.Errorf("expecting compacted data to be %v, got %v", expected, values[0])
+		}
+	}
+
+	if _, err := db.Compact(ds, CompactOptions{MaxRows: -1}); !errors.Is(err, errInvalidCompactOptions) {
+		t.Errorf("expecting negative stripe sizes to fail with %v, got %v", errInvalidCompactOptions, err)
+	}
+}
+
+func TestCompactingConstantColumns(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 100}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var raw strings.Builder
+	raw.WriteString("id,label\n")
+	for j := 0; j < 300; j++ {
+		fmt.Fprintf(&raw, "%v,constant\n", j)
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// constant columns get read as literals, these need to be hydrated to be compacted
+	compacted, err := db.Compact(ds, CompactOptions{MaxRows: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compacted.Stripes) != 1 || compacted.Stripes[0].Length != 300 {
+		t.Fatalf("expecting a single stripe of 300 rows, got %+v", compacted.Stripes)
+	}
+	cols, _, err := db.ReadColumnsFromStripeByNames(compacted, compacted.Stripes[0], []string{"label"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label := cols["label"]; !label.IsLiteral || label.Len() != 300 {
+		t.Errorf("expecting a constant column to be compacted into a single run of 300 rows, got %+v", label)
+	}
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errNoExpressions = errs.New(errs.ErrInternal, "computed columns are not supported without the query package")
+
+// ComputeFunc evaluates a computed column in a stripe, given the stripe's other columns (keyed by
+// their names) and its length
+type ComputeFunc func(columns map[string]*column.Chunk, length int) (*column.Chunk, error)
+
+// ExpressionCompiler compiles an expression of a computed column (see ColumnHint.Expression),
+// it returns the resulting column's type and nullability along with a way to evaluate it
+type ExpressionCompiler func(expression string, schema column.TableSchema) (column.Schema, ComputeFunc, error)
+
+// expressions are handled by the query package, which depends on us, so it registers its compiler
+// upon import (much like database/sql drivers do)
+var compileExpression ExpressionCompiler
+
+// RegisterExpressionCompiler makes computed columns available, it's called by the query package
+func RegisterExpressionCompiler(compiler ExpressionCompiler) {
+	compileExpression = compiler
+}
+
+// derivedColumn is a column not present in our input, it gets appended to each stripe as it's
+// loaded - it either holds a default value in all of its rows or it's computed (see ColumnHint)
+type derivedColumn struct {
+	schema  column.Schema
+	value   string
+	compute ComputeFunc // nil for defaults
+}
+
+// isDerived tells whether a hinted column need not be in our input
+func (ch ColumnHint) isDerived() bool {
+	return ch.Expression != "" || ch.Default != nil
+}
+
+// hasDerivations reports if any of the hints ask for defaults or computed columns
+func (hints SchemaHints) hasDerivations() bool {
+	for _, hint := range hints {
+		if hint.isDerived() {
+			return true
+		}
+	}
+	return false
+}
+
+// defaults lists default values of all the hinted columns that have any, keyed by column names
+func (hints SchemaHints) defaults() map[string]string {
+	var ret map[string]string
+	for name, hint := range hints {
+		if hint.Default != nil && hint.Expression == "" {
+			if ret == nil {
+				ret = make(map[string]string)
+			}
+			ret[name] = *hint.Default
+		}
+	}
+	return ret
+}
+
+// derivedColumns lists columns to be appended to our input (with a given schema): columns with
+// defaults missing in the input and computed columns, in this order and by name. Computed columns
+// can refer to all the other columns, except for other computed columns.
+func (hints SchemaHints) derivedColumns(schema column.TableSchema) ([]derivedColumn, error) {
+	var defaulted, computed []string
+	for name, hint := range hints {
+		_, _, err := schema.LocateColumn(name)
+		exists := err == nil
+		switch {
+		case hint.Expression != "" && exists:
+			return nil, fmt.Errorf("%w: computed column %v already exists", errInvalidSchemaHint, name)
+		case hint.Expression != "" && hint.Default != nil:
+			return nil, fmt.Errorf("%w: computed column %v cannot have a default (consider coalesce)", errInvalidSchemaHint, name)
+		case hint.isDerived() && !hint.Format.IsCanonical():
+			return nil, fmt.Errorf("%w: %v cannot have a date format", errInvalidSchemaHint, name)
+		case hint.Expression != "":
+			computed = append(computed, name)
+		case hint.Default != nil && !exists:
+			defaulted = append(defaulted, name)
+		}
+	}
+	sort.Strings(defaulted)
+	sort.Strings(computed)
+
+	var ret []derivedColumn
+	available := append(column.TableSchema(nil), schema...)
+	for _, name := range defaulted {
+		hint := hints[name]
+		value := *hint.Default
+		if value == "" {
+			return nil, fmt.Errorf("%w: empty default of %v (missing columns would be all null)", errInvalidSchemaHint, name)
+		}
+		dtype := hint.Dtype
+		if dtype == column.DtypeInvalid {
+			tg := column.NewTypeGuesser()
+			tg.AddValue(value)
+			dtype = tg.InferredType().Dtype
+		}
+		if _, err := column.NewChunkLiteralTyped(value, dtype, 1); err != nil {
+			return nil, fmt.Errorf("%w: default of %v is not a %v: %v", errInvalidSchemaHint, name, dtype, err)
+		}
+		dc := derivedColumn{schema: column.Schema{Name: name, Dtype: dtype}, value: value}
+		ret = append(ret, dc)
+		available = append(available, dc.schema)
+	}
+	for _, name := range computed {
+		if compileExpression == nil {
+			return nil, errNoExpressions
+		}
+		hint := hints[name]
+		rt, compute, err := compileExpression(hint.Expression, available)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot compute %v: %v", errInvalidSchemaHint, name, err)
+		}
+		if hint.Dtype != column.DtypeInvalid && hint.Dtype != rt.Dtype {
+			return nil, fmt.Errorf("%w: %v computes a %v, not a %v", errInvalidSchemaHint, name, rt.Dtype, hint.Dtype)
+		}
+		rt.Name = name
+		ret = append(ret, derivedColumn{schema: rt, compute: compute})
+	}
+	return ret, nil
+}
+
+// datasetSchema is the schema of our input along with our derived columns
+func (ls *loadSettings) datasetSchema() column.TableSchema {
+	if len(ls.derived) == 0 {
+		return ls.schema
+	}
+	schema := append(column.TableSchema(nil), ls.schema...)
+	for _, dc := range ls.derived {
+		schema = append(schema, dc.schema)
+	}
+	return schema
+}
+
+// derive appends derived columns to a freshly loaded stripe, so that they get stored along with
+// the rest of the data
+func (ls *loadSettings) derive(sd *stripeData) error {
+	if len(ls.derived) == 0 {
+		return nil
+	}
+	columns := make(map[string]*column.Chunk, len(ls.schema)+len(ls.derived))
+	for j, col := range ls.schema {
+		columns[col.Name] = sd.columns[j]
+	}
+	for _, dc := range ls.derived {
+		var chunk *column.Chunk
+		var err error
+		if dc.compute != nil {
+			chunk, err = dc.compute(columns, sd.meta.Length)
+		} else {
+			chunk, err = column.NewChunkLiteralTyped(dc.value, dc.schema.Dtype, sd.meta.Length)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot derive column %v: %w", dc.schema.Name, err)
+		}
+		// literals cannot be stored (e.g. results of constant expressions)
+		if chunk.IsLiteral {
+			materialised := column.NewChunk(chunk.Dtype())
+			if err := materialised.Append(chunk); err != nil {
+				return err
+			}
+			chunk = materialised
+		}
+		if chunk.Dtype() != dc.schema.Dtype {
+			return fmt.Errorf("derived column %v is a %v, expecting a %v", dc.schema.Name, chunk.Dtype(), dc.schema.Dtype)
+		}
+		sd.columns = append(sd.columns, chunk)
+		columns[dc.schema.Name] = chunk
+	}
+	return nil
+}
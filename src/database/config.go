@@ -0,0 +1,104 @@
+package database
+
+import (
+	"crypto/subtle"
+	"path/filepath"
+	"time"
+)
+
+// Reload applies settings that can change while the database is running - auth tokens (and
+// read-only access), cache sizes, stripe sizes (of data loaded from now on) and default limits of
+// queries (bytes scanned and timeouts), all the other fields of a given config are ignored. Zero
+// values stand for defaults, just like in NewDatabase. Reloaded settings get persisted along with
+// the rest of our config.
+func (db *Database) Reload(config Config) error {
+	config.setDefaults()
+	db.Lock()
+	db.Config.AuthTokens = append([]string(nil), config.AuthTokens...)
+	db.Config.ReadOnlyTokens = append([]string(nil), config.ReadOnlyTokens...)
+	db.Config.ReadOnly = config.ReadOnly
+	db.Config.QueryCacheSize = config.QueryCacheSize
+	db.Config.ChunkCacheSize = config.ChunkCacheSize
+	db.Config.MaxRowsPerStripe = config.MaxRowsPerStripe
+	db.Config.MaxBytesPerStripe = config.MaxBytesPerStripe
+	db.Config.MaxBytesScanned = config.MaxBytesScanned
+	db.Config.QueryTimeout = config.QueryTimeout
+	reloaded := *db.Config
+	hooks := db.reloadHooks
+	db.Unlock()
+
+	db.chunks.resize(reloaded.ChunkCacheSize)
+	for _, hook := range hooks {
+		hook(reloaded)
+	}
+	if db.inMemory {
+		return nil
+	}
+	return writeConfig(filepath.Join(reloaded.WorkingDirectory, "smda_db.json"), &reloaded)
+}
+
+// OnReload registers a function to be called with our config whenever it gets reloaded, so that
+// components outside of this package can pick up new settings (e.g. the size of query.Cache)
+func (db *Database) OnReload(hook func(Config)) {
+	db.Lock()
+	defer db.Unlock()
+	db.reloadHooks = append(db.reloadHooks, hook)
+}
+
+// stripeLimits returns the current Config.MaxRowsPerStripe and Config.MaxBytesPerStripe, these
+// can change at any point (see Reload), so they need to be read under a lock
+func (db *Database) stripeLimits() (maxRows, maxBytes int) {
+	db.Lock()
+	defer db.Unlock()
+	return db.Config.MaxRowsPerStripe, db.Config.MaxBytesPerStripe
+}
+
+// MaxBytesScanned returns the current Config.MaxBytesScanned, it can change at any point (see Reload)
+func (db *Database) MaxBytesScanned() int {
+	db.Lock()
+	defer db.Unlock()
+	return db.Config.MaxBytesScanned
+}
+
+// QueryTimeout returns the current Config.QueryTimeout, it can change at any point (see Reload)
+func (db *Database) QueryTimeout() time.Duration {
+	db.Lock()
+	defer db.Unlock()
+	return time.Duration(db.Config.QueryTimeout) * time.Millisecond
+}
+
+// Authorise checks whether a token is one of Config.AuthTokens (or Config.ReadOnlyTokens),
+// everyone is authorised if there are no tokens configured
+func (db *Database) Authorise(token string) bool {
+	db.Lock()
+	defer db.Unlock()
+	if len(db.Config.AuthTokens) == 0 && len(db.Config.ReadOnlyTokens) == 0 {
+		return true
+	}
+	full, readOnly := matchToken(token, db.Config.AuthTokens), matchToken(token, db.Config.ReadOnlyTokens)
+	return full || readOnly
+}
+
+// ReadOnly reports whether requests presenting a given token can only read data (and not modify
+// it), that is when the whole database is read only (Config.ReadOnly) or when the token is one of
+// Config.ReadOnlyTokens (and not one of Config.AuthTokens as well)
+func (db *Database) ReadOnly(token string) bool {
+	db.Lock()
+	defer db.Unlock()
+	if db.Config.ReadOnly {
+		return true
+	}
+	full, readOnly := matchToken(token, db.Config.AuthTokens), matchToken(token, db.Config.ReadOnlyTokens)
+	return readOnly && !full
+}
+
+func matchToken(token string, tokens []string) bool {
+	ok := false
+	for _, valid := range tokens {
+		// not bailing early, so that we don't leak which of the tokens matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadingConfig(t *testing.T) {
+	wdir := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabase(wdir, &Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var reloaded Config
+	db.OnReload(func(config Config) {
+		reloaded = config
+	})
+	if !db.Authorise("") {
+		t.Error("expecting everyone to be authorised if there are no tokens")
+	}
+	if err := db.Reload(Config{AuthTokens: []string{"foo", "bar"}, MaxRowsPerStripe: 3, ChunkCacheSize: -1, MaxBytesScanned: 1000, QueryTimeout: 500, PortHTTP: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	if db.MaxBytesScanned() != 1000 {
+		t.Errorf("expecting the limit on bytes scanned to be reloaded, got %v", db.MaxBytesScanned())
+	}
+	if db.QueryTimeout() != 500*time.Millisecond {
+		t.Errorf("expecting the query timeout to be reloaded, got %v", db.QueryTimeout())
+	}
+	if reloaded.MaxRowsPerStripe != 3 || reloaded.QueryCacheSize != 100 {
+		t.Errorf("expecting hooks to get reloaded settings (with defaults), got %+v", reloaded)
+	}
+	if db.Config.PortHTTP == 1234 {
+		t.Error("not expecting settings other than the reloadable ones to change")
+	}
+	for token, expected := range map[string]bool{"foo": true, "bar": true, "": false, "baz": false} {
+		if db.Authorise(token) != expected {
+			t.Errorf("expecting %q to be authorised: %v", token, expected)
+		}
+	}
+	if db.chunks.enabled() {
+		t.Error("expecting a negative size to disable the chunk cache")
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2\n3\n4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.Stripes) != 2 {
+		t.Errorf("expecting new data to be loaded using reloaded stripe sizes, got %v stripes", len(ds.Stripes))
+	}
+
+	// reloaded settings are persisted (apart from auth tokens)
+	db2, err := NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db2.Config.MaxRowsPerStripe != 3 || len(db2.Config.AuthTokens) != 0 {
+		t.Errorf("expecting reloaded settings to be persisted (without tokens), got %+v", db2.Config)
+	}
+}
+
+func TestReadOnlyAccess(t *testing.T) {
+	db, err := NewDatabase("", &Config{AuthTokens: []string{"admin", "both"}, ReadOnlyTokens: []string{"demo", "both"}}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	tests := []struct {
+		token                string
+		authorised, readOnly bool
+	}{
+		{"admin", true, false},
+		{"demo", true, true},
+		{"both", true, false}, // full access wins
+		{"", false, false},
+		{"foo", false, false},
+	}
+	for _, test := range tests {
+		if authorised, readOnly := db.Authorise(test.token), db.ReadOnly(test.token); authorised != test.authorised || readOnly != test.readOnly {
+			t.Errorf("expecting %q to be authorised: %v, read only: %v, got %v and %v", test.token, test.authorised, test.readOnly, authorised, readOnly)
+		}
+	}
+
+	// read-only databases are read only for everyone, read-only tokens alone still need to be presented
+	if err := db.Reload(Config{ReadOnlyTokens: []string{"demo"}, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if db.Authorise("") || !db.Authorise("demo") {
+		t.Error("expecting read-only tokens to be needed when they are the only ones configured")
+	}
+	if !db.ReadOnly("demo") || !db.ReadOnly("admin") {
+		t.Error("expecting a read-only database not to grant write access to anyone")
+	}
+}
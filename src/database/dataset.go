@@ -10,15 +10,21 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
 )
 
 var errPathNotEmpty = errors.New("path not empty, but does not contain a smda config file")
-var errDatasetNotFound = errors.New("dataset not found")
+var errDatasetNotFound = errs.New(errs.ErrNotFound, "dataset not found")
+var errStripeNotFound = errs.New(errs.ErrNotFound, "stripe not found")
+var errNoWorkingDirectory = errors.New("in-memory databases have no working directory")
 
 // Database is the main struct that contains it all - notably the datasets' metadata and the webserver
 // Having the webserver here makes it convenient for testing - we can spawn new servers at a moment's notice
@@ -28,6 +34,26 @@ type Database struct {
 	ServerHTTP  *http.Server
 	ServerHTTPS *http.Server
 	Config      *Config
+
+	storage          storage
+	inMemory         bool        // no working directory, see InMemory
+	lazy             bool        // see Lazy
+	partial          bool        // some datasets only have their manifest headers read, see Lazy
+	zeroCopy         bool        // see ZeroCopy
+	aws              *awsClients // nil unless any buckets are configured
+	uploads          *s3Uploads  // nil unless an upload bucket is configured
+	jobs             *jobs
+	chunks           *chunkCache
+	inserts          *inserts
+	external         s3Lister   // reads external datasets stored in S3, set up upon first use
+	resolving        sync.Mutex // serialises resolution of external datasets (see ResolveExternal)
+	transactions     *transactions
+	blobs            *blobRefs  // references to stored stripes, guarded by the database's lock
+	snapshots        int        // open snapshots, data removed while there are any get removed later
+	removed          []*Dataset // datasets removed while there were open snapshots (see Snapshot)
+	aliases          map[string]Alias
+	reloadHooks      []func(Config) // see OnReload
+	writeCompression compression
 }
 
 // Config sets some high level properties for a new Database. It's useful for testing or for passing
@@ -38,6 +64,48 @@ type Config struct {
 	DatabaseID        UID    `json:"database_id"`
 	MaxRowsPerStripe  int    `json:"max_rows_per_stripe"`
 	MaxBytesPerStripe int    `json:"max_bytes_per_stripe"`
+	// each column chunk gets compressed on its own, using one of none/gzip/snappy/zstd (defaults to snappy)
+	// zstd tends to give the best results for wide string columns, at the expense of write speed
+	Compression string `json:"compression"`
+	// number of query results kept in memory (see query.Cache), negative values disable caching
+	QueryCacheSize int `json:"query_cache_size"`
+	// approximate cap (in bytes) on memory held by deserialised column chunks shared across queries
+	// (see ChunkCacheStats), negative values disable caching
+	ChunkCacheSize int `json:"chunk_cache_size"`
+	// number of recent queries kept in memory (see query.History), they get persisted in batches
+	// of this size in smda.queries, negative values disable query history
+	QueryHistorySize int `json:"query_history_size"`
+	// number of paginated query results kept in memory (see query.Cursors), negative values disable paging
+	MaxCursors int `json:"max_cursors"`
+	// approximate cap (in bytes) on memory held by a single query, queries exceeding it get aborted,
+	// zero means no limit
+	MaxQueryMemory int `json:"max_query_memory"`
+	// queries get aborted once they read more than this many bytes from storage (chunks served from
+	// the chunk cache don't count), zero means no limit, queries can override it (see query.Settings)
+	MaxBytesScanned int `json:"max_bytes_scanned"`
+	// queries get aborted once they run for longer than this (in milliseconds), zero means no timeout,
+	// queries can override it (see query.Settings)
+	QueryTimeout int `json:"query_timeout"`
+	// GROUP BY queries keep up to this many groups in memory, groups beyond that get spilled to
+	// temporary files in our working directory and aggregated afterwards (in-memory databases keep all
+	// their groups in memory), negative values disable spilling
+	MaxGroupsInMemory int `json:"max_groups_in_memory"`
+	// if positive, only the latest N versions of each dataset are kept, older ones get dropped
+	// whenever a new version is added
+	RetainVersions int `json:"retain_versions"`
+	// number of background ingestion jobs (see SubmitLoad) running at the same time, others are queued
+	IngestWorkers int `json:"ingest_workers"`
+	// number of goroutines parsing a single file as it gets loaded, each of them loads its own
+	// blocks of rows into stripes (defaults to the number of CPUs)
+	ParseWorkers int `json:"parse_workers"`
+	// rows inserted via InsertRows are buffered in memory and written as a new stripe once there
+	// are this many of them or once this many milliseconds elapse since the first of them got
+	// buffered (negative intervals disable periodic flushing)
+	InsertBufferRows    int `json:"insert_buffer_rows"`
+	InsertFlushInterval int `json:"insert_flush_interval"`
+	// build bloom filters for high cardinality int and string columns when writing stripes, these
+	// allow queries to skip stripes that cannot contain values they look up (e.g. `WHERE id = 123`)
+	BloomFilters bool `json:"bloom_filters"`
 
 	// webserver stuff
 	// TODO: is it supposed to go here? What about certs?
@@ -45,12 +113,109 @@ type Config struct {
 	UseTLS    bool `json:"use_tls"`
 	PortHTTP  int  `json:"port_http"`
 	PortHTTPS int  `json:"port_https"`
+	// Postgres clients can connect on this port (see src/pgserver), zero means they can't
+	PortPostgres int `json:"port_postgres"`
+	// how long (in milliseconds) a shutting down server waits for in-flight requests to finish,
+	// requests still running afterwards get aborted, negative values abort them right away
+	ShutdownGracePeriod int `json:"shutdown_grace_period"`
+	// if set, HTTP requests need to present one of these as a bearer token (see Authorise), they
+	// are not persisted along with the rest of our config, clients cannot see them either
+	AuthTokens []string `json:"-"`
+	// tokens that only grant read access (see ReadOnly), they authorise requests just like AuthTokens
+	ReadOnlyTokens []string `json:"-"`
+	// no data can be modified via our HTTP API, only read and queried (see ReadOnly), this is up to
+	// the server being run, so it doesn't get persisted either
+	ReadOnly bool `json:"-"`
+
+	// if a bucket is set, stripes are stored in S3 instead of in our working directory,
+	// credentials and region are taken from the standard AWS environment
+	StorageBucket string `json:"storage_bucket,omitempty"`
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+	// if an upload bucket is set, clients can upload data directly to S3 using pre-signed
+	// URLs (see PresignUpload), objects get stored under the upload prefix
+	UploadBucket string `json:"upload_bucket,omitempty"`
+	UploadPrefix string `json:"upload_prefix,omitempty"`
+	// external datasets (see RegisterExternal) can only read local files within this directory,
+	// local files cannot be read at all if it's empty (S3 objects are always available)
+	ExternalDirectory string `json:"external_directory,omitempty"`
+}
+
+// setDefaults fills in zero values (see the individual fields for what these defaults are)
+func (config *Config) setDefaults() {
+	if config.MaxRowsPerStripe == 0 {
+		config.MaxRowsPerStripe = 100_000
+	}
+	if config.MaxBytesPerStripe == 0 {
+		config.MaxBytesPerStripe = 10_000_000
+	}
+	if config.QueryCacheSize == 0 {
+		config.QueryCacheSize = 100
+	}
+	if config.ChunkCacheSize == 0 {
+		config.ChunkCacheSize = 128 << 20
+	}
+	if config.QueryHistorySize == 0 {
+		config.QueryHistorySize = 100
+	}
+	if config.MaxCursors == 0 {
+		config.MaxCursors = 100
+	}
+	if config.MaxGroupsInMemory == 0 {
+		config.MaxGroupsInMemory = 5_000_000
+	}
+	if config.IngestWorkers <= 0 {
+		config.IngestWorkers = 2
+	}
+	if config.ParseWorkers <= 0 {
+		config.ParseWorkers = runtime.GOMAXPROCS(0)
+	}
+	if config.InsertBufferRows <= 0 {
+		config.InsertBufferRows = 10_000
+	}
+	if config.InsertFlushInterval == 0 {
+		config.InsertFlushInterval = 5_000
+	}
+	if config.ShutdownGracePeriod == 0 {
+		config.ShutdownGracePeriod = 30_000
+	}
+}
+
+func writeConfig(path string, config *Config) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(config); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), os.ModePerm)
+}
+
+// Option tweaks how a Database gets set up (see NewDatabase)
+type Option func(*Database)
+
+// InMemory sets up an ephemeral database - it has no working directory, stripes live in memory
+// (unless stored in S3, see Config.StorageBucket), so does all the metadata, and nothing gets
+// persisted. Useful for tests and for short-lived processes (e.g. our Lambda handler).
+func InMemory() Option {
+	return func(db *Database) {
+		db.inMemory = true
+	}
+}
+
+// ZeroCopy makes stripe readers reuse decompressed column data as the values of fixed width
+// columns (ints, floats, dates etc.), instead of copying them (see column.DeserializeBytes).
+// This speeds up reads, but stripes compressed as `none` still get copied.
+func ZeroCopy() Option {
+	return func(db *Database) {
+		db.zeroCopy = true
+	}
 }
 
 // NewDatabase initiates a new database object and binds it to a given directory. If the directory
-// doesn't exist, it creates it. If it exists, it loads the data contained within.
+// doesn't exist, it creates it. If it exists, it loads the data contained within. In-memory
+// databases (see InMemory) ignore the directory altogether.
 // TODO: perhaps merge the two args
-func NewDatabase(wdir string, baseConfig *Config) (*Database, error) {
+func NewDatabase(wdir string, baseConfig *Config, opts ...Option) (*Database, error) {
 	// many objects within the database get random IDs assigned, so we better seed at some point
 	// ARCH: might get in the way in testing, we'll deal with it if it happens to be a problem
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -64,7 +229,18 @@ func NewDatabase(wdir string, baseConfig *Config) (*Database, error) {
 	config.WorkingDirectory = wdir
 	config.CreatedTimestamp = time.Now().UTC().Unix()
 
-	if wdir == "" {
+	db := &Database{
+		Config:   config,
+		Datasets: make([]*Dataset, 0),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.inMemory {
+		config.WorkingDirectory = ""
+	}
+
+	if wdir == "" && !db.inMemory {
 		// if no directory supplied, create a database in a temp directory
 		// ARCH: we'll probably do this in $HOME in the future
 		tdir, err := os.MkdirTemp("", "smda_tmp")
@@ -74,84 +250,147 @@ func NewDatabase(wdir string, baseConfig *Config) (*Database, error) {
 		config.WorkingDirectory = filepath.Join(tdir, "smda_db")
 	}
 
-	abspath, err := filepath.Abs(config.WorkingDirectory)
+	var cfgPath string
+	if !db.inMemory {
+		abspath, err := filepath.Abs(config.WorkingDirectory)
+		if err != nil {
+			return nil, err
+		}
+		cfgPath = filepath.Join(abspath, "smda_db.json")
+		// TODO: test how we recover these values from a given file, how we can override them etc.
+		if stat, err := os.Stat(abspath); err == nil && stat.IsDir() {
+			f, err := os.Open(cfgPath)
+			if err != nil {
+				return nil, fmt.Errorf("%w: cannot initialise a database in %v (%v)", errPathNotEmpty, abspath, err)
+			}
+
+			if err := json.NewDecoder(f).Decode(&config); err != nil {
+				f.Close() // choosing to close this explicitly, because defer would run quite late
+				return nil, err
+			}
+			f.Close()
+		}
+	}
+
+	config.setDefaults()
+	if config.Compression == "" {
+		config.Compression = compressionSnappy.String()
+	}
+	ctype, err := compressionFromString(config.Compression)
 	if err != nil {
 		return nil, err
 	}
-	cfgPath := filepath.Join(abspath, "smda_db.json")
-	// TODO: test how we recover these values from a given file, how we can override them etc.
-	if stat, err := os.Stat(abspath); err == nil && stat.IsDir() {
-		f, err := os.Open(cfgPath)
-		if err != nil {
-			return nil, fmt.Errorf("%w: cannot initialise a database in %v (%v)", errPathNotEmpty, abspath, err)
-		}
+	// we can read bzip2, but not write it
+	if ctype == compressionBzip2 {
+		return nil, fmt.Errorf("%w: %v", errCannotWriteCompression, ctype)
+	}
+	if config.DatabaseID.Otype == OtypeNone {
+		config.DatabaseID = newUID(OtypeDatabase)
+	}
+
+	db.writeCompression = ctype
+	db.jobs = newJobs(config.IngestWorkers)
+	db.chunks = newChunkCache(config.ChunkCacheSize)
+	db.inserts = newInserts()
+	db.transactions = newTransactions()
+	db.blobs = newBlobRefs()
+	db.aliases = make(map[string]Alias)
 
-		if err := json.NewDecoder(f).Decode(&config); err != nil {
-			f.Close() // choosing to close this explicitly, because defer would run quite late
+	if !db.inMemory {
+		if err := os.MkdirAll(config.WorkingDirectory, os.ModePerm); err != nil {
+			return nil, err
+		}
+		// write this new configuration to a json file (that may have existed already)
+		// ARCH: test if the contents are the same as what we've created and don't write in that case (just to save some mtime confusion)
+		if err := writeConfig(cfgPath, config); err != nil {
 			return nil, err
 		}
-		f.Close()
 	}
 
-	if config.MaxRowsPerStripe == 0 {
-		config.MaxRowsPerStripe = 100_000
+	if config.StorageBucket != "" || config.UploadBucket != "" {
+		db.aws = &awsClients{}
+		if !db.lazy {
+			if err := db.aws.init(); err != nil {
+				return nil, err
+			}
+		}
 	}
-	if config.MaxBytesPerStripe == 0 {
-		config.MaxBytesPerStripe = 10_000_000
+	switch {
+	case config.StorageBucket != "":
+		db.storage = newS3Storage(db.aws, config.StorageBucket, config.StoragePrefix)
+	case db.inMemory:
+		db.storage = newMemoryStorage()
+	default:
+		db.storage = newLocalStorage(db.dataPath())
 	}
-	if config.DatabaseID.Otype == OtypeNone {
-		config.DatabaseID = newUID(OtypeDatabase)
+	if config.UploadBucket != "" {
+		db.uploads = &s3Uploads{client: db.aws, presigner: db.aws, bucket: config.UploadBucket, prefix: config.UploadPrefix}
+	}
+	if db.inMemory {
+		return db, nil
 	}
 
-	if err := os.MkdirAll(config.WorkingDirectory, os.ModePerm); err != nil {
+	if err := os.MkdirAll(db.manifestPath(nil), os.ModePerm); err != nil {
 		return nil, err
 	}
-	// write this new configuration to a json file (that may have existed already)
-	// ARCH: test if the contents are the same as what we've created and don't write in that case (just to save some mtime confusion)
-	buf := new(bytes.Buffer)
-	enc := json.NewEncoder(buf)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(config); err != nil {
+	if err := os.MkdirAll(db.dataPath(), os.ModePerm); err != nil {
 		return nil, err
 	}
-	if err := os.WriteFile(cfgPath, buf.Bytes(), os.ModePerm); err != nil {
+
+	// commits that didn't get to write all their manifests need to be finished first
+	if err := db.recoverCommits(); err != nil {
 		return nil, err
 	}
-
-	db := &Database{
-		Config:   config,
-		Datasets: make([]*Dataset, 0),
+	// read manifests and load existing files, datasets in namespaces have their manifests
+	// in subdirectories (one per namespace)
+	manifests, err := listManifests(db.manifestPath(nil))
+	if err != nil {
+		return nil, err
 	}
-
-	if err := os.MkdirAll(db.manifestPath(nil), os.ModePerm); err != nil {
+	read := readManifest
+	if db.lazy {
+		read = readManifestHeader
+		db.partial = len(manifests) > 0
+	}
+	datasets, err := readManifests(manifests, read)
+	if err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(db.dataPath(), os.ModePerm); err != nil {
+	// these have their manifests written already and retention doesn't apply to them (see AddDataset)
+	db.Datasets = append(db.Datasets, datasets...)
+	db.blobs.reference(datasets...)
+	if err := db.readAliases(); err != nil {
 		return nil, err
 	}
 
-	// read manifests and load existing files
-	manifests, err := os.ReadDir(db.manifestPath(nil))
+	return db, nil
+}
+
+// listManifests returns paths to all manifests in a given directory and in its subdirectories
+// (but not any deeper, namespaces cannot be nested)
+func listManifests(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
 	if err != nil {
 		return nil, err
 	}
-	for _, manifest := range manifests {
-		var ds Dataset
-		f, err := os.Open(filepath.Join(db.manifestPath(nil), manifest.Name()))
-		if err != nil {
-			return nil, err
+	var ret []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			ret = append(ret, filepath.Join(root, entry.Name()))
+			continue
 		}
-		if err := json.NewDecoder(f).Decode(&ds); err != nil {
-			f.Close() // again being explicit, there can be many of these
+		nested, err := os.ReadDir(filepath.Join(root, entry.Name()))
+		if err != nil {
 			return nil, err
 		}
-		f.Close()
-		if err := db.AddDataset(&ds); err != nil {
-			return nil, err
+		for _, manifest := range nested {
+			if manifest.IsDir() {
+				continue
+			}
+			ret = append(ret, filepath.Join(root, entry.Name(), manifest.Name()))
 		}
 	}
-
-	return db, nil
+	return ret, nil
 }
 
 func (db *Database) manifestPath(ds *Dataset) string {
@@ -159,7 +398,7 @@ func (db *Database) manifestPath(ds *Dataset) string {
 	if ds == nil {
 		return root
 	}
-	return filepath.Join(root, ds.ID.String()+".json")
+	return filepath.Join(root, ds.Namespace, ds.ID.String()+".json")
 }
 func (db *Database) dataPath() string {
 	return filepath.Join(db.Config.WorkingDirectory, "data")
@@ -167,6 +406,13 @@ func (db *Database) dataPath() string {
 
 // Drop deletes all local data for a given Database
 func (db *Database) Drop() error {
+	db.inserts.discardAll()
+	if db.inMemory {
+		if ms, ok := db.storage.(*memoryStorage); ok {
+			ms.clear()
+		}
+		return nil
+	}
 	return os.RemoveAll(db.Config.WorkingDirectory)
 }
 
@@ -180,7 +426,10 @@ const (
 	OtypeDatabase
 	OtypeDataset
 	OtypeStripe
-	// when we start using IDs for columns and jobs and other objects, this will be handy
+	OtypeUpload
+	OtypeJob
+	OtypeTransaction
+	// when we start using IDs for columns and other objects, this will be handy
 )
 
 // UID is a unique ID for a given object, it's NOT a uuid
@@ -252,15 +501,47 @@ type Stripe struct {
 	Id      UID      `json:"id"`
 	Length  int      `json:"length"`
 	Offsets []uint32 `json:"offsets"`
+	// stripes can be shared across dataset versions (see AppendToDataset), in which case
+	// this points to the dataset the stripe was originally written for (and stored with)
+	Owner *UID `json:"owner,omitempty"`
+	// SHA-256 of the stripe's contents (in hex), stripes are stored under it (see blobKey), so that
+	// identical stripes are only stored once, stripes written before we hashed them don't have it
+	Hash string `json:"hash,omitempty"`
+	// stripes of external datasets are not stored by us, this locates their data (see RegisterExternal)
+	Source *StripeSource `json:"source,omitempty"`
+	// column types as they were written, only present if they differ from the dataset's schema
+	// (this happens when appends widen column types, see AppendToDataset), we need to widen
+	// these columns as we read them
+	Dtypes []column.Dtype `json:"dtypes,omitempty"`
+	// how individual columns are encoded, only present if any of them is not plain encoded
+	Encodings []column.Encoding `json:"encodings,omitempty"`
+	// bloom filters are stored after all the columns, filter of column j is located between
+	// Blooms[j] and Blooms[j+1] (columns without filters have this range empty), this is only
+	// present if there are any filters (see Config.BloomFilters)
+	Blooms []uint32 `json:"blooms,omitempty"`
+	// string columns get stored in two sections, their offsets and their contents (so that we can read
+	// just the former), Splits[j] is where the contents of column j begin (zero for columns stored
+	// in one piece), this is only present if any columns are split (stripes written before we
+	// split columns don't have it)
+	Splits []uint32 `json:"splits,omitempty"`
+}
+
+// SchemaChange records how a column changed when a dataset version got created
+type SchemaChange struct {
+	Before column.Schema `json:"before"`
+	After  column.Schema `json:"after"`
 }
 
 // Dataset contains metadata for a given dataset, which at this point means a table
 type Dataset struct {
 	ID   UID    `json:"id"`
 	Name string `json:"name"`
+	// datasets can be grouped in namespaces (e.g. per team or project), they are then referred
+	// to as `namespace.name`, datasets in the default namespace have this empty
+	Namespace string `json:"namespace,omitempty"`
 	// ARCH: move the next three to a a `Meta` struct?
 	Created int64 `json:"created_timestamp"`
-	NRows   int64 `json:"nrows"`
+	NRows   int64 `json:"nrows"` // sum of lengths of all stripes, so that rows can be counted without reading any
 	// ARCH: note that we'd ideally get this as the uncompressed size... might be tricky to get
 	SizeRaw    int64 `json:"size_raw"`
 	SizeOnDisk int64 `json:"size_on_disk"`
@@ -269,41 +550,117 @@ type Dataset struct {
 	// TODO/OPTIM: we need the following for manifests, but it's unnecessary for writing in our
 	// web requests - remove it from there
 	Stripes []Stripe `json:"stripes"`
+	// changes in column types and nullability compared to the previous version
+	SchemaChanges []SchemaChange `json:"schema_changes,omitempty"`
+	// how special float values (NaN, infinities) are loaded and rendered
+	FloatPolicy column.FloatPolicy `json:"float_policy,omitempty"`
+	// columns the data are sorted by (ascending, nulls last), as verified when loading them,
+	// queries can then skip sorting and binary search for ranges of values
+	SortKey []string `json:"sort_key,omitempty"`
+	// per-column stats (aligned with the schema) collected as data get written, datasets loaded
+	// before we collected them don't have any
+	Stats []column.ColumnStats `json:"stats,omitempty"`
+	// external datasets are read from files we don't manage, they cannot be modified
+	External *ExternalSource `json:"external,omitempty"`
+	// data of datasets that only live in memory (see NewResultDataset), aligned with the schema
+	memory []*column.Chunk
+	// a manifest yet to be read in full, only its header has been read so far (see Lazy)
+	manifest string
 }
 
-// NewDataset creates a new empty dataset
+// NewDataset creates a new empty dataset (in the default namespace)
 func NewDataset(name string) *Dataset {
+	return NewDatasetInNamespace("", name)
+}
+
+// NewDatasetInNamespace creates a new empty dataset in a given namespace, an empty namespace
+// denotes the default one
+func NewDatasetInNamespace(namespace, name string) *Dataset {
 	// ARCH: we don't give the user a choice - the name will get modified if it doesn't
 	// satisfy our rules... allow for some UnsafeNewDataset thingy?
 	name = cleanupIdentifier(name, "dataset")
+	if namespace != "" {
+		namespace = cleanupIdentifier(namespace, "namespace")
+	}
 	// we need to use a high resolution timer, because subsequent dataset creation need to have a timer
 	// that advanced between these actions
 	// ARCH: this might be an issue in Windows, where the resolution is low?
 	return &Dataset{
-		ID:      newUID(OtypeDataset),
-		Created: time.Now().UnixNano(),
-		Name:    name,
+		ID:        newUID(OtypeDataset),
+		Created:   time.Now().UnixNano(),
+		Name:      name,
+		Namespace: namespace,
+	}
+}
+
+// QualifiedName is how datasets are referred to in queries and in lookups (e.g. GetDatasetLatest),
+// cleaned up names never contain dots, so this is unambiguous
+func QualifiedName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// QualifiedName returns this dataset's name prefixed with its namespace (if it has one)
+func (ds *Dataset) QualifiedName() string {
+	return QualifiedName(ds.Namespace, ds.Name)
+}
+
+// Stripe looks up one of this dataset's stripes by its ID
+func (ds *Dataset) Stripe(id string) (Stripe, error) {
+	for _, stripe := range ds.Stripes {
+		if stripe.Id.String() == id {
+			return stripe, nil
+		}
 	}
+	return Stripe{}, fmt.Errorf("%w: %v in %v@v%v", errStripeNotFound, id, ds.QualifiedName(), ds.ID)
 }
 
 // DatasetPath returns the path of a given dataset (all the stripes are there)
 // ARCH: consider merging this with dataPath based on a nullable dataset argument (like manifestPath)
 func (db *Database) DatasetPath(ds *Dataset) string {
-	return filepath.Join(db.dataPath(), ds.ID.String())
+	return filepath.Join(db.dataPath(), ds.Namespace, ds.ID.String())
 }
 
+// stripePath is only meaningful for local storage, use stripeKey for storage-agnostic access
 func (db *Database) stripePath(ds *Dataset, stripe Stripe) string {
-	return filepath.Join(db.DatasetPath(ds), stripe.Id.String())
+	return filepath.Join(db.dataPath(), filepath.FromSlash(stripeKey(ds, stripe)))
+}
+
+// stripeKey identifies a stripe within a storage backend, namespaced datasets have their
+// stripes stored under their namespace. Content addressed stripes are stored by their hashes,
+// regardless of which datasets refer to them (see blobKey), older stripes are stored with their
+// datasets (owners of shared stripes are always in the same namespace, see AppendToDataset)
+func stripeKey(ds *Dataset, stripe Stripe) string {
+	if stripe.Hash != "" {
+		return blobKey(ds.Namespace, stripe.Hash)
+	}
+	owner := ds.ID
+	if stripe.Owner != nil {
+		owner = *stripe.Owner
+	}
+	return path.Join(ds.Namespace, owner.String(), stripe.Id.String())
 }
 
-// GetDataset retrieves a dataset based on its UID
+// GetDatasetByVersion retrieves a dataset based on its (qualified) name and UID
 // OPTIM: not efficient in this implementation, but we don't have a map-like structure
 // to store our datasets - we keep them in a slice, so that we have predictable order
 // -> we need a sorted map
 func (db *Database) GetDatasetByVersion(name, version string) (*Dataset, error) {
+	db.Lock()
+	defer db.Unlock()
+	ds, err := findVersion(db.Datasets, name, version)
+	if err != nil {
+		return nil, err
+	}
+	return ds, db.hydrate(ds)
+}
+
+func findVersion(datasets []*Dataset, name, version string) (*Dataset, error) {
 	var found *Dataset
-	for _, dataset := range db.Datasets {
-		if dataset.Name != name {
+	for _, dataset := range datasets {
+		if dataset.QualifiedName() != name {
 			continue
 		}
 		if dataset.ID.String() == version {
@@ -317,9 +674,19 @@ func (db *Database) GetDatasetByVersion(name, version string) (*Dataset, error)
 }
 
 func (db *Database) GetDatasetLatest(name string) (*Dataset, error) {
+	db.Lock()
+	defer db.Unlock()
+	ds, err := findLatest(db.Datasets, name)
+	if err != nil {
+		return nil, err
+	}
+	return ds, db.hydrate(ds)
+}
+
+func findLatest(datasets []*Dataset, name string) (*Dataset, error) {
 	var found *Dataset
-	for _, dataset := range db.Datasets {
-		if dataset.Name != name {
+	for _, dataset := range datasets {
+		if dataset.QualifiedName() != name {
 			continue
 		}
 		if found == nil || dataset.Created > found.Created {
@@ -339,64 +706,182 @@ func (db *Database) GetDataset(name, version string, latest bool) (*Dataset, err
 	return db.GetDatasetByVersion(name, version)
 }
 
+// ResolveDataset works like GetDataset, but names of latest versions may also be aliases (see
+// Alias), this is how queries look up their datasets
+func (db *Database) ResolveDataset(name, version string, latest bool) (*Dataset, error) {
+	db.Lock()
+	defer db.Unlock()
+	ds, err := lookupDataset(db.Datasets, db.aliases, name, version, latest)
+	if err != nil {
+		return nil, err
+	}
+	return ds, db.hydrate(ds)
+}
+
 // AddDataset adds a Dataset to a Database
 // this is a pretty rare event, so we don't expect much contention
 // it's just to avoid some issues when marshaling the object around in the API etc.
 func (db *Database) AddDataset(ds *Dataset) error {
 	db.Lock()
 	db.Datasets = append(db.Datasets, ds)
+	orphaned := db.blobs.reference(ds)
 	db.Unlock()
+	// stripes written but not referenced are of no use, removing them is best effort (like in removeStripes)
+	db.removeBlobs(orphaned)
+	if db.inMemory {
+		return db.applyRetention(ds.QualifiedName())
+	}
 
-	fn := db.manifestPath(ds)
 	// only write the manifest if it doesn't exist already
-	// OPTIM: consider adding a boolean arg here to avoid os.Stat on all
-	// manifests upon startup (that's where it gets triggered the most)
-	if _, err := os.Stat(fn); err == nil {
+	if _, err := os.Stat(db.manifestPath(ds)); err == nil {
 		return nil
 	}
+	if err := db.writeManifest(ds); err != nil {
+		return err
+	}
+	// previews only need to be read when listing datasets, so we materialise them upfront
+	if _, err := db.writePreview(ds); err != nil {
+		return err
+	}
+
+	// retention only applies to new versions, not to datasets loaded upon startup (those don't get
+	// added via AddDataset)
+	return db.applyRetention(ds.QualifiedName())
+}
+
+// writeManifest writes (or overwrites) a given dataset's manifest
+func (db *Database) writeManifest(ds *Dataset) error {
+	fn := db.manifestPath(ds)
+	if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+		return err
+	}
 	f, err := os.Create(fn)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	// ARCH/OPTIM: bufio? Though the manifests are likely to be small (or will they?)
-	if err := json.NewEncoder(f).Encode(ds); err != nil {
-		return err
+	return json.NewEncoder(f).Encode(ds)
+}
+
+// versions returns all versions of a given dataset, the newest first
+func (db *Database) versions(name string) []*Dataset {
+	db.Lock()
+	defer db.Unlock()
+	var ret []*Dataset
+	for _, dataset := range db.Datasets {
+		if dataset.QualifiedName() == name {
+			ret = append(ret, dataset)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created > ret[j].Created
+	})
+	return ret
+}
+
+func (db *Database) applyRetention(name string) error {
+	if db.Config.RetainVersions <= 0 {
+		return nil
+	}
+	versions := db.versions(name)
+	if len(versions) <= db.Config.RetainVersions {
+		return nil
+	}
+	for _, ds := range versions[db.Config.RetainVersions:] {
+		if err := db.removeDataset(ds); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
+// DropDataset removes a given version of a dataset - or all of its versions, if no version is
+// specified. Stripes shared with versions that are not being dropped are retained.
+func (db *Database) DropDataset(name, version string) error {
+	var drop []*Dataset
+	if version != "" {
+		ds, err := db.GetDatasetByVersion(name, version)
+		if err != nil {
+			return err
+		}
+		drop = append(drop, ds)
+	} else {
+		drop = db.versions(name)
+		if len(drop) == 0 {
+			return fmt.Errorf("dataset %v not found: %w", name, errDatasetNotFound)
+		}
+		// there is nothing left to insert buffered rows into
+		db.inserts.discard(name)
+	}
+	for _, ds := range drop {
+		if err := db.removeDataset(ds); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// removeDataset removes a dataset's manifest first, so that a failure to remove any of its stripes
+// leaves orphaned files behind, but never a manifest pointing to missing data
 // tests cover only "real" datasets, not the raw ones
 func (db *Database) removeDataset(ds *Dataset) error {
 	db.Lock()
+	// stripes may be shared with datasets not read yet, we need to know about them
+	if err := db.hydrateAll(); err != nil {
+		db.Unlock()
+		return err
+	}
+	pos := -1
 	for j, dataset := range db.Datasets {
 		if dataset == ds {
-			db.Datasets = append(db.Datasets[:j], db.Datasets[j+1:]...)
-			// if the dataset isn't found, this is a noop
+			pos = j
 			break
 		}
 	}
-	// not deferring this - we're not throwing errors and we want to unlock
-	// it before the end of the function (removing data might take a while)
-	db.Unlock()
-
-	for _, stripe := range ds.Stripes {
-		if err := os.Remove(db.stripePath(ds, stripe)); err != nil {
+	// if the dataset isn't found, this is a noop
+	if pos == -1 {
+		db.Unlock()
+		return nil
+	}
+	if !db.inMemory {
+		if err := os.Remove(db.manifestPath(ds)); err != nil && !os.IsNotExist(err) {
+			db.Unlock()
+			return err
+		}
+		if err := os.Remove(db.previewPath(ds)); err != nil && !os.IsNotExist(err) {
+			db.Unlock()
 			return err
 		}
 	}
-
-	if err := os.Remove(db.manifestPath(ds)); err != nil {
-		return err
+	db.Datasets = append(db.Datasets[:pos], db.Datasets[pos+1:]...)
+	// open snapshots may still be reading this dataset, its data get removed once they are released
+	if db.snapshots > 0 {
+		db.removed = append(db.removed, ds)
+		db.Unlock()
+		return nil
 	}
+	db.Unlock()
+	return db.removeDatasetData(ds)
+}
 
-	// This might throw a "directory not empty" in the future as other datasets might claim
-	// parts of this directory (if we start sharing stripes). But let's cross that bridge
-	// when we get to it
-	if err := os.Remove(db.DatasetPath(ds)); err != nil {
-		return err
+// removeDatasetData removes stripes of datasets that are no longer in our database
+func (db *Database) removeDatasetData(datasets ...*Dataset) error {
+	// stripes can be shared across datasets (be it versions sharing them, see AppendToDataset,
+	// or identical data, see blobKey), we must not remove those still in use
+	db.Lock()
+	var orphaned []string
+	for _, ds := range datasets {
+		// datasets that never got added only have their stripes pending
+		delete(db.blobs.pending, ds.ID)
+		orphaned = append(orphaned, db.blobs.unreference(storedKeys(ds))...)
 	}
+	// not deferring this - we want to unlock it before removing data (that might take a while)
+	db.Unlock()
 
-	return nil
+	for _, ds := range datasets {
+		db.chunks.invalidate(ds.ID)
+	}
+	// the local storage removes the dataset's directory once its last stripe is gone
+	return db.removeBlobs(orphaned)
 }
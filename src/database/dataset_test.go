@@ -54,6 +54,62 @@ func TestNewUidDeJSONify(t *testing.T) {
 	}
 }
 
+func TestInMemoryDatabase(t *testing.T) {
+	// temporary files would end up here, as would a temporary working directory
+	tdir := t.TempDir()
+	t.Setenv("TMPDIR", tdir)
+
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Config.WorkingDirectory != "" {
+		t.Errorf("expecting in-memory databases not to have a working directory, got %v", db.Config.WorkingDirectory)
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y\n3,z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	appended, err := db.AppendToDataset(ds, strings.NewReader("a,b\n4,w"), WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appended.NRows != 4 || len(appended.Stripes) != 3 {
+		t.Errorf("expecting an appended dataset to have 4 rows in 3 stripes, got %v rows in %v stripes", appended.NRows, len(appended.Stripes))
+	}
+	cols, _, err := db.ReadColumnsFromStripeByNames(appended, appended.Stripes[2], []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols["b"].Len() != 1 {
+		t.Errorf("expecting the appended stripe to hold a single row, got %v", cols["b"].Len())
+	}
+	if _, err := db.InitMultipartUpload(); !errors.Is(err, errNoWorkingDirectory) {
+		t.Errorf("expecting multipart uploads to fail with %v, got %v", errNoWorkingDirectory, err)
+	}
+
+	entries, err := os.ReadDir(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("expecting an in-memory database not to touch disk, found %v", entries[0].Name())
+	}
+
+	if err := db.DropDataset("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if objects := db.storage.(*memoryStorage).objects; len(objects) != 0 {
+		t.Errorf("expecting dropped datasets to free their stripes, %v remain", len(objects))
+	}
+	if err := db.Drop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestInitDB(t *testing.T) {
 	dirname := t.TempDir()
 	for _, path := range []string{"foo", "bar", "baz"} {
@@ -262,6 +318,72 @@ func TestRemovingDatasets(t *testing.T) {
 	}
 }
 
+func TestNamespacedDatasets(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	// the same name in different namespaces
+	datasets := make(map[string]*Dataset)
+	for _, namespace := range []string{"", "sales", "Marketing Team"} {
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions("orders", strings.NewReader("foo,bar\n1,2\n3,4"), LoadOptions{Namespace: namespace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		datasets[ds.QualifiedName()] = ds
+	}
+	for _, name := range []string{"orders", "sales.orders", "marketing_team.orders"} {
+		ds, ok := datasets[name]
+		if !ok {
+			t.Fatalf("expecting a dataset called %v", name)
+		}
+		for _, stripe := range ds.Stripes {
+			path := db.stripePath(ds, stripe)
+			if _, err := os.Stat(path); err != nil {
+				t.Fatal(err)
+			}
+			if rel, _ := filepath.Rel(db.dataPath(), path); ds.Namespace != "" && !strings.HasPrefix(rel, ds.Namespace+string(filepath.Separator)) {
+				t.Errorf("expecting stripes of %v to be stored in its namespace, got %v", name, rel)
+			}
+		}
+	}
+
+	// manifests in namespaces need to be picked up when a database gets reopened
+	db2, err := NewDatabase(db.Config.WorkingDirectory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ds := range datasets {
+		ds2, err := db2.GetDatasetLatest(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ds, ds2) {
+			t.Errorf("expecting %v to roundtrip, got %+v", name, ds2)
+		}
+	}
+
+	if err := db.DropDataset("sales.orders", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetDatasetLatest("sales.orders"); !errors.Is(err, errDatasetNotFound) {
+		t.Errorf("expecting a dropped dataset not to be found, got %v", err)
+	}
+	for _, name := range []string{"orders", "marketing_team.orders"} {
+		if _, err := db.GetDatasetLatest(name); err != nil {
+			t.Errorf("dropping a dataset should not affect other namespaces, got %v", err)
+		}
+	}
+}
+
 func TestGettingNewDatasets(t *testing.T) {
 	db, err := NewDatabase("", nil)
 	if err != nil {
@@ -288,3 +410,102 @@ func TestGettingNewDatasets(t *testing.T) {
 		t.Errorf("did not get the same dataset back")
 	}
 }
+
+func TestDroppingDatasets(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var versions []*Dataset
+	for _, name := range []string{"foo", "foo", "foo", "bar"} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader("a,b\n1,2\n3,4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, ds)
+	}
+
+	if err := db.DropDataset("foo", versions[1].ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetDatasetByVersion("foo", versions[1].ID.String()); !errors.Is(err, errDatasetNotFound) {
+		t.Errorf("expecting a dropped version not to be found, got %v", err)
+	}
+	if _, err := os.Stat(db.manifestPath(versions[1])); !os.IsNotExist(err) {
+		t.Errorf("expecting a manifest to be removed along with a dataset, got %v", err)
+	}
+	if len(db.Datasets) != 3 {
+		t.Errorf("expecting three datasets to remain, got %v", len(db.Datasets))
+	}
+
+	if err := db.DropDataset("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetDatasetLatest("foo"); !errors.Is(err, errDatasetNotFound) {
+		t.Errorf("expecting all versions of a dataset to be dropped, got %v", err)
+	}
+	if _, err := db.GetDatasetLatest("bar"); err != nil {
+		t.Errorf("expecting other datasets not to be affected, got %v", err)
+	}
+
+	for _, version := range []string{"", versions[0].ID.String()} {
+		if err := db.DropDataset("foo", version); !errors.Is(err, errDatasetNotFound) {
+			t.Errorf("expecting dropping a non-existent dataset to result in %v, got %v", errDatasetNotFound, err)
+		}
+	}
+}
+
+func TestRetainingVersions(t *testing.T) {
+	wdir := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabase(wdir, &Config{RetainVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// appended versions share stripes with the original one, these need to survive retention
+	var latest *Dataset
+	for j := 0; j < 3; j++ {
+		latest, err = db.AppendToDataset(ds, strings.NewReader("a,b\n5,6"), WideningNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds = latest
+	}
+	versions := db.versions("foo")
+	if len(versions) != 2 || versions[0] != latest {
+		t.Fatalf("expecting only the latest two versions to be retained, got %v", len(versions))
+	}
+	for _, stripe := range latest.Stripes {
+		if _, _, err := db.ReadColumnsFromStripeByNames(latest, stripe, []string{"a"}); err != nil {
+			t.Errorf("expecting all stripes of the latest version to be readable, got %v", err)
+		}
+	}
+
+	// retention doesn't apply to datasets loaded upon startup
+	db2, err := NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db2.Datasets) != 2 {
+		t.Errorf("expecting two versions to be persisted, got %v", len(db2.Datasets))
+	}
+}
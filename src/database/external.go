@@ -0,0 +1,740 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidExternal = errs.New(errs.ErrBadRequest, "invalid external dataset")
+var errNoExternalObjects = errs.New(errs.ErrNotFound, "no external data found")
+var errExternalReadOnly = errs.New(errs.ErrBadRequest, "external datasets cannot be modified")
+var errExternalChanged = errs.New(errs.ErrBadRequest, "external data changed since they were resolved")
+
+// external data get read sequentially through buffers this large, so that we don't issue too many
+// requests to remote storage (each read of an S3 object is a range GET)
+const externalBufferSize = 8 << 20
+
+// ExternalSource describes data of an external dataset, these are read from files we don't manage
+// (local files or S3 objects) as they get queried, they never get loaded into our storage
+type ExternalSource struct {
+	// a local path (relative to Config.ExternalDirectory) or an s3://bucket/key URI, either can
+	// be a glob pattern (see path.Match), all the matched objects then form a single dataset
+	URI     string           `json:"uri"`
+	Format  string           `json:"format"` // csv or parquet
+	Objects []ExternalObject `json:"objects"`
+	// CSV dialect (see LoadOptions), it's inferred from the first object unless given, all the
+	// objects need to share it (including their compression)
+	Compression string      `json:"compression,omitempty"`
+	Delimiter   string      `json:"delimiter,omitempty"`
+	Quote       string      `json:"quote,omitempty"`
+	NoHeader    bool        `json:"no_header,omitempty"`
+	NullTokens  []string    `json:"null_tokens,omitempty"`
+	Decimal     string      `json:"decimal,omitempty"`
+	Thousands   string      `json:"thousands,omitempty"`
+	SchemaHints SchemaHints `json:"schema_hints,omitempty"`
+	// schemas (and stripes) are only inferred upon first query, see ResolveExternal
+	Resolved bool `json:"resolved"`
+}
+
+// ExternalObject is a file (or an S3 object) an external dataset consists of
+type ExternalObject struct {
+	Path string `json:"path"` // relative to Config.ExternalDirectory or an S3 key
+	Size int64  `json:"size"`
+}
+
+// StripeSource locates a stripe of an external dataset in its objects - CSV stripes are byte
+// ranges of whole records (or whole objects, if they are compressed), Parquet stripes are row groups
+type StripeSource struct {
+	Object   int   `json:"object"` // see ExternalSource.Objects
+	Offset   int64 `json:"offset,omitempty"`
+	Size     int64 `json:"size,omitempty"`
+	RowGroup int   `json:"row_group,omitempty"`
+}
+
+// ExternalOptions tweak how external data get read, CSV data accept the same options as data
+// being loaded, apart from sort keys (these could not be verified)
+type ExternalOptions struct {
+	LoadOptions
+	// csv or parquet, inferred from the extension of the first object if empty
+	Format string
+}
+
+// externalStore lists and opens objects external datasets consist of
+type externalStore interface {
+	list(pattern string) ([]ExternalObject, error)
+	open(path string) (storageObject, error)
+}
+
+type localExternal struct {
+	root string
+}
+
+func (le localExternal) list(pattern string) ([]ExternalObject, error) {
+	matches, err := filepath.Glob(filepath.Join(le.root, filepath.FromSlash(pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidExternal, err)
+	}
+	var ret []ExternalObject
+	for _, match := range matches {
+		stat, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		if stat.IsDir() {
+			continue
+		}
+		rel, err := filepath.Rel(le.root, match)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ExternalObject{Path: filepath.ToSlash(rel), Size: stat.Size()})
+	}
+	return ret, nil
+}
+
+func (le localExternal) open(p string) (storageObject, error) {
+	return os.Open(filepath.Join(le.root, filepath.FromSlash(p)))
+}
+
+type s3External struct {
+	client s3Lister
+	bucket string
+}
+
+// patterns get matched against whole keys, so `*` doesn't match across slashes
+func (se s3External) list(pattern string) ([]ExternalObject, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidExternal, err)
+	}
+	prefix := pattern
+	if pos := strings.IndexAny(pattern, `*?[\`); pos > -1 {
+		prefix = pattern[:pos]
+	}
+	var ret []ExternalObject
+	pages := s3.NewListObjectsV2Paginator(se.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(se.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if ok, _ := path.Match(pattern, key); ok {
+				ret = append(ret, ExternalObject{Path: key, Size: obj.Size})
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (se s3External) open(p string) (storageObject, error) {
+	return &s3Object{ss: newS3Storage(se.client, se.bucket, ""), path: p}, nil
+}
+
+// externalStore determines where an external dataset's data live and how they are to be matched
+func (db *Database) externalStore(uri string) (externalStore, string, error) {
+	if strings.HasPrefix(uri, "s3://") {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+		if bucket == "" || key == "" {
+			return nil, "", fmt.Errorf("%w: expecting s3://bucket/key, got %v", errInvalidExternal, uri)
+		}
+		return s3External{client: db.externalClient(), bucket: bucket}, key, nil
+	}
+	if strings.Contains(uri, "://") {
+		return nil, "", fmt.Errorf("%w: unsupported URI %v", errInvalidExternal, uri)
+	}
+	if db.Config.ExternalDirectory == "" {
+		return nil, "", fmt.Errorf("%w: local files are not allowed (see Config.ExternalDirectory)", errInvalidExternal)
+	}
+	// no escaping our directory
+	pattern := path.Clean("/" + filepath.ToSlash(uri))[1:]
+	if pattern == "" {
+		return nil, "", fmt.Errorf("%w: no path given", errInvalidExternal)
+	}
+	return localExternal{root: db.Config.ExternalDirectory}, pattern, nil
+}
+
+func (db *Database) externalClient() s3Lister {
+	db.Lock()
+	defer db.Unlock()
+	if db.external == nil {
+		if db.aws == nil {
+			db.aws = &awsClients{}
+		}
+		db.external = db.aws
+	}
+	return db.external
+}
+
+// RegisterExternal creates a dataset backed by external data - local files or S3 objects (see
+// ExternalSource.URI), these are only listed here, their schema gets inferred upon first query
+// (see ResolveExternal) and queries then parse the data as they read them. The dataset needs to be
+// added via AddDataset. External datasets cannot be appended to or modified in any other way.
+// ARCH: we assume data don't change once resolved, we only detect changes that break parsing
+// (or that change row counts), registering the same data again creates a fresh version
+func (db *Database) RegisterExternal(name, uri string, opts ExternalOptions) (*Dataset, error) {
+	if len(opts.SortKey) > 0 {
+		return nil, fmt.Errorf("%w: external data cannot be verified to be sorted", errNotSorted)
+	}
+	store, pattern, err := db.externalStore(uri)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := store.list(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("%w: %v", errNoExternalObjects, uri)
+	}
+	ext := &ExternalSource{
+		URI:         uri,
+		Format:      opts.Format,
+		Objects:     objects,
+		Delimiter:   opts.Delimiter,
+		Quote:       opts.Quote,
+		NoHeader:    opts.NoHeader,
+		NullTokens:  opts.NullTokens,
+		Decimal:     opts.Decimal,
+		Thousands:   opts.Thousands,
+		SchemaHints: opts.SchemaHints,
+	}
+	if ext.Format == "" {
+		ext.Format = "csv"
+		switch path.Ext(objects[0].Path) {
+		case ".parquet", ".pq":
+			ext.Format = "parquet"
+		}
+	}
+	switch ext.Format {
+	case "csv":
+		f, err := store.open(objects[0].Path)
+		if err != nil {
+			return nil, err
+		}
+		ctype, dlim, err := inferFormat(bufio.NewReaderSize(io.NewSectionReader(f, 0, objects[0].Size), externalBufferSize))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if dlim == delimiterNone {
+			dlim = delimiterComma
+		}
+		ext.Compression = ctype.String()
+		if ext.Delimiter == "" {
+			ext.Delimiter = dlim.String()
+		}
+		// validates the dialect
+		if _, err := ext.loadSettings(); err != nil {
+			return nil, err
+		}
+		// ARCH: these would have to be derived on every read
+		if ext.SchemaHints.hasDerivations() {
+			return nil, fmt.Errorf("%w: external data cannot have defaults or computed columns", errInvalidExternal)
+		}
+	case "parquet":
+		if ext.Delimiter != "" || ext.Quote != "" || ext.NoHeader || ext.NullTokens != nil || ext.Decimal != "" || ext.Thousands != "" || ext.SchemaHints != nil {
+			return nil, fmt.Errorf("%w: CSV options don't apply to Parquet data", errInvalidExternal)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format %v", errInvalidExternal, ext.Format)
+	}
+
+	ds := NewDatasetInNamespace(opts.Namespace, name)
+	ds.External = ext
+	ds.FloatPolicy = opts.Floats
+	ds.Schema = column.TableSchema{}
+	ds.Stripes = []Stripe{}
+	for _, obj := range objects {
+		ds.SizeRaw += obj.Size
+	}
+	return ds, nil
+}
+
+func (ext *ExternalSource) loadSettings() (*loadSettings, error) {
+	ctype, err := compressionFromString(ext.Compression)
+	if err != nil {
+		return nil, err
+	}
+	ls := &loadSettings{readCompression: ctype, delimiter: delimiterComma, cleanupColumns: true}
+	opts := LoadOptions{
+		Delimiter:  ext.Delimiter,
+		Quote:      ext.Quote,
+		NoHeader:   ext.NoHeader,
+		NullTokens: ext.NullTokens,
+		Decimal:    ext.Decimal,
+		Thousands:  ext.Thousands,
+	}
+	if err := opts.applyDialect(ls); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// ResolveExternal infers the schema of an unresolved external dataset and splits its data into
+// stripes. This reads all the data once, so it only happens upon first query (and then gets
+// persisted). The resolved dataset replaces the unresolved one (it keeps its version), other
+// datasets are returned as they are.
+// ARCH: resolutions don't run concurrently, even for different datasets
+func (db *Database) ResolveExternal(ds *Dataset) (*Dataset, error) {
+	if ds.External == nil || ds.External.Resolved {
+		return ds, nil
+	}
+	db.resolving.Lock()
+	defer db.resolving.Unlock()
+	// someone else may have resolved it while we waited
+	current, err := db.GetDatasetByVersion(ds.QualifiedName(), ds.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	if current.External.Resolved {
+		return current, nil
+	}
+
+	resolved := *current
+	ext := *current.External
+	resolved.External = &ext
+	store, _, err := db.externalStore(ext.URI)
+	if err != nil {
+		return nil, err
+	}
+	if ext.Format == "parquet" {
+		err = db.resolveParquet(&resolved, store)
+	} else {
+		err = db.resolveCSV(&resolved, store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ext.Resolved = true
+
+	db.Lock()
+	defer db.Unlock()
+	for j, dataset := range db.Datasets {
+		if dataset != current {
+			continue
+		}
+		db.Datasets[j] = &resolved
+		// the dataset might have been dropped in the meantime, we must not write its manifest then
+		if !db.inMemory {
+			if err := db.writeManifest(&resolved); err != nil {
+				return nil, err
+			}
+			if err := os.Remove(db.previewPath(&resolved)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		break
+	}
+	return &resolved, nil
+}
+
+// recordScanner splits uncompressed CSV data into records, so that we can find byte ranges of
+// whole records, each of which can then be parsed on its own. Records end with newlines that are
+// not within quoted fields.
+type recordScanner struct {
+	r     *bufio.Reader
+	quote byte // zero if quoting is disabled
+}
+
+// appendRecord appends the next record (including its newline) and returns its length
+func (rs *recordScanner) appendRecord(buf []byte) ([]byte, int, error) {
+	start := len(buf)
+	quoted := false
+	for {
+		line, err := rs.r.ReadSlice('\n')
+		buf = append(buf, line...)
+		if rs.quote != 0 && bytes.Count(line, []byte{rs.quote})%2 == 1 {
+			quoted = !quoted
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF:
+			if len(buf) == start {
+				return buf, 0, io.EOF
+			}
+			return buf, len(buf) - start, nil
+		case err != nil:
+			return nil, 0, err
+		}
+		if !quoted {
+			return buf, len(buf) - start, nil
+		}
+	}
+}
+
+// fixedWidthReader makes sure all rows have the same number of values
+type fixedWidthReader struct {
+	rr    RowReader
+	width int
+}
+
+func (fwr *fixedWidthReader) ReadRow() ([]string, error) {
+	row, err := fwr.rr.ReadRow()
+	if err == nil && len(row) != fwr.width {
+		return nil, fmt.Errorf("%w: row has %v values, expecting %v", errSchemaMismatch, len(row), fwr.width)
+	}
+	return row, err
+}
+
+// csvResolver infers types of CSV data and splits them into stripes, object by object
+type csvResolver struct {
+	ds       *Dataset
+	settings *loadSettings
+	ranges   *loadSettings // stripes of uncompressed data are parsed as ranges without headers
+	quote    byte          // zero if quoting is disabled
+	maxRows  int
+	maxBytes int
+	header   []string
+	guessers []*column.TypeGuesser
+}
+
+// resolveCSV reads all the objects of a dataset, inferring their types and splitting them into
+// stripes (as limited by Config.MaxRowsPerStripe and MaxBytesPerStripe)
+func (db *Database) resolveCSV(ds *Dataset, store externalStore) error {
+	ext := ds.External
+	settings, err := ext.loadSettings()
+	if err != nil {
+		return err
+	}
+	ranges := *settings
+	ranges.noHeader = true
+	maxRows, maxBytes := db.stripeLimits()
+	cr := &csvResolver{ds: ds, settings: settings, ranges: &ranges, maxRows: maxRows, maxBytes: maxBytes}
+	if settings.delimiter != delimiterTab && !settings.noQuotes {
+		cr.quote = '"'
+		if settings.quote != 0 {
+			cr.quote = settings.quote
+		}
+	}
+	for j, obj := range ext.Objects {
+		f, err := store.open(obj.Path)
+		if err != nil {
+			return err
+		}
+		err = cr.resolveObject(j, io.NewSectionReader(f, 0, obj.Size))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %w", obj.Path, err)
+		}
+	}
+	if cr.guessers == nil {
+		return fmt.Errorf("%w: %v contains no data", errNoExternalObjects, ext.URI)
+	}
+
+	schema := make(column.TableSchema, len(cr.guessers))
+	for j, tg := range cr.guessers {
+		schema[j] = tg.InferredType()
+		if schema[j].Dtype == column.DtypeInvalid {
+			return errCannotInferTypes
+		}
+		schema[j].Name = cr.header[j]
+	}
+	if err := ext.SchemaHints.apply(schema); err != nil {
+		return err
+	}
+	ds.Schema = schema
+	return nil
+}
+
+func (cr *csvResolver) resolveObject(nthObject int, f io.Reader) error {
+	r := bufio.NewReaderSize(f, externalBufferSize)
+	// compressed data cannot be read in ranges, each object becomes a single stripe
+	// ARCH: this means large compressed objects result in large stripes
+	if cr.settings.readCompression != compressionNone {
+		rr, err := NewRowReader(r, cr.settings)
+		if err != nil {
+			return err
+		}
+		nrows, err := cr.guessTypes(rr, !cr.settings.noHeader)
+		if err != nil {
+			return err
+		}
+		cr.addStripe(nrows, &StripeSource{Object: nthObject, Size: cr.ds.External.Objects[nthObject].Size})
+		return nil
+	}
+
+	rs := &recordScanner{r: r, quote: cr.quote}
+	var offset int64
+	if !cr.settings.noHeader {
+		buf, n, err := rs.appendRecord(nil)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := cr.guessTypes(newSliceReader(buf, cr.settings), true); err != nil {
+			return err
+		}
+		offset = int64(n)
+	}
+	for {
+		var buf []byte
+		var err error
+		for records := 0; records < cr.maxRows && len(buf) < cr.maxBytes; records++ {
+			if buf, _, err = rs.appendRecord(buf); err != nil {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(buf) == 0 {
+			return nil
+		}
+		nrows, err := cr.guessTypes(newSliceReader(buf, cr.ranges), false)
+		if err != nil {
+			return err
+		}
+		cr.addStripe(nrows, &StripeSource{Object: nthObject, Offset: offset, Size: int64(len(buf))})
+		offset += int64(len(buf))
+	}
+}
+
+func (cr *csvResolver) addStripe(nrows int, source *StripeSource) {
+	if nrows == 0 {
+		return
+	}
+	cr.ds.Stripes = append(cr.ds.Stripes, Stripe{Id: newUID(OtypeStripe), Length: nrows, Source: source})
+	cr.ds.NRows += int64(nrows)
+}
+
+// guessTypes feeds rows into our type guessers and returns how many there were. Readers yield
+// a header first, it's either an object's actual header (which then needs to match those of other
+// objects), or an empty one (for ranges and headerless data), which only sets our column count.
+func (cr *csvResolver) guessTypes(rr RowReader, header bool) (int, error) {
+	hd, err := rr.ReadRow()
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	hd = cleanupColumns(append([]string(nil), hd...))
+	switch {
+	case cr.guessers == nil:
+		cr.header = hd
+		for range hd {
+			cr.guessers = append(cr.guessers, column.NewTypeGuesserWithFormat(cr.settings.numbers))
+		}
+	case header && strings.Join(hd, "\x00") != strings.Join(cr.header, "\x00"):
+		return 0, fmt.Errorf("%w: columns differ from those of %v", errSchemaMismatch, cr.ds.External.Objects[0].Path)
+	}
+	fwr := &fixedWidthReader{rr: rr, width: len(cr.guessers)}
+	nrows := 0
+	for {
+		row, err := fwr.ReadRow()
+		if err == io.EOF {
+			return nrows, nil
+		}
+		if err != nil {
+			return nrows, err
+		}
+		for j, val := range row {
+			cr.guessers[j].AddValue(val)
+		}
+		nrows++
+	}
+}
+
+// newSliceReader reads rows from a byte slice, it cannot fail, because it only reads from memory
+// and our settings were validated already
+func newSliceReader(buf []byte, settings *loadSettings) RowReader {
+	rr, err := NewRowReader(bytes.NewReader(buf), settings)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// resolveParquet reads metadata of all the objects of a dataset, each row group becomes a stripe
+func (db *Database) resolveParquet(ds *Dataset, store externalStore) error {
+	ext := ds.External
+	for j, obj := range ext.Objects {
+		f, err := store.open(obj.Path)
+		if err != nil {
+			return err
+		}
+		pf, err := column.ReadParquetFile(f, obj.Size)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %w", obj.Path, err)
+		}
+		names := make([]string, len(pf.Schema))
+		for k, col := range pf.Schema {
+			names[k] = col.Name
+		}
+		names = cleanupColumns(names)
+		if j == 0 {
+			ds.Schema = make(column.TableSchema, len(pf.Schema))
+			for k, col := range pf.Schema {
+				ds.Schema[k] = column.Schema{Name: names[k], Dtype: col.Dtype, Nullable: col.Nullable}
+			}
+		}
+		if len(pf.Schema) != len(ds.Schema) {
+			return fmt.Errorf("%w: columns of %v differ from those of %v", errSchemaMismatch, obj.Path, ext.Objects[0].Path)
+		}
+		for k, col := range pf.Schema {
+			if names[k] != ds.Schema[k].Name || col.Dtype != ds.Schema[k].Dtype {
+				return fmt.Errorf("%w: columns of %v differ from those of %v", errSchemaMismatch, obj.Path, ext.Objects[0].Path)
+			}
+			ds.Schema[k].Nullable = ds.Schema[k].Nullable || col.Nullable
+		}
+		for rg, nrows := range pf.RowGroups {
+			if nrows == 0 {
+				continue
+			}
+			ds.Stripes = append(ds.Stripes, Stripe{Id: newUID(OtypeStripe), Length: nrows, Source: &StripeSource{Object: j, RowGroup: rg}})
+			ds.NRows += int64(nrows)
+		}
+	}
+	return nil
+}
+
+// countingReaderAt tracks how many bytes we read from external objects (see ReadStats)
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int
+}
+
+func (cr *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cr.r.ReadAt(p, off)
+	cr.n += n
+	return n, err
+}
+
+// readExternalColumns is ReadColumnsFromStripe for external datasets. CSV stripes get parsed in
+// full, so all their columns get cached, Parquet files allow us to read just the columns we need.
+// Offsets of string columns get read along with their contents.
+func (db *Database) readExternalColumns(ds *Dataset, stripe Stripe, columns []string) (map[string]*column.Chunk, ReadStats, error) {
+	var stats ReadStats
+	cols := make(map[string]*column.Chunk, len(columns))
+	var missing []int
+	for _, name := range columns {
+		if _, ok := cols[name]; ok {
+			continue
+		}
+		idx, _, err := ds.Schema.LocateColumn(name)
+		if err != nil {
+			return nil, stats, err
+		}
+		if col, ok := db.chunks.get(chunkKey{version: ds.ID, stripe: stripe.Id, column: idx}); ok {
+			stats.CacheHits++
+			cols[name] = col
+			continue
+		}
+		if db.chunks.enabled() {
+			stats.CacheMisses++
+		}
+		// a placeholder, so that we skip duplicates
+		cols[name] = nil
+		missing = append(missing, idx)
+	}
+	if len(missing) == 0 {
+		return cols, stats, nil
+	}
+
+	obj := ds.External.Objects[stripe.Source.Object]
+	store, _, err := db.externalStore(ds.External.URI)
+	if err != nil {
+		return nil, stats, err
+	}
+	f, err := store.open(obj.Path)
+	if err != nil {
+		return nil, stats, err
+	}
+	defer f.Close()
+	cr := &countingReaderAt{r: f}
+	defer func() { stats.BytesRead = cr.n }()
+
+	read := make(map[int]*column.Chunk, len(ds.Schema))
+	if ds.External.Format == "parquet" {
+		// OPTIM: we read each file's footer for every stripe, we could cache them
+		pf, err := column.ReadParquetFile(cr, obj.Size)
+		if err != nil {
+			return nil, stats, err
+		}
+		if stripe.Source.RowGroup >= len(pf.RowGroups) || pf.RowGroups[stripe.Source.RowGroup] != stripe.Length || len(pf.Schema) != len(ds.Schema) {
+			return nil, stats, fmt.Errorf("%w: %v", errExternalChanged, obj.Path)
+		}
+		for _, idx := range missing {
+			if pf.Schema[idx].Dtype != ds.Schema[idx].Dtype {
+				return nil, stats, fmt.Errorf("%w: %v", errExternalChanged, obj.Path)
+			}
+			if read[idx], err = pf.ReadColumn(cr, stripe.Source.RowGroup, idx); err != nil {
+				return nil, stats, err
+			}
+		}
+	} else {
+		chunks, err := readExternalCSV(ds, stripe, cr)
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to read %v: %w", obj.Path, err)
+		}
+		for idx, chunk := range chunks {
+			read[idx] = chunk
+		}
+	}
+
+	for idx, chunk := range read {
+		db.chunks.put(chunkKey{version: ds.ID, stripe: stripe.Id, column: idx}, chunk)
+	}
+	for _, idx := range missing {
+		cols[ds.Schema[idx].Name] = read[idx]
+	}
+	return cols, stats, nil
+}
+
+func readExternalCSV(ds *Dataset, stripe Stripe, r io.ReaderAt) ([]*column.Chunk, error) {
+	settings, err := ds.External.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	var rr RowReader
+	if settings.readCompression == compressionNone {
+		buf := make([]byte, stripe.Source.Size)
+		if _, err := io.ReadFull(io.NewSectionReader(r, stripe.Source.Offset, stripe.Source.Size), buf); err != nil {
+			return nil, fmt.Errorf("%w: %v", errExternalChanged, err)
+		}
+		settings.noHeader = true
+		rr = newSliceReader(buf, settings)
+	} else {
+		obj := ds.External.Objects[stripe.Source.Object]
+		if rr, err = NewRowReader(bufio.NewReaderSize(io.NewSectionReader(r, 0, obj.Size), externalBufferSize), settings); err != nil {
+			return nil, err
+		}
+	}
+	// a header (an empty one for ranges and headerless data)
+	if _, err := rr.ReadRow(); err != nil {
+		if err == io.EOF {
+			err = errExternalChanged
+		}
+		return nil, err
+	}
+	data, err := newStripeFromReader(&fixedWidthReader{rr: rr, width: len(ds.Schema)}, ds.Schema, ds.FloatPolicy, settings.numbers, ds.External.SchemaHints.dateFormats(ds.Schema), nil, stripe.Length+1, math.MaxInt)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if data.meta.Length != stripe.Length {
+		return nil, fmt.Errorf("%w: expecting %v rows, got %v", errExternalChanged, stripe.Length, data.meta.Length)
+	}
+	return data.columns, nil
+}
@@ -0,0 +1,332 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func readExternal(t *testing.T, db *Database, ds *Dataset) map[string][]string {
+	t.Helper()
+	names := make([]string, len(ds.Schema))
+	for j, col := range ds.Schema {
+		names[j] = col.Name
+	}
+	ret := make(map[string][]string)
+	for _, stripe := range ds.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, chunk := range cols {
+			for j := 0; j < chunk.Len(); j++ {
+				val, ok := chunk.JSONLiteral(j)
+				if !ok {
+					val = "null"
+				}
+				ret[name] = append(ret[name], val)
+			}
+		}
+	}
+	return ret
+}
+
+func TestExternalCSV(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"trips/2020.csv":  "id,note\n1,foo\n2,\"multi\nline\"\n3,bar\n",
+		"trips/2021.csv":  "id,note\n4,baz\n5,\n",
+		"trips/other.txt": "a\n1",
+	}
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := NewDatabase("", &Config{ExternalDirectory: dir, MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.RegisterExternal("trips", "trips/*.csv", ExternalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.External.Objects) != 2 || ds.External.Format != "csv" || ds.External.Resolved || len(ds.Schema) != 0 {
+		t.Errorf("expecting an unresolved dataset of two objects, got %+v", ds.External)
+	}
+
+	resolved, err := db.ResolveExternal(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolved.External.Resolved || resolved.ID != ds.ID || resolved.NRows != 5 || len(resolved.Stripes) != 3 {
+		t.Errorf("unexpected resolved dataset: %+v", resolved)
+	}
+	expected := column.TableSchema{{Name: "id", Dtype: column.DtypeInt}, {Name: "note", Dtype: column.DtypeString, Nullable: true}}
+	if len(resolved.Schema) != 2 || resolved.Schema[0] != expected[0] || resolved.Schema[1] != expected[1] {
+		t.Errorf("expecting schema %v, got %v", expected, resolved.Schema)
+	}
+	if latest, err := db.GetDatasetLatest("trips"); err != nil || latest != resolved {
+		t.Errorf("expecting the resolved dataset to replace the unresolved one, got %v (%v)", latest, err)
+	}
+	if again, err := db.ResolveExternal(ds); err != nil || again != resolved {
+		t.Errorf("expecting datasets to only be resolved once, got %v (%v)", again, err)
+	}
+
+	data := readExternal(t, db, resolved)
+	if got := strings.Join(data["id"], ","); got != "1,2,3,4,5" {
+		t.Errorf("unexpected ids: %v", got)
+	}
+	if got := strings.Join(data["note"], ","); got != `"foo","multi\nline","bar","baz",""` {
+		t.Errorf("unexpected notes: %v", got)
+	}
+
+	// resolution gets persisted
+	db2, err := NewDatabase(db.Config.WorkingDirectory, &Config{ExternalDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	persisted, err := db2.GetDatasetLatest("trips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !persisted.External.Resolved || persisted.NRows != 5 {
+		t.Errorf("expecting resolved datasets to be persisted, got %+v", persisted)
+	}
+
+	// changes which break our stripes get detected
+	if err := os.WriteFile(filepath.Join(dir, "trips/2021.csv"), []byte("id,note\n4,baz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db2.ReadColumnsFromStripeByNames(persisted, persisted.Stripes[2], []string{"id"})
+	if !errors.Is(err, errExternalChanged) {
+		t.Errorf("expecting changed data to be reported, got %v", err)
+	}
+}
+
+func TestExternalCompressedCSV(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte("1;2\n3;4\n5;6\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.csv.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("", &Config{ExternalDirectory: dir, MaxRowsPerStripe: 2}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.RegisterExternal("data", "data.csv.gz", ExternalOptions{LoadOptions: LoadOptions{NoHeader: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if ds.External.Compression != "gzip" || ds.External.Delimiter != "semicolon" {
+		t.Errorf("expecting the dialect to be inferred, got %+v", ds.External)
+	}
+	resolved, err := db.ResolveExternal(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compressed objects cannot be split
+	if len(resolved.Stripes) != 1 || resolved.NRows != 3 || resolved.Schema[0].Name != "column_01" {
+		t.Errorf("unexpected resolved dataset: %+v", resolved)
+	}
+	if got := strings.Join(readExternal(t, db, resolved)["column_02"], ","); got != "2,4,6" {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
+
+func TestExternalParquet(t *testing.T) {
+	dir := t.TempDir()
+	for j, contents := range []string{"a,b\n1,foo\n2,\n", "a,b\n3,bar\n"} {
+		src, err := NewDatabase("", nil, InMemory())
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := src.LoadDatasetFromReaderAuto("foo", strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.AddDataset(loaded); err != nil {
+			t.Fatal(err)
+		}
+		cols, _, err := src.ReadColumnsFromStripeByNames(loaded, loaded.Stripes[0], []string{"a", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := column.WriteParquet(&buf, loaded.Schema, []*column.Chunk{cols["a"], cols["b"]}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, []string{"one.parquet", "two.parquet"}[j]), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewDatabase("", &Config{ExternalDirectory: dir}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	if _, err := db.RegisterExternal("foo", "*.parquet", ExternalOptions{LoadOptions: LoadOptions{Delimiter: "tab"}}); !errors.Is(err, errInvalidExternal) {
+		t.Errorf("expecting CSV options to be rejected for Parquet data, got %v", err)
+	}
+	ds, err := db.RegisterExternal("foo", "*.parquet", ExternalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := db.ResolveExternal(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.External.Format != "parquet" || len(resolved.Stripes) != 2 || resolved.NRows != 3 || !resolved.Schema[1].Nullable {
+		t.Errorf("unexpected resolved dataset: %+v", resolved)
+	}
+	data := readExternal(t, db, resolved)
+	if got := strings.Join(data["a"], ","); got != "1,2,3" {
+		t.Errorf("unexpected values: %v", got)
+	}
+	if got := strings.Join(data["b"], ","); got != `"foo","","bar"` {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
+
+func TestExternalS3(t *testing.T) {
+	db, err := NewDatabase("", nil, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	client, fs := newFakeS3Client(t)
+	db.external = client
+	fs.objects["/smda-bucket/data/a.csv"] = []byte("x,y\n1,2\n")
+	fs.objects["/smda-bucket/data/b.csv"] = []byte("x,y\n3,4\n")
+	fs.objects["/smda-bucket/data/nested/c.csv"] = []byte("x,y\n5,6\n")
+
+	ds, err := db.RegisterExternal("data", "s3://smda-bucket/data/*.csv", ExternalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.External.Objects) != 2 || ds.External.Objects[1].Path != "data/b.csv" || ds.SizeRaw != 16 {
+		t.Errorf("unexpected objects listed: %+v", ds.External.Objects)
+	}
+	resolved, err := db.ResolveExternal(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(readExternal(t, db, resolved)["y"], ","); got != "2,4" {
+		t.Errorf("unexpected values: %v", got)
+	}
+
+	if _, err := db.RegisterExternal("data", "s3://smda-bucket/nothing/*.csv", ExternalOptions{}); !errors.Is(err, errNoExternalObjects) {
+		t.Errorf("expecting no matches to be reported, got %v", err)
+	}
+}
+
+func TestExternalRestrictions(t *testing.T) {
+	// files outside of our directory cannot be reached
+	parent := t.TempDir()
+	if err := os.WriteFile(filepath.Join(parent, "secret.csv"), []byte("a\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(parent, "external")
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.csv"), []byte("a\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("", &Config{ExternalDirectory: dir}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, uri := range []string{"http://example.com/data.csv", "s3://bucket", "../secret.csv", "/../secret.csv", "nonexistent.csv"} {
+		if _, err := db.RegisterExternal("foo", uri, ExternalOptions{}); err == nil {
+			t.Errorf("expecting %v to be rejected", uri)
+		}
+	}
+	if _, err := db.RegisterExternal("foo", "data.csv", ExternalOptions{LoadOptions: LoadOptions{SortKey: []string{"a"}}}); !errors.Is(err, errNotSorted) {
+		t.Errorf("expecting sort keys to be rejected, got %v", err)
+	}
+
+	ds, err := db.RegisterExternal("foo", "data.csv", ExternalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err = db.ResolveExternal(ds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AppendToDataset(ds, strings.NewReader("a\n2"), WideningNone); !errors.Is(err, errExternalReadOnly) {
+		t.Errorf("expecting appends to be rejected, got %v", err)
+	}
+	if _, err := db.InsertRows("foo", [][]string{{"2"}}); !errors.Is(err, errExternalReadOnly) {
+		t.Errorf("expecting inserts to be rejected, got %v", err)
+	}
+	if _, err := db.Compact(ds, CompactOptions{}); !errors.Is(err, errExternalReadOnly) {
+		t.Errorf("expecting compaction to be rejected, got %v", err)
+	}
+	if errs := db.Fsck(); len(errs) > 0 {
+		t.Errorf("not expecting external datasets to be checked, got %v", errs)
+	}
+
+	local, err := NewDatabase("", nil, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.RegisterExternal("foo", "data.csv", ExternalOptions{}); !errors.Is(err, errInvalidExternal) {
+		t.Errorf("expecting local files to be disallowed by default, got %v", err)
+	}
+}
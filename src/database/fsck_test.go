@@ -0,0 +1,60 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2, BloomFilters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("id,name\n1,foo\n2,bar\n3,baz\n4,bak\n5,bal\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if errs := db.Fsck(); len(errs) > 0 {
+		t.Fatalf("expecting intact data to pass, got %v", errs)
+	}
+
+	// flip a bit in the second column of the first stripe
+	stripe := ds.Stripes[0]
+	path := db.stripePath(ds, stripe)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[stripe.Offsets[1]+6] ^= 1
+	if err := os.WriteFile(path, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	errs := db.Fsck()
+	if len(errs) != 1 || !errors.Is(errs[0], errIncorrectChecksum) || !strings.Contains(errs[0].Error(), "column name") || !strings.Contains(errs[0].Error(), stripe.Id.String()) {
+		t.Errorf("expecting a corrupted column to be identified, got %v", errs)
+	}
+
+	// missing stripes and stripes with wrong lengths get reported as well, all stripes get checked
+	if err := os.Remove(db.stripePath(ds, ds.Stripes[1])); err != nil {
+		t.Fatal(err)
+	}
+	ds.Stripes[2].Length++
+	errs = db.Fsck()
+	if len(errs) != 4 {
+		t.Fatalf("expecting four problems to be found, got %v", errs)
+	}
+	if !errors.Is(errs[1], os.ErrNotExist) || !errors.Is(errs[2], errColumnLengthMismatch) || !errors.Is(errs[3], errColumnLengthMismatch) {
+		t.Errorf("expecting a missing stripe and a length mismatch, got %v", errs)
+	}
+}
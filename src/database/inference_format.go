@@ -8,11 +8,16 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/kokes/smda/src/errs"
 )
 
+var errUnknownCompression = errs.New(errs.ErrBadRequest, "unknown compression")
+var errInvalidDelimiter = errs.New(errs.ErrBadRequest, "invalid delimiter")
+
 type compression uint8
 
 const (
@@ -20,11 +25,22 @@ const (
 	compressionGzip
 	compressionBzip2
 	compressionSnappy
+	compressionZstd
 )
 
 // OPTIM: obvious reasons
 func (c compression) String() string {
-	return []string{"none", "gzip", "bzip2", "snappy"}[c]
+	return []string{"none", "gzip", "bzip2", "snappy", "zstd"}[c]
+}
+
+// compressionFromString is the inverse of compression.String
+func compressionFromString(s string) (compression, error) {
+	for _, ctype := range []compression{compressionNone, compressionGzip, compressionBzip2, compressionSnappy, compressionZstd} {
+		if ctype.String() == s {
+			return ctype, nil
+		}
+	}
+	return compressionNone, fmt.Errorf("%w: %v", errUnknownCompression, s)
 }
 
 type delimiter uint8
@@ -49,17 +65,33 @@ func (d delimiter) String() string {
 		delimiterPipe:      "pipe"}[d]
 }
 
+// delimiterFromString accepts either a delimiter's name (see delimiter.String) or the delimiter
+// itself (a single byte) - the former is handy in URLs, where some delimiters would otherwise
+// need escaping (or, in case of semicolons, are not allowed at all)
+func delimiterFromString(s string) (delimiter, error) {
+	for _, dlim := range []delimiter{delimiterComma, delimiterSemicolon, delimiterTab, delimiterSpace, delimiterPipe} {
+		if dlim.String() == s {
+			return dlim, nil
+		}
+	}
+	if len(s) != 1 || s[0] == '\n' || s[0] == '\r' || s[0] >= 0x80 {
+		return delimiterNone, fmt.Errorf("%w: %q", errInvalidDelimiter, s)
+	}
+	return delimiter(s[0]), nil
+}
+
 // https://en.wikipedia.org/wiki/List_of_file_signatures
 func inferCompression(buffer []byte) compression {
 	// 1) detect compression from contents, not filename
 	signatures := map[compression][]byte{
 		compressionGzip:  {0x1f, 0x8b},
 		compressionBzip2: {0x42, 0x5A, 0x68},
+		compressionZstd:  {0x28, 0xB5, 0x2F, 0xFD},
 		// TODO: support snappy? does it have a unified header (there are multiple formats etc.)
 	}
 
 	for ctype, signature := range signatures {
-		if bytes.Equal(buffer[:len(signature)], signature) {
+		if bytes.HasPrefix(buffer, signature) {
 			return ctype
 		}
 	}
@@ -79,6 +111,9 @@ func readCompressed(r io.Reader, ctype compression) (io.Reader, error) {
 		return bzip2.NewReader(r), nil
 	case compressionSnappy:
 		return snappy.NewReader(r), nil
+	case compressionZstd:
+		// a single-threaded decoder doesn't spawn any goroutines, so it's fine not to close it
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
 	default:
 		return nil, fmt.Errorf("cannot open a file compressed as %v", ctype)
 	}
@@ -120,12 +155,17 @@ func inferDelimiter(buf []byte) delimiter {
 	return delimiterNone
 }
 
-func inferCompressionAndDelimiter(path string) (compression, delimiter, error) {
-	f, err := os.Open(path)
+func inferCompressionAndDelimiter(inc *incomingFile) (compression, delimiter, error) {
+	f, err := inc.open()
 	if err != nil {
 		return 0, 0, err
 	}
 	defer f.Close()
+	return inferFormat(f)
+}
+
+// inferFormat infers compression and delimiter from the beginning of a file
+func inferFormat(f io.Reader) (compression, delimiter, error) {
 	r := bufio.NewReader(f)
 
 	header := make([]byte, 32)
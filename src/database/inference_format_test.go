@@ -3,10 +3,12 @@ package database
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"io"
 	"testing"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestBasicCompressionInference(t *testing.T) {
@@ -121,11 +123,22 @@ func TestCompressionStringer(t *testing.T) {
 		{compressionGzip, "gzip"},
 		{compressionBzip2, "bzip2"},
 		{compressionSnappy, "snappy"},
+		{compressionZstd, "zstd"},
 	}
 	for _, test := range tests {
 		if test.cmp.String() != test.str {
 			t.Errorf("expecting %+v to print as %+v", test.cmp, test.str)
 		}
+		cmp, err := compressionFromString(test.str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmp != test.cmp {
+			t.Errorf("expecting %+v to parse as %+v, got %+v", test.str, test.cmp, cmp)
+		}
+	}
+	if _, err := compressionFromString("lzma"); !errors.Is(err, errUnknownCompression) {
+		t.Errorf("expecting an unknown compression to fail with %v, got %v", errUnknownCompression, err)
 	}
 }
 
@@ -143,6 +156,25 @@ func TestDelimiterStringer(t *testing.T) {
 		if test.dlm.String() != test.str {
 			t.Errorf("expecting %+v to print as %+v", test.dlm, test.str)
 		}
+		// `none` is not a delimiter we can parse, it's inferred
+		if test.dlm == delimiterNone {
+			continue
+		}
+		dlm, err := delimiterFromString(test.str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dlm != test.dlm {
+			t.Errorf("expecting %+v to parse as %+v, got %+v", test.str, test.dlm, dlm)
+		}
+	}
+	if dlm, err := delimiterFromString(";"); err != nil || dlm != delimiterSemicolon {
+		t.Errorf("expecting a literal delimiter to parse, got %v (%v)", dlm, err)
+	}
+	for _, invalid := range []string{"none", "", "\n", ";;", "é"} {
+		if _, err := delimiterFromString(invalid); !errors.Is(err, errInvalidDelimiter) {
+			t.Errorf("expecting %q to fail with %v, got %v", invalid, errInvalidDelimiter, err)
+		}
 	}
 }
 
@@ -211,3 +243,34 @@ func TestWrappingSnappyData(t *testing.T) {
 		t.Fatalf("expected %+v, got %+v", raw, newData)
 	}
 }
+
+func TestWrappingZstdData(t *testing.T) {
+	raw := []byte("foobarbaz")
+	zdata := new(bytes.Buffer)
+	zw, err := zstd.NewWriter(zdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(zw, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+
+	if ctype := inferCompression(zdata.Bytes()); ctype != compressionZstd {
+		t.Errorf("expecting zstd data to be detected as such, got %v", ctype)
+	}
+
+	data := bytes.NewReader(zdata.Bytes())
+	newReader, err := readCompressed(data, compressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newData, err := io.ReadAll(newReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, newData) {
+		t.Fatalf("expected %+v, got %+v", raw, newData)
+	}
+}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+// values commonly used for missing data, conflicting values in otherwise typed columns are
+// suggested as null tokens if they are one of these (ignoring case)
+var commonNullTokens = map[string]bool{
+	"na": true, "n/a": true, "#n/a": true, "null": true, "nil": true, "none": true,
+	"\\n": true, "-": true, "--": true, "?": true, ".": true,
+}
+
+// Dialect is a CSV dialect as detected (or overridden, see LoadOptions) for a given file
+type Dialect struct {
+	Compression string `json:"compression"`
+	Delimiter   string `json:"delimiter"`
+	NoHeader    bool   `json:"no_header"`
+}
+
+// NullTokenCandidate is a value that may be meant as a null (LoadOptions.NullTokens), since it
+// prevented some columns from being loaded as numbers, dates etc.
+type NullTokenCandidate struct {
+	Value   string   `json:"value"`
+	Count   int      `json:"count"`
+	Columns []string `json:"columns"`
+}
+
+// BadRow is a row that would fail a load on its own, e.g. one with a wrong number of fields
+type BadRow struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// LoadPreview is what a load of a sample of a file would result in (see PreviewLoad)
+type LoadPreview struct {
+	Dialect Dialect `json:"dialect"`
+	// the schema of the resulting dataset, including any hints (see LoadOptions.SchemaHints)
+	Schema column.TableSchema `json:"schema"`
+	NRows  int                `json:"nrows"`
+	// the sample was cut short, so the rest of a file may be inferred differently (or fail to load)
+	Truncated bool `json:"truncated"`
+	// columns that are mostly of a narrower type than inferred, along with the values that don't
+	// fit it (rows are numbered from zero, see InferColumnTypes) - these can be loaded as hinted
+	// types once their conflicts are resolved (e.g. via null tokens)
+	Suggestions []ColumnInference    `json:"suggestions"`
+	NullTokens  []NullTokenCandidate `json:"null_tokens"`
+	BadRows     []BadRow             `json:"bad_rows"`
+	NBadRows    int                  `json:"nbad_rows"`
+}
+
+// PreviewLoad infers what loading data with given options would result in, it only reads the
+// first maxBytes of them and nothing gets persisted. Unlike actual loads, it tolerates rows that
+// cannot be loaded and it reports them instead (see LoadPreview).
+func (db *Database) PreviewLoad(r io.Reader, maxBytes int, opts LoadOptions) (*LoadPreview, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: no data", errCannotInferTypes)
+	}
+	preview := &LoadPreview{Truncated: len(data) > maxBytes}
+	if preview.Truncated {
+		data = data[:maxBytes]
+	}
+	inc := &incomingFile{data: data}
+	ctype, dlim, err := inferCompressionAndDelimiter(inc)
+	if err != nil {
+		return nil, err
+	}
+	// we don't want to parse half a row (compressed data get cut short in readRows)
+	if preview.Truncated && ctype == compressionNone {
+		if end := bytes.LastIndexByte(data, '\n'); end > -1 {
+			inc.data = data[:end+1]
+		}
+	}
+	if dlim == delimiterNone {
+		dlim = delimiterComma
+	}
+	ls := &loadSettings{
+		readCompression: ctype,
+		delimiter:       dlim,
+		cleanupColumns:  true,
+		floats:          opts.Floats,
+	}
+	if err := opts.applyDialect(ls); err != nil {
+		return nil, err
+	}
+	preview.Dialect = Dialect{Compression: ctype.String(), Delimiter: ls.delimiter.String(), NoHeader: ls.noHeader}
+	ls.defaults = opts.SchemaHints.defaults()
+
+	header, values, rows, err := preview.readRows(inc, ls)
+	if err != nil {
+		return nil, err
+	}
+	schema := make(column.TableSchema, len(header))
+	var conflicted []string
+	var conflictedValues [][]string
+	for j, name := range header {
+		tg := column.NewTypeGuesserWithFormat(ls.numbers)
+		dominant := column.NewLenientTypeGuesser(ls.numbers)
+		for _, val := range values[j] {
+			tg.AddValue(val)
+			dominant.AddValue(val)
+		}
+		schema[j] = tg.InferredType()
+		if schema[j].Dtype == column.DtypeInvalid {
+			return nil, errCannotInferTypes
+		}
+		schema[j].Name = name
+		suggested := dominant.DominantType()
+		if suggested.Dtype == schema[j].Dtype || suggested.Dtype == column.DtypeInvalid {
+			continue
+		}
+		suggested.Name = name
+		inf, err := conflictingValues(values[j], schema[j], suggested, ls.numbers, ls.floats)
+		if err != nil {
+			return nil, err
+		}
+		for k, conflict := range inf.Conflicts {
+			inf.Conflicts[k].Row = rows[conflict.Row]
+		}
+		preview.Suggestions = append(preview.Suggestions, inf)
+		conflicted = append(conflicted, name)
+		conflictedValues = append(conflictedValues, values[j])
+	}
+	preview.NullTokens = nullTokenCandidates(conflicted, conflictedValues)
+
+	if err := opts.SchemaHints.apply(schema); err != nil {
+		return nil, err
+	}
+	derived, err := opts.SchemaHints.derivedColumns(schema)
+	if err != nil {
+		return nil, err
+	}
+	ls.schema = schema
+	ls.derived = derived
+	preview.Schema = ls.datasetSchema()
+	return preview, nil
+}
+
+// readRows reads a header and all the values of a sample, column by column, rows that cannot be
+// loaded get skipped and recorded, so we also return the row numbers of all the values
+func (preview *LoadPreview) readRows(inc *incomingFile, ls *loadSettings) (header []string, values [][]string, rows []int, _ error) {
+	f, err := inc.open()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+	rr, err := NewRowReader(f, ls)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	row, err := rr.ReadRow()
+	if err == io.EOF {
+		return nil, nil, nil, fmt.Errorf("%w: no data", errCannotInferTypes)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header = append([]string(nil), row...)
+	if ls.cleanupColumns {
+		header = cleanupColumns(header)
+	}
+	defaulted := make([]string, len(header))
+	for j, name := range header {
+		defaulted[j] = ls.defaults[name]
+	}
+
+	values = make([][]string, len(header))
+	for nrow := 0; ; nrow++ {
+		row, err := rr.ReadRow()
+		switch {
+		case err == io.EOF:
+			return header, values, rows, nil
+		// truncated compressed data end abruptly, we drop whatever we read of the last row
+		case errors.Is(err, io.ErrUnexpectedEOF) && preview.Truncated:
+			return header, values, rows, nil
+		// malformed rows (see csvReader)
+		case errors.Is(err, errs.ErrBadRequest):
+			preview.addBadRow(nrow, err)
+			continue
+		case err != nil:
+			return nil, nil, nil, err
+		case len(row) != len(header):
+			preview.addBadRow(nrow, fmt.Errorf("expecting %v fields, got %v", len(header), len(row)))
+			continue
+		}
+		for j, val := range row {
+			if val == "" && defaulted[j] != "" {
+				val = defaulted[j]
+			}
+			values[j] = append(values[j], val)
+		}
+		rows = append(rows, nrow)
+		preview.NRows++
+	}
+}
+
+func (preview *LoadPreview) addBadRow(row int, err error) {
+	preview.NBadRows++
+	if len(preview.BadRows) < maxInferenceConflicts {
+		preview.BadRows = append(preview.BadRows, BadRow{Row: row, Error: err.Error()})
+	}
+}
+
+// conflictingValues finds values that don't fit a suggested type of a column
+func conflictingValues(values []string, inferred, suggested column.Schema, numbers column.NumberFormat, floats column.FloatPolicy) (ColumnInference, error) {
+	inf := ColumnInference{Column: inferred.Name, Before: inferred, After: suggested}
+	ch := column.NewChunk(column.DtypeString)
+	for _, val := range values {
+		// localised numbers only convert once normalised, values that are not numbers stay as they are
+		if normalised, err := numbers.Normalise(val); err == nil {
+			val = normalised
+		}
+		if err := ch.AddValue(val); err != nil {
+			return inf, err
+		}
+	}
+	_, conflicts, err := ch.ConvertLenient(suggested.Dtype, floats)
+	if err != nil {
+		return inf, err
+	}
+	inf.NConflicts = len(conflicts)
+	if len(conflicts) > maxInferenceConflicts {
+		conflicts = conflicts[:maxInferenceConflicts]
+	}
+	inf.Conflicts = conflicts
+	return inf, nil
+}
+
+// nullTokenCandidates lists values commonly used for missing data found in given columns (those
+// with suggestions, where these values are likely to conflict), the most frequent ones first
+func nullTokenCandidates(columns []string, values [][]string) []NullTokenCandidate {
+	var ret []NullTokenCandidate
+	found := make(map[string]int)
+	for j, name := range columns {
+		counts := make(map[string]int)
+		for _, val := range values[j] {
+			if commonNullTokens[strings.ToLower(val)] {
+				counts[val]++
+			}
+		}
+		for val, count := range counts {
+			pos, ok := found[val]
+			if !ok {
+				pos = len(ret)
+				found[val] = pos
+				ret = append(ret, NullTokenCandidate{Value: val})
+			}
+			ret[pos].Count += count
+			ret[pos].Columns = append(ret[pos].Columns, name)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count == ret[j].Count {
+			return ret[i].Value < ret[j].Value
+		}
+		return ret[i].Count > ret[j].Count
+	})
+	return ret
+}
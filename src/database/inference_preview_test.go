@@ -0,0 +1,132 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestPreviewingLoads(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	raw := "foo;bar;baz\n1;a;2020-01-01\n2;b\nNA;c;2020-01-02\n4;d;-\n5;\"e;2020-01-03\n"
+	preview, err := db.PreviewLoad(strings.NewReader(raw), 1<<20, LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &LoadPreview{
+		Dialect: Dialect{Compression: "none", Delimiter: "semicolon"},
+		Schema: column.TableSchema{
+			{Name: "foo", Dtype: column.DtypeString},
+			{Name: "bar", Dtype: column.DtypeString},
+			{Name: "baz", Dtype: column.DtypeString},
+		},
+		NRows: 3,
+		Suggestions: []ColumnInference{
+			{
+				Column: "foo", Before: column.Schema{Name: "foo", Dtype: column.DtypeString}, After: column.Schema{Name: "foo", Dtype: column.DtypeInt, Nullable: true},
+				NConflicts: 1, Conflicts: []column.ConversionConflict{{Row: 2, Value: "NA"}},
+			},
+			{
+				Column: "baz", Before: column.Schema{Name: "baz", Dtype: column.DtypeString}, After: column.Schema{Name: "baz", Dtype: column.DtypeDate, Nullable: true},
+				NConflicts: 1, Conflicts: []column.ConversionConflict{{Row: 3, Value: "-"}},
+			},
+		},
+		NullTokens: []NullTokenCandidate{{Value: "-", Count: 1, Columns: []string{"baz"}}, {Value: "NA", Count: 1, Columns: []string{"foo"}}},
+		NBadRows:   2,
+	}
+	if len(preview.BadRows) != 2 || preview.BadRows[0].Row != 1 || preview.BadRows[1].Row != 4 {
+		t.Errorf("expecting rows 1 and 4 to be reported as bad, got %+v", preview.BadRows)
+	}
+	preview.BadRows = nil
+	if !reflect.DeepEqual(preview, expected) {
+		t.Errorf("expecting a preview of %q to be %+v, got %+v", raw, expected, preview)
+	}
+
+	// suggested null tokens and hints get reflected
+	opts := LoadOptions{NullTokens: []string{"NA", "-"}, SchemaHints: SchemaHints{"bar": ColumnHint{Dtype: column.DtypeString, Nullable: new(bool)}}}
+	preview, err = db.PreviewLoad(strings.NewReader(raw), 1<<20, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := column.TableSchema{
+		{Name: "foo", Dtype: column.DtypeInt, Nullable: true},
+		{Name: "bar", Dtype: column.DtypeString},
+		{Name: "baz", Dtype: column.DtypeDate, Nullable: true},
+	}
+	if !reflect.DeepEqual(preview.Schema, schema) || len(preview.Suggestions) > 0 || len(preview.NullTokens) > 0 {
+		t.Errorf("expecting null tokens to resolve conflicts, got %+v", preview)
+	}
+}
+
+func TestPreviewingTruncatedLoads(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var raw bytes.Buffer
+	raw.WriteString("a,b\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString("123,foo\n")
+	}
+	// the only strings get cut off, so does the last row (it's only partially read)
+	raw.WriteString("bar,12345\n")
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data     []byte
+		maxBytes int
+		nrows    int
+	}{
+		{raw.Bytes(), raw.Len(), 1001},
+		{raw.Bytes(), raw.Len() - 3, 1000},
+		{raw.Bytes(), 15, 1},
+		{gzipped.Bytes(), gzipped.Len() - 10, -1},
+	}
+	for _, test := range tests {
+		preview, err := db.PreviewLoad(bytes.NewReader(test.data), test.maxBytes, LoadOptions{})
+		if err != nil {
+			t.Errorf("failed to preview %v bytes of data: %v", test.maxBytes, err)
+			continue
+		}
+		if preview.Truncated != (test.maxBytes < len(test.data)) || len(preview.BadRows) > 0 {
+			t.Errorf("unexpected preview of %v bytes of data: %+v", test.maxBytes, preview)
+		}
+		if test.nrows > -1 && preview.NRows != test.nrows {
+			t.Errorf("expecting %v rows in %v bytes of data, got %v", test.nrows, test.maxBytes, preview.NRows)
+		}
+		if test.nrows > -1 && test.nrows < 1001 && preview.Schema[0].Dtype != column.DtypeInt {
+			t.Errorf("expecting a cut off value not to be inferred, got %+v", preview.Schema)
+		}
+	}
+
+	if _, err := db.PreviewLoad(strings.NewReader(""), 100, LoadOptions{}); !errors.Is(err, errCannotInferTypes) {
+		t.Errorf("expecting a preview of no data to fail, got %v", err)
+	}
+}
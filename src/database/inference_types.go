@@ -2,15 +2,16 @@ package database
 
 import (
 	"bytes"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errCannotInferTypes = errors.New("cannot infer types")
+var errCannotInferTypes = errs.New(errs.ErrBadRequest, "cannot infer types")
+var errInvalidSchemaHint = errs.New(errs.ErrBadRequest, "invalid schema hint")
 
 func cleanupIdentifier(s, prefix string) string {
 	chars := bytes.TrimSpace([]byte(s))
@@ -83,24 +84,35 @@ func cleanupColumns(columns []string) []string {
 	return ret
 }
 
-// inferTypes loads a file from a path and tries to determine the schema of said file.
+// type inference of new data only looks at this many rows (see inferTypesFromSample)
+const inferenceSampleRows = 100_000
+
+// inferTypes reads cached incoming data and tries to determine their schema.
 // This is only about the schema, not the file format (delimiter, BOM, compression, ...), all
 // of that is within the loadSettings struct
-func inferTypes(path string, settings *loadSettings) (column.TableSchema, error) {
-	f, err := os.Open(path)
+func inferTypes(inc *incomingFile, settings *loadSettings) (column.TableSchema, error) {
+	schema, _, err := inferTypesFromSample(inc, settings, 0)
+	return schema, err
+}
+
+// inferTypesFromSample is inferTypes, which only reads the first maxRows rows (all of them if
+// zero), it reports whether it got to the end of our data. Types inferred from a sample get
+// enforced as data are loaded (see schemaViolation).
+func inferTypesFromSample(inc *incomingFile, settings *loadSettings, maxRows int) (_ column.TableSchema, complete bool, _ error) {
+	f, err := inc.open()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer f.Close()
 	rr, err := NewRowReader(f, settings)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	row, err := rr.ReadRow()
 	if err != nil {
 		// this may trigger an EOF, if the input file is empty - that's fine
-		return nil, err
+		return nil, false, err
 	}
 	// we're reusing records, so we need to copy here
 	hd := make([]string, len(row))
@@ -111,18 +123,31 @@ func inferTypes(path string, settings *loadSettings) (column.TableSchema, error)
 
 	tgs := make([]*column.TypeGuesser, 0, len(hd))
 	for range hd {
-		tgs = append(tgs, column.NewTypeGuesser())
+		tgs = append(tgs, column.NewTypeGuesserWithFormat(settings.numbers))
+	}
+	// empty values get replaced by defaults before they are loaded, so they may not be nulls
+	defaults := make([]string, len(hd))
+	for j, name := range hd {
+		defaults[j] = settings.defaults[name]
 	}
 
-	for {
+	complete = true
+	for nrows := 0; ; nrows++ {
+		if maxRows > 0 && nrows >= maxRows {
+			complete = false
+			break
+		}
 		row, err := rr.ReadRow()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			return nil, false, err
 		}
 		for j, val := range row {
+			if val == "" && defaults[j] != "" {
+				val = defaults[j]
+			}
 			tgs[j].AddValue(val)
 		}
 	}
@@ -130,10 +155,90 @@ func inferTypes(path string, settings *loadSettings) (column.TableSchema, error)
 	for j, tg := range tgs {
 		ret[j] = tg.InferredType()
 		if ret[j].Dtype == column.DtypeInvalid {
-			return nil, errCannotInferTypes
+			return nil, false, errCannotInferTypes
 		}
 		ret[j].Name = hd[j]
 	}
 
-	return ret, nil
+	return ret, complete, nil
+}
+
+// ColumnHint overrides the inferred type and/or nullability of a column, unset fields are inferred.
+// Hints can also be written as just their type (e.g. `"int"` instead of `{"dtype": "int"}`).
+// Dates and datetimes in formats we don't detect (e.g. `31/12/2020`) need their format declared,
+// such columns are dates (or datetimes for epoch timestamps), unless their type is given.
+// Hints can also add columns not in the input, see Default and Expression.
+type ColumnHint struct {
+	Dtype    column.Dtype      `json:"dtype"`
+	Nullable *bool             `json:"nullable,omitempty"`
+	Format   column.DateFormat `json:"format,omitempty"`
+	// Default replaces empty values (and null tokens), it's written as our canonical values are
+	// (e.g. `2020-12-31` or `1.5`), columns missing in the input hold it in all their rows
+	Default *string `json:"default,omitempty"`
+	// Expression computes a column not in the input from the other columns, e.g. `price * qty`,
+	// it gets evaluated as data get loaded and it's stored like any other column
+	// ARCH: hints are not persisted, so appended data need to contain derived columns themselves
+	Expression string `json:"expression,omitempty"`
+}
+
+func (ch *ColumnHint) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*ch = ColumnHint{}
+		return json.Unmarshal(data, &ch.Dtype)
+	}
+	type hint ColumnHint // avoids recursion
+	return json.Unmarshal(data, (*hint)(ch))
+}
+
+// SchemaHints are column hints keyed by column names (as they appear in the resulting dataset,
+// i.e. after they get cleaned up), columns not listed get inferred as usual
+type SchemaHints map[string]ColumnHint
+
+// apply overrides an inferred schema, all the hinted columns need to exist (unless they are
+// derived, see derivedColumns)
+// ARCH: data that don't fit hinted types only fail once they get loaded, not here
+func (hints SchemaHints) apply(schema column.TableSchema) error {
+	for name, hint := range hints {
+		idx, _, err := schema.LocateColumn(name)
+		if err != nil && hint.isDerived() {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSchemaHint, err)
+		}
+		if hint.Expression != "" {
+			// derivedColumns reports this
+			continue
+		}
+		dtype := hint.Dtype
+		if !hint.Format.IsCanonical() {
+			if dtype == column.DtypeInvalid {
+				dtype = hint.Format.Dtype()
+			}
+			// date layouts can hold datetimes as well, epoch timestamps are always datetimes
+			if !(dtype == hint.Format.Dtype() || dtype == column.DtypeDatetime) {
+				return fmt.Errorf("%w: %v cannot be a %v in the %v format", errInvalidSchemaHint, name, dtype, hint.Format)
+			}
+		}
+		if dtype != column.DtypeInvalid {
+			schema[idx].Dtype = dtype
+		}
+		if hint.Nullable != nil {
+			schema[idx].Nullable = *hint.Nullable
+		}
+	}
+	return nil
+}
+
+// dateFormats lists date formats of all the columns of a schema (hints of which have been applied),
+// columns without hinted formats get our canonical one
+// ARCH: formats only apply to the data they were hinted for, appended data need canonical dates
+func (hints SchemaHints) dateFormats(schema column.TableSchema) []column.DateFormat {
+	formats := make([]column.DateFormat, len(schema))
+	for name, hint := range hints {
+		if idx, _, err := schema.LocateColumn(name); err == nil {
+			formats[idx] = hint.Format
+		}
+	}
+	return formats
 }
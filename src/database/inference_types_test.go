@@ -93,7 +93,7 @@ func TestDatasetTypeInference(t *testing.T) {
 		if err := CacheIncomingFile(strings.NewReader(dataset.raw), f.Name()); err != nil {
 			t.Fatal(err)
 		}
-		cs, err := inferTypes(f.Name(), &loadSettings{})
+		cs, err := inferTypes(&incomingFile{path: f.Name()}, &loadSettings{})
 		if err != nil {
 			t.Error(err)
 			continue
@@ -106,7 +106,7 @@ func TestDatasetTypeInference(t *testing.T) {
 
 func TestInferTypesNoFile(t *testing.T) {
 	filename := filepath.Join(t.TempDir(), "does_not_exist.csv")
-	if _, err := inferTypes(filename, nil); !os.IsNotExist(err) {
+	if _, err := inferTypes(&incomingFile{path: filename}, nil); !os.IsNotExist(err) {
 		t.Errorf("expecting type inference on a non-existent file to throw a file not found error, got: %+v", err)
 	}
 }
@@ -118,7 +118,7 @@ func TestInferTypesEmptyFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	f.Close()
-	if _, err := inferTypes(filename, &loadSettings{}); err != io.EOF {
+	if _, err := inferTypes(&incomingFile{path: filename}, &loadSettings{}); err != io.EOF {
 		t.Errorf("expecting type inference on a non-existent file to throw a file not found error, got: %+v", err)
 	}
 }
@@ -129,7 +129,7 @@ func TestInferTypesInvalidCSV(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := inferTypes(filename, &loadSettings{}); !errors.Is(err, csv.ErrQuote) {
+	if _, err := inferTypes(&incomingFile{path: filename}, &loadSettings{}); !errors.Is(err, csv.ErrQuote) {
 		t.Errorf("type inference on an invalid CSV should throw a native error, csv.ErrQuote in this case, but got: %+v", err)
 	}
 }
@@ -140,7 +140,7 @@ func TestInferTypesOnlyHeader(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := inferTypes(filename, &loadSettings{}); !errors.Is(err, errCannotInferTypes) {
+	if _, err := inferTypes(&incomingFile{path: filename}, &loadSettings{}); !errors.Is(err, errCannotInferTypes) {
 		t.Errorf("type inference on a header-only file should fail with %v, got %v instead", errCannotInferTypes, err)
 	}
 }
@@ -153,7 +153,7 @@ func TestInferTypesNoloadSettings(t *testing.T) {
 	}
 	f.Close()
 
-	if _, err := inferTypes(filename, nil); err != errInvalidloadSettings {
+	if _, err := inferTypes(&incomingFile{path: filename}, nil); err != errInvalidloadSettings {
 		t.Errorf("when inferring types from a CSV, we need to submit load settings - did not submit them, but didn't get errInvalidloadSettings, got: %+v", err)
 	}
 }
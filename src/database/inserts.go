@@ -0,0 +1,202 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errNoRows = errs.New(errs.ErrBadRequest, "no rows to insert")
+
+// insertBuffer holds rows inserted into a dataset (see InsertRows) that have not been written yet,
+// we keep them in their textual form and only convert them to columns when flushing, so that they
+// get loaded into whatever the latest version of the dataset is at that point (e.g. one with
+// columns retyped in the meantime)
+type insertBuffer struct {
+	sync.Mutex
+	name  string
+	rows  [][]string
+	timer *time.Timer // pending periodic flush, if any
+	err   error       // the last periodic flush failed, we report it on the next insert
+}
+
+type inserts struct {
+	sync.Mutex
+	buffers map[string]*insertBuffer
+}
+
+func newInserts() *inserts {
+	return &inserts{buffers: make(map[string]*insertBuffer)}
+}
+
+func (ins *inserts) buffer(name string) *insertBuffer {
+	ins.Lock()
+	defer ins.Unlock()
+	buf, ok := ins.buffers[name]
+	if !ok {
+		buf = &insertBuffer{name: name}
+		ins.buffers[name] = buf
+	}
+	return buf
+}
+
+// discard throws away rows buffered for a given dataset (e.g. when it gets dropped)
+func (ins *inserts) discard(name string) {
+	ins.Lock()
+	buf, ok := ins.buffers[name]
+	delete(ins.buffers, name)
+	ins.Unlock()
+	if !ok {
+		return
+	}
+	buf.Lock()
+	defer buf.Unlock()
+	if buf.timer != nil {
+		buf.timer.Stop()
+		buf.timer = nil
+	}
+	buf.rows = nil
+}
+
+func (ins *inserts) discardAll() {
+	ins.Lock()
+	names := make([]string, 0, len(ins.buffers))
+	for name := range ins.buffers {
+		names = append(names, name)
+	}
+	ins.Unlock()
+	for _, name := range names {
+		ins.discard(name)
+	}
+}
+
+// InsertRows buffers rows to be added to the latest version of a given dataset. Values are
+// textual, the same way they'd be in a CSV (empty strings are nulls), and they get validated
+// against the dataset's schema right away. Buffered rows are written as a new stripe (and
+// a new version of the dataset) once there are Config.InsertBufferRows of them or once
+// Config.InsertFlushInterval elapses, until then they are not visible to queries (see
+// FlushInserts). It returns the number of rows buffered after this insert.
+// ARCH: buffered rows only live in memory, they are lost if we crash before flushing them
+// ARCH: each flush creates a new version with a small stripe, so frequent flushes result in many
+// versions and tiny stripes (see Config.RetainVersions and Compact)
+func (db *Database) InsertRows(name string, rows [][]string) (int, error) {
+	if len(rows) == 0 {
+		return 0, errNoRows
+	}
+	ds, err := db.GetDatasetLatest(name)
+	if err != nil {
+		return 0, err
+	}
+	if ds.External != nil {
+		return 0, errExternalReadOnly
+	}
+	if _, err := rowsToColumns(ds, rows); err != nil {
+		return 0, err
+	}
+
+	buf := db.inserts.buffer(ds.QualifiedName())
+	buf.Lock()
+	defer buf.Unlock()
+	if err := buf.err; err != nil {
+		buf.err = nil
+		return 0, fmt.Errorf("failed to flush previously inserted rows: %w", err)
+	}
+	buf.rows = append(buf.rows, rows...)
+	if len(buf.rows) >= db.Config.InsertBufferRows {
+		if _, err := db.flushBuffer(buf); err != nil {
+			return len(buf.rows), err
+		}
+		return 0, nil
+	}
+	if buf.timer == nil && db.Config.InsertFlushInterval > 0 {
+		buf.timer = time.AfterFunc(time.Duration(db.Config.InsertFlushInterval)*time.Millisecond, func() {
+			buf.Lock()
+			defer buf.Unlock()
+			buf.timer = nil
+			if _, err := db.flushBuffer(buf); err != nil {
+				buf.err = err
+			}
+		})
+	}
+	return len(buf.rows), nil
+}
+
+// FlushInserts writes all the rows buffered for a given dataset (see InsertRows), it returns the
+// resulting version of the dataset, or nil if there was nothing to flush
+func (db *Database) FlushInserts(name string) (*Dataset, error) {
+	db.inserts.Lock()
+	buf, ok := db.inserts.buffers[name]
+	db.inserts.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	buf.Lock()
+	defer buf.Unlock()
+	return db.flushBuffer(buf)
+}
+
+// FlushAllInserts writes rows buffered for all our datasets, it's meant to be called before
+// shutting down
+func (db *Database) FlushAllInserts() error {
+	db.inserts.Lock()
+	names := make([]string, 0, len(db.inserts.buffers))
+	for name := range db.inserts.buffers {
+		names = append(names, name)
+	}
+	db.inserts.Unlock()
+	for _, name := range names {
+		if _, err := db.FlushInserts(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushBuffer needs to be called with the buffer locked, so that concurrent flushes don't append
+// to the same version of a dataset (and not see each other's rows). Rows are retained if we
+// fail to write them.
+func (db *Database) flushBuffer(buf *insertBuffer) (*Dataset, error) {
+	if buf.timer != nil {
+		buf.timer.Stop()
+		buf.timer = nil
+	}
+	if len(buf.rows) == 0 {
+		return nil, nil
+	}
+	ds, err := db.GetDatasetLatest(buf.name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rowsToColumns(ds, buf.rows)
+	if err != nil {
+		return nil, err
+	}
+	appended, err := db.AppendResult(ds, data)
+	if err != nil {
+		return nil, err
+	}
+	buf.rows = nil
+	return appended, nil
+}
+
+// rowsToColumns loads textual rows into columns of a given dataset's types
+func rowsToColumns(ds *Dataset, rows [][]string) ([]*column.Chunk, error) {
+	data := make([]*column.Chunk, len(ds.Schema))
+	for j, col := range ds.Schema {
+		data[j] = column.NewChunk(col.Dtype)
+	}
+	for j, row := range rows {
+		if len(row) != len(ds.Schema) {
+			return nil, fmt.Errorf("%w: row %v has %v values, expecting %v", errSchemaMismatch, j, len(row), len(ds.Schema))
+		}
+		for k, val := range row {
+			if err := data[k].AddValueWithPolicy(val, ds.FloatPolicy); err != nil {
+				return nil, errs.Wrap(errs.ErrBadRequest, fmt.Errorf("row %v, column %v: %w", j, ds.Schema[k].Name, err))
+			}
+		}
+	}
+	return data, nil
+}
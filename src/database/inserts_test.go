@@ -0,0 +1,138 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+func TestInsertingRows(t *testing.T) {
+	db, err := NewDatabase("", &Config{InsertBufferRows: 3, InsertFlushInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	buffered, err := db.InsertRows("foo", [][]string{{"2", "y"}, {"", "z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffered != 2 {
+		t.Errorf("expecting two rows to be buffered, got %v", buffered)
+	}
+	if latest, err := db.GetDatasetLatest("foo"); err != nil || latest != ds {
+		t.Errorf("not expecting buffered rows to create a new version, got %v (%v)", latest, err)
+	}
+	// invalid rows get rejected right away, without affecting the buffer
+	for _, rows := range [][][]string{nil, {{"3"}}, {{"3", "x"}, {"foo", "y"}}} {
+		_, err := db.InsertRows("foo", rows)
+		if !errors.Is(err, errs.ErrBadRequest) {
+			t.Errorf("expecting %v to be rejected as a bad request, got %v", rows, err)
+		}
+	}
+	if _, err := db.InsertRows("bar", [][]string{{"1"}}); !errors.Is(err, errDatasetNotFound) {
+		t.Errorf("expecting inserts into unknown datasets to fail, got %v", err)
+	}
+
+	// reaching the buffer size flushes all the rows
+	buffered, err = db.InsertRows("foo", [][]string{{"4", "w"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffered != 0 {
+		t.Errorf("expecting the buffer to be flushed, got %v rows", buffered)
+	}
+	latest, err := db.GetDatasetLatest("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == ds || latest.NRows != 4 || len(latest.Stripes) != 2 || !latest.Schema[0].Nullable {
+		t.Errorf("expecting inserted rows in a new version, got %+v", latest)
+	}
+	cols, _, err := db.ReadColumnsFromStripeByNames(latest, latest.Stripes[1], []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols["a"].Len() != 3 || cols["b"].Len() != 3 {
+		t.Errorf("expecting the new stripe to contain all three rows, got %v", cols["a"].Len())
+	}
+
+	// explicit flushes
+	if flushed, err := db.FlushInserts("foo"); err != nil || flushed != nil {
+		t.Errorf("not expecting an empty buffer to flush, got %v, %v", flushed, err)
+	}
+	if _, err := db.InsertRows("foo", [][]string{{"5", "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := db.FlushInserts("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed == nil || flushed.NRows != 5 {
+		t.Errorf("expecting a flush to result in a new version, got %+v", flushed)
+	}
+
+	// rows buffered for dropped datasets are discarded
+	if _, err := db.InsertRows("foo", [][]string{{"6", "u"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropDataset("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushAllInserts(); err != nil {
+		t.Errorf("not expecting rows of dropped datasets to be flushed, got %v", err)
+	}
+}
+
+func TestPeriodicInsertFlushes(t *testing.T) {
+	db, err := NewDatabase("", &Config{InsertFlushInterval: 10}, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	for j := 2; j < 5; j++ {
+		if _, err := db.InsertRows("foo", [][]string{{strconv.Itoa(j)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		latest, err := db.GetDatasetLatest("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.NRows == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting buffered rows to be flushed periodically, got %v rows", latest.NRows)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errJobNotFound = errs.New(errs.ErrNotFound, "job not found")
+
+// finished jobs are kept around (so that clients can poll them), but only this many of them
+const maxFinishedJobs = 100
+
+// JobStatus describes where a job is in its lifecycle
+type JobStatus string
+
+// jobs start queued, they run once there's a free worker and they end up either finished or failed
+const (
+	JobQueued   JobStatus = "queued"
+	JobRunning  JobStatus = "running"
+	JobFinished JobStatus = "finished"
+	JobFailed   JobStatus = "failed"
+)
+
+// Job is a background ingestion of data - raw data get cached upon submission, but they only get
+// parsed and loaded into a new dataset (version) once there's a free worker (see Config.IngestWorkers).
+// This is a snapshot of a job's state, see GetJob for its current state.
+// ARCH: jobs only live in memory, they don't survive restarts (and neither do queued data)
+type Job struct {
+	ID         UID        `json:"id"`
+	Name       string     `json:"name"` // name of the dataset being loaded (or appended to)
+	Status     JobStatus  `json:"status"`
+	Submitted  time.Time  `json:"submitted"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	BytesTotal int64      `json:"bytes_total"` // size of the raw data (they may be compressed)
+	BytesRead  int64      `json:"bytes_read"`
+	Rows       int64      `json:"rows"` // rows ingested so far
+	Error      string     `json:"error,omitempty"`
+	Dataset    *Dataset   `json:"dataset,omitempty"` // set once finished
+}
+
+// loadProgress gets updated as data get loaded, it's accessed atomically, so that it can be
+// read while loading is in progress
+type loadProgress struct {
+	bytes int64
+	rows  int64
+}
+
+// countingReader tracks how much has been read from a given reader
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+type job struct {
+	Job
+	progress loadProgress
+}
+
+// jobs holds all the queued, running and recently finished jobs, `workers` limits how many of
+// them run at the same time
+type jobs struct {
+	sync.Mutex
+	jobs     map[UID]*job
+	finished []UID // oldest first
+	workers  chan struct{}
+}
+
+func newJobs(workers int) *jobs {
+	return &jobs{
+		jobs:    make(map[UID]*job),
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// GetJob reports the current state of a given job
+func (db *Database) GetJob(id UID) (Job, error) {
+	db.jobs.Lock()
+	defer db.jobs.Unlock()
+	jb, ok := db.jobs.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %v", errJobNotFound, id)
+	}
+	ret := jb.Job
+	if ret.Status == JobRunning {
+		ret.BytesRead = atomic.LoadInt64(&jb.progress.bytes)
+		ret.Rows = atomic.LoadInt64(&jb.progress.rows)
+	}
+	return ret, nil
+}
+
+// SubmitLoad is an asynchronous version of LoadDatasetFromReaderAutoWithOptions - data get cached
+// right away, but they only get loaded (and the resulting dataset added to our database) in
+// a background job, which can be polled using GetJob
+func (db *Database) SubmitLoad(name string, r io.Reader, opts LoadOptions) (Job, error) {
+	return db.submitJob(name, r, func(inc *incomingFile, progress *loadProgress) (*Dataset, error) {
+		opts.progress = progress
+		ds, err := db.loadDatasetFromIncomingAuto(name, inc, opts)
+		if err != nil {
+			return nil, err
+		}
+		if size, err := inc.size(); err == nil {
+			ds.SizeRaw = size
+		}
+		if err := db.AddDataset(ds); err != nil {
+			return nil, err
+		}
+		return ds, nil
+	})
+}
+
+// SubmitAppend is an asynchronous version of AppendToDatasetWithOptions, see SubmitLoad
+func (db *Database) SubmitAppend(ds *Dataset, r io.Reader, policy WideningPolicy, opts LoadOptions) (Job, error) {
+	return db.submitJob(ds.QualifiedName(), r, func(inc *incomingFile, progress *loadProgress) (*Dataset, error) {
+		opts.progress = progress
+		return db.appendToDataset(ds, inc, policy, opts)
+	})
+}
+
+func (db *Database) submitJob(name string, r io.Reader, load func(*incomingFile, *loadProgress) (*Dataset, error)) (Job, error) {
+	inc, err := db.cacheIncoming(r)
+	if err != nil {
+		return Job{}, err
+	}
+	size, err := inc.size()
+	if err != nil {
+		inc.remove()
+		return Job{}, err
+	}
+	jb := &job{Job: Job{
+		ID:         newUID(OtypeJob),
+		Name:       name,
+		Status:     JobQueued,
+		Submitted:  time.Now().UTC(),
+		BytesTotal: size,
+	}}
+	db.jobs.Lock()
+	db.jobs.jobs[jb.ID] = jb
+	submitted := jb.Job
+	db.jobs.Unlock()
+
+	go func() {
+		db.jobs.workers <- struct{}{}
+		defer func() { <-db.jobs.workers }()
+		defer inc.remove()
+
+		db.jobs.Lock()
+		jb.Status = JobRunning
+		db.jobs.Unlock()
+
+		ds, err := load(inc, &jb.progress)
+		db.jobs.finish(jb, ds, err)
+	}()
+	return submitted, nil
+}
+
+// finish records the outcome of a job and prunes old finished jobs
+func (js *jobs) finish(jb *job, ds *Dataset, err error) {
+	js.Lock()
+	defer js.Unlock()
+	jb.BytesRead = atomic.LoadInt64(&jb.progress.bytes)
+	jb.Rows = atomic.LoadInt64(&jb.progress.rows)
+	finished := time.Now().UTC()
+	jb.Finished = &finished
+	jb.Status = JobFinished
+	jb.Dataset = ds
+	if err != nil {
+		jb.Status = JobFailed
+		jb.Error = err.Error()
+	}
+	js.finished = append(js.finished, jb.ID)
+	if len(js.finished) > maxFinishedJobs {
+		delete(js.jobs, js.finished[0])
+		js.finished = js.finished[1:]
+	}
+}
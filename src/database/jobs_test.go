@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob polls a job until it's done (or until we give up)
+func waitForJob(t *testing.T, db *Database, id UID) Job {
+	for j := 0; j < 500; j++ {
+		job, err := db.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == JobFinished || job.Status == JobFailed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %v did not finish in time", id)
+	return Job{}
+}
+
+func TestIngestionJobs(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2, IngestWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	data := "foo,bar\n1,2\n3,4\n5,6\n"
+	job, err := db.SubmitLoad("foo", strings.NewReader(data), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID.Otype != OtypeJob || job.BytesTotal != int64(len(data)) || job.Name != "foo" {
+		t.Errorf("unexpected job submitted: %+v", job)
+	}
+	job = waitForJob(t, db, job.ID)
+	if job.Status != JobFinished || job.Rows != 3 || job.BytesRead != int64(len(data)) || job.Finished == nil || job.Dataset == nil {
+		t.Fatalf("unexpected job finished: %+v", job)
+	}
+	ds, err := db.GetDatasetLatest("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.ID != job.Dataset.ID || len(ds.Stripes) != 2 {
+		t.Errorf("expecting the loaded dataset to be added, got %+v", ds)
+	}
+
+	// appends work the same way, failures get reported via the job
+	appended, err := db.SubmitAppend(ds, strings.NewReader("foo,bar\n7,8\n"), WideningNone, LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := db.SubmitAppend(ds, strings.NewReader("foo,baz\n7,8\n"), WideningNone, LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, db, appended.ID); job.Status != JobFinished || job.Dataset.NRows != 4 {
+		t.Errorf("expecting an append to succeed, got %+v", job)
+	}
+	if job := waitForJob(t, db, failed.ID); job.Status != JobFailed || !strings.Contains(job.Error, errSchemaMismatch.Error()) || job.Dataset != nil {
+		t.Errorf("expecting an append to fail, got %+v", job)
+	}
+
+	if _, err := db.GetJob(newUID(OtypeJob)); !errors.Is(err, errJobNotFound) {
+		t.Errorf("expecting unknown jobs not to be found, got %v", err)
+	}
+}
+
+func TestFinishedJobsPruning(t *testing.T) {
+	js := newJobs(1)
+	var ids []UID
+	for j := 0; j < maxFinishedJobs+5; j++ {
+		jb := &job{Job: Job{ID: newUID(OtypeJob)}}
+		js.jobs[jb.ID] = jb
+		js.finish(jb, nil, nil)
+		ids = append(ids, jb.ID)
+	}
+	if len(js.jobs) != maxFinishedJobs {
+		t.Errorf("expecting %v jobs to be kept, got %v", maxFinishedJobs, len(js.jobs))
+	}
+	if _, ok := js.jobs[ids[4]]; ok {
+		t.Error("expecting the oldest jobs to be pruned")
+	}
+	if _, ok := js.jobs[ids[5]]; !ok {
+		t.Error("expecting newer jobs to be kept")
+	}
+}
@@ -14,9 +14,13 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/kokes/smda/src/bitmap"
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
 )
 
 // ARCH: reintroduce versioning (and consider how it plays along with manifest files)
@@ -29,10 +33,14 @@ import (
 var errIncorrectChecksum = errors.New("could not validate data on disk: incorrect checksum")
 var errInvalidloadSettings = errors.New("expecting load settings for a rawLoader, got nil")
 var errInvalidOffsetData = errors.New("invalid offset data")
-var errSchemaMismatch = errors.New("dataset does not conform to the schema provided")
+var errSchemaMismatch = errs.New(errs.ErrBadRequest, "dataset does not conform to the schema provided")
+var errInvalidAppend = errs.New(errs.ErrBadRequest, "invalid append")
 var errNoMapData = errors.New("cannot load data from a map with no data")
 var errLengthMismatch = errors.New("column length mismatch")
 var errCannotWriteCompression = errors.New("cannot write data compressed by this compression")
+var errInvalidDialect = errs.New(errs.ErrBadRequest, "invalid CSV dialect")
+var errUnexpectedNull = errors.New("null in a column that is not nullable")
+var errNotSorted = errs.New(errs.ErrBadRequest, "data not sorted by the given sort key")
 
 // LoadSampleData reads all CSVs from a given directory and loads them up into the database
 // using default settings
@@ -77,19 +85,91 @@ func CacheIncomingFile(r io.Reader, path string) error {
 	return nil
 }
 
+// incomingFile holds raw data cached before they get loaded - we need to read them several
+// times over (to infer their format, then their schema and only then to load them). Data are
+// cached in a temporary file, unless we're an in-memory database, in which case they stay in RAM.
+type incomingFile struct {
+	path string // empty for data held in memory
+	data []byte
+}
+
+func (db *Database) cacheIncoming(r io.Reader) (*incomingFile, error) {
+	if db.inMemory {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return &incomingFile{data: data}, nil
+	}
+	f, err := os.CreateTemp("", "")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := CacheIncomingFile(r, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &incomingFile{path: f.Name()}, nil
+}
+
+func (inc *incomingFile) open() (io.ReadCloser, error) {
+	if inc.path == "" {
+		return io.NopCloser(bytes.NewReader(inc.data)), nil
+	}
+	return os.Open(inc.path)
+}
+
+func (inc *incomingFile) size() (int64, error) {
+	if inc.path == "" {
+		return int64(len(inc.data)), nil
+	}
+	stat, err := os.Stat(inc.path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (inc *incomingFile) remove() error {
+	if inc.path == "" {
+		inc.data = nil
+		return nil
+	}
+	return os.Remove(inc.path)
+}
+
 // ARCH: we might want to separate out there row reader thingies into a separate file,
 // because this loader.go file is more about high level operations (read dataset, read into stripe etc.)
 type loadSettings struct {
 	// ARCH: consider the following
 	// encoding
-	// hasHeader
 	// discardExtraColumns
 	// allowFewerColumns
-	cleanupColumns   bool
-	readCompression  compression
-	delimiter        delimiter
+	cleanupColumns  bool
+	readCompression compression
+	delimiter       delimiter
+	// quote characters default to `"`, files without quoting are split on delimiters only
+	quote    byte
+	noQuotes bool
+	// headerless files get a header of empty names (cleanupColumns turns them into column_01 etc.)
+	noHeader bool
+	// values loaded as nulls (in addition to empty strings)
+	nullTokens       []string
 	schema           column.TableSchema
 	writeCompression compression
+	floats           column.FloatPolicy
+	numbers          column.NumberFormat
+	// formats of dates in individual columns of the schema, all canonical if nil (see ColumnHint)
+	dates []column.DateFormat
+	// values of empty fields, keyed by column names, and columns appended to our input (these are
+	// not a part of `schema`, see datasetSchema)
+	defaults  map[string]string
+	derived   []derivedColumn
+	namespace string
+	sortKey   []string
+	// updated as data get loaded, if set (see Job)
+	progress *loadProgress
 }
 
 type RowReader interface {
@@ -105,34 +185,77 @@ func NewRowReader(r io.Reader, settings *loadSettings) (RowReader, error) {
 	if settings == nil {
 		return nil, errInvalidloadSettings
 	}
-	ur, err := readCompressed(r, settings.readCompression)
+	dr, err := decodeInput(r, settings)
 	if err != nil {
 		return nil, err
 	}
-	bl, err := skipBom(ur)
+	return newRowReaderFromDecoded(dr, settings, true)
+}
+
+// decodeInput decompresses raw input and strips its BOM, if there is one
+func decodeInput(r io.Reader, settings *loadSettings) (io.Reader, error) {
+	ur, err := readCompressed(r, settings.readCompression)
 	if err != nil {
 		return nil, err
 	}
-	if settings.delimiter == delimiterTab {
-		return newTSVReader(bl), nil
+	return skipBom(ur)
+}
+
+// newRowReaderFromDecoded is NewRowReader for input that has already been decoded (see decodeInput),
+// blocks of rows cut out of the middle of a file (see rowSplitter) have no header
+func newRowReaderFromDecoded(r io.Reader, settings *loadSettings, header bool) (RowReader, error) {
+	var rr RowReader
+	if settings.delimiter == delimiterTab || settings.noQuotes {
+		dlim := settings.delimiter
+		if dlim == delimiterNone {
+			dlim = delimiterComma
+		}
+		rr = newTSVReader(r, dlim)
+	} else {
+		var err error
+		rr, err = newCSVReader(r, settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the header is always the first row, so that null tokens don't apply to it
+	if header && settings.noHeader {
+		rr = &headerlessReader{rr: rr}
+	}
+	if len(settings.nullTokens) > 0 {
+		ntr := newNullTokenReader(rr, settings.nullTokens)
+		ntr.headerRead = !header
+		rr = ntr
 	}
 
-	return newCSVReader(bl, settings)
+	return rr, nil
 }
 
 type csvReader struct {
 	cr *csv.Reader
+	// encoding/csv only supports `"` as a quote character, so to support other quote characters,
+	// we swap them for `"` (and vice versa) in the input and then swap them back in parsed values
+	swapQuote byte
 }
 
 func newCSVReader(r io.Reader, settings *loadSettings) (*csvReader, error) {
+	csvr := &csvReader{}
+	if settings.quote != 0 && settings.quote != '"' {
+		if settings.delimiter == delimiter(settings.quote) || settings.delimiter == '"' {
+			return nil, fmt.Errorf("%w: cannot use %q as both a delimiter and a quote character", errInvalidDialect, settings.delimiter)
+		}
+		csvr.swapQuote = settings.quote
+		r = &quoteSwapper{r: r, quote: settings.quote}
+	}
 	cr := csv.NewReader(r)
 	cr.ReuseRecord = true
 	if settings.delimiter != delimiterNone {
 		// we purposefully chose a single byte instead of a rune as a delimiter
 		cr.Comma = rune(settings.delimiter)
 	}
+	csvr.cr = cr
 
-	return &csvReader{cr: cr}, nil
+	return csvr, nil
 }
 
 func (csvr *csvReader) ReadRow() ([]string, error) {
@@ -141,18 +264,65 @@ func (csvr *csvReader) ReadRow() ([]string, error) {
 	// we will handle column counts ourselves
 	// but we'll still return EOFs for the consumer to handle
 	if err != nil && err != csv.ErrFieldCount {
+		// malformed files (e.g. unterminated quotes) are not our fault
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return nil, errs.Wrap(errs.ErrBadRequest, err)
+		}
 		return nil, err
 	}
+	if csvr.swapQuote != 0 {
+		for j, val := range row {
+			row[j] = swapQuotes(val, csvr.swapQuote)
+		}
+	}
 	return row, nil
 }
 
+func swapQuotes(s string, quote byte) string {
+	if strings.IndexByte(s, quote) == -1 && strings.IndexByte(s, '"') == -1 {
+		return s
+	}
+	ret := []byte(s)
+	for j, char := range ret {
+		switch char {
+		case quote:
+			ret[j] = '"'
+		case '"':
+			ret[j] = quote
+		}
+	}
+	return string(ret)
+}
+
+type quoteSwapper struct {
+	r     io.Reader
+	quote byte
+}
+
+func (qs *quoteSwapper) Read(p []byte) (int, error) {
+	n, err := qs.r.Read(p)
+	for j, char := range p[:n] {
+		switch char {
+		case qs.quote:
+			p[j] = '"'
+		case '"':
+			p[j] = qs.quote
+		}
+	}
+	return n, err
+}
+
+// tsvReader reads TSVs, but also any other files without quoting, it just splits lines
+// on a given delimiter
 type tsvReader struct {
-	scanner *bufio.Scanner
+	scanner   *bufio.Scanner
+	delimiter string
 }
 
-func newTSVReader(r io.Reader) *tsvReader {
+func newTSVReader(r io.Reader, dlim delimiter) *tsvReader {
 	scanner := bufio.NewScanner(r)
-	return &tsvReader{scanner: scanner}
+	return &tsvReader{scanner: scanner, delimiter: string(rune(dlim))}
 }
 
 func (tsvr *tsvReader) ReadRow() ([]string, error) {
@@ -164,7 +334,67 @@ func (tsvr *tsvReader) ReadRow() ([]string, error) {
 
 		return nil, err
 	}
-	return strings.Split(tsvr.scanner.Text(), "\t"), nil
+	return strings.Split(tsvr.scanner.Text(), tsvr.delimiter), nil
+}
+
+// headerlessReader yields a header of empty column names first, then all the rows, including
+// the very first one
+type headerlessReader struct {
+	rr    RowReader
+	first []string
+	state int // 0 = nothing read yet, 1 = header yielded, 2 = first row yielded
+}
+
+func (hr *headerlessReader) ReadRow() ([]string, error) {
+	switch hr.state {
+	case 0:
+		row, err := hr.rr.ReadRow()
+		if err != nil {
+			return nil, err
+		}
+		// rows may get reused by the underlying reader
+		hr.first = make([]string, len(row))
+		copy(hr.first, row)
+		hr.state = 1
+		return make([]string, len(row)), nil
+	case 1:
+		hr.state = 2
+		return hr.first, nil
+	}
+	return hr.rr.ReadRow()
+}
+
+// nullTokenReader replaces given tokens (e.g. NA or \N) with empty strings, which we load
+// as nulls, the first row is left as is, because it's the header
+type nullTokenReader struct {
+	rr         RowReader
+	tokens     map[string]bool
+	headerRead bool
+}
+
+func newNullTokenReader(rr RowReader, tokens []string) *nullTokenReader {
+	ntr := &nullTokenReader{rr: rr, tokens: make(map[string]bool, len(tokens))}
+	for _, token := range tokens {
+		ntr.tokens[token] = true
+	}
+	return ntr
+}
+
+func (ntr *nullTokenReader) ReadRow() ([]string, error) {
+	row, err := ntr.rr.ReadRow()
+	if err != nil {
+		return nil, err
+	}
+	if !ntr.headerRead {
+		ntr.headerRead = true
+		return row, nil
+	}
+	for j, val := range row {
+		if ntr.tokens[val] {
+			row[j] = ""
+		}
+	}
+	return row, nil
 }
 
 var bomBytes []byte = []byte{0xEF, 0xBB, 0xBF}
@@ -202,8 +432,11 @@ func writeCompressed(w io.Writer, ctype compression) (io.WriteCloser, error) {
 		return gzip.NewWriter(w), nil
 	case compressionSnappy:
 		return snappy.NewBufferedWriter(w), nil
+	case compressionZstd:
+		// OPTIM: we create a new encoder for each chunk, we could pool them and use Reset
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
 	}
-	// TODO: lz4, zstd
+	// TODO: lz4
 	return nil, fmt.Errorf("%w: %v", errCannotWriteCompression, ctype)
 }
 
@@ -213,82 +446,250 @@ func (ds *stripeData) writeToWriter(w io.Writer, ctype compression) (nbytes int6
 	offsets = make([]uint32, 0, 1+len(ds.columns))
 	offsets = append(offsets, 0)
 	buf := new(bytes.Buffer)
-	for _, column := range ds.columns {
-		// OPTIM: we used to marshal into byte slices, so that we could checksum our data,
-		// which can be done by writing to intermediate io.Writers instead, as shown here,
-		// but we'd like to eliminate the buffer entirely and write into the underlying writer,
-		// perhaps using io.MultiWriter, but that would mean placing the checksum AFTER the column
-		// THOUGH PERHAPS we could just eliminate the checksum entirely and put it in our manifest file
-		// will that help us with reads though? We will still have to load the whole chunk to checksum it
-		if err := buf.WriteByte(byte(ctype)); err != nil {
-			return 0, nil, err
-		}
-		if ctype == compressionNone {
-			if _, err := column.WriteTo(buf); err != nil {
-				return 0, nil, err
-			}
-		} else {
-			cw, err := writeCompressed(buf, ctype)
-			if err != nil {
-				return 0, nil, err
-			}
-			if _, err := column.WriteTo(cw); err != nil {
-				// TODO: are we leaking resources by not closing the writer here?
-				return 0, nil, err
-			}
-			if err := cw.Close(); err != nil {
-				return 0, nil, err
-			}
-		}
-
-		nw := buf.Len()
-		checksum := crc32.ChecksumIEEE(buf.Bytes())
-		if err := binary.Write(w, binary.LittleEndian, checksum); err != nil {
+	rle := false
+	encodings := make([]column.Encoding, 0, len(ds.columns))
+	for _, col := range ds.columns {
+		encoding := col.PreferredEncoding()
+		rle = rle || encoding == column.EncodingRLE
+		encodings = append(encodings, encoding)
+	}
+	splits := make([]uint32, len(ds.columns))
+	split := false
+	for j, col := range ds.columns {
+		nw, head, err := writeColumn(w, buf, col, encodings[j], ctype)
+		if err != nil {
 			return 0, nil, err
 		}
-		if _, err := io.Copy(w, buf); err != nil {
-			return 0, nil, err
+		if head > 0 {
+			splits[j] = totalOffset + head
+			split = true
 		}
-		totalOffset += 4 + uint32(nw) // checksum + byte slice length
+		totalOffset += nw
 		offsets = append(offsets, totalOffset)
-		buf.Reset()
 	}
 
+	// plain encoding is the default, so we only keep track of encodings if there's anything else
+	if rle {
+		ds.meta.Encodings = encodings
+	}
+	if split {
+		ds.meta.Splits = splits
+	}
 	return int64(totalOffset), offsets, nil
 }
 
-func (db *Database) writeStripeToFile(ds *Dataset, stripe *stripeData, ctype compression) (int64, error) {
-	if err := os.MkdirAll(db.DatasetPath(ds), os.ModePerm); err != nil {
+// writeColumn writes a single column of a stripe and returns the number of bytes written, buf is a reusable
+// scratch buffer. Plain encoded string columns get written in two sections - offsets and contents - so
+// that we can read just the offsets (see StripeReader.ReadColumnOffsets), in which case we also return
+// the size of the first section (it's zero for columns written in one piece).
+func writeColumn(w io.Writer, buf *bytes.Buffer, col *column.Chunk, encoding column.Encoding, ctype compression) (uint32, uint32, error) {
+	if col.Dtype() == column.DtypeString && encoding == column.EncodingPlain {
+		head, err := writeSection(w, buf, col.WriteOffsetsTo, ctype)
+		if err != nil {
+			return 0, 0, err
+		}
+		contents, err := writeSection(w, buf, col.WriteStringsTo, ctype)
+		if err != nil {
+			return 0, 0, err
+		}
+		return head + contents, head, nil
+	}
+	writeChunk := col.WriteTo
+	if encoding == column.EncodingRLE {
+		writeChunk = col.WriteRLETo
+	}
+	nw, err := writeSection(w, buf, writeChunk, ctype)
+	return nw, 0, err
+}
+
+// writeSection writes a checksum, followed by the compression type and the compressed output of writeChunk
+func writeSection(w io.Writer, buf *bytes.Buffer, writeChunk func(io.Writer) (int64, error), ctype compression) (uint32, error) {
+	buf.Reset()
+	// OPTIM: we used to marshal into byte slices, so that we could checksum our data,
+	// which can be done by writing to intermediate io.Writers instead, as shown here,
+	// but we'd like to eliminate the buffer entirely and write into the underlying writer,
+	// perhaps using io.MultiWriter, but that would mean placing the checksum AFTER the column
+	// THOUGH PERHAPS we could just eliminate the checksum entirely and put it in our manifest file
+	// will that help us with reads though? We will still have to load the whole chunk to checksum it
+	if err := buf.WriteByte(byte(ctype)); err != nil {
 		return 0, err
 	}
+	if ctype == compressionNone {
+		if _, err := writeChunk(buf); err != nil {
+			return 0, err
+		}
+	} else {
+		cw, err := writeCompressed(buf, ctype)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := writeChunk(cw); err != nil {
+			// TODO: are we leaking resources by not closing the writer here?
+			return 0, err
+		}
+		if err := cw.Close(); err != nil {
+			return 0, err
+		}
+	}
 
-	f, err := os.Create(db.stripePath(ds, stripe.meta))
-	if err != nil {
+	nw := buf.Len()
+	checksum := crc32.ChecksumIEEE(buf.Bytes())
+	if err := binary.Write(w, binary.LittleEndian, checksum); err != nil {
 		return 0, err
 	}
-	defer f.Close()
-	bw := bufio.NewWriter(f)
-	defer bw.Flush()
+	if _, err := io.Copy(w, buf); err != nil {
+		return 0, err
+	}
+	return 4 + uint32(nw), nil // checksum + byte slice length
+}
 
-	nbytes, offsets, err := stripe.writeToWriter(bw, ctype)
+func (db *Database) writeStripeToFile(ds *Dataset, stripe *stripeData, ctype compression) (int64, error) {
+	// nothing gets stored until the writer gets closed, so there's nothing to clean up upon failure
+	w := db.newBlobWriter(ds)
+	nbytes, offsets, err := stripe.writeToWriter(w, ctype)
 	if err != nil {
 		return 0, err
 	}
+	if db.Config.BloomFilters {
+		filters := make([][]byte, len(stripe.columns))
+		for j, col := range stripe.columns {
+			if filter := newBloomFilter(col); filter != nil {
+				filters[j] = filter.Bytes()
+			}
+		}
+		nb, blooms, err := writeBloomFilters(w, uint32(nbytes), filters)
+		if err != nil {
+			return 0, err
+		}
+		nbytes += nb
+		stripe.meta.Blooms = blooms
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
 	// ARCH: we're "injecting" offsets into a passed-in stripeData pointer,
 	// should we return this instead and let the caller work with it?
 	stripe.meta.Offsets = offsets
+	stripe.meta.Hash = w.hash
 	return nbytes, nil
 }
 
+// removeStripes cleans up after datasets that failed to load (e.g. due to malformed data or
+// aborted uploads), so that we don't leave behind stripes no manifest refers to. Only stripes
+// written for a given dataset (and not yet added to our database) get removed, those shared
+// with other datasets are retained.
+// ARCH: this is best effort, errors are ignored, since we're already handling one
+func (db *Database) removeStripes(ds *Dataset, stripes []Stripe) {
+	keys := make([]string, 0, len(stripes))
+	for _, stripe := range stripes {
+		keys = append(keys, stripeKey(ds, stripe))
+	}
+	db.Lock()
+	orphaned := db.blobs.unreference(db.blobs.dropPending(ds, keys))
+	db.Unlock()
+	db.removeBlobs(orphaned)
+}
+
+// sortChecker verifies that incoming data are sorted by a given key (ascending, nulls last), it
+// remembers the last row of each stripe, so that stripe boundaries get checked as well
+type sortChecker struct {
+	idxs []int
+	last []*column.Chunk
+}
+
+func newSortChecker(key []string, schema column.TableSchema) (*sortChecker, error) {
+	sc := &sortChecker{idxs: make([]int, 0, len(key))}
+	for _, name := range key {
+		idx, _, err := schema.LocateColumn(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errNotSorted, err)
+		}
+		sc.idxs = append(sc.idxs, idx)
+	}
+	return sc, nil
+}
+
+func compareKeys(key []*column.Chunk, i, j int) int {
+	for _, col := range key {
+		if cmp := col.Compare(true, false, i, j); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+func (sc *sortChecker) check(columns []*column.Chunk) error {
+	key := make([]*column.Chunk, 0, len(sc.idxs))
+	for _, idx := range sc.idxs {
+		key = append(key, columns[idx])
+	}
+	length := key[0].Len()
+	// the boundary check: previous stripe's last row followed by this stripe's first row
+	first := bitmap.NewBitmap(length)
+	first.Set(0, true)
+	if sc.last != nil {
+		boundary := make([]*column.Chunk, 0, len(key))
+		for j, col := range key {
+			pair := sc.last[j].Clone()
+			if err := pair.Append(col.Prune(first)); err != nil {
+				return err
+			}
+			boundary = append(boundary, pair)
+		}
+		if compareKeys(boundary, 0, 1) > 0 {
+			return fmt.Errorf("%w: stripe boundary out of order", errNotSorted)
+		}
+	}
+	for j := 1; j < length; j++ {
+		if compareKeys(key, j-1, j) > 0 {
+			return fmt.Errorf("%w: row %v out of order", errNotSorted, j)
+		}
+	}
+	last := bitmap.NewBitmap(length)
+	last.Set(length-1, true)
+	sc.last = sc.last[:0]
+	for _, col := range key {
+		sc.last = append(sc.last, col.Prune(last))
+	}
+	return nil
+}
+
+// schemaViolation is a value that doesn't fit the type (or nullability) of its column, this
+// happens when types are inferred from a sample of our data (see inferTypesFromSample) or when
+// they are declared upfront (see SchemaHints)
+type schemaViolation struct {
+	column string
+	err    error
+}
+
+func (sv *schemaViolation) Error() string {
+	return fmt.Sprintf("failed to populate column %v: %v", sv.column, sv.err)
+}
+
+func (sv *schemaViolation) Unwrap() error {
+	return sv.err
+}
+
 // readIntoStripe reads data from a source file and saves them into a stripe
 // maybe these two arguments can be embedded into rl.settings?
-func newStripeFromReader(rr RowReader, schema column.TableSchema, maxRows, maxBytes int) (*stripeData, error) {
+func newStripeFromReader(rr RowReader, schema column.TableSchema, floats column.FloatPolicy, numbers column.NumberFormat, dates []column.DateFormat, defaults map[string]string, maxRows, maxBytes int) (*stripeData, error) {
 	ds := newDataStripe()
 
 	// given a schema, initialise a data stripe
 	ds.columns = make([]*column.Chunk, 0, len(schema))
-	for _, col := range schema {
+	// numbers formatted according to a locale need to be normalised before they get parsed
+	localised := make([]bool, len(schema))
+	// and so do dates in formats other than ours
+	dated := make([]bool, len(schema))
+	// empty strings are nulls, unless they are in string columns (or unless they have defaults)
+	nullable := make([]bool, len(schema))
+	defaulted := make([]string, len(schema))
+	for j, col := range schema {
+		defaulted[j] = defaults[col.Name]
 		ds.columns = append(ds.columns, column.NewChunk(col.Dtype))
+		localised[j] = !numbers.IsCanonical() && (col.Dtype == column.DtypeInt || col.Dtype == column.DtypeFloat || col.Dtype == column.DtypeDecimal)
+		dated[j] = j < len(dates) && !dates[j].IsCanonical() && (col.Dtype == column.DtypeDate || col.Dtype == column.DtypeDatetime)
+		nullable[j] = col.Nullable || col.Dtype == column.DtypeString
 	}
 
 	// now let's finally load some data
@@ -306,8 +707,24 @@ func newStripeFromReader(rr RowReader, schema column.TableSchema, maxRows, maxBy
 			// OPTIM: here's where all the strconv byte/string copies begin
 			// or it really began in yieldRow
 			// https://github.com/golang/go/issues/42429
-			if err := ds.columns[j].AddValue(val); err != nil {
-				return nil, fmt.Errorf("failed to populate column %v: %w", schema[j].Name, err)
+			if localised[j] {
+				val, err = numbers.Normalise(val)
+			}
+			if dated[j] {
+				val, err = dates[j].Normalise(val)
+			}
+			if err == nil && val == "" && defaulted[j] != "" {
+				val = defaulted[j]
+			}
+			if err == nil && val == "" && !nullable[j] {
+				err = errUnexpectedNull
+			}
+			if err == nil {
+				err = ds.columns[j].AddValueWithPolicy(val, floats)
+			}
+			if err != nil {
+				// values that do not fit their schema are the fault of whoever supplied them
+				return nil, errs.Wrap(errs.ErrBadRequest, &schemaViolation{column: schema[j].Name, err: err})
 			}
 		}
 		ds.meta.Length++
@@ -320,28 +737,40 @@ func newStripeFromReader(rr RowReader, schema column.TableSchema, maxRows, maxBy
 }
 
 type StripeReader struct {
-	f *os.File
-	// seeking is slow, so keep position manually is a big win
-	// if we read columns sequentially, we don't need to seek at all
-	pos       int
+	// we read individual columns using ReadAt, so that we don't depend on
+	// the position within the stripe (and so that remote storage can serve
+	// us just the byte ranges we need)
+	f         storageObject
+	dataset   string // these two identify what we're reading in errors
+	stripe    UID
 	offsets   []uint32
+	splits    []uint32 // where contents of split columns begin, see Stripe.Splits
 	schema    column.TableSchema
-	buffer    *bytes.Buffer
+	dtypes    []column.Dtype // stored column types, if they differ from the schema
+	encodings []column.Encoding
+	blooms    []uint32
+	buffer    []byte
 	bytesRead int
+	zeroCopy  bool // see ZeroCopy
 }
 
-// OPTIM: pass in a bytes buffer to reuse it?
 func NewStripeReader(db *Database, ds *Dataset, stripe Stripe) (*StripeReader, error) {
-	f, err := os.Open(db.stripePath(ds, stripe))
+	f, err := db.storage.open(stripeKey(ds, stripe))
 	if err != nil {
 		return nil, err
 	}
 
 	return &StripeReader{
-		f:       f,
-		offsets: stripe.Offsets,
-		schema:  ds.Schema,
-		buffer:  new(bytes.Buffer),
+		f:         f,
+		dataset:   fmt.Sprintf("%v@v%v", ds.QualifiedName(), ds.ID),
+		stripe:    stripe.Id,
+		offsets:   stripe.Offsets,
+		splits:    stripe.Splits,
+		schema:    ds.Schema,
+		dtypes:    stripe.Dtypes,
+		encodings: stripe.Encodings,
+		blooms:    stripe.Blooms,
+		zeroCopy:  db.zeroCopy,
 	}, nil
 }
 
@@ -349,54 +778,260 @@ func (sr *StripeReader) Close() error {
 	return sr.f.Close()
 }
 
-func (sr *StripeReader) ReadColumn(nthColumn int) (*column.Chunk, error) {
+// columnError adds context to errors encountered when reading a given column, so that we know which
+// data are corrupted
+func (sr *StripeReader) columnError(nthColumn int, err error) error {
+	return fmt.Errorf("%w (dataset %v, stripe %v, column %v)", err, sr.dataset, sr.stripe, sr.schema[nthColumn].Name)
+}
+
+// sections returns boundaries of all the sections a column is stored in - most columns are stored
+// in one piece, plain encoded strings are stored in two (offsets and contents, see writeColumn)
+func (sr *StripeReader) sections(nthColumn int) []uint32 {
 	offsetStart, offsetEnd := sr.offsets[nthColumn], sr.offsets[nthColumn+1]
+	if sr.splits != nil && sr.splits[nthColumn] > 0 {
+		return []uint32{offsetStart, sr.splits[nthColumn], offsetEnd}
+	}
+	return []uint32{offsetStart, offsetEnd}
+}
+
+// readRaw reads a column's bytes as they are stored (including its checksums, which get verified),
+// the returned slice is only valid until the next read
+func (sr *StripeReader) readRaw(nthColumn int) ([]byte, error) {
+	raw, err := sr.readSections(sr.sections(nthColumn))
+	if err != nil {
+		return nil, sr.columnError(nthColumn, err)
+	}
+	return raw, nil
+}
+
+// readSections reads bytes between the first and the last boundary and verifies checksums of all the
+// sections in between
+func (sr *StripeReader) readSections(bounds []uint32) ([]byte, error) {
+	offsetStart, offsetEnd := bounds[0], bounds[len(bounds)-1]
 	length := int(offsetEnd) - int(offsetStart)
 	if length < 5 {
 		return nil, errInvalidOffsetData
 	}
 
-	sr.buffer.Reset()
-	sr.buffer.Grow(length)
+	if cap(sr.buffer) < length {
+		sr.buffer = make([]byte, length)
+	}
+	raw := sr.buffer[:length]
+	// ReaderAt may return io.EOF alongside a full read, if our column is at the very end
+	if n, err := sr.f.ReadAt(raw, int64(offsetStart)); err != nil && !(err == io.EOF && n == length) {
+		return nil, err
+	}
+	sr.bytesRead += length
+
+	for j := 1; j < len(bounds); j++ {
+		if bounds[j]-bounds[j-1] < 5 || bounds[j] > offsetEnd {
+			return nil, errInvalidOffsetData
+		}
+		section := raw[bounds[j-1]-offsetStart : bounds[j]-offsetStart]
+		// IEEE CRC32 is in the first four bytes of each section
+		checksumExpected := binary.LittleEndian.Uint32(section[:4])
+		checksumGot := crc32.ChecksumIEEE(section[4:])
+		if checksumExpected != checksumGot {
+			return nil, errIncorrectChecksum
+		}
+	}
+	return raw, nil
+}
+
+// sectionReader decompresses a section read by readSections (after its checksum and compression type)
+func sectionReader(section []byte) (io.Reader, error) {
+	ctype := compression(section[4])
+	return readCompressed(bytes.NewReader(section[5:]), ctype)
+}
 
-	if sr.pos != int(offsetStart) {
-		if _, err := sr.f.Seek(int64(offsetStart), io.SeekStart); err != nil {
+// sectionBytes is like sectionReader, but it returns the decompressed section in a buffer of
+// its own (sections get read into a buffer that's reused, see readSections)
+func sectionBytes(section []byte) ([]byte, error) {
+	ctype := compression(section[4])
+	if ctype == compressionNone {
+		return append([]byte(nil), section[5:]...), nil
+	}
+	cr, err := readCompressed(bytes.NewReader(section[5:]), ctype)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(cr)
+}
+
+func (sr *StripeReader) ReadColumn(nthColumn int) (*column.Chunk, error) {
+	chunk, err := sr.readColumn(nthColumn)
+	if err != nil {
+		return nil, sr.columnError(nthColumn, err)
+	}
+	return chunk, nil
+}
+
+func (sr *StripeReader) readColumn(nthColumn int) (*column.Chunk, error) {
+	bounds := sr.sections(nthColumn)
+	raw, err := sr.readSections(bounds)
+	if err != nil {
+		return nil, err
+	}
+	if len(bounds) == 3 {
+		split := bounds[1] - bounds[0]
+		chunk, err := readSplitColumn(raw[:split], raw[split:])
+		if err != nil {
 			return nil, err
 		}
-		sr.pos = int(offsetStart)
+		return sr.widen(nthColumn, chunk)
+	}
+
+	dtype := sr.schema[nthColumn].Dtype
+	if sr.dtypes != nil {
+		dtype = sr.dtypes[nthColumn]
 	}
-	if _, err := io.CopyN(sr.buffer, sr.f, int64(length)); err != nil {
+	rle := sr.encodings != nil && sr.encodings[nthColumn] == column.EncodingRLE
+	var chunk *column.Chunk
+	if sr.zeroCopy && !rle {
+		data, err := sectionBytes(raw)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err = column.DeserializeBytes(data, dtype)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cr, err := sectionReader(raw)
+		if err != nil {
+			return nil, err
+		}
+		deserialize := column.Deserialize
+		if rle {
+			deserialize = column.DeserializeRLE
+		}
+		chunk, err = deserialize(cr, dtype)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// stored types may differ from the schema's, see widen
+	return sr.widen(nthColumn, chunk)
+}
+
+// readSplitColumn reads a string column stored in two sections - its offsets and its contents
+func readSplitColumn(head, contents []byte) (*column.Chunk, error) {
+	r, err := sectionReader(head)
+	if err != nil {
 		return nil, err
 	}
-	sr.pos += length
-	sr.bytesRead += length
+	chunk, _, err := column.DeserializeOffsets(r)
+	if err != nil {
+		return nil, err
+	}
+	r, err = sectionReader(contents)
+	if err != nil {
+		return nil, err
+	}
+	if err := chunk.LoadStrings(r); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
 
-	raw := sr.buffer.Bytes()
-	// IEEE CRC32 is in the first four bytes of this slice
-	checksumExpected := binary.LittleEndian.Uint32(raw[:4])
-	checksumGot := crc32.ChecksumIEEE(raw[4:])
-	if checksumExpected != checksumGot {
-		return nil, errIncorrectChecksum
+// widen converts a chunk read from a stripe into its dataset's type, if the two differ
+func (sr *StripeReader) widen(nthColumn int, chunk *column.Chunk) (*column.Chunk, error) {
+	dtype := sr.schema[nthColumn].Dtype
+	if chunk.Dtype() == dtype {
+		return chunk, nil
 	}
-	ctype := compression(raw[4])
+	// this stripe predates a type widening, so we need to catch up
+	// OPTIM: we could rewrite such stripes in the background
+	return chunk.Widen(dtype)
+}
 
-	br := bytes.NewReader(raw[5:])
-	cr, err := readCompressed(br, ctype)
+// ReadColumnOffsets reads a string column without its contents, so that we can tell nullity and lengths
+// of its values at a fraction of the cost of reading it in full - the returned chunk must not be used
+// for anything else. Columns not stored in two sections get read in full and so do columns with multi-byte
+// characters, because their lengths cannot be inferred from offsets.
+func (sr *StripeReader) ReadColumnOffsets(nthColumn int) (*column.Chunk, error) {
+	chunk, err := sr.readColumnOffsets(nthColumn)
 	if err != nil {
+		return nil, sr.columnError(nthColumn, err)
+	}
+	return chunk, nil
+}
+
+func (sr *StripeReader) readColumnOffsets(nthColumn int) (*column.Chunk, error) {
+	bounds := sr.sections(nthColumn)
+	if len(bounds) != 3 || sr.schema[nthColumn].Dtype != column.DtypeString {
+		return sr.readColumn(nthColumn)
+	}
+	head, err := sr.readSections(bounds[:2])
+	if err != nil {
+		return nil, err
+	}
+	r, err := sectionReader(head)
+	if err != nil {
+		return nil, err
+	}
+	chunk, runes, err := column.DeserializeOffsets(r)
+	if err != nil {
+		return nil, err
+	}
+	if !runes {
+		return chunk, nil
+	}
+	contents, err := sr.readSections(bounds[1:])
+	if err != nil {
+		return nil, err
+	}
+	if r, err = sectionReader(contents); err != nil {
+		return nil, err
+	}
+	if err := chunk.LoadStrings(r); err != nil {
 		return nil, err
 	}
-	return column.Deserialize(cr, sr.schema[nthColumn].Dtype)
+	return chunk, nil
 }
 
 // OPTIM: perhaps reorder the column requests, so that they are contiguous, or at least in order
-//        also add a benchmark that reads columns in reverse and see if we get any benefits from this
-func (db *Database) ReadColumnsFromStripeByNames(ds *Dataset, stripe Stripe, columns []string) (map[string]*column.Chunk, int, error) {
-	cols := make(map[string]*column.Chunk, len(columns))
-	sr, err := NewStripeReader(db, ds, stripe)
-	if err != nil {
-		return nil, 0, err
+//
+//	also add a benchmark that reads columns in reverse and see if we get any benefits from this
+func (db *Database) ReadColumnsFromStripeByNames(ds *Dataset, stripe Stripe, columns []string) (map[string]*column.Chunk, ReadStats, error) {
+	return db.ReadColumnsFromStripe(ds, stripe, columns, nil)
+}
+
+// ReadStats describe how columns were read - how many bytes we read from storage and how many
+// chunks we found in our chunk cache (see Config.ChunkCacheSize)
+type ReadStats struct {
+	BytesRead   int
+	CacheHits   int
+	CacheMisses int
+}
+
+// Add accumulates stats of multiple reads
+func (rs *ReadStats) Add(other ReadStats) {
+	rs.BytesRead += other.BytesRead
+	rs.CacheHits += other.CacheHits
+	rs.CacheMisses += other.CacheMisses
+}
+
+// ReadColumnsFromStripe reads columns the same way ReadColumnsFromStripeByNames does, but string columns
+// listed in `offsetsOnly` get read without their contents, if possible (see StripeReader.ReadColumnOffsets)
+// Chunks returned may be cached and shared with other readers, so they must not be modified in place.
+// Constant chunks may be returned as literals (see column.DeserializeRLE and plainChunk).
+func (db *Database) ReadColumnsFromStripe(ds *Dataset, stripe Stripe, columns []string, offsetsOnly []string) (map[string]*column.Chunk, ReadStats, error) {
+	if ds.External != nil {
+		return db.readExternalColumns(ds, stripe, columns)
+	}
+	if ds.memory != nil {
+		return readMemoryColumns(ds, columns)
 	}
-	defer sr.Close()
+	var stats ReadStats
+	cols := make(map[string]*column.Chunk, len(columns))
+	// we only open the stripe if any of the columns are not cached
+	var sr *StripeReader
+	defer func() {
+		if sr != nil {
+			sr.Close()
+		}
+	}()
 	for _, column := range columns {
 		// we allow for duplicates in `columns`, so just skip those
 		if _, ok := cols[column]; ok {
@@ -404,16 +1039,54 @@ func (db *Database) ReadColumnsFromStripeByNames(ds *Dataset, stripe Stripe, col
 		}
 		idx, _, err := ds.Schema.LocateColumn(column)
 		if err != nil {
-			return nil, 0, err
+			return nil, stats, err
+		}
+		key := chunkKey{version: ds.ID, stripe: stripe.Id, column: idx}
+		for _, name := range offsetsOnly {
+			if name == column {
+				key.offsetsOnly = true
+				break
+			}
+		}
+		if col, ok := db.chunks.get(key); ok {
+			stats.CacheHits++
+			cols[column] = col
+			continue
+		}
+		if db.chunks.enabled() {
+			stats.CacheMisses++
+		}
+		if sr == nil {
+			if sr, err = NewStripeReader(db, ds, stripe); err != nil {
+				return nil, stats, err
+			}
 		}
 		// ARCH: consider ReadColumnByName to avoid the LocateColumn call above (and hide it in this method)
-		col, err := sr.ReadColumn(idx)
+		read := sr.ReadColumn
+		if key.offsetsOnly {
+			read = sr.ReadColumnOffsets
+		}
+		col, err := read(idx)
 		if err != nil {
-			return nil, 0, err
+			stats.BytesRead = sr.bytesRead
+			return nil, stats, err
 		}
+		db.chunks.put(key, col)
 		cols[column] = col
 	}
-	return cols, sr.bytesRead, nil
+	if sr != nil {
+		stats.BytesRead = sr.bytesRead
+	}
+	return cols, stats, nil
+}
+
+// plainChunk hydrates literals read from stripes (see column.DeserializeRLE), so that they can be
+// converted, serialised or appended to like any other chunk
+func plainChunk(chunk *column.Chunk) *column.Chunk {
+	if !chunk.IsLiteral {
+		return chunk
+	}
+	return chunk.Reorder(make([]int, chunk.Len()))
 }
 
 func validateHeaderAgainstSchema(header []string, schema column.TableSchema) error {
@@ -430,18 +1103,32 @@ func validateHeaderAgainstSchema(header []string, schema column.TableSchema) err
 }
 
 // This is how data gets in! This is the main entrypoint
+// Our input gets split into blocks of rows, which get parsed in parallel (see parseBlocks)
 func (db *Database) loadDatasetFromReader(name string, r io.Reader, settings *loadSettings) (*Dataset, error) {
-	dataset := NewDataset(name)
+	if settings == nil {
+		return nil, errInvalidloadSettings
+	}
+	dataset := NewDatasetInNamespace(settings.namespace, name)
 	if settings.schema == nil {
 		return nil, errors.New("cannot load data without a schema")
 	}
-	rr, err := NewRowReader(r, settings)
+	dr, err := decodeInput(r, settings)
+	if err != nil {
+		return nil, err
+	}
+	rs := newRowSplitter(dr, settings)
+	// the first row is our header, a block of just one byte gives us just that
+	first, err := rs.next(1)
+	if err != nil {
+		return nil, err
+	}
+	hr, err := newRowReaderFromDecoded(bytes.NewReader(first), settings, true)
 	if err != nil {
 		return nil, err
 	}
 	// at this point we're checking all headers, but once we allow for custom schemas (e.g. renaming columns, custom type
 	// declarations etc.), we'll want to have an option that skips this verification
-	header, err := rr.ReadRow()
+	header, err := hr.ReadRow()
 	if err != nil {
 		return nil, err
 	}
@@ -451,69 +1138,150 @@ func (db *Database) loadDatasetFromReader(name string, r io.Reader, settings *lo
 	if err := validateHeaderAgainstSchema(header, settings.schema); err != nil {
 		return nil, err
 	}
+	// headerless files start with data right away
+	if settings.noHeader {
+		rs.unread(first)
+	}
 
-	stripes := make([]Stripe, 0)
-	for {
-		// ARCH: this err handling is a bit clunky - can we perhaps not return io.EOF upstream? It doesn't tell us anything here...
-		ds, loadingErr := newStripeFromReader(rr, settings.schema, db.Config.MaxRowsPerStripe, db.Config.MaxBytesPerStripe)
-		if loadingErr != nil && loadingErr != io.EOF {
-			return nil, loadingErr
-		}
-		dataset.NRows += int64(ds.meta.Length)
-		// we started reading this stripe just as we were at the end of a file - so we only get an EOF
-		// and no data
-		if loadingErr == io.EOF && ds.meta.Length == 0 {
-			break
-		}
-		// ARCH: this could possibly happen
-		if ds.meta.Length == 0 {
-			return nil, errors.New("no data loaded")
-		}
-
-		nbytes, err := db.writeStripeToFile(dataset, ds, settings.writeCompression)
+	var sorted *sortChecker
+	if len(settings.sortKey) > 0 {
+		sorted, err = newSortChecker(settings.sortKey, settings.datasetSchema())
 		if err != nil {
 			return nil, err
 		}
-		dataset.SizeOnDisk += nbytes
-
-		stripes = append(stripes, ds.meta)
+	}
 
-		if loadingErr == io.EOF {
-			break
+	stripes := make([]Stripe, 0)
+	collectors := newStatsCollectors(settings.datasetSchema())
+	err = db.parseBlocks(dataset, rs, settings, func(pb *parsedBlock) error {
+		// stripes get removed all at once upon failure, see below
+		stripes = append(stripes, pb.metas()...)
+		for _, ds := range pb.stripes {
+			if sorted != nil {
+				if err := sorted.check(ds.columns); err != nil {
+					return err
+				}
+			}
+			if err := collectors.add(ds.columns); err != nil {
+				return err
+			}
+			dataset.NRows += int64(ds.meta.Length)
+		}
+		dataset.SizeOnDisk += pb.nbytes
+		if settings.progress != nil {
+			atomic.StoreInt64(&settings.progress.rows, dataset.NRows)
 		}
+		return nil
+	})
+	if err != nil {
+		db.removeStripes(dataset, stripes)
+		return nil, err
 	}
 
-	dataset.Schema = settings.schema
+	dataset.Schema = settings.datasetSchema()
 	dataset.Stripes = stripes
+	dataset.FloatPolicy = settings.floats
+	dataset.SortKey = settings.sortKey
+	dataset.Stats = collectors.stats()
 	return dataset, nil
 }
 
 // convenience wrapper
-func (db *Database) loadDatasetFromLocalFile(name, path string, settings *loadSettings) (*Dataset, error) {
-	f, err := os.Open(path)
+func (db *Database) loadDatasetFromIncoming(name string, inc *incomingFile, settings *loadSettings) (*Dataset, error) {
+	f, err := inc.open()
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return db.loadDatasetFromReader(name, f, settings)
+	var r io.Reader = f
+	if settings.progress != nil {
+		r = &countingReader{r: f, n: &settings.progress.bytes}
+	}
+	return db.loadDatasetFromReader(name, r, settings)
 }
 
 // LoadDatasetFromReaderAuto loads data from a reader and returns a Dataset
 func (db *Database) LoadDatasetFromReaderAuto(name string, r io.Reader) (*Dataset, error) {
-	f, err := os.CreateTemp("", "")
+	return db.LoadDatasetFromReaderAutoWithOptions(name, r, LoadOptions{})
+}
+
+// LoadOptions tweak how data get loaded, the zero value gives us the defaults
+// (as used by LoadDatasetFromReaderAuto)
+type LoadOptions struct {
+	// namespace the new dataset is to be created in, empty for the default namespace
+	Namespace string
+	// what happens to special float values (NaN, infinities), the policy sticks with the dataset
+	// (and its appended versions)
+	Floats column.FloatPolicy
+
+	// CSV dialect, the delimiter is either its name (e.g. `semicolon`, see delimiter.String)
+	// or the delimiter itself, it gets inferred if empty
+	Delimiter string
+	// a single quote character (`"` if empty) or `none`, which disables quoting altogether
+	Quote string
+	// headerless files get their columns named column_01, column_02 etc.
+	NoHeader bool
+	// values to be loaded as nulls, in addition to empty strings (e.g. NA or \N)
+	NullTokens []string
+	// numbers formatted according to a locale, e.g. `1.234,56` has a decimal comma (`,`) and
+	// thousands separated by dots (`.`), see column.NumberFormat
+	Decimal   string
+	Thousands string
+
+	// columns the data are sorted by, loading fails if they are not (see Dataset.SortKey)
+	SortKey []string
+	// types and nullability of some (or all) columns, overriding type inference for them
+	SchemaHints SchemaHints
+
+	progress *loadProgress // see SubmitLoad
+}
+
+// applyDialect sets CSV dialect options in a given loadSettings, overriding any inferred values
+func (opts LoadOptions) applyDialect(ls *loadSettings) error {
+	if opts.Delimiter != "" {
+		dlim, err := delimiterFromString(opts.Delimiter)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidDialect, err)
+		}
+		ls.delimiter = dlim
+	}
+	switch {
+	case opts.Quote == "":
+	case opts.Quote == "none":
+		ls.noQuotes = true
+	case len(opts.Quote) == 1 && opts.Quote[0] != '\n' && opts.Quote[0] != '\r' && opts.Quote[0] < 0x80:
+		ls.quote = opts.Quote[0]
+	default:
+		return fmt.Errorf("%w: invalid quote character %q", errInvalidDialect, opts.Quote)
+	}
+	ls.noHeader = opts.NoHeader
+	ls.nullTokens = opts.NullTokens
+	numbers, err := column.NewNumberFormat(opts.Decimal, opts.Thousands)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%w: %v", errInvalidDialect, err)
 	}
-	defer os.Remove(f.Name())
-	if err := CacheIncomingFile(r, f.Name()); err != nil {
+	ls.numbers = numbers
+	return nil
+}
+
+// LoadDatasetFromReaderAutoWithOptions is like LoadDatasetFromReaderAuto, but it allows for
+// non-default loading options
+func (db *Database) LoadDatasetFromReaderAutoWithOptions(name string, r io.Reader, opts LoadOptions) (*Dataset, error) {
+	inc, err := db.cacheIncoming(r)
+	if err != nil {
 		return nil, err
 	}
+	defer inc.remove()
+
+	return db.loadDatasetFromIncomingAuto(name, inc, opts)
+}
 
-	return db.loadDatasetFromLocalFileAuto(name, f.Name())
+func (db *Database) loadDatasetFromLocalFileAuto(name, path string, opts LoadOptions) (*Dataset, error) {
+	return db.loadDatasetFromIncomingAuto(name, &incomingFile{path: path}, opts)
 }
 
-func (db *Database) loadDatasetFromLocalFileAuto(name, path string) (*Dataset, error) {
-	ctype, dlim, err := inferCompressionAndDelimiter(path)
+func (db *Database) loadDatasetFromIncomingAuto(name string, inc *incomingFile, opts LoadOptions) (*Dataset, error) {
+	ctype, dlim, err := inferCompressionAndDelimiter(inc)
 	if err != nil {
 		return nil, err
 	}
@@ -528,23 +1296,239 @@ func (db *Database) loadDatasetFromLocalFileAuto(name, path string) (*Dataset, e
 		delimiter:       dlim,
 		cleanupColumns:  true,
 		// ARCH: we only set write compression in *Auto calls
-		// TODO/OPTIM: make this configurable and optimised
 		// TODO: make benchmarks compression aware (test for each compression? Or just for uncompressed?)
-		writeCompression: compressionSnappy,
+		writeCompression: db.writeCompression,
+		floats:           opts.Floats,
+		namespace:        opts.Namespace,
+		sortKey:          opts.SortKey,
+		progress:         opts.progress,
 	}
+	if err := opts.applyDialect(ls); err != nil {
+		return nil, err
+	}
+
+	ls.defaults = opts.SchemaHints.defaults()
+	infer := func(maxRows int) (bool, error) {
+		schema, complete, err := inferTypesFromSample(inc, ls, maxRows)
+		if err != nil {
+			return false, err
+		}
+		if err := opts.SchemaHints.apply(schema); err != nil {
+			return false, err
+		}
+		derived, err := opts.SchemaHints.derivedColumns(schema)
+		if err != nil {
+			return false, err
+		}
+		ls.schema = schema
+		ls.dates = opts.SchemaHints.dateFormats(schema)
+		ls.derived = derived
+		return complete, nil
+	}
+	complete, err := infer(inferenceSampleRows)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := db.loadDatasetFromIncoming(name, inc, ls)
+	if err != nil && !complete && isSchemaViolation(err) {
+		// the sample was not representative, so we infer types from all our data and try again
+		if _, err := infer(0); err != nil {
+			return nil, err
+		}
+		return db.loadDatasetFromIncoming(name, inc, ls)
+	}
+	return ds, err
+}
+
+func isSchemaViolation(err error) bool {
+	var sv *schemaViolation
+	return errors.As(err, &sv)
+}
+
+// WideningPolicy determines what happens when appended data don't fit existing column types
+type WideningPolicy uint8
+
+const (
+	// WideningNone keeps column types as they are, so appending incompatible data fails
+	WideningNone WideningPolicy = iota
+	// WideningAllowed widens column types to accommodate new data (e.g. ints become floats),
+	// existing stripes stay as they are and get converted as they are read
+	WideningAllowed
+)
 
-	schema, err := inferTypes(path, ls)
+// AppendToDataset loads new data into an existing dataset. Since datasets are immutable, this
+// creates (and adds to our database) a new version of the dataset, which shares all the existing
+// stripes with its predecessor and adds new ones on top. The incoming data need to have the same
+// columns as the existing dataset and their values need to be loadable into its column types,
+// unless we allow these types to be widened. Any schema changes get recorded in the new version.
+func (db *Database) AppendToDataset(ds *Dataset, r io.Reader, policy WideningPolicy) (*Dataset, error) {
+	return db.AppendToDatasetWithOptions(ds, r, policy, LoadOptions{})
+}
+
+// AppendToDatasetWithOptions is like AppendToDataset, but it allows for a CSV dialect and schema
+// hints, just like LoadDatasetFromReaderAutoWithOptions. Hints are applied to the incoming data,
+// so columns with defaults may be missing in them and computed columns must be missing.
+// The namespace and float policy are those of the existing dataset and appended data cannot have
+// a sort key (see below).
+func (db *Database) AppendToDatasetWithOptions(ds *Dataset, r io.Reader, policy WideningPolicy, opts LoadOptions) (*Dataset, error) {
+	inc, err := db.cacheIncoming(r)
 	if err != nil {
 		return nil, err
 	}
-	ls.schema = schema
+	defer inc.remove()
 
-	return db.loadDatasetFromLocalFile(name, path, ls)
+	return db.appendToDataset(ds, inc, policy, opts)
+}
+
+func (db *Database) appendToDataset(ds *Dataset, inc *incomingFile, policy WideningPolicy, opts LoadOptions) (*Dataset, error) {
+	if ds.External != nil {
+		return nil, errExternalReadOnly
+	}
+	if len(opts.SortKey) > 0 {
+		return nil, fmt.Errorf("%w: appended data cannot have a sort key", errInvalidAppend)
+	}
+	if opts.Namespace != "" && opts.Namespace != ds.Namespace {
+		return nil, fmt.Errorf("%w: cannot append to %v in namespace %v", errInvalidAppend, ds.QualifiedName(), opts.Namespace)
+	}
+	ctype, dlim, err := inferCompressionAndDelimiter(inc)
+	if err != nil {
+		return nil, err
+	}
+	if dlim == delimiterNone {
+		dlim = delimiterComma
+	}
+	ls := &loadSettings{
+		readCompression:  ctype,
+		delimiter:        dlim,
+		cleanupColumns:   true,
+		writeCompression: db.writeCompression,
+		floats:           ds.FloatPolicy,
+		namespace:        ds.Namespace,
+		progress:         opts.progress,
+	}
+	if err := opts.applyDialect(ls); err != nil {
+		return nil, err
+	}
+	ls.defaults = opts.SchemaHints.defaults()
+
+	var changes []SchemaChange
+	var widened bool
+	infer := func(maxRows int) (bool, error) {
+		incoming, complete, err := inferTypesFromSample(inc, ls, maxRows)
+		if err != nil {
+			return false, err
+		}
+		if err := opts.SchemaHints.apply(incoming); err != nil {
+			return false, err
+		}
+		derived, err := opts.SchemaHints.derivedColumns(incoming)
+		if err != nil {
+			return false, err
+		}
+		ls.schema = incoming
+		ls.dates = opts.SchemaHints.dateFormats(incoming)
+		ls.derived = derived
+		schema, chs, wd, err := appendedSchema(ds, ls.datasetSchema(), policy)
+		if err != nil {
+			return false, err
+		}
+		changes, widened = chs, wd
+		ls.schema = schema[:len(incoming)]
+		for j := range derived {
+			col := schema[len(incoming)+j]
+			// computed values cannot be converted to other types as they are loaded
+			if derived[j].compute != nil && col.Dtype != derived[j].schema.Dtype {
+				return false, fmt.Errorf("%w: computed column %v is a %v, expecting a %v", errSchemaMismatch, col.Name, derived[j].schema.Dtype, col.Dtype)
+			}
+			derived[j].schema = col
+		}
+		return complete, nil
+	}
+	complete, err := infer(inferenceSampleRows)
+	if err != nil {
+		return nil, err
+	}
+
+	appended, err := db.loadDatasetFromIncoming(ds.Name, inc, ls)
+	if err != nil && !complete && isSchemaViolation(err) {
+		// new nulls or values needing wider types need not be in the sample, see loadDatasetFromIncomingAuto
+		if _, err := infer(0); err != nil {
+			return nil, err
+		}
+		appended, err = db.loadDatasetFromIncoming(ds.Name, inc, ls)
+	}
+	if err != nil {
+		return nil, err
+	}
+	schema := ls.datasetSchema()
+	stripes := make([]Stripe, 0, len(ds.Stripes)+len(appended.Stripes))
+	for _, stripe := range ds.Stripes {
+		if stripe.Owner == nil {
+			owner := ds.ID
+			stripe.Owner = &owner
+		}
+		// stripes that have been widened before already know their original types
+		if widened && stripe.Dtypes == nil {
+			stripe.Dtypes = make([]column.Dtype, len(ds.Schema))
+			for j, col := range ds.Schema {
+				stripe.Dtypes[j] = col.Dtype
+			}
+		}
+		stripes = append(stripes, stripe)
+	}
+	// ARCH: appended versions are not sorted, unless we check that the new data sort after
+	// the existing ones (we'd have to read the last stripe's key columns), so they lose their sort key
+	appended.SchemaChanges = changes
+	appended.Stats = mergeStats(schema, ds.Stats, appended.Stats, ds.NRows, appended.NRows)
+	appended.Stripes = append(stripes, appended.Stripes...)
+	appended.NRows += ds.NRows
+	appended.SizeOnDisk += ds.SizeOnDisk
+	appended.SizeRaw = ds.SizeRaw
+	if size, err := inc.size(); err == nil {
+		appended.SizeRaw += size
+	}
+
+	if err := db.AddDataset(appended); err != nil {
+		return nil, err
+	}
+	return appended, nil
+}
+
+// appendedSchema reconciles the schema of a dataset with that of data appended to it (see
+// AppendToDataset), it lists all the changes and whether any columns got widened
+func appendedSchema(ds *Dataset, incoming column.TableSchema, policy WideningPolicy) (column.TableSchema, []SchemaChange, bool, error) {
+	if len(incoming) != len(ds.Schema) {
+		return nil, nil, false, fmt.Errorf("%w: expecting %v columns, got %v", errSchemaMismatch, len(ds.Schema), len(incoming))
+	}
+	// unless we're allowed to widen them, column types stay the same (loading will fail if
+	// the new data don't fit them), but new data may always introduce nulls
+	schema := make(column.TableSchema, len(ds.Schema))
+	var changes []SchemaChange
+	widened := false
+	for j, col := range ds.Schema {
+		if incoming[j].Name != col.Name {
+			return nil, nil, false, fmt.Errorf("%w: expecting column %v, got %v", errSchemaMismatch, col.Name, incoming[j].Name)
+		}
+		schema[j] = col
+		schema[j].Nullable = col.Nullable || incoming[j].Nullable
+		if policy == WideningAllowed {
+			// incompatible types are left as they are, loading will fail if need be
+			if dtype, ok := column.WidenType(col.Dtype, incoming[j].Dtype); ok && dtype != col.Dtype {
+				schema[j].Dtype = dtype
+				widened = true
+			}
+		}
+		if schema[j] != col {
+			changes = append(changes, SchemaChange{Before: col, After: schema[j]})
+		}
+	}
+	return schema, changes, widened, nil
 }
 
 // LoadDatasetFromMap allows for an easy setup of a new dataset, mostly useful for tests
 // Converts this map into an in-memory CSV file and passes it to our usual routines
-// OPTIM: the underlying call (LoadDatasetFromReaderAuto) caches this raw data on disk, may be unecessary
+// OPTIM: the underlying call (LoadDatasetFromReaderAuto) caches this raw data on disk (unless
+// we're in memory), may be unecessary
 func (db *Database) LoadDatasetFromMap(name string, data map[string][]string) (*Dataset, error) {
 	if len(data) == 0 {
 		return nil, errNoMapData
@@ -580,3 +1564,190 @@ func (db *Database) LoadDatasetFromMap(name string, data map[string][]string) (*
 
 	return db.LoadDatasetFromReaderAuto(name, bf)
 }
+
+// StoreResult persists columnar data (typically query results) as a new dataset and adds it
+// to our database, so it can be queried like any other dataset. Column names get cleaned up
+// the same way they do when loading raw data (so `sum(foo)` becomes `sum_foo`).
+// ARCH: we only split data into stripes by MaxRowsPerStripe, not by MaxBytesPerStripe
+func (db *Database) StoreResult(name string, schema column.TableSchema, data []*column.Chunk) (*Dataset, error) {
+	return db.StoreResultInNamespace("", name, schema, data)
+}
+
+// StoreResultInNamespace is like StoreResult, but it stores data in a given namespace
+func (db *Database) StoreResultInNamespace(namespace, name string, schema column.TableSchema, data []*column.Chunk) (*Dataset, error) {
+	if err := validateResult(schema, data); err != nil {
+		return nil, err
+	}
+	dataset := NewDatasetInNamespace(namespace, name)
+	dataset.Schema = resultSchema(schema)
+	dataset.Stripes = make([]Stripe, 0)
+	stripes, nbytes, err := db.writeResultStripes(dataset, data)
+	if err != nil {
+		return nil, err
+	}
+	dataset.Stripes = append(dataset.Stripes, stripes...)
+	dataset.SizeOnDisk = nbytes
+	dataset.Stats = resultStats(dataset.Schema, data)
+	if len(data) > 0 {
+		dataset.NRows = int64(data[0].Len())
+	}
+
+	if err := db.AddDataset(dataset); err != nil {
+		return nil, err
+	}
+	return dataset, nil
+}
+
+// NewResultDataset wraps columnar data (typically query results) in a dataset that lives in
+// memory only - it's not added to our database and nothing gets written. It can be read like
+// any other dataset (see ReadColumnsFromStripe), which lets queries read results of other
+// queries (e.g. of common table expressions). Column names get cleaned up as in StoreResult.
+// ARCH: all the data end up in a single stripe, so queries reading them cannot parallelise
+func NewResultDataset(name string, schema column.TableSchema, data []*column.Chunk) (*Dataset, error) {
+	if err := validateResult(schema, data); err != nil {
+		return nil, err
+	}
+	dataset := NewDataset(name)
+	dataset.Schema = resultSchema(schema)
+	dataset.Stripes = make([]Stripe, 0, 1)
+	dataset.Stats = resultStats(dataset.Schema, data)
+	dataset.memory = data
+	if len(data) > 0 && data[0].Len() > 0 {
+		dataset.NRows = int64(data[0].Len())
+		dataset.Stripes = append(dataset.Stripes, Stripe{Id: newUID(OtypeStripe), Length: data[0].Len()})
+	}
+	return dataset, nil
+}
+
+// readMemoryColumns is ReadColumnsFromStripe for datasets created by NewResultDataset
+func readMemoryColumns(ds *Dataset, columns []string) (map[string]*column.Chunk, ReadStats, error) {
+	cols := make(map[string]*column.Chunk, len(columns))
+	for _, name := range columns {
+		idx, _, err := ds.Schema.LocateColumn(name)
+		if err != nil {
+			return nil, ReadStats{}, err
+		}
+		cols[name] = ds.memory[idx]
+	}
+	return cols, ReadStats{}, nil
+}
+
+// resultSchema cleans up column names of results, so that they are valid column names in datasets
+func resultSchema(schema column.TableSchema) column.TableSchema {
+	names := make([]string, 0, len(schema))
+	for _, col := range schema {
+		names = append(names, col.Name)
+	}
+	ret := make(column.TableSchema, 0, len(schema))
+	for j, colName := range cleanupColumns(names) {
+		ret = append(ret, column.Schema{
+			Name:     colName,
+			Dtype:    schema[j].Dtype,
+			Nullable: schema[j].Nullable,
+		})
+	}
+	return ret
+}
+
+// AppendResult is like AppendToDataset, but for columnar data, it creates (and adds to our database)
+// a new version of a dataset with data added on top of the existing stripes. Data need to have the
+// same types as the dataset's columns (only their nullability may differ).
+func (db *Database) AppendResult(ds *Dataset, data []*column.Chunk) (*Dataset, error) {
+	if ds.External != nil {
+		return nil, errExternalReadOnly
+	}
+	if err := validateResult(ds.Schema, data); err != nil {
+		return nil, err
+	}
+	appended := NewDatasetInNamespace(ds.Namespace, ds.Name)
+	appended.FloatPolicy = ds.FloatPolicy
+	appended.Schema = make(column.TableSchema, len(ds.Schema))
+	for j, col := range ds.Schema {
+		appended.Schema[j] = col
+		appended.Schema[j].Nullable = col.Nullable || (data[j].Nullability != nil && data[j].Nullability.Count() > 0)
+		if appended.Schema[j] != col {
+			appended.SchemaChanges = append(appended.SchemaChanges, SchemaChange{Before: col, After: appended.Schema[j]})
+		}
+	}
+	stripes, nbytes, err := db.writeResultStripes(appended, data)
+	if err != nil {
+		return nil, err
+	}
+	appended.Stripes = make([]Stripe, 0, len(ds.Stripes)+len(stripes))
+	for _, stripe := range ds.Stripes {
+		if stripe.Owner == nil {
+			owner := ds.ID
+			stripe.Owner = &owner
+		}
+		appended.Stripes = append(appended.Stripes, stripe)
+	}
+	appended.Stripes = append(appended.Stripes, stripes...)
+	appended.NRows = ds.NRows
+	if len(data) > 0 {
+		appended.NRows += int64(data[0].Len())
+	}
+	appended.Stats = mergeStats(appended.Schema, ds.Stats, resultStats(appended.Schema, data), ds.NRows, appended.NRows-ds.NRows)
+	appended.SizeOnDisk = ds.SizeOnDisk + nbytes
+	appended.SizeRaw = ds.SizeRaw
+
+	if err := db.AddDataset(appended); err != nil {
+		return nil, err
+	}
+	return appended, nil
+}
+
+// validateResult checks that columnar data conform to a given schema and that they are of the same length
+func validateResult(schema column.TableSchema, data []*column.Chunk) error {
+	if len(schema) != len(data) {
+		return errSchemaMismatch
+	}
+	nrows := 0
+	if len(data) > 0 {
+		nrows = data[0].Len()
+	}
+	for j, col := range data {
+		if col.Dtype() != schema[j].Dtype {
+			return fmt.Errorf("%w: column %v is of type %v, not %v", errSchemaMismatch, schema[j].Name, col.Dtype(), schema[j].Dtype)
+		}
+		if col.Len() != nrows {
+			return fmt.Errorf("length mismatch in column %v: %w", schema[j].Name, errLengthMismatch)
+		}
+	}
+	return nil
+}
+
+// writeResultStripes splits columnar data into stripes (by MaxRowsPerStripe) and writes them for
+// a given dataset, it returns the stripes' metadata and their total size
+func (db *Database) writeResultStripes(dataset *Dataset, data []*column.Chunk) ([]Stripe, int64, error) {
+	nrows := 0
+	if len(data) > 0 {
+		nrows = data[0].Len()
+	}
+	var stripes []Stripe
+	var size int64
+	stripeSize, _ := db.stripeLimits()
+	for offset := 0; offset < nrows; offset += stripeSize {
+		length := stripeSize
+		if offset+length > nrows {
+			length = nrows - offset
+		}
+		positions := make([]int, length)
+		for j := range positions {
+			positions[j] = offset + j
+		}
+		stripe := newDataStripe()
+		stripe.meta.Length = length
+		for _, col := range data {
+			// this also hydrates literal chunks, which cannot be serialised
+			stripe.columns = append(stripe.columns, col.Reorder(positions))
+		}
+		nbytes, err := db.writeStripeToFile(dataset, stripe, db.writeCompression)
+		if err != nil {
+			db.removeStripes(dataset, stripes)
+			return nil, 0, err
+		}
+		size += nbytes
+		stripes = append(stripes, stripe.meta)
+	}
+	return stripes, size, nil
+}
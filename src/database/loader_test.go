@@ -6,6 +6,7 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -14,6 +15,7 @@ import (
 	"testing"
 
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
 )
 
 func TestAutoInferenceInLoading(t *testing.T) {
@@ -75,7 +77,7 @@ func TestAutoInferenceInLoading(t *testing.T) {
 		if err := os.WriteFile(tfn, bf.Bytes(), os.ModePerm); err != nil {
 			t.Fatal(err)
 		}
-		ds, err = d.loadDatasetFromLocalFileAuto("dataset", tfn)
+		ds, err = d.loadDatasetFromLocalFileAuto("dataset", tfn, LoadOptions{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -155,6 +157,105 @@ func TestReadingFromStripes(t *testing.T) {
 	}
 }
 
+func TestStripeCompression(t *testing.T) {
+	row := "some fairly repetitive string,123,true,12.345\n"
+	raw := "foo,bar,baz,bak\n" + strings.Repeat(row, 1000)
+	var sizeUncompressed int64
+	for _, cmp := range []string{"none", "gzip", "snappy", "zstd"} {
+		db, err := NewDatabase("", &Config{Compression: cmp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("dataset", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmp == "none" {
+			sizeUncompressed = ds.SizeOnDisk
+		} else if ds.SizeOnDisk >= sizeUncompressed {
+			t.Errorf("expecting %v to compress our data (%v bytes), got %v bytes", cmp, sizeUncompressed, ds.SizeOnDisk)
+		}
+
+		sr, err := NewStripeReader(db, ds, ds.Stripes[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sr.Close()
+		for cn := range ds.Schema {
+			col, err := sr.ReadColumn(cn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if col.Len() != 1000 {
+				t.Errorf("expecting %v rows in a %v compressed column, got %v", 1000, cmp, col.Len())
+			}
+		}
+	}
+
+	if _, err := NewDatabase("", &Config{Compression: "bzip2"}); !errors.Is(err, errCannotWriteCompression) {
+		t.Errorf("expecting bzip2 not to be supported for writing, got %v", err)
+	}
+	if _, err := NewDatabase("", &Config{Compression: "lzma"}); !errors.Is(err, errUnknownCompression) {
+		t.Errorf("expecting an unknown compression to fail with %v, got %v", errUnknownCompression, err)
+	}
+}
+
+func TestZeroCopyReads(t *testing.T) {
+	raw := "a,b,c,d,e,f\n"
+	for j := 0; j < 1000; j++ {
+		nullable := strconv.Itoa(j)
+		if j%7 == 0 {
+			nullable = ""
+		}
+		raw += fmt.Sprintf("%v,%v,%v.5,2020-02-%02d,foo%v,%v\n", j, nullable, j, 1+j%28, j, j%2 == 0)
+	}
+	for _, cmp := range []string{"none", "gzip", "snappy", "zstd"} {
+		db, err := NewDatabase("", &Config{Compression: cmp, MaxRowsPerStripe: 300}, ZeroCopy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("dataset", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		// older stripes get widened as they are read
+		ds, err = db.AppendToDataset(ds, strings.NewReader("a,b,c,d,e,f\n1.5,2,3,2020-01-01,bar,true"), WideningAllowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stripe := range ds.Stripes {
+			db.zeroCopy = true
+			zc, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"a", "b", "c", "d", "e", "f"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.zeroCopy = false
+			cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"a", "b", "c", "d", "e", "f"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, col := range cols {
+				if !column.ChunksEqual(col, zc[name]) {
+					t.Errorf("expecting zero-copy reads of column %v (%v compressed) to match regular reads", name, cmp)
+				}
+			}
+		}
+	}
+}
+
 // note that this measures throughput in terms of the original file size, not the size it takes on the disk
 func BenchmarkReadingFromStripes(b *testing.B) {
 	db, err := NewDatabase("", nil)
@@ -218,6 +319,306 @@ func BenchmarkReadingFromStripes(b *testing.B) {
 	}
 }
 
+func TestRunLengthEncodedStripes(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var raw strings.Builder
+	raw.WriteString("id,day,label\n")
+	expected := map[string]*column.Chunk{
+		"id":    column.NewChunk(column.DtypeInt),
+		"day":   column.NewChunk(column.DtypeDate),
+		"label": column.NewChunk(column.DtypeString),
+	}
+	for j := 0; j < 1000; j++ {
+		row := []string{strconv.Itoa(j), "2020-01-" + strconv.Itoa(10+j/100), "constant"}
+		raw.WriteString(strings.Join(row, ",") + "\n")
+		for k, name := range []string{"id", "day", "label"} {
+			if err := expected[name].AddValue(row[k]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("events", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripe := ds.Stripes[0]
+	encodings := []column.Encoding{column.EncodingPlain, column.EncodingRLE, column.EncodingRLE}
+	if !reflect.DeepEqual(stripe.Encodings, encodings) {
+		t.Fatalf("expecting columns to be encoded as %v, got %v", encodings, stripe.Encodings)
+	}
+
+	cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"id", "day", "label"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// constant columns are read as literals
+	if !cols["label"].IsLiteral || cols["day"].IsLiteral {
+		t.Errorf("expecting only the constant column to be read as a literal")
+	}
+	for name, col := range cols {
+		if col.IsLiteral {
+			col = col.Reorder(make([]int, col.Len()))
+		}
+		if !column.ChunksEqual(col, expected[name]) {
+			t.Errorf("column %v was not read back intact", name)
+		}
+	}
+}
+
+func TestLoadingWithDialects(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	dateFormat := func(layout string) column.DateFormat {
+		df, err := column.NewDateFormat(layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return df
+	}
+
+	tests := []struct {
+		raw    string
+		opts   LoadOptions
+		schema column.TableSchema
+		data   [][]string
+		err    error
+	}{
+		// European exports tend to be semicolon delimited
+		{"a;b\n1;\"foo;bar\"\n2;baz", LoadOptions{Delimiter: "semicolon"}, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeString}}, [][]string{{"1", "2"}, {"foo;bar", "baz"}}, nil},
+		{"a;b\n1;2", LoadOptions{Delimiter: ";"}, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeInt}}, [][]string{{"1"}, {"2"}}, nil},
+		{"a\tb\n1\t\"2\"", LoadOptions{Delimiter: "tab"}, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeString}}, [][]string{{"1"}, {"\"2\""}}, nil},
+		// a single row cannot be inferred as pipe delimited, so this needs an explicit delimiter
+		{"a|b", LoadOptions{Delimiter: "|", NoHeader: true}, column.TableSchema{{Name: "column_01", Dtype: column.DtypeString}, {Name: "column_02", Dtype: column.DtypeString}}, [][]string{{"a"}, {"b"}}, nil},
+		{"1,2\n3,4", LoadOptions{NoHeader: true}, column.TableSchema{{Name: "column_01", Dtype: column.DtypeInt}, {Name: "column_02", Dtype: column.DtypeInt}}, [][]string{{"1", "3"}, {"2", "4"}}, nil},
+		{"a,b\n'foo, \"bar\"',2\n'it''s',3", LoadOptions{Quote: "'"}, column.TableSchema{{Name: "a", Dtype: column.DtypeString}, {Name: "b", Dtype: column.DtypeInt}}, [][]string{{"foo, \"bar\"", "it's"}, {"2", "3"}}, nil},
+		{"a,b\n\"foo,2\n\"bar,3", LoadOptions{Quote: "none"}, column.TableSchema{{Name: "a", Dtype: column.DtypeString}, {Name: "b", Dtype: column.DtypeInt}}, [][]string{{"\"foo", "\"bar"}, {"2", "3"}}, nil},
+		{"a,b\n1,NA\nNA,\\N\n3,4", LoadOptions{NullTokens: []string{"NA", "\\N"}}, column.TableSchema{{Name: "a", Dtype: column.DtypeInt, Nullable: true}, {Name: "b", Dtype: column.DtypeInt, Nullable: true}}, [][]string{{"1", "", "3"}, {"", "", "4"}}, nil},
+		// null tokens don't apply to headers
+		{"NA,b\n1,NA", LoadOptions{NullTokens: []string{"NA"}}, column.TableSchema{{Name: "na", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeNull, Nullable: true}}, [][]string{{"1"}, {""}}, nil},
+		// numbers formatted according to a locale
+		{"a;b;c\n\"1.234,5\";1.000;x\n2,25;12;y", LoadOptions{Delimiter: ";", Decimal: ",", Thousands: "."}, column.TableSchema{{Name: "a", Dtype: column.DtypeFloat}, {Name: "b", Dtype: column.DtypeInt}, {Name: "c", Dtype: column.DtypeString}}, [][]string{{"1234.5", "2.25"}, {"1000", "12"}, {"x", "y"}}, nil},
+		{"a;b\n1,50;-1 000 000\n2,25;3e2", LoadOptions{Delimiter: ";", Decimal: ",", Thousands: " "}, column.TableSchema{{Name: "a", Dtype: column.DtypeDecimal}, {Name: "b", Dtype: column.DtypeFloat}}, [][]string{{"1.50", "2.25"}, {"-1000000", "300"}}, nil},
+		{"a,b\n\"1,234.5\",N/A\n-,\"12,345\"", LoadOptions{Thousands: ",", NullTokens: []string{"N/A", "-"}}, column.TableSchema{{Name: "a", Dtype: column.DtypeFloat, Nullable: true}, {Name: "b", Dtype: column.DtypeInt, Nullable: true}}, [][]string{{"1234.5", ""}, {"", "12345"}}, nil},
+		// numbers not formatted according to our locale are not numbers at all (1.5 or 1.50 is ambiguous)
+		{"a;b\n1.5;1.50\n2,5;1.500", LoadOptions{Delimiter: ";", Decimal: ",", Thousands: "."}, column.TableSchema{{Name: "a", Dtype: column.DtypeString}, {Name: "b", Dtype: column.DtypeString}}, [][]string{{"1.5", "2,5"}, {"1.50", "1.500"}}, nil},
+		{"a;b\n1.5;2", LoadOptions{Delimiter: ";", Decimal: ",", SchemaHints: SchemaHints{"a": {Dtype: column.DtypeFloat}}}, nil, nil, errs.ErrBadRequest},
+		// unambiguous dates and datetimes get detected, others need their formats declared
+		{"a,b,c\n2020/12/31,2020-12-31T12:00:00Z,2020-12-31T12:00:00.5+02:00", LoadOptions{}, column.TableSchema{{Name: "a", Dtype: column.DtypeDate}, {Name: "b", Dtype: column.DtypeDatetime}, {Name: "c", Dtype: column.DtypeDatetime}}, [][]string{{"2020-12-31"}, {"2020-12-31 12:00:00"}, {"2020-12-31 10:00:00.500000"}}, nil},
+		{"a,b\n31/12/2020,1609459200\n1/2/2021,", LoadOptions{SchemaHints: SchemaHints{"a": {Format: dateFormat("DD/MM/YYYY")}, "b": {Format: dateFormat("epoch")}}}, column.TableSchema{{Name: "a", Dtype: column.DtypeDate}, {Name: "b", Dtype: column.DtypeDatetime, Nullable: true}}, [][]string{{"2020-12-31", "2021-02-01"}, {"2021-01-01 00:00:00", ""}}, nil},
+		{"a;b\n12.31.2020 12:34:56;1609459200123", LoadOptions{Delimiter: ";", SchemaHints: SchemaHints{"a": {Dtype: column.DtypeDatetime, Format: dateFormat("MM.DD.YYYY")}, "b": {Format: dateFormat("epoch_ms")}}}, column.TableSchema{{Name: "a", Dtype: column.DtypeDatetime}, {Name: "b", Dtype: column.DtypeDatetime}}, [][]string{{"2020-12-31 12:34:56"}, {"2021-01-01 00:00:00.123000"}}, nil},
+		{"a\n31/12/2020", LoadOptions{SchemaHints: SchemaHints{"a": {Format: dateFormat("MM/DD/YYYY")}}}, nil, nil, errs.ErrBadRequest},
+		{"a\n1609459200", LoadOptions{SchemaHints: SchemaHints{"a": {Dtype: column.DtypeDate, Format: dateFormat("epoch")}}}, nil, nil, errInvalidSchemaHint},
+		{"a,b\n1,2", LoadOptions{Decimal: ";"}, nil, nil, errInvalidDialect},
+		{"a,b\n1,2", LoadOptions{Thousands: "."}, nil, nil, errInvalidDialect},
+		{"a,b\n1,2", LoadOptions{Delimiter: "ab"}, nil, nil, errInvalidDialect},
+		{"a,b\n1,2", LoadOptions{Quote: "''"}, nil, nil, errInvalidDialect},
+		{"a,b\n1,2", LoadOptions{Quote: ",", Delimiter: ","}, nil, nil, errInvalidDialect},
+	}
+	for _, test := range tests {
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions("dialects", strings.NewReader(test.raw), test.opts)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q (%+v) to result in %v, got %v", test.raw, test.opts, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(ds.Schema, test.schema) {
+			t.Errorf("expecting %q (%+v) to have schema %v, got %v", test.raw, test.opts, test.schema, ds.Schema)
+			continue
+		}
+		names := make([]string, 0, len(test.schema))
+		for _, col := range test.schema {
+			names = append(names, col.Name)
+		}
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, ds.Stripes[0], names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, col := range test.schema {
+			expected := column.NewChunk(col.Dtype)
+			if err := expected.AddValues(test.data[j]); err != nil {
+				t.Fatal(err)
+			}
+			if !column.ChunksEqual(cols[col.Name], expected) {
+				t.Errorf("expecting column %v of %q (%+v) to be loaded as %v", col.Name, test.raw, test.opts, test.data[j])
+			}
+		}
+	}
+}
+
+func TestLoadingWithSchemaHints(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	tests := []struct {
+		raw    string
+		hints  string
+		schema column.TableSchema
+		err    error
+	}{
+		{"a,b\n1,2", `{}`, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeInt}}, nil},
+		{"a,b\n1,2", `{"a": "string"}`, column.TableSchema{{Name: "a", Dtype: column.DtypeString}, {Name: "b", Dtype: column.DtypeInt}}, nil},
+		{"a,b\n1,2", `{"a": {"dtype": "float"}, "b": {"dtype": "int", "nullable": true}}`, column.TableSchema{{Name: "a", Dtype: column.DtypeFloat}, {Name: "b", Dtype: column.DtypeInt, Nullable: true}}, nil},
+		// types and nullability can be hinted independently
+		{"a,b\n1,", `{"b": {"nullable": true}}`, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeNull, Nullable: true}}, nil},
+		{"a,b\n1,", `{"b": {"dtype": "date"}}`, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeDate, Nullable: true}}, nil},
+		// hints refer to cleaned up column names
+		{"Foo Bar\n1", `{"foo_bar": "string"}`, column.TableSchema{{Name: "foo_bar", Dtype: column.DtypeString}}, nil},
+		{"a,b\n1,2", `{"c": "int"}`, nil, errInvalidSchemaHint},
+		// data that don't fit hinted types fail to load
+		{"a,b\nfoo,2", `{"a": "int"}`, nil, strconv.ErrSyntax},
+		{"a,b\n1,", `{"b": {"dtype": "int", "nullable": false}}`, nil, errUnexpectedNull},
+		// defaults fill in empty values and missing columns
+		{"a,b\n1,", `{"b": {"default": "0"}}`, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeInt}}, nil},
+		{"a\n1", `{"c": {"default": "foo"}, "b": {"default": "2", "dtype": "float"}}`, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeFloat}, {Name: "c", Dtype: column.DtypeString}}, nil},
+		{"a\n1", `{"c": {"default": ""}}`, nil, errInvalidSchemaHint},
+		{"a\n1", `{"c": {"default": "foo", "dtype": "int"}}`, nil, errInvalidSchemaHint},
+		{"a\n1", `{"a": {"expression": "1"}}`, nil, errInvalidSchemaHint},
+		// expressions get compiled by the query package, which we don't import here
+		{"a\n1", `{"c": {"expression": "a + 1"}}`, nil, errNoExpressions},
+	}
+	for _, test := range tests {
+		var hints SchemaHints
+		if err := json.Unmarshal([]byte(test.hints), &hints); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions("hints", strings.NewReader(test.raw), LoadOptions{SchemaHints: hints})
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q (with hints %v) to result in %v, got %v", test.raw, test.hints, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(ds.Schema, test.schema) {
+			t.Errorf("expecting %q (with hints %v) to have schema %v, got %v", test.raw, test.hints, test.schema, ds.Schema)
+		}
+	}
+}
+
+func TestLoadingSortedData(t *testing.T) {
+	// tiny stripes, so that we check stripe boundaries as well
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	tests := []struct {
+		raw     string
+		sortKey []string
+		err     error
+	}{
+		{"a,b\n1,2\n1,3\n2,1\n3,0", []string{"a"}, nil},
+		{"a,b\n1,2\n1,3\n2,1\n3,0", []string{"a", "b"}, nil},
+		{"a,b\n1,2\n1,3\n2,1\n3,0", []string{"b"}, errNotSorted},
+		// out of order across stripes
+		{"a,b\n1,2\n2,3\n1,1\n3,0", []string{"a"}, errNotSorted},
+		{"a,b\n1,3\n1,2\n2,1\n3,0", []string{"a", "b"}, errNotSorted},
+		// nulls sort last
+		{"a,b\n1,2\n1,3\n2,1\n,0\n,1", []string{"a", "b"}, nil},
+		{"a,b\n,2\n1,3", []string{"a"}, errNotSorted},
+		// strings cannot be null, empty strings sort first
+		{"a,b\n,2\nfoo,3\nzoo,1", []string{"a"}, nil},
+		{"a,b\n2020-01-01,1\n2020-02-01,2\n2021-01-01,3", []string{"a"}, nil},
+		{"a,b\n1,2", []string{"c"}, errNotSorted},
+	}
+	for _, test := range tests {
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions("sorted", strings.NewReader(test.raw), LoadOptions{SortKey: test.sortKey})
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q sorted by %v to result in %v, got %v", test.raw, test.sortKey, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(ds.SortKey, test.sortKey) {
+			t.Errorf("expecting %q to be sorted by %v, got %v", test.raw, test.sortKey, ds.SortKey)
+		}
+	}
+
+	// sort keys are persisted in manifests, but they don't survive appends
+	ds, err := db.LoadDatasetFromReaderAutoWithOptions("sorted", strings.NewReader("a\n1\n2\n3"), LoadOptions{SortKey: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := NewDatabase(db.Config.WorkingDirectory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds2, err := db2.GetDatasetLatest("sorted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ds2.SortKey, []string{"a"}) {
+		t.Errorf("expecting a sort key to be persisted, got %v", ds2.SortKey)
+	}
+	appended, err := db.AppendToDataset(ds, strings.NewReader("a\n0"), WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appended.SortKey != nil {
+		t.Errorf("expecting appended data to lose their sort key, got %v", appended.SortKey)
+	}
+}
+
+
+func TestFailedLoadsCleanUp(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	// the first stripe gets written before we find out the data are not sorted
+	raw := "a,b\n1,2\n2,3\n1,1\n3,0"
+	if _, err := db.LoadDatasetFromReaderAutoWithOptions("sorted", strings.NewReader(raw), LoadOptions{SortKey: []string{"a"}}); !errors.Is(err, errNotSorted) {
+		t.Fatalf("expecting unsorted data to fail loading, got %v", err)
+	}
+	entries, err := os.ReadDir(db.dataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expecting failed loads not to leave any data behind, got %v", entries)
+	}
+}
 func TestColumnSchemaMarshalingRoundtrips(t *testing.T) {
 	cs := column.Schema{Name: "foo", Dtype: column.DtypeBool, Nullable: true}
 	dt, err := json.Marshal(cs)
@@ -347,6 +748,51 @@ func TestCacheErrors(t *testing.T) {
 }
 
 // if we flip any single bit in the file - apart from the checksums and version, we should get a checksum error
+func TestSplitStringColumns(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var raw strings.Builder
+	raw.WriteString("id,word,name\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString(strconv.Itoa(j) + ",word_" + strconv.Itoa(j*j) + ",jméno_" + strconv.Itoa(j) + "\n")
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("words", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripe := ds.Stripes[0]
+	if len(stripe.Splits) != 3 || stripe.Splits[0] != 0 || stripe.Splits[1] == 0 || stripe.Splits[2] == 0 {
+		t.Fatalf("expecting string columns to be split, got %v", stripe.Splits)
+	}
+
+	full, fullRead, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"word", "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// names have multi-byte characters, so they need to be read in full
+	lazy, lazyRead, err := db.ReadColumnsFromStripe(ds, stripe, []string{"word", "name"}, []string{"word", "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full["word"].OffsetsOnly() || !lazy["word"].OffsetsOnly() || lazy["name"].OffsetsOnly() {
+		t.Errorf("expecting only words to be read without contents")
+	}
+	if !column.ChunksEqual(full["name"], lazy["name"]) || full["word"].Len() != lazy["word"].Len() {
+		t.Errorf("expecting columns read without contents to be otherwise intact")
+	}
+	if lazyRead.BytesRead >= fullRead.BytesRead {
+		t.Errorf("expecting reading just offsets to be cheaper, read %v and %v bytes", lazyRead.BytesRead, fullRead.BytesRead)
+	}
+}
+
 func TestChecksumValidation(t *testing.T) {
 	db, err := NewDatabase("", nil)
 	if err != nil {
@@ -403,7 +849,7 @@ func TestChecksumValidation(t *testing.T) {
 				t.Error(err)
 				continue
 			}
-			if err := readStripes(); err != errIncorrectChecksum {
+			if err := readStripes(); !errors.Is(err, errIncorrectChecksum) {
 				t.Errorf("flipping bits should trigger %+v, got %+v instead", errIncorrectChecksum, err)
 			}
 		}
@@ -438,7 +884,7 @@ func TestInvalidOffsets(t *testing.T) {
 	for _, test := range tests {
 		ds.Stripes[0].Offsets = test
 
-		if _, _, err := db.ReadColumnsFromStripeByNames(ds, ds.Stripes[0], cols); err != errInvalidOffsetData {
+		if _, _, err := db.ReadColumnsFromStripeByNames(ds, ds.Stripes[0], cols); !errors.Is(err, errInvalidOffsetData) {
 			t.Errorf("expecting offsets %+v to trigger errInvalidOffsetData, but got %+v instead", test, err)
 		}
 	}
@@ -526,3 +972,232 @@ func TestLoadingFromMaps(t *testing.T) {
 // func (db *Database) loadDatasetFromReader(r io.Reader, settings loadSettings) (*Dataset, error) {
 // func (db *Database) loadDatasetFromLocalFile(path string, settings loadSettings) (*Dataset, error) {
 // ReadColumnsFromStripeByNames
+
+func TestAppendingToDatasets(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", strings.NewReader("foo,bar\n1,a\n2,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	appended, err := db.AppendToDataset(ds, strings.NewReader("foo,bar\n3,\n4,d"), WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appended.ID == ds.ID || appended.Name != ds.Name {
+		t.Errorf("expecting appends to create a new version of %v, got %v (%v)", ds.Name, appended.Name, appended.ID)
+	}
+	latest, err := db.GetDatasetLatest(ds.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != appended {
+		t.Errorf("expecting the appended dataset to be the latest version")
+	}
+	if appended.NRows != 4 || len(appended.Stripes) != 2 {
+		t.Errorf("expecting 4 rows in 2 stripes, got %v rows in %v stripes", appended.NRows, len(appended.Stripes))
+	}
+	es := column.TableSchema{{Name: "foo", Dtype: column.DtypeInt}, {Name: "bar", Dtype: column.DtypeString, Nullable: true}}
+	if !reflect.DeepEqual(appended.Schema, es) {
+		t.Errorf("expecting appended schema to be %+v, got %+v", es, appended.Schema)
+	}
+
+	// the original version is unchanged and can be removed without affecting the new one
+	if ds.NRows != 2 || len(ds.Stripes) != 1 {
+		t.Errorf("appending should not modify the original dataset, got %v rows in %v stripes", ds.NRows, len(ds.Stripes))
+	}
+	if err := db.removeDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*column.Chunk{
+		column.NewChunkIntsFromSlice([]int64{1, 2}, nil),
+		column.NewChunkIntsFromSlice([]int64{3, 4}, nil),
+	}
+	for j, stripe := range appended.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(appended, stripe, []string{"foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(cols["foo"], expected[j]) {
+			t.Errorf("expecting stripe %v to contain %v, got %v", j, expected[j], cols["foo"])
+		}
+	}
+	if err := db.removeDataset(appended); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(db.DatasetPath(ds)); !os.IsNotExist(err) {
+		t.Errorf("expecting shared stripes to be deleted along with the last dataset using them, got %+v", err)
+	}
+}
+
+func TestAppendingWithWidening(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", strings.NewReader("foo,bar,baz\n1,,a\n2,,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.AppendToDataset(ds, strings.NewReader("foo,bar,baz\n3,4,c"), WideningAllowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended, err := db.AppendToDataset(first, strings.NewReader("foo,bar,baz\n1.5,,e\n2.5,6,d"), WideningAllowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := column.TableSchema{
+		{Name: "foo", Dtype: column.DtypeFloat},
+		{Name: "bar", Dtype: column.DtypeInt, Nullable: true},
+		{Name: "baz", Dtype: column.DtypeString},
+	}
+	if !reflect.DeepEqual(appended.Schema, es) {
+		t.Errorf("expecting widened schema to be %+v, got %+v", es, appended.Schema)
+	}
+	if len(first.SchemaChanges) != 1 || first.SchemaChanges[0].Before.Dtype != column.DtypeNull || first.SchemaChanges[0].After.Dtype != column.DtypeInt {
+		t.Errorf("expecting the first append to widen bar from null to int, got %+v", first.SchemaChanges)
+	}
+	if len(appended.SchemaChanges) != 1 || appended.SchemaChanges[0].After != es[0] {
+		t.Errorf("expecting the second append to widen foo to floats, got %+v", appended.SchemaChanges)
+	}
+	if ds.Schema[0].Dtype != column.DtypeInt || ds.Stripes[0].Dtypes != nil {
+		t.Errorf("widening should not modify previous versions, got %+v", ds)
+	}
+
+	expected := []map[string]*column.Chunk{
+		{"foo": column.NewChunkFloatsFromSlice([]float64{1, 2}, nil)},
+		{"foo": column.NewChunkFloatsFromSlice([]float64{3}, nil)},
+		{"foo": column.NewChunkFloatsFromSlice([]float64{1.5, 2.5}, nil)},
+	}
+	for j, stripe := range appended.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(appended, stripe, []string{"foo", "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(cols["foo"], expected[j]["foo"]) {
+			t.Errorf("expecting stripe %v to contain %v, got %v", j, expected[j]["foo"], cols["foo"])
+		}
+		if cols["bar"].Dtype() != column.DtypeInt {
+			t.Errorf("expecting stripe %v to contain ints, got %v", j, cols["bar"].Dtype())
+		}
+	}
+	// stripes widened twice still remember their original types
+	if dtypes := appended.Stripes[0].Dtypes; len(dtypes) != 3 || dtypes[0] != column.DtypeInt || dtypes[1] != column.DtypeNull {
+		t.Errorf("expecting the first stripe to retain its original types, got %v", dtypes)
+	}
+
+	// incompatible types don't get widened
+	if _, err := db.AppendToDataset(appended, strings.NewReader("foo,bar,baz\nabc,1,e"), WideningAllowed); !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("expecting an incompatible append to fail with %v, got %v", strconv.ErrSyntax, err)
+	}
+}
+
+func TestAppendingMismatchedData(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", strings.NewReader("foo,bar\n1,a\n2,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data string
+		err  error
+	}{
+		{"foo\n1", errSchemaMismatch},
+		{"foo,bar,baz\n1,2,3", errSchemaMismatch},
+		{"foo,baz\n1,2", errSchemaMismatch},
+		{"foo,bar\nabc,d", strconv.ErrSyntax},
+		{"foo,bar\n1.5,d", strconv.ErrSyntax}, // types don't get widened by default
+	}
+	for _, test := range tests {
+		if _, err := db.AppendToDataset(ds, strings.NewReader(test.data), WideningNone); !errors.Is(err, test.err) {
+			t.Errorf("expecting appending %v to fail with %v, got %v", test.data, test.err, err)
+		}
+	}
+	if len(db.Datasets) != 1 {
+		t.Errorf("failed appends should not create new versions, got %v datasets", len(db.Datasets))
+	}
+}
+
+func TestAppendingWithOptions(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	hints := SchemaHints{"baz": {Default: strptr("x")}}
+	ds, err := db.LoadDatasetFromReaderAutoWithOptions("foobar", strings.NewReader("foo;bar\n1;a\n2;b"), LoadOptions{SchemaHints: hints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dialect and defaults of the original load don't stick, they need to be passed again
+	if _, err := db.AppendToDataset(ds, strings.NewReader("foo|bar\nNA|c"), WideningNone); !errors.Is(err, errSchemaMismatch) {
+		t.Errorf("expecting appending without options to fail with %v, got %v", errSchemaMismatch, err)
+	}
+	opts := LoadOptions{Delimiter: "pipe", NullTokens: []string{"NA"}, SchemaHints: hints}
+	appended, err := db.AppendToDatasetWithOptions(ds, strings.NewReader("foo|bar\nNA|c"), WideningNone, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := column.TableSchema{
+		{Name: "foo", Dtype: column.DtypeInt, Nullable: true},
+		{Name: "bar", Dtype: column.DtypeString},
+		{Name: "baz", Dtype: column.DtypeString},
+	}
+	if appended.NRows != 3 || !reflect.DeepEqual(appended.Schema, expected) {
+		t.Errorf("expecting an append with options to result in %+v, got %+v (%v rows)", expected, appended.Schema, appended.NRows)
+	}
+
+	failing := []LoadOptions{
+		{SortKey: []string{"foo"}},
+		{Namespace: "other"},
+	}
+	for _, opts := range failing {
+		if _, err := db.AppendToDatasetWithOptions(ds, strings.NewReader("foo,bar,baz\n3,d,y"), WideningNone, opts); !errors.Is(err, errInvalidAppend) {
+			t.Errorf("expecting appending with %+v to fail with %v, got %v", opts, errInvalidAppend, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errUploadNotFound = errs.New(errs.ErrNotFound, "upload not found")
+var errInvalidPartNumber = errs.New(errs.ErrBadRequest, "invalid part number")
+var errMissingParts = errs.New(errs.ErrBadRequest, "upload is missing some parts")
+
+// parts are numbered from 1, the upper bound mirrors that of S3 multipart uploads
+const maxUploadParts = 10_000
+
+// Multipart uploads let clients send large files in parts (each in its own request), so that a failed
+// request only means resending a single part, not the whole file. The protocol is as follows:
+//  1. InitMultipartUpload returns an upload ID
+//  2. parts get written using WriteUploadPart, in any order (and possibly concurrently), a part
+//     can be written again (e.g. after a failed request), UploadParts lists what's been received
+//  3. CompleteMultipartUpload stitches all the parts together and loads them as a new dataset
+//     (AbortMultipartUpload discards them instead)
+//
+// Parts are plain chunks of the file's bytes, so compressed files can be split at arbitrary offsets.
+// ARCH: parts live in our working directory, even if stripes are stored in S3, so in-memory
+// databases don't support multipart uploads
+// TODO: uploads that are never completed (or aborted) are never cleaned up
+
+// UploadPart describes a part of a multipart upload that has been received
+type UploadPart struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+}
+
+func (db *Database) uploadPath(id UID) string {
+	return filepath.Join(db.Config.WorkingDirectory, "uploads", id.String())
+}
+
+func (db *Database) existingUploadPath(id UID) (string, error) {
+	if id.Otype != OtypeUpload {
+		return "", fmt.Errorf("%w: %v", errInvalidUploadID, id)
+	}
+	if db.inMemory {
+		return "", errNoWorkingDirectory
+	}
+	dir := db.uploadPath(id)
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return "", fmt.Errorf("%w: %v", errUploadNotFound, id)
+	}
+	return dir, nil
+}
+
+func partFilename(part int) string {
+	return fmt.Sprintf("part-%05d", part)
+}
+
+// InitMultipartUpload starts a new multipart upload, its parts can be written using the returned ID
+func (db *Database) InitMultipartUpload() (UID, error) {
+	id := newUID(OtypeUpload)
+	if db.inMemory {
+		return id, errNoWorkingDirectory
+	}
+	if err := os.MkdirAll(db.uploadPath(id), os.ModePerm); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// WriteUploadPart stores a single part of a multipart upload, overwriting the part if it had been
+// received before. Parts are first written to a temporary file, so that an interrupted request
+// doesn't leave a partial part behind.
+func (db *Database) WriteUploadPart(id UID, part int, r io.Reader) (int64, error) {
+	dir, err := db.existingUploadPath(id)
+	if err != nil {
+		return 0, err
+	}
+	if part < 1 || part > maxUploadParts {
+		return 0, fmt.Errorf("%w: %v (needs to be between 1 and %v)", errInvalidPartNumber, part, maxUploadParts)
+	}
+	f, err := os.CreateTemp(dir, "incoming-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, partFilename(part))); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// UploadParts lists all the parts received so far (ordered by their numbers), this is useful
+// for resuming interrupted uploads
+func (db *Database) UploadParts(id UID) ([]UploadPart, error) {
+	dir, err := db.existingUploadPath(id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]UploadPart, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "part-") {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "part-"))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, UploadPart{Number: number, Size: info.Size()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// CompleteMultipartUpload stitches parts 1 through N together and loads them as a new dataset,
+// there can't be any gaps in part numbers. The upload is removed once it's loaded.
+// ARCH: like LoadDatasetFromReaderAuto, this doesn't add the dataset to the database
+func (db *Database) CompleteMultipartUpload(name string, id UID, opts LoadOptions) (*Dataset, error) {
+	parts, err := db.UploadParts(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: no parts received", errMissingParts)
+	}
+	for j, part := range parts {
+		if part.Number != j+1 {
+			return nil, fmt.Errorf("%w: part %v not received", errMissingParts, j+1)
+		}
+	}
+	dir := db.uploadPath(id)
+	// OPTIM: we could read the parts in sequence instead of copying them into a single file, but
+	// both type inference and loading need a file they can read from the start
+	path := filepath.Join(dir, "stitched")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, part := range parts {
+		pf, err := os.Open(filepath.Join(dir, partFilename(part.Number)))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		n, err := io.Copy(f, pf)
+		pf.Close()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		size += n
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	ds, err := db.loadDatasetFromLocalFileAuto(name, path, opts)
+	if err != nil {
+		// we keep the parts, so that the client can e.g. fix a part and retry
+		os.Remove(path)
+		return nil, err
+	}
+	ds.SizeRaw = size
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// AbortMultipartUpload discards all the parts of an upload
+func (db *Database) AbortMultipartUpload(id UID) error {
+	dir, err := db.existingUploadPath(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMultipartUploads(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var raw bytes.Buffer
+	raw.WriteString("foo,bar\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString("1,abc\n2,def\n")
+	}
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{raw.Bytes(), compressed.Bytes()} {
+		id, err := db.InitMultipartUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// split at arbitrary offsets (mid-row, mid-gzip-block), sent out of order, with a retry
+		cuts := []int{0, len(data) / 3, len(data) / 2, len(data)}
+		order := []int{2, 0, 1, 2}
+		for _, j := range order {
+			if _, err := db.WriteUploadPart(id, j+1, bytes.NewReader(data[cuts[j]:cuts[j+1]])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		parts, err := db.UploadParts(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []UploadPart{
+			{1, int64(cuts[1] - cuts[0])},
+			{2, int64(cuts[2] - cuts[1])},
+			{3, int64(cuts[3] - cuts[2])},
+		}
+		if !reflect.DeepEqual(parts, expected) {
+			t.Errorf("expecting parts %+v, got %+v", expected, parts)
+		}
+
+		ds, err := db.CompleteMultipartUpload("foobar", id, LoadOptions{Namespace: "big"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds.Name != "foobar" || ds.Namespace != "big" || ds.NRows != 2000 || ds.SizeRaw != int64(len(data)) {
+			t.Errorf("unexpected dataset loaded from a multipart upload: %+v", ds)
+		}
+		if _, err := os.Stat(db.uploadPath(id)); !os.IsNotExist(err) {
+			t.Errorf("expecting completed uploads to be removed, got %v", err)
+		}
+		if _, err := db.WriteUploadPart(id, 1, strings.NewReader("foo")); !errors.Is(err, errUploadNotFound) {
+			t.Errorf("expecting completed uploads not to accept parts, got %v", err)
+		}
+	}
+}
+
+func TestMultipartUploadErrors(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	id, err := db.InitMultipartUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompleteMultipartUpload("foo", id, LoadOptions{}); !errors.Is(err, errMissingParts) {
+		t.Errorf("expecting empty uploads to fail, got %v", err)
+	}
+	for _, part := range []int{0, -1, maxUploadParts + 1} {
+		if _, err := db.WriteUploadPart(id, part, strings.NewReader("foo")); !errors.Is(err, errInvalidPartNumber) {
+			t.Errorf("expecting part %v to be rejected, got %v", part, err)
+		}
+	}
+	if _, err := db.WriteUploadPart(id, 1, strings.NewReader("foo,bar\n1,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.WriteUploadPart(id, 3, strings.NewReader("3,4\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompleteMultipartUpload("foo", id, LoadOptions{}); !errors.Is(err, errMissingParts) {
+		t.Errorf("expecting uploads with gaps to fail, got %v", err)
+	}
+	// failed completions keep the parts, so missing ones can be supplied
+	if _, err := db.WriteUploadPart(id, 2, strings.NewReader("5,6\n")); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := db.CompleteMultipartUpload("foo", id, LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.NRows != 3 {
+		t.Errorf("expecting three rows, got %v", ds.NRows)
+	}
+
+	aborted, err := db.InitMultipartUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AbortMultipartUpload(aborted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UploadParts(aborted); !errors.Is(err, errUploadNotFound) {
+		t.Errorf("expecting aborted uploads to be gone, got %v", err)
+	}
+	if _, err := db.UploadParts(ds.ID); !errors.Is(err, errInvalidUploadID) {
+		t.Errorf("expecting non-upload IDs to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// rowSplitter cuts decoded input (see decodeInput) into blocks of whole rows, so that these can
+// be parsed independently of each other. Rows end with newlines, unless these are quoted, so we
+// keep track of quotes - escaped quotes are doubled, so they don't affect this.
+// ARCH: errors of malformed data (e.g. csv.ParseError) report lines within blocks, not files
+type rowSplitter struct {
+	r       *bufio.Reader
+	quote   byte   // zero if values cannot be quoted
+	pending []byte // see unread
+}
+
+func newRowSplitter(r io.Reader, settings *loadSettings) *rowSplitter {
+	rs := &rowSplitter{r: bufio.NewReader(r)}
+	// see NewRowReader for when we parse quotes
+	if settings.delimiter != delimiterTab && !settings.noQuotes {
+		rs.quote = '"'
+		if settings.quote != 0 {
+			rs.quote = settings.quote
+		}
+	}
+	return rs
+}
+
+// next returns a block of at least size bytes (unless we are at the end of our input), which
+// ends at the end of a row, io.EOF means there is nothing left to read
+func (rs *rowSplitter) next(size int) ([]byte, error) {
+	block := rs.pending
+	rs.pending = nil
+	quoted, partial := false, false
+	for len(block) < size || quoted || partial {
+		line, err := rs.r.ReadSlice('\n')
+		block = append(block, line...)
+		if rs.quote != 0 && bytes.Count(line, []byte{rs.quote})%2 == 1 {
+			quoted = !quoted
+		}
+		// lines longer than our buffer come in parts
+		partial = errors.Is(err, bufio.ErrBufferFull)
+		switch {
+		case err == io.EOF:
+			if len(block) == 0 {
+				return nil, io.EOF
+			}
+			// unterminated quotes are for our parser to report
+			return block, nil
+		case err != nil && !partial:
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// unread puts a block back, so that it's at the start of the next one (blocks always end with
+// whole rows, so we don't lose track of quotes)
+func (rs *rowSplitter) unread(block []byte) {
+	rs.pending = append(block, rs.pending...)
+}
+
+// parsedBlock holds stripes parsed out of a block of rows and already written to storage
+type parsedBlock struct {
+	stripes []*stripeData
+	nbytes  int64
+	err     error
+}
+
+func (pb *parsedBlock) metas() []Stripe {
+	metas := make([]Stripe, 0, len(pb.stripes))
+	for _, stripe := range pb.stripes {
+		metas = append(metas, stripe.meta)
+	}
+	return metas
+}
+
+// parseBlocks parses blocks of rows into stripes, which it writes to storage, the work is
+// split among Config.ParseWorkers goroutines. Stripes are yielded in the order of the blocks they
+// come from, so the first block to fail is also the first error to be yielded. Should a consumer
+// stop early (by returning an error), stripes written in the meantime get removed, stripes it
+// received need to be removed by it.
+// ARCH: blocks are as large as stripes (in bytes), so that most blocks become a single stripe
+// (blocks with too many rows produce several), we only have a few blocks in flight at a time
+func (db *Database) parseBlocks(dataset *Dataset, rs *rowSplitter, settings *loadSettings, consume func(*parsedBlock) error) error {
+	maxRows, maxBytes := db.stripeLimits()
+	workers := db.Config.ParseWorkers
+
+	type job struct {
+		block  []byte
+		result chan *parsedBlock
+	}
+	jobs := make(chan job)
+	// results in the order of their blocks, each gets filled in by whichever worker parses it
+	order := make(chan chan *parsedBlock, workers)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		defer close(jobs)
+		for {
+			block, err := rs.next(maxBytes)
+			if err == io.EOF {
+				return
+			}
+			result := make(chan *parsedBlock, 1)
+			select {
+			case order <- result:
+			case <-done:
+				return
+			}
+			if err != nil {
+				result <- &parsedBlock{err: err}
+				return
+			}
+			select {
+			case jobs <- job{block, result}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.result <- db.parseBlock(dataset, job.block, settings, maxRows, maxBytes)
+			}
+		}()
+	}
+
+	var err error
+	for result := range order {
+		pb := <-result
+		if pb.err != nil {
+			err = pb.err
+			break
+		}
+		if err = consume(pb); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		wg.Wait()
+		return nil
+	}
+	// we need to wait for everything in flight to finish, so that we can clean up after it
+	close(done)
+	wg.Wait()
+	for result := range order {
+		select {
+		case pb := <-result:
+			for _, stripe := range pb.stripes {
+				db.removeStripes(dataset, []Stripe{stripe.meta})
+			}
+		default:
+			// this block never got to a worker
+		}
+	}
+	return err
+}
+
+// parseBlock loads a block of rows into stripes (there can be more of them if the block has more
+// rows than a stripe can hold) and writes them to storage
+func (db *Database) parseBlock(dataset *Dataset, block []byte, settings *loadSettings, maxRows, maxBytes int) *parsedBlock {
+	pb := &parsedBlock{}
+	fail := func(err error) *parsedBlock {
+		db.removeStripes(dataset, pb.metas())
+		return &parsedBlock{err: err}
+	}
+	rr, err := newRowReaderFromDecoded(bytes.NewReader(block), settings, false)
+	if err != nil {
+		return fail(err)
+	}
+	for {
+		ds, loadingErr := newStripeFromReader(rr, settings.schema, settings.floats, settings.numbers, settings.dates, settings.defaults, maxRows, maxBytes)
+		if loadingErr != nil && loadingErr != io.EOF {
+			return fail(loadingErr)
+		}
+		// blocks end with complete rows, so we only get an empty stripe at the very end of one
+		if ds.meta.Length == 0 {
+			return pb
+		}
+		if err := settings.derive(ds); err != nil {
+			return fail(err)
+		}
+		nbytes, err := db.writeStripeToFile(dataset, ds, settings.writeCompression)
+		if err != nil {
+			return fail(err)
+		}
+		pb.nbytes += nbytes
+		pb.stripes = append(pb.stripes, ds)
+		if loadingErr == io.EOF {
+			return pb
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestRowSplitting(t *testing.T) {
+	long := strings.Repeat("x", 10_000)
+	tests := []struct {
+		raw      string
+		settings loadSettings
+		size     int
+		blocks   []string
+	}{
+		{"", loadSettings{}, 1, nil},
+		{"a\nb\nc", loadSettings{}, 1, []string{"a\n", "b\n", "c"}},
+		{"a\nb\nc\n", loadSettings{}, 3, []string{"a\nb\n", "c\n"}},
+		{"a\nb\nc\n", loadSettings{}, 100, []string{"a\nb\nc\n"}},
+		// quoted newlines don't end rows
+		{"\"a\nb\",c\nd\n", loadSettings{}, 1, []string{"\"a\nb\",c\n", "d\n"}},
+		{"\"a\"\"\nb\",c\nd\n", loadSettings{}, 1, []string{"\"a\"\"\nb\",c\n", "d\n"}},
+		{"'a\nb',c\nd\n", loadSettings{quote: '\''}, 1, []string{"'a\nb',c\n", "d\n"}},
+		{"\"a\nb\n", loadSettings{noQuotes: true}, 1, []string{"\"a\n", "b\n"}},
+		{"\"a\tb\n", loadSettings{delimiter: delimiterTab}, 1, []string{"\"a\tb\n"}},
+		// unterminated quotes run until the end of our input
+		{"\"a\nb\nc", loadSettings{}, 1, []string{"\"a\nb\nc"}},
+		// rows longer than our buffer
+		{long + "\nb\n", loadSettings{}, 1, []string{long + "\n", "b\n"}},
+		{"\"" + long + "\n" + long + "\"\nb", loadSettings{}, 1, []string{"\"" + long + "\n" + long + "\"\n", "b"}},
+	}
+	for _, test := range tests {
+		rs := newRowSplitter(strings.NewReader(test.raw), &test.settings)
+		var blocks []string
+		for {
+			block, err := rs.next(test.size)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, string(block))
+		}
+		if !reflect.DeepEqual(blocks, test.blocks) {
+			t.Errorf("expecting %q to be split into %q, got %q", test.raw, test.blocks, blocks)
+		}
+	}
+}
+
+func TestParallelLoading(t *testing.T) {
+	// tiny stripes, so that we get lots of blocks parsed in parallel
+	db, err := NewDatabase("", &Config{MaxBytesPerStripe: 100, ParseWorkers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var raw strings.Builder
+	raw.WriteString("id,name\n")
+	nrows := 1000
+	for j := 0; j < nrows; j++ {
+		fmt.Fprintf(&raw, "%v,\"row\n%v\"\n", j, j)
+	}
+	ds, err := db.LoadDatasetFromReaderAutoWithOptions("parallel", strings.NewReader(raw.String()), LoadOptions{SortKey: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.NRows != int64(nrows) || len(ds.Stripes) < 2 {
+		t.Fatalf("expecting %v rows in multiple stripes, got %v rows in %v stripes", nrows, ds.NRows, len(ds.Stripes))
+	}
+	// stripes are in the order of our input
+	expected := column.NewChunk(column.DtypeInt)
+	loaded := column.NewChunk(column.DtypeInt)
+	for j := 0; j < nrows; j++ {
+		if err := expected.AddValue(strconv.Itoa(j)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stripe := range ds.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{"id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.Append(cols["id"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !column.ChunksEqual(loaded, expected) {
+		t.Error("expecting parallel loading to preserve the order of rows")
+	}
+
+	// values not fitting their types fail the whole load, nothing is left behind
+	if err := db.removeDatasetData(ds); err != nil {
+		t.Fatal(err)
+	}
+	raw.WriteString("foo,bar\n")
+	hints := SchemaHints{"id": {Dtype: column.DtypeInt}}
+	if _, err := db.LoadDatasetFromReaderAutoWithOptions("parallel", strings.NewReader(raw.String()), LoadOptions{SchemaHints: hints}); !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("expecting invalid data to fail loading, got %v", err)
+	}
+	entries, err := os.ReadDir(db.dataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expecting failed loads not to leave any data behind, got %v entries", len(entries))
+	}
+}
+
+func TestInferringTypesFromSamples(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	sample := "a,b\n" + strings.Repeat("1,2\n", inferenceSampleRows)
+	tests := []struct {
+		raw    string
+		schema column.TableSchema
+	}{
+		{sample, column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeInt}}},
+		// data beyond our sample get their types inferred again
+		{sample + "foo,2\n", column.TableSchema{{Name: "a", Dtype: column.DtypeString}, {Name: "b", Dtype: column.DtypeInt}}},
+		{sample + "1,\n", column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeInt, Nullable: true}}},
+	}
+	for _, test := range tests {
+		ds, err := db.LoadDatasetFromReaderAuto("sampled", strings.NewReader(test.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ds.Schema, test.schema) {
+			t.Errorf("expecting a schema of %v, got %v", test.schema, ds.Schema)
+		}
+		if ds.NRows != int64(strings.Count(test.raw, "\n")-1) {
+			t.Errorf("expecting all the rows to be loaded, got %v", ds.NRows)
+		}
+	}
+
+	// appends beyond samples may introduce nulls
+	ds, err := db.LoadDatasetFromReaderAuto("sampled", strings.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended, err := db.AppendToDataset(ds, strings.NewReader(sample+"1,\n"), WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !appended.Schema[1].Nullable {
+		t.Errorf("expecting nulls beyond our sample to make a column nullable, got %v", appended.Schema[1])
+	}
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kokes/smda/src/column"
+)
+
+// previewRows is the number of rows in each part of a preview (see Preview)
+const previewRows = 10
+
+// Preview is a small extract of a dataset version, so that listings can show what its data look
+// like without querying them. It contains the first rows of a dataset and rows sampled (without
+// replacement) from all of it, both in their original order. Values are JSON literals, grouped by
+// column - Head[j] and Sample[j] contain values of the j-th column (named in Columns).
+type Preview struct {
+	ID      UID                 `json:"id"`
+	Columns []string            `json:"columns"`
+	Head    [][]json.RawMessage `json:"head"`
+	Sample  [][]json.RawMessage `json:"sample"`
+}
+
+func (db *Database) previewPath(ds *Dataset) string {
+	return filepath.Join(db.Config.WorkingDirectory, "previews", ds.Namespace, ds.ID.String()+".json")
+}
+
+// Preview returns a preview of a given dataset version, previews get persisted as datasets get
+// added (see AddDataset), those of older datasets are created (and persisted) upon first request,
+// in-memory databases don't persist them at all
+func (db *Database) Preview(ds *Dataset) (*Preview, error) {
+	if db.inMemory {
+		return db.newPreview(ds)
+	}
+	data, err := os.ReadFile(db.previewPath(ds))
+	if os.IsNotExist(err) {
+		return db.writePreview(ds)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var preview Preview
+	if err := json.Unmarshal(data, &preview); err != nil {
+		return nil, err
+	}
+	return &preview, nil
+}
+
+func (db *Database) writePreview(ds *Dataset) (*Preview, error) {
+	preview, err := db.newPreview(ds)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return nil, err
+	}
+	fn := db.previewPath(ds)
+	if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(fn, data, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+func (db *Database) newPreview(ds *Dataset) (*Preview, error) {
+	nrows := 0
+	for _, stripe := range ds.Stripes {
+		nrows += stripe.Length
+	}
+	n := previewRows
+	if n > nrows {
+		n = nrows
+	}
+	head := make([]int, n)
+	for j := range head {
+		head[j] = j
+	}
+	// OPTIM: we read the first stripe twice if any rows get sampled from it
+	sampled := make(map[int]bool, n)
+	for len(sampled) < n {
+		sampled[rand.Intn(nrows)] = true
+	}
+	sample := make([]int, 0, n)
+	for row := range sampled {
+		sample = append(sample, row)
+	}
+	sort.Ints(sample)
+
+	preview := &Preview{ID: ds.ID, Columns: make([]string, 0, len(ds.Schema))}
+	for _, col := range ds.Schema {
+		preview.Columns = append(preview.Columns, col.Name)
+	}
+	var err error
+	if preview.Head, err = db.readRows(ds, head); err != nil {
+		return nil, err
+	}
+	if preview.Sample, err = db.readRows(ds, sample); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// readRows reads given rows (sorted positions within a whole dataset) of all the columns of
+// a dataset, values are returned as JSON literals, grouped by column
+func (db *Database) readRows(ds *Dataset, rows []int) ([][]json.RawMessage, error) {
+	ret := make([][]json.RawMessage, len(ds.Schema))
+	for j := range ret {
+		ret[j] = make([]json.RawMessage, 0, len(rows))
+	}
+	offset := 0
+	for _, stripe := range ds.Stripes {
+		var positions []int
+		for len(rows) > 0 && rows[0] < offset+stripe.Length {
+			positions = append(positions, rows[0]-offset)
+			rows = rows[1:]
+		}
+		offset += stripe.Length
+		if len(positions) == 0 {
+			continue
+		}
+		if err := db.readStripeRows(ds, stripe, positions, ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (db *Database) readStripeRows(ds *Dataset, stripe Stripe, positions []int, ret [][]json.RawMessage) error {
+	readColumn := func(j int) (*column.Chunk, error) {
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{ds.Schema[j].Name})
+		if err != nil {
+			return nil, err
+		}
+		return cols[ds.Schema[j].Name], nil
+	}
+	if ds.External == nil {
+		sr, err := NewStripeReader(db, ds, stripe)
+		if err != nil {
+			return err
+		}
+		defer sr.Close()
+		readColumn = sr.ReadColumn
+	}
+	for j := range ds.Schema {
+		chunk, err := readColumn(j)
+		if err != nil {
+			return err
+		}
+		for _, pos := range positions {
+			val, ok := chunk.JSONLiteralWithPolicy(pos, ds.FloatPolicy)
+			if !ok {
+				val = "null"
+			}
+			ret[j] = append(ret[j], json.RawMessage(val))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPreviews(t *testing.T) {
+	for _, opts := range [][]Option{nil, {InMemory()}} {
+		db, err := NewDatabase("", &Config{MaxRowsPerStripe: 4}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		var raw strings.Builder
+		raw.WriteString("id,name,score\n")
+		for j := 0; j < 25; j++ {
+			score := strconv.Itoa(2 * j)
+			if j%5 == 0 {
+				score = ""
+			}
+			fmt.Fprintf(&raw, "%v,row%v,%v\n", j, j, score)
+		}
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		preview, err := db.Preview(ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preview.ID != ds.ID || strings.Join(preview.Columns, ",") != "id,name,score" {
+			t.Fatalf("unexpected preview: %+v", preview)
+		}
+		if len(preview.Head) != 3 || len(preview.Head[0]) != previewRows || len(preview.Sample[2]) != previewRows {
+			t.Fatalf("expecting %v rows of three columns in each part of a preview, got %+v", previewRows, preview)
+		}
+		for j, val := range preview.Head[0] {
+			if string(val) != strconv.Itoa(j) {
+				t.Errorf("expecting row %v to be in the head of a preview, got %s", j, val)
+			}
+		}
+		if string(preview.Head[1][1]) != `"row1"` || string(preview.Head[2][0]) != "null" || string(preview.Head[2][1]) != "2" {
+			t.Errorf("expecting values to be previewed as JSON literals, got %s", preview.Head)
+		}
+		last := -1
+		for j, val := range preview.Sample[0] {
+			id, err := strconv.Atoi(string(val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id <= last || id >= 25 {
+				t.Errorf("expecting sampled rows to be distinct and in order, got %s", preview.Sample[0])
+				break
+			}
+			last = id
+			score := strconv.Itoa(2 * id)
+			if id%5 == 0 {
+				score = "null"
+			}
+			if string(preview.Sample[2][j]) != score {
+				t.Errorf("expecting sampled row %v to have a score of %v, got %s", id, score, preview.Sample[2][j])
+			}
+		}
+		if db.inMemory {
+			continue
+		}
+
+		// previews get persisted as datasets get added, if they are missing, they get recreated
+		fn := db.previewPath(ds)
+		persisted, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served, err := json.Marshal(preview)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(persisted) != string(served) {
+			t.Errorf("expecting a persisted preview to be served, got %s and %s", persisted, served)
+		}
+		if err := os.Remove(fn); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Preview(ds); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(fn); err != nil {
+			t.Errorf("expecting a missing preview to be recreated, got %v", err)
+		}
+		if err := db.DropDataset("foo", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("expecting a preview to be removed along with its dataset, got %v", err)
+		}
+	}
+}
+
+func TestPreviewsOfSmallDatasets(t *testing.T) {
+	db, err := NewDatabase("", nil, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{"foo\n1", "foo\n1\n2\n3"} {
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		preview, err := db.Preview(ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(preview.Head[0]) != int(ds.NRows) || len(preview.Sample[0]) != int(ds.NRows) {
+			t.Errorf("expecting all %v rows to be previewed, got %+v", ds.NRows, preview)
+		}
+	}
+}
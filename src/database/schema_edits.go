@@ -0,0 +1,359 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidSchemaEdit = errs.New(errs.ErrBadRequest, "invalid schema edit")
+
+// SchemaEdit changes a single column of a dataset, it can rename it, change its type, or both
+type SchemaEdit struct {
+	Column string `json:"column"`
+	// new name of the column, it gets cleaned up the same way column names are when loading data
+	Rename string `json:"rename,omitempty"`
+	// new type of the column, values get converted as if they were loaded in this type (see
+	// column.Convert), so e.g. leading zeros lost when inferring zip codes as ints cannot be recovered
+	Dtype column.Dtype `json:"dtype,omitempty"`
+	// values that cannot be converted into the new type become nulls instead of failing the edit
+	// (see InferColumnTypes for how to find these beforehand)
+	NullInvalid bool `json:"null_invalid,omitempty"`
+}
+
+// EditSchema creates (and adds to our database) a new version of a dataset with some of its columns
+// renamed or retyped. Renames only change metadata, the new version shares all the stripes with its
+// predecessor. Type changes need new stripes, but only retyped columns get decoded and re-encoded,
+// all the other columns get copied over as they are stored.
+func (db *Database) EditSchema(ds *Dataset, edits []SchemaEdit) (*Dataset, error) {
+	if ds.External != nil {
+		return nil, errExternalReadOnly
+	}
+	if len(edits) == 0 {
+		return nil, fmt.Errorf("%w: no edits supplied", errInvalidSchemaEdit)
+	}
+	schema := make(column.TableSchema, len(ds.Schema))
+	copy(schema, ds.Schema)
+	renames := make(map[string]string)
+	retyped := make(map[int]column.Dtype)
+	lenient := make(map[int]bool)
+	seen := make(map[int]bool)
+	for _, edit := range edits {
+		idx, col, err := ds.Schema.LocateColumn(edit.Column)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSchemaEdit, err)
+		}
+		if seen[idx] {
+			return nil, fmt.Errorf("%w: column %v edited more than once", errInvalidSchemaEdit, col.Name)
+		}
+		seen[idx] = true
+		if edit.Rename != "" {
+			schema[idx].Name = cleanupIdentifier(edit.Rename, "column")
+			renames[col.Name] = schema[idx].Name
+		}
+		switch edit.Dtype {
+		case column.DtypeInvalid, col.Dtype:
+			// no type change
+		case column.DtypeNull:
+			return nil, fmt.Errorf("%w: cannot change the type of %v to null", errInvalidSchemaEdit, col.Name)
+		default:
+			schema[idx].Dtype = edit.Dtype
+			retyped[idx] = edit.Dtype
+			lenient[idx] = edit.NullInvalid
+		}
+	}
+	names := make(map[string]bool, len(schema))
+	for _, col := range schema {
+		if names[col.Name] {
+			return nil, fmt.Errorf("%w: duplicate column name %v", errInvalidSchemaEdit, col.Name)
+		}
+		names[col.Name] = true
+	}
+
+	edited := NewDatasetInNamespace(ds.Namespace, ds.Name)
+	edited.NRows = ds.NRows
+	edited.SizeRaw = ds.SizeRaw
+	edited.FloatPolicy = ds.FloatPolicy
+	for _, key := range ds.SortKey {
+		// ARCH: retyped values may sort differently (e.g. ints as strings), we'd have to verify the
+		// order again, so we drop the sort key altogether
+		idx, _, err := ds.Schema.LocateColumn(key)
+		if _, ok := retyped[idx]; ok && err == nil {
+			edited.SortKey = nil
+			break
+		}
+		if name, ok := renames[key]; ok {
+			key = name
+		}
+		edited.SortKey = append(edited.SortKey, key)
+	}
+
+	if len(retyped) == 0 {
+		edited.Stripes = make([]Stripe, 0, len(ds.Stripes))
+		for _, stripe := range ds.Stripes {
+			if stripe.Owner == nil {
+				owner := ds.ID
+				stripe.Owner = &owner
+			}
+			edited.Stripes = append(edited.Stripes, stripe)
+		}
+		edited.SizeOnDisk = ds.SizeOnDisk
+		edited.Stats = ds.Stats
+	} else {
+		// conversions may introduce nulls (e.g. empty strings as ints) or remove them (strings are
+		// never null), so we need to see all the converted data to tell their nullability
+		for idx := range retyped {
+			schema[idx].Nullable = false
+		}
+		// stats of retyped columns need to be collected anew
+		collectors := make(statsCollectors, len(schema))
+		for idx, dtype := range retyped {
+			collectors[idx] = column.NewStatsCollector(dtype)
+		}
+		for _, stripe := range ds.Stripes {
+			rewritten, nbytes, err := db.rewriteStripe(ds, edited, stripe, retyped, lenient, schema, collectors)
+			if err != nil {
+				db.removeStripes(edited, edited.Stripes)
+				return nil, err
+			}
+			edited.Stripes = append(edited.Stripes, rewritten)
+			edited.SizeOnDisk += nbytes
+		}
+		if ds.Stats != nil {
+			edited.Stats = make([]column.ColumnStats, len(ds.Stats))
+			copy(edited.Stats, ds.Stats)
+			for idx := range retyped {
+				edited.Stats[idx] = collectors[idx].Stats()
+			}
+		}
+	}
+	edited.Schema = schema
+	for j, col := range ds.Schema {
+		if schema[j] != col {
+			edited.SchemaChanges = append(edited.SchemaChanges, SchemaChange{Before: col, After: schema[j]})
+		}
+	}
+
+	if err := db.AddDataset(edited); err != nil {
+		return nil, err
+	}
+	return edited, nil
+}
+
+// maxInferenceConflicts caps the number of conflicting values reported for each column
+const maxInferenceConflicts = 100
+
+// ColumnInference is a type inferred anew for a column of a dataset (see InferColumnTypes)
+type ColumnInference struct {
+	Column string        `json:"column"`
+	Before column.Schema `json:"before"`
+	After  column.Schema `json:"after"`
+	// values not conforming to the inferred type, they'd become nulls upon conversion, rows are
+	// numbered across the whole dataset (from zero), we only list the first few of them
+	NConflicts int                         `json:"nconflicts"`
+	Conflicts  []column.ConversionConflict `json:"conflicts"`
+}
+
+// InferColumnTypes infers types of given columns anew, based on all of their values, tolerating
+// some values of other types (see column.TypeGuesser.DominantType) - e.g. a column loaded as
+// strings due to a single bad value will get inferred as ints. Nothing gets changed, the inferred
+// types can be applied via EditSchema (with SchemaEdit.NullInvalid, so that conflicts become nulls).
+func (db *Database) InferColumnTypes(ds *Dataset, columns []string) ([]ColumnInference, error) {
+	if ds.External != nil {
+		return nil, errExternalReadOnly
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%w: no columns supplied", errInvalidSchemaEdit)
+	}
+	inferences := make([]ColumnInference, 0, len(columns))
+	guessers := make([]*column.TypeGuesser, 0, len(columns))
+	for _, name := range columns {
+		_, col, err := ds.Schema.LocateColumn(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSchemaEdit, err)
+		}
+		inferences = append(inferences, ColumnInference{Column: col.Name, Before: col})
+		guessers = append(guessers, column.NewLenientTypeGuesser(column.NumberFormat{}))
+	}
+	// ARCH: we read all the data twice - first to infer types, then to find values that don't
+	// conform to them (the chunk cache may spare us some of the reads)
+	for _, stripe := range ds.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, columns)
+		if err != nil {
+			return nil, err
+		}
+		for j, name := range columns {
+			guessers[j].AddChunk(plainChunk(cols[name]))
+		}
+	}
+	for j := range inferences {
+		inferences[j].After = guessers[j].DominantType()
+		inferences[j].After.Name = inferences[j].Column
+	}
+	offset := 0
+	for _, stripe := range ds.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, columns)
+		if err != nil {
+			return nil, err
+		}
+		for j, name := range columns {
+			inf := &inferences[j]
+			if inf.After.Dtype == inf.Before.Dtype {
+				continue
+			}
+			_, conflicts, err := plainChunk(cols[name]).ConvertLenient(inf.After.Dtype, ds.FloatPolicy)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert column %v: %w", name, err)
+			}
+			inf.NConflicts += len(conflicts)
+			for _, conflict := range conflicts {
+				if len(inf.Conflicts) == maxInferenceConflicts {
+					break
+				}
+				conflict.Row += offset
+				inf.Conflicts = append(inf.Conflicts, conflict)
+			}
+		}
+		offset += stripe.Length
+	}
+	return inferences, nil
+}
+
+// rewriteStripe writes a copy of a stripe for a dataset with some of its columns retyped, these get
+// converted and re-encoded, all the other columns are copied byte for byte (that includes their
+// compression, encoding and the types they were written in). Retyped columns that turn out to
+// contain nulls get marked as nullable in the supplied schema and their stats get collected. Lenient
+// columns get their unconvertible values nullified (see SchemaEdit.NullInvalid).
+func (db *Database) rewriteStripe(src, dst *Dataset, stripe Stripe, retyped map[int]column.Dtype, lenient map[int]bool, schema column.TableSchema, collectors statsCollectors) (Stripe, int64, error) {
+	sr, err := NewStripeReader(db, src, stripe)
+	if err != nil {
+		return Stripe{}, 0, err
+	}
+	defer sr.Close()
+
+	rewritten := Stripe{
+		Id:      newUID(OtypeStripe),
+		Length:  stripe.Length,
+		Offsets: make([]uint32, 0, 1+len(src.Schema)),
+	}
+	dtypes := make([]column.Dtype, len(src.Schema))
+	encodings := make([]column.Encoding, len(src.Schema))
+	widened, rle := false, false
+	for j, col := range src.Schema {
+		dtypes[j] = col.Dtype
+		if stripe.Dtypes != nil {
+			dtypes[j] = stripe.Dtypes[j]
+		}
+		if stripe.Encodings != nil {
+			encodings[j] = stripe.Encodings[j]
+		}
+	}
+
+	// nothing gets stored until the writer gets closed (see blobWriter)
+	bw := db.newBlobWriter(dst)
+	fail := func(err error) (Stripe, int64, error) {
+		return Stripe{}, 0, err
+	}
+	buf := new(bytes.Buffer)
+	convertedColumns := make(map[int]*column.Chunk, len(retyped))
+	splits := make([]uint32, len(src.Schema))
+	offset := uint32(0)
+	rewritten.Offsets = append(rewritten.Offsets, offset)
+	for j := range src.Schema {
+		var nw uint32
+		if dtype, ok := retyped[j]; ok {
+			chunk, err := sr.ReadColumn(j)
+			if err != nil {
+				return fail(err)
+			}
+			chunk = plainChunk(chunk)
+			var converted *column.Chunk
+			if lenient[j] {
+				converted, _, err = chunk.ConvertLenient(dtype, src.FloatPolicy)
+			} else {
+				converted, err = chunk.Convert(dtype, src.FloatPolicy)
+			}
+			if err != nil {
+				return fail(fmt.Errorf("cannot convert column %v: %w", src.Schema[j].Name, err))
+			}
+			if converted.Nullability != nil && converted.Nullability.Count() > 0 {
+				schema[j].Nullable = true
+			}
+			if err := collectors[j].Add(converted); err != nil {
+				return fail(err)
+			}
+			convertedColumns[j] = converted
+			dtypes[j] = dtype
+			encodings[j] = converted.PreferredEncoding()
+			var head uint32
+			nw, head, err = writeColumn(bw, buf, converted, encodings[j], db.writeCompression)
+			if err != nil {
+				return fail(err)
+			}
+			if head > 0 {
+				splits[j] = offset + head
+			}
+		} else {
+			raw, err := sr.readRaw(j)
+			if err != nil {
+				return fail(err)
+			}
+			if _, err := bw.Write(raw); err != nil {
+				return fail(err)
+			}
+			nw = uint32(len(raw))
+			if stripe.Splits != nil && stripe.Splits[j] > 0 {
+				splits[j] = stripe.Splits[j] - stripe.Offsets[j] + offset
+			}
+		}
+		offset += nw
+		rewritten.Offsets = append(rewritten.Offsets, offset)
+		widened = widened || dtypes[j] != schema[j].Dtype
+		rle = rle || encodings[j] != column.EncodingPlain
+	}
+	// bloom filters of untouched columns get copied as well, retyped columns get new ones
+	size := int64(offset)
+	if stripe.Blooms != nil || db.Config.BloomFilters {
+		filters := make([][]byte, len(src.Schema))
+		for j := range src.Schema {
+			converted, ok := convertedColumns[j]
+			if !ok {
+				if filters[j], err = sr.readBloomFilter(j); err != nil {
+					return fail(err)
+				}
+				continue
+			}
+			if db.Config.BloomFilters {
+				if filter := newBloomFilter(converted); filter != nil {
+					filters[j] = filter.Bytes()
+				}
+			}
+		}
+		nb, blooms, err := writeBloomFilters(bw, offset, filters)
+		if err != nil {
+			return fail(err)
+		}
+		size += nb
+		rewritten.Blooms = blooms
+	}
+	if err := bw.Close(); err != nil {
+		return fail(err)
+	}
+	rewritten.Hash = bw.hash
+	// like when loading data, we only keep track of types and encodings that differ from the defaults
+	if widened {
+		rewritten.Dtypes = dtypes
+	}
+	if rle {
+		rewritten.Encodings = encodings
+	}
+	for _, split := range splits {
+		if split > 0 {
+			rewritten.Splits = splits
+			break
+		}
+	}
+	return rewritten, size, nil
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestRenamingColumns(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAutoWithOptions("foobar", strings.NewReader("foo,bar\n1,a\n2,b"), LoadOptions{SortKey: []string{"foo", "bar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	edited, err := db.EditSchema(ds, []SchemaEdit{{Column: "foo", Rename: "Foo Baz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := column.TableSchema{
+		{Name: "foo_baz", Dtype: column.DtypeInt},
+		{Name: "bar", Dtype: column.DtypeString},
+	}
+	if !reflect.DeepEqual(edited.Schema, es) {
+		t.Errorf("expecting renamed schema to be %+v, got %+v", es, edited.Schema)
+	}
+	if !reflect.DeepEqual(edited.SortKey, []string{"foo_baz", "bar"}) {
+		t.Errorf("expecting the sort key to follow renames, got %v", edited.SortKey)
+	}
+	if len(edited.SchemaChanges) != 1 || edited.SchemaChanges[0].Before.Name != "foo" || edited.SchemaChanges[0].After != es[0] {
+		t.Errorf("unexpected schema changes: %+v", edited.SchemaChanges)
+	}
+	// renames don't touch any data
+	if len(edited.Stripes) != 1 || edited.Stripes[0].Id != ds.Stripes[0].Id || *edited.Stripes[0].Owner != ds.ID {
+		t.Errorf("expecting renamed datasets to share stripes with their predecessors, got %+v", edited.Stripes)
+	}
+	if ds.Schema[0].Name != "foo" {
+		t.Errorf("edits should not modify previous versions, got %+v", ds.Schema)
+	}
+	cols, _, err := db.ReadColumnsFromStripeByNames(edited, edited.Stripes[0], []string{"foo_baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !column.ChunksEqual(cols["foo_baz"], column.NewChunkIntsFromSlice([]int64{1, 2}, nil)) {
+		t.Errorf("unexpected data in a renamed column: %v", cols["foo_baz"])
+	}
+	latest, err := db.GetDatasetLatest("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != edited {
+		t.Errorf("expecting the edited dataset to be the latest version")
+	}
+}
+
+func TestRetypingColumns(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", strings.NewReader("foo,zip,baz\n1,01234,a\n2,,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// the first stripe will have foo stored as ints, while the schema says floats
+	appended, err := db.AppendToDataset(ds, strings.NewReader("foo,zip,baz\n1.5,56789,c"), WideningAllowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, err := db.EditSchema(appended, []SchemaEdit{
+		{Column: "zip", Dtype: column.DtypeString},
+		{Column: "baz", Rename: "qux"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := column.TableSchema{
+		{Name: "foo", Dtype: column.DtypeFloat},
+		{Name: "zip", Dtype: column.DtypeString},
+		{Name: "qux", Dtype: column.DtypeString},
+	}
+	if !reflect.DeepEqual(edited.Schema, es) {
+		t.Errorf("expecting retyped schema to be %+v, got %+v", es, edited.Schema)
+	}
+	if len(edited.SchemaChanges) != 2 {
+		t.Errorf("expecting two schema changes, got %+v", edited.SchemaChanges)
+	}
+	if edited.NRows != 3 || len(edited.Stripes) != 2 {
+		t.Fatalf("unexpected retyped dataset: %+v", edited)
+	}
+	// untouched columns are copied as they are, including their original types
+	if dtypes := edited.Stripes[0].Dtypes; !reflect.DeepEqual(dtypes, []column.Dtype{column.DtypeInt, column.DtypeString, column.DtypeString}) {
+		t.Errorf("expecting the first stripe to retain its original types, got %v", dtypes)
+	}
+	if edited.Stripes[1].Dtypes != nil {
+		t.Errorf("expecting the second stripe to match the schema, got %v", edited.Stripes[1].Dtypes)
+	}
+
+	expected := []map[string][]string{
+		// leading zeros are lost by inferring zip codes as ints
+		{"foo": {"1", "2"}, "zip": {"1234", ""}, "qux": {"a", "b"}},
+		{"foo": {"1.5"}, "zip": {"56789"}, "qux": {"c"}},
+	}
+	for j, stripe := range edited.Stripes {
+		if stripe.Owner != nil || stripe.Id == appended.Stripes[j].Id {
+			t.Errorf("expecting retyped datasets to have their own stripes, got %+v", stripe)
+		}
+		cols, _, err := db.ReadColumnsFromStripeByNames(edited, stripe, []string{"foo", "zip", "qux"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, col := range es {
+			ec := column.NewChunk(col.Dtype)
+			if err := ec.AddValues(expected[j][col.Name]); err != nil {
+				t.Fatal(err)
+			}
+			if !column.ChunksEqual(cols[col.Name], ec) {
+				t.Errorf("expecting column %v in stripe %v to be %v, got %v", col.Name, j, ec, cols[col.Name])
+			}
+		}
+	}
+
+	// and back, empty strings become nulls
+	reverted, err := db.EditSchema(edited, []SchemaEdit{{Column: "zip", Dtype: column.DtypeInt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Schema[1].Dtype != column.DtypeInt || !reverted.Schema[1].Nullable {
+		t.Errorf("expecting zip to be nullable ints, got %+v", reverted.Schema[1])
+	}
+}
+
+func TestInferringColumnTypes(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", strings.NewReader("foo,bar,baz\n1,a,x\n2,b,1\nn/a,c,y\n4,,z\n5,e,2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	inferences, err := db.InferColumnTypes(ds, []string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ColumnInference{
+		{
+			Column: "foo", Before: ds.Schema[0], After: column.Schema{Name: "foo", Dtype: column.DtypeInt, Nullable: true},
+			NConflicts: 1, Conflicts: []column.ConversionConflict{{Row: 2, Value: "n/a"}},
+		},
+		{Column: "bar", Before: ds.Schema[1], After: ds.Schema[1]},
+		{Column: "baz", Before: ds.Schema[2], After: ds.Schema[2]},
+	}
+	if !reflect.DeepEqual(inferences, expected) {
+		t.Errorf("expecting inferred types to be %+v, got %+v", expected, inferences)
+	}
+	for _, columns := range [][]string{nil, {"nope"}} {
+		if _, err := db.InferColumnTypes(ds, columns); !errors.Is(err, errInvalidSchemaEdit) {
+			t.Errorf("expecting inference of %v to fail, got %v", columns, err)
+		}
+	}
+
+	// the inferred type can only be applied if conflicts are nullified
+	if _, err := db.EditSchema(ds, []SchemaEdit{{Column: "foo", Dtype: column.DtypeInt}}); err == nil {
+		t.Error("expecting conflicting values to fail the conversion")
+	}
+	edited, err := db.EditSchema(ds, []SchemaEdit{{Column: "foo", Dtype: column.DtypeInt, NullInvalid: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Schema[0] != expected[0].After {
+		t.Errorf("expecting foo to be retyped as %+v, got %+v", expected[0].After, edited.Schema[0])
+	}
+	values := column.NewChunk(column.DtypeInt)
+	for _, stripe := range edited.Stripes {
+		cols, _, err := db.ReadColumnsFromStripeByNames(edited, stripe, []string{"foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := values.Append(cols["foo"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ec := column.NewChunk(column.DtypeInt)
+	if err := ec.AddValues([]string{"1", "2", "", "4", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if !column.ChunksEqual(values, ec) {
+		t.Errorf("expecting conflicting values to become nulls, got %v", values)
+	}
+}
+
+func TestInvalidSchemaEdits(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", strings.NewReader("foo,bar\n1,a\n2,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	tests := [][]SchemaEdit{
+		nil,
+		{{Column: "baz", Rename: "foo"}},
+		{{Column: "foo", Rename: "bar"}},
+		{{Column: "foo", Rename: "a"}, {Column: "foo", Dtype: column.DtypeFloat}},
+		{{Column: "foo", Dtype: column.DtypeNull}},
+	}
+	for _, edits := range tests {
+		if _, err := db.EditSchema(ds, edits); !errors.Is(err, errInvalidSchemaEdit) {
+			t.Errorf("expecting edits %+v to be rejected, got %v", edits, err)
+		}
+	}
+
+	if _, err := db.EditSchema(ds, []SchemaEdit{{Column: "bar", Dtype: column.DtypeInt}}); err == nil {
+		t.Error("expecting strings that don't look like ints not to convert")
+	}
+	if len(db.Datasets) != 1 {
+		t.Errorf("expecting failed edits not to create new versions, got %v datasets", len(db.Datasets))
+	}
+	entries, err := os.ReadDir(db.dataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expecting failed edits not to leave any data behind, got %v", entries)
+	}
+}
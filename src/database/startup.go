@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var errInvalidManifest = errors.New("invalid manifest")
+
+// Lazy defers setting up anything not needed right away until first use, which lowers start up
+// latency of short-lived processes (e.g. Lambda cold starts), which often serve requests that
+// don't need most of it. S3 clients get set up once they are needed and manifests only get their
+// headers (names and versions) read upon start up, each dataset is read in full the first time
+// it's looked up (see hydrate). WarmUp can be used to initialise everything (e.g. in the
+// background) before requests come in.
+func Lazy() Option {
+	return func(db *Database) {
+		db.lazy = true
+	}
+}
+
+// WarmUp performs all the initialisation lazy databases deferred (see Lazy), it's safe to call
+// it concurrently with other operations (those wait for it to finish if they need to), it's
+// a no-op for databases with nothing left to initialise
+func (db *Database) WarmUp() error {
+	if err := db.LoadManifests(); err != nil {
+		return err
+	}
+	if db.aws == nil {
+		return nil
+	}
+	return db.aws.init()
+}
+
+// LoadManifests reads all the manifests a lazy database hasn't read yet (see Lazy), so that all
+// of db.Datasets can be used directly (e.g. when listing them)
+func (db *Database) LoadManifests() error {
+	db.Lock()
+	defer db.Unlock()
+	return db.hydrateAll()
+}
+
+// hydrate reads a dataset's manifest in full, if it has only had its header read so far (see
+// Lazy), this needs to be called with the database locked
+// OPTIM: manifests are read while holding the lock, so lookups of other datasets wait for it
+func (db *Database) hydrate(ds *Dataset) error {
+	if ds.manifest == "" {
+		return nil
+	}
+	loaded, err := readManifest(ds.manifest)
+	if err != nil {
+		return err
+	}
+	if loaded.ID != ds.ID {
+		return fmt.Errorf("%w: manifest %v changed since start up", errInvalidManifest, ds.manifest)
+	}
+	*ds = *loaded
+	db.blobs.reference(ds)
+	return nil
+}
+
+// hydrateAll reads all the manifests not read yet, references to stored stripes are only complete
+// afterwards, so this needs to happen before any stripes get stored or removed (see blobRefs),
+// this needs to be called with the database locked
+func (db *Database) hydrateAll() error {
+	if !db.partial {
+		return nil
+	}
+	for _, ds := range db.Datasets {
+		if err := db.hydrate(ds); err != nil {
+			return err
+		}
+	}
+	db.partial = false
+	return nil
+}
+
+// awsClients sets up an S3 client (shared by our storage and uploads) based on the standard AWS
+// environment (env variables, shared config files etc.), it gets initialised upon first use, it
+// implements s3API, s3Lister and s3Presigner
+type awsClients struct {
+	once      sync.Once
+	err       error
+	client    *s3.Client
+	presigner *s3.PresignClient
+}
+
+func (ac *awsClients) init() error {
+	ac.once.Do(func() {
+		cfg, err := awsconfig.LoadDefaultConfig(context.TODO())
+		if err != nil {
+			ac.err = err
+			return
+		}
+		ac.client = s3.NewFromConfig(cfg)
+		ac.presigner = s3.NewPresignClient(ac.client)
+	})
+	return ac.err
+}
+
+func (ac *awsClients) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := ac.init(); err != nil {
+		return nil, err
+	}
+	return ac.client.PutObject(ctx, params, optFns...)
+}
+
+func (ac *awsClients) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := ac.init(); err != nil {
+		return nil, err
+	}
+	return ac.client.GetObject(ctx, params, optFns...)
+}
+
+func (ac *awsClients) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := ac.init(); err != nil {
+		return nil, err
+	}
+	return ac.client.DeleteObject(ctx, params, optFns...)
+}
+
+func (ac *awsClients) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if err := ac.init(); err != nil {
+		return nil, err
+	}
+	return ac.client.ListObjectsV2(ctx, params, optFns...)
+}
+
+func (ac *awsClients) PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	if err := ac.init(); err != nil {
+		return nil, err
+	}
+	return ac.presigner.PresignPutObject(ctx, params, optFns...)
+}
+
+// readManifests decodes manifests concurrently (databases with many dataset versions would
+// otherwise spend most of their start up decoding them one by one) using a given reader (either
+// readManifest or readManifestHeader), datasets are returned in the order of their manifests
+func readManifests(paths []string, read func(string) (*Dataset, error)) ([]*Dataset, error) {
+	datasets := make([]*Dataset, len(paths))
+	errs := make([]error, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				datasets[j], errs[j] = read(paths[j])
+			}
+		}()
+	}
+	for j := range paths {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return datasets, nil
+}
+
+func readManifest(path string) (*Dataset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ds Dataset
+	if err := json.Unmarshal(data, &ds); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+// readManifestHeader only reads what's needed to look up a dataset (its ID, name, namespace and
+// creation time), the rest of its manifest gets read once the dataset is needed (see hydrate).
+// Manifests are encoded with fields in the order of Dataset's fields, so these come first and we
+// can stop reading right after them, regardless of how many stripes there are.
+func readManifestHeader(path string) (*Dataset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("%w: %v is not an object", errInvalidManifest, path)
+	}
+	ds := &Dataset{manifest: path}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok {
+		case "id":
+			err = dec.Decode(&ds.ID)
+		case "name":
+			err = dec.Decode(&ds.Name)
+		case "namespace":
+			err = dec.Decode(&ds.Namespace)
+		case "created_timestamp":
+			if err := dec.Decode(&ds.Created); err != nil {
+				return nil, err
+			}
+			return ds, nil
+		default:
+			// not a manifest we've written, so we'd better read all of it
+			return readManifest(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %v has no creation time", errInvalidManifest, path)
+}
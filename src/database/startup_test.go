@@ -0,0 +1,167 @@
+package database
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLazyDatabases(t *testing.T) {
+	config := &Config{StorageBucket: "smda-bucket", UploadBucket: "smda-bucket", UploadPrefix: "ingest"}
+	db, err := NewDatabase("", config, InMemory(), Lazy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.aws == nil || db.aws.client != nil {
+		t.Fatal("expecting a lazy database not to set up its S3 client right away")
+	}
+	if err := db.WarmUp(); err != nil {
+		t.Fatal(err)
+	}
+	if db.aws.client == nil || db.aws.presigner == nil {
+		t.Error("expecting a warmed up database to have its S3 clients set up")
+	}
+	// repeated warm ups are no-ops
+	client := db.aws.client
+	if err := db.WarmUp(); err != nil || db.aws.client != client {
+		t.Errorf("expecting a repeated warm up not to do anything, got %v", err)
+	}
+
+	local, err := NewDatabase("", nil, Lazy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := local.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := local.WarmUp(); err != nil {
+		t.Errorf("expecting a warm up with nothing to initialise to pass, got %v", err)
+	}
+}
+
+func TestReadingManyManifests(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for j := 0; j < 50; j++ {
+		ds := NewDatasetInNamespace([]string{"", "sales"}[j%2], "foo")
+		ds.NRows = int64(j)
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db2, err := NewDatabase(db.Config.WorkingDirectory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db2.Datasets) != len(db.Datasets) {
+		t.Fatalf("expecting %v datasets to be loaded, got %v", len(db.Datasets), len(db2.Datasets))
+	}
+	for _, ds := range db.Datasets {
+		loaded, err := db2.GetDatasetByVersion(ds.QualifiedName(), ds.ID.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ds, loaded) {
+			t.Errorf("expecting %+v to be loaded, got %+v", ds, loaded)
+		}
+	}
+
+	if err := os.WriteFile(db.manifestPath(db.Datasets[7]), []byte("{"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDatabase(db.Config.WorkingDirectory, nil); err == nil {
+		t.Error("expecting a corrupt manifest to fail a database's start up")
+	}
+}
+
+func TestLazyManifests(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromMap("foo", map[string][]string{"a": {"1", "2"}, "b": {"x", "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// the appended version shares its first stripe with the original
+	appended, err := db.AppendToDataset(ds, strings.NewReader("a,b\n3,z"), WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lazy, err := NewDatabase(db.Config.WorkingDirectory, nil, Lazy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lazy.Datasets) != 2 {
+		t.Fatalf("expecting two datasets, got %v", len(lazy.Datasets))
+	}
+	for _, stub := range lazy.Datasets {
+		if stub.manifest == "" || stub.Schema != nil || stub.Stripes != nil || stub.Name != "foo" {
+			t.Errorf("expecting only manifest headers to be read upon start up, got %+v", stub)
+		}
+	}
+	loaded, err := lazy.GetDatasetByVersion("foo", ds.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, ds) {
+		t.Errorf("expecting %+v to be read upon lookup, got %+v", ds, loaded)
+	}
+	latest, err := lazy.GetDatasetLatest("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(latest, appended) {
+		t.Errorf("expecting %+v to be the latest version, got %+v", appended, latest)
+	}
+
+	// stripes shared with datasets not read yet must survive drops
+	lazy, err = NewDatabase(db.Config.WorkingDirectory, nil, Lazy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lazy.DropDataset("foo", appended.ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if errs := lazy.Fsck(); len(errs) > 0 {
+		t.Errorf("expecting the original version to be intact after dropping its successor, got %v", errs)
+	}
+	if err := lazy.LoadManifests(); err != nil || len(lazy.Datasets) != 1 || lazy.Datasets[0].manifest != "" {
+		t.Errorf("expecting all manifests to be loaded, got %v", err)
+	}
+
+	// corrupt manifests only fail lookups of their datasets
+	if err := os.WriteFile(db.manifestPath(ds), []byte(`{"id":"`+ds.ID.String()+`","name":"foo","created_timestamp":1,"nrows":`), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	lazy, err = NewDatabase(db.Config.WorkingDirectory, nil, Lazy())
+	if err != nil {
+		t.Fatalf("expecting a lazy database to start up despite a corrupt manifest, got %v", err)
+	}
+	if _, err := lazy.GetDatasetByVersion("foo", ds.ID.String()); err == nil {
+		t.Error("expecting a corrupt manifest to fail a lookup")
+	}
+	if err := lazy.WarmUp(); err == nil {
+		t.Error("expecting a corrupt manifest to fail a warm up")
+	}
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"github.com/kokes/smda/src/column"
+)
+
+// statsCollectors gather column stats of a dataset as its stripes get written, so that we can
+// describe datasets without querying them (see Dataset.Stats)
+type statsCollectors []*column.StatsCollector
+
+func newStatsCollectors(schema column.TableSchema) statsCollectors {
+	collectors := make(statsCollectors, len(schema))
+	for j, col := range schema {
+		collectors[j] = column.NewStatsCollector(col.Dtype)
+	}
+	return collectors
+}
+
+func (sc statsCollectors) add(columns []*column.Chunk) error {
+	for j, col := range columns {
+		if err := sc[j].Add(col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc statsCollectors) stats() []column.ColumnStats {
+	stats := make([]column.ColumnStats, len(sc))
+	for j, collector := range sc {
+		stats[j] = collector.Stats()
+	}
+	return stats
+}
+
+// resultStats collects stats of columnar data (they have been validated against a schema)
+func resultStats(schema column.TableSchema, data []*column.Chunk) []column.ColumnStats {
+	collectors := newStatsCollectors(schema)
+	if err := collectors.add(data); err != nil {
+		// types were validated beforehand, so this cannot happen
+		panic(err)
+	}
+	return collectors.stats()
+}
+
+// mergeStats combines stats of a dataset with stats of data appended to it, datasets created
+// before we collected stats don't have any, so their appended versions don't have them either
+func mergeStats(schema column.TableSchema, a, b []column.ColumnStats, rowsA, rowsB int64) []column.ColumnStats {
+	if a == nil || b == nil {
+		return nil
+	}
+	merged := make([]column.ColumnStats, len(schema))
+	for j, col := range schema {
+		merged[j] = column.MergeStats(col.Dtype, a[j], b[j], rowsA, rowsB)
+	}
+	return merged
+}
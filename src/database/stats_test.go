@@ -0,0 +1,99 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func strptr(s string) *string {
+	return &s
+}
+
+func TestCollectingDatasetStats(t *testing.T) {
+	db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	// stats get collected across stripes
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n3,xy\n,xy\n1,z\n5,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.Stripes) != 2 {
+		t.Fatalf("expecting data to be split in two stripes, got %v", len(ds.Stripes))
+	}
+	expected := []column.ColumnStats{
+		{NullFraction: 0.25, Distinct: 3, Min: strptr("1"), Max: strptr("5")},
+		{Distinct: 3, Min: strptr(""), Max: strptr("z"), AvgLength: 1.25},
+	}
+	if !reflect.DeepEqual(ds.Stats, expected) {
+		t.Errorf("expecting stats %+v, got %+v", expected, ds.Stats)
+	}
+
+	// appended data are merged with the existing stats
+	appended, err := db.AppendToDataset(ds, strings.NewReader("a,b\n7.5,abc"), WideningAllowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []column.ColumnStats{
+		{NullFraction: 0.2, Distinct: 3, Min: strptr("1"), Max: strptr("7.5")},
+		{Distinct: 3, Min: strptr(""), Max: strptr("z"), AvgLength: 1.6},
+	}
+	if !reflect.DeepEqual(appended.Stats, expected) {
+		t.Errorf("expecting appended stats %+v, got %+v", expected, appended.Stats)
+	}
+
+	// retyped columns get their stats collected again, other columns keep theirs
+	edited, err := db.EditSchema(appended, []SchemaEdit{{Column: "a", Dtype: column.DtypeString}, {Column: "b", Rename: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []column.ColumnStats{
+		{Distinct: 5, Min: strptr(""), Max: strptr("7.5"), AvgLength: 1.2}, // nulls become empty strings
+		expected[1],
+	}
+	if !reflect.DeepEqual(edited.Stats, expected) {
+		t.Errorf("expecting edited stats %+v, got %+v", expected, edited.Stats)
+	}
+
+	// stored results have stats as well
+	schema := column.TableSchema{{Name: "x", Dtype: column.DtypeInt}}
+	stored, err := db.StoreResult("bar", schema, []*column.Chunk{column.NewChunkLiteralInts(4, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []column.ColumnStats{{Distinct: 1, Min: strptr("4"), Max: strptr("4")}}
+	if !reflect.DeepEqual(stored.Stats, expected) {
+		t.Errorf("expecting stored stats %+v, got %+v", expected, stored.Stats)
+	}
+	stored, err = db.AppendResult(stored, []*column.Chunk{column.NewChunkIntsFromSlice([]int64{1, 9}, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []column.ColumnStats{{Distinct: 2, Min: strptr("1"), Max: strptr("9")}}
+	if !reflect.DeepEqual(stored.Stats, expected) {
+		t.Errorf("expecting stats of appended results %+v, got %+v", expected, stored.Stats)
+	}
+
+	// datasets without stats (e.g. loaded before we collected them) don't get partial stats
+	ds.Stats = nil
+	appended, err = db.AppendToDataset(ds, strings.NewReader("a,b\n1,a"), WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appended.Stats != nil {
+		t.Errorf("expecting appends to datasets without stats not to have stats, got %+v", appended.Stats)
+	}
+}
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidRange = errs.New(errs.ErrBadRequest, "invalid byte range requested")
+
+// storage abstracts away where stripe data physically live. Paths are always relative
+// to the storage's root and use forward slashes (`blobs/hash`, see stripeKey).
+// ARCH: manifests and the config still live in the working directory (or nowhere, for
+// in-memory databases), only stripes go through this interface (they are the bulk of our data)
+type storage interface {
+	// create returns a writer for a new object, the object is only guaranteed
+	// to be persisted once the writer gets closed
+	create(path string) (io.WriteCloser, error)
+	// open returns an object that can serve arbitrary byte ranges - we typically only
+	// need a few columns from a given stripe, so we don't want to read it all
+	open(path string) (storageObject, error)
+	remove(path string) error
+}
+
+type storageObject interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// localStorage is the default backend, it stores stripes in our working directory
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) *localStorage {
+	return &localStorage{root: root}
+}
+
+func (ls *localStorage) fullPath(p string) string {
+	return filepath.Join(ls.root, filepath.FromSlash(p))
+}
+
+func (ls *localStorage) create(p string) (io.WriteCloser, error) {
+	fn := ls.fullPath(p)
+	if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.Create(fn)
+}
+
+func (ls *localStorage) open(p string) (storageObject, error) {
+	return os.Open(ls.fullPath(p))
+}
+
+// removing the last object in a directory removes the directory as well, this is
+// to mimic object storage, where "directories" don't exist on their own
+func (ls *localStorage) remove(p string) error {
+	fn := ls.fullPath(p)
+	if err := os.Remove(fn); err != nil {
+		return err
+	}
+	dir := filepath.Dir(fn)
+	if dir == filepath.Clean(ls.root) {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return os.Remove(dir)
+	}
+	return nil
+}
+
+// memoryStorage keeps stripes in memory, it's used by in-memory databases (see InMemory)
+type memoryStorage struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string][]byte)}
+}
+
+type memoryWriter struct {
+	buf  *bytes.Buffer
+	ms   *memoryStorage
+	path string
+}
+
+func (mw *memoryWriter) Write(p []byte) (int, error) {
+	return mw.buf.Write(p)
+}
+
+func (mw *memoryWriter) Close() error {
+	mw.ms.Lock()
+	defer mw.ms.Unlock()
+	mw.ms.objects[mw.path] = mw.buf.Bytes()
+	return nil
+}
+
+func (ms *memoryStorage) create(p string) (io.WriteCloser, error) {
+	return &memoryWriter{buf: new(bytes.Buffer), ms: ms, path: p}, nil
+}
+
+type memoryObject struct {
+	*bytes.Reader
+}
+
+func (mo memoryObject) Close() error {
+	return nil
+}
+
+// objects are never modified once written, so readers can share their underlying data
+func (ms *memoryStorage) open(p string) (storageObject, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	data, ok := ms.objects[p]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", os.ErrNotExist, p)
+	}
+	return memoryObject{bytes.NewReader(data)}, nil
+}
+
+func (ms *memoryStorage) remove(p string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.objects[p]; !ok {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, p)
+	}
+	delete(ms.objects, p)
+	return nil
+}
+
+func (ms *memoryStorage) clear() {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.objects = make(map[string][]byte)
+}
+
+// s3API is the subset of the S3 client we use, it's here mostly to make testing easier
+type s3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// s3Lister is what we need to read external datasets stored in S3 (see RegisterExternal)
+type s3Lister interface {
+	s3API
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// s3Storage stores stripes in an S3 bucket (under an optional prefix). Writes are buffered
+// in memory, because a stripe is bounded in size (see MaxBytesPerStripe), and reads
+// are served via range requests, so that we only fetch columns we actually need
+// TODO: multipart uploads for larger stripes?
+// OPTIM: we issue one GET per column - we could merge adjacent ranges into a single request
+type s3Storage struct {
+	client s3API
+	bucket string
+	prefix string
+}
+
+func newS3Storage(client s3API, bucket, prefix string) *s3Storage {
+	return &s3Storage{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (ss *s3Storage) key(p string) string {
+	return path.Join(ss.prefix, p)
+}
+
+type s3Writer struct {
+	buf  *bytes.Buffer
+	ss   *s3Storage
+	path string
+}
+
+func (sw *s3Writer) Write(p []byte) (int, error) {
+	return sw.buf.Write(p)
+}
+
+func (sw *s3Writer) Close() error {
+	_, err := sw.ss.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:        aws.String(sw.ss.bucket),
+		Key:           aws.String(sw.ss.key(sw.path)),
+		Body:          bytes.NewReader(sw.buf.Bytes()),
+		ContentLength: int64(sw.buf.Len()),
+	})
+	return err
+}
+
+func (ss *s3Storage) create(p string) (io.WriteCloser, error) {
+	return &s3Writer{buf: new(bytes.Buffer), ss: ss, path: p}, nil
+}
+
+type s3Object struct {
+	ss   *s3Storage
+	path string
+}
+
+// ReadAt issues a range GET for each call
+func (so *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errInvalidRange
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	resp, err := so.ss.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(so.ss.bucket),
+		Key:    aws.String(so.ss.key(so.path)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (so *s3Object) Close() error {
+	return nil
+}
+
+// ARCH: we don't check if the object exists, we'll only find out upon the first read
+func (ss *s3Storage) open(p string) (storageObject, error) {
+	return &s3Object{ss: ss, path: p}, nil
+}
+
+func (ss *s3Storage) remove(p string) error {
+	_, err := ss.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(ss.key(p)),
+	})
+	return err
+}
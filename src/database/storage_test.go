@@ -0,0 +1,208 @@
+package database
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/kokes/smda/src/column"
+)
+
+// fakeS3 implements just enough of the S3 API to store, range-read, list and delete objects
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.Lock()
+	defer fs.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fs.objects[r.URL.Path] = body
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") == "2" {
+			fs.list(w, r)
+			return
+		}
+		fs.gets++
+		data, ok := fs.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		// plain GETs get the whole object
+		if r.Header.Get("Range") == "" {
+			w.Write(data)
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+	case http.MethodDelete:
+		delete(fs.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list returns all the matching objects in a single page
+func (fs *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Path + "/" + r.URL.Query().Get("prefix")
+	keys := make([]string, 0, len(fs.objects))
+	for key := range fs.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	type object struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		IsTruncated bool
+		Contents    []object
+	}{}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{Key: strings.TrimPrefix(key, r.URL.Path+"/"), Size: len(fs.objects[key])})
+	}
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func newFakeS3Client(t *testing.T) (*s3.Client, *fakeS3) {
+	fs := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fs)
+	t.Cleanup(srv.Close)
+
+	client := s3.New(s3.Options{
+		Region:           "eu-central-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: s3.EndpointResolverFromURL(srv.URL),
+		UsePathStyle:     true,
+	})
+	return client, fs
+}
+
+func newFakeS3Storage(t *testing.T, prefix string) (*s3Storage, *fakeS3) {
+	client, fs := newFakeS3Client(t)
+	return newS3Storage(client, "smda-bucket", prefix), fs
+}
+
+func TestStorageRoundtrip(t *testing.T) {
+	ss, _ := newFakeS3Storage(t, "some/prefix")
+	backends := []storage{newLocalStorage(t.TempDir()), ss, newMemoryStorage()}
+
+	for _, backend := range backends {
+		w, err := backend.create("foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("hello world")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := backend.open("foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := f.ReadAt(buf, 6); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if string(buf) != "world" {
+			t.Errorf("expecting a range read to return %v, got %v", "world", string(buf))
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := backend.remove("foo/bar"); err != nil {
+			t.Fatal(err)
+		}
+		f, err = backend.open("foo/bar")
+		if err == nil {
+			_, err = f.ReadAt(buf, 0)
+		}
+		if err == nil {
+			t.Errorf("expecting a removed object not to be readable")
+		}
+	}
+}
+
+func TestS3StripeStorage(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ss, fs := newFakeS3Storage(t, "data")
+	db.storage = ss
+
+	data := strings.NewReader("foo,bar,baz\n1,2,3\n4,5,6")
+	ds, err := db.LoadDatasetFromReaderAuto("foobar", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.objects) != len(ds.Stripes) {
+		t.Fatalf("expecting %v objects in S3, got %v", len(ds.Stripes), len(fs.objects))
+	}
+	key := fmt.Sprintf("/smda-bucket/data/blobs/%v", ds.Stripes[0].Hash)
+	if _, ok := fs.objects[key]; !ok {
+		t.Errorf("expecting stripe to be stored under %v", key)
+	}
+
+	// adding a dataset reads it back to create its preview
+	fs.gets = 0
+	cols, _, err := db.ReadColumnsFromStripeByNames(ds, ds.Stripes[0], []string{"baz", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.gets != 2 {
+		t.Errorf("expecting one range request per column, got %v requests", fs.gets)
+	}
+	expected := column.NewChunkIntsFromSlice([]int64{3, 6}, nil)
+	if !column.ChunksEqual(cols["baz"], expected) {
+		t.Errorf("expecting column baz to be %v, got %v", expected, cols["baz"])
+	}
+
+	if err := db.removeDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.objects) != 0 {
+		t.Errorf("expecting stripes to be deleted along with a dataset, %v remain", len(fs.objects))
+	}
+}
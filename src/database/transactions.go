@@ -0,0 +1,322 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errTransactionNotFound = errs.New(errs.ErrNotFound, "transaction not found")
+var errTransactionClosed = errs.New(errs.ErrBadRequest, "transaction already committed or rolled back")
+var errAlreadyAdded = errs.New(errs.ErrBadRequest, "dataset already added")
+
+// Transaction stages new datasets (or new versions of existing ones), so that they all become
+// visible at once, when the transaction gets committed - readers either see all of them or none.
+// Data of staged datasets get written as they are loaded, only their manifests get written upon
+// commit. Commits are all-or-nothing on disk as well, we first write a record of all the datasets
+// committed and should we crash before writing all their manifests, the record gets replayed
+// when the database starts up again.
+// ARCH: open transactions only live in memory, data staged in transactions not committed before
+// a restart are left behind as stray stripe files (see Fsck)
+type Transaction struct {
+	sync.Mutex
+	ID       UID
+	db       *Database
+	datasets []*Dataset
+	done     bool
+}
+
+type transactions struct {
+	sync.Mutex
+	open map[UID]*Transaction
+}
+
+func newTransactions() *transactions {
+	return &transactions{open: make(map[UID]*Transaction)}
+}
+
+// Begin opens a new transaction, it needs to be committed or rolled back (see GetTransaction)
+func (db *Database) Begin() *Transaction {
+	tx := &Transaction{ID: newUID(OtypeTransaction), db: db}
+	db.transactions.Lock()
+	db.transactions.open[tx.ID] = tx
+	db.transactions.Unlock()
+	return tx
+}
+
+// GetTransaction retrieves a transaction that is still open
+func (db *Database) GetTransaction(id UID) (*Transaction, error) {
+	db.transactions.Lock()
+	defer db.transactions.Unlock()
+	tx, ok := db.transactions.open[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", errTransactionNotFound, id)
+	}
+	return tx, nil
+}
+
+// Add stages a dataset to be added to our database upon commit, it's the transactional
+// equivalent of AddDataset
+func (tx *Transaction) Add(ds *Dataset) error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.done {
+		return errTransactionClosed
+	}
+	for _, staged := range tx.datasets {
+		if staged.ID == ds.ID {
+			return fmt.Errorf("%w: %v@v%v", errAlreadyAdded, ds.QualifiedName(), ds.ID)
+		}
+	}
+	if _, err := tx.db.GetDatasetByVersion(ds.QualifiedName(), ds.ID.String()); err == nil {
+		return fmt.Errorf("%w: %v@v%v", errAlreadyAdded, ds.QualifiedName(), ds.ID)
+	}
+	tx.datasets = append(tx.datasets, ds)
+	return nil
+}
+
+// Datasets lists datasets staged so far
+func (tx *Transaction) Datasets() []*Dataset {
+	tx.Lock()
+	defer tx.Unlock()
+	return append([]*Dataset(nil), tx.datasets...)
+}
+
+// MarshalJSON lists the transaction's ID along with all the staged datasets
+func (tx *Transaction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID       UID        `json:"id"`
+		Datasets []*Dataset `json:"datasets"`
+	}{tx.ID, tx.Datasets()})
+}
+
+func (tx *Transaction) close() {
+	tx.done = true
+	tx.db.transactions.Lock()
+	delete(tx.db.transactions.open, tx.ID)
+	tx.db.transactions.Unlock()
+}
+
+// Commit makes all the staged datasets visible at once. Retention (see Config.RetainVersions)
+// applies once they are all visible. If the commit fails before anything becomes visible, the
+// transaction stays open, so that it can be rolled back.
+func (tx *Transaction) Commit() error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.done {
+		return errTransactionClosed
+	}
+	db := tx.db
+	if !db.inMemory && len(tx.datasets) > 0 {
+		if err := db.writeCommitRecord(tx); err != nil {
+			return err
+		}
+	}
+	tx.close()
+	if len(tx.datasets) == 0 {
+		return nil
+	}
+	db.Lock()
+	db.Datasets = append(db.Datasets, tx.datasets...)
+	orphaned := db.blobs.reference(tx.datasets...)
+	db.Unlock()
+	// best effort, see AddDataset
+	db.removeBlobs(orphaned)
+
+	if !db.inMemory {
+		for _, ds := range tx.datasets {
+			if err := db.writeManifest(ds); err != nil {
+				return err
+			}
+		}
+		// all the manifests are in place, there's nothing to replay
+		if err := os.Remove(db.commitRecordPath(tx.ID)); err != nil {
+			return err
+		}
+		for _, ds := range tx.datasets {
+			if _, err := db.writePreview(ds); err != nil {
+				return err
+			}
+		}
+	}
+	applied := make(map[string]bool)
+	for _, ds := range tx.datasets {
+		name := ds.QualifiedName()
+		if applied[name] {
+			continue
+		}
+		applied[name] = true
+		if err := db.applyRetention(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback discards all the staged datasets along with their data
+func (tx *Transaction) Rollback() error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.done {
+		return errTransactionClosed
+	}
+	tx.close()
+	for _, ds := range tx.datasets {
+		// staged datasets may share stripes with existing versions (and external data are not ours)
+		var owned []Stripe
+		for _, stripe := range ds.Stripes {
+			if stripe.Owner == nil && stripe.Source == nil {
+				owned = append(owned, stripe)
+			}
+		}
+		tx.db.removeStripes(ds, owned)
+	}
+	return nil
+}
+
+func (db *Database) commitRecordPath(id UID) string {
+	return filepath.Join(db.Config.WorkingDirectory, "transactions", id.String()+".json")
+}
+
+// writeCommitRecord writes all the datasets of a transaction into a single file, which only
+// appears once it's complete (we write it elsewhere first and then move it in place)
+func (db *Database) writeCommitRecord(tx *Transaction) error {
+	fn := db.commitRecordPath(tx.ID)
+	if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(tx.datasets); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// recoverCommits replays commit records of transactions that didn't get to write all their
+// manifests, incomplete records (of commits that never happened) get removed
+func (db *Database) recoverCommits() error {
+	dir := filepath.Join(db.Config.WorkingDirectory, "transactions")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fn := filepath.Join(dir, entry.Name())
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			if err := os.Remove(fn); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		var datasets []*Dataset
+		err = json.NewDecoder(f).Decode(&datasets)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read commit record %v: %w", fn, err)
+		}
+		for _, ds := range datasets {
+			if _, err := os.Stat(db.manifestPath(ds)); err == nil {
+				continue
+			}
+			if err := db.writeManifest(ds); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot is a consistent view of our datasets as they were when it was taken, datasets added
+// (or committed) later are not part of it, and data of datasets removed later stay readable
+// until the snapshot gets released (see Release). This lets readers use multiple datasets (or
+// look up the same one repeatedly) without seeing any commits half way through.
+// ARCH: removed data only get cleaned up once there are no open snapshots at all, so a steady
+// stream of overlapping snapshots would defer cleanups indefinitely
+type Snapshot struct {
+	db       *Database
+	datasets []*Dataset
+	aliases  map[string]Alias
+	once     sync.Once
+}
+
+// Snapshot takes a snapshot of our datasets, it needs to be released once no longer needed
+func (db *Database) Snapshot() *Snapshot {
+	db.Lock()
+	defer db.Unlock()
+	db.snapshots++
+	aliases := make(map[string]Alias, len(db.aliases))
+	for name, alias := range db.aliases {
+		aliases[name] = alias
+	}
+	return &Snapshot{db: db, datasets: append([]*Dataset(nil), db.Datasets...), aliases: aliases}
+}
+
+// Release lets us clean up data removed while this snapshot was open, it's safe to call it
+// multiple times
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		db := s.db
+		db.Lock()
+		db.snapshots--
+		var removed []*Dataset
+		if db.snapshots == 0 {
+			removed, db.removed = db.removed, nil
+		}
+		db.Unlock()
+		// errors would only leave stray stripes behind, there's no one to report them to
+		if len(removed) > 0 {
+			_ = db.removeDatasetData(removed...)
+		}
+	})
+}
+
+// Datasets lists all the datasets in this snapshot
+func (s *Snapshot) Datasets() ([]*Dataset, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	for _, ds := range s.datasets {
+		if err := s.db.hydrate(ds); err != nil {
+			return nil, err
+		}
+	}
+	return append([]*Dataset(nil), s.datasets...), nil
+}
+
+// GetDataset works like Database.ResolveDataset, but only within this snapshot
+func (s *Snapshot) GetDataset(name, version string, latest bool) (*Dataset, error) {
+	// datasets not read yet get read upon lookup (see Lazy), which needs the database locked
+	s.db.Lock()
+	defer s.db.Unlock()
+	ds, err := lookupDataset(s.datasets, s.aliases, name, version, latest)
+	if err != nil {
+		return nil, err
+	}
+	return ds, s.db.hydrate(ds)
+}
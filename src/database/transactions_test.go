@@ -0,0 +1,205 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommittingTransactions(t *testing.T) {
+	wdir := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	tx := db.Begin()
+	for _, name := range []string{"foo", "bar"} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader("a,b\n1,2\n3,4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Add(ds); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Add(ds); !errors.Is(err, errAlreadyAdded) {
+			t.Errorf("expecting adding a dataset twice to fail with %v, got %v", errAlreadyAdded, err)
+		}
+	}
+	if len(db.Datasets) != 0 {
+		t.Errorf("not expecting staged datasets to be visible, got %v", len(db.Datasets))
+	}
+	if found, err := db.GetTransaction(tx.ID); err != nil || found != tx {
+		t.Errorf("expecting an open transaction to be found, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Datasets) != 2 {
+		t.Errorf("expecting committed datasets to be visible, got %v", len(db.Datasets))
+	}
+	for _, ds := range db.Datasets {
+		if _, _, err := db.ReadColumnsFromStripeByNames(ds, ds.Stripes[0], []string{"a", "b"}); err != nil {
+			t.Errorf("expecting committed data to be readable, got %v", err)
+		}
+	}
+	if _, err := db.GetTransaction(tx.ID); !errors.Is(err, errTransactionNotFound) {
+		t.Errorf("expecting committed transactions to be closed, got %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, errTransactionClosed) {
+		t.Errorf("expecting repeated commits to fail with %v, got %v", errTransactionClosed, err)
+	}
+	if err := tx.Rollback(); !errors.Is(err, errTransactionClosed) {
+		t.Errorf("expecting rollbacks of committed transactions to fail with %v, got %v", errTransactionClosed, err)
+	}
+	if _, err := os.Stat(db.commitRecordPath(tx.ID)); !os.IsNotExist(err) {
+		t.Errorf("expecting commit records to be removed after commits, got %v", err)
+	}
+
+	db2, err := NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db2.Datasets) != 2 {
+		t.Errorf("expecting committed datasets to be persisted, got %v", len(db2.Datasets))
+	}
+}
+
+func TestRollingBackTransactions(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := db.Begin()
+	if err := tx.Add(ds); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Datasets) != 0 {
+		t.Errorf("not expecting rolled back datasets to be visible, got %v", len(db.Datasets))
+	}
+	if _, _, err := db.ReadColumnsFromStripeByNames(ds, ds.Stripes[0], []string{"a"}); err == nil {
+		t.Error("expecting data of rolled back datasets to be removed")
+	}
+	if err := tx.Add(ds); !errors.Is(err, errTransactionClosed) {
+		t.Errorf("expecting additions to closed transactions to fail with %v, got %v", errTransactionClosed, err)
+	}
+}
+
+func TestRecoveringCommits(t *testing.T) {
+	wdir := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := db.Begin()
+	if err := tx.Add(ds); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash after writing a commit record, but before writing any manifests
+	if err := db.writeCommitRecord(tx); err != nil {
+		t.Fatal(err)
+	}
+	// and an incomplete record of another commit
+	incomplete := db.commitRecordPath(newUID(OtypeTransaction)) + ".tmp"
+	if err := os.WriteFile(incomplete, []byte("[{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := NewDatabase(wdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db2.Datasets) != 1 || db2.Datasets[0].ID != ds.ID {
+		t.Fatalf("expecting a commit to be replayed upon startup, got %v datasets", len(db2.Datasets))
+	}
+	if _, _, err := db2.ReadColumnsFromStripeByNames(db2.Datasets[0], db2.Datasets[0].Stripes[0], []string{"a"}); err != nil {
+		t.Errorf("expecting recovered data to be readable, got %v", err)
+	}
+	for _, fn := range []string{db.commitRecordPath(tx.ID), incomplete} {
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("expecting %v to be removed upon recovery, got %v", fn, err)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	tx := db.Begin()
+	bar, err := db.LoadDatasetFromReaderAuto("bar", strings.NewReader("a\n1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Add(bar); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.GetDataset("bar", "", true); !errors.Is(err, errDatasetNotFound) {
+		t.Errorf("not expecting datasets committed later to be in a snapshot, got %v", err)
+	}
+	if err := db.DropDataset("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	found, err := snap.GetDataset("foo", "", true)
+	if err != nil || found != ds {
+		t.Fatalf("expecting dropped datasets to remain in a snapshot, got %v", err)
+	}
+	if _, _, err := db.ReadColumnsFromStripeByNames(found, found.Stripes[0], []string{"a"}); err != nil {
+		t.Errorf("expecting data of dropped datasets to remain readable while snapshots are open, got %v", err)
+	}
+
+	snap.Release()
+	snap.Release() // releasing twice is a no-op
+	if _, _, err := db.ReadColumnsFromStripeByNames(found, found.Stripes[0], []string{"a"}); err == nil {
+		t.Error("expecting data of dropped datasets to be removed once snapshots are released")
+	}
+	if db.snapshots != 0 {
+		t.Errorf("expecting no open snapshots, got %v", db.snapshots)
+	}
+}
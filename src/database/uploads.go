@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errUploadsNotConfigured = errs.New(errs.ErrBadRequest, "pre-signed uploads need an upload bucket configured")
+var errInvalidUploadID = errs.New(errs.ErrBadRequest, "invalid upload ID")
+
+// pre-signed URLs are only valid for a limited amount of time
+const presignExpiry = 15 * time.Minute
+
+// s3Presigner is the subset of the S3 presigning client we use
+type s3Presigner interface {
+	PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// s3Uploads lets clients upload data directly into S3, bypassing our server (this is useful
+// in environments with payload limits, e.g. in AWS Lambda), we ingest these objects once
+// the upload completes (see LoadDatasetFromUpload)
+type s3Uploads struct {
+	client    s3API
+	presigner s3Presigner
+	bucket    string
+	prefix    string
+}
+
+func newS3Uploads(client *s3.Client, bucket, prefix string) *s3Uploads {
+	return &s3Uploads{
+		client:    client,
+		presigner: s3.NewPresignClient(client),
+		bucket:    bucket,
+		prefix:    prefix,
+	}
+}
+
+// each upload gets its own random key, so that concurrent uploads don't clash
+func (su *s3Uploads) key(id UID) string {
+	return path.Join(su.prefix, id.String())
+}
+
+// PresignedUpload describes where and how a client should upload its data
+type PresignedUpload struct {
+	ID      UID         `json:"id"`
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+	Headers http.Header `json:"headers"`
+	Expires time.Time   `json:"expires"`
+}
+
+// PresignUpload generates a URL the client can upload data to, the upload then needs to be
+// ingested using its ID
+func (db *Database) PresignUpload(ctx context.Context) (*PresignedUpload, error) {
+	if db.uploads == nil {
+		return nil, errUploadsNotConfigured
+	}
+	id := newUID(OtypeUpload)
+	signed, err := db.uploads.presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(db.uploads.bucket),
+		Key:    aws.String(db.uploads.key(id)),
+	}, s3.WithPresignExpires(presignExpiry))
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedUpload{
+		ID:      id,
+		URL:     signed.URL,
+		Method:  signed.Method,
+		Headers: signed.SignedHeader,
+		Expires: time.Now().Add(presignExpiry),
+	}, nil
+}
+
+// LoadDatasetFromUpload loads a dataset from a previously uploaded object (see PresignUpload),
+// the object gets deleted once it's loaded
+// ARCH: like LoadDatasetFromReaderAuto, this doesn't add the dataset to the database
+func (db *Database) LoadDatasetFromUpload(ctx context.Context, name string, id UID) (*Dataset, error) {
+	if db.uploads == nil {
+		return nil, errUploadsNotConfigured
+	}
+	if id.Otype != OtypeUpload {
+		return nil, fmt.Errorf("%w: %v", errInvalidUploadID, id)
+	}
+	key := db.uploads.key(id)
+	obj, err := db.uploads.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(db.uploads.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	ds, err := db.LoadDatasetFromReaderAuto(name, obj.Body)
+	if err != nil {
+		return nil, err
+	}
+	ds.SizeRaw = obj.ContentLength
+
+	if _, err := db.uploads.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(db.uploads.bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
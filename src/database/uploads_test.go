@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPresignedUploads(t *testing.T) {
+	db, err := NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ctx := context.Background()
+	if _, err := db.PresignUpload(ctx); !errors.Is(err, errUploadsNotConfigured) {
+		t.Errorf("expecting uploads to fail without a bucket, got %v", err)
+	}
+
+	client, fs := newFakeS3Client(t)
+	db.uploads = newS3Uploads(client, "smda-bucket", "ingest")
+
+	upload, err := db.PresignUpload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	another, err := db.PresignUpload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.ID == another.ID || upload.URL == another.URL {
+		t.Errorf("expecting each upload to get its own key, got %v twice", upload.URL)
+	}
+	if upload.Method != http.MethodPut || !strings.Contains(upload.URL, "/smda-bucket/ingest/"+upload.ID.String()) {
+		t.Errorf("unexpected pre-signed request: %v %v", upload.Method, upload.URL)
+	}
+
+	req, err := http.NewRequest(upload.Method, upload.URL, strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ds, err := db.LoadDatasetFromUpload(ctx, "foobar", upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Name != "foobar" || ds.NRows != 2 || ds.SizeRaw != 15 {
+		t.Errorf("unexpected dataset loaded from an upload: %+v", ds)
+	}
+	if len(fs.objects) != 0 {
+		t.Errorf("expecting uploads to be deleted once ingested, got %v objects", len(fs.objects))
+	}
+	if _, err := db.LoadDatasetFromUpload(ctx, "foobar", upload.ID); err == nil {
+		t.Errorf("expecting an already ingested upload to fail")
+	}
+	if _, err := db.LoadDatasetFromUpload(ctx, "foobar", ds.ID); !errors.Is(err, errInvalidUploadID) {
+		t.Errorf("expecting non-upload IDs to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"os"
+)
+
+// ColumnUsage is the storage taken up by a single column across all the stripes of a dataset version
+type ColumnUsage struct {
+	Name       string `json:"name"`
+	Bytes      int64  `json:"bytes"`
+	BloomBytes int64  `json:"bloom_bytes,omitempty"`
+}
+
+// DatasetUsage describes the storage taken up by a dataset version. Versions created by appends
+// share stripes with their predecessors (see AppendToDataset), these count towards the size of each
+// version referencing them, but only towards the owned size of the version they were written for.
+// Identical stripes of unrelated datasets in a namespace are shared as well (see blobKey), these are owned by
+// whichever dataset comes first.
+type DatasetUsage struct {
+	ID            UID    `json:"id"`
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace,omitempty"`
+	Stripes       int    `json:"stripes"`
+	SharedStripes int    `json:"shared_stripes"` // stripes owned by other datasets
+	// sizes of all the stripes this version references and of those it owns, as per its manifest
+	Bytes      int64 `json:"bytes"`
+	BytesOwned int64 `json:"bytes_owned"`
+	// sizes of the files of owned stripes as reported by our storage (only local and in-memory
+	// storage report these), missing files are counted separately
+	BytesOnDisk    int64 `json:"bytes_on_disk,omitempty"`
+	MissingStripes int   `json:"missing_stripes,omitempty"`
+	SizeRaw        int64 `json:"size_raw"`
+	// how much smaller the stored data are compared to the data loaded (which may have been
+	// compressed themselves), this is only known for datasets loaded from raw data
+	CompressionRatio float64       `json:"compression_ratio,omitempty"`
+	Columns          []ColumnUsage `json:"columns"`
+}
+
+// DiskUsage is a breakdown of storage taken up by all the datasets in a database, the total
+// counts each stripe once, regardless of how many versions share it
+type DiskUsage struct {
+	Bytes       int64          `json:"bytes"`
+	BytesOnDisk int64          `json:"bytes_on_disk,omitempty"`
+	Datasets    []DatasetUsage `json:"datasets"`
+}
+
+// objectSizer is implemented by storage backends that can cheaply report sizes of their objects
+// ARCH: S3 would need a HEAD request per stripe, so we only rely on manifests there
+type objectSizer interface {
+	size(path string) (int64, error)
+}
+
+func (ls *localStorage) size(p string) (int64, error) {
+	fi, err := os.Stat(ls.fullPath(p))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (ms *memoryStorage) size(p string) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	data, ok := ms.objects[p]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+// stripeSize is the size of a stripe as recorded in its manifest - columns are followed by
+// bloom filters (if there are any)
+func stripeSize(stripe Stripe) int64 {
+	size := int64(stripe.Offsets[len(stripe.Offsets)-1])
+	if len(stripe.Blooms) > 0 {
+		size = int64(stripe.Blooms[len(stripe.Blooms)-1])
+	}
+	return size
+}
+
+// DiskUsage reports storage taken up by each dataset version (and each of its columns), it's
+// computed from our manifests, file sizes are only checked to report actual usage and missing data
+func (db *Database) DiskUsage() (DiskUsage, error) {
+	db.Lock()
+	if err := db.hydrateAll(); err != nil {
+		db.Unlock()
+		return DiskUsage{}, err
+	}
+	datasets := append([]*Dataset(nil), db.Datasets...)
+	db.Unlock()
+
+	sizer, hasSizes := db.storage.(objectSizer)
+	ret := DiskUsage{Datasets: make([]DatasetUsage, 0, len(datasets))}
+	// identical stripes are stored once (see blobKey), they are owned by the first dataset we come across
+	counted := make(map[string]bool)
+	for _, ds := range datasets {
+		usage := DatasetUsage{
+			ID:        ds.ID,
+			Name:      ds.Name,
+			Namespace: ds.Namespace,
+			Stripes:   len(ds.Stripes),
+			SizeRaw:   ds.SizeRaw,
+			Columns:   make([]ColumnUsage, len(ds.Schema)),
+		}
+		for j, col := range ds.Schema {
+			usage.Columns[j].Name = col.Name
+		}
+		// external data are not ours, they take up no storage
+		if ds.External != nil {
+			ret.Datasets = append(ret.Datasets, usage)
+			continue
+		}
+		for _, stripe := range ds.Stripes {
+			for j := range ds.Schema {
+				usage.Columns[j].Bytes += int64(stripe.Offsets[j+1] - stripe.Offsets[j])
+				if len(stripe.Blooms) > 0 {
+					usage.Columns[j].BloomBytes += int64(stripe.Blooms[j+1] - stripe.Blooms[j])
+				}
+			}
+			size := stripeSize(stripe)
+			usage.Bytes += size
+			key := stripeKey(ds, stripe)
+			if stripe.Owner != nil || counted[key] {
+				usage.SharedStripes++
+				continue
+			}
+			counted[key] = true
+			usage.BytesOwned += size
+			if !hasSizes {
+				continue
+			}
+			onDisk, err := sizer.size(key)
+			if errors.Is(err, os.ErrNotExist) {
+				usage.MissingStripes++
+				continue
+			}
+			if err != nil {
+				return DiskUsage{}, err
+			}
+			usage.BytesOnDisk += onDisk
+		}
+		if usage.SizeRaw > 0 && usage.Bytes > 0 {
+			usage.CompressionRatio = float64(usage.SizeRaw) / float64(usage.Bytes)
+		}
+		ret.Bytes += usage.BytesOwned
+		ret.BytesOnDisk += usage.BytesOnDisk
+		ret.Datasets = append(ret.Datasets, usage)
+	}
+	return ret, nil
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	for _, opts := range [][]Option{nil, {InMemory()}} {
+		db, err := NewDatabase("", &Config{MaxRowsPerStripe: 2}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y\n3,z"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.SizeRaw = 20
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		appended, err := db.AppendToDataset(ds, strings.NewReader("a,b\n4,w"), WideningNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		usage, err := db.DiskUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(usage.Datasets) != 2 {
+			t.Fatalf("expecting usage of two dataset versions, got %+v", usage.Datasets)
+		}
+		first, second := usage.Datasets[0], usage.Datasets[1]
+		if first.ID != ds.ID || second.ID != appended.ID {
+			t.Fatalf("expecting usage to be reported for %v and %v, got %v and %v", ds.ID, appended.ID, first.ID, second.ID)
+		}
+		if !(first.Stripes == 2 && first.SharedStripes == 0 && second.Stripes == 3 && second.SharedStripes == 2) {
+			t.Errorf("unexpected stripe counts: %+v, %+v", first, second)
+		}
+		if first.Bytes != ds.SizeOnDisk || first.BytesOwned != ds.SizeOnDisk || second.Bytes != appended.SizeOnDisk {
+			t.Errorf("expecting sizes to match those recorded when writing data, got %+v, %+v", first, second)
+		}
+		if second.BytesOwned >= second.Bytes || usage.Bytes != first.BytesOwned+second.BytesOwned {
+			t.Errorf("expecting shared stripes to only count towards their owners, got %+v", usage)
+		}
+		if usage.BytesOnDisk != usage.Bytes {
+			t.Errorf("expecting files to be as large as manifests say, got %v and %v", usage.BytesOnDisk, usage.Bytes)
+		}
+		var columnBytes int64
+		for _, col := range first.Columns {
+			columnBytes += col.Bytes + col.BloomBytes
+		}
+		if columnBytes != first.Bytes {
+			t.Errorf("expecting column sizes to add up to %v, got %v", first.Bytes, columnBytes)
+		}
+		if first.CompressionRatio != float64(20)/float64(first.Bytes) {
+			t.Errorf("expecting a compression ratio of %v, got %v", float64(20)/float64(first.Bytes), first.CompressionRatio)
+		}
+
+		// missing data get reported, not summed up
+		if err := db.storage.remove(stripeKey(ds, ds.Stripes[0])); err != nil {
+			t.Fatal(err)
+		}
+		usage, err = db.DiskUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Datasets[0].MissingStripes != 1 || usage.BytesOnDisk >= usage.Bytes {
+			t.Errorf("expecting a missing stripe to be reported, got %+v", usage.Datasets[0])
+		}
+	}
+}
+
+func TestDiskUsageWithoutSizes(t *testing.T) {
+	db, err := NewDatabase("", nil, InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// storage backends that cannot report object sizes only have manifests to go by
+	db.storage = storageWithoutSizes{db.storage}
+	usage, err := db.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != ds.SizeOnDisk || usage.BytesOnDisk != 0 {
+		t.Errorf("expecting %v bytes as per the manifest, got %+v", ds.SizeOnDisk, usage)
+	}
+}
+
+type storageWithoutSizes struct {
+	storage
+}
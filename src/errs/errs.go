@@ -0,0 +1,89 @@
+// Package errs categorises errors, so that callers can tell failures caused by their input (e.g.
+// invalid queries or missing datasets) from those on our end (e.g. corrupt data on disk). Our
+// packages define their errors using New, these can still be matched by errors.Is, but they can
+// be matched against their categories as well.
+package errs
+
+import "errors"
+
+// categories of errors, uncategorised errors are deemed internal
+var (
+	ErrBadRequest        = errors.New("bad request")
+	ErrNotFound          = errors.New("not found")
+	ErrResourceExhausted = errors.New("resource exhausted")
+	ErrTimeout           = errors.New("timeout")
+	ErrInternal          = errors.New("internal error")
+)
+
+// machine readable codes of our categories, these are stable, so that clients can rely on them
+var codes = map[error]string{
+	ErrBadRequest:        "bad_request",
+	ErrNotFound:          "not_found",
+	ErrResourceExhausted: "resource_exhausted",
+	ErrTimeout:           "timeout",
+	ErrInternal:          "internal",
+}
+
+type categorised struct {
+	category error
+	text     string
+}
+
+func (e *categorised) Error() string {
+	return e.text
+}
+
+func (e *categorised) Is(target error) bool {
+	return target == e.category
+}
+
+// New creates an error in a given category (one of the above)
+func New(category error, text string) error {
+	return &categorised{category: category, text: text}
+}
+
+type wrapped struct {
+	category error
+	err      error
+}
+
+func (e *wrapped) Error() string {
+	return e.err.Error()
+}
+
+func (e *wrapped) Unwrap() error {
+	return e.err
+}
+
+func (e *wrapped) Is(target error) bool {
+	return target == e.category
+}
+
+// Wrap puts an existing error in a given category, it can still be matched against the errors it
+// wraps (e.g. strconv.ErrSyntax if a value fails to parse)
+func Wrap(category error, err error) error {
+	return &wrapped{category: category, err: err}
+}
+
+// Category determines which category an error belongs to, if it wraps errors of several
+// categories, the outermost one wins
+func Category(err error) error {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch cerr := err.(type) {
+		case *categorised:
+			return cerr.category
+		case *wrapped:
+			return cerr.category
+		}
+		// errors can also wrap categories directly, e.g. fmt.Errorf("%w: ...", ErrNotFound)
+		if _, ok := codes[err]; ok {
+			return err
+		}
+	}
+	return ErrInternal
+}
+
+// Code returns a machine readable code of an error's category (e.g. `not_found`)
+func Code(err error) string {
+	return codes[Category(err)]
+}
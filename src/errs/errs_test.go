@@ -0,0 +1,54 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCategories(t *testing.T) {
+	errMissing := New(ErrNotFound, "thing not found")
+	errInvalid := New(ErrBadRequest, "invalid thing")
+	tests := []struct {
+		err      error
+		category error
+		code     string
+	}{
+		{errMissing, ErrNotFound, "not_found"},
+		{fmt.Errorf("%w: foo", errMissing), ErrNotFound, "not_found"},
+		{fmt.Errorf("%w: foo", errInvalid), ErrBadRequest, "bad_request"},
+		{fmt.Errorf("failed: %w", fmt.Errorf("%w: foo", errInvalid)), ErrBadRequest, "bad_request"},
+		{fmt.Errorf("%w: too much", ErrResourceExhausted), ErrResourceExhausted, "resource_exhausted"},
+		{fmt.Errorf("%w: too slow", ErrTimeout), ErrTimeout, "timeout"},
+		{Wrap(ErrBadRequest, io.ErrUnexpectedEOF), ErrBadRequest, "bad_request"},
+		{fmt.Errorf("failed: %w", Wrap(ErrNotFound, io.ErrUnexpectedEOF)), ErrNotFound, "not_found"},
+		// the outermost category wins
+		{Wrap(ErrBadRequest, fmt.Errorf("%w: foo", errMissing)), ErrBadRequest, "bad_request"},
+		{io.ErrUnexpectedEOF, ErrInternal, "internal"},
+		{fmt.Errorf("cannot read: %w", io.ErrUnexpectedEOF), ErrInternal, "internal"},
+	}
+	for _, test := range tests {
+		if cat := Category(test.err); cat != test.category {
+			t.Errorf("expecting %v to be categorised as %v, got %v", test.err, test.category, cat)
+		}
+		if code := Code(test.err); code != test.code {
+			t.Errorf("expecting %v to have a code %v, got %v", test.err, test.code, code)
+		}
+		if test.category != ErrInternal && !errors.Is(test.err, test.category) {
+			t.Errorf("expecting %v to match its category %v", test.err, test.category)
+		}
+	}
+	if !errors.Is(fmt.Errorf("%w: foo", errMissing), errMissing) {
+		t.Error("expecting categorised errors to match themselves")
+	}
+	if !errors.Is(Wrap(ErrBadRequest, io.ErrUnexpectedEOF), io.ErrUnexpectedEOF) {
+		t.Error("expecting wrapped errors to match the errors they wrap")
+	}
+	if errors.Is(errMissing, New(ErrNotFound, "thing not found")) {
+		t.Error("expecting distinct errors of the same category not to match each other")
+	}
+	if errors.Is(errMissing, ErrBadRequest) {
+		t.Error("expecting errors not to match other categories")
+	}
+}
@@ -0,0 +1,168 @@
+// Package lambdaadapter runs net/http handlers (e.g. web.SetupRoutes) behind AWS Lambda function
+// URLs - it converts Lambda's events into requests and records responses, so that they can be
+// converted back into events.
+package lambdaadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Handler wraps an http.Handler, so that it can be passed to lambda.Start
+func Handler(h http.Handler) func(context.Context, events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	return func(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+		httpReq, err := Request(ctx, req)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{}, err
+		}
+		rw := NewResponseWriter()
+		h.ServeHTTP(rw, httpReq)
+		return rw.Response(), nil
+	}
+}
+
+// Request converts a Lambda function URL request into a native one, bound to a given context.
+// Binary bodies arrive base64 encoded and cookies arrive separately from other headers, both get
+// reverted here.
+func Request(ctx context.Context, req events.LambdaFunctionURLRequest) (*http.Request, error) {
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode request body: %w", err)
+		}
+		body = decoded
+	}
+	header := make(http.Header, len(req.Headers))
+	for k, v := range req.Headers {
+		header.Set(k, v) // `Add` would've done the same
+	}
+	if len(req.Cookies) > 0 {
+		header.Set("Cookie", strings.Join(req.Cookies, "; "))
+	}
+	host := req.RequestContext.DomainName
+	if host == "" {
+		host = header.Get("Host")
+	}
+	ret := &http.Request{
+		Method:        req.RequestContext.HTTP.Method,
+		Proto:         req.RequestContext.HTTP.Protocol,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		RemoteAddr:    req.RequestContext.HTTP.SourceIP,
+		RequestURI:    req.RawPath,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Header:        header,
+		Host:          host,
+		URL: &url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     req.RequestContext.HTTP.Path,
+			RawPath:  req.RawPath,
+			RawQuery: req.RawQueryString,
+		},
+	}
+	if req.RawQueryString != "" {
+		ret.RequestURI += "?" + req.RawQueryString
+	}
+	return ret.WithContext(ctx), nil
+}
+
+// ResponseWriter records a response, so that it can be returned to Lambda in one go (see Response)
+type ResponseWriter struct {
+	headers http.Header
+	buffer  bytes.Buffer
+	status  int // zero until a header gets written
+}
+
+func NewResponseWriter() *ResponseWriter {
+	return &ResponseWriter{headers: make(http.Header)}
+}
+
+func (rw *ResponseWriter) Header() http.Header {
+	return rw.headers
+}
+
+// WriteHeader records a status, only the first one counts (as in net/http)
+func (rw *ResponseWriter) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+}
+
+func (rw *ResponseWriter) Write(s []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.buffer.Write(s)
+}
+
+// Flush is a no-op, responses can only be returned as a whole, so streamed responses (e.g. server
+// sent events) arrive all at once
+func (rw *ResponseWriter) Flush() {}
+
+// isText tells whether a response can be returned as is, other responses get base64 encoded
+func isText(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// Response converts a recorded response into a Lambda function URL response, responses without a
+// status (or a body) result in a 200 like they do in net/http. Cookies get returned separately, as
+// Lambda expects, other headers with multiple values get joined.
+func (rw *ResponseWriter) Response() events.LambdaFunctionURLResponse {
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	headers := make(map[string]string, len(rw.headers))
+	var cookies []string
+	for h, v := range rw.headers {
+		if h == "Set-Cookie" {
+			cookies = append(cookies, v...)
+			continue
+		}
+		headers[h] = strings.Join(v, ",")
+	}
+	ret := events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers:    headers,
+		Cookies:    cookies,
+	}
+	contentType := rw.headers.Get("Content-Type")
+	if contentType == "" && rw.buffer.Len() > 0 {
+		// net/http would sniff the type as well
+		contentType = http.DetectContentType(rw.buffer.Bytes())
+		headers["Content-Type"] = contentType
+	}
+	if isText(contentType) {
+		ret.Body = rw.buffer.String()
+	} else {
+		ret.Body = base64.StdEncoding.EncodeToString(rw.buffer.Bytes())
+		ret.IsBase64Encoded = true
+	}
+	return ret
+}
@@ -0,0 +1,147 @@
+package lambdaadapter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/web"
+)
+
+func newRequest(method, path, query, body string) events.LambdaFunctionURLRequest {
+	req := events.LambdaFunctionURLRequest{
+		RawPath:        path,
+		RawQueryString: query,
+		Body:           body,
+		Headers:        map[string]string{"content-type": "text/csv"},
+	}
+	req.RequestContext.DomainName = "abc.lambda-url.eu-central-1.on.aws"
+	req.RequestContext.HTTP.Method = method
+	req.RequestContext.HTTP.Path = path
+	return req
+}
+
+func TestConvertingRequests(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "foo")
+	req := newRequest(http.MethodPost, "/upload/auto", "name=foo&x=1", base64.StdEncoding.EncodeToString([]byte("a\n1\x00")))
+	req.IsBase64Encoded = true
+	req.Cookies = []string{"a=b", "c=d"}
+	httpReq, err := Request(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(httpReq.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "a\n1\x00" || httpReq.ContentLength != int64(len(body)) {
+		t.Errorf("expecting base64 encoded bodies to get decoded, got %q", body)
+	}
+	if cookies := httpReq.Cookies(); len(cookies) != 2 || cookies[1].Value != "d" {
+		t.Errorf("expecting cookies to be passed on, got %+v", cookies)
+	}
+	if httpReq.Header.Get("Content-Type") != "text/csv" || httpReq.URL.Query().Get("name") != "foo" || httpReq.Host != req.RequestContext.DomainName {
+		t.Errorf("unexpected conversion of %+v: %+v", req, httpReq)
+	}
+	if httpReq.RequestURI != "/upload/auto?name=foo&x=1" {
+		t.Errorf("unexpected request URI: %v", httpReq.RequestURI)
+	}
+	if httpReq.Context().Value(ctxKey{}) != "foo" {
+		t.Errorf("expecting requests to carry their contexts")
+	}
+
+	req.Body = "not base64"
+	if _, err := Request(ctx, req); err == nil {
+		t.Errorf("expecting invalid base64 bodies to fail")
+	}
+}
+
+func TestRecordingResponses(t *testing.T) {
+	tests := []struct {
+		handler  http.HandlerFunc
+		expected events.LambdaFunctionURLResponse
+	}{
+		{func(w http.ResponseWriter, r *http.Request) {}, events.LambdaFunctionURLResponse{StatusCode: http.StatusOK, Headers: map[string]string{}}},
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK)
+		}, events.LambdaFunctionURLResponse{StatusCode: http.StatusNotFound, Headers: map[string]string{}}},
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Add("Vary", "a")
+			w.Header().Add("Vary", "b")
+			http.SetCookie(w, &http.Cookie{Name: "foo", Value: "bar"})
+			http.SetCookie(w, &http.Cookie{Name: "baz", Value: "bak"})
+			w.Write([]byte(`{"foo": 1}`))
+		}, events.LambdaFunctionURLResponse{StatusCode: http.StatusOK, Body: `{"foo": 1}`, Cookies: []string{"foo=bar", "baz=bak"},
+			Headers: map[string]string{"Content-Type": "application/json", "Vary": "a,b"}}},
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte{0, 1, 2})
+		}, events.LambdaFunctionURLResponse{StatusCode: http.StatusCreated, Body: "AAEC", IsBase64Encoded: true,
+			Headers: map[string]string{"Content-Type": "application/octet-stream"}}},
+		// content types get sniffed
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("\x89PNG\x0D\x0A\x1A\x0A"))
+		}, events.LambdaFunctionURLResponse{StatusCode: http.StatusOK, Body: "iVBORw0KGgo=", IsBase64Encoded: true,
+			Headers: map[string]string{"Content-Type": "image/png"}}},
+	}
+	for _, test := range tests {
+		resp, err := Handler(test.handler)(context.Background(), newRequest(http.MethodGet, "/", "", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp, test.expected) {
+			t.Errorf("expecting %+v, got %+v", test.expected, resp)
+		}
+	}
+}
+
+// the adapter is meant for our router, so we go through an upload and a query
+func TestServingRoutes(t *testing.T) {
+	db, err := database.NewDatabase("", nil, database.InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	handle := Handler(web.SetupRoutes(db))
+
+	resp, err := handle(context.Background(), newRequest(http.MethodPost, "/upload/auto", "name=foo", "a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.IsBase64Encoded {
+		t.Fatalf("unexpected upload response: %+v", resp)
+	}
+	body, err := json.Marshal(map[string]string{"sql": "SELECT sum(a) FROM foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = handle(context.Background(), newRequest(http.MethodPost, "/api/query", "", string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, "4") {
+		t.Errorf("unexpected query response: %+v", resp)
+	}
+	resp, err = handle(context.Background(), newRequest(http.MethodGet, "/api/datasets/bar/preview", "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expecting previews of missing datasets to result in a 404, got %+v", resp)
+	}
+}
@@ -0,0 +1,138 @@
+package pgserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errMessageTooLarge = errors.New("message too large")
+var errInvalidMessage = errors.New("invalid message")
+
+// This implements (parts of) version 3.0 of the Postgres frontend/backend protocol, as described in
+// https://www.postgresql.org/docs/current/protocol.html
+// Apart from the startup message, each message consists of a type byte, a 32-bit length (which
+// includes itself, but not the type byte) and a body. All integers are big endian.
+
+const (
+	protocolVersion = 196608   // 3.0
+	sslRequest      = 80877103 // clients ask for TLS this way, before they send a startup message
+	gssRequest      = 80877104 // ditto for GSSAPI encryption
+	cancelRequest   = 80877102
+
+	maxMessageSize = 1 << 24
+)
+
+// frontend messages
+const (
+	msgQuery     = 'Q'
+	msgTerminate = 'X'
+	msgSync      = 'S'
+	msgParse     = 'P'
+	msgBind      = 'B'
+	msgDescribe  = 'D'
+	msgExecute   = 'E'
+	msgClose     = 'C'
+	msgFlush     = 'H'
+	msgPassword  = 'p'
+)
+
+// backend messages
+const (
+	msgAuthentication  = 'R'
+	msgParameterStatus = 'S'
+	msgReadyForQuery   = 'Z'
+	msgRowDescription  = 'T'
+	msgDataRow         = 'D'
+	msgCommandComplete = 'C'
+	msgEmptyQuery      = 'I'
+	msgErrorResponse   = 'E'
+)
+
+// transaction status reported in ReadyForQuery, we don't support transactions, so we're always idle
+const statusIdle = 'I'
+
+// readStartup reads the length-prefixed startup packet (it has no type byte), returning its code
+// (protocol version or a special request) and its body
+func readStartup(r io.Reader) (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 8 {
+		return 0, nil, fmt.Errorf("%w: startup packet of %v bytes", errInvalidMessage, length)
+	}
+	if length > maxMessageSize {
+		return 0, nil, errMessageTooLarge
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[4:]), body, nil
+}
+
+// readMessage reads a single typed message
+func readMessage(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 {
+		return 0, nil, fmt.Errorf("%w: message of %v bytes", errInvalidMessage, length)
+	}
+	if length > maxMessageSize {
+		return 0, nil, errMessageTooLarge
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// message builds a single backend message, it's only written out by `send`
+// ARCH: we don't check errors when sending, because bufio.Writer keeps the first error it
+// encounters and returns it when flushing, which is where we check it
+type message struct {
+	mtype byte
+	body  []byte
+}
+
+func newMessage(mtype byte) *message {
+	return &message{mtype: mtype}
+}
+
+func (m *message) int16(val int16) *message {
+	m.body = append(m.body, byte(val>>8), byte(val))
+	return m
+}
+
+func (m *message) int32(val int32) *message {
+	m.body = append(m.body, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+	return m
+}
+
+func (m *message) bytes(val []byte) *message {
+	m.body = append(m.body, val...)
+	return m
+}
+
+// string writes a null-terminated string
+func (m *message) string(val string) *message {
+	m.body = append(m.body, val...)
+	m.body = append(m.body, 0)
+	return m
+}
+
+func (m *message) send(w *bufio.Writer) {
+	var header [5]byte
+	header[0] = m.mtype
+	binary.BigEndian.PutUint32(header[1:], uint32(4+len(m.body)))
+	w.Write(header[:])
+	w.Write(m.body)
+}
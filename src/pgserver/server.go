@@ -0,0 +1,318 @@
+package pgserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query"
+)
+
+var errUnsupportedProtocol = errors.New("unsupported protocol version")
+var errUnsupportedMessage = errors.New("unsupported message type")
+var errExtendedProtocol = errors.New("extended query protocol is not supported, only simple queries are")
+var errCancelRequest = errors.New("query cancellation is not supported")
+var errAuthFailed = errors.New("password authentication failed (expecting one of the server's auth tokens)")
+var errQueryPanicked = errors.New("query failed unexpectedly")
+
+// SQLSTATE codes we report to clients
+// TODO: map our errors onto more specific codes (e.g. 42601 for syntax errors), they are all
+// reported as internal errors for now
+const (
+	codeInternalError       = "XX000"
+	codeFeatureNotSupported = "0A000"
+	codeProtocolViolation   = "08P01"
+	codeInvalidPassword     = "28P01"
+)
+
+// parameters reported to clients upon connecting, some clients refuse to work without them
+// (e.g. JDBC checks client_encoding), our datetimes have no time zone, we report them as UTC
+var serverParameters = [][2]string{
+	{"server_version", "14.0"},
+	{"server_encoding", "UTF8"},
+	{"client_encoding", "UTF8"},
+	{"DateStyle", "ISO, MDY"},
+	{"TimeZone", "UTC"},
+	{"integer_datetimes", "on"},
+	{"standard_conforming_strings", "on"},
+}
+
+// ListenAndServe listens on a given TCP address and serves Postgres clients (see Serve)
+func ListenAndServe(ctx context.Context, db *database.Database, address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening for postgres clients on %v", address)
+	return Serve(ctx, db, ln)
+}
+
+// Serve accepts Postgres clients (psql, BI tools) on a given listener and runs their queries, until
+// the context gets cancelled - the listener and all connections get closed at that point (queries
+// in flight get cancelled) and we wait for all the connections to wind down.
+// Only the simple query protocol is supported, results are sent in the text format.
+// If our HTTP API requires auth tokens (see Config.AuthTokens), clients need to present one of
+// them as their password, any user is accepted. The database requested by clients is ignored,
+// there is just one.
+// ARCH: we don't support TLS, so passwords (tokens) get sent in cleartext, much like they do
+// when our HTTP API is served without TLS
+// ARCH: queries don't go through the query cache or history, unlike those submitted via HTTP
+func Serve(ctx context.Context, db *database.Database, ln net.Listener) error {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		ln.Close()
+	}()
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			// closing a connection is what unblocks reads from it when shutting down
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-connCtx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			// a panic would otherwise take down the whole server, not just this session
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("postgres client %v: %v: %v", conn.RemoteAddr(), errQueryPanicked, r)
+					conn.Close()
+				}
+			}()
+			if err := serveConn(connCtx, db, conn); err != nil && err != io.EOF && connCtx.Err() == nil {
+				log.Printf("postgres client %v: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+		}()
+	}
+}
+
+func serveConn(ctx context.Context, db *database.Database, conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	if err := startup(r, w, db); err != nil {
+		return err
+	}
+	// once an extended query message fails, everything up until the next Sync gets ignored,
+	// so that clients get a single error for a single attempt
+	failed := false
+	for {
+		mtype, body, err := readMessage(r)
+		if err != nil {
+			return err
+		}
+		switch mtype {
+		case msgTerminate:
+			return nil
+		case msgQuery:
+			runQuery(ctx, db, w, strings.TrimRight(string(body), "\x00"))
+			readyForQuery(w)
+		case msgSync:
+			failed = false
+			readyForQuery(w)
+		case msgFlush:
+		case msgParse, msgBind, msgDescribe, msgExecute, msgClose:
+			if !failed {
+				sendError(w, codeFeatureNotSupported, errExtendedProtocol)
+				failed = true
+			}
+		default:
+			err := fmt.Errorf("%w: %q", errUnsupportedMessage, mtype)
+			sendError(w, codeProtocolViolation, err)
+			w.Flush()
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// startup negotiates a new session - clients may first ask for encryption, which we don't support,
+// so they either proceed unencrypted or give up, then they send their startup message (and
+// a password, if we ask for one)
+func startup(r io.Reader, w *bufio.Writer, db *database.Database) error {
+	for {
+		code, _, err := readStartup(r)
+		if err != nil {
+			return err
+		}
+		switch code {
+		case sslRequest, gssRequest:
+			w.WriteByte('N')
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case cancelRequest:
+			// these come in separate connections, there's nothing to reply
+			return errCancelRequest
+		case protocolVersion:
+			// everyone is authorised if there are no tokens configured
+			if !db.Authorise("") {
+				if err := authenticate(r, w, db); err != nil {
+					return err
+				}
+			}
+			newMessage(msgAuthentication).int32(0).send(w) // AuthenticationOk
+			for _, param := range serverParameters {
+				newMessage(msgParameterStatus).string(param[0]).string(param[1]).send(w)
+			}
+			readyForQuery(w)
+			return w.Flush()
+		default:
+			err := fmt.Errorf("%w: %v.%v", errUnsupportedProtocol, code>>16, code&0xffff)
+			sendError(w, codeFeatureNotSupported, err)
+			w.Flush()
+			return err
+		}
+	}
+}
+
+// authenticate asks for a cleartext password and checks it against our auth tokens, these are
+// the same as in our HTTP API, so read-only tokens are accepted as well (we only run queries)
+func authenticate(r io.Reader, w *bufio.Writer, db *database.Database) error {
+	newMessage(msgAuthentication).int32(3).send(w) // AuthenticationCleartextPassword
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	mtype, body, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+	if mtype != msgPassword {
+		err := fmt.Errorf("%w: expecting a password, got %q", errUnsupportedMessage, mtype)
+		sendError(w, codeProtocolViolation, err)
+		w.Flush()
+		return err
+	}
+	if !db.Authorise(strings.TrimRight(string(body), "\x00")) {
+		sendError(w, codeInvalidPassword, errAuthFailed)
+		w.Flush()
+		return errAuthFailed
+	}
+	return nil
+}
+
+func readyForQuery(w *bufio.Writer) {
+	newMessage(msgReadyForQuery).bytes([]byte{statusIdle}).send(w)
+}
+
+func sendError(w *bufio.Writer, code string, err error) {
+	newMessage(msgErrorResponse).
+		bytes([]byte{'S'}).string("ERROR").
+		bytes([]byte{'V'}).string("ERROR").
+		bytes([]byte{'C'}).string(code).
+		bytes([]byte{'M'}).string(err.Error()).
+		bytes([]byte{0}).
+		send(w)
+}
+
+// runQuery runs a simple query and sends its results (or an error) to the client, panics get
+// reported as errors as well, so that the session carries on
+// ARCH: multiple statements in a single query are not supported, we only strip a trailing semicolon
+// (psql and others send it along)
+func runQuery(ctx context.Context, db *database.Database, w *bufio.Writer, sql string) {
+	defer func() {
+		if r := recover(); r != nil {
+			sendError(w, codeInternalError, fmt.Errorf("%w: %v", errQueryPanicked, r))
+		}
+	}()
+	sql = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if sql == "" {
+		newMessage(msgEmptyQuery).send(w)
+		return
+	}
+	// clients often set up their sessions upon connecting (e.g. `SET extra_float_digits = 3`),
+	// we have no session settings, so we just acknowledge these
+	if fields := strings.Fields(sql); strings.EqualFold(fields[0], "set") {
+		newMessage(msgCommandComplete).string("SET").send(w)
+		return
+	}
+	res, err := query.RunSQL(ctx, db, sql)
+	if err != nil {
+		sendError(w, codeInternalError, err)
+		return
+	}
+	// EXPLAIN returns its plan as a single JSON value, like `EXPLAIN (FORMAT JSON)` does in Postgres
+	if res.Plan != nil {
+		plan, err := json.Marshal(res.Plan)
+		if err != nil {
+			sendError(w, codeInternalError, err)
+			return
+		}
+		schema := column.TableSchema{{Name: "QUERY PLAN", Dtype: column.DtypeString}}
+		data := column.NewChunk(column.DtypeString)
+		if err := data.AddValue(string(plan)); err != nil {
+			sendError(w, codeInternalError, err)
+			return
+		}
+		if err := sendRows(w, schema, []*column.Chunk{data}); err != nil {
+			sendError(w, codeInternalError, err)
+		}
+		return
+	}
+	res.Materialise()
+	if err := sendRows(w, res.Schema, res.Data); err != nil {
+		sendError(w, codeInternalError, err)
+	}
+}
+
+// sendRows describes our columns, sends all the rows and completes the command, nothing gets sent
+// if any of the columns cannot be described
+func sendRows(w *bufio.Writer, schema column.TableSchema, data []*column.Chunk) error {
+	desc := newMessage(msgRowDescription).int16(int16(len(schema)))
+	for _, col := range schema {
+		oid, size, err := column.PostgresType(col.Dtype)
+		if err != nil {
+			return err
+		}
+		// columns are not from any table (hence the zeroes), there are no type modifiers (-1)
+		// and values are formatted as text (0)
+		desc.string(col.Name).int32(0).int16(0).int32(int32(oid)).int16(size).int32(-1).int16(0)
+	}
+	desc.send(w)
+
+	length := 0
+	if len(data) > 0 {
+		length = data[0].Len()
+	}
+	for rownum := 0; rownum < length; rownum++ {
+		row := newMessage(msgDataRow).int16(int16(len(data)))
+		for _, col := range data {
+			val, ok := col.PostgresText(rownum)
+			if !ok {
+				row.int32(-1) // nulls have no value
+				continue
+			}
+			row.int32(int32(len(val))).bytes([]byte(val))
+		}
+		row.send(w)
+	}
+	newMessage(msgCommandComplete).string(fmt.Sprintf("SELECT %d", length)).send(w)
+	return nil
+}
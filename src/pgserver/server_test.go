@@ -0,0 +1,292 @@
+package pgserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/database"
+)
+
+// client speaks just enough of the protocol to test our server
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func (c *client) sendStartup(code uint32, body []byte) {
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(buf[4:], code)
+	c.w.Write(append(buf, body...))
+	c.w.Flush()
+}
+
+func (c *client) send(mtype byte, body string) {
+	newMessage(mtype).string(body).send(c.w)
+	c.w.Flush()
+}
+
+// response is what we track of messages received before a ReadyForQuery
+type response struct {
+	columns []string
+	oids    []int32
+	rows    [][]string // nulls are reported as <null>
+	tag     string
+	errors  []string
+	empty   bool
+}
+
+func (c *client) receive(t *testing.T) response {
+	var res response
+	for {
+		mtype, body, err := readMessage(c.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch mtype {
+		case msgReadyForQuery:
+			return res
+		case msgRowDescription:
+			ncols := int(binary.BigEndian.Uint16(body))
+			body = body[2:]
+			for j := 0; j < ncols; j++ {
+				end := strings.IndexByte(string(body), 0)
+				res.columns = append(res.columns, string(body[:end]))
+				body = body[end+1:]
+				res.oids = append(res.oids, int32(binary.BigEndian.Uint32(body[6:])))
+				body = body[18:]
+			}
+		case msgDataRow:
+			ncols := int(binary.BigEndian.Uint16(body))
+			body = body[2:]
+			row := make([]string, 0, ncols)
+			for j := 0; j < ncols; j++ {
+				length := int32(binary.BigEndian.Uint32(body))
+				body = body[4:]
+				if length < 0 {
+					row = append(row, "<null>")
+					continue
+				}
+				row = append(row, string(body[:length]))
+				body = body[length:]
+			}
+			res.rows = append(res.rows, row)
+		case msgCommandComplete:
+			res.tag = strings.TrimRight(string(body), "\x00")
+		case msgEmptyQuery:
+			res.empty = true
+		case msgErrorResponse:
+			for _, field := range strings.Split(string(body), "\x00") {
+				if strings.HasPrefix(field, "M") {
+					res.errors = append(res.errors, field[1:])
+				}
+			}
+		case msgAuthentication, msgParameterStatus:
+		default:
+			t.Fatalf("unexpected message type %q", mtype)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, config *database.Config) (*database.Database, net.Listener, context.CancelFunc, chan error) {
+	db, err := database.NewDatabase("", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Serve(ctx, db, ln)
+	}()
+	return db, ln, cancel, errs
+}
+
+func connect(t *testing.T, ln net.Listener) *client {
+	c := dial(t, ln)
+	if res := c.receive(t); len(res.errors) > 0 {
+		t.Fatalf("failed to connect: %v", res.errors)
+	}
+	return c
+}
+
+// dial sends a startup message, leaving the response (and authentication, if any) to the caller
+func dial(t *testing.T, ln net.Listener) *client {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	// psql asks for TLS first, we decline
+	c.sendStartup(sslRequest, nil)
+	if reply, err := c.r.ReadByte(); err != nil || reply != 'N' {
+		t.Fatalf("expecting TLS to be declined, got %q (%v)", reply, err)
+	}
+	c.sendStartup(protocolVersion, []byte("user\x00smda\x00database\x00smda\x00\x00"))
+	return c
+}
+
+func TestSimpleQueries(t *testing.T) {
+	db, ln, cancel, errs := newTestServer(t, nil)
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromMap("foo", map[string][]string{
+		"id":    {"1", "2", "3"},
+		"name":  {"joe", "", "ann"},
+		"score": {"1.5", "2", ""},
+		"ok":    {"t", "f", "t"},
+		"day":   {"2020-01-02", "2021-03-04", ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	c := connect(t, ln)
+	tests := []struct {
+		query    string
+		expected response
+	}{
+		{"SELECT id, name, score, ok, day FROM foo ORDER BY id DESC LIMIT 2;", response{
+			columns: []string{"id", "name", "score", "ok", "day"},
+			oids:    []int32{20, 25, 701, 16, 1082},
+			rows:    [][]string{{"3", "ann", "<null>", "t", "<null>"}, {"2", "", "2", "f", "2021-03-04"}},
+			tag:     "SELECT 2",
+		}},
+		{"SELECT count() AS cnt FROM foo WHERE id > 1", response{columns: []string{"cnt"}, oids: []int32{20}, rows: [][]string{{"2"}}, tag: "SELECT 1"}},
+		{"SELECT 1 FROM foo WHERE false", response{columns: []string{"1"}, oids: []int32{20}, tag: "SELECT 0"}},
+		{"  ;", response{empty: true}},
+		{"SET extra_float_digits = 3", response{tag: "SET"}},
+		{"SELECT nonexistent FROM foo", response{errors: []string{"unknown identifier: nonexistent"}}},
+		// coalescing multiple arguments is not implemented (it panics), this shouldn't bring us down
+		{"SELECT sum(coalesce(score, 1)) FROM foo", response{errors: []string{"query failed unexpectedly: TODO: not implemented yet"}}},
+	}
+	for _, test := range tests {
+		c.send(msgQuery, test.query)
+		if res := c.receive(t); !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("expecting %v to result in %+v, got %+v", test.query, test.expected, res)
+		}
+	}
+
+	c.send(msgQuery, "EXPLAIN SELECT id FROM foo")
+	if res := c.receive(t); len(res.rows) != 1 || !strings.Contains(res.rows[0][0], `"columns":["id"]`) {
+		t.Errorf("expecting a query plan, got %+v", res)
+	}
+
+	// extended protocol messages fail, but only once until the next sync
+	c.send(msgParse, "\x00SELECT 1\x00\x00\x00")
+	c.send(msgBind, "\x00\x00\x00\x00\x00\x00\x00\x00")
+	c.send(msgSync, "")
+	if res := c.receive(t); len(res.errors) != 1 || res.errors[0] != errExtendedProtocol.Error() {
+		t.Errorf("expecting a single error for an extended query, got %+v", res)
+	}
+	// the connection is still usable afterwards
+	c.send(msgQuery, "SELECT 1")
+	if res := c.receive(t); res.tag != "SELECT 1" {
+		t.Errorf("expecting a connection to survive an extended query, got %+v", res)
+	}
+
+	c.send(msgTerminate, "")
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("expecting the server to shut down cleanly, got %v", err)
+	}
+}
+
+func TestUnsupportedProtocol(t *testing.T) {
+	db, ln, cancel, errs := newTestServer(t, nil)
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	c.sendStartup(2<<16, nil)
+	mtype, _, err := readMessage(c.r)
+	if err != nil || mtype != msgErrorResponse {
+		t.Errorf("expecting an old protocol to be rejected, got %q (%v)", mtype, err)
+	}
+
+	// open connections get closed upon shutdown
+	idle := connect(t, ln)
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("expecting the server to shut down cleanly, got %v", err)
+	}
+	if _, _, err := readMessage(idle.r); err == nil {
+		t.Error("expecting idle connections to be closed when shutting down")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	db, ln, cancel, errs := newTestServer(t, &database.Config{AuthTokens: []string{"secret"}, ReadOnlyTokens: []string{"reader"}})
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"secret", true},
+		{"reader", true}, // we only run queries, so read-only tokens are fine
+		{"", false},
+		{"secre", false},
+		{"foo", false},
+	}
+	for _, test := range tests {
+		c := dial(t, ln)
+		mtype, body, err := readMessage(c.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtype != msgAuthentication || binary.BigEndian.Uint32(body) != 3 {
+			t.Fatalf("expecting a cleartext password request, got %q (%v)", mtype, body)
+		}
+		c.send(msgPassword, test.password)
+		if !test.ok {
+			// failed authentication closes the connection, there's no ReadyForQuery
+			mtype, body, err := readMessage(c.r)
+			if err != nil || mtype != msgErrorResponse || !strings.Contains(string(body), errAuthFailed.Error()) {
+				t.Errorf("expecting password %q to be rejected, got %q: %s (%v)", test.password, mtype, body, err)
+			}
+			if _, _, err := readMessage(c.r); err == nil {
+				t.Errorf("expecting a connection to be closed after a failed authentication")
+			}
+			continue
+		}
+		if res := c.receive(t); len(res.errors) > 0 {
+			t.Errorf("expecting password %q to be accepted, got %v", test.password, res.errors)
+		}
+		c.send(msgQuery, "SELECT 1")
+		if res := c.receive(t); res.tag != "SELECT 1" {
+			t.Errorf("expecting authenticated clients to run queries, got %+v", res)
+		}
+		c.send(msgTerminate, "")
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("expecting the server to shut down cleanly, got %v", err)
+	}
+}
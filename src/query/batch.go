@@ -0,0 +1,67 @@
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// Statement is a single query of a batch (see Cache.RunBatch)
+type Statement struct {
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params"`
+}
+
+// StatementResult is the outcome of a single statement in a batch - either its result or its error,
+// statements that didn't get to run (because an earlier one failed) are marked as skipped
+type StatementResult struct {
+	Result     *Result `json:"result,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	ErrorCode  string  `json:"error_code,omitempty"` // see errs.Code
+	Skipped    bool    `json:"skipped,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// RunBatch runs a series of statements one after another, so that clients (e.g. dashboards) can
+// get results of several queries in one go. A failing statement doesn't fail the whole batch, unless
+// `stopOnError` is set, in which case all the subsequent statements get skipped. `done` gets called
+// after each statement that ran (e.g. to record it in our query history), it can be nil.
+// Statements run with given settings, SET statements (e.g. `SET timezone = 'Europe/Prague'`) change
+// them for all the statements that follow, they don't yield any results.
+// ARCH: statements don't see each other's effects, there are no transactions (or writes, for that matter)
+func (c *Cache) RunBatch(ctx context.Context, db *database.Database, stmts []Statement, settings Settings, stopOnError bool, done func(stmt Statement, started time.Time, res *Result, err error)) []StatementResult {
+	ret := make([]StatementResult, len(stmts))
+	failed := false
+	for j, stmt := range stmts {
+		if failed && stopOnError {
+			ret[j].Skipped = true
+			continue
+		}
+		if setting, ok, err := expr.ParseSetSQL(stmt.SQL); ok || err != nil {
+			if err == nil {
+				err = settings.set(setting)
+			}
+			if err != nil {
+				ret[j].Error, ret[j].ErrorCode = err.Error(), errs.Code(err)
+				failed = true
+			}
+			continue
+		}
+		started := time.Now()
+		res, err := c.RunSQLWithSettings(ctx, db, stmt.SQL, settings, stmt.Params...)
+		ret[j].DurationMs = float64(time.Since(started).Microseconds()) / 1000
+		if done != nil {
+			done(stmt, started, res, err)
+		}
+		if err != nil {
+			ret[j].Error, ret[j].ErrorCode = err.Error(), errs.Code(err)
+			failed = true
+			continue
+		}
+		ret[j].Result = res
+	}
+	return ret
+}
@@ -0,0 +1,125 @@
+package query
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+)
+
+func TestRunningBatches(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	stmts := []Statement{
+		{SQL: "SELECT sum(a) FROM foo"},
+		{SQL: "SELECT a FROM foo WHERE b > ?", Params: []interface{}{3}},
+		{SQL: "SELECT nonexistent FROM foo"},
+		{SQL: "SELECT b FROM foo"},
+	}
+	tests := []struct {
+		stopOnError bool
+		expected    []string // data of each statement, "error", or "skipped"
+		ran         int
+	}{
+		{false, []string{"[[4]]", "[[3]]", "error", "[[2] [4]]"}, 4},
+		{true, []string{"[[4]]", "[[3]]", "error", "skipped"}, 3},
+	}
+	cache := NewCache(10)
+	for _, test := range tests {
+		var ran []string
+		results := cache.RunBatch(context.Background(), db, stmts, Settings{}, test.stopOnError, func(stmt Statement, started time.Time, res *Result, err error) {
+			ran = append(ran, stmt.SQL)
+		})
+		var got []string
+		for _, res := range results {
+			switch {
+			case res.Skipped:
+				got = append(got, "skipped")
+			case res.Error != "":
+				got = append(got, "error")
+			default:
+				got = append(got, resultRows(t, res.Result))
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expecting a batch (stopping on errors: %v) to result in %v, got %v", test.stopOnError, test.expected, got)
+		}
+		if len(ran) != test.ran {
+			t.Errorf("expecting %v statements to run, got %v", test.ran, ran)
+		}
+	}
+}
+
+func TestSettingsInBatches(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("dt\n2020-02-29 23:30:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	stmts := []Statement{
+		{SQL: "SELECT extract(hour FROM dt) FROM foo"},
+		{SQL: "SET timezone = 'Europe/Prague'"},
+		{SQL: "SELECT extract(hour FROM dt) FROM foo"},
+		{SQL: "SET TIME ZONE 'America/New_York'"},
+		{SQL: "SELECT extract(hour FROM dt) FROM foo"},
+		{SQL: "SET timezone TO 'Europe/Atlantis'"},
+		{SQL: "SET foo = 'bar'"},
+		{SQL: "SET timezone"},
+		{SQL: "SELECT extract(hour FROM dt) FROM foo"},
+		{SQL: "SET max_bytes_scanned = 'lots'"},
+		{SQL: "SET max_bytes_scanned = '1000000'"},
+		{SQL: "SET timeout = 'forever'"},
+		{SQL: "SET timeout = '5000'"},
+		{SQL: "SELECT extract(hour FROM dt) FROM foo"},
+		{SQL: "SET profile = 'maybe'"},
+		{SQL: "SET profile = 'true'"},
+		{SQL: "SELECT extract(hour FROM dt) FROM foo"},
+	}
+	expected := []string{"[[23]]", "", "[[0]]", "", "[[18]]", "error", "error", "error", "[[18]]", "error", "", "error", "", "[[18]]", "error", "", "[[18]]"}
+	results := NewCache(10).RunBatch(context.Background(), db, stmts, Settings{}, false, nil)
+	for j, res := range results {
+		got := res.Error
+		switch {
+		case got != "":
+			got = "error"
+		case res.Result != nil:
+			got = resultRows(t, res.Result)
+		}
+		if got != expected[j] {
+			t.Errorf("expecting %q to result in %v, got %v", stmts[j].SQL, expected[j], got)
+		}
+		if profiled := res.Result != nil && res.Result.Profile != nil; profiled != (j == len(stmts)-1) {
+			t.Errorf("unexpected profiling of %q (profiled: %v)", stmts[j].SQL, profiled)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package query
+
+import (
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// pointLookups are equality conditions of a filter (e.g. `WHERE user_id = 'x'`), they can be checked
+// against stripes' bloom filters - if a stripe's filter doesn't contain a value we're looking up, the
+// stripe cannot match our filter and we don't need to read it at all
+type pointLookups struct {
+	columns []string
+	hashes  [][]uint64 // hashes of values looked up in each column
+}
+
+// newPointLookups prepares lookups for a given filter, it returns nil if there are no lookups or if
+// the dataset doesn't have any bloom filters
+func newPointLookups(ds *database.Dataset, filter expr.Expression) (*pointLookups, error) {
+	if ds == nil || filter == nil {
+		return nil, nil
+	}
+	blooms := false
+	for _, stripe := range ds.Stripes {
+		if stripe.Blooms != nil {
+			blooms = true
+			break
+		}
+	}
+	if !blooms {
+		return nil, nil
+	}
+	pl := &pointLookups{}
+	seen := make(map[string]bool)
+	for _, name := range expr.ColumnsUsed(filter, ds.Schema) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		_, col, err := ds.Schema.LocateColumn(name)
+		if err != nil {
+			return nil, err
+		}
+		// only these get bloom filters (see database.Config.BloomFilters)
+		if col.Dtype != column.DtypeInt && col.Dtype != column.DtypeString {
+			continue
+		}
+		var hashes []uint64
+		for _, point := range expr.ColumnRange(filter, ds.Schema, name).Points {
+			value, err := expr.Evaluate(point, 1, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			// values of other types (e.g. floats compared to ints) hash differently
+			if value.Dtype() != col.Dtype {
+				continue
+			}
+			if hash, ok := value.StableHash(0); ok {
+				hashes = append(hashes, hash)
+			}
+		}
+		if hashes != nil {
+			pl.columns = append(pl.columns, name)
+			pl.hashes = append(pl.hashes, hashes)
+		}
+	}
+	if pl.columns == nil {
+		return nil, nil
+	}
+	return pl, nil
+}
+
+// skipStripe checks if a stripe's bloom filters rule out any of our lookups (a nil pointLookups
+// never skips anything), it also reports how many bytes it read
+// OPTIM: filters get read in separate requests from the data itself, so stripes we don't skip
+// incur an extra read (per looked up column)
+func (pl *pointLookups) skipStripe(db *database.Database, ds *database.Dataset, stripe database.Stripe) (bool, int, error) {
+	if pl == nil || stripe.Blooms == nil {
+		return false, 0, nil
+	}
+	bytesRead := 0
+	for j, name := range pl.columns {
+		filter, nbytes, err := db.ReadBloomFilter(ds, stripe, name)
+		bytesRead += nbytes
+		if err != nil {
+			return false, bytesRead, err
+		}
+		if filter == nil {
+			continue
+		}
+		for _, hash := range pl.hashes[j] {
+			if !filter.MayContain(hash) {
+				return true, bytesRead, nil
+			}
+		}
+	}
+	return false, bytesRead, nil
+}
@@ -0,0 +1,82 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errMemoryBudgetExceeded = errs.New(errs.ErrResourceExhausted, "query exceeded its memory budget")
+var errQueryTooExpensive = errs.New(errs.ErrResourceExhausted, "query too expensive")
+
+// memoryBudget caps the amount of memory held by a single query - we account for chunks read from
+// stripes, evaluated expressions and our (intermediate) results
+// ARCH: this is only an approximation, we don't track hash maps and aggregator state in GROUP BY
+// queries or temporary allocations within expression evaluation
+type memoryBudget struct {
+	limit int // in bytes, non-positive values mean no limit
+}
+
+// check verifies that all the chunks held at the same time fit within our budget
+func (mb *memoryBudget) check(chunks ...*column.Chunk) error {
+	used := 0
+	for _, chunk := range chunks {
+		if chunk != nil {
+			used += chunk.MemoryUsage()
+		}
+	}
+	if mb.limit > 0 && used > mb.limit {
+		return fmt.Errorf("%w: needed %v bytes, the limit is %v bytes", errMemoryBudgetExceeded, used, mb.limit)
+	}
+	return nil
+}
+
+// scanBudget caps the number of bytes a query reads from storage (see database.ReadStats), it's
+// shared by all the parts of a query (subqueries, union parts, common tables), so it's kept in its
+// context (see Run). Stripes may be read concurrently, hence the lock.
+// ARCH: we only find out how much a stripe costs after reading it, so we overshoot by up to a stripe
+// (per worker), we also don't count reads of bloom filters
+type scanBudget struct {
+	sync.Mutex
+	limit   int // in bytes, non-positive values mean no limit
+	scanned int
+	stripes int // stripes read so far, for diagnostics
+}
+
+type scanBudgetKey struct{}
+
+// scanBudgetFrom retrieves the scan budget of a query, nil if there's none (which tracks nothing)
+func scanBudgetFrom(ctx context.Context) *scanBudget {
+	sb, _ := ctx.Value(scanBudgetKey{}).(*scanBudget)
+	return sb
+}
+
+// add records bytes read by a single stripe, it fails once we've read more than our limit
+func (sb *scanBudget) add(bytes int) error {
+	if sb == nil {
+		return nil
+	}
+	sb.Lock()
+	defer sb.Unlock()
+	sb.scanned += bytes
+	sb.stripes++
+	if sb.limit > 0 && sb.scanned > sb.limit {
+		return fmt.Errorf("%w: scanned %v bytes, the limit is %v bytes", errQueryTooExpensive, sb.scanned, sb.limit)
+	}
+	return nil
+}
+
+// chunksHeld collects chunks from stripe data and results, so that we can check them in one go
+func chunksHeld(columns map[string]*column.Chunk, results ...[]*column.Chunk) []*column.Chunk {
+	var ret []*column.Chunk
+	for _, col := range columns {
+		ret = append(ret, col)
+	}
+	for _, res := range results {
+		ret = append(ret, res...)
+	}
+	return ret
+}
@@ -0,0 +1,197 @@
+package query
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// Cache is an LRU cache of query results. Datasets are immutable and each of their versions has
+// a unique ID, so we key results by the version a query resolves to (not the name), which means
+// we cannot serve stale results - appending to a dataset creates a new version, which misses.
+// ARCH: we bound the number of results, not their size in memory
+type Cache struct {
+	sync.Mutex
+	capacity int
+	entries  map[cacheKey]*list.Element
+	lru      *list.List // front = most recently used
+	hits     int
+	misses   int
+}
+
+type cacheKey struct {
+	version  string
+	query    string
+	timezone string // the same query yields different results in different timezones
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	result *Result
+}
+
+// CacheStats describe the state of a cache, it's serialisable, so that we can expose it
+type CacheStats struct {
+	Capacity int `json:"capacity"`
+	Entries  int `json:"entries"`
+	Hits     int `json:"hits"`
+	Misses   int `json:"misses"`
+}
+
+// NewCache initialises a cache that holds up to `capacity` results, a non-positive capacity
+// disables caching altogether
+func NewCache(capacity int) *Cache {
+	return &Cache{
+		capacity: capacity,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// we hand out copies, because results get modified by their consumers (see Materialise or Prune),
+// the underlying chunks are never modified in place, so we can share those
+func (res *Result) shallowCopy() *Result {
+	ret := *res
+	ret.Data = append(ret.Data[:0:0], res.Data...)
+	if res.rowIdxs != nil {
+		ret.rowIdxs = append(ret.rowIdxs[:0:0], res.rowIdxs...)
+	}
+	return &ret
+}
+
+// cacheable queries need to target a dataset and cannot contain non-deterministic expressions
+// or samples (unless seeded, see REPEATABLE)
+// ARCH: we key results by a single dataset version, so we cannot cache unions (of multiple datasets)
+// or queries with subqueries or common tables (these may read other datasets)
+func cacheable(q expr.Query) bool {
+	if q.Dataset == nil || len(q.Union) > 0 || len(q.With) > 0 || len(q.Subqueries()) > 0 {
+		return false
+	}
+	if q.Sample != nil && q.Sample.Seed == nil {
+		return false
+	}
+	exprs := append([]expr.Expression{}, q.Select...)
+	if q.Filter != nil {
+		exprs = append(exprs, q.Filter)
+	}
+	exprs = append(exprs, q.Aggregate...)
+	exprs = append(exprs, q.Order...)
+	for _, ex := range exprs {
+		if !expr.IsDeterministic(ex) {
+			return false
+		}
+	}
+	return true
+}
+
+// the key needs to be computed before running a query, because Run modifies the query
+// (e.g. by expanding `*`)
+func (c *Cache) key(db *database.Database, q expr.Query) (cacheKey, bool) {
+	c.Lock()
+	capacity := c.capacity
+	c.Unlock()
+	if capacity <= 0 || !cacheable(q) {
+		return cacheKey{}, false
+	}
+	ds, err := db.ResolveDataset(q.Dataset.QualifiedName(), q.Dataset.Version, q.Dataset.Latest)
+	if err != nil {
+		// let Run report this error
+		return cacheKey{}, false
+	}
+	key := cacheKey{version: ds.ID.String(), query: q.String()}
+	if q.Timezone != nil {
+		key.timezone = q.Timezone.String()
+	}
+	return key, true
+}
+
+// Run runs a query, unless its results are already cached
+func (c *Cache) Run(ctx context.Context, db *database.Database, q expr.Query) (*Result, error) {
+	key, ok := c.key(db, q)
+	// cached results wouldn't tell us anything about how long a query takes
+	if !ok || profileFrom(ctx) != nil {
+		return Run(ctx, db, q)
+	}
+	c.Lock()
+	if el, found := c.entries[key]; found {
+		c.hits++
+		c.lru.MoveToFront(el)
+		res := el.Value.(*cacheEntry).result.shallowCopy()
+		c.Unlock()
+		return res, nil
+	}
+	c.misses++
+	c.Unlock()
+
+	// we don't hold the lock while running the query, so concurrent misses of the same query
+	// may run it multiple times, but only one result gets stored
+	res, err := Run(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, found := c.entries[key]; !found {
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, result: res.shallowCopy()})
+		c.evict()
+	}
+	return res, nil
+}
+
+func (c *Cache) evict() {
+	for c.lru.Len() > 0 && c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Resize changes the number of results the cache holds, evicting the least recently used ones if
+// it shrinks, a non-positive capacity disables caching
+func (c *Cache) Resize(capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	c.capacity = capacity
+	c.evict()
+}
+
+// RunSQLWithParams is a cached equivalent of the package level RunSQLWithParams
+func (c *Cache) RunSQLWithParams(ctx context.Context, db *database.Database, query string, params ...interface{}) (*Result, error) {
+	return c.RunSQLWithSettings(ctx, db, query, Settings{}, params...)
+}
+
+// RunSQLWithSettings is like RunSQLWithParams, but with non-default settings (e.g. a timezone)
+func (c *Cache) RunSQLWithSettings(ctx context.Context, db *database.Database, query string, settings Settings, params ...interface{}) (*Result, error) {
+	q, err := parseSQLWithParams(query, settings, params)
+	if err != nil {
+		return nil, err
+	}
+	return c.Run(settings.withLimits(ctx), db, q)
+}
+
+// Invalidate removes all cached results of a given dataset version (e.g. when it gets removed)
+func (c *Cache) Invalidate(version database.UID) {
+	c.Lock()
+	defer c.Unlock()
+	for key, el := range c.entries {
+		if key.version == version.String() {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return CacheStats{
+		Capacity: c.capacity,
+		Entries:  c.lru.Len(),
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
@@ -0,0 +1,163 @@
+package query
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+)
+
+func TestCachingResults(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(2)
+	queries := []struct {
+		query  string
+		params []interface{}
+		stats  CacheStats
+	}{
+		{"SELECT a FROM foo LIMIT 10", nil, CacheStats{Capacity: 2, Entries: 1, Hits: 0, Misses: 1}},
+		{"SELECT a FROM foo LIMIT 10", nil, CacheStats{Capacity: 2, Entries: 1, Hits: 1, Misses: 1}},
+		// different parameters are different queries
+		{"SELECT a FROM foo WHERE b > ? LIMIT 10", []interface{}{2}, CacheStats{Capacity: 2, Entries: 2, Hits: 1, Misses: 2}},
+		{"SELECT a FROM foo WHERE b > ? LIMIT 10", []interface{}{3}, CacheStats{Capacity: 2, Entries: 2, Hits: 1, Misses: 3}},
+		{"SELECT a FROM foo WHERE b > ? LIMIT 10", []interface{}{3}, CacheStats{Capacity: 2, Entries: 2, Hits: 2, Misses: 3}},
+		// the first query got evicted
+		{"SELECT a FROM foo LIMIT 10", nil, CacheStats{Capacity: 2, Entries: 2, Hits: 2, Misses: 4}},
+		// no caching of queries without datasets or with non-deterministic functions
+		{"SELECT 1", nil, CacheStats{Capacity: 2, Entries: 2, Hits: 2, Misses: 4}},
+		{"SELECT now() FROM foo LIMIT 1", nil, CacheStats{Capacity: 2, Entries: 2, Hits: 2, Misses: 4}},
+	}
+	for _, test := range queries {
+		if _, err := cache.RunSQLWithParams(context.Background(), db, test.query, test.params...); err != nil {
+			t.Fatal(err)
+		}
+		if stats := cache.Stats(); stats != test.stats {
+			t.Errorf("after running %v (%v), expecting stats to be %+v, got %+v", test.query, test.params, test.stats, stats)
+		}
+	}
+
+	// consumers modifying their results don't affect cached data
+	res, err := cache.RunSQLWithParams(context.Background(), db, "SELECT a FROM foo ORDER BY a DESC LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Materialise()
+	res, err = cache.RunSQLWithParams(context.Background(), db, "SELECT a FROM foo ORDER BY a DESC LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Stats().Hits != 3 {
+		t.Errorf("expecting a cache hit, got %+v", cache.Stats())
+	}
+	// materialisation drops sorting information, this must not propagate to the cache
+	if res.rowIdxs == nil {
+		t.Errorf("expecting cached results to be unaffected by materialisation: %+v", res)
+	}
+
+	// new versions of a dataset don't get served stale results
+	appended, err := db.AppendToDataset(ds, strings.NewReader("a,b\n5,6"), database.WideningNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = cache.RunSQLWithParams(context.Background(), db, "SELECT a FROM foo ORDER BY a DESC LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Materialise()
+	expected := column.NewChunkIntsFromSlice([]int64{5}, nil)
+	if !column.ChunksEqual(res.Data[0], expected) {
+		t.Errorf("expecting a fresh result %v, got %v", expected, res.Data[0])
+	}
+
+	cache.Invalidate(appended.ID)
+	if stats := cache.Stats(); stats.Entries != 1 {
+		t.Errorf("expecting invalidation to leave one entry, got %+v", stats)
+	}
+}
+
+func TestCachingSampledQueries(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4\n5,6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(2)
+	queries := []struct {
+		query string
+		stats CacheStats
+	}{
+		// samples differ from run to run, unless they are seeded
+		{"SELECT count(), sum(a) FROM foo TABLESAMPLE BERNOULLI (10)", CacheStats{Capacity: 2}},
+		{"SELECT count(), sum(a) FROM foo TABLESAMPLE BERNOULLI (10)", CacheStats{Capacity: 2}},
+		{"SELECT count(), sum(a) FROM foo TABLESAMPLE BERNOULLI (10) REPEATABLE (42)", CacheStats{Capacity: 2, Entries: 1, Misses: 1}},
+		{"SELECT count(), sum(a) FROM foo TABLESAMPLE BERNOULLI (10) REPEATABLE (42)", CacheStats{Capacity: 2, Entries: 1, Hits: 1, Misses: 1}},
+	}
+	for _, test := range queries {
+		if _, err := cache.RunSQLWithParams(context.Background(), db, test.query); err != nil {
+			t.Fatal(err)
+		}
+		if stats := cache.Stats(); stats != test.stats {
+			t.Errorf("after running %v, expecting stats to be %+v, got %+v", test.query, test.stats, stats)
+		}
+	}
+}
+
+func TestDisabledCache(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(0)
+	for j := 0; j < 3; j++ {
+		if _, err := cache.RunSQLWithParams(context.Background(), db, "SELECT a FROM foo LIMIT 10"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := cache.Stats(); stats != (CacheStats{}) {
+		t.Errorf("expecting a disabled cache not to record anything, got %+v", stats)
+	}
+}
@@ -0,0 +1,55 @@
+package query
+
+import (
+	"context"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+type commonTablesKey struct{}
+
+// runWith runs common tables of a query (in order, so that each of them can read those before it)
+// and then the query itself, which can read all of them. Results of common tables are wrapped in
+// in-memory datasets (see database.NewResultDataset), so they get read like any other dataset.
+// ARCH: common tables get run even in EXPLAIN queries, we need their schemas to validate the query
+// ARCH: results of common tables don't count towards our memory budget (see memoryBudget)
+func runWith(ctx context.Context, db *database.Database, q expr.Query) (*Result, error) {
+	tables := make(map[string]*database.Dataset)
+	ctx = context.WithValue(ctx, commonTablesKey{}, tables)
+	for _, cte := range q.With {
+		inner := cte.Query
+		inner.Explain = false
+		tctx, stop := startTimer(ctx, timerCommonTable)
+		res, err := run(tctx, db, inner)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+		data, err := res.orderedData()
+		if err != nil {
+			return nil, err
+		}
+		ds, err := database.NewResultDataset(cte.Name, res.Schema, data)
+		if err != nil {
+			return nil, err
+		}
+		ds.FloatPolicy = res.floats
+		tables[cte.Name] = ds
+	}
+	q.With = nil
+	return run(ctx, db, q)
+}
+
+// commonTable looks up a common table a dataset in a query refers to (only plain names can)
+func commonTable(ctx context.Context, dataset *expr.Dataset) (*database.Dataset, bool) {
+	if dataset.Namespace != "" || !dataset.Latest {
+		return nil, false
+	}
+	tables, ok := ctx.Value(commonTablesKey{}).(map[string]*database.Dataset)
+	if !ok {
+		return nil, false
+	}
+	ds, ok := tables[dataset.Name]
+	return ds, ok
+}
@@ -0,0 +1,128 @@
+package query
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+var errCursorNotFound = errs.New(errs.ErrNotFound, "cursor not found (it may have expired)")
+var errInvalidPageSize = errs.New(errs.ErrBadRequest, "invalid page size")
+
+// cursors not used for this long get discarded
+const cursorTTL = 10 * time.Minute
+
+// Cursors hold on to query results, so that clients can page through them without re-running their
+// queries - the first page hands out a continuation token (a cursor), which gets exchanged for the
+// next page (and a new cursor), until there's nothing left.
+// ARCH: like our Cache, we bound the number of results held, not their size in memory, the least
+// recently used cursor gets evicted once we're at capacity
+type Cursors struct {
+	sync.Mutex
+	capacity int
+	entries  map[string]*cursorEntry
+}
+
+type cursorEntry struct {
+	result   *Result
+	offset   int // rows already served
+	pageSize int
+	used     time.Time
+}
+
+// NewCursors initialises a cursor store that holds up to `capacity` results, a non-positive capacity
+// disables paging (all results get served in full)
+func NewCursors(capacity int) *Cursors {
+	return &Cursors{
+		capacity: capacity,
+		entries:  make(map[string]*cursorEntry),
+	}
+}
+
+func newCursorToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// FirstPage returns the first `pageSize` rows of a given result, along with a cursor for the next
+// page (an empty cursor means there are no more rows)
+func (cs *Cursors) FirstPage(res *Result, pageSize int) (*Result, string, error) {
+	if pageSize <= 0 {
+		return nil, "", errInvalidPageSize
+	}
+	if cs.capacity <= 0 || res.Plan != nil || res.Length <= pageSize {
+		return res, "", nil
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.expire()
+	if len(cs.entries) >= cs.capacity {
+		var lru string
+		for token, entry := range cs.entries {
+			if lru == "" || entry.used.Before(cs.entries[lru].used) {
+				lru = token
+			}
+		}
+		delete(cs.entries, lru)
+	}
+	token := newCursorToken()
+	cs.entries[token] = &cursorEntry{result: res, pageSize: pageSize, used: time.Now()}
+	return cs.page(token, pageSize)
+}
+
+// NextPage returns the next page of results for a given cursor, the page size of the previous
+// page is used unless a positive one is supplied. Each cursor can only be used once, the next page
+// comes along with a new cursor (an empty cursor means there are no more rows).
+func (cs *Cursors) NextPage(cursor string, pageSize int) (*Result, string, error) {
+	if pageSize < 0 {
+		return nil, "", errInvalidPageSize
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.expire()
+	entry, ok := cs.entries[cursor]
+	if !ok {
+		return nil, "", errCursorNotFound
+	}
+	delete(cs.entries, cursor)
+	if pageSize == 0 {
+		pageSize = entry.pageSize
+	}
+	entry.pageSize = pageSize
+	entry.used = time.Now()
+	token := newCursorToken()
+	cs.entries[token] = entry
+	return cs.page(token, pageSize)
+}
+
+// page serves the next page of a given cursor, exhausted cursors get discarded (and not handed out)
+func (cs *Cursors) page(token string, pageSize int) (*Result, string, error) {
+	entry := cs.entries[token]
+	page := entry.result.SkipRows(entry.offset)
+	if page.Length > pageSize {
+		page.Length = pageSize
+	}
+	entry.offset += page.Length
+	if entry.offset >= entry.result.Length {
+		delete(cs.entries, token)
+		return page, "", nil
+	}
+	page.cursor = token
+	return page, token, nil
+}
+
+// expire discards cursors that haven't been used in a while, it needs to be called with the lock held
+// OPTIM: we scan all the cursors on each call, but there are at most `capacity` of them
+func (cs *Cursors) expire() {
+	for token, entry := range cs.entries {
+		if time.Since(entry.used) > cursorTTL {
+			delete(cs.entries, token)
+		}
+	}
+}
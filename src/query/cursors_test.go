@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kokes/smda/src/database"
+)
+
+func TestPagingThroughResults(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n5\n3\n9\n2\n5\n7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	res, err := RunSQL(context.Background(), db, "SELECT a FROM foo ORDER BY a DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cursors := NewCursors(2)
+	page, cursor, err := cursors.FirstPage(res, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := []string{resultRows(t, page)}
+	// page sizes can change along the way
+	for _, size := range []int{2, 0} {
+		if cursor == "" {
+			t.Fatalf("expecting a cursor after %v", pages)
+		}
+		used := cursor
+		page, cursor, err = cursors.NextPage(cursor, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, resultRows(t, page))
+		if _, _, err := cursors.NextPage(used, size); !errors.Is(err, errCursorNotFound) {
+			t.Errorf("expecting cursors to be usable only once, got %v", err)
+		}
+	}
+	expected := []string{"[[9] [7] [5]]", "[[5] [3]]", "[[2] [1]]"}
+	if strings.Join(pages, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expecting pages to be %v, got %v", expected, pages)
+	}
+	if cursor != "" {
+		t.Errorf("expecting no cursor after the last page, got %v", cursor)
+	}
+	// the underlying result is not affected by paging
+	if got := resultRows(t, res); got != "[[9] [7] [5] [5] [3] [2] [1]]" {
+		t.Errorf("paging modified the underlying result: %v", got)
+	}
+
+	// small results fit in a single page
+	if _, cursor, err := cursors.FirstPage(res, 100); err != nil || cursor != "" {
+		t.Errorf("expecting no cursor for a single page, got %v (%v)", cursor, err)
+	}
+	if _, _, err := cursors.FirstPage(res, 0); !errors.Is(err, errInvalidPageSize) {
+		t.Errorf("expecting an empty page to fail with %v, got %v", errInvalidPageSize, err)
+	}
+	if _, _, err := cursors.NextPage("foo", 1); !errors.Is(err, errCursorNotFound) {
+		t.Errorf("expecting an unknown cursor to fail with %v, got %v", errCursorNotFound, err)
+	}
+
+	// the least recently used cursor gets evicted
+	_, first, _ := cursors.FirstPage(res, 1)
+	_, second, _ := cursors.FirstPage(res, 1)
+	_, third, _ := cursors.FirstPage(res, 1)
+	if _, _, err := cursors.NextPage(first, 1); !errors.Is(err, errCursorNotFound) {
+		t.Errorf("expecting the oldest cursor to be evicted, got %v", err)
+	}
+	for _, cursor := range []string{second, third} {
+		if _, _, err := cursors.NextPage(cursor, 1); err != nil {
+			t.Errorf("expecting recent cursors to be retained, got %v", err)
+		}
+	}
+
+	// disabled paging serves results in full
+	page, cursor, err = NewCursors(-1).FirstPage(res, 1)
+	if err != nil || cursor != "" || page.Length != res.Length {
+		t.Errorf("expecting disabled paging to return full results, got %v rows (%v, %v)", page.Length, cursor, err)
+	}
+}
@@ -0,0 +1,144 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/column"
+)
+
+var errNotAggregating = errors.New("not an aggregating function")
+var errAggregatorMismatch = errors.New("cannot merge states of different aggregations")
+
+// Aggregator is the state of an aggregating function call (e.g. `sum(a+b)`) - it gets updated
+// with data (Update), partial states can be combined (Merge) and the aggregates computed
+// (Finalize). Partial states allow for aggregating data independently (e.g. stripes in parallel
+// or data on different machines), so each Aggregator is meant to be used by a single goroutine.
+// Queries keep the state of each aggregating function within it (see InitAggregator), other
+// states are detached from their functions.
+type Aggregator struct {
+	fun   *Function
+	state *column.AggState
+}
+
+// NewAggregator creates a fresh state for an aggregating function, it doesn't affect the state
+// kept in the function itself. A schema determines the types of the function's arguments.
+func NewAggregator(fun *Function, schema column.TableSchema) (*Aggregator, error) {
+	if fun.aggregatorFactory == nil {
+		return nil, fmt.Errorf("%w: %v", errNotAggregating, fun)
+	}
+	var rtypes []column.Dtype
+	for _, ch := range fun.args {
+		rtype, err := ch.ReturnType(schema)
+		if err != nil {
+			return nil, err
+		}
+		rtypes = append(rtypes, rtype.Dtype)
+	}
+	state, err := fun.aggregatorFactory(rtypes...)
+	if err != nil {
+		return nil, err
+	}
+	if fun.name == "percentile" && len(fun.args) == 2 {
+		quantile, err := quantileArgument(fun.args[1])
+		if err != nil {
+			return nil, err
+		}
+		if err := state.SetQuantile(quantile); err != nil {
+			return nil, err
+		}
+	}
+	return &Aggregator{fun: fun, state: state}, nil
+}
+
+// Update aggregates a batch of rows (columns read from a stripe, filtered by an optional filter),
+// each row goes into a group determined by its bucket, there are `ngroups` groups in total
+// (rows of global aggregations all go in a single group)
+func (agg *Aggregator) Update(buckets []uint64, ngroups int, columnData map[string]*column.Chunk, filter *bitmap.Bitmap) error {
+	// e.g. sum(1+foo) needs `1+foo` evaluated first, then we feed the resulting
+	// chunk to the sum aggregator
+	var child *column.Chunk
+	var err error
+	// in case we have e.g. `count()`, we cannot evaluate its children as there are none
+	if len(agg.fun.args) > 0 {
+		child, err = Evaluate(agg.fun.args[0], len(buckets), columnData, filter)
+		if err != nil {
+			return err
+		}
+	}
+	// FILTER (WHERE ...) narrows down rows to aggregate, but all the groups stay in place
+	if agg.fun.filter != nil {
+		cond, err := Evaluate(agg.fun.filter, len(buckets), columnData, filter)
+		if err != nil {
+			return err
+		}
+		truths, count := cond.TruthsCount()
+		if child != nil {
+			child = child.Prune(truths)
+		}
+		kept := make([]uint64, 0, count)
+		for j, bucket := range buckets {
+			if truths.Get(j) {
+				kept = append(kept, bucket)
+			}
+		}
+		buckets = kept
+	}
+	agg.state.AddChunk(buckets, ngroups, child)
+	return nil
+}
+
+// Mergeable reports whether states of this aggregation can be merged - all can, except for
+// DISTINCT aggregations other than count, min and max (they'd need to keep all their values)
+func (agg *Aggregator) Mergeable() bool {
+	return agg.state.Mergeable()
+}
+
+// Merge folds another state of the same function into this one, groups are matched by their
+// positions, the other state must not be used afterwards
+func (agg *Aggregator) Merge(other *Aggregator) error {
+	if agg.fun.String() != other.fun.String() {
+		return fmt.Errorf("%w: %v and %v", errAggregatorMismatch, agg.fun, other.fun)
+	}
+	return agg.state.Merge(other.state)
+}
+
+// MarshalBinary serialises this state, so that it can be stored (e.g. for each stripe) and merged
+// into other states later on, only approximate aggregations (approx_count_distinct) support this
+func (agg *Aggregator) MarshalBinary() ([]byte, error) {
+	return agg.state.MarshalBinary()
+}
+
+// UnmarshalBinary restores a state serialised by MarshalBinary, it needs to be a fresh state of
+// the same function (see NewAggregator)
+func (agg *Aggregator) UnmarshalBinary(data []byte) error {
+	return agg.state.UnmarshalBinary(data)
+}
+
+// Finalize computes the aggregates, one value per group
+func (agg *Aggregator) Finalize() (*column.Chunk, error) {
+	return agg.state.Resolve()
+}
+
+// Aggregator returns the state of an aggregating function, as initialised by InitAggregator
+// (and updated by UpdateAggregator), nil if there's none
+func (ex *Function) Aggregator() *Aggregator {
+	return ex.aggregator
+}
+
+// InitAggregator sets up a fresh state of an aggregating function (see Aggregator), expressions
+// containing it then evaluate to its aggregates
+func InitAggregator(fun *Function, schema column.TableSchema) error {
+	agg, err := NewAggregator(fun, schema)
+	if err != nil {
+		return err
+	}
+	fun.aggregator = agg
+	return nil
+}
+
+// UpdateAggregator updates the state of an aggregating function (see Aggregator.Update)
+func UpdateAggregator(fun *Function, buckets []uint64, ndistinct int, columnData map[string]*column.Chunk, filter *bitmap.Bitmap) error {
+	return fun.aggregator.Update(buckets, ndistinct, columnData, filter)
+}
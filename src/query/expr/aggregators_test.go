@@ -0,0 +1,98 @@
+package expr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestCombiningAggregators(t *testing.T) {
+	schema := column.TableSchema{{Name: "a", Dtype: column.DtypeInt}}
+	parts := []*column.Chunk{
+		column.NewChunkIntsFromSlice([]int64{1, 2, 3}, nil),
+		column.NewChunkIntsFromSlice([]int64{10, -4}, nil),
+		column.NewChunkIntsFromSlice([]int64{}, nil),
+	}
+	tests := []struct {
+		raw      string
+		expected *column.Chunk
+	}{
+		{"sum(a)", column.NewChunkIntsFromSlice([]int64{12}, nil)},
+		{"sum(a*2)", column.NewChunkIntsFromSlice([]int64{24}, nil)},
+		{"min(a)", column.NewChunkIntsFromSlice([]int64{-4}, nil)},
+		{"count()", column.NewChunkIntsFromSlice([]int64{5}, nil)},
+		{"avg(a)", column.NewChunkFloatsFromSlice([]float64{2.4}, nil)},
+		{"approx_count_distinct(a)", column.NewChunkIntsFromSlice([]int64{5}, nil)},
+	}
+	for _, test := range tests {
+		ex, err := ParseStringExpr(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fun := ex.(*Function)
+		total, err := NewAggregator(fun, schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each part gets aggregated on its own, as if it were a stripe aggregated elsewhere
+		for _, part := range parts {
+			partial, err := NewAggregator(fun, schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buckets := make([]uint64, part.Len())
+			if err := partial.Update(buckets, 1, map[string]*column.Chunk{"a": part}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := total.Merge(partial); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := total.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(got, test.expected) {
+			t.Errorf("expecting %v to combine into %v, got %v", test.raw, test.expected, got)
+		}
+		if fun.Aggregator() != nil {
+			t.Errorf("expecting detached aggregators not to affect %v", test.raw)
+		}
+	}
+}
+
+func TestInvalidAggregators(t *testing.T) {
+	schema := column.TableSchema{{Name: "a", Dtype: column.DtypeInt}, {Name: "b", Dtype: column.DtypeInt}}
+	newAggregator := func(raw string) (*Aggregator, error) {
+		ex, err := ParseStringExpr(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewAggregator(ex.(*Function), schema)
+	}
+	if _, err := newAggregator("coalesce(a, b)"); !errors.Is(err, errNotAggregating) {
+		t.Errorf("expecting projections not to have aggregators, got %v", err)
+	}
+	sumA, err := newAggregator("sum(a)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sumB, err := newAggregator("sum(b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sumA.Merge(sumB); !errors.Is(err, errAggregatorMismatch) {
+		t.Errorf("expecting states of different aggregations not to merge, got %v", err)
+	}
+	if _, err := sumA.MarshalBinary(); err == nil {
+		t.Error("expecting states of exact aggregations not to be serialisable")
+	}
+	distinct, err := newAggregator("sum(distinct a)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distinct.Mergeable() {
+		t.Error("expecting distinct sums not to be mergeable")
+	}
+}
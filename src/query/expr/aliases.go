@@ -0,0 +1,82 @@
+package expr
+
+import (
+	"strings"
+
+	"github.com/kokes/smda/src/column"
+)
+
+// aliased is a reference to a relabeled projection (e.g. `total` in `SELECT a+b AS total ... WHERE
+// total > 5`), it evaluates the projection's expression, but it keeps printing as the label, so
+// that lookups of GROUP BY expressions or plans are not affected
+type aliased struct {
+	label *Identifier
+	inner Expression
+}
+
+func (ex *aliased) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	schema, err := ex.inner.ReturnType(ts)
+	if err != nil {
+		return schema, err
+	}
+	schema.Name = ex.label.Name
+	return schema, nil
+}
+func (ex *aliased) String() string {
+	return ex.label.String()
+}
+func (ex *aliased) Children() []Expression {
+	return []Expression{ex.inner}
+}
+
+// ExpandAliases replaces identifiers referring to labels of relabeled projections by the expressions
+// they label, so that filters and groupings can refer to them. Names can refer to both a column
+// and a label, it's up to the caller to decide which takes precedence - filters get evaluated
+// before projections, so columns take precedence there (`SELECT a AS b FROM t WHERE b > 1` filters
+// on column b), while groupings refer to projections, so labels take precedence (`SELECT a AS b
+// FROM t GROUP BY b` groups by a). Like Fold, this edits the expression in place.
+func ExpandAliases(ex Expression, schema column.TableSchema, projections []Expression, columnsFirst bool) Expression {
+	switch node := ex.(type) {
+	case *Identifier:
+		if node.Name == "*" {
+			return ex
+		}
+		if _, err := node.ReturnType(schema); err == nil && columnsFirst {
+			return ex
+		}
+		for _, proj := range projections {
+			rel, ok := proj.(*Relabel)
+			if !ok {
+				continue
+			}
+			if rel.Label == node.Name || (!node.quoted && strings.ToLower(rel.Label) == node.Name) {
+				return &aliased{label: node, inner: rel.inner}
+			}
+		}
+	case *Parentheses:
+		node.inner = ExpandAliases(node.inner, schema, projections, columnsFirst)
+	case *Prefix:
+		node.right = ExpandAliases(node.right, schema, projections, columnsFirst)
+	case *NullTest:
+		node.inner = ExpandAliases(node.inner, schema, projections, columnsFirst)
+	case *Infix:
+		node.left = ExpandAliases(node.left, schema, projections, columnsFirst)
+		node.right = ExpandAliases(node.right, schema, projections, columnsFirst)
+	case *Function:
+		for j, arg := range node.args {
+			node.args[j] = ExpandAliases(arg, schema, projections, columnsFirst)
+		}
+		if node.filter != nil {
+			node.filter = ExpandAliases(node.filter, schema, projections, columnsFirst)
+		}
+	case *Tuple:
+		for j, el := range node.inner {
+			node.inner[j] = ExpandAliases(el, schema, projections, columnsFirst)
+		}
+	case *Relabel:
+		node.inner = ExpandAliases(node.inner, schema, projections, columnsFirst)
+	case *Ordering:
+		node.inner = ExpandAliases(node.inner, schema, projections, columnsFirst)
+	}
+	return ex
+}
@@ -0,0 +1,57 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestExpandingAliases(t *testing.T) {
+	schema := column.TableSchema{
+		{Name: "a", Dtype: column.DtypeInt},
+		{Name: "b", Dtype: column.DtypeInt},
+	}
+	projections, err := ParseStringExprs(`a+b AS total, a AS b, a*2 AS "Double"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		raw          string
+		columnsFirst bool
+		columns      []string // columns the expanded expression uses
+	}{
+		{"total > 5", true, []string{"a", "b"}},
+		{"TOTAL > 5", true, []string{"a", "b"}},
+		{`"Double" > 5`, true, []string{"a"}},
+		{"b > 5", true, []string{"b"}},
+		{"b > 5", false, []string{"a"}},
+		{"coalesce(total, b) > 5", true, []string{"a", "b"}},
+		{"a > 5", false, []string{"a"}},
+	}
+	for _, test := range tests {
+		ex, err := ParseStringExpr(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original := ex.String()
+		expanded := ExpandAliases(ex, schema, projections, test.columnsFirst)
+		if expanded.String() != original {
+			t.Errorf("expecting %v to print the same after expanding aliases, got %v", original, expanded)
+		}
+		if err := ResolveIdentifiers(schema, expanded); err != nil {
+			t.Errorf("expecting %v to resolve once aliases get expanded, got %v", test.raw, err)
+			continue
+		}
+		used := ColumnsUsed(expanded, schema)
+		if len(used) != len(test.columns) {
+			t.Errorf("expecting %v to use %v, got %v", test.raw, test.columns, used)
+			continue
+		}
+		for j, col := range used {
+			if col != test.columns[j] {
+				t.Errorf("expecting %v to use %v, got %v", test.raw, test.columns, used)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package expr
+
+import (
+	"fmt"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errInvalidComputedColumn = errs.New(errs.ErrBadRequest, "invalid computed column")
+
+func init() {
+	database.RegisterExpressionCompiler(compileComputedColumn)
+}
+
+// compileComputedColumn turns an expression in schema hints (e.g. `price * qty`) into a function
+// evaluating it for each stripe as it gets loaded
+func compileComputedColumn(expression string, schema column.TableSchema) (column.Schema, database.ComputeFunc, error) {
+	ex, err := ParseStringExpr(expression)
+	if err != nil {
+		return column.Schema{}, nil, err
+	}
+	aggs, err := AggExpr(ex)
+	if err != nil {
+		return column.Schema{}, nil, err
+	}
+	if len(aggs) > 0 || len(subqueries(ex)) > 0 {
+		return column.Schema{}, nil, fmt.Errorf("%w: aggregations and subqueries are not allowed", errInvalidComputedColumn)
+	}
+	if err := ResolveIdentifiers(schema, ex); err != nil {
+		return column.Schema{}, nil, err
+	}
+	ex = Fold(ex)
+	rt, err := ex.ReturnType(schema)
+	if err != nil {
+		return column.Schema{}, nil, err
+	}
+	if rt.Dtype == column.DtypeNull {
+		return column.Schema{}, nil, fmt.Errorf("%w: expressions cannot be all null", errInvalidComputedColumn)
+	}
+	compute := func(columns map[string]*column.Chunk, length int) (*column.Chunk, error) {
+		return Evaluate(ex, length, columns, nil)
+	}
+	return rt, compute, nil
+}
@@ -1,17 +1,17 @@
 package expr
 
 import (
-	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/kokes/smda/src/bitmap"
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errQueryPatternNotSupported = errors.New("query pattern not supported")
-var errFunctionNotImplemented = errors.New("function not implemented")
-var errDivisionByZero = errors.New("division by zero") // TODO/ARCH: hint that we can use NULLIF?
+var errQueryPatternNotSupported = errs.New(errs.ErrBadRequest, "query pattern not supported")
+var errFunctionNotImplemented = errs.New(errs.ErrBadRequest, "function not implemented")
+var errDivisionByZero = errs.New(errs.ErrBadRequest, "division by zero") // TODO/ARCH: hint that we can use NULLIF?
 
 // OPTIM: we're doing a lot of type shenanigans at runtime - when we evaluate a function on each stripe, we do
 // the same tree of operations - this applies not just here, but in projections.go as well - e.g. we know that
@@ -20,7 +20,7 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 	// TODO: test this via UpdateAggregator
 	if f, ok := expr.(*Function); ok && f.aggregator != nil {
 		// TODO: assert that filters !== nil?
-		return f.aggregator.Resolve()
+		return f.aggregator.Finalize()
 	}
 
 	switch node := expr.(type) {
@@ -38,7 +38,7 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 			// noop
 			return Evaluate(node.right, chunkLength, columnData, filter)
 		case tokenSub:
-			// OPTIM: this whole block will benefit from constant folding, especially if the child is a literal int/float
+			// literals (e.g. `-3`) get folded beforehand (see Fold), OPTIM: columns could be negated without a multiplication
 			newExpr := &Infix{
 				operator: tokenMul,
 				left:     &Integer{value: -1},
@@ -75,6 +75,11 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 		return column.NewChunkLiteralStrings(node.value, chunkLength), nil
 	case *Null:
 		return column.NewChunkLiteralTyped("", column.DtypeNull, chunkLength)
+	case *Placeholder:
+		if node.value == nil {
+			return nil, fmt.Errorf("%w: parameter %v", errUnboundPlaceholder, node.position)
+		}
+		return Evaluate(node.value, chunkLength, columnData, filter)
 	case *Function:
 		// OPTIM: we could optimise shallow function calls - e.g. `log(foo) > 1` doesn't need
 		// `log(foo)` as a newly allocated chunk, we can compute that on the fly
@@ -93,7 +98,60 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 		return node.evaler(children...)
 	case *Relabel:
 		return Evaluate(node.inner, chunkLength, columnData, filter)
+	case *NullTest:
+		inner, err := Evaluate(node.inner, chunkLength, columnData, filter)
+		if err != nil {
+			return nil, err
+		}
+		return column.EvalIsNull(inner, node.negated), nil
+	case *constant:
+		return node.value.LiteralOfLength(chunkLength), nil
+	case *simplified:
+		return Evaluate(node.inner, chunkLength, columnData, filter)
+	case *aliased:
+		return Evaluate(node.inner, chunkLength, columnData, filter)
+	case *Interval:
+		return nil, errIntervalArithmetic
+	case *Subquery:
+		if node.value == nil {
+			return nil, fmt.Errorf("%w: %v", errUnresolvedSubquery, node)
+		}
+		// the value may be null, so it cannot be a literal, we repeat it instead
+		return node.value.Reorder(make([]int, chunkLength)), nil
 	case *Infix:
+		if node.operator == tokenIn {
+			var set *column.ValueSet
+			switch right := node.right.(type) {
+			case *Subquery:
+				if right.set == nil {
+					return nil, fmt.Errorf("%w: %v", errUnresolvedSubquery, right)
+				}
+				set = right.set
+			case *Tuple:
+				var err error
+				if set, err = right.valueSet(); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("%w: IN clauses need a tuple or a subquery, got %v", errQueryPatternNotSupported, node.right)
+			}
+			inner, err := Evaluate(node.left, chunkLength, columnData, filter)
+			if err != nil {
+				return nil, err
+			}
+			return column.EvalIn(inner, set)
+		}
+		if operand, iv, ok := node.intervalOperands(); ok {
+			inner, err := Evaluate(operand, chunkLength, columnData, filter)
+			if err != nil {
+				return nil, err
+			}
+			interval := iv.value
+			if node.operator == tokenSub {
+				interval = interval.Negate()
+			}
+			return column.EvalAddInterval(inner, interval)
+		}
 		c1, err := Evaluate(node.left, chunkLength, columnData, filter)
 		if err != nil {
 			return nil, err
@@ -176,6 +234,14 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 			return column.EvalGt(c1, c2)
 		case tokenGte:
 			return column.EvalGte(c1, c2)
+		case tokenLike:
+			return column.EvalLike(c1, c2)
+		case tokenIlike:
+			return column.EvalIlike(c1, c2)
+		case tokenRegex:
+			return node.regexp.Match(c1, c2, false)
+		case tokenIregex:
+			return node.regexp.Match(c1, c2, true)
 		case tokenAdd:
 			return column.EvalAdd(c1, c2)
 		case tokenSub:
@@ -187,8 +253,7 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 			if err != nil {
 				return nil, err
 			}
-			zeros := eq.Truths()
-			if zeros.Count() > 0 {
+			if _, zeros := eq.TruthsCount(); zeros > 0 {
 				return nil, errDivisionByZero
 			}
 			return column.EvalDivide(c1, c2)
@@ -201,22 +266,3 @@ func Evaluate(expr Expression, chunkLength int, columnData map[string]*column.Ch
 		return nil, fmt.Errorf("expression %v not supported: %w", expr, errQueryPatternNotSupported)
 	}
 }
-
-func UpdateAggregator(fun *Function, buckets []uint64, ndistinct int, columnData map[string]*column.Chunk, filter *bitmap.Bitmap) error {
-	// if expr.aggregator == nil {err}
-	// if len(expr.children) != 1 {err}// what about count()?
-
-	// e.g. sum(1+foo) needs `1+foo` evaluated first, then we feed the resulting
-	// chunk to the sum aggregator
-	var child *column.Chunk
-	var err error
-	// in case we have e.g. `count()`, we cannot evaluate its children as there are none
-	if len(fun.args) > 0 {
-		child, err = Evaluate(fun.args[0], len(buckets), columnData, filter)
-		if err != nil {
-			return err
-		}
-	}
-	fun.aggregator.AddChunk(buckets, ndistinct, child)
-	return nil
-}
@@ -80,7 +80,13 @@ func TestBasicEval(t *testing.T) {
 		{"NULL = foo123n", column.DtypeBool, 3, "f,t,f", nil},
 		{"foo123n IS NULL", column.DtypeBool, 3, "f,t,f", nil},
 		{"foo123n != NULL", column.DtypeBool, 3, "t,f,t", nil},
-		// {"foo123n IS NOT NULL", column.DtypeBool, 3, "t,f,t", nil}, // uncomment once implemented in the parser properly
+		{"foo123n IS NOT NULL", column.DtypeBool, 3, "t,f,t", nil},
+		{"foo123 IS NULL", column.DtypeBool, 3, "f,f,f", nil},
+		{"foo123 IS NOT NULL", column.DtypeBool, 3, "t,t,t", nil},
+		{"(foo123n + 1) IS NULL", column.DtypeBool, 3, "f,t,f", nil},
+		{"NULL IS NULL", column.DtypeBool, 3, "lit:t", nil},
+		{"3 IS NULL", column.DtypeBool, 3, "lit:f", nil},
+		{"3 IS NOT NULL", column.DtypeBool, 3, "lit:t", nil},
 		// NULL and literals
 		{"3 = NULL", column.DtypeBool, 3, ",,", nil},
 		{"3 != NULL", column.DtypeBool, 3, ",,", nil},
@@ -126,6 +132,42 @@ func TestBasicEval(t *testing.T) {
 		{"str_foo != str_foo", column.DtypeBool, 3, "f,f,f", nil},
 		{"str_foo = 'o'", column.DtypeBool, 3, "f,t,t", nil},
 		{"str_foo != 'f'", column.DtypeBool, 3, "f,t,t", nil},
+		{"names LIKE 'Jo%'", column.DtypeBool, 3, "t,f,f", nil},
+		{"names LIKE '%ej'", column.DtypeBool, 3, "f,t,f", nil},
+		{"names LIKE 'B_b'", column.DtypeBool, 3, "f,f,t", nil},
+		{"names LIKE 'b%'", column.DtypeBool, 3, "f,f,f", nil},
+		{"names ILIKE 'b%'", column.DtypeBool, 3, "f,f,t", nil},
+		{"names ILIKE '%Ř%'", column.DtypeBool, 3, "f,t,f", nil},
+		{"names NOT LIKE 'Jo%'", column.DtypeBool, 3, "f,t,t", nil},
+		{"names NOT ILIKE '%O%'", column.DtypeBool, 3, "f,f,f", nil},
+		{"'foo' LIKE 'f%'", column.DtypeBool, 3, "lit:t", nil},
+		{"NULL LIKE 'f%'", column.DtypeBool, 3, ",,", nil},
+		{"names ~ '^Jo'", column.DtypeBool, 3, "t,f,f", nil},
+		{"names ~ 'd.*j$'", column.DtypeBool, 3, "f,t,f", nil},
+		{"names ~ '^b'", column.DtypeBool, 3, "f,f,f", nil},
+		{"names ~* '^b'", column.DtypeBool, 3, "f,f,t", nil},
+		{"NOT (names ~ '^Jo')", column.DtypeBool, 3, "f,t,t", nil},
+		{"'foo' ~ 'o+$'", column.DtypeBool, 3, "lit:t", nil},
+		{"regexp_matches(names, 'ř')", column.DtypeBool, 3, "f,t,f", nil},
+		{"regexp_matches(names, '^BO', 'i')", column.DtypeBool, 3, "f,f,t", nil},
+		{"regexp_matches(names, '^BO', 'ic')", column.DtypeBool, 3, "f,f,f", nil},
+
+		// IN lists
+		{"foo123 IN (1, 3)", column.DtypeBool, 3, "t,f,t", nil},
+		{"foo123 IN (1 + 1, 4)", column.DtypeBool, 3, "f,t,f", nil},
+		{"foo123 IN (1.0, 2.5)", column.DtypeBool, 3, "t,f,f", nil},
+		{"foo123 IN (1, 2.5)", column.DtypeBool, 3, "t,f,f", nil},
+		{"float123 IN (2, 3)", column.DtypeBool, 3, "f,t,t", nil},
+		{"foo123n IN (1, 2)", column.DtypeBool, 3, "t,,f", nil},
+		{"foo123 IN (1, NULL)", column.DtypeBool, 3, "t,,", nil},
+		{"foo123 NOT IN (1, NULL)", column.DtypeBool, 3, "f,,", nil},
+		{"foo123 IN (NULL)", column.DtypeBool, 3, ",,", nil},
+		{"NULL IN (1, 2)", column.DtypeBool, 3, ",,", nil},
+		{"names IN ('Bob', 'Joe', 'joe')", column.DtypeBool, 3, "t,f,t", nil},
+		{"names NOT IN ('Bob')", column.DtypeBool, 3, "t,t,f", nil},
+		{"str_foo IN ('o', NULL)", column.DtypeBool, 3, ",t,t", nil},
+		{"bool_tff IN (true)", column.DtypeBool, 3, "t,f,f", nil},
+		{"foo123 IN (foo123, 2)", column.DtypeInvalid, 0, "", errTupleNotConstant},
 
 		// all literals
 		{"(foo123 > 0) AND (2 >= 1)", column.DtypeBool, 3, "t,t,t", nil},
@@ -179,6 +221,57 @@ func TestBasicEval(t *testing.T) {
 		{"split_part(names, 'o', 1)", column.DtypeString, 3, "J,,B", nil},
 		{"split_part(names, 'o', 2)", column.DtypeString, 3, "e,,b", nil},
 		{"split_part(names, 'o', 3)", column.DtypeString, 3, ",,", nil},
+		{"concat(names, '-', str_foo)", column.DtypeString, 3, "Joe-f,Ondřej-o,Bob-o", nil},
+		{"concat(names)", column.DtypeString, 3, "Joe,Ondřej,Bob", nil},
+		{"concat(names, null, names)", column.DtypeString, 3, "JoeJoe,OndřejOndřej,BobBob", nil},
+		{"concat('foo', 'bar')", column.DtypeString, 3, "lit:foobar", nil},
+		{"replace(names, 'o', '0')", column.DtypeString, 3, "J0e,Ondřej,B0b", nil},
+		{"replace(names, 'ř', 'r')", column.DtypeString, 3, "Joe,Ondrej,Bob", nil},
+		{"replace(names, names, str_foo)", column.DtypeString, 3, "f,o,o", nil},
+		{"replace('foo', 'o', '')", column.DtypeString, 3, "lit:f", nil},
+		{"length(names)", column.DtypeInt, 3, "3,6,3", nil}, // characters, not bytes
+		{"length(str_foo)", column.DtypeInt, 3, "1,1,1", nil},
+		{"length('')", column.DtypeInt, 3, "lit:0", nil},
+		{"substr(names, 2)", column.DtypeString, 3, "oe,ndřej,ob", nil},
+		{"substr(names, 2, 3)", column.DtypeString, 3, "oe,ndř,ob", nil},
+		{"substr(names, 0, 2)", column.DtypeString, 3, "J,O,B", nil},
+		{"substr(names, -3, 5)", column.DtypeString, 3, "J,O,B", nil},
+		{"substr(names, 5, 2)", column.DtypeString, 3, ",ej,", nil},
+		{"substr(names, 1, 0)", column.DtypeString, 3, ",,", nil},
+		{"substr('Ondřej', 4, 1)", column.DtypeString, 3, "lit:ř", nil},
+		// dates and times
+		{"date_trunc('month', dates)", column.DtypeDate, 3, "2020-02-01,2021-01-01,1999-12-01", nil},
+		{"date_trunc('year', dates)", column.DtypeDate, 3, "2020-01-01,2021-01-01,1999-01-01", nil},
+		{"date_trunc('week', dates)", column.DtypeDate, 3, "2020-02-24,2021-01-25,1999-12-27", nil},
+		{"date_trunc('hour', datetimes)", column.DtypeDatetime, 3, "2020-02-29 12:00:00,2021-01-31 00:00:00,1999-12-31 23:00:00", nil},
+		{"date_trunc('day', datetimes)", column.DtypeDatetime, 3, "2020-02-29 00:00:00,2021-01-31 00:00:00,1999-12-31 00:00:00", nil},
+		{"date_part('year', dates)", column.DtypeInt, 3, "2020,2021,1999", nil},
+		{"extract(month from dates)", column.DtypeInt, 3, "2,1,12", nil},
+		{"extract(dow from dates)", column.DtypeInt, 3, "6,0,5", nil},
+		{"extract(doy from dates)", column.DtypeInt, 3, "60,31,365", nil},
+		{"extract(minute from datetimes)", column.DtypeInt, 3, "34,0,59", nil},
+		{"extract(epoch from datetimes)", column.DtypeInt, 3, "1582979696,1612051200,946684799", nil},
+		{"date_diff('day', dates, datetimes)", column.DtypeInt, 3, "0,0,0", nil},
+		{"date_diff('minute', dates, datetimes)", column.DtypeInt, 3, "754,0,1439", nil},
+		{"date_diff('month', dates, date_trunc('year', dates))", column.DtypeInt, 3, "-1,0,-11", nil},
+		// casting
+		{"cast(foo123 as string)", column.DtypeString, 3, "1,2,3", nil},
+		{"cast(foo123n as float)", column.DtypeFloat, 3, "1,,3", nil},
+		{"cast('12' as int)", column.DtypeInt, 3, "lit:12", nil},
+		{"cast(datetimes as date)", column.DtypeDate, 3, "2020-02-29,2021-01-31,1999-12-31", nil},
+		{"cast(dates as datetime)", column.DtypeDatetime, 3, "2020-02-29 00:00:00,2021-01-31 00:00:00,1999-12-31 00:00:00", nil},
+		{"cast(bool_tff as string)", column.DtypeString, 3, "true,false,false", nil},
+		{"toint(float1p452p13p0)", column.DtypeInt, 3, ",,3", nil}, // only whole floats convert
+		{"toint(names)", column.DtypeInt, 3, ",,", nil},
+		{"tofloat('1.5')", column.DtypeFloat, 3, "lit:1.5", nil},
+		{"toint('foo')", column.DtypeInt, 3, ",,", nil},
+		{"tostring(float123)", column.DtypeString, 3, "1,2,3", nil},
+		{"todate(datetimes)", column.DtypeDate, 3, "2020-02-29,2021-01-31,1999-12-31", nil},
+		{"dates + interval '1 day'", column.DtypeDate, 3, "2020-03-01,2021-02-01,2000-01-01", nil},
+		{"dates - interval '1 month'", column.DtypeDate, 3, "2020-01-29,2020-12-31,1999-11-30", nil},
+		{"interval '1 month' + dates", column.DtypeDate, 3, "2020-03-29,2021-02-28,2000-01-31", nil},
+		{"dates + interval '1 hour'", column.DtypeDatetime, 3, "2020-02-29 01:00:00,2021-01-31 01:00:00,1999-12-31 01:00:00", nil},
+		{"datetimes - interval '1 minute 30 seconds'", column.DtypeDatetime, 3, "2020-02-29 12:33:26,2021-01-30 23:58:30,1999-12-31 23:58:29", nil},
 	}
 
 	db, err := database.NewDatabase("", nil)
@@ -203,6 +296,8 @@ func TestBasicEval(t *testing.T) {
 		"bool_ftf":        {"f", "t", "f"},
 		"str_foo":         {"f", "o", "o"},
 		"names":           {"Joe", "Ondřej", "Bob"},
+		"dates":           {"2020-02-29", "2021-01-31", "1999-12-31"},
+		"datetimes":       {"2020-02-29 12:34:56", "2021-01-31 00:00:00", "1999-12-31 23:59:59"},
 		"names_ws": {"		joe ", "jane	", " bob "},
 	})
 	if err != nil {
@@ -240,6 +335,21 @@ func TestBasicEval(t *testing.T) {
 		if !column.ChunksEqual(res, expected) {
 			t.Errorf("%vth test: expected expression %+v to result in\n\t%+v, got\n\t%+v instead", j+1, test.expr, expected, res)
 		}
+
+		// constant folding must not change results
+		folded, err := ParseStringExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		folded = Fold(folded)
+		fres, err := Evaluate(folded, test.outputLength, coldata, nil)
+		if err != nil {
+			t.Errorf("failed to evaluate folded %v: %v", test.expr, err)
+			continue
+		}
+		if !column.ChunksEqual(fres, expected) {
+			t.Errorf("%vth test: expected folded expression %+v to result in\n\t%+v, got\n\t%+v instead", j+1, test.expr, expected, fres)
+		}
 	}
 }
 
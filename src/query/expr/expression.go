@@ -1,17 +1,23 @@
 package expr
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errNoNestedAggregations = errors.New("cannot nest aggregations (e.g. sum(min(a)))")
-var errTypeMismatch = errors.New("expecting compatible types")
+var errNoNestedAggregations = errs.New(errs.ErrBadRequest, "cannot nest aggregations (e.g. sum(min(a)))")
+var errTypeMismatch = errs.New(errs.ErrBadRequest, "expecting compatible types")
 var errNoTypes = errors.New("expecting at least one column")
+var errParameterCount = errs.New(errs.ErrBadRequest, "number of parameters does not match the number of placeholders")
+var errParameterType = errs.New(errs.ErrBadRequest, "unsupported parameter type")
 
 type Expression interface {
 	ReturnType(ts column.TableSchema) (column.Schema, error)
@@ -38,15 +44,68 @@ func PruneFunctionCalls(ex Expression) {
 //    to the Query struct (the Unmarshaler should mostly take care of this)
 // 4) The HTML/JS frontend needs to incorporate this in some way
 type Query struct {
+	// common table expressions (WITH clauses), these run before the query itself and it can then
+	// read their results as if they were datasets, each of them can read those before it
+	With      []CommonTable
 	Select    []Expression
 	Dataset   *Dataset
 	Filter    Expression
 	Aggregate []Expression
 	Order     []Expression
 	Limit     *int
+	// rows skipped before LIMIT applies, without ORDER BY, these are given by the order of stripes
+	Offset *int
+	// EXPLAIN queries don't get executed, they only report how they would be
+	Explain bool
+	// UNION ALL parts, their results get appended to ours
+	// ARCH: ORDER BY and LIMIT clauses apply to individual parts, not to the whole union
+	Union []Query
+	// TABLESAMPLE clauses only let a random subset of the dataset into the query
+	Sample *Sample
+	// timezone datetimes get evaluated (and rendered) in, they are in UTC if this is nil
+	// (see SetTimezone)
+	Timezone *time.Location
 	// TODO: PAFilter (post-aggregation filter, == having) - check how it behaves without aggregations elsewhere
 }
 
+// CommonTable is a named query in a WITH clause, e.g. `WITH totals AS (SELECT ...)`
+type CommonTable struct {
+	Name  string
+	Query Query
+}
+
+// SampleMethod determines how we sample data in TABLESAMPLE clauses
+type SampleMethod uint8
+
+const (
+	// SampleBernoulli includes each row with a given probability, so we still read all the data
+	SampleBernoulli SampleMethod = iota
+	// SampleSystem includes whole stripes with a given probability, so it's fast (we don't read
+	// stripes that are not selected), but it's less random, because rows are sampled in blocks
+	SampleSystem
+)
+
+func (sm SampleMethod) String() string {
+	return []string{"BERNOULLI", "SYSTEM"}[sm]
+}
+
+// Sample describes a TABLESAMPLE clause, e.g. `TABLESAMPLE BERNOULLI (10) REPEATABLE (42)`
+type Sample struct {
+	Method SampleMethod
+	// percentage of rows (or stripes) to be sampled, between 0 and 100
+	Percent float64
+	// sampling is random unless a seed is given (via REPEATABLE)
+	Seed *int64
+}
+
+func (s *Sample) String() string {
+	ret := fmt.Sprintf("TABLESAMPLE %v (%v)", s.Method, strconv.FormatFloat(s.Percent, 'g', -1, 64))
+	if s.Seed != nil {
+		ret += fmt.Sprintf(" REPEATABLE (%d)", *s.Seed)
+	}
+	return ret
+}
+
 // ARCH/TODO(go1.18?): use strings.Join(slices.Map(...)) with generics
 func stringifyExpressions(exprs []Expression) string {
 	svar := make([]string, 0, len(exprs))
@@ -60,6 +119,20 @@ func stringifyExpressions(exprs []Expression) string {
 // this stringer is tested in the parser
 func (q Query) String() string {
 	var sb strings.Builder
+	if q.Explain {
+		sb.WriteString("EXPLAIN ")
+	}
+	for j, cte := range q.With {
+		if j == 0 {
+			sb.WriteString("WITH ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("%s AS (%s)", cte.Name, cte.Query))
+	}
+	if len(q.With) > 0 {
+		sb.WriteString(" ")
+	}
 	sb.WriteString(fmt.Sprintf("SELECT %s", stringifyExpressions(q.Select)))
 	// ARCH: preparing for queries without FROM clauses
 	if q.Dataset != nil {
@@ -67,6 +140,9 @@ func (q Query) String() string {
 		if q.Dataset.alias != nil {
 			sb.WriteString(fmt.Sprintf(" AS %v", q.Dataset.alias))
 		}
+		if q.Sample != nil {
+			sb.WriteString(fmt.Sprintf(" %v", q.Sample))
+		}
 	}
 	if q.Filter != nil {
 		sb.WriteString(fmt.Sprintf(" WHERE %s", q.Filter))
@@ -80,27 +156,186 @@ func (q Query) String() string {
 	if q.Limit != nil {
 		sb.WriteString(fmt.Sprintf(" LIMIT %d", *q.Limit))
 	}
+	if q.Offset != nil {
+		sb.WriteString(fmt.Sprintf(" OFFSET %d", *q.Offset))
+	}
+	for _, part := range q.Union {
+		sb.WriteString(fmt.Sprintf(" UNION ALL %s", part))
+	}
 
 	return sb.String()
 }
 
-func InitAggregator(fun *Function, schema column.TableSchema) error {
-	var rtypes []column.Dtype
-	for _, ch := range fun.args {
-		rtype, err := ch.ReturnType(schema)
+func placeholders(exprs ...Expression) []*Placeholder {
+	var ret []*Placeholder
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		if ph, ok := expr.(*Placeholder); ok {
+			ret = append(ret, ph)
+		}
+		if sq, ok := expr.(*Subquery); ok {
+			ret = append(ret, sq.Query.placeholders()...)
+		}
+		ret = append(ret, placeholders(expr.Children()...)...)
+	}
+	return ret
+}
+
+// literalFromValue converts a query parameter to a literal expression, we support native Go
+// types as well as json.Number (to preserve integers from JSON payloads)
+func literalFromValue(val interface{}) (Expression, error) {
+	switch v := val.(type) {
+	case nil:
+		return &Null{}, nil
+	case bool:
+		return &Bool{value: v}, nil
+	case int:
+		return &Integer{value: int64(v)}, nil
+	case int32:
+		return &Integer{value: int64(v)}, nil
+	case int64:
+		return &Integer{value: v}, nil
+	case float32:
+		return &Float{value: float64(v)}, nil
+	case float64:
+		return &Float{value: v}, nil
+	case string:
+		return &String{value: v}, nil
+	case json.Number:
+		if iv, err := v.Int64(); err == nil {
+			return &Integer{value: iv}, nil
+		}
+		fv, err := v.Float64()
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("%w: %v", errParameterType, v)
 		}
-		rtypes = append(rtypes, rtype.Dtype)
+		return &Float{value: fv}, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", errParameterType, val)
+	}
+}
+
+// placeholders are numbered across all the parts of a union (and its common tables)
+func (q *Query) placeholders() []*Placeholder {
+	var phs []*Placeholder
+	for j := range q.With {
+		phs = append(phs, q.With[j].Query.placeholders()...)
+	}
+	exprs := make([]Expression, 0, len(q.Select)+len(q.Aggregate)+len(q.Order)+1)
+	exprs = append(exprs, q.Select...)
+	exprs = append(exprs, q.Filter)
+	exprs = append(exprs, q.Aggregate...)
+	exprs = append(exprs, q.Order...)
+	phs = append(phs, placeholders(exprs...)...)
+	for j := range q.Union {
+		phs = append(phs, q.Union[j].placeholders()...)
 	}
-	aggregator, err := fun.aggregatorFactory(rtypes...)
-	if err != nil {
-		return err
+	return phs
+}
+
+// Subqueries lists all subqueries in a query's clauses (but not in its union parts, common tables
+// or in other subqueries, these get resolved when those queries run)
+func (q *Query) Subqueries() []*Subquery {
+	exprs := make([]Expression, 0, len(q.Select)+len(q.Aggregate)+len(q.Order)+1)
+	exprs = append(exprs, q.Select...)
+	exprs = append(exprs, q.Filter)
+	exprs = append(exprs, q.Aggregate...)
+	exprs = append(exprs, q.Order...)
+	return subqueries(exprs...)
+}
+
+func subqueries(exprs ...Expression) []*Subquery {
+	var ret []*Subquery
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		if sq, ok := expr.(*Subquery); ok {
+			ret = append(ret, sq)
+		}
+		ret = append(ret, subqueries(expr.Children()...)...)
+	}
+	return ret
+}
+
+// Bind assigns values to placeholders (`?`) in a query, in the order they appear in the query
+func (q *Query) Bind(params ...interface{}) error {
+	phs := q.placeholders()
+	if len(phs) != len(params) {
+		return fmt.Errorf("%w: expecting %v, got %v", errParameterCount, len(phs), len(params))
+	}
+	for _, ph := range phs {
+		value, err := literalFromValue(params[ph.position-1])
+		if err != nil {
+			return err
+		}
+		ph.value = value
 	}
-	fun.aggregator = aggregator
 	return nil
 }
 
+// SetTimezone makes a query (including its union parts, common tables and subqueries) evaluate datetimes
+// in a given timezone, all the functions that depend on timezones get swapped for their variants (see
+// column.TimezoneFunc)
+func (q *Query) SetTimezone(loc *time.Location) {
+	q.Timezone = loc
+	for j := range q.With {
+		q.With[j].Query.SetTimezone(loc)
+	}
+	exprs := make([]Expression, 0, len(q.Select)+len(q.Aggregate)+len(q.Order)+1)
+	exprs = append(exprs, q.Select...)
+	exprs = append(exprs, q.Filter)
+	exprs = append(exprs, q.Aggregate...)
+	exprs = append(exprs, q.Order...)
+	setTimezone(loc, exprs...)
+	for j := range q.Union {
+		q.Union[j].SetTimezone(loc)
+	}
+}
+
+func setTimezone(loc *time.Location, exprs ...Expression) {
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		switch node := expr.(type) {
+		case *Function:
+			if evaler, ok := column.TimezoneFunc(node.name, loc); ok {
+				node.evaler = evaler
+			}
+		case *Subquery:
+			node.Query.SetTimezone(loc)
+		}
+		setTimezone(loc, expr.Children()...)
+	}
+}
+
+// quantileArgument extracts the quantile in percentile(expr, quantile), it needs to be a numeric
+// constant (a literal, a parameter bound to one or e.g. `1-0.05`), because it's the same for all
+// the rows aggregated
+func quantileArgument(ex Expression) (float64, error) {
+	if ph, ok := ex.(*Placeholder); ok && ph.value != nil {
+		ex = ph.value
+	}
+	if isConstant(ex) {
+		ex = Fold(ex)
+	}
+	switch lit := ex.(type) {
+	case *Integer:
+		return float64(lit.value), nil
+	case *Float:
+		return lit.value, nil
+	case *constant:
+		if dt := lit.value.Dtype(); dt == column.DtypeInt || dt == column.DtypeFloat {
+			value, _ := lit.value.JSONLiteral(0)
+			return strconv.ParseFloat(value, 64)
+		}
+	}
+	return 0, fmt.Errorf("%w: quantile needs to be a numeric constant, got %v", errWrongArgumentType, ex)
+}
+
 func AggExpr(expr Expression) ([]*Function, error) {
 	var ret []*Function
 	found := false
@@ -125,12 +360,16 @@ func AggExpr(expr Expression) ([]*Function, error) {
 	return ret, nil
 }
 
+func isNumericType(dt column.Dtype) bool {
+	return dt == column.DtypeInt || dt == column.DtypeFloat || dt == column.DtypeDecimal
+}
+
 // should this be in the database package?
 func comparableTypes(t1, t2 column.Dtype) bool {
 	if t1 == t2 {
 		return true
 	}
-	if (t1 == column.DtypeFloat && t2 == column.DtypeInt) || (t2 == column.DtypeFloat && t1 == column.DtypeInt) {
+	if isNumericType(t1) && isNumericType(t2) {
 		return true
 	}
 	// we can compare 1=null or do 4+null
@@ -192,8 +431,32 @@ func HasIdentifiers(expr Expression) bool {
 	return false
 }
 
+// IsDeterministic tells us if an expression always yields the same results given the same data
+// (e.g. `now()` doesn't), which is what allows us to cache query results
+func IsDeterministic(expr Expression) bool {
+	if fun, ok := expr.(*Function); ok && fun.name == "now" {
+		return false
+	}
+	for _, ch := range expr.Children() {
+		if !IsDeterministic(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsRowCount tells us if an expression is a plain `count()` (or `count(*)`, possibly relabelled),
+// without arguments or filters, it then only depends on the number of rows, not on any data
+func IsRowCount(expr Expression) bool {
+	if rel, ok := expr.(*Relabel); ok {
+		expr = rel.inner
+	}
+	fun, ok := expr.(*Function)
+	return ok && fun.name == "count" && len(fun.args) == 0 && fun.filter == nil && !fun.distinct
+}
+
 // ARCH: this panics when a given column is not in the schema, but since we already validated
-// this schema during the ReturnType call, we should be fine. It's still a bit worrying that
+// this schema (see ResolveIdentifiers), we should be fine. It's still a bit worrying that
 // we might panic though.
 // TODO(next)/TODO(joins): all the columnsUsed functions need to support multiple schemas and namespaces
 // perhaps we should return []*Identifier, that would solve a few other issues as well
@@ -227,3 +490,48 @@ func ColumnsUsedMultiple(schema column.TableSchema, exprs ...Expression) []strin
 	sort.Strings(cols)
 	return dedupeSortedStrings(cols)
 }
+
+// LengthOnlyColumns returns string columns used in given expressions only to determine lengths or nullity
+// of their values (`length(foo)`, `foo IS NULL`), these don't need their contents to be read from disk
+func LengthOnlyColumns(schema column.TableSchema, exprs ...Expression) []string {
+	lengthOnly := make(map[string]bool)
+	var walk func(Expression)
+	walk = func(ex Expression) {
+		var inner Expression
+		switch node := ex.(type) {
+		case *Identifier:
+			lengthOnly[ColumnsUsed(node, schema)[0]] = false
+			return
+		case *Function:
+			if node.name == "length" && len(node.args) == 1 {
+				inner = node.args[0]
+			}
+		case *NullTest:
+			inner = node.inner
+		}
+		if idf, ok := inner.(*Identifier); ok {
+			name := ColumnsUsed(idf, schema)[0]
+			if _, ok := lengthOnly[name]; !ok {
+				lengthOnly[name] = true
+			}
+			return
+		}
+		for _, ch := range ex.Children() {
+			walk(ch)
+		}
+	}
+	for _, expr := range exprs {
+		walk(expr)
+	}
+	var cols []string
+	for name, ok := range lengthOnly {
+		if !ok {
+			continue
+		}
+		if _, col, err := schema.LocateColumn(name); err == nil && col.Dtype == column.DtypeString {
+			cols = append(cols, name)
+		}
+	}
+	sort.Strings(cols)
+	return cols
+}
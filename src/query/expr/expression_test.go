@@ -1,6 +1,7 @@
 package expr
 
 import (
+	"encoding/json"
 	"errors"
 	"reflect"
 	"strings"
@@ -29,6 +30,7 @@ func TestAggExpr(t *testing.T) {
 		{"min(5*min(a))", nil, errNoNestedAggregations},
 		{"sum(max(b))", nil, errNoNestedAggregations},
 		{"1-sum(nullif(foo, max(bar)))", nil, errNoNestedAggregations},
+		{"sum(a) filter (where max(b) > 1)", nil, errNoNestedAggregations},
 	}
 	for _, test := range tests {
 		expr, err := ParseStringExpr(test.raw)
@@ -68,12 +70,19 @@ func TestExprStringer(t *testing.T) {
 		{"1+2*3 as bar", "1+2*3 AS bar"},
 		// these are the only three infix operators that have spaces around the op
 		{"foo is bar", "foo IS bar"},
+		{"foo is null", "foo IS NULL"},
+		{"foo is NOT null", "foo IS NOT NULL"},
 		{"foo and bar", "foo AND bar"},
 		{"foo or bar", "foo OR bar"},
 		// ... and these do not (not exhaustive)
 		{"foo=bar", "foo=bar"},
 		{"foo > bar", "foo>bar"},
 		{"foo <= bar", "foo<=bar"},
+		{"foo + interval '7 days'", "foo+INTERVAL '7 days'"},
+		{"extract(YEAR from foo)", "date_part('year', foo)"},
+		{"cast(foo as INTEGER)", "CAST(foo AS int)"},
+		{"sum(foo) filter (where bar > 3)", "sum(foo) FILTER (WHERE bar>3)"},
+		{"CAST(foo + 1 AS text)", "CAST(foo+1 AS string)"},
 	}
 
 	for _, test := range tests {
@@ -222,6 +231,44 @@ func TestColumnsUsedVarargs(t *testing.T) {
 	}
 }
 
+func TestLengthOnlyColumns(t *testing.T) {
+	tests := []struct {
+		rawExprs   []string
+		lengthOnly []string
+	}{
+		{[]string{"length(foo)"}, []string{"foo"}},
+		{[]string{"length(foo) > 3", "bar IS NOT NULL"}, []string{"bar", "foo"}},
+		{[]string{"length(foo)", "nullif(foo, 'x') IS NULL"}, nil},
+		{[]string{"length(foo)", "foo"}, nil},
+		{[]string{"foo", "foo IS NULL"}, nil},
+		{[]string{"length(upper(foo))"}, nil},
+		{[]string{"length(foo) AS len", "count(bar)"}, []string{"foo"}},
+		// only strings can be read without their contents
+		{[]string{"num IS NULL"}, nil},
+	}
+
+	schema := column.TableSchema{
+		{Name: "foo", Dtype: column.DtypeString},
+		{Name: "bar", Dtype: column.DtypeString},
+		{Name: "num", Dtype: column.DtypeInt},
+	}
+	for _, test := range tests {
+		var exprs []Expression
+		for _, rawExpr := range test.rawExprs {
+			expr, err := ParseStringExpr(rawExpr)
+			if err != nil {
+				t.Errorf("cannot parse %+v, got %+v", rawExpr, err)
+				continue
+			}
+			exprs = append(exprs, expr)
+		}
+		lengthOnly := LengthOnlyColumns(schema, exprs...)
+		if !reflect.DeepEqual(lengthOnly, test.lengthOnly) {
+			t.Errorf("expecting %+v to use %+v for lengths only, but got %+v instead", test.rawExprs, test.lengthOnly, lengthOnly)
+		}
+	}
+}
+
 func TestValidity(t *testing.T) {
 	schema := column.TableSchema([]column.Schema{
 		{Name: "my_int_column", Dtype: column.DtypeInt},
@@ -256,6 +303,10 @@ func TestValiditySadPaths(t *testing.T) {
 		"'bar' = my_int_column",
 		"my_int_column > 3 AND my_float_column",
 		"my_bool_column + my_float_column",
+		// LIKE needs strings on both sides, with a literal pattern
+		"my_int_column LIKE '1%'", "my_bool_column ILIKE 'f%'",
+		// the same goes for regular expressions
+		"my_int_column ~ '^1'", "my_bool_column ~* my_bool_column",
 		// non-existing functions
 		"foobar(my_int_column)",
 	}
@@ -279,6 +330,9 @@ func TestReturnTypes(t *testing.T) {
 		{Name: "my_float_column", Dtype: column.DtypeFloat},
 		{Name: "my_Float_column", Dtype: column.DtypeInt}, // this is intentionally incorrect
 		{Name: "my_string_column", Dtype: column.DtypeString},
+		{Name: "my_date_column", Dtype: column.DtypeDate},
+		{Name: "my_datetime_column", Dtype: column.DtypeDatetime, Nullable: true},
+		{Name: "my_json_column", Dtype: column.DtypeJSON},
 	})
 	testCases := []struct {
 		rawExpr    string
@@ -338,6 +392,14 @@ func TestReturnTypes(t *testing.T) {
 		{"1 + null", column.Schema{Dtype: column.DtypeInt}, nil},
 		{"null + 1", column.Schema{Dtype: column.DtypeInt}, nil},
 
+		// IN lists (nulls on either side make results unknown)
+		{"my_int_column IN (1, 2.5)", column.Schema{Dtype: column.DtypeBool, Nullable: true}, nil},
+		{"my_string_column IN ('a', null)", column.Schema{Dtype: column.DtypeBool, Nullable: true}, nil},
+		{"my_date_column IN (null)", column.Schema{Dtype: column.DtypeBool, Nullable: true}, nil},
+		{"my_int_column IN (1, 'a')", column.Schema{}, errTupleTypeMismatch},
+		{"my_int_column IN ('a', 'b')", column.Schema{}, errTypeMismatch},
+		{"my_int_column IN (my_int_column, 2)", column.Schema{}, errTupleNotConstant},
+
 		// and/or
 		{"my_float_column > 3 AND my_int_column = 4", column.Schema{Dtype: column.DtypeBool}, nil},
 		{"my_float_column > 3 OR my_int_column = 4", column.Schema{Dtype: column.DtypeBool}, nil},
@@ -345,16 +407,41 @@ func TestReturnTypes(t *testing.T) {
 		// function calls
 		{"count()", column.Schema{Dtype: column.DtypeInt}, nil},
 		{"count(my_int_column)", column.Schema{Dtype: column.DtypeInt}, nil},
+		{"my_datetime_column IS NULL", column.Schema{Dtype: column.DtypeBool}, nil},
+		{"nullif(my_int_column, 12) IS NOT NULL", column.Schema{Name: "nullif(my_int_column, 12) IS NOT NULL", Dtype: column.DtypeBool}, nil},
+		{"NULL IS NULL", column.Schema{Dtype: column.DtypeBool}, nil},
 		{"nullif(my_int_column, 12)", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
 		{"nullif(my_float_column, 12)", column.Schema{Dtype: column.DtypeFloat, Nullable: true}, nil},
 		{"14*min(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
 		{"14*max(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
 		{"14*min(my_int_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
 		{"14*max(my_int_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		{"max(my_string_column)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"min(my_date_column)", column.Schema{Dtype: column.DtypeDate, Nullable: false}, nil},
+		{"max(my_datetime_column)", column.Schema{Dtype: column.DtypeDatetime, Nullable: true}, nil},
+		{"min(my_bool_column)", column.Schema{}, errWrongArgumentType},
+		{"max(my_json_column)", column.Schema{}, errWrongArgumentType},
 		{"sum(my_int_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
 		{"sum(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
 		{"avg(my_int_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
 		{"avg(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
+		{"sum(null)", column.Schema{Dtype: column.DtypeNull}, nil},
+		{"avg(null)", column.Schema{Dtype: column.DtypeNull}, nil},
+		{"count(null)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		// filtered aggregations may have no rows to aggregate
+		{"sum(my_int_column) filter (where my_bool_column)", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
+		{"min(my_int_column) filter (where my_int_column > 3)", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
+		{"max(my_date_column) filter (where my_bool_column)", column.Schema{Dtype: column.DtypeDate, Nullable: true}, nil},
+		{"count(my_int_column) filter (where my_bool_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		{"count() filter (where my_bool_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		{"sum(my_int_column) filter (where my_int_column)", column.Schema{}, errInvalidFilterClause},
+		{"var_pop(my_int_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
+		{"stddev(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: true}, nil},
+		{"median(my_int_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
+		{"percentile(my_float_column, 0.9)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
+		{"percentile(my_float_column, 1)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
+		{"percentile(my_float_column, my_int_column)", column.Schema{}, errWrongArgumentType},
+		{"variance(my_string_column)", column.Schema{}, errWrongArgumentType},
 		{"round(my_int_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
 		{"round(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
 		{"round(my_int_column, 3)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
@@ -368,6 +455,21 @@ func TestReturnTypes(t *testing.T) {
 		// {"mid(my_string_column, 4)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
 		// {"right(my_string_column, 4)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
 		{"split_part(my_string_column, 'foo', 4)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"concat(my_string_column, 'foo', null)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"replace(my_string_column, 'foo', 'bar')", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"length(my_string_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		{"substr(my_string_column, 2)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"substr(my_string_column, 2, 3)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"date_trunc('month', my_date_column)", column.Schema{Dtype: column.DtypeDate, Nullable: false}, nil},
+		{"date_trunc('day', my_datetime_column)", column.Schema{Dtype: column.DtypeDatetime, Nullable: true}, nil},
+		{"date_part('year', my_date_column)", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		{"extract(hour from my_datetime_column)", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
+		{"date_diff('day', my_date_column, now())", column.Schema{Dtype: column.DtypeInt, Nullable: false}, nil},
+		{"date_diff('day', my_date_column, my_datetime_column)", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
+		{"my_date_column + interval '7 days'", column.Schema{Dtype: column.DtypeDate, Nullable: false}, nil},
+		{"interval '1 month' + my_date_column", column.Schema{Dtype: column.DtypeDate, Nullable: false}, nil},
+		{"my_date_column - interval '3 hours'", column.Schema{Dtype: column.DtypeDatetime, Nullable: false}, nil},
+		{"now() - interval '1 week'", column.Schema{Dtype: column.DtypeDatetime, Nullable: false}, nil},
 
 		// trigonometric functions always return a nullable column (though sin/cos/exp don't have to)
 		{"sin(my_float_column)", column.Schema{Dtype: column.DtypeFloat, Nullable: true}, nil},
@@ -385,6 +487,8 @@ func TestReturnTypes(t *testing.T) {
 		{"min()", column.Schema{}, errWrongNumberofArguments},
 		{"max()", column.Schema{}, errWrongNumberofArguments},
 		{"avg()", column.Schema{}, errWrongNumberofArguments},
+		{"stddev()", column.Schema{}, errWrongNumberofArguments},
+		{"percentile(my_float_column)", column.Schema{}, errWrongNumberofArguments},
 		{"sum()", column.Schema{}, errWrongNumberofArguments},
 		{"sum(my_int_column, my_float_column)", column.Schema{}, errWrongNumberofArguments},
 		{"round()", column.Schema{}, errWrongNumberofArguments},
@@ -404,10 +508,50 @@ func TestReturnTypes(t *testing.T) {
 		{"nullif(my_int_column, 4, 5)", column.Schema{}, errWrongNumberofArguments},
 		{"coalesce()", column.Schema{}, errWrongNumberofArguments},
 		{"left(my_string_column)", column.Schema{}, errWrongNumberofArguments},
+		{"concat()", column.Schema{}, errWrongNumberofArguments},
+		{"replace(my_string_column, 'foo')", column.Schema{}, errWrongNumberofArguments},
+		{"length()", column.Schema{}, errWrongNumberofArguments},
+		{"substr(my_string_column)", column.Schema{}, errWrongNumberofArguments},
+		{"substr(my_string_column, 1, 2, 3)", column.Schema{}, errWrongNumberofArguments},
 		// {"mid(my_string_column)", column.Schema{}, errWrongNumberofArguments},
 		// {"right(my_string_column)", column.Schema{}, errWrongNumberofArguments},
 
 		{"sum(my_string_column)", column.Schema{}, errWrongArgumentType},
+		{"concat(my_string_column, my_int_column)", column.Schema{}, errWrongArgumentType},
+		{"replace(my_string_column, 'foo', 1)", column.Schema{}, errWrongArgumentType},
+		{"length(my_int_column)", column.Schema{}, errWrongArgumentType},
+		{"json_extract(my_json_column, '$.foo')", column.Schema{Dtype: column.DtypeJSON, Nullable: true}, nil},
+		{"json_extract(my_string_column, '$.foo[0]', 'int')", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
+		{"cast(my_json_column as string)", column.Schema{Dtype: column.DtypeString, Nullable: true}, nil},
+		{"cast(my_string_column as json)", column.Schema{Dtype: column.DtypeJSON, Nullable: true}, nil},
+		{"json_extract(my_json_column)", column.Schema{}, errWrongNumberofArguments},
+		{"json_extract(my_int_column, '$.foo')", column.Schema{}, errWrongArgumentType},
+		{"json_extract(my_json_column, my_string_column)", column.Schema{}, errWrongArgumentType},
+		{"json_extract(my_json_column, '$.foo', my_string_column)", column.Schema{}, errWrongArgumentType},
+		{"regexp_matches(my_string_column, '^a')", column.Schema{Dtype: column.DtypeBool, Nullable: false}, nil},
+		{"regexp_matches(my_string_column, '^a', 'i')", column.Schema{Dtype: column.DtypeBool, Nullable: false}, nil},
+		{"regexp_matches(my_string_column, null)", column.Schema{Dtype: column.DtypeBool, Nullable: true}, nil},
+		{"regexp_matches(my_string_column)", column.Schema{}, errWrongNumberofArguments},
+		{"regexp_matches(my_string_column, my_string_column)", column.Schema{}, errWrongArgumentType},
+		{"regexp_matches(my_int_column, '1')", column.Schema{}, errWrongArgumentType},
+		{"regexp_matches(my_string_column, '^a', my_string_column)", column.Schema{}, errWrongArgumentType},
+		{"cast(my_int_column as float)", column.Schema{Dtype: column.DtypeFloat, Nullable: false}, nil},
+		{"cast(my_int_column as string)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"cast(my_string_column as date)", column.Schema{Dtype: column.DtypeDate, Nullable: true}, nil},
+		{"cast(null as date)", column.Schema{Dtype: column.DtypeDate, Nullable: true}, nil},
+		{"toint(my_float_column)", column.Schema{Dtype: column.DtypeInt, Nullable: true}, nil},
+		{"tostring(my_int_column)", column.Schema{Dtype: column.DtypeString, Nullable: false}, nil},
+		{"todate(my_string_column, 'foo')", column.Schema{}, errWrongNumberofArguments},
+		{"substr(my_string_column, 'foo')", column.Schema{}, errWrongArgumentType},
+		{"date_trunc('month')", column.Schema{}, errWrongNumberofArguments},
+		{"date_diff('day', my_date_column)", column.Schema{}, errWrongNumberofArguments},
+		{"date_trunc(my_string_column, my_date_column)", column.Schema{}, errWrongArgumentType},
+		{"date_part('year', my_string_column)", column.Schema{}, errWrongArgumentType},
+		{"date_diff('day', my_date_column, my_int_column)", column.Schema{}, errWrongArgumentType},
+		{"interval '1 day'", column.Schema{}, errIntervalArithmetic},
+		{"my_int_column + interval '1 day'", column.Schema{}, errIntervalArithmetic},
+		{"interval '1 day' - my_date_column", column.Schema{}, errIntervalArithmetic},
+		{"my_date_column * interval '1 day'", column.Schema{}, errIntervalArithmetic},
 		// {"NULLIF(my_float_column, 12)", column.Schema{Dtype: column.DtypeFloat, Nullable: true}, nil}, // once we implement case folding...
 
 		// "ahoy", "foo / bar", "2 * foo", "2+3*4", "count(foobar)", "bak = 'my literal'",
@@ -471,3 +615,59 @@ func TestHasIdentifiers(t *testing.T) {
 		}
 	}
 }
+
+func TestBindingParameters(t *testing.T) {
+	tests := []struct {
+		query  string
+		params []interface{}
+		dtypes []column.Dtype // return types of the (bound) projections
+		err    error
+	}{
+		{"SELECT 1", nil, []column.Dtype{column.DtypeInt}, nil},
+		{"SELECT ?", []interface{}{1}, []column.Dtype{column.DtypeInt}, nil},
+		{"SELECT ?, ?, ?", []interface{}{int64(1), 2.5, "foo"}, []column.Dtype{column.DtypeInt, column.DtypeFloat, column.DtypeString}, nil},
+		{"SELECT ?, ?", []interface{}{true, nil}, []column.Dtype{column.DtypeBool, column.DtypeNull}, nil},
+		{"SELECT ?, ?", []interface{}{json.Number("12"), json.Number("1.5")}, []column.Dtype{column.DtypeInt, column.DtypeFloat}, nil},
+		{"SELECT ?, 2 + ? FROM foo WHERE bar = ?", []interface{}{"foo", 1.5, 2}, []column.Dtype{column.DtypeString, column.DtypeFloat}, nil},
+		{"SELECT ?", nil, nil, errParameterCount},
+		{"SELECT ?", []interface{}{1, 2}, nil, errParameterCount},
+		{"SELECT 1 FROM foo WHERE bar = ?", nil, nil, errParameterCount},
+		{"SELECT ?", []interface{}{[]int{1, 2}}, nil, errParameterType},
+		{"SELECT ?", []interface{}{struct{}{}}, nil, errParameterType},
+	}
+
+	for _, test := range tests {
+		q, err := ParseQuerySQL(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Bind(test.params...); !errors.Is(err, test.err) {
+			t.Errorf("binding %v to %v should result in %v, got %v instead", test.params, test.query, test.err, err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		for j, proj := range q.Select {
+			rt, err := proj.ReturnType(nil)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if rt.Dtype != test.dtypes[j] {
+				t.Errorf("expecting %v in %v to be bound as %v, got %v", proj, test.query, test.dtypes[j], rt.Dtype)
+			}
+		}
+	}
+}
+
+func TestUnboundPlaceholders(t *testing.T) {
+	ex, err := ParseStringExpr("foo = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := column.TableSchema{{Name: "foo", Dtype: column.DtypeInt}}
+	if _, err := ex.ReturnType(schema); !errors.Is(err, errUnboundPlaceholder) {
+		t.Errorf("expecting unbound placeholders to fail with %v, got %v", errUnboundPlaceholder, err)
+	}
+}
@@ -0,0 +1,137 @@
+package expr
+
+import (
+	"github.com/kokes/smda/src/column"
+)
+
+// constant is an expression folded into a single value (see Fold), it still reports its type
+// and stringifies as the original expression, so that column names, cache keys or lookups
+// of ORDER BY/GROUP BY expressions are not affected by folding
+type constant struct {
+	original Expression
+	value    *column.Chunk // a literal chunk of length 1
+}
+
+func (ex *constant) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	return ex.original.ReturnType(ts)
+}
+func (ex *constant) String() string {
+	return ex.original.String()
+}
+func (ex *constant) Children() []Expression {
+	return nil
+}
+
+// simplified is an expression that was rewritten into an equivalent, but simpler expression
+// (e.g. `foo AND true` into `foo`), like constants, it keeps its original representation
+type simplified struct {
+	original Expression
+	inner    Expression
+}
+
+func (ex *simplified) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	return ex.original.ReturnType(ts)
+}
+func (ex *simplified) String() string {
+	return ex.original.String()
+}
+func (ex *simplified) Children() []Expression {
+	return []Expression{ex.inner}
+}
+
+// constantBool detects `true`/`false` literals, be it in the query itself, in its parameters
+// or as a result of folding
+func constantBool(ex Expression) (value bool, ok bool) {
+	if ph, isPh := ex.(*Placeholder); isPh && ph.value != nil {
+		ex = ph.value
+	}
+	switch node := ex.(type) {
+	case *Bool:
+		return node.value, true
+	case *constant:
+		if node.value.Dtype() == column.DtypeBool {
+			return node.value.Truths().Get(0), true
+		}
+	}
+	return false, false
+}
+
+// Fold is an optimisation pass, it evaluates all subtrees that don't depend on any data (e.g. `1+2*3`)
+// once, instead of evaluating them for every stripe, it also simplifies boolean expressions with
+// constant operands (`foo AND true` is `foo`, `foo OR true` is always true etc.)
+// Folding edits the expression in place and it's meant to be run on validated expressions, it can
+// be applied repeatedly. Subtrees that fail to evaluate (e.g. `1/0`) are left as they are, so that
+// they fail at runtime, the same way as without folding.
+// ARCH: we only fold expressions that evaluate into non-null literals, that excludes e.g. `1 + NULL`
+func Fold(ex Expression) Expression {
+	switch node := ex.(type) {
+	case *Integer, *Float, *Bool, *String, *Null, *Interval, *Placeholder, *Identifier, *Subquery, *constant, *simplified:
+		// nothing to fold here (or folded already)
+		return ex
+	case *Parentheses:
+		node.inner = Fold(node.inner)
+	case *aliased:
+		node.inner = Fold(node.inner)
+	case *Prefix:
+		node.right = Fold(node.right)
+	case *NullTest:
+		node.inner = Fold(node.inner)
+	case *Infix:
+		node.left = Fold(node.left)
+		node.right = Fold(node.right)
+		if reduced := simplifyLogic(node); reduced != nil {
+			return reduced
+		}
+	case *Function:
+		for j, arg := range node.args {
+			node.args[j] = Fold(arg)
+		}
+		if node.filter != nil {
+			node.filter = Fold(node.filter)
+		}
+	case *Tuple:
+		for j, el := range node.inner {
+			node.inner[j] = Fold(el)
+		}
+	// relabels and orderings are looked up by their types, so we only fold what they wrap
+	case *Relabel:
+		node.inner = Fold(node.inner)
+		return ex
+	case *Ordering:
+		node.inner = Fold(node.inner)
+		return ex
+	}
+
+	if !isConstant(ex) || !IsDeterministic(ex) {
+		return ex
+	}
+	value, err := Evaluate(ex, 1, nil, nil)
+	if err != nil || !value.IsLiteral || value.Nullability != nil {
+		return ex
+	}
+	return &constant{original: ex, value: value}
+}
+
+// simplifyLogic reduces AND/OR expressions with a constant operand, it relies on three-valued logic
+// (NULL AND false is false, NULL OR true is true), so it applies to nullable operands as well
+func simplifyLogic(node *Infix) Expression {
+	// fully constant expressions get evaluated instead
+	if (node.operator != tokenAnd && node.operator != tokenOr) || isConstant(node) {
+		return nil
+	}
+	value, ok := constantBool(node.left)
+	other := node.right
+	if !ok {
+		value, ok = constantBool(node.right)
+		other = node.left
+	}
+	if !ok {
+		return nil
+	}
+	// `foo AND false` is always false, `foo OR true` is always true
+	if value == (node.operator == tokenOr) {
+		return &constant{original: node, value: column.NewChunkLiteralBools(value, 1)}
+	}
+	// `foo AND true` and `foo OR false` are just `foo`
+	return &simplified{original: node, inner: other}
+}
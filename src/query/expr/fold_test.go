@@ -0,0 +1,93 @@
+package expr
+
+import (
+	"testing"
+)
+
+func TestFolding(t *testing.T) {
+	tests := []struct {
+		raw   string
+		value string // JSON literal of the folded value, empty if the expression doesn't fold to a constant
+		inner string // what a simplified expression reduces to
+	}{
+		{"1+2*3", "7", ""},
+		{"-3", "-3", ""},
+		{"(1 + 2.5) / 2", "1.75", ""},
+		{"'a' = 'a'", "true", ""},
+		{"4 > 1 AND 2 < 1", "false", ""},
+		{"NOT (1 = 1)", "false", ""},
+		{"upper('foo')", `"FOO"`, ""},
+		// boolean simplifications
+		{"foo AND true", "", "foo"},
+		{"true AND foo", "", "foo"},
+		{"foo OR false", "", "foo"},
+		{"foo AND 1 = 1", "", "foo"},
+		{"foo AND false", "false", ""},
+		{"foo OR 1 = 1", "true", ""},
+		{"foo > 1 AND bar OR false", "", "foo>1 AND bar"},
+		// not folded
+		{"foo", "", ""},
+		{"foo + 1", "", ""},
+		{"1 + NULL", "", ""},
+		{"1 / 0", "", ""},
+		{"now()", "", ""},
+		{"sum(1)", "", ""},
+		{"NULL AND true", "", ""},
+	}
+	for _, test := range tests {
+		ex, err := ParseStringExpr(test.raw)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		original := ex.String()
+		folded := Fold(ex)
+		if folded.String() != original {
+			t.Errorf("folding %v changed its representation to %v", test.raw, folded)
+		}
+		// folding is idempotent
+		if again := Fold(folded); again != folded {
+			t.Errorf("expecting %v to be folded only once", test.raw)
+		}
+		switch node := folded.(type) {
+		case *constant:
+			value, _ := node.value.JSONLiteral(0)
+			if value != test.value {
+				t.Errorf("expecting %v to fold into %v, got %v", test.raw, test.value, value)
+			}
+		case *simplified:
+			if node.inner.String() != test.inner {
+				t.Errorf("expecting %v to be simplified into %v, got %v", test.raw, test.inner, node.inner)
+			}
+		default:
+			if test.value != "" || test.inner != "" {
+				t.Errorf("expecting %v to be folded, got %T", test.raw, folded)
+			}
+		}
+	}
+}
+
+func TestFoldingParameters(t *testing.T) {
+	q, err := ParseQuerySQL("SELECT foo FROM bar WHERE foo > ? + 1 AND ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Bind(2, true); err != nil {
+		t.Fatal(err)
+	}
+	folded := Fold(q.Filter)
+	if folded.String() != "foo>2+1 AND TRUE" {
+		t.Errorf("unexpected representation of a folded filter: %v", folded)
+	}
+	simple, ok := folded.(*simplified)
+	if !ok {
+		t.Fatalf("expecting a bound boolean parameter to be simplified away, got %T", folded)
+	}
+	cmp, ok := simple.inner.(*Infix)
+	if !ok {
+		t.Fatalf("expecting a comparison, got %T", simple.inner)
+	}
+	if _, ok := cmp.right.(*constant); !ok {
+		t.Errorf("expecting bound parameters to be folded, got %T", cmp.right)
+	}
+}
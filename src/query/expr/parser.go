@@ -6,19 +6,28 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/kokes/smda/src/column"
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errUnparsedBit = errors.New("parsing incomplete")
-var errNoClosingBracket = errors.New("no closing bracket after an opening one")
-var errUnsupportedPrefixToken = errors.New("unsupported prefix token")
-var errSQLOnlySelects = errors.New("only SELECT queries supported")
-var errInvalidQuery = errors.New("invalid SQL query")
-var errInvalidFunctionName = errors.New("invalid function name")
-var errEmptyExpression = errors.New("cannot parse an expression from an empty string")
-var errInvalidTuple = errors.New("invalid tuple expression")
-var errDistinctNeedsColumn = errors.New("DISTINCT in a function call needs an argument")
-var errInvalidDatasetVersion = errors.New("invalid dataset version")
+var errUnparsedBit = errs.New(errs.ErrBadRequest, "parsing incomplete")
+var errNoClosingBracket = errs.New(errs.ErrBadRequest, "no closing bracket after an opening one")
+var errUnsupportedPrefixToken = errs.New(errs.ErrBadRequest, "unsupported prefix token")
+var errSQLOnlySelects = errs.New(errs.ErrBadRequest, "only SELECT queries supported")
+var errInvalidQuery = errs.New(errs.ErrBadRequest, "invalid SQL query")
+var errInvalidFunctionName = errs.New(errs.ErrBadRequest, "invalid function name")
+var errEmptyExpression = errs.New(errs.ErrBadRequest, "cannot parse an expression from an empty string")
+var errInvalidTuple = errs.New(errs.ErrBadRequest, "invalid tuple expression")
+var errDistinctNeedsColumn = errs.New(errs.ErrBadRequest, "DISTINCT in a function call needs an argument")
+var errInvalidDatasetVersion = errs.New(errs.ErrBadRequest, "invalid dataset version")
+var errInvalidInterval = errs.New(errs.ErrBadRequest, "INTERVAL needs to be followed by a string literal")
+var errInvalidExtract = errs.New(errs.ErrBadRequest, "EXTRACT needs to be in the form of EXTRACT(field FROM expression)")
+var errInvalidCast = errs.New(errs.ErrBadRequest, "CAST needs to be in the form of CAST(expression AS type)")
+var errInvalidSet = errs.New(errs.ErrBadRequest, "SET needs to be in the form of SET name = 'value' (or SET TIME ZONE 'value')")
+var errInvalidWith = errs.New(errs.ErrBadRequest, "WITH needs to be in the form of WITH name AS (SELECT ...)[, name AS (SELECT ...)]")
+var errInvalidFilterClause = errs.New(errs.ErrBadRequest, "FILTER needs to be in the form of FILTER (WHERE condition) and it only applies to aggregating functions")
+var errInvalidSample = errs.New(errs.ErrBadRequest, "TABLESAMPLE needs to be in the form of TABLESAMPLE {BERNOULLI|SYSTEM} (percent) [REPEATABLE (seed)]")
 
 const (
 	_ int = iota
@@ -43,6 +52,8 @@ var precedences = map[tokenType]int{
 	tokenNot:    EQUALS,
 	tokenLike:   EQUALS,
 	tokenIlike:  EQUALS,
+	tokenRegex:  EQUALS,
+	tokenIregex: EQUALS,
 	tokenLt:     LESSGREATER,
 	tokenGt:     LESSGREATER,
 	tokenLte:    LESSGREATER,
@@ -64,6 +75,8 @@ type Parser struct {
 	tokens   tokenList
 	position int
 	errors   []error
+	// number of placeholders (`?`) encountered so far, used to number them
+	placeholders int
 
 	prefixParseFns map[tokenType]prefixParseFn
 	infixParseFns  map[tokenType]infixParseFn
@@ -96,6 +109,8 @@ func NewParser(s string) (*Parser, error) {
 		tokenTrue:             p.parseLiteralBool,
 		tokenFalse:            p.parseLiteralBool,
 		tokenNull:             p.parseLiteralNULL,
+		tokenPlaceholder:      p.parsePlaceholder,
+		tokenInterval:         p.parseLiteralInterval,
 		tokenAdd:              p.parsePrefixExpression,
 		tokenSub:              p.parsePrefixExpression,
 		tokenNot:              p.parsePrefixExpression,
@@ -112,6 +127,8 @@ func NewParser(s string) (*Parser, error) {
 		tokenNeq:    p.parseInfixExpression,
 		tokenLike:   p.parseInfixExpression,
 		tokenIlike:  p.parseInfixExpression,
+		tokenRegex:  p.parseInfixExpression,
+		tokenIregex: p.parseInfixExpression,
 		tokenIn:     p.parseInfixExpression,
 		tokenNot:    p.parseInfixExpression,
 		tokenLt:     p.parseInfixExpression,
@@ -175,9 +192,27 @@ func (p *Parser) parseLiteralFloat() Expression {
 func (p *Parser) parseLiteralString() Expression {
 	return &String{value: string(p.curToken().value)}
 }
+func (p *Parser) parseLiteralInterval() Expression {
+	if p.peekToken().ttype != tokenLiteralString {
+		p.errors = append(p.errors, errInvalidInterval)
+		return nil
+	}
+	p.position++
+	raw := string(p.curToken().value)
+	value, err := column.ParseInterval(raw)
+	if err != nil {
+		p.errors = append(p.errors, err)
+		return nil
+	}
+	return &Interval{raw: raw, value: value}
+}
 func (p *Parser) parseLiteralNULL() Expression {
 	return &Null{}
 }
+func (p *Parser) parsePlaceholder() Expression {
+	p.placeholders++
+	return &Placeholder{position: p.placeholders}
+}
 func (p *Parser) parseLiteralBool() Expression {
 	// OPTIM: use a switch on p.curToken().ttype instead?
 	val, _ := strconv.ParseBool(string(p.curToken().String()))
@@ -186,6 +221,10 @@ func (p *Parser) parseLiteralBool() Expression {
 }
 
 func (p *Parser) parseParentheses() Expression {
+	// `(SELECT max(foo) FROM bar)`
+	if p.peekToken().ttype == tokenSelect {
+		return p.parseSubquery(true)
+	}
 	p.position++
 	expr := p.parseExpression(LOWEST)
 
@@ -217,6 +256,12 @@ func (p *Parser) parseCallExpression(left Expression) Expression {
 		return nil
 	}
 	funName := id.Name
+	if funName == "extract" {
+		return p.parseExtract()
+	}
+	if funName == "cast" {
+		return p.parseCast()
+	}
 	var distinct bool
 
 	if p.peekToken().ttype == tokenDistinct {
@@ -246,7 +291,7 @@ func (p *Parser) parseCallExpression(left Expression) Expression {
 
 	if p.peekToken().ttype == tokenRparen {
 		p.position++
-		return expr
+		return p.parseFilterClause(expr)
 	}
 	p.position++
 
@@ -263,14 +308,111 @@ func (p *Parser) parseCallExpression(left Expression) Expression {
 	}
 	p.position++
 
+	return p.parseFilterClause(expr)
+}
+
+// parseFilterClause parses an optional `FILTER (WHERE condition)` following a function call (its
+// closing parenthesis being the current token). FILTER is not a keyword, so that it can still be
+// used as a name (e.g. `sum(foo) filter` is just a relabeling)
+func (p *Parser) parseFilterClause(fun *Function) Expression {
+	next := p.peekToken()
+	if next.ttype != tokenIdentifier || !bytes.EqualFold(next.value, []byte("filter")) ||
+		p.position+3 >= len(p.tokens) || p.tokens[p.position+2].ttype != tokenLparen || p.tokens[p.position+3].ttype != tokenWhere {
+		return fun
+	}
+	if fun.aggregatorFactory == nil {
+		p.errors = append(p.errors, fmt.Errorf("%w: %v is not an aggregating function", errInvalidFilterClause, fun.name))
+		return nil
+	}
+	// skipping FILTER, the opening parenthesis and WHERE
+	p.position += 4
+	fun.filter = p.parseExpression(LOWEST)
+	if fun.filter == nil {
+		return nil
+	}
+	if p.peekToken().ttype != tokenRparen {
+		p.errors = append(p.errors, errNoClosingBracket)
+		return nil
+	}
+	p.position++
+	return fun
+}
+// EXTRACT(year FROM foo) is just syntactic sugar for date_part('year', foo)
+func (p *Parser) parseExtract() Expression {
+	p.position++
+	field := p.curToken()
+	if field.ttype != tokenIdentifier || p.peekToken().ttype != tokenFrom {
+		p.errors = append(p.errors, errInvalidExtract)
+		return nil
+	}
+	p.position += 2
+	arg := p.parseExpression(LOWEST)
+	if p.peekToken().ttype != tokenRparen {
+		p.errors = append(p.errors, errNoClosingBracket)
+		return nil
+	}
+	p.position++
+
+	expr, err := NewFunction("date_part", false)
+	if err != nil {
+		p.errors = append(p.errors, err)
+		return nil
+	}
+	expr.args = []Expression{&String{value: string(bytes.ToLower(field.value))}, arg}
+	return expr
+}
+
+// CAST(foo AS int) gets parsed into a cast function with the (canonical) type name as its second argument
+func (p *Parser) parseCast() Expression {
+	p.position++
+	arg := p.parseExpression(LOWEST)
+	if p.peekToken().ttype != tokenAs {
+		p.errors = append(p.errors, errInvalidCast)
+		return nil
+	}
+	p.position += 2
+	typ := p.curToken()
+	if typ.ttype != tokenIdentifier || p.peekToken().ttype != tokenRparen {
+		p.errors = append(p.errors, errInvalidCast)
+		return nil
+	}
+	p.position++
+	dtype, err := column.CastType(string(typ.value))
+	if err != nil {
+		p.errors = append(p.errors, fmt.Errorf("%w: %v", errInvalidCast, err))
+		return nil
+	}
+
+	expr, err := NewFunction("cast", false)
+	if err != nil {
+		p.errors = append(p.errors, err)
+		return nil
+	}
+	expr.args = []Expression{arg, &String{value: dtype.String()}}
 	return expr
 }
+
 func (p *Parser) parseInfixExpression(left Expression) Expression {
 	curToken := p.curToken()
 	expr := &Infix{operator: curToken.ttype, left: left}
 	precedence := p.curPrecedence()
 	p.position++
 
+	// IS [NOT] NULL is a standalone expression, not a comparison
+	if expr.operator == tokenIs {
+		negated := p.curToken().ttype == tokenNot
+		next := p.curToken()
+		if negated {
+			next = p.peekToken()
+		}
+		if next.ttype == tokenNull {
+			if negated {
+				p.position++
+			}
+			return &NullTest{inner: left, negated: negated}
+		}
+	}
+
 	// IS NOT => NOT
 	// ARCH/COMPAT: maybe this whole IS IN, IS NOT IN, IS LIKE etc. are not supported (at least I can't get them to work in pg)
 	//				it would certainly simplify a lot of code over here
@@ -302,6 +444,9 @@ func (p *Parser) parseInfixExpression(left Expression) Expression {
 
 	expr.right = p.parseExpression(precedence)
 
+	if expr.operator == tokenRegex || expr.operator == tokenIregex {
+		expr.regexp = new(column.RegexpMatcher)
+	}
 	if expr.operator == tokenDot {
 		i1, ok1 := expr.left.(*Identifier)
 		i2, ok2 := expr.right.(*Identifier)
@@ -322,6 +467,10 @@ func (p *Parser) parseTuple(precedence int) Expression {
 		p.errors = append(p.errors, fmt.Errorf("%w: IN clauses need to be followed by a parenthesised clause", errInvalidTuple))
 		return nil
 	}
+	// foo in (select bar from baz)
+	if p.peekToken().ttype == tokenSelect {
+		return p.parseSubquery(false)
+	}
 	// foo in ()
 	if p.peekToken().ttype == tokenRparen {
 		p.errors = append(p.errors, fmt.Errorf("%w: cannot have an empty tuple", errInvalidTuple))
@@ -341,6 +490,23 @@ func (p *Parser) parseTuple(precedence int) Expression {
 	return &Tuple{inner: inner}
 }
 
+// parseSubquery parses a SELECT statement enclosed in brackets, starting at the opening one and
+// leaving the parser at the closing one
+// ARCH: subqueries cannot contain UNION ALL clauses (parseSelect doesn't handle those)
+func (p *Parser) parseSubquery(scalar bool) Expression {
+	p.position++
+	q, err := p.parseSelect()
+	if err != nil {
+		p.errors = append(p.errors, err)
+		return nil
+	}
+	if p.curToken().ttype != tokenRparen {
+		p.errors = append(p.errors, fmt.Errorf("%w: subqueries need to end with a closing bracket", errNoClosingBracket))
+		return nil
+	}
+	return &Subquery{Query: q, scalar: scalar}
+}
+
 func (p *Parser) parseExpression(precedence int) Expression {
 	curToken := p.curToken()
 
@@ -420,11 +586,73 @@ func (p *Parser) parseRelabeling() (*Identifier, error) {
 	return label, nil
 }
 
+// parseSample parses a TABLESAMPLE clause (starting with the sampling method), it leaves the position
+// at the very last token of the clause (a closing parenthesis)
+func (p *Parser) parseSample() (*Sample, error) {
+	sample := &Sample{}
+	method := p.curToken()
+	switch {
+	case method.ttype == tokenIdentifier && bytes.EqualFold(method.value, []byte("bernoulli")):
+		sample.Method = SampleBernoulli
+	case method.ttype == tokenIdentifier && bytes.EqualFold(method.value, []byte("system")):
+		sample.Method = SampleSystem
+	default:
+		return nil, fmt.Errorf("%w: unknown sampling method %v", errInvalidSample, method)
+	}
+	// both the percentage and the seed are parenthesised numbers
+	parseArgument := func(allowFloats bool) (token, error) {
+		p.position++
+		if p.curToken().ttype != tokenLparen {
+			return token{}, errInvalidSample
+		}
+		p.position++
+		arg := p.curToken()
+		if !(arg.ttype == tokenLiteralInt || (allowFloats && arg.ttype == tokenLiteralFloat)) {
+			return token{}, fmt.Errorf("%w: unexpected %v", errInvalidSample, arg)
+		}
+		p.position++
+		if p.curToken().ttype != tokenRparen {
+			return token{}, errInvalidSample
+		}
+		return arg, nil
+	}
+	arg, err := parseArgument(true)
+	if err != nil {
+		return nil, err
+	}
+	sample.Percent, err = strconv.ParseFloat(string(arg.value), 64)
+	if err != nil {
+		return nil, err
+	}
+	if sample.Percent < 0 || sample.Percent > 100 {
+		return nil, fmt.Errorf("%w: sampling percentage needs to be between 0 and 100, got %v", errInvalidSample, sample.Percent)
+	}
+
+	next := p.peekToken()
+	if next.ttype == tokenIdentifier && bytes.EqualFold(next.value, []byte("repeatable")) {
+		p.position++
+		arg, err := parseArgument(false)
+		if err != nil {
+			return nil, err
+		}
+		seed, err := strconv.ParseInt(string(arg.value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sample.Seed = &seed
+	}
+	return sample, nil
+}
+
 // parse expressions separated by commas
 func (p *Parser) parseExpressions() ([]Expression, error) {
 	var ret []Expression
 	for {
 		expr := p.parseExpression(LOWEST)
+		// errors within the expression itself take precedence over those that follow it
+		if err := p.Err(); err != nil {
+			return nil, err
+		}
 		label, err := p.parseRelabeling()
 		if err != nil {
 			return nil, err
@@ -503,11 +731,152 @@ func ParseStringExprs(s string) ([]Expression, error) {
 }
 
 func ParseQuerySQL(s string) (Query, error) {
-	var q Query
+	q, err := parseQuerySQL(s)
+	if err != nil {
+		// not all parsing errors have their categories, but they are all caused by the query
+		return q, errs.Wrap(errs.ErrBadRequest, err)
+	}
+	return q, nil
+}
+
+func parseQuerySQL(s string) (Query, error) {
 	p, err := NewParser(s)
+	if err != nil {
+		return Query{}, err
+	}
+	explain := false
+	if p.curToken().ttype == tokenExplain {
+		explain = true
+		p.position++
+	}
+	with, err := p.parseWith()
+	if err != nil {
+		return Query{}, err
+	}
+	q, err := p.parseUnion()
+	if err != nil {
+		return q, err
+	}
+	q.Explain = explain
+	q.With = with
+
+	// ARCH: using '<' to avoid issues with walking past the end (when using p.position++ instead of peekToken)
+	if p.position < len(p.tokens) {
+		return q, fmt.Errorf("%w: incomplete parsing of supplied query", errInvalidQuery)
+	}
+
+	return q, nil
+}
+
+// parseUnion parses a SELECT statement along with all its UNION ALL parts
+func (p *Parser) parseUnion() (Query, error) {
+	q, err := p.parseSelect()
 	if err != nil {
 		return q, err
 	}
+	for p.curToken().ttype == tokenUnion {
+		p.position++
+		if p.curToken().ttype != tokenAll {
+			return q, fmt.Errorf("%w: only UNION ALL is supported", errInvalidQuery)
+		}
+		p.position++
+		part, err := p.parseSelect()
+		if err != nil {
+			return q, err
+		}
+		q.Union = append(q.Union, part)
+	}
+	return q, nil
+}
+
+// parseWith parses common table expressions (`WITH name AS (SELECT ...), ...`), if there are any,
+// it leaves the parser at the token following them
+// ARCH: WITH is not a keyword, so that it can still be used as a column name (like SET)
+// ARCH: recursive CTEs (WITH RECURSIVE) and column lists (WITH name (a, b) AS ...) are not supported
+func (p *Parser) parseWith() ([]CommonTable, error) {
+	if !isKeyword(p.curToken(), "with") {
+		return nil, nil
+	}
+	var ctes []CommonTable
+	for {
+		p.position++
+		if p.curToken().ttype != tokenIdentifier || p.peekToken().ttype != tokenAs {
+			return nil, errInvalidWith
+		}
+		name := string(p.curToken().value)
+		for _, cte := range ctes {
+			if cte.Name == name {
+				return nil, fmt.Errorf("%w: %v is defined multiple times", errInvalidWith, name)
+			}
+		}
+		p.position += 2
+		if p.curToken().ttype != tokenLparen {
+			return nil, errInvalidWith
+		}
+		p.position++
+		q, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+		if p.curToken().ttype != tokenRparen {
+			return nil, fmt.Errorf("%w: %v needs to end with a closing bracket", errInvalidWith, name)
+		}
+		p.position++
+		ctes = append(ctes, CommonTable{Name: name, Query: q})
+		if p.curToken().ttype != tokenComma {
+			return ctes, nil
+		}
+	}
+}
+
+// Setting is a name and a value of a query setting, as changed by a SET statement
+type Setting struct {
+	Name, Value string
+}
+
+func isKeyword(tok token, keyword string) bool {
+	return tok.ttype == tokenIdentifier && bytes.EqualFold(tok.value, []byte(keyword))
+}
+
+// ParseSetSQL parses `SET name = 'value'` (or `SET name TO 'value'`) statements, which change settings
+// of subsequent queries, `SET TIME ZONE 'value'` is an alias of `SET timezone = 'value'`. It reports
+// false if a given statement is not a SET statement at all.
+// ARCH: SET is not a keyword, so that it can still be used as a column name
+func ParseSetSQL(s string) (Setting, bool, error) {
+	p, err := NewParser(s)
+	if err != nil {
+		return Setting{}, false, err
+	}
+	if !isKeyword(p.curToken(), "set") {
+		return Setting{}, false, nil
+	}
+	p.position++
+	var setting Setting
+	switch {
+	case isKeyword(p.curToken(), "time") && isKeyword(p.peekToken(), "zone"):
+		setting.Name = "timezone"
+		p.position += 2
+	case p.curToken().ttype == tokenIdentifier:
+		setting.Name = string(bytes.ToLower(p.curToken().value))
+		p.position++
+		if !(p.curToken().ttype == tokenEq || isKeyword(p.curToken(), "to")) {
+			return setting, true, errInvalidSet
+		}
+		p.position++
+	default:
+		return setting, true, errInvalidSet
+	}
+	if p.curToken().ttype != tokenLiteralString || p.position != len(p.tokens)-1 {
+		return setting, true, errInvalidSet
+	}
+	setting.Value = string(p.curToken().value)
+	return setting, true, nil
+}
+
+// parseSelect parses a single SELECT statement, it leaves the parser at the token following it
+func (p *Parser) parseSelect() (Query, error) {
+	var q Query
+	var err error
 	if p.curToken().ttype != tokenSelect {
 		return q, errSQLOnlySelects
 	}
@@ -530,24 +899,34 @@ func ParseQuerySQL(s string) (Query, error) {
 			return q, fmt.Errorf("expecting dataset name, got %v", p.curToken())
 		}
 		q.Dataset = &Dataset{Name: string(p.curToken().value), Latest: true}
+		// namespaced datasets, e.g. `FROM sales.orders`
+		if p.peekToken().ttype == tokenDot {
+			p.position += 2
+			if p.curToken().ttype != tokenIdentifier {
+				return q, fmt.Errorf("%w: expecting dataset name after a namespace", errInvalidQuery)
+			}
+			q.Dataset.Namespace = q.Dataset.Name
+			q.Dataset.Name = string(p.curToken().value)
+		}
 		if p.peekToken().ttype == tokenAt {
 			p.position += 2
 			if p.curToken().ttype != tokenIdentifier {
 				return q, fmt.Errorf("%w: expecting dataset version after @", errInvalidQuery)
 			}
 			dsn := p.curToken().value
-			if len(dsn) == 0 || dsn[0] != 'v' {
-				return q, fmt.Errorf("%w: %s", errInvalidDatasetVersion, dsn)
-			}
-			if len(dsn[1:]) != 18 {
+			switch {
+			case bytes.EqualFold(dsn, []byte("latest")):
+				// plain names refer to latest versions anyway, but scripts may want to be explicit
+			case len(dsn) == 0 || dsn[0] != 'v', len(dsn[1:]) != 18:
 				return q, fmt.Errorf("%w: %s", errInvalidDatasetVersion, dsn)
+			default:
+				version, err := database.UIDFromHex(dsn[1:])
+				if err != nil {
+					return q, err
+				}
+				q.Dataset.Version = version.String()
+				q.Dataset.Latest = false
 			}
-			version, err := database.UIDFromHex(dsn[1:])
-			if err != nil {
-				return q, err
-			}
-			q.Dataset.Version = version.String()
-			q.Dataset.Latest = false
 		}
 		label, err := p.parseRelabeling()
 		if err != nil {
@@ -556,6 +935,13 @@ func ParseQuerySQL(s string) (Query, error) {
 		if label != nil {
 			q.Dataset.alias = label
 		}
+		if p.peekToken().ttype == tokenTablesample {
+			p.position += 2
+			q.Sample, err = p.parseSample()
+			if err != nil {
+				return q, err
+			}
+		}
 
 		p.position++
 	}
@@ -605,11 +991,20 @@ func ParseQuerySQL(s string) (Query, error) {
 			return q, err
 		}
 		q.Limit = &limit
+		p.position++
 	}
 
-	// ARCH: using '<' to avoid issues with walking past the end (when using p.position++ instead of peekToken)
-	if p.position < len(p.tokens)-1 {
-		return q, fmt.Errorf("%w: incomplete parsing of supplied query", errInvalidQuery)
+	if p.curToken().ttype == tokenOffset {
+		p.position++
+		if p.curToken().ttype != tokenLiteralInt {
+			return q, fmt.Errorf("%w: can only OFFSET by integers", errInvalidQuery)
+		}
+		offset, err := strconv.Atoi(string(p.curToken().value))
+		if err != nil {
+			return q, err
+		}
+		q.Offset = &offset
+		p.position++
 	}
 
 	return q, nil
@@ -3,7 +3,10 @@ package expr
 import (
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/kokes/smda/src/column"
 )
 
 func TestParsingContents(t *testing.T) {
@@ -140,6 +143,11 @@ func TestParsingContents(t *testing.T) {
 				right: &String{value: "%ahoy%"},
 			},
 		}},
+		{"foo ~* '^ahoy'", &Infix{operator: tokenIregex,
+			left:   &Identifier{Name: "foo"},
+			right:  &String{value: "^ahoy"},
+			regexp: new(column.RegexpMatcher),
+		}},
 
 		// prefix and infix
 		{"-4 / foo", &Infix{operator: tokenQuo,
@@ -183,11 +191,16 @@ func TestParsingContents(t *testing.T) {
 				}},
 			},
 		}},
-		{"foo is not null", &Prefix{operator: tokenNot,
-			right: &Infix{operator: tokenEq,
-				left:  &Identifier{Name: "foo"},
-				right: &Null{},
+		{"foo is null", &NullTest{inner: &Identifier{Name: "foo"}}},
+		{"foo is not null", &NullTest{inner: &Identifier{Name: "foo"}, negated: true}},
+		{"foo + 1 IS NOT NULL AND bar", &Infix{operator: tokenAnd,
+			left: &NullTest{negated: true,
+				inner: &Infix{operator: tokenAdd,
+					left:  &Identifier{Name: "foo"},
+					right: &Integer{value: 1},
+				},
 			},
+			right: &Identifier{Name: "bar"},
 		}},
 
 		// operators
@@ -340,6 +353,19 @@ func TestParsingContents(t *testing.T) {
 				right:    &Identifier{Name: "bar"},
 			},
 		}}},
+		{"cast(foo as bigint)", &Function{name: "cast", args: []Expression{
+			&Identifier{Name: "foo"},
+			&String{value: "int"},
+		}}},
+		{"extract(year from foo)", &Function{name: "date_part", args: []Expression{
+			&String{value: "year"},
+			&Identifier{Name: "foo"},
+		}}},
+		{"foo - interval '1 year 2 days'", &Infix{
+			operator: tokenSub,
+			left:     &Identifier{Name: "foo"},
+			right:    &Interval{raw: "1 year 2 days", value: column.Interval{Months: 12, Days: 2}},
+		}},
 		{"count(1, 2, 3)", &Function{name: "count", args: []Expression{
 			&Integer{value: 1},
 			&Integer{value: 2},
@@ -485,6 +511,17 @@ func TestParsingErrors(t *testing.T) {
 		{"foo in ()", errInvalidTuple},
 		{"sin(distinct foo)", errDistinctInProjection},
 		{"(@(", errUnsupportedPrefixToken}, // found via fuzzing; a weird error, I know
+		{"foo + interval 3", errInvalidInterval},
+		{"foo + interval", errInvalidInterval},
+		{"extract(year, foo)", errInvalidExtract},
+		{"extract(year from foo", errNoClosingBracket},
+		{"cast(foo)", errInvalidCast},
+		{"cast(foo, int)", errInvalidCast},
+		{"cast(foo as blob)", errInvalidCast},
+		{"cast(foo as int", errInvalidCast},
+		{"lower(foo) filter (where foo)", errInvalidFilterClause},
+		{"sum(foo) filter (where foo", errNoClosingBracket},
+		{"sum(foo) filter (where)", errUnsupportedPrefixToken},
 	}
 
 	for _, test := range tests {
@@ -546,7 +583,7 @@ func TestParsingSQL(t *testing.T) {
 		raw string
 		err error
 	}{
-		{"WITH foo", errSQLOnlySelects},
+		{"WITH foo", errInvalidWith},
 		{"SELECT 1", nil},
 		{"SELECT 1 LIMIT 100", nil},
 		{"SELECT 1 WHERE TRUE", nil},
@@ -577,6 +614,35 @@ func TestParsingSQL(t *testing.T) {
 		{"SELECT foo FROM bar GROUP BY foo LIMIT 2", nil},
 		{"SELECT foo FROM bar@v020485a2686b8d38fe LIMIT 200", nil},
 		{"SELECT foo FROM bar GROUP BY foo ORDER BY foo, bar", nil},
+		{"SELECT foo FROM bar WHERE foo=?", nil},
+		{"SELECT foo+? FROM bar WHERE foo>? AND baz<?", nil},
+		{"EXPLAIN SELECT foo FROM bar WHERE foo>2 GROUP BY foo LIMIT 2", nil},
+		{"EXPLAIN SELECT 1", nil},
+		{"EXPLAIN WITH foo", errInvalidWith},
+		{"WITH foo AS (SELECT a FROM bar) SELECT a FROM foo", nil},
+		{"EXPLAIN WITH foo AS (SELECT a FROM bar WHERE a>?), baz AS (SELECT a FROM foo UNION ALL SELECT 1) SELECT a FROM baz WHERE a<?", nil},
+		{"WITH foo AS (SELECT a FROM bar) SELECT a FROM foo WHERE a IN (SELECT a FROM foo) UNION ALL SELECT a FROM foo", nil},
+		{"WITH foo AS (SELECT a FROM bar), foo AS (SELECT 1) SELECT a FROM foo", errInvalidWith},
+		{"WITH foo (SELECT a FROM bar) SELECT a FROM foo", errInvalidWith},
+		{"WITH foo AS SELECT a FROM bar SELECT a FROM foo", errInvalidWith},
+		{"WITH foo AS (SELECT a FROM bar SELECT a FROM foo", errInvalidWith},
+		{"WITH foo AS (SELECT a FROM bar),", errInvalidWith},
+		{"WITH foo AS (SELECT a FROM bar)", errSQLOnlySelects},
+		{"SELECT with FROM bar", nil},
+		{"SELECT foo FROM bar UNION ALL SELECT foo FROM baz", nil},
+		{"SELECT foo FROM bar WHERE foo>? LIMIT 2 UNION ALL SELECT foo+? FROM baz UNION ALL SELECT 1", nil},
+		{"EXPLAIN SELECT foo FROM bar UNION ALL SELECT foo FROM baz", nil},
+		{"SELECT foo FROM bar UNION SELECT foo FROM baz", errInvalidQuery},
+		{"SELECT foo FROM bar UNION ALL foo FROM baz", errSQLOnlySelects},
+		{"SELECT foo FROM bar UNION ALL", errSQLOnlySelects},
+		{"SELECT foo FROM bar LIMIT 2 foo", errInvalidQuery},
+		{"SELECT foo FROM bar ORDER BY foo LIMIT 2 OFFSET 4", nil},
+		{"SELECT foo FROM bar OFFSET 10", nil},
+		{"SELECT foo FROM bar LIMIT 2 OFFSET 4 UNION ALL SELECT foo FROM baz OFFSET 1", nil},
+		{"SELECT foo FROM bar OFFSET 10 LIMIT 2", errInvalidQuery},
+		{"SELECT foo FROM bar LIMIT 2 OFFSET foo", errInvalidQuery},
+		{"SELECT foo FROM bar LIMIT 2 OFFSET -1", errInvalidQuery},
+		{"SELECT foo FROM bar LIMIT 2 OFFSET", errInvalidQuery},
 		// we do roundtrips only, so we have to specify the full `ASC NULLS LAST`, we cannot have just `ASC`
 		// TODO: this means we can't test parsing `ORDER BY foo NULLS LAST` with ASC being implicit
 		// TODO(next): doing roundtrips also means we can't test comments - `{"SELECT * FROM bar\n-- my comment\nLIMIT 5", nil},`
@@ -595,7 +661,18 @@ func TestParsingSQL(t *testing.T) {
 		{"SELECT foo, baz FROM bar ORDER BY 1 DESC NULLS FIRST, 2 ASC NULLS LAST", nil},
 		{"SELECT foo, baz FROM bar ORDER BY 1 ASC NULLS LAST, 2 DESC NULLS LAST", nil},
 
+		{"SELECT foo FROM sales.orders", nil},
+		{"SELECT foo FROM sales.orders@v020485a2686b8d38fe WHERE foo>2", nil},
+		{"SELECT foo FROM sales.orders AS bar", nil},
+		{"SELECT foo FROM sales.", errInvalidQuery},
+		{"SELECT foo FROM bar TABLESAMPLE BERNOULLI (10)", nil},
+		{"SELECT foo FROM bar AS b TABLESAMPLE SYSTEM (0.5) REPEATABLE (42) WHERE foo>2", nil},
+		{"SELECT foo FROM bar TABLESAMPLE reservoir (10)", errInvalidSample},
+		{"SELECT foo FROM bar TABLESAMPLE BERNOULLI 10", errInvalidSample},
+		{"SELECT foo FROM bar TABLESAMPLE BERNOULLI (101)", errInvalidSample},
+		{"SELECT foo FROM bar TABLESAMPLE BERNOULLI (10) REPEATABLE (1.5)", errInvalidSample},
 		{"SELECT foo FROM bar@234", errInvalidQuery},
+		{"SELECT foo FROM bar@newest", errInvalidDatasetVersion},
 		{"SELECT foo FROM bar GROUP for 1", errInvalidQuery},
 		{"SELECT foo FROM bar GROUP BY foo LIMIT foo", errInvalidQuery},
 		{"SELECT foo FROM bar GROUP BY foo ORDER on foo", errInvalidQuery},
@@ -604,6 +681,14 @@ func TestParsingSQL(t *testing.T) {
 		{"SELECT foo FROM bar GROUP BY foo ORDER BY foo ASC NULLS LIMIT 100", errInvalidQuery},
 		{"SELECT foo FROM bar GROUP BY foo ORDER BY foo DESC NULLS LIMIT 100", errInvalidQuery},
 
+		{"SELECT foo FROM bar WHERE baz IN (SELECT baz FROM qux WHERE foo>2)", nil},
+		{"SELECT foo FROM bar WHERE foo>(SELECT max(foo) FROM qux) AND baz IN (SELECT baz FROM qux LIMIT 3)", nil},
+		{"SELECT (SELECT count() FROM qux) FROM bar", nil},
+		{"SELECT foo FROM bar WHERE baz IN (SELECT baz FROM qux WHERE foo IN (SELECT foo FROM quux))", nil},
+		{"SELECT foo FROM bar WHERE baz IN (SELECT baz FROM qux LIMIT foo)", errInvalidQuery},
+		{"SELECT foo FROM bar WHERE baz IN (SELECT baz FROM qux", errNoClosingBracket},
+		{"SELECT foo FROM bar WHERE baz IN (SELECT baz FROM qux UNION ALL SELECT baz FROM quux)", errNoClosingBracket},
+
 		// fuzzing entries
 		{"SELECT r FROM J@v111111D1110000000011", errInvalidDatasetVersion}, // this is invalid, because the version needs to be 18 chars
 	}
@@ -619,3 +704,54 @@ func TestParsingSQL(t *testing.T) {
 		}
 	}
 }
+
+// @latest is only an explicit way of referring to latest versions, so it doesn't roundtrip
+func TestParsingLatestVersions(t *testing.T) {
+	for _, raw := range []string{"SELECT foo FROM bar@latest", "SELECT foo FROM bar@LATEST AS b", "SELECT foo FROM sales.bar@latest"} {
+		q, err := ParseQuerySQL(raw)
+		if err != nil {
+			t.Errorf("failed to parse %v: %v", raw, err)
+			continue
+		}
+		if !q.Dataset.Latest || q.Dataset.Version != "" {
+			t.Errorf("expecting %v to refer to the latest version, got %+v", raw, q.Dataset)
+		}
+		if strings.Contains(q.String(), "@") {
+			t.Errorf("expecting %v to be serialised without a version, got %v", raw, q)
+		}
+	}
+}
+
+func TestParsingSetStatements(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected Setting
+		ok       bool
+		err      error
+	}{
+		{"SELECT 1", Setting{}, false, nil},
+		{"select", Setting{}, false, nil},
+		{"SET timezone = 'Europe/Prague'", Setting{"timezone", "Europe/Prague"}, true, nil},
+		{"set TimeZone to 'UTC'", Setting{"timezone", "UTC"}, true, nil},
+		{"SET timezone 'UTC'", Setting{}, true, errInvalidSet},
+		{"SET TIME ZONE 'America/New_York'", Setting{"timezone", "America/New_York"}, true, nil},
+		{"SET foo = 'bar' -- comment", Setting{"foo", "bar"}, true, nil},
+		{"SET timezone", Setting{}, true, errInvalidSet},
+		{"SET timezone = 1", Setting{}, true, errInvalidSet},
+		{"SET timezone = 'UTC' 'UTC'", Setting{}, true, errInvalidSet},
+		{"SET = 'UTC'", Setting{}, true, errInvalidSet},
+	}
+	for _, test := range tests {
+		setting, ok, err := ParseSetSQL(test.raw)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %q to result in %v, got %v", test.raw, test.err, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("expecting %q to be a SET statement: %v, got %v", test.raw, test.ok, ok)
+		}
+		if err == nil && setting != test.expected {
+			t.Errorf("expecting %q to be parsed as %+v, got %+v", test.raw, test.expected, setting)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package expr
+
+import "github.com/kokes/smda/src/column"
+
+// Bound is one end of a range of values, its value is an expression without any identifiers
+// (e.g. a literal), which can be evaluated once for the whole query
+type Bound struct {
+	Value     Expression
+	Inclusive bool
+}
+
+// Range describes values of a column a filter can match - they need to be greater than all the lower
+// bounds and less than all the upper bounds (a range with no bounds matches all values)
+type Range struct {
+	Lower, Upper []Bound
+	// values the column is compared for equality with (these are included in the bounds as well)
+	Points []Expression
+	// exact ranges match exactly the rows the filter matches, otherwise there are other conditions
+	// in the filter and the range only narrows down potential matches
+	Exact bool
+}
+
+// conjunctions flattens `a AND b AND (c AND d)` into [a, b, c, d]
+func conjunctions(ex Expression) []Expression {
+	switch node := ex.(type) {
+	case *Parentheses:
+		return conjunctions(node.inner)
+	case *simplified:
+		return conjunctions(node.inner)
+	case *Infix:
+		if node.operator == tokenAnd {
+			return append(conjunctions(node.left), conjunctions(node.right)...)
+		}
+	}
+	return []Expression{ex}
+}
+
+func isConstant(ex Expression) bool {
+	if HasIdentifiers(ex) {
+		return false
+	}
+	aggs, err := AggExpr(ex)
+	return err == nil && aggs == nil
+}
+
+// ColumnRange extracts bounds on a given column from a filter, it looks for comparisons of said column
+// against constant expressions in the filter's conjunctions, e.g. `a > 3 AND b = 2 AND a <= 10` yields
+// a range of (3, 10] for column `a` (an inexact one, because of the condition on `b`)
+func ColumnRange(filter Expression, schema column.TableSchema, name string) Range {
+	rng := Range{Exact: true}
+	for _, cond := range conjunctions(filter) {
+		infix, ok := cond.(*Infix)
+		if !ok {
+			rng.Exact = false
+			continue
+		}
+		operator, operand, value := infix.operator, infix.left, infix.right
+		// `3 < a` is the same as `a > 3`
+		if isConstant(operand) {
+			operand, value = value, operand
+			switch operator {
+			case tokenLt:
+				operator = tokenGt
+			case tokenLte:
+				operator = tokenGte
+			case tokenGt:
+				operator = tokenLt
+			case tokenGte:
+				operator = tokenLte
+			}
+		}
+		idn, ok := operand.(*Identifier)
+		if !ok || !isConstant(value) {
+			rng.Exact = false
+			continue
+		}
+		if cols := ColumnsUsed(idn, schema); len(cols) != 1 || cols[0] != name {
+			rng.Exact = false
+			continue
+		}
+		switch operator {
+		case tokenEq:
+			rng.Lower = append(rng.Lower, Bound{value, true})
+			rng.Upper = append(rng.Upper, Bound{value, true})
+			rng.Points = append(rng.Points, value)
+		case tokenGt, tokenGte:
+			rng.Lower = append(rng.Lower, Bound{value, operator == tokenGte})
+		case tokenLt, tokenLte:
+			rng.Upper = append(rng.Upper, Bound{value, operator == tokenLte})
+		default:
+			rng.Exact = false
+		}
+	}
+	return rng
+}
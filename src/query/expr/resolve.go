@@ -0,0 +1,103 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errUnknownIdentifier = errs.New(errs.ErrBadRequest, "unknown identifier")
+
+// UnknownIdentifierError reports an identifier that doesn't refer to any column of a given schema,
+// suggesting the closest column name, if there is one close enough (e.g. a typo or a missing 's')
+type UnknownIdentifierError struct {
+	Name       string
+	Suggestion string
+}
+
+func (e *UnknownIdentifierError) Error() string {
+	if e.Suggestion == "" {
+		return fmt.Sprintf("%v: %v", errUnknownIdentifier, e.Name)
+	}
+	return fmt.Sprintf("%v: %v (did you mean %v?)", errUnknownIdentifier, e.Name, e.Suggestion)
+}
+
+func (e *UnknownIdentifierError) Unwrap() error {
+	return errUnknownIdentifier
+}
+
+// ResolveIdentifiers checks that all identifiers in given expressions refer to columns in
+// a schema, so that queries fail before any data get read (and with a helpful error), it
+// returns an UnknownIdentifierError for the first one that doesn't
+// TODO(joins): this suffers from the same issues as ColumnsUsed (namespaces are ignored)
+func ResolveIdentifiers(schema column.TableSchema, exprs ...Expression) error {
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		if idf, ok := expr.(*Identifier); ok && idf.Name != "*" {
+			if _, err := idf.ReturnType(schema); err != nil {
+				return &UnknownIdentifierError{Name: idf.String(), Suggestion: suggestColumn(idf.Name, schema)}
+			}
+		}
+		if err := ResolveIdentifiers(schema, expr.Children()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suggestColumn finds the column closest to a given name, ignoring casing, names more than
+// a third of their length (or two edits) away are not deemed similar
+func suggestColumn(name string, schema column.TableSchema) string {
+	name = strings.ToLower(name)
+	maxDistance := len(name) / 3
+	if maxDistance > 2 {
+		maxDistance = 2
+	}
+	var suggestion string
+	best := maxDistance + 1
+	for _, col := range schema {
+		if dist := editDistance(name, strings.ToLower(col.Name)); dist < best {
+			best, suggestion = dist, col.Name
+		}
+	}
+	if suggestion != "" && needsQuoting(suggestion) {
+		return NewIdentifier(suggestion).String()
+	}
+	return suggestion
+}
+
+// editDistance is the Levenshtein distance of two strings (computed over bytes, which is enough
+// for our purposes - column names tend to be ASCII)
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,78 @@
+package expr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kokes/smda/src/column"
+)
+
+func TestResolvingIdentifiers(t *testing.T) {
+	schema := column.TableSchema{
+		{Name: "price", Dtype: column.DtypeFloat},
+		{Name: "quantity", Dtype: column.DtypeInt},
+		{Name: "Customer Name", Dtype: column.DtypeString},
+		{Name: "id", Dtype: column.DtypeInt},
+	}
+	tests := []struct {
+		raw        string
+		unknown    string // empty if all identifiers resolve
+		suggestion string
+	}{
+		{"price * quantity", "", ""},
+		{"PRICE", "", ""},
+		{`"Customer Name"`, "", ""},
+		{"sum(price) > 10 AND id IN (1, 2)", "", ""},
+		{"*", "", ""},
+		{"prices", "prices", "price"},
+		{"1 + sum(quantiy)", "quantiy", "quantity"},
+		{"upper(customer_name)", "customer_name", `"Customer Name"`},
+		{`"Price"`, `"Price"`, "price"},
+		{"idx", "idx", "id"},
+		{"ix", "ix", ""}, // too short for a suggestion
+		{"volume", "volume", ""},
+	}
+	for _, test := range tests {
+		ex, err := ParseStringExpr(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ResolveIdentifiers(schema, ex)
+		if test.unknown == "" {
+			if err != nil {
+				t.Errorf("expecting %v to resolve, got %v", test.raw, err)
+			}
+			continue
+		}
+		var unknown *UnknownIdentifierError
+		if !errors.As(err, &unknown) || !errors.Is(err, errUnknownIdentifier) {
+			t.Errorf("expecting %v not to resolve, got %v", test.raw, err)
+			continue
+		}
+		if unknown.Name != test.unknown || unknown.Suggestion != test.suggestion {
+			t.Errorf("expecting %v to report %v (suggesting %q), got %v (suggesting %q)", test.raw, test.unknown, test.suggestion, unknown.Name, unknown.Suggestion)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"price", "price", 0},
+		{"price", "prices", 1},
+		{"quantiy", "quantity", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if dist := editDistance(test.a, test.b); dist != test.distance {
+			t.Errorf("expecting the distance of %q and %q to be %v, got %v", test.a, test.b, test.distance, dist)
+		}
+		if dist := editDistance(test.b, test.a); dist != test.distance {
+			t.Errorf("expecting the distance of %q and %q to be %v, got %v", test.b, test.a, test.distance, dist)
+		}
+	}
+}
@@ -2,17 +2,18 @@ package expr
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/kokes/smda/src/errs"
 )
 
-var errUnknownToken = errors.New("unknown token")
-var errInvalidInteger = errors.New("invalid integer")
-var errInvalidFloat = errors.New("invalid floating point number")
-var errInvalidString = errors.New("invalid string literal")
-var errInvalidIdentifier = errors.New("invalid identifier")
+var errUnknownToken = errs.New(errs.ErrBadRequest, "unknown token")
+var errInvalidInteger = errs.New(errs.ErrBadRequest, "invalid integer")
+var errInvalidFloat = errs.New(errs.ErrBadRequest, "invalid floating point number")
+var errInvalidString = errs.New(errs.ErrBadRequest, "invalid string literal")
+var errInvalidIdentifier = errs.New(errs.ErrBadRequest, "invalid identifier")
 
 type tokenType uint8
 
@@ -29,6 +30,7 @@ const (
 	tokenComment
 	tokenDot
 	// keywords:
+	tokenExplain
 	tokenSelect
 	tokenFrom
 	tokenAt
@@ -43,12 +45,16 @@ const (
 	tokenGroup
 	tokenBy
 	tokenLimit
+	tokenOffset
 	tokenOrder
 	tokenAsc
 	tokenDesc
 	tokenNulls
 	tokenFirst
 	tokenLast
+	tokenUnion
+	tokenAll
+	tokenTablesample
 	// non-select keywords:
 	tokenAnd
 	tokenOr
@@ -65,6 +71,7 @@ const (
 	tokenCase
 	tokenWhen
 	tokenEnd
+	tokenInterval
 	// keywords end
 	tokenAdd
 	tokenSub
@@ -76,12 +83,15 @@ const (
 	tokenLt
 	tokenGte
 	tokenLte
+	tokenRegex  // ~
+	tokenIregex // ~*, a case insensitive ~
 	tokenLparen
 	tokenRparen
 	tokenComma
 	tokenLiteralInt
 	tokenLiteralFloat
 	tokenLiteralString
+	tokenPlaceholder
 	tokenEOF // to signify end of parsing
 	// potential additions: || (string concatenation), :: (casting), &|^ (bitwise operations), ** (power)
 )
@@ -102,18 +112,25 @@ var keywords = map[string]tokenType{
 	"case":     tokenCase,
 	"when":     tokenWhen,
 	"end":      tokenEnd,
+	"interval": tokenInterval,
+	"explain":  tokenExplain,
 	"select":   tokenSelect,
 	"from":     tokenFrom,
 	"where":    tokenWhere,
 	"group":    tokenGroup,
 	"by":       tokenBy,
 	"limit":    tokenLimit,
+	"offset":   tokenOffset,
 	"order":    tokenOrder,
 	"asc":      tokenAsc,
 	"desc":     tokenDesc,
 	"nulls":    tokenNulls,
 	"first":    tokenFirst,
 	"last":     tokenLast,
+	"union":    tokenUnion,
+	"all":      tokenAll,
+	// sampling methods (BERNOULLI, SYSTEM) are not keywords, so that they can still be used as names
+	"tablesample": tokenTablesample,
 }
 
 // ARCH: it might be useful to just use .value in most cases here
@@ -157,6 +174,10 @@ func (tok token) String() string {
 		return "WHEN"
 	case tokenEnd:
 		return "END"
+	case tokenInterval:
+		return "INTERVAL"
+	case tokenExplain:
+		return "EXPLAIN"
 	case tokenSelect:
 		return "SELECT"
 	case tokenFrom:
@@ -171,6 +192,8 @@ func (tok token) String() string {
 		return "BY"
 	case tokenLimit:
 		return "LIMIT"
+	case tokenOffset:
+		return "OFFSET"
 	case tokenOrder:
 		return "ORDER"
 	case tokenAsc:
@@ -183,6 +206,12 @@ func (tok token) String() string {
 		return "FIRST"
 	case tokenLast:
 		return "LAST"
+	case tokenUnion:
+		return "UNION"
+	case tokenAll:
+		return "ALL"
+	case tokenTablesample:
+		return "TABLESAMPLE"
 	case tokenAdd:
 		return "+"
 	case tokenSub:
@@ -203,6 +232,10 @@ func (tok token) String() string {
 		return ">="
 	case tokenLte:
 		return "<="
+	case tokenRegex:
+		return "~"
+	case tokenIregex:
+		return "~*"
 	case tokenLparen:
 		return "("
 	case tokenRparen:
@@ -216,6 +249,8 @@ func (tok token) String() string {
 	case tokenLiteralString:
 		escaped := bytes.ReplaceAll(tok.value, []byte("'"), []byte("\\'"))
 		return fmt.Sprintf("'%s'", escaped)
+	case tokenPlaceholder:
+		return "?"
 	case tokenInvalid:
 		return "invalid_token"
 	case tokenEOF:
@@ -340,6 +375,14 @@ func (ts *tokenScanner) scan() (token, error) {
 		}
 		ts.position++
 		return token{tokenGt, nil}, nil
+	case '~':
+		next := ts.peek(2)
+		if bytes.Equal(next, []byte("~*")) {
+			ts.position += 2
+			return token{tokenIregex, nil}, nil
+		}
+		ts.position++
+		return token{tokenRegex, nil}, nil
 	case '!':
 		next := ts.peek(2)
 		if bytes.Equal(next, []byte("!=")) {
@@ -370,6 +413,9 @@ func (ts *tokenScanner) scan() (token, error) {
 	case '@':
 		ts.position++
 		return token{tokenAt, nil}, nil
+	case '?':
+		ts.position++
+		return token{tokenPlaceholder, nil}, nil
 	case '\'': // string literal
 		return ts.consumeStringLiteral()
 	default:
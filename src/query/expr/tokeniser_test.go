@@ -26,6 +26,9 @@ func TestBasicTokenisation(t *testing.T) {
 		{"*<>", []tokenType{tokenMul, tokenNeq}},
 		{"*,*", []tokenType{tokenMul, tokenComma, tokenMul}},
 		{"- -", []tokenType{tokenSub, tokenSub}},
+		{"~", []tokenType{tokenRegex}},
+		{"~*", []tokenType{tokenIregex}},
+		{"~ *", []tokenType{tokenRegex, tokenMul}},
 	}
 
 	for _, test := range tt {
@@ -95,6 +98,8 @@ func TestTokenisationWithValues(t *testing.T) {
 		{"2.3e2 + 3e12", []token{{tokenLiteralFloat, []byte("2.3e2")}, {tokenAdd, nil}, {tokenLiteralFloat, []byte("3e12")}}},
 		{"2.3e2 - 3e12", []token{{tokenLiteralFloat, []byte("2.3e2")}, {tokenSub, nil}, {tokenLiteralFloat, []byte("3e12")}}},
 		{"''", []token{{tokenLiteralString, []byte("")}}},
+		{"foo=?", []token{{tokenIdentifier, []byte("foo")}, {tokenEq, nil}, {tokenPlaceholder, nil}}},
+		{"(?,?)", []token{{tokenLparen, nil}, {tokenPlaceholder, nil}, {tokenComma, nil}, {tokenPlaceholder, nil}, {tokenRparen, nil}}},
 		{"'ahoy'*", []token{{tokenLiteralString, []byte("ahoy")}, {tokenMul, nil}}},
 		{"''''*", []token{{tokenLiteralString, []byte("'")}, {tokenMul, nil}}},
 		{"''''''*", []token{{tokenLiteralString, []byte("''")}, {tokenMul, nil}}},
@@ -248,6 +253,7 @@ func TestTokenisationStringer(t *testing.T) {
 		{"foo-bar*2", "foo - bar * 2"},
 		{"Foo+Bar", "Foo + Bar"},
 		{"coalesce(1,2,3)", "coalesce ( 1 , 2 , 3 )"},
+		{"foo in (?,?)", "foo IN ( ? , ? )"},
 		// {"count(distinct foo)", "COUNT(DISTINCT foo)"},
 	}
 
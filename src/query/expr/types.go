@@ -5,28 +5,43 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/kokes/smda/src/bitmap"
 	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
 )
 
-var errWrongNumberofArguments = errors.New("wrong number arguments passed to a function")
-var errWrongArgumentType = errors.New("wrong argument type passed to a function")
-var errEmptyTuple = errors.New("tuple cannot be empty")
-var errTupleTypeMismatch = errors.New("all values in a tuple must be the same")
-var errDistinctInProjection = errors.New("cannot use DISTINCT in a non-aggregating function")
+var errWrongNumberofArguments = errs.New(errs.ErrBadRequest, "wrong number arguments passed to a function")
+var errWrongArgumentType = errs.New(errs.ErrBadRequest, "wrong argument type passed to a function")
+var errUnboundPlaceholder = errs.New(errs.ErrBadRequest, "query parameter not bound")
+var errEmptyTuple = errs.New(errs.ErrBadRequest, "tuple cannot be empty")
+var errTupleTypeMismatch = errs.New(errs.ErrBadRequest, "all values in a tuple must be the same")
+var errTupleNotConstant = errs.New(errs.ErrBadRequest, "tuples can only contain constants")
+var errDistinctInProjection = errs.New(errs.ErrBadRequest, "cannot use DISTINCT in a non-aggregating function")
+var errIntervalArithmetic = errs.New(errs.ErrBadRequest, "intervals can only be added to or subtracted from dates and datetimes")
+var errUnresolvedSubquery = errors.New("subquery not resolved")
+var errSubqueryColumns = errs.New(errs.ErrBadRequest, "subqueries need to return a single column")
+var errScalarSubqueryRows = errs.New(errs.ErrBadRequest, "scalar subqueries cannot return more than one row")
 
 type Dataset struct {
-	Name    string
-	Version string
-	Latest  bool
-	alias   *Identifier // TODO(next): not a huge fan of this type
+	Namespace string // empty for the default namespace
+	Name      string
+	Version   string
+	Latest    bool
+	alias     *Identifier // TODO(next): not a huge fan of this type
+}
+
+// QualifiedName is how the dataset is looked up in the database (see database.QualifiedName)
+func (ex *Dataset) QualifiedName() string {
+	return database.QualifiedName(ex.Namespace, ex.Name)
 }
 
 func (ex *Dataset) String() string {
 	if ex.Latest {
-		return ex.Name
+		return ex.QualifiedName()
 	}
 
-	return fmt.Sprintf("%v@v%v", ex.Name, ex.Version)
+	return fmt.Sprintf("%v@v%v", ex.QualifiedName(), ex.Version)
 }
 
 type Identifier struct {
@@ -175,37 +190,104 @@ func (ex *Null) Children() []Expression {
 	return nil
 }
 
+// Interval is an `INTERVAL '7 days'` literal, it cannot be evaluated on its own, it can only
+// shift dates and datetimes (see Infix)
+type Interval struct {
+	raw   string
+	value column.Interval
+}
+
+func (ex *Interval) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	return column.Schema{}, errIntervalArithmetic
+}
+func (ex *Interval) String() string {
+	return fmt.Sprintf("INTERVAL '%s'", ex.raw)
+}
+func (ex *Interval) Children() []Expression {
+	return nil
+}
+
+// Placeholder is a `?` in a query, it gets replaced by a literal value once we bind query
+// parameters (see Query.Bind), so that user supplied values never need to be interpolated in SQL
+type Placeholder struct {
+	position int // 1-based, in order of appearance
+	value    Expression
+}
+
+func (ex *Placeholder) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	if ex.value == nil {
+		return column.Schema{}, fmt.Errorf("%w: parameter %v", errUnboundPlaceholder, ex.position)
+	}
+	return ex.value.ReturnType(ts)
+}
+// once bound, placeholders print as their values, so that queries with different parameters
+// don't stringify the same (we use this for caching)
+func (ex *Placeholder) String() string {
+	if ex.value != nil {
+		return ex.value.String()
+	}
+	return "?"
+}
+func (ex *Placeholder) Children() []Expression {
+	return nil
+}
+
 type Tuple struct {
 	inner []Expression
 }
 
 // this is a bit weird, because a Tuple is a container, it doesn't "return" anything,
 // so we'll just return the homogenous type it contains
-// so (1, 2, 3) -> int, (1, 2.0, 3) -> float, (1, 'foo', 3) -> err
-// TODO/ARCH: we don't worry if these are all literals... should we? Or should we leave that to eval?
+// so (1, 2, 3) -> int, (1, 2.0, 3) -> float, (1, 'foo', 3) -> err, nulls go with anything,
+// (1, NULL) -> int. Tuples only contain constants, they get turned into sets (see valueSet).
 func (ex *Tuple) ReturnType(ts column.TableSchema) (column.Schema, error) {
 	// this is already prohibited by the parser, but let's be on the safe side
 	if len(ex.inner) == 0 {
 		return column.Schema{}, errEmptyTuple
 	}
-	first, err := ex.inner[0].ReturnType(ts)
-	if err != nil {
-		return column.Schema{}, err
-	}
-	settled := first.Dtype
-	for _, el := range ex.inner[1:] {
+	var types []column.Dtype
+	for _, el := range ex.inner {
+		if !isConstant(el) {
+			return column.Schema{}, fmt.Errorf("%w: %v", errTupleNotConstant, el)
+		}
 		rv, err := el.ReturnType(ts)
 		if err != nil {
 			return column.Schema{}, err
 		}
-		// TODO(next): implement isNumericType/compatibleTypes or something along those lines to support (1, 2.0, 3)
-		if rv.Dtype != settled {
-			return column.Schema{}, errTupleTypeMismatch
+		if rv.Dtype != column.DtypeNull {
+			types = append(types, rv.Dtype)
 		}
 	}
+	if len(types) == 0 {
+		return column.Schema{Dtype: column.DtypeNull}, nil
+	}
+	settled, err := coalesceType(types...)
+	if err != nil {
+		return column.Schema{}, errTupleTypeMismatch
+	}
 	return column.Schema{Dtype: settled}, nil
 }
 
+// valueSet evaluates all the values of a tuple and collects them in a set, so that `foo IN (...)`
+// is a lookup for each value of `foo` rather than a comparison with each value of the tuple
+// OPTIM: we build the set each time we evaluate the tuple (i.e. for each stripe), we could build
+// it just once per query, but tuples tend to be short
+func (ex *Tuple) valueSet() (*column.ValueSet, error) {
+	rt, err := ex.ReturnType(nil)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*column.Chunk, 0, len(ex.inner))
+	for _, el := range ex.inner {
+		value, err := Evaluate(el, 1, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return column.NewValueSetFromLiterals(rt.Dtype, values...)
+}
+
 func (ex *Tuple) String() string {
 	var sb strings.Builder
 	sb.WriteByte('(')
@@ -223,13 +305,81 @@ func (ex *Tuple) Children() []Expression {
 	return ex.inner
 }
 
+// Subquery is a SELECT nested in an expression, it's either a scalar subquery (e.g. `(SELECT max(foo) FROM bar)`),
+// which stands for a single value, or it is on the right hand side of an IN clause (`foo IN (SELECT bar FROM baz)`),
+// in which case it stands for a set of values. Subqueries cannot refer to columns of outer queries, so they
+// get run just once, before the outer query, and their results are stored here (see SetResult)
+type Subquery struct {
+	Query  Query
+	scalar bool
+	value  *column.Chunk    // scalar subqueries
+	set    *column.ValueSet // IN subqueries
+}
+
+// SetResult stores the results of a subquery, it validates their shape (a single column and,
+// for scalar subqueries, at most one row)
+func (ex *Subquery) SetResult(schema column.TableSchema, data *column.Chunk) error {
+	if len(schema) != 1 {
+		return fmt.Errorf("%w: got %v", errSubqueryColumns, len(schema))
+	}
+	if !ex.scalar {
+		set, err := column.NewValueSet(data)
+		if err != nil {
+			return err
+		}
+		ex.set = set
+		return nil
+	}
+	switch data.Len() {
+	case 0:
+		// no rows mean a NULL, but a NULL of the subquery's type, so that comparisons with it are
+		// unknown (a null literal would get special cased, `x = NULL` is evaluated as `x IS NULL`)
+		value := column.NewChunk(schema[0].Dtype)
+		if err := value.AddValue(""); err != nil {
+			return err
+		}
+		// strings get loaded as empty strings, not as nulls (null columns have no nullability)
+		if value.Dtype() != column.DtypeNull {
+			value.Nullability = bitmap.NewBitmap(1)
+			value.Nullability.Set(0, true)
+		}
+		ex.value = value
+	case 1:
+		ex.value = data
+	default:
+		return fmt.Errorf("%w: got %v", errScalarSubqueryRows, data.Len())
+	}
+	return nil
+}
+
+func (ex *Subquery) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	switch {
+	case ex.value != nil:
+		return column.Schema{Name: ex.String(), Dtype: ex.value.Dtype(), Nullable: true}, nil
+	case ex.set != nil:
+		// like tuples, sets don't really return anything, we only report the type of their values
+		return column.Schema{Dtype: ex.set.Dtype()}, nil
+	}
+	return column.Schema{}, fmt.Errorf("%w: %v", errUnresolvedSubquery, ex)
+}
+
+func (ex *Subquery) String() string {
+	return fmt.Sprintf("(%v)", ex.Query)
+}
+
+// subqueries are evaluated separately, so they are leaves in our expression trees
+func (ex *Subquery) Children() []Expression {
+	return nil
+}
+
 type Function struct {
 	name              string
 	distinct          bool
 	args              []Expression
 	evaler            func(...*column.Chunk) (*column.Chunk, error)
-	aggregator        *column.AggState
+	aggregator        *Aggregator // see InitAggregator
 	aggregatorFactory func(...column.Dtype) (*column.AggState, error)
+	filter            Expression // only rows satisfying it get aggregated, see `FILTER (WHERE ...)`
 }
 
 // NewFunction is one of the very few constructors as we have to do some fiddling here
@@ -241,6 +391,10 @@ func NewFunction(name string, distinct bool) (*Function, error) {
 			return nil, fmt.Errorf("%w: %v", errDistinctInProjection, name)
 		}
 		ex.evaler = fncp
+		if name == "regexp_matches" {
+			// each call gets its own matcher, so that the pattern gets compiled only once per query
+			ex.evaler = new(column.RegexpMatcher).Eval
+		}
 	} else {
 		// if it's not a projection, it must be an aggregator
 		// ARCH: cannot initialise the aggregator here, because we don't know
@@ -272,6 +426,15 @@ func (ex *Function) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		}
 		argTypes = append(argTypes, ctype)
 	}
+	if ex.filter != nil {
+		ftype, err := ex.filter.ReturnType(ts)
+		if err != nil {
+			return schema, err
+		}
+		if ftype.Dtype != column.DtypeBool {
+			return schema, fmt.Errorf("%w: expecting a boolean condition, got %v", errInvalidFilterClause, ftype.Dtype)
+		}
+	}
 	switch ex.name {
 	case "now":
 		if len(argTypes) != 0 {
@@ -291,18 +454,28 @@ func (ex *Function) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		}
 		schema.Dtype = column.DtypeInt
 		schema.Nullable = false
+	case "approx_count_distinct":
+		if len(argTypes) != 1 {
+			return schema, errWrongNumberofArguments
+		}
+		schema.Dtype = column.DtypeInt
+		schema.Nullable = false
 	case "min", "max":
 		if len(argTypes) != 1 {
 			return schema, errWrongNumberofArguments
 		}
+		// ordering of JSON values is not defined, bools have no aggregators (yet)
+		if argTypes[0].Dtype == column.DtypeBool || argTypes[0].Dtype == column.DtypeJSON {
+			return schema, errWrongArgumentType
+		}
 		schema.Dtype = argTypes[0].Dtype
 		schema.Nullable = argTypes[0].Nullable
 	case "sum":
 		if len(argTypes) != 1 {
 			return schema, errWrongNumberofArguments
 		}
-		// ARCH: isNumericType or something?
-		if argTypes[0].Dtype != column.DtypeFloat && argTypes[0].Dtype != column.DtypeInt {
+		// sums of nulls are nulls
+		if !isNumericType(argTypes[0].Dtype) && argTypes[0].Dtype != column.DtypeNull {
 			return schema, errWrongArgumentType
 		}
 		schema.Dtype = argTypes[0].Dtype
@@ -318,6 +491,32 @@ func (ex *Function) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		// TODO(next): check arg for a numeric type (and fix where we mention "isNumericType")
 		// and do this for sin/cos etc.
 		schema.Dtype = column.DtypeFloat // average of integers will be a float
+		if argTypes[0].Dtype == column.DtypeNull {
+			schema.Dtype = column.DtypeNull
+		}
+		schema.Nullable = argTypes[0].Nullable
+	case "var_samp", "variance", "var_pop", "stddev_samp", "stddev", "stddev_pop", "median":
+		if len(argTypes) != 1 {
+			return schema, errWrongNumberofArguments
+		}
+		if !isNumericType(argTypes[0].Dtype) {
+			return schema, errWrongArgumentType
+		}
+		schema.Dtype = column.DtypeFloat
+		// sample statistics of a single value are undefined
+		schema.Nullable = argTypes[0].Nullable || ex.name == "var_samp" || ex.name == "variance" ||
+			ex.name == "stddev_samp" || ex.name == "stddev"
+	case "percentile":
+		if len(argTypes) != 2 {
+			return schema, errWrongNumberofArguments
+		}
+		if !isNumericType(argTypes[0].Dtype) {
+			return schema, errWrongArgumentType
+		}
+		if _, err := quantileArgument(ex.args[1]); err != nil {
+			return schema, err
+		}
+		schema.Dtype = column.DtypeFloat
 		schema.Nullable = argTypes[0].Nullable
 	case "sin", "cos", "tan", "asin", "acos", "atan", "sinh", "cosh", "tanh", "sqrt", "exp", "exp2", "log", "log2", "log10":
 		if len(argTypes) != 1 {
@@ -331,6 +530,9 @@ func (ex *Function) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		}
 		// OPTIM: in case len(argTypes) == 1 && DtypeInt, we could make this a noop
 		schema.Dtype = column.DtypeFloat
+		if argTypes[0].Dtype == column.DtypeDecimal {
+			schema.Dtype = column.DtypeDecimal
+		}
 		schema.Nullable = argTypes[0].Nullable
 	case "nullif":
 		if len(argTypes) != 2 {
@@ -370,6 +572,45 @@ func (ex *Function) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		}
 		schema.Dtype = column.DtypeString
 		schema.Nullable = argTypes[0].Nullable
+	case "regexp_matches":
+		if len(argTypes) != 2 && len(argTypes) != 3 {
+			return schema, errWrongNumberofArguments
+		}
+		if !validRegexpArgs(ex.args[1], argTypes[0], argTypes[1]) {
+			return schema, errWrongArgumentType
+		}
+		if len(argTypes) == 3 {
+			if !isLiteralish(ex.args[2]) || argTypes[2].Dtype != column.DtypeString {
+				return schema, errWrongArgumentType
+			}
+		}
+		schema.Dtype = column.DtypeBool
+		schema.Nullable = argTypes[0].Nullable || argTypes[1].Nullable || argTypes[0].Dtype == column.DtypeNull || argTypes[1].Dtype == column.DtypeNull
+	case "json_extract":
+		if len(argTypes) != 2 && len(argTypes) != 3 {
+			return schema, errWrongNumberofArguments
+		}
+		if !(argTypes[0].Dtype == column.DtypeJSON || argTypes[0].Dtype == column.DtypeString || argTypes[0].Dtype == column.DtypeNull) {
+			return schema, errWrongArgumentType
+		}
+		if !isLiteralish(ex.args[1]) || argTypes[1].Dtype != column.DtypeString {
+			return schema, errWrongArgumentType
+		}
+		dtype := column.DtypeJSON
+		if len(argTypes) == 3 {
+			typ, ok := ex.args[2].(*String)
+			if !ok {
+				return schema, errWrongArgumentType
+			}
+			var err error
+			dtype, err = column.CastType(typ.value)
+			if err != nil {
+				return schema, err
+			}
+		}
+		schema.Dtype = dtype
+		// values can be missing in any document
+		schema.Nullable = true
 	case "left":
 		if len(argTypes) != 2 {
 			return schema, errWrongNumberofArguments
@@ -397,9 +638,102 @@ func (ex *Function) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		}
 		schema.Dtype = column.DtypeString
 		schema.Nullable = argTypes[0].Nullable
+	case "concat":
+		if len(argTypes) == 0 {
+			return schema, errWrongNumberofArguments
+		}
+		for _, arg := range argTypes {
+			if arg.Dtype != column.DtypeString && arg.Dtype != column.DtypeNull {
+				return schema, errWrongArgumentType
+			}
+		}
+		schema.Dtype = column.DtypeString
+		schema.Nullable = false // nulls are ignored
+	case "replace":
+		if len(argTypes) != 3 {
+			return schema, errWrongNumberofArguments
+		}
+		for _, arg := range argTypes {
+			if arg.Dtype != column.DtypeString {
+				return schema, errWrongArgumentType
+			}
+		}
+		schema.Dtype = column.DtypeString
+		schema.Nullable = argTypes[0].Nullable
+	case "length":
+		if len(argTypes) != 1 {
+			return schema, errWrongNumberofArguments
+		}
+		if argTypes[0].Dtype != column.DtypeString {
+			return schema, errWrongArgumentType
+		}
+		schema.Dtype = column.DtypeInt
+		schema.Nullable = argTypes[0].Nullable
+	case "date_trunc", "date_part", "date_diff":
+		nargs := 2
+		if ex.name == "date_diff" {
+			nargs = 3
+		}
+		if len(argTypes) != nargs {
+			return schema, errWrongNumberofArguments
+		}
+		// units/fields need to be literals, we validate their values during evaluation
+		if _, ok := ex.args[0].(*String); !ok {
+			return schema, errWrongArgumentType
+		}
+		for _, arg := range argTypes[1:] {
+			if arg.Dtype != column.DtypeDate && arg.Dtype != column.DtypeDatetime {
+				return schema, errWrongArgumentType
+			}
+			schema.Nullable = schema.Nullable || arg.Nullable
+		}
+		schema.Dtype = column.DtypeInt
+		if ex.name == "date_trunc" {
+			schema.Dtype = argTypes[1].Dtype
+		}
+	case "cast":
+		typ, ok := ex.castType()
+		if !ok {
+			return schema, errWrongNumberofArguments
+		}
+		dtype, err := column.CastType(typ)
+		if err != nil {
+			return schema, err
+		}
+		schema.Dtype = dtype
+		// empty strings become nulls in all other types, so do JSON nulls
+		schema.Nullable = argTypes[0].Nullable || argTypes[0].Dtype == column.DtypeNull ||
+			(argTypes[0].Dtype == column.DtypeString && dtype != column.DtypeString) || argTypes[0].Dtype == column.DtypeJSON
+	case "toint", "tofloat", "tostring", "todate":
+		if len(argTypes) != 1 {
+			return schema, errWrongNumberofArguments
+		}
+		schema.Dtype = map[string]column.Dtype{
+			"toint": column.DtypeInt, "tofloat": column.DtypeFloat, "tostring": column.DtypeString, "todate": column.DtypeDate,
+		}[ex.name]
+		// values that cannot be converted become nulls (this cannot happen when converting into strings)
+		schema.Nullable = argTypes[0].Nullable || argTypes[0].Dtype == column.DtypeNull || ex.name != "tostring"
+	case "substr":
+		if len(argTypes) != 2 && len(argTypes) != 3 {
+			return schema, errWrongNumberofArguments
+		}
+		if argTypes[0].Dtype != column.DtypeString {
+			return schema, errWrongArgumentType
+		}
+		for _, arg := range argTypes[1:] {
+			if arg.Dtype != column.DtypeInt {
+				return schema, errWrongArgumentType
+			}
+		}
+		schema.Dtype = column.DtypeString
+		schema.Nullable = argTypes[0].Nullable
 	default:
 		return schema, fmt.Errorf("unsupported function: %v", ex.name)
 	}
+	// groups with no rows satisfying a filter have nothing to aggregate (counts are zero then)
+	if ex.filter != nil && ex.name != "count" && ex.name != "approx_count_distinct" {
+		schema.Nullable = true
+	}
 
 	return schema, nil
 }
@@ -408,14 +742,37 @@ func (ex *Function) String() string {
 	for _, ch := range ex.args {
 		args = append(args, ch.String())
 	}
+	// CAST has its own syntax, its type is a string literal internally
+	if typ, ok := ex.castType(); ok {
+		return fmt.Sprintf("CAST(%s AS %s)", args[0], typ)
+	}
 	var distinct string
 	if ex.distinct {
 		distinct = "DISTINCT "
 	}
 
-	return fmt.Sprintf("%s(%s%s)", ex.name, distinct, strings.Join(args, ", "))
+	call := fmt.Sprintf("%s(%s%s)", ex.name, distinct, strings.Join(args, ", "))
+	if ex.filter != nil {
+		return fmt.Sprintf("%s FILTER (WHERE %s)", call, ex.filter)
+	}
+	return call
+}
+
+// castType returns the target type of a CAST expression (a cast function with a string literal type)
+func (ex *Function) castType() (string, bool) {
+	if ex.name != "cast" || len(ex.args) != 2 {
+		return "", false
+	}
+	typ, ok := ex.args[1].(*String)
+	if !ok {
+		return "", false
+	}
+	return typ.value, true
 }
 func (ex *Function) Children() []Expression {
+	if ex.filter != nil {
+		return append(ex.args[:len(ex.args):len(ex.args)], ex.filter)
+	}
 	return ex.args
 }
 
@@ -433,7 +790,7 @@ func (ex *Prefix) ReturnType(ts column.TableSchema) (column.Schema, error) {
 			return schema, err
 		}
 		// TODO/ARCH: we check for numerical types in various places, unify it
-		if !(ch.Dtype == column.DtypeInt || ch.Dtype == column.DtypeFloat) {
+		if !isNumericType(ch.Dtype) {
 			return schema, errTypeMismatch
 		}
 
@@ -466,10 +823,37 @@ func (ex *Prefix) Children() []Expression {
 	return []Expression{ex.right}
 }
 
+// NullTest is `foo IS NULL` (or `foo IS NOT NULL`), we don't treat it as a comparison against
+// a NULL literal, we evaluate it directly using the nullability of its operand
+type NullTest struct {
+	inner   Expression
+	negated bool
+}
+
+func (ex *NullTest) ReturnType(ts column.TableSchema) (column.Schema, error) {
+	schema := column.Schema{Name: ex.String()}
+	if _, err := ex.inner.ReturnType(ts); err != nil {
+		return schema, err
+	}
+	// values are either null or not, never unknown
+	schema.Dtype = column.DtypeBool
+	return schema, nil
+}
+func (ex *NullTest) String() string {
+	if ex.negated {
+		return fmt.Sprintf("%s IS NOT NULL", ex.inner)
+	}
+	return fmt.Sprintf("%s IS NULL", ex.inner)
+}
+func (ex *NullTest) Children() []Expression {
+	return []Expression{ex.inner}
+}
+
 type Infix struct {
 	operator tokenType
 	left     Expression
 	right    Expression
+	regexp   *column.RegexpMatcher // for ~ and ~*, so that the pattern gets compiled only once per query
 }
 
 func (ex *Infix) ReturnType(ts column.TableSchema) (column.Schema, error) {
@@ -477,6 +861,21 @@ func (ex *Infix) ReturnType(ts column.TableSchema) (column.Schema, error) {
 	// we had columns without names on multiple occasions (oh and test all this)
 	// the issue is that we test ReturnTypes, but we don't test their names
 	schema := column.Schema{Name: ex.String()}
+	if operand, iv, ok := ex.intervalOperands(); ok {
+		t, err := operand.ReturnType(ts)
+		if err != nil {
+			return schema, err
+		}
+		if t.Dtype != column.DtypeDate && t.Dtype != column.DtypeDatetime {
+			return schema, fmt.Errorf("%w: %v", errIntervalArithmetic, t.Dtype)
+		}
+		schema.Dtype = t.Dtype
+		if t.Dtype == column.DtypeDate && iv.value.Microseconds != 0 {
+			schema.Dtype = column.DtypeDatetime
+		}
+		schema.Nullable = t.Nullable
+		return schema, nil
+	}
 	t1, err := ex.left.ReturnType(ts)
 	if err != nil {
 		return schema, err
@@ -498,12 +897,31 @@ func (ex *Infix) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		}
 		schema.Dtype = column.DtypeBool
 		schema.Nullable = t1.Nullable || t2.Nullable
+	case tokenIn:
+		if !comparableTypes(t1.Dtype, t2.Dtype) {
+			return schema, errTypeMismatch
+		}
+		schema.Dtype = column.DtypeBool
+		// nulls on either side can make the result unknown
+		schema.Nullable = true
 	case tokenLike, tokenIlike:
-		if _, ok := ex.right.(*String); !ok {
+		// patterns need to be string literals (or parameters bound to them)
+		_, literal := ex.right.(*String)
+		_, placeholder := ex.right.(*Placeholder)
+		if !(literal || placeholder) || t2.Dtype != column.DtypeString {
 			return schema, errTypeMismatch // ARCH: specify more? wrap?
 		}
+		if !(t1.Dtype == column.DtypeString || t1.Dtype == column.DtypeNull) {
+			return schema, errTypeMismatch
+		}
 		schema.Dtype = column.DtypeBool
 		schema.Nullable = t1.Nullable
+	case tokenRegex, tokenIregex:
+		if !validRegexpArgs(ex.right, t1, t2) {
+			return schema, errTypeMismatch
+		}
+		schema.Dtype = column.DtypeBool
+		schema.Nullable = t1.Nullable || t2.Nullable || t1.Dtype == column.DtypeNull || t2.Dtype == column.DtypeNull
 	case tokenAdd, tokenSub, tokenMul, tokenQuo:
 		if !comparableTypes(t1.Dtype, t2.Dtype) {
 			return schema, errTypeMismatch
@@ -512,6 +930,14 @@ func (ex *Infix) ReturnType(ts column.TableSchema) (column.Schema, error) {
 		if t1.Dtype == column.DtypeNull {
 			schema.Dtype = t2.Dtype
 		}
+		// decimals win over ints (1 + 2.30 = 3.30), but not over floats, we cannot make those exact
+		if t1.Dtype == column.DtypeDecimal || t2.Dtype == column.DtypeDecimal {
+			schema.Dtype = column.DtypeDecimal
+			// decimal division is not exact, so it's computed in floats
+			if ex.operator == tokenQuo {
+				schema.Dtype = column.DtypeFloat
+			}
+		}
 		// for mixed use cases, always resolve it as a float (1 - 2.0 = -1.0)
 		if t1.Dtype == column.DtypeFloat || t2.Dtype == column.DtypeFloat {
 			schema.Dtype = column.DtypeFloat
@@ -522,9 +948,40 @@ func (ex *Infix) ReturnType(ts column.TableSchema) (column.Schema, error) {
 	}
 	return schema, nil
 }
+// intervalOperands detects `date + interval`, `interval + date` and `date - interval`
+func (ex *Infix) intervalOperands() (Expression, *Interval, bool) {
+	if ex.operator != tokenAdd && ex.operator != tokenSub {
+		return nil, nil, false
+	}
+	if iv, ok := ex.right.(*Interval); ok {
+		return ex.left, iv, true
+	}
+	if iv, ok := ex.left.(*Interval); ok && ex.operator == tokenAdd {
+		return ex.right, iv, true
+	}
+	return nil, nil, false
+}
+// regular expressions match strings (or nulls) against patterns, which need to be literals (or parameters
+// bound to them), so that they can be compiled just once per query
+func validRegexpArgs(pattern Expression, value, ptype column.Schema) bool {
+	if !isLiteralish(pattern) {
+		return false
+	}
+	return (value.Dtype == column.DtypeString || value.Dtype == column.DtypeNull) &&
+		(ptype.Dtype == column.DtypeString || ptype.Dtype == column.DtypeNull)
+}
+
+func isLiteralish(expr Expression) bool {
+	switch expr.(type) {
+	case *String, *Null, *Placeholder:
+		return true
+	}
+	return false
+}
+
 func (ex *Infix) String() string {
 	op := token{ttype: ex.operator}.String() // TODO: this is a hack, because we don't have ttype stringers
-	if ex.operator == tokenAnd || ex.operator == tokenOr || ex.operator == tokenIs {
+	if ex.operator == tokenAnd || ex.operator == tokenOr || ex.operator == tokenIs || ex.operator == tokenIn {
 		op = fmt.Sprintf(" %s ", op)
 	}
 	return fmt.Sprintf("%s%s%s", ex.left, op, ex.right)
@@ -1,8 +1,11 @@
 package expr
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+
+	"github.com/kokes/smda/src/column"
 )
 
 func TestNewIdentifier(t *testing.T) {
@@ -39,3 +42,43 @@ func TestIdentifierStringer(t *testing.T) {
 		}
 	}
 }
+
+func TestSubqueryResults(t *testing.T) {
+	ints := column.NewChunkIntsFromSlice([]int64{1, 2}, nil)
+	schema := column.TableSchema{{Name: "foo", Dtype: column.DtypeInt}}
+	tests := []struct {
+		scalar bool
+		schema column.TableSchema
+		data   *column.Chunk
+		dtype  column.Dtype
+		err    error
+	}{
+		{false, schema, ints, column.DtypeInt, nil},
+		{true, schema, column.NewChunkIntsFromSlice([]int64{1}, nil), column.DtypeInt, nil},
+		// no rows make a NULL of the subquery's type
+		{true, schema, column.NewChunkIntsFromSlice(nil, nil), column.DtypeInt, nil},
+		{true, schema, ints, column.DtypeInvalid, errScalarSubqueryRows},
+		{false, append(schema, schema...), ints, column.DtypeInvalid, errSubqueryColumns},
+	}
+	for _, test := range tests {
+		sq := &Subquery{scalar: test.scalar}
+		if _, err := sq.ReturnType(nil); !errors.Is(err, errUnresolvedSubquery) {
+			t.Errorf("expecting unresolved subqueries to have no type, got %v", err)
+		}
+		if err := sq.SetResult(test.schema, test.data); !errors.Is(err, test.err) {
+			t.Errorf("expecting results %+v to result in %v, got %v", test.data, test.err, err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		rtype, err := sq.ReturnType(nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if rtype.Dtype != test.dtype {
+			t.Errorf("expecting subquery results %+v to be of type %v, got %v", test.data, test.dtype, rtype.Dtype)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package query
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// queries get persisted in an internal dataset, so they can be queried like any other data
+// (e.g. `SELECT dataset, count() FROM smda.queries GROUP BY dataset`)
+const (
+	historyNamespace = "smda"
+	historyName      = "queries"
+)
+
+// pending records get persisted once there's enough of them or once the oldest of them is this old
+const historyFlushInterval = time.Minute
+
+var historySchema = column.TableSchema{
+	{Name: "timestamp", Dtype: column.DtypeDatetime},
+	{Name: "sql", Dtype: column.DtypeString},
+	{Name: "dataset", Dtype: column.DtypeString},
+	{Name: "duration_ms", Dtype: column.DtypeFloat},
+	{Name: "bytes_read", Dtype: column.DtypeInt, Nullable: true},
+	{Name: "rows", Dtype: column.DtypeInt, Nullable: true},
+	{Name: "client_ip", Dtype: column.DtypeString},
+	{Name: "error", Dtype: column.DtypeString},
+}
+
+// QueryRecord describes a single executed query, failed queries get recorded as well (they have
+// an error and no bytes read or rows returned)
+type QueryRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	SQL        string    `json:"sql"`
+	Dataset    string    `json:"dataset"` // empty for queries without a dataset (or those that failed to parse)
+	DurationMs float64   `json:"duration_ms"`
+	BytesRead  *int      `json:"bytes_read"`
+	Rows       *int      `json:"rows"`
+	ClientIP   string    `json:"client_ip"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// History records executed queries, it keeps the most recent ones in memory and it periodically
+// appends them to an internal dataset (smda.queries), each append creates a new version of it and
+// the previous version gets dropped.
+// ARCH: records are only persisted once enough of them accumulate (or once they get old), so
+// a crash loses up to `capacity` of them - call Flush before shutting down
+// OPTIM: flushing happens synchronously in whichever Record call triggers it
+type History struct {
+	sync.Mutex
+	db       *database.Database
+	capacity int
+	recent   []QueryRecord // ring buffer, next points to the oldest record (once it's full)
+	next     int
+	pending  []QueryRecord
+	flushMu  sync.Mutex // serialises flushes, so that appends don't race each other
+}
+
+// NewHistory initialises a query history that keeps up to `capacity` recent queries in memory
+// and that persists queries in batches of this size, a non-positive capacity disables it altogether
+func NewHistory(db *database.Database, capacity int) *History {
+	return &History{
+		db:       db,
+		capacity: capacity,
+	}
+}
+
+// NewQueryRecord describes a query that started at a given time and that's just finished, either
+// with a result or with an error
+func NewQueryRecord(sql, clientIP string, started time.Time, res *Result, err error) QueryRecord {
+	rec := QueryRecord{
+		Timestamp:  started.UTC(),
+		SQL:        sql,
+		DurationMs: float64(time.Since(started).Microseconds()) / 1000,
+		ClientIP:   clientIP,
+	}
+	if q, perr := expr.ParseQuerySQL(sql); perr == nil && q.Dataset != nil {
+		rec.Dataset = q.Dataset.QualifiedName()
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		return rec
+	}
+	bytesRead, rows := res.bytesRead, res.Length
+	rec.BytesRead, rec.Rows = &bytesRead, &rows
+	return rec
+}
+
+// Record adds a query to our history, it only returns an error if it triggers a flush that fails
+// (the record is retained and will get persisted with the next flush)
+func (h *History) Record(rec QueryRecord) error {
+	if h.capacity <= 0 {
+		return nil
+	}
+	h.Lock()
+	if len(h.recent) < h.capacity {
+		h.recent = append(h.recent, rec)
+	} else {
+		h.recent[h.next] = rec
+		h.next = (h.next + 1) % h.capacity
+	}
+	h.pending = append(h.pending, rec)
+	flush := len(h.pending) >= h.capacity || time.Since(h.pending[0].Timestamp) > historyFlushInterval
+	h.Unlock()
+
+	if flush {
+		return h.Flush()
+	}
+	return nil
+}
+
+// Recent returns up to `n` most recent queries, the newest first, a non-positive `n` returns
+// all the queries we keep in memory
+func (h *History) Recent(n int) []QueryRecord {
+	h.Lock()
+	defer h.Unlock()
+	if n <= 0 || n > len(h.recent) {
+		n = len(h.recent)
+	}
+	ret := make([]QueryRecord, 0, n)
+	for j := 0; j < n; j++ {
+		idx := (h.next - 1 - j + 2*len(h.recent)) % len(h.recent)
+		ret = append(ret, h.recent[idx])
+	}
+	return ret
+}
+
+// Flush persists all pending records in smda.queries, records that fail to be persisted are
+// kept for the next flush
+func (h *History) Flush() error {
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+	h.Lock()
+	records := h.pending
+	h.pending = nil
+	h.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := h.persist(records); err != nil {
+		h.Lock()
+		h.pending = append(records, h.pending...)
+		h.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (h *History) persist(records []QueryRecord) error {
+	data := make([]*column.Chunk, len(historySchema))
+	for j, col := range historySchema {
+		data[j] = column.NewChunk(col.Dtype)
+	}
+	for _, rec := range records {
+		bytesRead, rows := "", ""
+		if rec.BytesRead != nil {
+			bytesRead = strconv.Itoa(*rec.BytesRead)
+		}
+		if rec.Rows != nil {
+			rows = strconv.Itoa(*rec.Rows)
+		}
+		values := []string{
+			rec.Timestamp.Format("2006-01-02 15:04:05.000000"),
+			rec.SQL,
+			rec.Dataset,
+			strconv.FormatFloat(rec.DurationMs, 'f', -1, 64),
+			bytesRead,
+			rows,
+			rec.ClientIP,
+			rec.Error,
+		}
+		for j, value := range values {
+			if err := data[j].AddValue(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := database.QualifiedName(historyNamespace, historyName)
+	previous, err := h.db.GetDatasetLatest(name)
+	if err != nil {
+		// no queries persisted yet
+		_, err := h.db.StoreResultInNamespace(historyNamespace, historyName, historySchema, data)
+		return err
+	}
+	if _, err := h.db.AppendResult(previous, data); err != nil {
+		return err
+	}
+	// the new version shares all the previous stripes, so this only removes its manifest
+	return h.db.DropDataset(name, previous.ID.String())
+}
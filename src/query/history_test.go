@@ -0,0 +1,134 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+)
+
+func TestQueryHistory(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	history := NewHistory(db, 2)
+	queries := []string{"SELECT a FROM foo", "SELECT 1", "SELECT nope FROM foo"}
+	for _, sql := range queries {
+		started := time.Now()
+		res, err := RunSQL(context.Background(), db, sql)
+		if err := history.Record(NewQueryRecord(sql, "127.0.0.1", started, res, err)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recent := history.Recent(0)
+	if len(recent) != 2 || recent[0].SQL != queries[2] || recent[1].SQL != queries[1] {
+		t.Fatalf("expecting the two most recent queries, the newest first, got %+v", recent)
+	}
+	if recent[0].Error == "" || recent[0].Rows != nil || recent[0].BytesRead != nil || recent[0].Dataset != "foo" {
+		t.Errorf("unexpected record of a failed query: %+v", recent[0])
+	}
+	if recent[1].Error != "" || recent[1].Rows == nil || *recent[1].Rows != 1 || recent[1].Dataset != "" {
+		t.Errorf("unexpected record of a dataless query: %+v", recent[1])
+	}
+	if limited := history.Recent(1); len(limited) != 1 || limited[0] != recent[0] {
+		t.Errorf("expecting a limit to return the newest query, got %+v", limited)
+	}
+
+	// the first two queries got persisted once capacity was reached, the last one is still pending
+	persisted, err := db.GetDatasetLatest("smda.queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if persisted.NRows != 2 {
+		t.Errorf("expecting two queries to be persisted, got %v", persisted.NRows)
+	}
+	if err := history.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// flushing again is a noop
+	if err := history.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := 0
+	for _, ds := range db.Datasets {
+		if ds.QualifiedName() == "smda.queries" {
+			versions++
+		}
+	}
+	if versions != 1 {
+		t.Errorf("expecting previous versions of query history to be dropped, got %v versions", versions)
+	}
+
+	res, err := RunSQL(context.Background(), db, "SELECT sql, dataset, rows, bytes_read > 0, client_ip FROM smda.queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		queries,
+		{"foo", "", "foo"},
+		{"2", "1", ""},
+		{"true", "false", ""},
+		{"127.0.0.1", "127.0.0.1", "127.0.0.1"},
+	}
+	for j, col := range res.Data {
+		ec := column.NewChunk(res.Schema[j].Dtype)
+		if err := ec.AddValues(expected[j]); err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(col, ec) {
+			t.Errorf("expecting column %v of query history to be %v, got %v", res.Schema[j].Name, ec, col)
+		}
+	}
+	if !res.Schema[2].Nullable || res.Schema[3].Dtype != column.DtypeBool {
+		t.Errorf("unexpected query history schema: %+v", res.Schema)
+	}
+}
+
+func TestQueryHistoryDisabled(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	history := NewHistory(db, -1)
+	rec := NewQueryRecord("SELECT 1", "", time.Now(), nil, errors.New("foo"))
+	if err := history.Record(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if recent := history.Recent(0); !reflect.DeepEqual(recent, []QueryRecord{}) {
+		t.Errorf("expecting disabled history not to record anything, got %+v", recent)
+	}
+	if len(db.Datasets) != 0 {
+		t.Errorf("expecting disabled history not to persist anything, got %v datasets", len(db.Datasets))
+	}
+}
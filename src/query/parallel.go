@@ -0,0 +1,216 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+var errWorkerPanicked = errs.New(errs.ErrInternal, "query worker failed unexpectedly")
+
+// stripeScan reads stripes of a dataset to be aggregated - it skips stripes ruled out by bloom
+// filters and it filters rows of all the others. It doesn't hold any state, so stripes can be
+// read concurrently.
+type stripeScan struct {
+	db         *database.Database
+	ds         *database.Dataset
+	filter     expr.Expression
+	columns    []string
+	lengthOnly []string
+	kr         *keyRange
+	lookups    *pointLookups
+	budget     *scanBudget
+}
+
+// scannedStripe holds columns of a stripe and the rows that passed our filter (nil if all did)
+type scannedStripe struct {
+	columns   map[string]*column.Chunk
+	filter    *bitmap.Bitmap
+	matched   int  // rows set in filter (or all of them)
+	pastRange bool // see keyRange
+}
+
+// read reads a given stripe, it returns nil if the stripe can be skipped altogether (the context
+// is only used for timing, see startTimer)
+func (sc *stripeScan) read(ctx context.Context, stripe database.Stripe) (*scannedStripe, database.ReadStats, error) {
+	rctx, stopRead := startTimer(ctx, stageRead)
+	skip, bytesRead, err := sc.lookups.skipStripe(sc.db, sc.ds, stripe)
+	stats := database.ReadStats{BytesRead: bytesRead}
+	if err != nil || skip {
+		stopRead()
+		return nil, stats, err
+	}
+	columnData, colStats, err := sc.db.ReadColumnsFromStripe(sc.ds, stripe, sc.columns, sc.lengthOnly)
+	recordReads(rctx, colStats)
+	stopRead()
+	stats.Add(colStats)
+	if err != nil {
+		return nil, stats, err
+	}
+	if err := sc.budget.add(colStats.BytesRead); err != nil {
+		return nil, stats, err
+	}
+	st := &scannedStripe{columns: columnData, matched: stripe.Length}
+	if sc.filter != nil {
+		_, stopFilter := startTimer(ctx, stageFilter)
+		st.filter, st.matched, st.pastRange, err = filterStripe(sc.db, sc.ds, stripe, sc.filter, sc.kr, columnData)
+		stopFilter()
+		if err != nil {
+			return nil, stats, err
+		}
+	}
+	return st, stats, nil
+}
+
+func mergeable(aggexprs []*expr.Function) bool {
+	for _, aggexpr := range aggexprs {
+		if !aggexpr.Aggregator().Mergeable() {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregateInParallel aggregates stripes of global aggregations (those without GROUP BY, e.g.
+// `SELECT sum(a) FROM t`) concurrently - each worker aggregates the stripes it reads into partial
+// states of our aggregators, these get merged once the worker is done. Partial states need to be
+// mergeable and rows cannot be sampled (samplers are sequential).
+// ARCH: memory budgets are checked for each stripe, but there are as many stripes in memory as
+// there are workers
+// ARCH: floats get summed in a different order than when aggregated sequentially, so their sums
+// may differ in their least significant digits
+func aggregateInParallel(ctx context.Context, scan *stripeScan, res *Result, gr *grouping, _ *sampler, budget *memoryBudget) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stripes := scan.ds.Stripes
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(stripes) {
+		workers = len(stripes)
+	}
+
+	var (
+		mu       sync.Mutex // guards everything below
+		firstErr error
+		read     int
+		rows     int
+		past     = len(stripes) // stripes past this one are past our filter's range
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	queue := make(chan int)
+	go func() {
+		defer close(queue)
+		for js := range stripes {
+			select {
+			case queue <- js:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// panics in our workers would take down the whole process, not just this query
+			defer func() {
+				if r := recover(); r != nil {
+					fail(fmt.Errorf("%w: %v", errWorkerPanicked, r))
+				}
+			}()
+			partials := make([]*expr.Aggregator, len(gr.aggexprs))
+			for j, aggexpr := range gr.aggexprs {
+				partial, err := expr.NewAggregator(aggexpr, gr.schema)
+				if err != nil {
+					fail(err)
+					return
+				}
+				partials[j] = partial
+			}
+			nrows := 0
+			for js := range queue {
+				mu.Lock()
+				skip := js > past
+				mu.Unlock()
+				if skip {
+					continue
+				}
+				st, stats, err := scan.read(ctx, stripes[js])
+				mu.Lock()
+				res.addReads(stats)
+				if st != nil {
+					read++
+					reportProgress(ctx, Progress{StripesRead: read, StripesTotal: len(stripes), BytesRead: res.bytesRead})
+					if st.pastRange && js < past {
+						past = js
+					}
+				}
+				mu.Unlock()
+				if err != nil {
+					fail(err)
+					return
+				}
+				if st == nil {
+					continue
+				}
+				if err := budget.check(chunksHeld(st.columns)...); err != nil {
+					fail(err)
+					return
+				}
+				length := st.matched
+				if length == 0 {
+					continue
+				}
+				// all rows go in a single group
+				buckets := make([]uint64, length)
+				_, stopAggregate := startTimer(ctx, stageAggregate)
+				for _, partial := range partials {
+					if err := partial.Update(buckets, 1, st.columns, st.filter); err != nil {
+						fail(err)
+						return
+					}
+				}
+				stopAggregate()
+				nrows += length
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			rows += nrows
+			for j, aggexpr := range gr.aggexprs {
+				if err := aggexpr.Aggregator().Merge(partials[j]); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	// a context cancelled from outside stops our workers early, so our aggregates are incomplete
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// like in sequential aggregations, there's a single group once there are any rows
+	if rows > 0 {
+		gr.groups[0] = 0
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// stages of query execution, as reported in query plans, timers of profiled queries are labelled
+// using these very names (see Profile), so that plans and timings can be matched against each other
+const (
+	stageRead      = "read"
+	stageSample    = "sample"
+	stageFilter    = "filter"
+	stageAggregate = "aggregate"
+	stageProject   = "project"
+	stageSort      = "sort"
+	stageLimit     = "limit"
+	stageOffset    = "offset"
+)
+
+// aggregation strategies
+const (
+	aggregationNone   = "none"
+	aggregationHash   = "hash"   // GROUP BY, we hash group values in each stripe
+	aggregationGlobal = "global" // aggregations without GROUP BY, there's a single group
+)
+
+// Plan describes how a query gets executed, it's what EXPLAIN queries return (instead of data)
+// ARCH: this describes what Run does, it's not used to drive it - so the two need to be kept in sync
+type Plan struct {
+	Dataset        string   `json:"dataset,omitempty"`
+	StripesTotal   int      `json:"stripes_total"`
+	StripesScanned int      `json:"stripes_scanned"`
+	Columns        []string `json:"columns"`
+	// filters get evaluated in each stripe before anything else, so only matching rows get projected
+	// or aggregated
+	Filter      *string `json:"filter"`
+	Aggregation string  `json:"aggregation"`
+	// filtered queries may terminate early (if there's a LIMIT), but we can't know that beforehand,
+	// so this is an upper bound (the same goes for sampled queries and bloom filter lookups, which may
+	// skip some stripes)
+	EstimatedBytesRead int        `json:"estimated_bytes_read"`
+	Steps              []PlanStep `json:"steps"`
+	// plans of other parts of a UNION ALL query
+	Union []*Plan `json:"union,omitempty"`
+}
+
+// PlanStep is a single stage of a query's execution
+type PlanStep struct {
+	Stage  string `json:"stage"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func joinExpressions(exprs []expr.Expression) string {
+	parts := make([]string, 0, len(exprs))
+	for _, ex := range exprs {
+		parts = append(parts, ex.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p *Plan) addStep(stage, detail string) {
+	p.Steps = append(p.Steps, PlanStep{Stage: stage, Detail: detail})
+}
+
+// newPlan mirrors decisions made in Run, it assumes the query has already been validated
+// and that `*` projections have been expanded (ds is nil for dataless queries)
+func newPlan(ds *database.Dataset, q expr.Query, aggregating bool) *Plan {
+	plan := &Plan{Columns: []string{}, Aggregation: aggregationNone}
+	if aggregating {
+		plan.Aggregation = aggregationGlobal
+		if q.Aggregate != nil {
+			plan.Aggregation = aggregationHash
+		}
+	}
+
+	sorted := ds != nil && !aggregating && presorted(ds, q)
+	counted := ds != nil && aggregating && rowCountOnly(ds, q)
+	if ds != nil {
+		plan.Dataset = fmt.Sprintf("%v@v%v", ds.QualifiedName(), ds.ID)
+		plan.StripesTotal = len(ds.Stripes)
+
+		exprs := append([]expr.Expression{}, q.Select...)
+		if aggregating {
+			exprs = append(exprs, q.Aggregate...)
+		}
+		if q.Filter != nil {
+			exprs = append(exprs, q.Filter)
+		}
+		seen := make(map[string]bool)
+		var idxs []int
+		for _, col := range expr.ColumnsUsedMultiple(ds.Schema, exprs...) {
+			if seen[col] {
+				continue
+			}
+			seen[col] = true
+			// validated in Run already
+			idx, _, err := ds.Schema.LocateColumn(col)
+			if err != nil {
+				panic(err)
+			}
+			plan.Columns = append(plan.Columns, col)
+			idxs = append(idxs, idx)
+		}
+
+		// only plain selects with a LIMIT (and no ordering, unless it's given by the sort key) can terminate
+		// early, we don't know the selectivity of filters (or samples), so we can only estimate this for
+		// unfiltered queries
+		remaining := -1
+		if !aggregating && (q.Order == nil || sorted) && q.Filter == nil && q.Sample == nil && q.Limit != nil {
+			remaining = *q.Limit
+		}
+		// bloom filters get read on top of the data (unless we skip a stripe)
+		var bloomIdxs []int
+		if pl, err := newPointLookups(ds, q.Filter); err == nil && pl != nil {
+			for _, col := range pl.columns {
+				idx, _, _ := ds.Schema.LocateColumn(col)
+				bloomIdxs = append(bloomIdxs, idx)
+			}
+		}
+		for _, stripe := range ds.Stripes {
+			// row counts are known upfront
+			if counted {
+				break
+			}
+			plan.StripesScanned++
+			for _, idx := range idxs {
+				// external stripes don't have column offsets, only CSV ranges have sizes (they get read in full)
+				if stripe.Offsets == nil {
+					if stripe.Source != nil {
+						plan.EstimatedBytesRead += int(stripe.Source.Size)
+					}
+					break
+				}
+				plan.EstimatedBytesRead += int(stripe.Offsets[idx+1]) - int(stripe.Offsets[idx])
+			}
+			for _, idx := range bloomIdxs {
+				if stripe.Blooms != nil {
+					plan.EstimatedBytesRead += int(stripe.Blooms[idx+1]) - int(stripe.Blooms[idx])
+				}
+			}
+			if remaining > 0 {
+				remaining -= stripe.Length
+				if remaining <= 0 {
+					break
+				}
+			}
+		}
+		plan.addStep(stageRead, fmt.Sprintf("%v of %v stripes", plan.StripesScanned, plan.StripesTotal))
+	}
+
+	if q.Sample != nil {
+		detail := fmt.Sprintf("%v%% of rows", q.Sample.Percent)
+		if q.Sample.Method == expr.SampleSystem {
+			detail = fmt.Sprintf("%v%% of stripes", q.Sample.Percent)
+		}
+		plan.addStep(stageSample, detail)
+	}
+
+	if q.Filter != nil {
+		filter := q.Filter.String()
+		plan.Filter = &filter
+		detail := filter
+		// validated in Run already
+		if kr, err := newKeyRange(ds, q.Filter); err == nil && kr != nil && kr.exact {
+			detail = fmt.Sprintf("%v (binary search on sort key %v)", filter, kr.column)
+		}
+		if pl, err := newPointLookups(ds, q.Filter); err == nil && pl != nil {
+			detail = fmt.Sprintf("%v (stripes skipped using bloom filters on %v)", detail, strings.Join(pl.columns, ", "))
+		}
+		plan.addStep(stageFilter, detail)
+	}
+	switch plan.Aggregation {
+	case aggregationHash:
+		plan.addStep(stageAggregate, fmt.Sprintf("hash aggregation by %v", joinExpressions(q.Aggregate)))
+	case aggregationGlobal:
+		detail := "global aggregation"
+		if counted {
+			detail = "row count taken from metadata"
+		}
+		plan.addStep(stageAggregate, detail)
+	}
+	plan.addStep(stageProject, joinExpressions(q.Select))
+	if q.Order != nil {
+		detail := "full sort"
+		// plain selects only keep the top rows of each stripe
+		if !aggregating && q.Limit != nil {
+			detail = fmt.Sprintf("top-%v per stripe, then a full sort", *q.Limit)
+		}
+		// and grouped ones only keep the top groups of each partition (see grouping.keepTopGroups)
+		if plan.Aggregation == aggregationHash && topGroups(q) >= 0 {
+			detail = fmt.Sprintf("top-%v groups per partition, then a full sort", *q.Limit)
+		}
+		if sorted {
+			detail = fmt.Sprintf("none needed (sort key %v)", strings.Join(ds.SortKey, ", "))
+		}
+		plan.addStep(stageSort, fmt.Sprintf("%v by %v", detail, joinExpressions(q.Order)))
+	}
+	if q.Limit != nil {
+		plan.addStep(stageLimit, fmt.Sprint(*q.Limit))
+	}
+
+	return plan
+}
@@ -0,0 +1,26 @@
+package query
+
+import "context"
+
+// Progress describes how far along a running query is, it gets reported after each stripe is read
+type Progress struct {
+	StripesRead  int `json:"stripes_read"`
+	StripesTotal int `json:"stripes_total"`
+	BytesRead    int `json:"bytes_read"`
+}
+
+type progressKey struct{}
+
+// WithProgress attaches a progress callback to a context, queries run within this context will
+// call it as they go through a dataset's stripes
+// ARCH: the callback is called synchronously, so it should be cheap (or at least not block)
+// queries may finish early (e.g. due to a LIMIT), so we don't always read all the stripes
+func WithProgress(ctx context.Context, fn func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func reportProgress(ctx context.Context, progress Progress) {
+	if fn, ok := ctx.Value(progressKey{}).(func(Progress)); ok {
+		fn(progress)
+	}
+}
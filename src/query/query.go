@@ -2,23 +2,34 @@ package query
 
 import (
 	"bytes"
+	"container/heap"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"time"
 
 	"github.com/kokes/smda/src/bitmap"
 	"github.com/kokes/smda/src/column"
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
 	"github.com/kokes/smda/src/query/expr"
 )
 
-var errNoProjection = errors.New("no expressions specified to be selected")
-var errInvalidLimitValue = errors.New("invalid limit value")
-var errInvalidProjectionInAggregation = errors.New("selections in aggregating expressions need to be either the group by clauses or aggregating expressions (e.g. sum(foo))")
-var errInvalidOrderClause = errors.New("invalid ORDER BY clause")
-var errInvalidGroupbyClause = errors.New("invalid GROUP BY clause")
-var errQueryNoDatasetIdentifiers = errors.New("query without a dataset has identifiers in the SELECT clause")
+var errNoProjection = errs.New(errs.ErrBadRequest, "no expressions specified to be selected")
+var errInvalidLimitValue = errs.New(errs.ErrBadRequest, "invalid limit value")
+var errInvalidOffsetValue = errs.New(errs.ErrBadRequest, "invalid offset value")
+var errInvalidProjectionInAggregation = errs.New(errs.ErrBadRequest, "selections in aggregating expressions need to be either the group by clauses or aggregating expressions (e.g. sum(foo))")
+var errInvalidOrderClause = errs.New(errs.ErrBadRequest, "invalid ORDER BY clause")
+var errInvalidGroupbyClause = errs.New(errs.ErrBadRequest, "invalid GROUP BY clause")
+var errQueryNoDatasetIdentifiers = errs.New(errs.ErrBadRequest, "query without a dataset has identifiers in the SELECT clause")
+var errPlanNotTabular = errs.New(errs.ErrBadRequest, "query plans cannot be exported as tables")
+var errUnionColumnCount = errs.New(errs.ErrBadRequest, "all parts of a union need to have the same number of columns")
+var errUnionIncompatibleTypes = errs.New(errs.ErrBadRequest, "incompatible column types in a union")
+var errInvalidFilter = errs.New(errs.ErrBadRequest, "invalid WHERE clause")
+var errAggregateInFilter = errs.New(errs.ErrBadRequest, "cannot filter by aggregating expressions")
 
 // Result holds the result of a query, at this point it's fairly literal - in the future we may want
 // a Result to be a Dataset of its own (for better interoperability, persistence, caching etc.)
@@ -27,8 +38,18 @@ type Result struct {
 	Schema column.TableSchema
 	Length int
 	Data   []*column.Chunk
+	// EXPLAIN queries don't produce any data, just a plan of how they would be executed
+	Plan *Plan
+	// timings of all the stages of a query, only present if it was asked for (see Settings.Profile)
+	Profile *Profile
 	// ARCH: consider something like `stats` that will encapsulate this?
 	bytesRead int
+	// rows written to temporary files by GROUP BY queries with too many groups (see grouping)
+	rowsSpilled int
+	// how special float values get serialised, this is inherited from the queried dataset
+	floats column.FloatPolicy
+	// continuation token for the next page of results (see Cursors), empty if there's none
+	cursor string
 
 	// this is used for sorting
 	rowIdxs    []int
@@ -38,26 +59,97 @@ type Result struct {
 	sortColumnsIdxs []int
 }
 
+func (res *Result) addReads(stats database.ReadStats) {
+	res.bytesRead += stats.BytesRead
+}
+
 // Length might be much smaller than the data within (thanks to ORDER BY), so we should prune our columns
+// and only keep the first res.Length rows (as ordered by rowIdxs)
 func (res *Result) Prune() {
 	// take actual data length, not res.Length, which may be artificially low (that's the purpose here, to set
 	// it low and discard all the other rows)
 	bm := bitmap.NewBitmap(res.Data[0].Len())
-	for j, el := range res.rowIdxs {
-		if el < res.Length {
-			bm.Set(j, true)
-		}
+	for _, el := range res.rowIdxs[:res.Length] {
+		bm.Set(el, true)
 	}
 	for j, col := range res.Data {
 		res.Data[j] = col.Prune(bm)
 	}
-	// TODO(next)/ARCH: the rowIdxs is all broken now... should we somehow clean it up?
-	// `reorder` recreates it, so it's fine, but e.g. rowIdxs is used in serialisation, so
-	// if we run Prune and then export... it might panic
+	// pruning retains the original order of rows, so our ordering no longer applies (`reorder` recreates it)
+	res.rowIdxs = nil
+}
+
+// positions returns row numbers of our results, in their final order
+func (res *Result) positions() []int {
+	if res.rowIdxs != nil {
+		return res.rowIdxs[:res.Length]
+	}
+	positions := make([]int, res.Length)
+	for j := range positions {
+		positions[j] = j
+	}
+	return positions
+}
+
+// Materialise physically reorders and truncates our data, so that it reflects the query's
+// ordering and limits - serialisation applies rowIdxs on the fly, but other consumers (e.g.
+// storing results as datasets) need the data as is
+func (res *Result) Materialise() {
+	positions := res.positions()
+	for j, col := range res.Data {
+		res.Data[j] = col.Reorder(positions)
+	}
+	// the data are now in order, so our ordering is the identity
+	res.rowIdxs = nil
+}
+
+// orderedData returns our data as they are to be exported - in order and truncated
+// OPTIM: we copy all our data when reordering them, even if there's nothing to reorder
+func (res *Result) orderedData() ([]*column.Chunk, error) {
+	if res.Plan != nil {
+		return nil, errPlanNotTabular
+	}
+	positions := res.positions()
+	data := make([]*column.Chunk, 0, len(res.Data))
+	for _, col := range res.Data {
+		// this also hydrates literals
+		data = append(data, col.Reorder(positions))
+	}
+	return data, nil
+}
+
+// WriteArrow serialises our results in the Arrow IPC streaming format
+func (res *Result) WriteArrow(w io.Writer) error {
+	data, err := res.orderedData()
+	if err != nil {
+		return err
+	}
+	return column.WriteArrow(w, res.Schema, data)
+}
+
+// WriteCSV serialises our results as a CSV file with a header, nulls are written as empty values
+func (res *Result) WriteCSV(w io.Writer) error {
+	data, err := res.orderedData()
+	if err != nil {
+		return err
+	}
+	return column.WriteCSV(w, res.Schema, data)
+}
+
+// WriteParquet serialises our results as a Parquet file
+func (res *Result) WriteParquet(w io.Writer) error {
+	data, err := res.orderedData()
+	if err != nil {
+		return err
+	}
+	return column.WriteParquet(w, res.Schema, data)
 }
 
 // TODO(next): test this
 func (r *Result) MarshalJSON() ([]byte, error) {
+	if r.Plan != nil {
+		return json.Marshal(r.Plan)
+	}
 	buf := new(bytes.Buffer)
 	enc := json.NewEncoder(buf)
 	if _, err := buf.WriteString("{\n\t\"schema\": "); err != nil {
@@ -72,6 +164,19 @@ func (r *Result) MarshalJSON() ([]byte, error) {
 	if _, err := buf.WriteString(fmt.Sprintf(",\n\"bytes_read\": %d", r.bytesRead)); err != nil {
 		return nil, err
 	}
+	if r.cursor != "" {
+		if _, err := buf.WriteString(fmt.Sprintf(",\n\"cursor\": %q", r.cursor)); err != nil {
+			return nil, err
+		}
+	}
+	if r.Profile != nil {
+		if _, err := buf.WriteString(",\n\"profile\": "); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(r.Profile); err != nil {
+			return nil, err
+		}
+	}
 
 	// ARCH: there is no notion of order here - `foo asc, bar desc` is the same as the other way around
 	// we might want to encode this order here at some point, so that the FE can react to it
@@ -97,6 +202,19 @@ func (r *Result) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
+	// literals have the same value in all rows, so we only serialise them once
+	literals := make([][]byte, len(r.Data))
+	for cn, col := range r.Data {
+		if !col.IsLiteral || col.Len() == 0 {
+			continue
+		}
+		val, ok := col.AppendJSONLiteral(nil, 0, r.floats)
+		if !ok {
+			val = []byte("null")
+		}
+		literals[cn] = val
+	}
+	var val []byte
 	for j := 0; j < r.Length; j++ {
 		rownum := j
 		if r.rowIdxs != nil {
@@ -112,13 +230,18 @@ func (r *Result) MarshalJSON() ([]byte, error) {
 					return nil, err
 				}
 			}
-			// TODO(next)/OPTIM: literal optimisation - find out literals beforehand and pre-serialise them
-			col := r.Data[cn]
-			val, ok := col.JSONLiteral(rownum)
+			if literals[cn] != nil {
+				if _, err := buf.Write(literals[cn]); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var ok bool
+			val, ok = r.Data[cn].AppendJSONLiteral(val[:0], rownum, r.floats)
 			if !ok {
-				val = "null"
+				val = append(val[:0], "null"...)
 			}
-			if _, err := buf.WriteString(val); err != nil {
+			if _, err := buf.Write(val); err != nil {
 				return nil, err
 			}
 		}
@@ -142,16 +265,30 @@ func (r *Result) MarshalJSON() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func filterStripe(db *database.Database, ds *database.Dataset, stripe database.Stripe, filterExpr expr.Expression, colData map[string]*column.Chunk) (*bitmap.Bitmap, error) {
+// filterStripe evaluates a filter in a given stripe and returns the rows matched (and their
+// number), if the dataset is sorted, it may use a key range instead - it then also reports if we're
+// past this range (so that no further stripes can match)
+func filterStripe(db *database.Database, ds *database.Dataset, stripe database.Stripe, filterExpr expr.Expression, kr *keyRange, colData map[string]*column.Chunk) (*bitmap.Bitmap, int, bool, error) {
+	past := false
+	if kr != nil {
+		bm, matched, pastRange, err := kr.filter(colData[kr.column])
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if kr.exact {
+			return bm, matched, pastRange, nil
+		}
+		past = pastRange
+	}
 	fvals, err := expr.Evaluate(filterExpr, stripe.Length, colData, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, false, err
 	}
 	// it's essential that we clone the bool column here (implicitly in Truths),
 	// because this bitmap may be truncated later on (e.g. in KeepFirstN)
 	// and expr.Evaluate may return a reference, not a clone (e.g. in exprIdent)
-	bm := fvals.Truths()
-	return bm, nil
+	bm, matched := fvals.TruthsCount()
+	return bm, matched, past, nil
 }
 
 // ARCH/OPTIM: there are a few issues here:
@@ -178,12 +315,28 @@ func lookupExpr(needle expr.Expression, haystack []expr.Expression) int {
 	return -1
 }
 
+// rowCountOnly determines if an aggregating query only counts all the rows of a dataset (e.g.
+// `SELECT count(*) FROM t`), we can then take the count from the dataset's metadata (see
+// database.Dataset.NRows) without reading any stripes. Empty datasets take the usual route, because
+// global aggregations over no rows result in no rows at all (which a LIMIT 0 gives us as well).
+func rowCountOnly(ds *database.Dataset, q expr.Query) bool {
+	if q.Filter != nil || q.Aggregate != nil || q.Sample != nil || ds.NRows == 0 || (q.Limit != nil && *q.Limit == 0) {
+		return false
+	}
+	for _, proj := range q.Select {
+		if !expr.IsRowCount(proj) {
+			return false
+		}
+	}
+	return true
+}
+
 // OPTIM: here are some rough calculations from running timers in the stripe loop (the only expensive part)
 // loading data from disk: 133ms, hashing: 55ms, prune bitmaps prep: 23ms, updating aggregators: 28ms
 // everything else is way faster
 // OPTIM: if there's GROUPBY+LIMIT (and without ORDERBY), we can shortcircuit the hashing part - once we
 // reach ndistinct == LIMIT, we can stop
-func aggregate(db *database.Database, ds *database.Dataset, res *Result, q expr.Query) error {
+func aggregate(ctx context.Context, db *database.Database, ds *database.Dataset, res *Result, q expr.Query, budget *memoryBudget) error {
 	// we need to validate all projections - they either need to be in the groupby clause
 	// or be aggregating (e.g. sum(ints) -> int)
 	// we'll also collect all the aggregating expressions, so that we can feed them individual chunks
@@ -214,104 +367,51 @@ func aggregate(db *database.Database, ds *database.Dataset, res *Result, q expr.
 	}
 
 	columnNames := expr.ColumnsUsedMultiple(ds.Schema, append(q.Aggregate, q.Select...)...)
+	// string columns only used for their lengths don't need their contents read
+	used := append(append([]expr.Expression{}, q.Aggregate...), q.Select...)
 	if q.Filter != nil {
 		columnNames = append(columnNames, expr.ColumnsUsedMultiple(ds.Schema, q.Filter)...)
+		used = append(used, q.Filter)
 	}
-	groups := make(map[uint64]uint64)
-	// ARCH: `nrc` and `rcs` are not very descriptive
-	nrc := make([]*column.Chunk, len(q.Aggregate))
-	for _, stripe := range ds.Stripes {
-		stripeLength := stripe.Length
-		var filter *bitmap.Bitmap
-		rcs := make([]*column.Chunk, len(q.Aggregate))
-		columnData, bytesRead, err := db.ReadColumnsFromStripeByNames(ds, stripe, columnNames)
-		res.bytesRead += bytesRead
-		if err != nil {
-			return err
-		}
-		if q.Filter != nil {
-			filter, err = filterStripe(db, ds, stripe, q.Filter, columnData)
-			if err != nil {
-				return err
-			}
-			stripeLength = filter.Count()
-		}
-
-		// 1) evaluate all the aggregation expressions (those expressions that determine groups, e.g. `country`)
-		for j, expression := range q.Aggregate {
-			rc, err := expr.Evaluate(expression, stripeLength, columnData, filter)
-			if err != nil {
-				return err
-			}
-			rcs[j] = rc
-		}
-		hashes := make([]uint64, stripeLength) // preserves unique rows (their hashes); OPTIM: preallocate some place
-		bm := bitmap.NewBitmap(stripeLength)   // denotes which rows are the unique ones
-		for j, rc := range rcs {
-			rc.Hash(j, hashes)
-		}
-		for row, hash := range hashes {
-			if _, ok := groups[hash]; !ok {
-				groups[hash] = uint64(len(groups))
-				// it's a new value, set our bitmap, so that we can prune it later
-				bm.Set(row, true)
-			}
-		}
-
-		// we have identified new rows in our stripe, add it to our existing columns
-		for j, rc := range rcs {
-			if nrc[j] == nil {
-				nrc[j] = rc.Prune(bm)
-				continue
-			}
-			// TODO: this is untested, because we have large stripes in testing
-			if err := nrc[j].Append(rc.Prune(bm)); err != nil {
-				return err
-			}
-		}
-
-		// 2) update our aggregating expressions (e.g. `sum(a)`)
-		// we no longer need the `hashes` for this stripe, so we'll repurpose it
-		// to get information on groups (buckets)
-		for j, el := range hashes {
-			hashes[j] = groups[el]
-		}
-		for _, aggexpr := range aggexprs {
-			if err := expr.UpdateAggregator(aggexpr, hashes, len(groups), columnData, filter); err != nil {
-				return err
-			}
-		}
+	lengthOnly := expr.LengthOnlyColumns(ds.Schema, used...)
+	sp := newSpill(db.Config.WorkingDirectory, db.Config.MaxGroupsInMemory)
+	if sp != nil {
+		defer sp.close()
 	}
-	// 3) resolve aggregating expressions
-	ret := make([]*column.Chunk, len(q.Select))
-	for j, gr := range q.Aggregate {
-		// OPTIM: we did this once already
-		pos := lookupExpr(gr, q.Select)
-		if pos == -1 {
-			continue
-		}
-		ret[pos] = nrc[j]
+	gr := newGrouping(ctx, ds.Schema, q, aggexprs, budget, sp)
+	smp := newSampler(q.Sample)
+	kr, err := newKeyRange(ds, q.Filter)
+	if err != nil {
+		return err
 	}
-	for j, proj := range q.Select {
-		if ret[j] != nil {
-			// this is an aggregating expression, skip it
-			continue
-		}
-		// we can pass in a nil map, because agg exprs get evaluated first
-		// TODO/ARCH: shouldn't this call Resolve directly (if we exporter the aggregator)? It's kind
-		// of funky to hide the Resolver under Evaluate
-		agg, err := expr.Evaluate(proj, len(groups), nil, nil)
-		if err != nil {
-			return err
-		}
-		ret[j] = agg
+	lookups, err := newPointLookups(ds, q.Filter)
+	if err != nil {
+		return err
+	}
+	scan := &stripeScan{db: db, ds: ds, filter: q.Filter, columns: columnNames, lengthOnly: lengthOnly, kr: kr, lookups: lookups, budget: scanBudgetFrom(ctx)}
+	aggregateStripes := aggregateSequentially
+	if q.Aggregate == nil && q.Sample == nil && len(ds.Stripes) > 1 && mergeable(aggexprs) {
+		aggregateStripes = aggregateInParallel
+	}
+	if err := aggregateStripes(ctx, scan, res, gr, smp, budget); err != nil {
+		return err
+	}
+	_, stopAggregate := startTimer(ctx, stageAggregate)
+	ret, err := gr.resolve()
+	stopAggregate()
+	res.rowsSpilled = gr.spilled
+	if err != nil {
+		return err
 	}
 
 	res.Data = ret
 	res.Length = ret[0].Len()
 
 	if q.Order != nil {
-		if err := reorder(res, q); err != nil {
+		_, stopSort := startTimer(ctx, stageSort)
+		err := reorder(res, q)
+		stopSort()
+		if err != nil {
 			return err
 		}
 	}
@@ -337,43 +437,64 @@ func aggregate(db *database.Database, ds *database.Dataset, res *Result, q expr.
 	return nil
 }
 
+// aggregateSequentially feeds all the stripes of a dataset into a grouping, one by one
+func aggregateSequentially(ctx context.Context, scan *stripeScan, res *Result, gr *grouping, smp *sampler, budget *memoryBudget) error {
+	stripes := scan.ds.Stripes
+	for js, stripe := range stripes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if smp.skipStripe() {
+			continue
+		}
+		st, stats, err := scan.read(ctx, stripe)
+		res.addReads(stats)
+		if err != nil {
+			return err
+		}
+		if st == nil {
+			continue
+		}
+		reportProgress(ctx, Progress{StripesRead: js + 1, StripesTotal: len(stripes), BytesRead: res.bytesRead})
+		if err := budget.check(chunksHeld(st.columns, gr.values)...); err != nil {
+			return err
+		}
+		filter, length := smp.sampleRows(st.filter, st.matched, stripe.Length)
+
+		_, stopAggregate := startTimer(ctx, stageAggregate)
+		err = gr.add(st.columns, filter, length)
+		stopAggregate()
+		if err != nil {
+			return err
+		}
+		// sorted data past our filter's range won't match it anymore
+		if st.pastRange {
+			break
+		}
+	}
+	return nil
+}
+
 // ARCH: we might want to split this file up, it's getting a bit gnarly
 func (res *Result) Len() int {
 	return res.Length
 }
 
-func (res *Result) Swap(i, j int) {
-	res.rowIdxs[i], res.rowIdxs[j] = res.rowIdxs[j], res.rowIdxs[i]
-}
-
-// based on the multi sorter in the sort Go docs
-func (res *Result) Less(i, j int) bool {
+// compareRows compares two rows (their positions in our data) using our sort columns
+func (res *Result) compareRows(p1, p2 int) int {
 	for pos, idx := range res.sortColumnsIdxs {
-		// i, j don't signify the position in the chunk's data field, because we're mapping row ordering
-		// using res.rowIdxs instead
-		p1, p2 := res.rowIdxs[i], res.rowIdxs[j]
-		cmp := res.Data[idx].Compare(res.asc[pos], res.nullsfirst[pos], p1, p2)
-		if cmp == -1 {
-			return true
-		}
-		if cmp == 1 {
-			return false
+		if cmp := res.Data[idx].Compare(res.asc[pos], res.nullsfirst[pos], p1, p2); cmp != 0 {
+			return cmp
 		}
 	}
-
-	// all are equal, so just return true to avoid further sorting,
-	// which wouldn't make a difference
-	return true
+	return 0
 }
 
-func reorder(res *Result, q expr.Query) error {
+// sortingColumns resolves ORDER BY clauses into positions of projections we sort by
+func sortingColumns(res *Result, q expr.Query) error {
 	if res.Length < 0 {
 		return errors.New("invalid structure of intermediate results")
 	}
-	res.rowIdxs = make([]int, res.Length)
-	for j := 0; j < res.Length; j++ {
-		res.rowIdxs[j] = j
-	}
 	res.asc = make([]bool, len(q.Order))
 	res.nullsfirst = make([]bool, len(q.Order))
 	res.sortColumnsIdxs = make([]int, len(q.Order))
@@ -388,41 +509,204 @@ func reorder(res *Result, q expr.Query) error {
 		}
 		// TODO/ARCH: I wanted to change q.Order in place... but we can't create a new Ordering,
 		// because `.inner` is private and I didn't want to expose it. But it might be the right way to go
-		// TODO: test this properly (we have parsing tests, not implementation testing)
 		if idx, ok := needle.(*expr.Integer); ok {
 			needle = q.Select[idx.Value()-1] // no need to validate any more, already did that
 		}
 
 		pos := lookupExpr(needle, q.Select)
 		if pos == -1 {
-			return fmt.Errorf("cannot sort by a column not in projections: %s", needle)
+			return fmt.Errorf("%w: cannot sort by a column not in projections: %s", errInvalidOrderClause, needle)
 		}
 		res.sortColumnsIdxs[j] = pos
 
 		res.asc[j] = asc
 		res.nullsfirst[j] = nullsFirst
 	}
+	return nil
+}
+
+func reorder(res *Result, q expr.Query) error {
+	if err := sortingColumns(res, q); err != nil {
+		return err
+	}
+	res.rowIdxs = make([]int, res.Length)
+	for j := 0; j < res.Length; j++ {
+		res.rowIdxs[j] = j
+	}
 
-	sort.Sort(res)
+	// a stable sort with a strict comparator, so that rows equal in all the sort keys retain their
+	// original order (and so that we match topK, which also prefers earlier rows)
+	sort.SliceStable(res.rowIdxs, func(i, j int) bool {
+		return res.compareRows(res.rowIdxs[i], res.rowIdxs[j]) < 0
+	})
 
 	return nil
 }
 
-func RunSQL(db *database.Database, query string) (*Result, error) {
+// rowHeap is a max-heap of row positions - the row that sorts last is at the top, so that we can
+// easily evict it once we find a better candidate
+type rowHeap struct {
+	res  *Result
+	rows []int
+}
+
+func (h *rowHeap) Len() int { return len(h.rows) }
+func (h *rowHeap) Less(i, j int) bool {
+	cmp := h.res.compareRows(h.rows[i], h.rows[j])
+	if cmp == 0 {
+		// for ties, prefer earlier rows, so that we match the results of a full sort
+		return h.rows[i] > h.rows[j]
+	}
+	return cmp > 0
+}
+func (h *rowHeap) Swap(i, j int)      { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+func (h *rowHeap) Push(x interface{}) { h.rows = append(h.rows, x.(int)) }
+func (h *rowHeap) Pop() interface{} {
+	last := h.rows[len(h.rows)-1]
+	h.rows = h.rows[:len(h.rows)-1]
+	return last
+}
+
+// topK prunes our data to the first k rows (in the order given by the query), it doesn't sort all
+// the data, it only keeps a bounded heap of k candidates, so it's O(n*log(k)) in time and O(k) in memory
+// the resulting rows retain their original order, they still need to be reordered
+func topK(res *Result, q expr.Query, k int) error {
+	if res.Length <= k {
+		return nil
+	}
+	if err := sortingColumns(res, q); err != nil {
+		return err
+	}
+	h := &rowHeap{res: res, rows: make([]int, 0, k+1)}
+	for j := 0; j < res.Length; j++ {
+		if h.Len() < k {
+			heap.Push(h, j)
+			continue
+		}
+		// only replace the current worst candidate if we're strictly better (ties go to earlier rows)
+		if k == 0 || res.compareRows(j, h.rows[0]) >= 0 {
+			continue
+		}
+		h.rows[0] = j
+		heap.Fix(h, 0)
+	}
+	res.rowIdxs = h.rows
+	res.Length = len(h.rows)
+	res.Prune()
+	return nil
+}
+
+func RunSQL(ctx context.Context, db *database.Database, query string) (*Result, error) {
 	q, err := expr.ParseQuerySQL(query)
 	if err != nil {
 		return nil, err
 	}
-	return Run(db, q)
+	return Run(ctx, db, q)
+}
+
+// RunSQLWithParams runs a query with placeholders (`?`), which get bound to the supplied
+// parameters (in order), e.g. `RunSQLWithParams(ctx, db, "SELECT * FROM t WHERE id = ?", 12)`
+func RunSQLWithParams(ctx context.Context, db *database.Database, query string, params ...interface{}) (*Result, error) {
+	q, err := parseSQLWithParams(query, Settings{}, params)
+	if err != nil {
+		return nil, err
+	}
+	return Run(ctx, db, q)
 }
 
-// Run runs a given query against this database
-// TODO: we have to differentiate between input errors and runtime errors (errors.Is?)
-// the former should result in a 4xx, the latter in a 5xx
-func Run(db *database.Database, q expr.Query) (*Result, error) {
+func parseSQLWithParams(query string, settings Settings, params []interface{}) (expr.Query, error) {
+	q, err := expr.ParseQuerySQL(query)
+	if err != nil {
+		return q, err
+	}
+	if err := q.Bind(params...); err != nil {
+		return q, err
+	}
+	if err := settings.apply(&q); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// Run runs a given query against this database, it can be cancelled via its context (checked
+// before each stripe gets processed) and it aborts if it exceeds db.Config.MaxQueryMemory or if it
+// reads more than db.Config.MaxBytesScanned (unless overridden, see Settings.MaxBytesScanned)
+// Queries running for longer than db.Config.QueryTimeout (see Settings.Timeout) fail with a TimeoutError.
+// Errors caused by the query itself (e.g. unknown columns or type mismatches) are categorised as
+// errs.ErrBadRequest, exceeding either limit as errs.ErrResourceExhausted and timeouts as
+// errs.ErrTimeout (see errs.Category)
+func Run(ctx context.Context, db *database.Database, q expr.Query) (*Result, error) {
+	// all the datasets of a query (e.g. of its subqueries or union parts) come from a single
+	// snapshot, so that concurrent commits (or drops) don't affect it half way through
+	if _, ok := ctx.Value(snapshotKey{}).(*database.Snapshot); !ok {
+		snap := db.Snapshot()
+		defer snap.Release()
+		ctx = context.WithValue(ctx, snapshotKey{}, snap)
+	}
+	if scanBudgetFrom(ctx) == nil {
+		ctx = context.WithValue(ctx, scanBudgetKey{}, &scanBudget{limit: db.MaxBytesScanned()})
+	}
+	ctx, cancel := withTimeout(ctx, db.QueryTimeout())
+	defer cancel()
+	tctx, stop := startTimer(ctx, timerQuery)
+	res, err := run(tctx, db, q)
+	if err != nil {
+		return nil, timedOut(ctx, err)
+	}
+	if q.Timezone != nil {
+		if err := res.localise(q.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	stop()
+	res.Profile = profileFrom(ctx)
+	return res, nil
+}
+
+// localise converts datetimes in results from UTC into local times in a given timezone (see
+// expr.Query.SetTimezone), this is the very last step of a query, so that nested queries (union
+// parts, subqueries) operate on UTC datetimes
+func (res *Result) localise(loc *time.Location) error {
+	for j, col := range res.Data {
+		local, err := column.DatetimesFromUTC(col, loc)
+		if err != nil {
+			return err
+		}
+		res.Data[j] = local
+	}
+	return nil
+}
+
+type snapshotKey struct{}
+
+// getDataset looks up a dataset in the snapshot a query runs in (see Run), unless it refers to
+// a common table (see runWith)
+func getDataset(ctx context.Context, db *database.Database, dataset *expr.Dataset) (*database.Dataset, error) {
+	if ds, ok := commonTable(ctx, dataset); ok {
+		return ds, nil
+	}
+	if snap, ok := ctx.Value(snapshotKey{}).(*database.Snapshot); ok {
+		return snap.GetDataset(dataset.QualifiedName(), dataset.Version, dataset.Latest)
+	}
+	return db.ResolveDataset(dataset.QualifiedName(), dataset.Version, dataset.Latest)
+}
+
+func run(ctx context.Context, db *database.Database, q expr.Query) (*Result, error) {
+	if len(q.With) > 0 {
+		return runWith(ctx, db, q)
+	}
+	if len(q.Union) > 0 {
+		return runUnion(ctx, db, q)
+	}
+	if q.Offset != nil {
+		return runWithOffset(ctx, db, q)
+	}
 	if len(q.Select) == 0 {
 		return nil, errNoProjection
 	}
+	if err := resolveSubqueries(ctx, db, q); err != nil {
+		return nil, err
+	}
 	res := &Result{
 		Schema: make([]column.Schema, 0, len(q.Select)),
 		Data:   make([]*column.Chunk, 0),
@@ -440,6 +724,9 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 				return nil, err
 			}
 			res.Schema = append(res.Schema, rt)
+			if q.Explain {
+				continue
+			}
 			col, err := expr.Evaluate(proj, 1, nil, nil)
 			if err != nil {
 				return nil, err
@@ -447,14 +734,22 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 			res.Data = append(res.Data, col)
 		}
 
+		if q.Explain {
+			return &Result{Plan: newPlan(nil, q, false)}, nil
+		}
 		res.Length = 1
 		return res, nil
 	}
 
-	ds, err := db.GetDataset(q.Dataset.Name, q.Dataset.Version, q.Dataset.Latest)
+	ds, err := getDataset(ctx, db, q.Dataset)
 	if err != nil {
 		return nil, err
 	}
+	// external datasets only get their schemas upon first query
+	if ds, err = db.ResolveExternal(ds); err != nil {
+		return nil, err
+	}
+	res.floats = ds.FloatPolicy
 
 	// expand `*` clauses
 	// ARCH: we're mutating `q.Select`... we don't tend to do that here (it messes up printing it back)
@@ -474,6 +769,21 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 		}
 	}
 	q.Select = projs
+	// filters and groupings can refer to labels of projections (see expr.ExpandAliases)
+	if q.Filter != nil {
+		q.Filter = expr.ExpandAliases(q.Filter, ds.Schema, q.Select, true)
+		if aggs, err := expr.AggExpr(q.Filter); err != nil || len(aggs) > 0 {
+			return nil, fmt.Errorf("%w: %v", errAggregateInFilter, q.Filter)
+		}
+	}
+	for j, agg := range q.Aggregate {
+		q.Aggregate[j] = expr.ExpandAliases(agg, ds.Schema, q.Select, false)
+	}
+	// resolve all identifiers upfront, so that typos don't surface as errors deep in evaluation
+	resolve := append(append([]expr.Expression{q.Filter}, q.Select...), q.Aggregate...)
+	if err := expr.ResolveIdentifiers(ds.Schema, resolve...); err != nil {
+		return nil, err
+	}
 
 	allAggregations := true
 	for _, col := range q.Select {
@@ -500,7 +810,7 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 			return nil, err
 		}
 		if rettype.Dtype != column.DtypeBool {
-			return nil, fmt.Errorf("can only filter by expressions that return booleans, got %v that returns %v", q.Filter, rettype.Dtype)
+			return nil, fmt.Errorf("%w: can only filter by expressions that return booleans, got %v that returns %v", errInvalidFilter, q.Filter, rettype.Dtype)
 		}
 	}
 
@@ -534,6 +844,7 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 		}
 	}
 
+	budget := &memoryBudget{limit: db.Config.MaxQueryMemory}
 	limit := -1
 	if q.Limit != nil {
 		if *q.Limit < 0 {
@@ -541,19 +852,45 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 		}
 		limit = *q.Limit
 	}
-	if q.Aggregate != nil || allAggregations {
-		// edit GROUP BY 1, 2 in place (replace them by their respective columns)
-		for j, agg := range q.Aggregate {
-			if idx, ok := agg.(*expr.Integer); ok {
-				n := idx.Value()
-				if n < 1 || n > int64(len(q.Select)) {
-					return nil, errInvalidGroupbyClause
-				}
-				q.Aggregate[j] = q.Select[n-1]
+	// edit GROUP BY 1, 2 in place (replace them by their respective columns)
+	for j, agg := range q.Aggregate {
+		if idx, ok := agg.(*expr.Integer); ok {
+			n := idx.Value()
+			if n < 1 || n > int64(len(q.Select)) {
+				return nil, errInvalidGroupbyClause
 			}
+			q.Aggregate[j] = q.Select[n-1]
 		}
-
-		if err := aggregate(db, ds, res, q); err != nil {
+	}
+	// evaluate data independent parts of our expressions upfront (this doesn't change how they print,
+	// so it doesn't affect column names or expression lookups)
+	for j, proj := range q.Select {
+		q.Select[j] = expr.Fold(proj)
+	}
+	for j, agg := range q.Aggregate {
+		q.Aggregate[j] = expr.Fold(agg)
+	}
+	if q.Filter != nil {
+		q.Filter = expr.Fold(q.Filter)
+	}
+	aggregating := q.Aggregate != nil || allAggregations
+	if q.Explain {
+		return &Result{Plan: newPlan(ds, q, aggregating)}, nil
+	}
+	if aggregating && rowCountOnly(ds, q) {
+		for j := range res.Data {
+			res.Data[j] = column.NewChunkIntsFromSlice([]int64{ds.NRows}, nil)
+		}
+		res.Length = 1
+		if q.Order != nil {
+			if err := reorder(res, q); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	if aggregating {
+		if err := aggregate(ctx, db, ds, res, q, budget); err != nil {
 			return nil, err
 		}
 
@@ -571,52 +908,95 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 	//  evaluate after each stripe finishes and cancel the remaining processes, to avoid straggler issues).
 	//  We can then map `n` to `numCPU` or something, but we could easily start with 1 to replicate current
 	//  behaviour.
-	for _, stripe := range ds.Stripes {
+	smp := newSampler(q.Sample)
+	kr, err := newKeyRange(ds, q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	lookups, err := newPointLookups(ds, q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	// data sorted by our sort key don't need to be reordered, so we also get to terminate early (if there's
+	// a LIMIT), as if there was no ORDER BY at all
+	order := q.Order
+	if presorted(ds, q) {
+		q.Order = nil
+	}
+	expected := expectedRows(ds, q, limit)
+	for js, stripe := range ds.Stripes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if smp.skipStripe() {
+			continue
+		}
+		rctx, stopRead := startTimer(ctx, stageRead)
+		skip, bytesRead, err := lookups.skipStripe(db, ds, stripe)
+		res.bytesRead += bytesRead
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			stopRead()
+			continue
+		}
 		colnames := expr.ColumnsUsedMultiple(ds.Schema, q.Select...)
+		used := append([]expr.Expression{}, q.Select...)
 		if q.Filter != nil {
 			colnames = append(colnames, expr.ColumnsUsedMultiple(ds.Schema, q.Filter)...)
+			used = append(used, q.Filter)
 		}
-		columns, bytesRead, err := db.ReadColumnsFromStripeByNames(ds, stripe, colnames)
-		res.bytesRead += bytesRead
+		lengthOnly := expr.LengthOnlyColumns(ds.Schema, used...)
+		columns, stats, err := db.ReadColumnsFromStripe(ds, stripe, colnames, lengthOnly)
+		recordReads(rctx, stats)
+		stopRead()
+		res.addReads(stats)
 		if err != nil {
 			return nil, err
 		}
+		if err := scanBudgetFrom(ctx).add(stats.BytesRead); err != nil {
+			return nil, err
+		}
+		reportProgress(ctx, Progress{StripesRead: js + 1, StripesTotal: len(ds.Stripes), BytesRead: res.bytesRead})
+		if err := budget.check(chunksHeld(columns, res.Data)...); err != nil {
+			return nil, err
+		}
 		var filter *bitmap.Bitmap
 		loadFromStripe := stripe.Length
+		pastRange := false
 		if q.Filter != nil {
-			filter, err = filterStripe(db, ds, stripe, q.Filter, columns)
+			_, stopFilter := startTimer(ctx, stageFilter)
+			filter, loadFromStripe, pastRange, err = filterStripe(db, ds, stripe, q.Filter, kr, columns)
+			stopFilter()
 			if err != nil {
 				return nil, err
 			}
-			// only prune the filter if we're not reordering in the end
-			if q.Order == nil && limit >= 0 && filter.Count() > limit {
-				filter.KeepFirstN(limit)
-			}
-		} else {
+		}
+		filter, loadFromStripe = smp.sampleRows(filter, loadFromStripe, stripe.Length)
+		// only prune the filter if we're not reordering in the end
+		if q.Order == nil && limit >= 0 && loadFromStripe > limit {
 			// TODO/ARCH: all this limit handling is a bit clunky, simplify it quite a bit
-			if q.Order == nil && limit >= 0 && stripe.Length > limit {
+			if filter == nil {
 				filter = bitmap.NewBitmap(stripe.Length)
 				filter.Invert()
-				filter.KeepFirstN(limit)
 			}
-		}
-		if filter != nil && filter.Count() < loadFromStripe {
-			loadFromStripe = filter.Count()
-		}
-		if q.Order == nil && limit >= 0 && limit < loadFromStripe {
-			loadFromStripe = limit
+			loadFromStripe = filter.KeepFirstN(limit)
 		}
 		if loadFromStripe == 0 {
+			if pastRange {
+				break
+			}
 			continue
 		}
 		if q.Order == nil {
 			limit -= loadFromStripe
 		}
-		// we construct an intermediate column storage and sort it before adding it to our result
-		// this will help us remove most of the data we don't need in case we're sorting it
-		// OPTIM: either top-k to avoid most of the sort (might be tricky when sorting by multiple cols)
-		// OPTIM: merge sort in the end, not append + sort (again, tricky for multiple cols)
+		// we construct an intermediate column storage and prune it (using top-k) before adding it to
+		// our result, this will help us remove most of the data we don't need in case we're sorting it
+		// OPTIM: merge sort in the end, not append + sort (tricky for multiple cols)
 		intermediate := &Result{}
+		_, stopProject := startTimer(ctx, stageProject)
 		for _, colExpr := range q.Select {
 			col, err := expr.Evaluate(colExpr, loadFromStripe, columns, filter)
 			if err != nil {
@@ -625,34 +1005,206 @@ func Run(db *database.Database, q expr.Query) (*Result, error) {
 
 			intermediate.Data = append(intermediate.Data, col)
 		}
+		stopProject()
 		intermediate.Length = intermediate.Data[0].Len()
+		if err := budget.check(chunksHeld(columns, res.Data, intermediate.Data)...); err != nil {
+			return nil, err
+		}
 
-		if q.Order != nil && limit > 0 && intermediate.Length > limit {
-			intermediate.Length = limit
-			if err := reorder(intermediate, q); err != nil {
+		if q.Order != nil && limit >= 0 {
+			_, stopSort := startTimer(ctx, stageSort)
+			err := topK(intermediate, q, limit)
+			stopSort()
+			if err != nil {
 				return nil, err
 			}
-			intermediate.Prune()
 		}
 		for j, col := range intermediate.Data {
 			if err := res.Data[j].Append(col); err != nil {
 				return nil, err
 			}
 		}
+		// once our first stripe gets through, we reserve room for all the other rows we expect
+		if expected > 0 {
+			for _, col := range res.Data {
+				col.Grow(expected - col.Len())
+			}
+			expected = 0
+		}
+		// keep our accumulated results bounded as well, so we only ever hold O(limit) rows
+		if q.Order != nil && limit >= 0 {
+			res.Length = res.Data[0].Len()
+			_, stopSort := startTimer(ctx, stageSort)
+			err := topK(res, q, limit)
+			stopSort()
+			if err != nil {
+				return nil, err
+			}
+		}
 
-		if limit <= 0 {
+		if (q.Limit != nil && limit <= 0) || pastRange {
 			break
 		}
 	}
 	res.Length = res.Data[0].Len()
 	if q.Order != nil {
-		if err := reorder(res, q); err != nil {
+		_, stopSort := startTimer(ctx, stageSort)
+		err := reorder(res, q)
+		stopSort()
+		if err != nil {
 			return nil, err
 		}
 		if q.Limit != nil && *q.Limit < res.Length {
 			res.Length = *q.Limit
 		}
 	}
+	// presorted data only need their ordering described
+	if q.Order == nil && order != nil {
+		q.Order = order
+		if err := sortingColumns(res, q); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// expectedRows estimates how many rows a plain (non-aggregating) query accumulates, so that we can
+// reserve room for them upfront (see column.Chunk.Grow). It's exact for unfiltered queries, filtered
+// (or sampled) ones only get their LIMIT reserved, if any, because they may well match just a few
+// rows. Ordered queries with a LIMIT keep replacing their results (see topK), so there's nothing to
+// reserve, we return zero in that case (and whenever we cannot tell).
+// ARCH: reservations count towards memory budgets (see memoryBudget), so queries bound to exceed
+// theirs fail early on
+func expectedRows(ds *database.Dataset, q expr.Query, limit int) int {
+	if q.Order != nil && limit >= 0 {
+		return 0
+	}
+	var total int
+	for _, stripe := range ds.Stripes {
+		total += stripe.Length
+	}
+	if limit >= 0 && limit < total {
+		return limit
+	}
+	if q.Filter != nil || q.Sample != nil {
+		return 0
+	}
+	return total
+}
 
+// runWithOffset runs a query with its LIMIT extended by its OFFSET and then skips the offset rows
+// OPTIM: we still evaluate (and sort) all the skipped rows, large offsets are about as expensive as
+// running the query without a LIMIT (see SkipRows for paging through results without re-running them)
+func runWithOffset(ctx context.Context, db *database.Database, q expr.Query) (*Result, error) {
+	offset := *q.Offset
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: %v", errInvalidOffsetValue, offset)
+	}
+	inner := q
+	inner.Offset = nil
+	if q.Limit != nil {
+		if *q.Limit < 0 {
+			return nil, fmt.Errorf("%w: %v", errInvalidLimitValue, *q.Limit)
+		}
+		limit := *q.Limit + offset
+		inner.Limit = &limit
+	}
+	res, err := run(ctx, db, inner)
+	if err != nil {
+		return nil, err
+	}
+	if res.Plan != nil {
+		res.Plan.addStep(stageOffset, fmt.Sprint(offset))
+		return res, nil
+	}
+	return res.SkipRows(offset), nil
+}
+
+// SkipRows returns a copy of our results without their first n rows (in their final order), no data
+// get copied, we only adjust which rows get served
+func (res *Result) SkipRows(n int) *Result {
+	ret := res.shallowCopy()
+	if n > ret.Length {
+		n = ret.Length
+	}
+	ret.rowIdxs = ret.positions()[n:]
+	ret.Length -= n
+	return ret
+}
+
+// runUnion runs all parts of a UNION ALL query independently and appends their results, column types
+// get widened where needed (e.g. ints and floats result in floats), column names are taken from
+// the first part
+// OPTIM: we run parts one by one, they could run concurrently
+func runUnion(ctx context.Context, db *database.Database, q expr.Query) (*Result, error) {
+	first := q
+	first.Union = nil
+	parts := append([]expr.Query{first}, q.Union...)
+	results := make([]*Result, 0, len(parts))
+	for _, part := range parts {
+		part.Explain = q.Explain
+		tctx, stop := startTimer(ctx, timerUnionPart)
+		pres, err := run(tctx, db, part)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, pres)
+	}
+	if q.Explain {
+		for _, pres := range results[1:] {
+			results[0].Plan.Union = append(results[0].Plan.Union, pres.Plan)
+		}
+		return results[0], nil
+	}
+
+	schema := append(column.TableSchema{}, results[0].Schema...)
+	for _, pres := range results[1:] {
+		if len(pres.Schema) != len(schema) {
+			return nil, fmt.Errorf("%w: expecting %v, got %v", errUnionColumnCount, len(schema), len(pres.Schema))
+		}
+		for j, col := range pres.Schema {
+			dtype, ok := column.WidenType(schema[j].Dtype, col.Dtype)
+			if !ok {
+				return nil, fmt.Errorf("%w: %v (%v) and %v (%v)", errUnionIncompatibleTypes, schema[j].Name, schema[j].Dtype, col.Name, col.Dtype)
+			}
+			schema[j].Dtype = dtype
+			schema[j].Nullable = schema[j].Nullable || col.Nullable
+		}
+	}
+
+	var total int
+	for _, pres := range results {
+		total += pres.Length
+	}
+	res := &Result{Schema: schema, Data: make([]*column.Chunk, len(schema))}
+	for j, col := range schema {
+		res.Data[j] = column.NewChunk(col.Dtype)
+		res.Data[j].Grow(total)
+	}
+	budget := &memoryBudget{limit: db.Config.MaxQueryMemory}
+	for _, pres := range results {
+		// parts may be ordered
+		pres.Materialise()
+		for j, col := range pres.Data {
+			wide, err := col.Widen(schema[j].Dtype)
+			if err != nil {
+				return nil, err
+			}
+			if err := res.Data[j].Append(wide); err != nil {
+				return nil, err
+			}
+		}
+		res.bytesRead += pres.bytesRead
+		// if any dataset preserves special floats, we need to be able to render them
+		if pres.floats > res.floats {
+			res.floats = pres.floats
+		}
+		if err := budget.check(res.Data...); err != nil {
+			return nil, err
+		}
+	}
+	res.Length = res.Data[0].Len()
 	return res, nil
 }
@@ -1,14 +1,24 @@
 package query
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kokes/smda/src/column"
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
 	"github.com/kokes/smda/src/query/expr"
 )
 
@@ -33,7 +43,7 @@ func TestTheMostBasicQuery(t *testing.T) {
 	}
 
 	query := fmt.Sprintf("select foo, bar, baz from %v limit 100", ds.Name)
-	qr, err := RunSQL(db, query)
+	qr, err := RunSQL(context.Background(), db, query)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,6 +63,137 @@ func TestTheMostBasicQuery(t *testing.T) {
 	}
 }
 
+func TestStoringResults(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	data := strings.NewReader("foo,bar\n1,a\n4,b\n3,c\n2,d\n5,e")
+	ds, err := db.LoadDatasetFromReaderAuto("foodata", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		schema column.TableSchema
+		nrows  int
+		first  *column.Chunk
+	}{
+		{
+			fmt.Sprintf("SELECT foo, bar FROM %v ORDER BY foo DESC LIMIT 4", ds.Name),
+			column.TableSchema{
+				{Name: "foo", Dtype: column.DtypeInt},
+				{Name: "bar", Dtype: column.DtypeString},
+			},
+			4,
+			column.NewChunkIntsFromSlice([]int64{5, 4, 3, 2}, nil),
+		},
+		{
+			fmt.Sprintf("SELECT foo+1, count() FROM %v WHERE foo > 1 GROUP BY foo+1", ds.Name),
+			column.TableSchema{
+				{Name: "foo_1", Dtype: column.DtypeInt},
+				{Name: "count", Dtype: column.DtypeInt},
+			},
+			4,
+			column.NewChunkIntsFromSlice([]int64{5, 4, 3, 6}, nil),
+		},
+		{
+			// literals get hydrated (and named)
+			fmt.Sprintf("SELECT 2, bar FROM %v LIMIT 3", ds.Name),
+			column.TableSchema{
+				{Name: "column2", Dtype: column.DtypeInt},
+				{Name: "bar", Dtype: column.DtypeString},
+			},
+			3,
+			column.NewChunkIntsFromSlice([]int64{2, 2, 2}, nil),
+		},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Materialise()
+		stored, err := db.StoreResult("derived", res.Schema, res.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stored.Schema, test.schema) {
+			t.Errorf("expecting %v to be stored with schema %+v, got %+v", test.query, test.schema, stored.Schema)
+		}
+		if stored.NRows != int64(test.nrows) || len(stored.Stripes) != (test.nrows+1)/2 {
+			t.Errorf("expecting %v to be stored as %v rows, got %v rows in %v stripes", test.query, test.nrows, stored.NRows, len(stored.Stripes))
+		}
+
+		// we can now query the derived dataset like any other
+		derived, err := RunSQL(context.Background(), db, fmt.Sprintf("SELECT %v FROM %v@v%v LIMIT 100", stored.Schema[0].Name, stored.Name, stored.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !column.ChunksEqual(derived.Data[0], test.first) {
+			t.Errorf("expecting %v to result in %+v, got %+v", test.query, test.first, derived.Data[0])
+		}
+	}
+}
+
+func TestQueriesWithParams(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	data := strings.NewReader("id,name\n1,foo\n2,bar\n3,o'reilly")
+	ds, err := db.LoadDatasetFromReaderAuto("foodata", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		params   []interface{}
+		expected *column.Chunk
+	}{
+		{"SELECT id FROM foodata WHERE id = ? LIMIT 10", []interface{}{2}, column.NewChunkIntsFromSlice([]int64{2}, nil)},
+		{"SELECT id FROM foodata WHERE id > ? AND id < ? LIMIT 10", []interface{}{1, 2.5}, column.NewChunkIntsFromSlice([]int64{2}, nil)},
+		{"SELECT id + ? FROM foodata LIMIT 10", []interface{}{10}, column.NewChunkIntsFromSlice([]int64{11, 12, 13}, nil)},
+		// values are never interpolated in SQL, so quotes and injections are a non-issue
+		{"SELECT id FROM foodata WHERE name = ? LIMIT 10", []interface{}{"o'reilly"}, column.NewChunkIntsFromSlice([]int64{3}, nil)},
+		{"SELECT id FROM foodata WHERE name = ? LIMIT 10", []interface{}{"foo' OR 1=1 --"}, column.NewChunkIntsFromSlice([]int64{}, nil)},
+	}
+	for _, test := range tests {
+		res, err := RunSQLWithParams(context.Background(), db, test.query, test.params...)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !column.ChunksEqual(res.Data[0], test.expected) {
+			t.Errorf("expecting %v with %v to result in %v, got %v", test.query, test.params, test.expected, res.Data[0])
+		}
+	}
+
+	if _, err := RunSQLWithParams(context.Background(), db, "SELECT id FROM foodata WHERE id = ?"); err == nil {
+		t.Error("expecting a query with unbound parameters to fail")
+	}
+}
+
 func TestQueryInvalidFilter(t *testing.T) {
 	db, err := database.NewDatabase("", nil)
 	if err != nil {
@@ -74,7 +215,7 @@ func TestQueryInvalidFilter(t *testing.T) {
 	}
 	q := expr.Query{Select: nil, Dataset: &expr.Dataset{Name: ds.Name, Latest: true}}
 
-	if _, err := Run(db, q); err != errNoProjection {
+	if _, err := Run(context.Background(), db, q); err != errNoProjection {
 		t.Errorf("expected that selecting nothing will yield %v, got %v instead", errNoProjection, err)
 	}
 }
@@ -99,57 +240,1980 @@ func TestLimitsInQueries(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	firstColRaw := []string{"1", "4", "7"}
-	cols, err := expr.ParseStringExprs("foo, bar, baz")
-	if err != nil {
-		t.Fatal(err)
-	}
-	q := expr.Query{Select: cols, Dataset: &expr.Dataset{Name: ds.Name, Latest: true}}
-
-	// limit omitted
-	qr, err := Run(db, q)
-	if err != nil {
-		t.Error(err)
-	}
-	if ds.Stripes[0].Length != len(firstColRaw) {
-		t.Errorf("omitting a limit should result in getting all the data, got only %d rows", qr.Data[0].Len())
+	firstColRaw := []string{"1", "4", "7"}
+	cols, err := expr.ParseStringExprs("foo, bar, baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := expr.Query{Select: cols, Dataset: &expr.Dataset{Name: ds.Name, Latest: true}}
+
+	// limit omitted
+	qr, err := Run(context.Background(), db, q)
+	if err != nil {
+		t.Error(err)
+	}
+	if ds.Stripes[0].Length != len(firstColRaw) {
+		t.Errorf("omitting a limit should result in getting all the data, got only %d rows", qr.Data[0].Len())
+	}
+
+	// negative limits
+	for _, limit := range []int{-100, -20, -1} {
+		q.Limit = &limit
+		_, err := Run(context.Background(), db, q)
+		if !errors.Is(err, errInvalidLimitValue) {
+			t.Errorf("expected error for negative values to be %+v, got %+v instead", errInvalidLimitValue, err)
+		}
+	}
+
+	// non-negative limits
+	for limit := 0; limit < 100; limit++ {
+		q.Limit = &limit
+
+		qr, err := Run(context.Background(), db, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expschema := column.TableSchema{
+			column.Schema{Name: "foo", Dtype: column.DtypeInt, Nullable: false},
+			column.Schema{Name: "bar", Dtype: column.DtypeInt, Nullable: false},
+			column.Schema{Name: "baz", Dtype: column.DtypeInt, Nullable: false},
+		}
+		if !(reflect.DeepEqual(qr.Schema, expschema) && len(qr.Data) == 3) {
+			t.Errorf("expected schema %+v, got %+v instead", expschema, qr.Schema)
+		}
+		firstCol := column.NewChunk(column.DtypeInt)
+		if limit > len(firstColRaw) {
+			firstCol.AddValues(firstColRaw)
+		} else {
+			firstCol.AddValues(firstColRaw[:limit])
+		}
+		if !reflect.DeepEqual(qr.Data[0], firstCol) {
+			t.Errorf("first column does not match what's expected: %+v vs. %+v", qr.Data[0], firstCol)
+		}
+	}
+}
+
+// resultRows formats query results as they get serialised (rows in their final order)
+func resultRows(t *testing.T, res *Result) string {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(res); err != nil {
+		t.Fatal(err)
+	}
+	var dec struct {
+		Data [][]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &dec); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(dec.Data)
+}
+
+func TestQueriesInTimezones(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	// datetimes are loaded as UTC, the first one is already March in Prague
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("dt\n2020-02-29 23:30:00\n2020-07-01 12:00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		timezone string
+		expected string
+	}{
+		{"SELECT dt FROM foo", "", "[[2020-02-29 23:30:00.000000] [2020-07-01 12:00:00.000000]]"},
+		{"SELECT dt FROM foo", "UTC", "[[2020-02-29 23:30:00.000000] [2020-07-01 12:00:00.000000]]"},
+		{"SELECT dt FROM foo", "Europe/Prague", "[[2020-03-01 00:30:00.000000] [2020-07-01 14:00:00.000000]]"},
+		{"SELECT date_trunc('month', dt) FROM foo", "", "[[2020-02-01 00:00:00.000000] [2020-07-01 00:00:00.000000]]"},
+		{"SELECT date_trunc('month', dt) FROM foo", "Europe/Prague", "[[2020-03-01 00:00:00.000000] [2020-07-01 00:00:00.000000]]"},
+		{"SELECT extract(day FROM dt), extract(epoch FROM dt) FROM foo LIMIT 1", "Europe/Prague", "[[1 1.583019e+09]]"},
+		{"SELECT extract(day FROM dt), extract(epoch FROM dt) FROM foo LIMIT 1", "", "[[29 1.583019e+09]]"},
+		// literals are local times
+		{"SELECT count() FROM foo WHERE dt >= cast('2020-03-01 00:00:00' AS datetime)", "Europe/Prague", "[[2]]"},
+		{"SELECT count() FROM foo WHERE dt >= cast('2020-03-01 00:00:00' AS datetime)", "", "[[1]]"},
+		{"SELECT cast('2020-03-01 00:00:00' AS datetime)", "Europe/Prague", "[[2020-03-01 00:00:00.000000]]"},
+		// so are parts of unions and subqueries, their results are only converted once
+		{"SELECT dt FROM foo WHERE dt = (SELECT min(dt) FROM foo) UNION ALL SELECT cast('2020-01-01 12:00:00' AS datetime)", "Europe/Prague", "[[2020-03-01 00:30:00.000000] [2020-01-01 12:00:00.000000]]"},
+	}
+	cache := NewCache(10)
+	for _, test := range tests {
+		res, err := cache.RunSQLWithSettings(context.Background(), db, test.query, Settings{Timezone: test.timezone})
+		if err != nil {
+			t.Errorf("query %q (in %q) failed: %v", test.query, test.timezone, err)
+			continue
+		}
+		if got := resultRows(t, res); got != test.expected {
+			t.Errorf("expecting %q (in %q) to result in %v, got %v", test.query, test.timezone, test.expected, got)
+		}
+	}
+	if _, err := cache.RunSQLWithSettings(context.Background(), db, "SELECT dt FROM foo", Settings{Timezone: "Europe/Atlantis"}); err == nil {
+		t.Error("expecting unknown timezones to fail")
+	}
+}
+
+func TestOrderingWithLimits(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT a FROM foo ORDER BY a DESC LIMIT 2", "[[9] [5]]"},
+		{"SELECT a FROM foo ORDER BY a LIMIT 3", "[[1] [2] [3]]"},
+		{"SELECT a FROM foo ORDER BY a LIMIT 0", "[]"},
+		{"SELECT a FROM foo ORDER BY a LIMIT 100", "[[1] [2] [3] [5] [5] [9]]"},
+		{"SELECT a, b FROM foo ORDER BY a DESC, b LIMIT 3", "[[9 z] [5 a] [5 y]]"},
+		{"SELECT a, b FROM foo ORDER BY 1 DESC, 2 DESC LIMIT 3", "[[9 z] [5 y] [5 a]]"},
+		{"SELECT b FROM foo ORDER BY b DESC LIMIT 2", "[[z] [y]]"},
+		{"SELECT c FROM foo ORDER BY c NULLS FIRST LIMIT 3", "[[<nil>] [<nil>] [1]]"},
+		{"SELECT c FROM foo ORDER BY c DESC NULLS LAST LIMIT 2", "[[4] [3]]"},
+		// descending orderings put nulls first by default (like Postgres)
+		{"SELECT c FROM foo ORDER BY c DESC LIMIT 3", "[[<nil>] [<nil>] [4]]"},
+		{"SELECT c FROM foo ORDER BY c NULLS LAST LIMIT 2", "[[1] [2]]"},
+		// ties retain the order of their rows
+		{"SELECT a, c FROM foo ORDER BY a DESC LIMIT 3", "[[9 4] [5 <nil>] [5 3]]"},
+		{"SELECT c, a FROM foo ORDER BY c LIMIT 100", "[[1 1] [2 3] [3 5] [4 9] [<nil> 5] [<nil> 2]]"},
+		{"SELECT a FROM foo WHERE a > 2 ORDER BY a LIMIT 2", "[[3] [5]]"},
+		{"SELECT a, 1 FROM foo ORDER BY a LIMIT 2", "[[1 1] [2 1]]"},
+	}
+	// a single stripe as well as many small ones, so that we exercise both top-k within a stripe
+	// and across stripes
+	for _, rowsPerStripe := range []int{0, 1, 2, 4} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b,c\n1,x,1\n5,y,\n3,,2\n9,z,4\n2,y,\n5,a,3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultRows(t, res); got != test.expected {
+				t.Errorf("[%v rows per stripe] expecting %v to result in %v, got %v", rowsPerStripe, test.query, test.expected, got)
+			}
+		}
+	}
+}
+
+// random data with plenty of ties and nulls, sorted by random keys, need to match a reference
+// (stable) sort, regardless of how the data is striped and if they get limited or not
+func TestOrderingRandomData(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	type row struct {
+		id int
+		a  *int
+		b  string
+		c  *float64
+	}
+	var rows []row
+	var buf strings.Builder
+	buf.WriteString("id,a,b,c\n")
+	for j := 0; j < 200; j++ {
+		r := row{id: j, b: []string{"", "x", "y", "z"}[rng.Intn(4)]}
+		as, cs := "", ""
+		if rng.Intn(3) > 0 {
+			a := rng.Intn(5) - 2
+			r.a, as = &a, strconv.Itoa(a)
+		}
+		if rng.Intn(3) > 0 {
+			c := float64(rng.Intn(4)) / 2
+			r.c, cs = &c, strconv.FormatFloat(c, 'f', -1, 64)
+		}
+		rows = append(rows, r)
+		fmt.Fprintf(&buf, "%v,%v,%v,%v\n", j, as, r.b, cs)
+	}
+	// -1, 0, 1 for nulls or value comparisons, nulls are placed regardless of direction
+	compareNulls := func(null1, null2, nullsFirst bool) (int, bool) {
+		if null1 == null2 {
+			return 0, null1
+		}
+		if null1 == nullsFirst {
+			return -1, true
+		}
+		return 1, true
+	}
+	compareKey := func(r1, r2 row, col string, asc, nullsFirst bool) int {
+		var cmp int
+		switch col {
+		case "a":
+			if c, done := compareNulls(r1.a == nil, r2.a == nil, nullsFirst); done {
+				return c
+			}
+			cmp = *r1.a - *r2.a
+		case "b":
+			cmp = strings.Compare(r1.b, r2.b)
+		case "c":
+			if c, done := compareNulls(r1.c == nil, r2.c == nil, nullsFirst); done {
+				return c
+			}
+			cmp = int(2 * (*r1.c - *r2.c))
+		}
+		if !asc {
+			cmp = -cmp
+		}
+		return cmp
+	}
+
+	for _, rowsPerStripe := range []int{0, 7} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(buf.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		for iter := 0; iter < 50; iter++ {
+			type key struct {
+				col             string
+				asc, nullsFirst bool
+			}
+			var keys []key
+			var clauses []string
+			for _, col := range rng.Perm(3)[:1+rng.Intn(3)] {
+				k := key{col: []string{"a", "b", "c"}[col], asc: rng.Intn(2) == 0, nullsFirst: rng.Intn(2) == 0}
+				keys = append(keys, k)
+				dir, nulls := "ASC", "NULLS LAST"
+				if !k.asc {
+					dir = "DESC"
+				}
+				if k.nullsFirst {
+					nulls = "NULLS FIRST"
+				}
+				clauses = append(clauses, fmt.Sprintf("%v %v %v", k.col, dir, nulls))
+			}
+			limit := len(rows)
+			query := fmt.Sprintf("SELECT id, a, b, c FROM foo ORDER BY %v", strings.Join(clauses, ", "))
+			if rng.Intn(2) == 0 {
+				limit = rng.Intn(20)
+				query += fmt.Sprintf(" LIMIT %v", limit)
+			}
+
+			expected := make([]row, len(rows))
+			copy(expected, rows)
+			sort.SliceStable(expected, func(i, j int) bool {
+				for _, k := range keys {
+					if cmp := compareKey(expected[i], expected[j], k.col, k.asc, k.nullsFirst); cmp != 0 {
+						return cmp < 0
+					}
+				}
+				return false
+			})
+			var expectedIDs []int
+			for _, r := range expected[:limit] {
+				expectedIDs = append(expectedIDs, r.id)
+			}
+
+			res, err := RunSQL(context.Background(), db, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for j := 0; j < res.Length; j++ {
+				val, _ := res.Data[0].JSONLiteral(res.rowIdxs[j])
+				id, err := strconv.Atoi(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, id)
+			}
+			if !reflect.DeepEqual(got, expectedIDs) {
+				t.Errorf("[%v rows per stripe] expecting %v to result in rows %v, got %v", rowsPerStripe, query, expectedIDs, got)
+			}
+		}
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT a FROM foo OFFSET 0", "[[1] [5] [3] [9] [2] [5]]"},
+		{"SELECT a FROM foo OFFSET 4", "[[2] [5]]"},
+		{"SELECT a FROM foo LIMIT 2 OFFSET 1", "[[5] [3]]"},
+		{"SELECT a FROM foo LIMIT 2 OFFSET 5", "[[5]]"},
+		{"SELECT a FROM foo LIMIT 2 OFFSET 100", "[]"},
+		{"SELECT a FROM foo WHERE a > 2 LIMIT 2 OFFSET 1", "[[3] [9]]"},
+		{"SELECT a FROM foo ORDER BY a LIMIT 2 OFFSET 2", "[[3] [5]]"},
+		{"SELECT a, b FROM foo ORDER BY a DESC, b OFFSET 3", "[[3 ] [2 y] [1 x]]"},
+		{"SELECT b, count() FROM foo GROUP BY b ORDER BY b LIMIT 2 OFFSET 1", "[[a 1] [x 1]]"},
+		{"SELECT count() FROM foo OFFSET 1", "[]"},
+		{"SELECT 1 OFFSET 0", "[[1]]"},
+		{"SELECT 1 OFFSET 1", "[]"},
+		// offsets apply to individual parts of a union
+		{"SELECT a FROM foo LIMIT 1 OFFSET 1 UNION ALL SELECT a FROM foo LIMIT 1 OFFSET 3", "[[5] [9]]"},
+	}
+	for _, rowsPerStripe := range []int{0, 1, 4} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b,c\n1,x,1\n5,y,\n3,,2\n9,z,4\n2,y,\n5,a,3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultRows(t, res); got != test.expected {
+				t.Errorf("[%v rows per stripe] expecting %v to result in %v, got %v", rowsPerStripe, test.query, test.expected, got)
+			}
+		}
+
+		res, err := RunSQL(context.Background(), db, "EXPLAIN SELECT a FROM foo LIMIT 2 OFFSET 3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := res.Plan.Steps
+		if last := steps[len(steps)-2:]; !reflect.DeepEqual(last, []PlanStep{{stageLimit, "5"}, {stageOffset, "3"}}) {
+			t.Errorf("expecting offsets to be explained after (extended) limits, got %+v", last)
+		}
+	}
+
+	// negative offsets cannot be parsed, but they can be constructed
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	q, err := expr.ParseQuerySQL("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := -1
+	q.Offset = &offset
+	if _, err := Run(context.Background(), db, q); !errors.Is(err, errInvalidOffsetValue) {
+		t.Errorf("expecting negative offsets to fail with %v, got %v", errInvalidOffsetValue, err)
+	}
+}
+
+func TestDistinctAggregations(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT count(distinct a) FROM foo", "[[3]]"},
+		{"SELECT count(distinct b) FROM foo", "[[4]]"},
+		{"SELECT count(distinct c) FROM foo", "[[2]]"},
+		{"SELECT count(distinct d) FROM foo", "[[3]]"}, // 1.2 and 1.20 are the same
+		{"SELECT count(distinct e) FROM foo", "[[2]]"},
+		{"SELECT count(c) FROM foo", "[[5]]"},
+		{"SELECT sum(distinct a), sum(a) FROM foo", "[[6 12]]"},
+		{"SELECT avg(distinct a) FROM foo", "[[2]]"},
+		{"SELECT a, count(distinct b), sum(distinct d) FROM foo GROUP BY a", "[[1 2 1.2] [2 2 4.5] [3 1 2.3]]"},
+	}
+	// values repeat across stripes, so distinct sets need to persist between them
+	for _, rowsPerStripe := range []int{0, 1, 2} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		data := "a,b,c,d,e\n1,x,t,1.2,2020-01-01\n1,y,f,1.20,2020-01-01\n2,x,,2.3,\n2,z,t,2.20,2020-02-01\n3,w,t,2.3,2020-01-01\n3,w,f,2.3,2020-01-01"
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultRows(t, res); got != test.expected {
+				t.Errorf("[%v rows per stripe] expecting %v to result in %v, got %v", rowsPerStripe, test.query, test.expected, got)
+			}
+		}
+	}
+}
+
+func TestConstantColumns(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT sum(a), count(distinct a), min(s), max(d) FROM foo", "[[40 1 foo 1.2]]"},
+		{"SELECT sum(1), count(distinct g), sum(distinct a) FROM foo", "[[8 2 5]]"},
+		{"SELECT g, sum(a), count() FROM foo GROUP BY g ORDER BY g", "[[x 20 4] [y 20 4]]"},
+		{"SELECT s, g, max(id) FROM foo GROUP BY s, g ORDER BY g DESC", "[[foo y 8] [foo x 4]]"},
+		{"SELECT a, id FROM foo ORDER BY a DESC, id DESC LIMIT 2", "[[5 8] [5 7]]"},
+		{"SELECT count() FROM foo WHERE s = 'foo' AND g = 'y'", "[[4]]"},
+		{"SELECT id FROM foo WHERE a > id", "[[1] [2] [3] [4]]"},
+		{"SELECT upper(g), a * id FROM foo WHERE id IN (4, 5)", "[[X 20] [Y 25]]"},
+	}
+	// constant columns (or constant within stripes) get read as literals
+	for _, rowsPerStripe := range []int{0, 4} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		var data strings.Builder
+		data.WriteString("id,a,s,d,g\n")
+		for j := 1; j <= 8; j++ {
+			g := "x"
+			if j > 4 {
+				g = "y"
+			}
+			data.WriteString(fmt.Sprintf("%v,5,foo,1.20,%v\n", j, g))
+		}
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(data.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultRows(t, res); got != test.expected {
+				t.Errorf("[%v rows per stripe] expecting %v to result in %v, got %v", rowsPerStripe, test.query, test.expected, got)
+			}
+		}
+	}
+}
+
+func TestAggregatingNulls(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		// nulls are skipped, they don't count as zeroes
+		{"SELECT count(), count(a), sum(a), avg(a), min(a), max(a) FROM foo", "[[6 4 10 2.5 1 4]]"},
+		{"SELECT count(n), sum(n), avg(n), min(n), max(n) FROM foo", "[[0 <nil> <nil> <nil> <nil>]]"},
+		{"SELECT g, count(a), sum(a), avg(a) FROM foo GROUP BY g", "[[x 2 3 1.5] [y 2 7 3.5]]"},
+		{"SELECT g, count(n), sum(n) FROM foo GROUP BY g", "[[x 0 <nil>] [y 0 <nil>]]"},
+		{"SELECT count() FILTER (WHERE a > 1), sum(a) FILTER (WHERE a > 1), avg(a) FILTER (WHERE a > 1) FROM foo", "[[3 9 3]]"},
+		{"SELECT count(a) filter (where a > 10), sum(a) filter (where a > 10) FROM foo", "[[0 <nil>]]"},
+		// rows with null conditions are filtered out
+		{"SELECT count() FILTER (WHERE a > 0) FROM foo", "[[4]]"},
+		{"SELECT g, count() FILTER (WHERE a < 4), sum(a) FILTER (WHERE g = 'y') FROM foo GROUP BY g", "[[x 2 <nil>] [y 1 7]]"},
+		{"SELECT count(distinct g) FILTER (WHERE a = 4) FROM foo", "[[1]]"},
+		{"SELECT sum(a) FILTER (WHERE a > 1) FROM foo WHERE g = 'x'", "[[2]]"},
+		// a field called filter is still a valid alias
+		{"SELECT sum(a) filter FROM foo", "[[10]]"},
+	}
+	for _, rowsPerStripe := range []int{0, 1, 2} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		data := "g,a,n\nx,1,\nx,,\ny,3,\ny,4,\nx,,\nx,2,"
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultRows(t, res); got != test.expected {
+				t.Errorf("[%v rows per stripe] expecting %v to result in %v, got %v", rowsPerStripe, test.query, test.expected, got)
+			}
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	// small stripes, so that reading them fits within our budget, it's the results that don't fit
+	db, err := database.NewDatabase("", &database.Config{MaxQueryMemory: 100_000, MaxRowsPerStripe: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var large strings.Builder
+	large.WriteString("a,b\n")
+	for j := 0; j < 50_000; j++ {
+		large.WriteString(fmt.Sprintf("%v,%v\n", j, j%10))
+	}
+	for name, data := range map[string]string{"small": "a,b\n1,2\n3,4", "large": large.String()} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		err   error
+	}{
+		{"SELECT a FROM small LIMIT 100", nil},
+		{"SELECT b, sum(a) FROM small GROUP BY b", nil},
+		{"SELECT a FROM large LIMIT 100", nil},
+		// top-k keeps only a few rows around
+		{"SELECT a FROM large ORDER BY a DESC LIMIT 100", nil},
+		{"SELECT b, sum(a) FROM large GROUP BY b", nil},
+		{"SELECT a FROM large LIMIT 100000", errMemoryBudgetExceeded},
+		{"SELECT a, count() FROM large GROUP BY a", errMemoryBudgetExceeded},
+	}
+	for _, test := range tests {
+		if _, err := RunSQL(context.Background(), db, test.query); !errors.Is(err, test.err) {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.err, err)
+		}
+	}
+}
+
+func TestScanLimits(t *testing.T) {
+	// cached chunks don't count towards the limit, so we don't cache any
+	db, err := database.NewDatabase("", &database.Config{MaxBytesScanned: 50_000, MaxRowsPerStripe: 1000, ChunkCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var large strings.Builder
+	large.WriteString("a,b\n")
+	for j := 0; j < 50_000; j++ {
+		large.WriteString(fmt.Sprintf("%v,%v\n", j, j%10))
+	}
+	for name, data := range map[string]string{"small": "a,b\n1,2\n3,4", "large": large.String()} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		settings Settings
+		err      error
+	}{
+		{"SELECT a FROM small", Settings{}, nil},
+		{"SELECT a FROM large LIMIT 10", Settings{}, nil},
+		{"SELECT a FROM large WHERE a < 0", Settings{}, errQueryTooExpensive},
+		{"SELECT sum(a) FROM large", Settings{}, errQueryTooExpensive},
+		{"SELECT b, sum(a) FROM large GROUP BY b", Settings{}, errQueryTooExpensive},
+		// all parts of a query share the same limit
+		{"SELECT a FROM small WHERE a IN (SELECT a FROM large)", Settings{}, errQueryTooExpensive},
+		{"WITH t AS (SELECT a FROM large LIMIT 10) SELECT a FROM t UNION ALL SELECT a FROM large LIMIT 10", Settings{MaxBytesScanned: 5000}, errQueryTooExpensive},
+		// queries can override the default in both directions
+		{"SELECT sum(a) FROM large", Settings{MaxBytesScanned: 1_000_000}, nil},
+		{"SELECT b, sum(a) FROM large GROUP BY b", Settings{MaxBytesScanned: -1}, nil},
+		{"SELECT a FROM large LIMIT 10", Settings{MaxBytesScanned: 100}, errQueryTooExpensive},
+	}
+	cache := NewCache(0)
+	for _, test := range tests {
+		_, err := cache.RunSQLWithSettings(context.Background(), db, test.query, test.settings)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %v (%+v) to result in %v, got %v", test.query, test.settings, test.err, err)
+		}
+		if test.err != nil && errs.Code(err) != "resource_exhausted" {
+			t.Errorf("expecting expensive queries to exhaust resources, got %v", errs.Code(err))
+		}
+	}
+}
+
+func TestQueryTimeouts(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{QueryTimeout: 20, MaxRowsPerStripe: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2\n3\n4\n5\n6\n7\n8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// each stripe takes a while to get through, so that our queries are slow for sure
+	ctx := WithProgress(context.Background(), func(Progress) {
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	tests := []struct {
+		query    string
+		settings Settings
+		timeout  bool
+	}{
+		{"SELECT a FROM foo", Settings{}, true},
+		{"SELECT sum(a) FROM foo", Settings{}, true},
+		{"SELECT a FROM foo WHERE a IN (SELECT a FROM foo)", Settings{}, true},
+		{"SELECT a FROM foo LIMIT 1", Settings{}, false},
+		// queries can override the default in both directions
+		{"SELECT a FROM foo", Settings{Timeout: -1}, false},
+		{"SELECT a FROM foo", Settings{Timeout: 10_000}, false},
+		{"SELECT sum(a) FROM foo", Settings{Timeout: 5}, true},
+	}
+	cache := NewCache(0)
+	for _, test := range tests {
+		_, err := cache.RunSQLWithSettings(ctx, db, test.query, test.settings)
+		var te *TimeoutError
+		if errors.As(err, &te) != test.timeout {
+			t.Errorf("expecting %v (%+v) to time out: %v, got %v", test.query, test.settings, test.timeout, err)
+			continue
+		}
+		if !test.timeout {
+			continue
+		}
+		if errs.Code(err) != "timeout" || te.ElapsedMs < te.TimeoutMs || te.StripesRead == 0 {
+			t.Errorf("expecting a timeout with its diagnostics, got %v (%+v)", errs.Code(err), te)
+		}
+	}
+
+	// cancellations by callers are not timeouts
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := RunSQL(cctx, db, "SELECT a FROM foo"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expecting a cancelled query not to time out, got %v", err)
+	}
+}
+
+func TestQueryCancellation(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, query := range []string{"SELECT a FROM foo LIMIT 10", "SELECT b, sum(a) FROM foo GROUP BY b"} {
+		if _, err := RunSQL(ctx, db, query); !errors.Is(err, context.Canceled) {
+			t.Errorf("expecting a cancelled query %v to fail with %v, got %v", query, context.Canceled, err)
+		}
+	}
+}
+
+func TestQueryProgress(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4\n5,6\n7,8\n9,10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query       string
+		stripesRead int
+	}{
+		{"SELECT a FROM foo", 3},
+		{"SELECT a FROM foo LIMIT 1", 1},
+		{"SELECT b, sum(a) FROM foo GROUP BY b", 3},
+		{"SELECT 1", 0},
+	}
+	for _, test := range tests {
+		var progress []Progress
+		ctx := WithProgress(context.Background(), func(p Progress) {
+			progress = append(progress, p)
+		})
+		res, err := RunSQL(ctx, db, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(progress) != test.stripesRead {
+			t.Errorf("expecting %v to report progress %v times, got %v", test.query, test.stripesRead, len(progress))
+			continue
+		}
+		for j, p := range progress {
+			if p.StripesRead != j+1 || p.StripesTotal != len(ds.Stripes) {
+				t.Errorf("unexpected progress of %v: %+v", test.query, p)
+			}
+		}
+		if len(progress) > 0 && progress[len(progress)-1].BytesRead != res.bytesRead {
+			t.Errorf("expecting %v to report %v bytes read, got %v", test.query, res.bytesRead, progress[len(progress)-1].BytesRead)
+		}
+	}
+}
+
+func TestUnionQueries(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for name, data := range map[string]string{
+		"ints":   "a,b\n1,foo\n2,bar\n3,baz",
+		"floats": "a,b\n1.5,foo\n,bar",
+		"dates":  "a,b\n2020-01-01,foo",
+	} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query  string
+		schema column.TableSchema
+		data   string
+		err    error
+	}{
+		{"SELECT a FROM ints UNION ALL SELECT a FROM ints", column.TableSchema{{Name: "a", Dtype: column.DtypeInt}}, "[[1] [2] [3] [1] [2] [3]]", nil},
+		{"SELECT a, b FROM ints WHERE a > 1 UNION ALL SELECT a, b FROM floats", column.TableSchema{{Name: "a", Dtype: column.DtypeFloat, Nullable: true}, {Name: "b", Dtype: column.DtypeString}}, "[[2 bar] [3 baz] [1.5 foo] [<nil> bar]]", nil},
+		{"SELECT a FROM ints ORDER BY a DESC LIMIT 2 UNION ALL SELECT 10", column.TableSchema{{Name: "a", Dtype: column.DtypeInt}}, "[[3] [2] [10]]", nil},
+		{"SELECT count() AS a FROM ints UNION ALL SELECT null UNION ALL SELECT max(a) FROM floats", column.TableSchema{{Name: "a", Dtype: column.DtypeFloat, Nullable: true}}, "[[3] [<nil>] [1.5]]", nil},
+		{"SELECT a FROM ints UNION ALL SELECT a, b FROM ints", nil, "", errUnionColumnCount},
+		{"SELECT a FROM ints UNION ALL SELECT b FROM ints", nil, "", errUnionIncompatibleTypes},
+		{"SELECT a FROM ints UNION ALL SELECT a FROM dates", nil, "", errUnionIncompatibleTypes},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(res.Schema, test.schema) {
+			t.Errorf("expecting %v to result in schema %v, got %v", test.query, test.schema, res.Schema)
+		}
+		raw, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Data [][]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if data := fmt.Sprint(decoded.Data); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+	}
+
+	res, err := RunSQL(context.Background(), db, "EXPLAIN SELECT a FROM ints UNION ALL SELECT a FROM floats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(res.Plan != nil && len(res.Plan.Union) == 1 && res.Plan.Union[0].StripesTotal == 1) {
+		t.Errorf("unexpected plan of a union: %+v", res.Plan)
+	}
+}
+
+func TestSubqueries(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for name, data := range map[string]string{
+		"orders":    "id,customer,amount\n1,1,10\n2,2,25.5\n3,1,4\n4,3,\n5,4,8",
+		"customers": "id,name,vip\n1,joe,t\n2,jane,f\n3,john,t\n,nobody,f",
+	} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		data  string
+		fails bool
+	}{
+		{"SELECT id FROM orders WHERE customer IN (SELECT id FROM customers WHERE vip)", "[[1] [3] [4]]", false},
+		{"SELECT id FROM orders WHERE customer NOT IN (SELECT id FROM customers WHERE vip)", "[[2] [5]]", false},
+		// ints get looked up in floats
+		{"SELECT id FROM orders WHERE id IN (SELECT amount FROM orders)", "[[4]]", false},
+		// nulls in the set make values not found in it unknown
+		{"SELECT id FROM orders WHERE customer NOT IN (SELECT id FROM customers)", "[]", false},
+		{"SELECT id FROM orders WHERE customer IN (SELECT id FROM customers WHERE name = 'nobody')", "[]", false},
+		{"SELECT id FROM orders WHERE customer NOT IN (SELECT id FROM customers WHERE false)", "[[1] [2] [3] [4] [5]]", false},
+		{"SELECT id FROM orders WHERE amount > (SELECT avg(amount) FROM orders)", "[[2]]", false},
+		{"SELECT id FROM orders WHERE amount < (SELECT max(amount) FROM orders WHERE false)", "[]", false},
+		{"SELECT id, (SELECT count() FROM customers) AS n FROM orders LIMIT 1", "[[1 4]]", false},
+		// empty scalar subqueries are nulls, comparisons with them are unknown (not IS NULL checks)
+		{"SELECT id FROM orders WHERE amount = (SELECT amount FROM orders WHERE amount > 100)", "[]", false},
+		{"SELECT id FROM orders WHERE NOT (amount = (SELECT amount FROM orders WHERE amount > 100))", "[]", false},
+		{"SELECT id FROM customers WHERE name = (SELECT name FROM customers WHERE false)", "[]", false},
+		{"SELECT 1 = (SELECT amount FROM orders WHERE false) AS x FROM orders LIMIT 1", "[[<nil>]]", false},
+		// nested subqueries
+		{"SELECT id FROM orders WHERE customer IN (SELECT id FROM customers WHERE name IN (SELECT 'jane'))", "[[2]]", false},
+		// IN subqueries need a single column, scalar subqueries a single row as well, the types need to be comparable
+		{"SELECT id FROM orders WHERE customer IN (SELECT id, name FROM customers)", "", true},
+		{"SELECT id FROM orders WHERE customer = (SELECT id FROM customers)", "", true},
+		{"SELECT id FROM orders WHERE customer IN (SELECT name FROM customers)", "", true},
+		// IN lists follow the same semantics, they can only contain constants
+		{"SELECT id FROM orders WHERE customer IN (1, 3)", "[[1] [3] [4]]", false},
+		{"SELECT id FROM orders WHERE customer NOT IN (1, 3, NULL)", "[]", false},
+		{"SELECT id FROM customers WHERE name IN ('jane', 'john', 'bob')", "[[2] [3]]", false},
+		{"SELECT count() FROM orders WHERE amount IN (4, 8.0)", "[[2]]", false},
+		{"SELECT id FROM orders WHERE customer IN (id, 2)", "", true},
+		{"SELECT id FROM orders WHERE customer IN ('joe')", "", true},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if test.fails {
+			if err == nil {
+				t.Errorf("expecting %v to fail", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expecting %v to succeed, got %v", test.query, err)
+			continue
+		}
+		raw, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Data [][]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if data := fmt.Sprint(decoded.Data); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+	}
+}
+
+func TestQueryingAliases(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var versions []*database.Dataset
+	for _, raw := range []string{"a\n1", "a\n1\n2"} {
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, ds)
+	}
+	if err := db.SetAlias(database.Alias{Name: "first_foo", Dataset: "foo", Version: versions[0].ID.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		data  string
+		err   error
+	}{
+		{"SELECT count() FROM foo@latest", "[[2]]", nil},
+		{"SELECT count() FROM first_foo", "[[1]]", nil},
+		{"SELECT count() FROM first_foo@latest", "[[1]]", nil},
+		{"SELECT count() FROM foo WHERE a IN (SELECT a FROM first_foo)", "[[1]]", nil},
+		{"SELECT a FROM first_foo UNION ALL SELECT a FROM foo@latest", "[[1] [1] [2]]", nil},
+		// common tables shadow aliases
+		{"WITH first_foo AS (SELECT 5 AS a) SELECT a FROM first_foo", "[[5]]", nil},
+		{fmt.Sprintf("SELECT count() FROM first_foo@v%v", versions[0].ID), "", errs.ErrNotFound},
+	}
+	cache := NewCache(10)
+	for _, test := range tests {
+		res, err := cache.RunSQLWithSettings(context.Background(), db, test.query, Settings{})
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := resultRows(t, res); got != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, got)
+		}
+	}
+
+	// cached results don't outlive repointed aliases
+	if err := db.SetAlias(database.Alias{Name: "first_foo", Dataset: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cache.RunSQLWithSettings(context.Background(), db, "SELECT count() FROM first_foo", Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultRows(t, res); got != "[[2]]" {
+		t.Errorf("expecting a repointed alias to resolve into the latest version, got %v", got)
+	}
+}
+
+func TestCommonTables(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for name, data := range map[string]string{
+		"orders":    "id,customer,amount\n1,1,10\n2,2,25.5\n3,1,4\n4,3,\n5,4,8",
+		"customers": "id,name\n1,joe\n2,jane\n3,john",
+	} {
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		data  string
+		err   error
+	}{
+		{"WITH big AS (SELECT id FROM orders WHERE amount > 5) SELECT id FROM big", "[[1] [2] [5]]", nil},
+		// column names get cleaned up, just like when storing results
+		{"WITH totals AS (SELECT customer, sum(amount) FROM orders GROUP BY customer) SELECT customer FROM totals WHERE sum_amount > 10 ORDER BY customer", "[[1] [2]]", nil},
+		// later tables can read earlier ones, the query can read them multiple times
+		{"WITH totals AS (SELECT customer, sum(amount) AS total FROM orders GROUP BY customer), top AS (SELECT customer, total FROM totals ORDER BY total DESC NULLS LAST LIMIT 1) SELECT name FROM customers WHERE id IN (SELECT customer FROM top)", "[[jane]]", nil},
+		{"WITH t AS (SELECT id FROM orders WHERE id < 3) SELECT id FROM t UNION ALL SELECT count() FROM t", "[[1] [2] [2]]", nil},
+		{"WITH t AS (SELECT 1 AS a UNION ALL SELECT 2) SELECT sum(a) FROM t", "[[3]]", nil},
+		{"WITH t AS (SELECT id FROM orders WHERE false) SELECT id FROM t", "[]", nil},
+		// common tables shadow datasets of the same name
+		{"WITH orders AS (SELECT id FROM customers) SELECT count() FROM orders", "[[3]]", nil},
+		{"WITH t AS (SELECT id FROM orders) SELECT amount FROM t", "", errs.ErrBadRequest},
+		{"WITH t AS (SELECT id FROM nonexistent) SELECT id FROM t", "", errs.ErrNotFound},
+		// common tables cannot read themselves (or those after them)
+		{"WITH t AS (SELECT id FROM u), u AS (SELECT id FROM orders) SELECT id FROM t", "", errs.ErrNotFound},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		raw, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Data [][]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if data := fmt.Sprint(decoded.Data); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+	}
+
+	res, err := RunSQLWithParams(context.Background(), db, "WITH t AS (SELECT id FROM orders WHERE id > ?) SELECT id FROM t WHERE id < ?", 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Length != 1 {
+		t.Errorf("expecting parameters to be bound in common tables as well, got %v rows", res.Length)
+	}
+	res, err = RunSQL(context.Background(), db, "EXPLAIN WITH t AS (SELECT id FROM orders) SELECT id FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Plan == nil || res.Plan.StripesTotal != 1 {
+		t.Errorf("expecting a plan reading a common table, got %+v", res.Plan)
+	}
+	cache := NewCache(10)
+	for j := 0; j < 2; j++ {
+		if _, err := cache.RunSQLWithParams(context.Background(), db, "WITH orders AS (SELECT id FROM customers) SELECT count() FROM orders"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("not expecting queries with common tables to be cached, got %+v", stats)
+	}
+}
+
+func TestNamespacedQueries(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for namespace, data := range map[string]string{"": "a\n1", "sales": "a\n2\n3", "hr": "a\n4"} {
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions("orders", strings.NewReader(data), database.LoadOptions{Namespace: namespace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		data  string
+		fails bool
+	}{
+		{"SELECT a FROM orders", "[[1]]", false},
+		{"SELECT a FROM sales.orders", "[[2] [3]]", false},
+		{"SELECT sum(a) FROM hr.orders", "[[4]]", false},
+		{"SELECT a FROM hr.orders UNION ALL SELECT a FROM orders", "[[4] [1]]", false},
+		// there is no such dataset in this namespace
+		{"SELECT a FROM marketing.orders", "", true},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if test.fails {
+			if err == nil {
+				t.Errorf("expecting %v to fail", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expecting %v to succeed, got %v", test.query, err)
+			continue
+		}
+		raw, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Data [][]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if data := fmt.Sprint(decoded.Data); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+	}
+}
+
+func TestStatisticalAggregations(t *testing.T) {
+	// we need multiple stripes for partial states to get merged
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var raw strings.Builder
+	raw.WriteString("a,b\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString(fmt.Sprintf("%v,%v.5\n", j, j%10))
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query     string
+		expected  float64
+		tolerance float64
+		null      bool
+	}{
+		{"SELECT var_samp(a) FROM foo", 83416.666666, 1e-3, false},
+		{"SELECT variance(a) FROM foo", 83416.666666, 1e-3, false},
+		{"SELECT var_pop(a) FROM foo", 83333.25, 1e-3, false},
+		{"SELECT stddev(a) FROM foo", 288.8194361, 1e-3, false},
+		{"SELECT stddev_pop(a) FROM foo", 288.6749902, 1e-3, false},
+		{"SELECT stddev_samp(a) FROM foo WHERE a > 8", 286.2213596, 1e-3, false},
+		{"SELECT var_pop(b) FROM foo", 8.25, 1e-9, false},
+		{"SELECT var_samp(distinct b) FROM foo", 9.1666666666, 1e-6, false},
+		{"SELECT var_samp(a) FROM foo WHERE a = 3", 0, 0, true},
+		{"SELECT var_pop(a) FROM foo WHERE a = 3", 0, 0, false},
+		// small inputs are exact, large ones are approximated
+		{"SELECT median(a) FROM foo WHERE a < 4", 1.5, 0, false},
+		{"SELECT percentile(a, 0.25) FROM foo WHERE a < 5", 1, 0, false},
+		{"SELECT percentile(b, 1) FROM foo WHERE a < 50", 9.5, 0, false},
+		{"SELECT median(a) FROM foo", 499.5, 5, false},
+		{"SELECT percentile(a, 0.9) FROM foo", 899.1, 5, false},
+		{"SELECT percentile(a, 0.999) FROM foo", 998, 1, false},
+		{"SELECT percentile(a, 0) FROM foo", 0, 0, false},
+		{"SELECT median(b) FROM foo", 5, 0.5, false},
+		{"SELECT approx_count_distinct(b) FROM foo", 10, 0, false},
+		{"SELECT approx_count_distinct(distinct b) FROM foo WHERE a < 5", 5, 0, false},
+		{"SELECT approx_count_distinct(a) FROM foo", 1000, 20, false},
+		{"SELECT approx_count_distinct(a) FROM foo WHERE a < 100", 100, 1, false},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if err != nil {
+			t.Fatalf("failed to run %v: %v", test.query, err)
+		}
+		val, ok := res.Data[0].JSONLiteral(0)
+		if ok == test.null {
+			t.Errorf("expecting %v to return null: %v, got %v", test.query, test.null, val)
+			continue
+		}
+		if test.null {
+			continue
+		}
+		got, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-test.expected) > test.tolerance {
+			t.Errorf("expecting %v to return %v (+- %v), got %v", test.query, test.expected, test.tolerance, got)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT percentile(a) FROM foo",
+		"SELECT percentile(a, b) FROM foo",
+		"SELECT percentile(a, 1.5) FROM foo",
+		"SELECT stddev(a, 2) FROM foo",
+		"SELECT approx_count_distinct() FROM foo",
+		"SELECT approx_count_distinct(a, b) FROM foo",
+	} {
+		if _, err := RunSQL(context.Background(), db, query); err == nil {
+			t.Errorf("expecting %v to fail", query)
+		}
+	}
+}
+
+func TestSortedDatasets(t *testing.T) {
+	// we compare the amount of data read, so we cannot serve any of it from the chunk cache
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 100, ChunkCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var raw strings.Builder
+	raw.WriteString("a,b\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString(fmt.Sprintf("%v,%v\n", j/3, j))
+	}
+	raw.WriteString(",1\n,2\n")
+	// the same data, once with a sort key and once without, so that we can compare results
+	for _, name := range []string{"sorted", "unsorted"} {
+		var opts database.LoadOptions
+		if name == "sorted" {
+			opts.SortKey = []string{"a", "b"}
+		}
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions(name, strings.NewReader(raw.String()), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query   string
+		cheaper bool // reads less data thanks to the sort key
+	}{
+		// ties are not sorted in a stable way (yet), so we only check unique orderings
+		{"SELECT a FROM %v ORDER BY a LIMIT 5", true},
+		{"SELECT a, b FROM %v ORDER BY a, b LIMIT 5", true},
+		{"SELECT a AS foo FROM %v ORDER BY foo LIMIT 5", true},
+		{"SELECT a FROM %v ORDER BY 1 ASC NULLS LAST LIMIT 5", true},
+		{"SELECT a, b FROM %v WHERE a > 10 ORDER BY a, b LIMIT 5", true},
+		// these don't follow the sort key
+		{"SELECT a, b FROM %v ORDER BY b, a LIMIT 5", false},
+		{"SELECT a FROM %v ORDER BY a DESC LIMIT 5", false},
+		{"SELECT a FROM %v ORDER BY a NULLS FIRST LIMIT 5", false},
+		{"SELECT a FROM %v WHERE b > 3 ORDER BY a LIMIT 5", true},
+		{"SELECT a FROM %v WHERE b = 3 ORDER BY a LIMIT 5", false},
+		// range filters
+		{"SELECT a, b FROM %v WHERE a < 10", true},
+		{"SELECT a, b FROM %v WHERE a <= 10 AND a >= 5", true},
+		{"SELECT a, b FROM %v WHERE 5 < a AND 10 >= a", true},
+		// floats cannot be converted to ints to be searched for
+		{"SELECT a, b FROM %v WHERE 5.0 < a AND 10.0 >= a", false},
+		{"SELECT a, b FROM %v WHERE a = 200", true},
+		{"SELECT count() FROM %v WHERE a < 17 AND b > 2", true},
+		{"SELECT count() FROM %v WHERE a < 17 AND a > 20", true},
+		{"SELECT b, count() FROM %v WHERE (a > 3 AND a < 100) GROUP BY b", true},
+		{"SELECT a, b FROM %v WHERE a > 320", false},
+		{"SELECT a, b FROM %v WHERE a > -1 AND a < 2", true},
+		{"SELECT a, b FROM %v WHERE a < 10 OR a > 320", false},
+		{"SELECT a, b FROM %v WHERE a = null", false},
+		{"SELECT a, b FROM %v WHERE a < 2.5", false},
+		// constant expressions get folded before we look for ranges
+		{"SELECT a, b FROM %v WHERE a < 5+5 AND true", true},
+		{"SELECT a, b FROM %v WHERE a >= 2*5 AND (a < 12 OR false)", true},
+	}
+	for _, test := range tests {
+		var results []*Result
+		for _, name := range []string{"sorted", "unsorted"} {
+			res, err := RunSQL(context.Background(), db, fmt.Sprintf(test.query, name))
+			if err != nil {
+				t.Fatalf("failed to run %v: %v", test.query, err)
+			}
+			results = append(results, res)
+		}
+		sorted, err := json.Marshal(results[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		unsorted, err := json.Marshal(results[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// we only compare data (and orderings), not the amount of data read
+		sorted = bytes.Replace(sorted, []byte(fmt.Sprintf(`"bytes_read":%v`, results[0].bytesRead)), nil, 1)
+		unsorted = bytes.Replace(unsorted, []byte(fmt.Sprintf(`"bytes_read":%v`, results[1].bytesRead)), nil, 1)
+		if !bytes.Equal(sorted, unsorted) {
+			t.Errorf("expecting %v to return the same results for sorted data, got %s and %s", test.query, sorted, unsorted)
+		}
+		if cheaper := results[0].bytesRead < results[1].bytesRead; cheaper != test.cheaper {
+			t.Errorf("expecting %v to read less data when sorted: %v, read %v and %v bytes", test.query, test.cheaper, results[0].bytesRead, results[1].bytesRead)
+		}
+	}
+
+	res, err := RunSQL(context.Background(), db, "EXPLAIN SELECT a FROM sorted WHERE a > 3 ORDER BY a LIMIT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PlanStep{
+		{stageRead, "11 of 11 stripes"},
+		{stageFilter, "a>3 (binary search on sort key a)"},
+		{stageProject, "a"},
+		{stageSort, "none needed (sort key a, b) by a"},
+		{stageLimit, "2"},
+	}
+	if !reflect.DeepEqual(res.Plan.Steps, expected) {
+		t.Errorf("expecting a plan of %+v, got %+v", expected, res.Plan.Steps)
+	}
+}
+
+func TestBloomFilterLookups(t *testing.T) {
+	var raw strings.Builder
+	raw.WriteString("id,user,score\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString(fmt.Sprintf("%v,user_%v,%v.5\n", j, j%500, j%7))
+	}
+	// the same data, once with bloom filters and once without, so that we can compare results
+	var dbs []*database.Database
+	for _, blooms := range []bool{true, false} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 100, BloomFilters: blooms, ChunkCacheSize: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("events", strings.NewReader(raw.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	tests := []struct {
+		query   string
+		cheaper bool // reads less data thanks to bloom filters
+	}{
+		{"SELECT id, user FROM events WHERE id = 123", true},
+		{"SELECT id, user FROM events WHERE 123 = id", true},
+		{"SELECT count() FROM events WHERE user = 'user_42'", true},
+		{"SELECT * FROM events WHERE user = 'user_42' AND score > 2", true},
+		{"SELECT * FROM events WHERE id = 12 AND id = 13", true},
+		{"SELECT id FROM events WHERE id = 120+3", true},
+		{"SELECT user, count() FROM events WHERE id = 5 GROUP BY user", true},
+		{"SELECT id FROM events WHERE user = 'nobody'", true},
+		// these cannot use bloom filters
+		{"SELECT id FROM events WHERE id = 123 OR id = 456", false},
+		{"SELECT id FROM events WHERE id > 123", false},
+		{"SELECT id FROM events WHERE id = 123.0", false},
+		{"SELECT id FROM events WHERE score = 2.5", false},
+		{"SELECT id FROM events WHERE id = null", false},
+	}
+	for _, test := range tests {
+		var results []*Result
+		for _, db := range dbs {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatalf("failed to run %v: %v", test.query, err)
+			}
+			results = append(results, res)
+		}
+		if with, without := resultRows(t, results[0]), resultRows(t, results[1]); with != without {
+			t.Errorf("expecting %v to return the same results with bloom filters, got %v and %v", test.query, with, without)
+		}
+		if cheaper := results[0].bytesRead < results[1].bytesRead; cheaper != test.cheaper {
+			t.Errorf("expecting %v to read less data thanks to bloom filters: %v, read %v and %v bytes", test.query, test.cheaper, results[0].bytesRead, results[1].bytesRead)
+		}
+		// estimates are still an upper bound
+		explained, err := RunSQL(context.Background(), dbs[0], "EXPLAIN "+test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explained.Plan.EstimatedBytesRead < results[0].bytesRead {
+			t.Errorf("expecting %v to read an estimated %v bytes, it read %v", test.query, explained.Plan.EstimatedBytesRead, results[0].bytesRead)
+		}
+	}
+
+	res, err := RunSQL(context.Background(), dbs[0], "EXPLAIN SELECT id FROM events WHERE id = 5 AND user = 'user_5'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PlanStep{stageFilter, "id=5 AND user='user_5' (stripes skipped using bloom filters on id, user)"}
+	if res.Plan.Steps[1] != expected {
+		t.Errorf("expecting the plan to mention bloom filters, got %+v", res.Plan.Steps[1])
+	}
+}
+
+func TestReadingStringLengths(t *testing.T) {
+	var raw strings.Builder
+	raw.WriteString("id,word,name\n")
+	for j := 0; j < 1000; j++ {
+		word := fmt.Sprintf("word_%v", j*j)
+		if j%10 == 0 {
+			word = ""
+		}
+		raw.WriteString(fmt.Sprintf("%v,%v,jméno_%v\n", j, word, j))
+	}
+	db, err := database.NewDatabase("", &database.Config{ChunkCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("words", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first query only needs string offsets, the second one needs string contents (lower() doesn't
+	// affect lengths of ASCII strings), the two should yield the same results
+	tests := []struct {
+		query, contents string
+		cheaper         bool
+	}{
+		{"SELECT length(word) FROM words", "SELECT length(lower(word)) FROM words", true},
+		{"SELECT count() FROM words WHERE word IS NULL", "SELECT count() FROM words WHERE lower(word) IS NULL", true},
+		{"SELECT id FROM words WHERE length(word) > 8 AND word IS NOT NULL", "SELECT id FROM words WHERE length(lower(word)) > 8", true},
+		{"SELECT length(word), count() FROM words GROUP BY length(word) ORDER BY length(word)", "SELECT length(lower(word)), count() FROM words GROUP BY length(lower(word)) ORDER BY length(lower(word))", true},
+		// contents are needed after all
+		{"SELECT length(word), word FROM words", "SELECT length(lower(word)), word FROM words", false},
+		{"SELECT count(word) FROM words WHERE word IS NULL", "SELECT count(word) FROM words WHERE lower(word) IS NULL", false},
+		// multi-byte characters don't allow us to infer lengths from offsets
+		{"SELECT length(name) FROM words", "SELECT length(lower(name)) FROM words", false},
+	}
+	for _, test := range tests {
+		var results []*Result
+		for _, query := range []string{test.query, test.contents} {
+			res, err := RunSQL(context.Background(), db, query)
+			if err != nil {
+				t.Fatalf("failed to run %v: %v", query, err)
+			}
+			results = append(results, res)
+		}
+		if lazy, full := resultRows(t, results[0]), resultRows(t, results[1]); lazy != full {
+			t.Errorf("expecting %v to return %v, got %v", test.query, full, lazy)
+		}
+		if cheaper := results[0].bytesRead < results[1].bytesRead; cheaper != test.cheaper {
+			t.Errorf("expecting %v to read less data than %v: %v, read %v and %v bytes", test.query, test.contents, test.cheaper, results[0].bytesRead, results[1].bytesRead)
+		}
+	}
+}
+func TestSpillingGroups(t *testing.T) {
+	var raw strings.Builder
+	raw.WriteString("id,key,word,val\n")
+	for j := 0; j < 2000; j++ {
+		val := strconv.Itoa(j % 13)
+		if j%17 == 0 {
+			val = ""
+		}
+		raw.WriteString(fmt.Sprintf("%v,%v,word_%v,%v\n", j, j%500, j%300, val))
+	}
+	// one database keeps all its groups in memory, the other one spills almost all of them
+	var dbs []*database.Database
+	for _, maxGroups := range []int{-1, 3} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 150, MaxGroupsInMemory: maxGroups})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	queries := []string{
+		"SELECT key, count(), sum(val), min(val), max(val), avg(val) FROM foo GROUP BY key ORDER BY key",
+		"SELECT word, count(distinct key), max(id) FROM foo WHERE id > 100 GROUP BY word ORDER BY word",
+		"SELECT key, length(word), count() FROM foo GROUP BY key, length(word) ORDER BY key, length(word)",
+		"SELECT val, count() FROM foo GROUP BY val ORDER BY val",
+		"SELECT key FROM foo GROUP BY key ORDER BY key DESC LIMIT 10",
+		"SELECT count() FROM foo",
+	}
+	for _, query := range queries {
+		var results []*Result
+		for _, db := range dbs {
+			res, err := RunSQL(context.Background(), db, query)
+			if err != nil {
+				t.Fatalf("failed to run %v: %v", query, err)
+			}
+			results = append(results, res)
+		}
+		if inMemory, spilled := resultRows(t, results[0]), resultRows(t, results[1]); inMemory != spilled {
+			t.Errorf("expecting %v to return %v, got %v when spilling", query, inMemory, spilled)
+		}
+		if results[0].rowsSpilled != 0 {
+			t.Errorf("expecting %v not to spill with spilling disabled", query)
+		}
+	}
+
+	res, err := RunSQL(context.Background(), dbs[1], queries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Length != 500 || res.rowsSpilled < 1000 {
+		t.Errorf("expecting most groups to be spilled, got %v groups and %v rows spilled", res.Length, res.rowsSpilled)
+	}
+	// temporary files get cleaned up
+	tmp, err := filepath.Glob(filepath.Join(dbs[1].Config.WorkingDirectory, "groupby-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmp) > 0 {
+		t.Errorf("expecting temporary files to be removed, found %v", tmp)
+	}
+}
+
+// groups ordered by and limited to the top N need to be the same as the first N of all the groups
+// (ties included), whether they get spilled or not
+func TestOrderingTopGroups(t *testing.T) {
+	var raw strings.Builder
+	raw.WriteString("id,key,word,val\n")
+	for j := 0; j < 1000; j++ {
+		val := strconv.Itoa(j % 7)
+		if j%11 == 0 {
+			val = ""
+		}
+		raw.WriteString(fmt.Sprintf("%v,%v,word_%v,%v\n", j, (j*j)%97, j%41, val))
+	}
+	queries := []struct {
+		query string
+		limit int
+	}{
+		{"SELECT key, count() FROM foo GROUP BY key ORDER BY count() DESC", 5},
+		{"SELECT key, count() FROM foo GROUP BY key ORDER BY 2, 1 DESC", 10},
+		{"SELECT word, sum(val) AS total FROM foo GROUP BY word ORDER BY total DESC NULLS FIRST", 7},
+		{"SELECT val, max(id) FROM foo GROUP BY val ORDER BY val", 3},
+		{"SELECT val, count() FROM foo WHERE id > 500 GROUP BY val ORDER BY 2 DESC", 100},
+		{"SELECT val, count() FROM foo WHERE id > 5000 GROUP BY val ORDER BY 2 DESC", 2},
+		{"SELECT key, word, count() FROM foo GROUP BY key, word ORDER BY 3 DESC, 1", 1},
+		{"SELECT key, min(id) FROM foo GROUP BY key ORDER BY 2 DESC", 0},
+	}
+	for _, maxGroups := range []int{-1, 3} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 150, MaxGroupsInMemory: maxGroups})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range queries {
+			all, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limited, err := RunSQL(context.Background(), db, fmt.Sprintf("%v LIMIT %v", test.query, test.limit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if all.Length > test.limit {
+				all.Length = test.limit
+			}
+			if expected, got := resultRows(t, all), resultRows(t, limited); got != expected {
+				t.Errorf("[max %v groups] expecting %v LIMIT %v to result in %v, got %v", maxGroups, test.query, test.limit, expected, got)
+			}
+			// only the top groups get materialised
+			if limited.Data[0].Len() > test.limit {
+				t.Errorf("[max %v groups] expecting %v LIMIT %v to keep at most %v groups, got %v", maxGroups, test.query, test.limit, test.limit, limited.Data[0].Len())
+			}
+		}
+	}
+}
+
+func TestExpectingRows(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4\n5,6\n7,8\n9,10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"SELECT a FROM foo", 5},
+		{"SELECT a FROM foo LIMIT 3", 3},
+		{"SELECT a FROM foo LIMIT 10", 5},
+		{"SELECT a FROM foo LIMIT 0", 0},
+		{"SELECT a FROM foo ORDER BY a", 5},
+		{"SELECT a FROM foo ORDER BY a LIMIT 3", 0},
+		{"SELECT a FROM foo WHERE a > 3", 0},
+		{"SELECT a FROM foo WHERE a > 3 LIMIT 2", 2},
+		{"SELECT a FROM foo TABLESAMPLE BERNOULLI (50)", 0},
+	}
+	for _, test := range tests {
+		q, err := expr.ParseQuerySQL(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limit := -1
+		if q.Limit != nil {
+			limit = *q.Limit
+		}
+		if got := expectedRows(ds, q, limit); got != test.expected {
+			t.Errorf("expecting %v to reserve %v rows, got %v", test.query, test.expected, got)
+		}
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromMap("foo", map[string][]string{
+		"a": {"1", "2", "3", "4"},
+		"b": {"t", "f", "", "t"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		folded, plain string
+		columns       []string
+	}{
+		{"SELECT a+2*3 FROM foo", "SELECT a+6 FROM foo", []string{"a+2*3"}},
+		{"SELECT a, 1+1 AS two FROM foo WHERE a > 1+1", "SELECT a, 2 AS two FROM foo WHERE a > 2", []string{"a", "two"}},
+		{"SELECT a FROM foo WHERE b AND true", "SELECT a FROM foo WHERE b", []string{"a"}},
+		{"SELECT a FROM foo WHERE b OR 1 = 1", "SELECT a FROM foo", []string{"a"}},
+		{"SELECT a FROM foo WHERE b AND 'x' = 'y'", "SELECT a FROM foo WHERE false", []string{"a"}},
+		{"SELECT b AND true FROM foo", "SELECT b FROM foo", []string{"b AND TRUE"}},
+		{"SELECT b OR false, count() FROM foo GROUP BY b OR false", "SELECT b, count() FROM foo GROUP BY b", []string{"b OR FALSE", "count()"}},
+		{"SELECT sum(a*(1+1)) FROM foo", "SELECT sum(a*2) FROM foo", []string{"sum(a*(1+1))"}},
+		{"SELECT percentile(a, 1-0.5) FROM foo", "SELECT percentile(a, 0.5) FROM foo", []string{"percentile(a, 1-0.5)"}},
+	}
+	for _, test := range tests {
+		folded, err := RunSQL(context.Background(), db, test.folded)
+		if err != nil {
+			t.Errorf("failed to run %v: %v", test.folded, err)
+			continue
+		}
+		plain, err := RunSQL(context.Background(), db, test.plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr, pr := resultRows(t, folded), resultRows(t, plain); fr != pr {
+			t.Errorf("expecting %v to return %v, got %v", test.folded, pr, fr)
+		}
+		var columns []string
+		for _, col := range folded.Schema {
+			columns = append(columns, col.Name)
+		}
+		if !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("expecting %v to return columns %v, got %v", test.folded, test.columns, columns)
+		}
+	}
+}
+
+func TestSampledQueries(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var raw strings.Builder
+	raw.WriteString("a\n")
+	for j := 0; j < 1000; j++ {
+		raw.WriteString(strconv.Itoa(j) + "\n")
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		min, max int64
+		multiple int64 // SYSTEM samples whole stripes
+	}{
+		{"SELECT count() FROM foo TABLESAMPLE BERNOULLI (100)", 1000, 1000, 1},
+		{"SELECT count() FROM foo TABLESAMPLE BERNOULLI (0)", 0, 0, 1},
+		{"SELECT count() FROM foo TABLESAMPLE SYSTEM (100)", 1000, 1000, 1},
+		{"SELECT count() FROM foo TABLESAMPLE BERNOULLI (10) REPEATABLE (42)", 50, 150, 1},
+		{"SELECT count() FROM foo TABLESAMPLE bernoulli (2.5) REPEATABLE (42)", 5, 50, 1},
+		{"SELECT count() FROM foo TABLESAMPLE BERNOULLI (50) REPEATABLE (1) WHERE a < 100", 20, 80, 1},
+		{"SELECT count() FROM foo TABLESAMPLE SYSTEM (50) REPEATABLE (42)", 100, 900, 100},
+	}
+	for _, test := range tests {
+		var counts []int64
+		// seeded samples need to be repeatable
+		for j := 0; j < 2; j++ {
+			res, err := RunSQL(context.Background(), db, test.query)
+			if err != nil {
+				t.Fatalf("failed to run %v: %v", test.query, err)
+			}
+			// global aggregations over no rows return no rows at all
+			if res.Length == 0 {
+				counts = append(counts, 0)
+				continue
+			}
+			val, ok := res.Data[0].JSONLiteral(0)
+			if !ok {
+				t.Fatalf("expecting %v to return a count", test.query)
+			}
+			count, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts = append(counts, count)
+		}
+		if counts[0] < test.min || counts[0] > test.max || counts[0]%test.multiple != 0 {
+			t.Errorf("expecting %v to return between %v and %v rows (in multiples of %v), got %v", test.query, test.min, test.max, test.multiple, counts[0])
+		}
+		if strings.Contains(test.query, "REPEATABLE") && counts[0] != counts[1] {
+			t.Errorf("expecting %v to be repeatable, got %v", test.query, counts)
+		}
+	}
+
+	res, err := RunSQL(context.Background(), db, "SELECT a FROM foo TABLESAMPLE BERNOULLI (50) LIMIT 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Length != 5 {
+		t.Errorf("expecting a sampled query to respect its limit, got %v rows", res.Length)
+	}
+}
+
+func TestSpecialFloatsInResults(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	for name, floats := range map[string]column.FloatPolicy{"nullified": column.FloatSpecialsAsNulls, "preserved": column.FloatSpecialsPreserved} {
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions(name, strings.NewReader("a,b\n1.5,1\nNaN,2\n-inf,3\n,4\ninf,5"), database.LoadOptions{Floats: floats})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := db.LoadDatasetFromReaderAutoWithOptions("keys", strings.NewReader("a\n0\n-0\nNaN\ninf\n1"), database.LoadOptions{Floats: column.FloatSpecialsPreserved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		data  string
+	}{
+		{"SELECT a FROM nullified", `[[1.5],[null],[null],[null],[null]]`},
+		{"SELECT a FROM preserved", `[[1.5],["NaN"],["-Infinity"],[null],["Infinity"]]`},
+		{"SELECT a FROM preserved ORDER BY a ASC NULLS LAST", `[["-Infinity"],[1.5],["Infinity"],["NaN"],[null]]`},
+		{"SELECT a FROM preserved WHERE a > 0", `[[1.5],["Infinity"]]`},
+		{"SELECT a*2 FROM preserved WHERE a > 2", `[["Infinity"]]`},
+		// negative zeros group with zeros, NaNs (of any bit pattern, inf*0 differs from a NaN literal) form one group
+		{"SELECT a, count() FROM keys GROUP BY a ORDER BY a", `[[0,2],[1,1],["Infinity",1],["NaN",1]]`},
+		{"SELECT a*0, count() FROM keys GROUP BY a*0 ORDER BY a*0", `[[0,3],["NaN",2]]`},
+		{"SELECT count(distinct a*0) FROM keys", `[[2]]`},
+		// literals get serialised just once, but they repeat in each row
+		{"SELECT a, 1, 'x', NULL, 2.5, true FROM preserved LIMIT 2", `[[1.5,1,"x",null,2.5,true],["NaN",1,"x",null,2.5,true]]`},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if data := string(decoded.Data); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+	}
+}
+
+func TestExplainingQueries(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2, ChunkCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b,c\n1,2,3\n3,4,5\n5,6,7\n7,8,9\n9,10,11"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query       string
+		scanned     int
+		columns     []string
+		aggregation string
+		stages      []string
+	}{
+		{"SELECT 1", 0, []string{}, aggregationNone, []string{stageProject}},
+		{"SELECT a FROM foo", 3, []string{"a"}, aggregationNone, []string{stageRead, stageProject}},
+		{"SELECT * FROM foo LIMIT 3", 2, []string{"a", "b", "c"}, aggregationNone, []string{stageRead, stageProject, stageLimit}},
+		{"SELECT a FROM foo LIMIT 1", 1, []string{"a"}, aggregationNone, []string{stageRead, stageProject, stageLimit}},
+		{"SELECT a FROM foo ORDER BY a LIMIT 1", 3, []string{"a"}, aggregationNone, []string{stageRead, stageProject, stageSort, stageLimit}},
+		{"SELECT a FROM foo WHERE b > 4 LIMIT 1", 3, []string{"a", "b"}, aggregationNone, []string{stageRead, stageFilter, stageProject, stageLimit}},
+		{"SELECT sum(a) FROM foo", 3, []string{"a"}, aggregationGlobal, []string{stageRead, stageAggregate, stageProject}},
+		{"SELECT b, max(a) FROM foo WHERE c > 3 GROUP BY 1 ORDER BY 2", 3, []string{"a", "b", "c"}, aggregationHash, []string{stageRead, stageFilter, stageAggregate, stageProject, stageSort}},
+		{"SELECT a FROM foo TABLESAMPLE BERNOULLI (10) LIMIT 1", 3, []string{"a"}, aggregationNone, []string{stageRead, stageSample, stageProject, stageLimit}},
 	}
-
-	// negative limits
-	for _, limit := range []int{-100, -20, -1} {
-		q.Limit = &limit
-		_, err := Run(db, q)
-		if !errors.Is(err, errInvalidLimitValue) {
-			t.Errorf("expected error for negative values to be %+v, got %+v instead", errInvalidLimitValue, err)
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, "EXPLAIN "+test.query)
+		if err != nil {
+			t.Errorf("failed to explain %v: %v", test.query, err)
+			continue
+		}
+		plan := res.Plan
+		if plan == nil {
+			t.Errorf("expecting %v to be explained, got no plan", test.query)
+			continue
+		}
+		if plan.StripesScanned != test.scanned {
+			t.Errorf("expecting %v to scan %v stripes, got %v", test.query, test.scanned, plan.StripesScanned)
+		}
+		if !reflect.DeepEqual(plan.Columns, test.columns) {
+			t.Errorf("expecting %v to read columns %v, got %v", test.query, test.columns, plan.Columns)
+		}
+		if plan.Aggregation != test.aggregation {
+			t.Errorf("expecting %v to aggregate using %v, got %v", test.query, test.aggregation, plan.Aggregation)
+		}
+		stages := make([]string, 0, len(plan.Steps))
+		for _, step := range plan.Steps {
+			stages = append(stages, step.Stage)
+		}
+		if !reflect.DeepEqual(stages, test.stages) {
+			t.Errorf("expecting %v to be executed in stages %v, got %v", test.query, test.stages, stages)
 		}
-	}
-
-	// non-negative limits
-	for limit := 0; limit < 100; limit++ {
-		q.Limit = &limit
 
-		qr, err := Run(db, q)
+		// estimates need to be exact for unfiltered (and unsampled) queries and an upper bound otherwise
+		actual, err := RunSQL(context.Background(), db, test.query)
 		if err != nil {
 			t.Fatal(err)
 		}
-		expschema := column.TableSchema{
-			column.Schema{Name: "foo", Dtype: column.DtypeInt, Nullable: false},
-			column.Schema{Name: "bar", Dtype: column.DtypeInt, Nullable: false},
-			column.Schema{Name: "baz", Dtype: column.DtypeInt, Nullable: false},
-		}
-		if !(reflect.DeepEqual(qr.Schema, expschema) && len(qr.Data) == 3) {
-			t.Errorf("expected schema %+v, got %+v instead", expschema, qr.Schema)
+		exact := plan.Filter == nil
+		for _, stage := range stages {
+			if stage == stageSample {
+				exact = false
+			}
 		}
-		firstCol := column.NewChunk(column.DtypeInt)
-		if limit > len(firstColRaw) {
-			firstCol.AddValues(firstColRaw)
-		} else {
-			firstCol.AddValues(firstColRaw[:limit])
+		if (exact && plan.EstimatedBytesRead != actual.bytesRead) || plan.EstimatedBytesRead < actual.bytesRead {
+			t.Errorf("expecting %v to read an estimated %v bytes, it read %v", test.query, plan.EstimatedBytesRead, actual.bytesRead)
 		}
-		if !reflect.DeepEqual(qr.Data[0], firstCol) {
-			t.Errorf("first column does not match what's expected: %+v vs. %+v", qr.Data[0], firstCol)
+		if _, err := json.Marshal(res); err != nil {
+			t.Errorf("could not serialise the plan of %v: %v", test.query, err)
 		}
 	}
+
+	if _, err := RunSQL(context.Background(), db, "EXPLAIN SELECT nonexistent FROM foo"); err == nil {
+		t.Error("expecting invalid queries to fail to be explained")
+	}
 }
 
 func TestBasicQueries(t *testing.T) {
@@ -194,10 +2258,15 @@ func TestBasicQueries(t *testing.T) {
 		{"foo,bar\n,1\nt,2", "SELECT bar = 1 FROM dataset GROUP BY bar=1", "bar=1\nt\nf"},
 		{"foo,bar\n,1\nt,2", "SELECT bar > 0 FROM dataset GROUP BY bar > 0", "bar>0\nt"},
 		// TODO: nullable strings tests
+		// JSON documents
+		{"id,doc\n1,\"{\"\"a\"\": 1}\"\n2,\"{\"\"a\"\": 2, \"\"b\"\": [3]}\"\n", "SELECT json_extract(doc, '$.a', 'int') FROM dataset", "a\n1\n2"},
+		{"id,doc\n1,\"{\"\"a\"\": [\"\"x\"\"]}\"\n2,\"{\"\"a\"\": [\"\"y\"\", 3]}\"\n", "SELECT cast(json_extract(doc, '$.a[0]') AS string) FROM dataset", "a\nx\ny"},
 
 		{"foo,bar\n1,12\n13,2\n1,3\n", "SELECT foo, min(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,3\n13,2"},
 		{"foo,bar\n1,12.3\n13,2\n1,3.3\n", "SELECT foo, min(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,3.3\n13,2"},
 		{"foo,bar\n1,12.3\n13,2\n1,3.3\n", "SELECT foo, max(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,12.3\n13,2"},
+		{"foo,bar\na,1.20\nb,2.30\na,0.50\n", "SELECT foo, sum(bar) FROM dataset GROUP BY foo", "foo,sum(bar)\na,1.70\nb,2.30"},
+		{"foo,bar\na,1.20\nb,2.30\na,0.50\n", "SELECT foo, max(bar) FROM dataset GROUP BY foo", "foo,max(bar)\na,1.20\nb,2.30"},
 		{"foo,bar\n1,foo\n13,bar\n13,baz\n", "SELECT foo, min(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,foo\n13,bar"},
 		{"foo,bar\n1,foo\n13,bar\n13,baz\n", "SELECT foo, max(bar) FROM dataset GROUP BY foo", "foo,max(bar)\n1,foo\n13,baz"},
 		{"foo,bar\n1,12.3\n13,2\n1,3.5\n", "SELECT foo, sum(bar) FROM dataset GROUP BY foo", "foo,sum(bar)\n1,15.8\n13,2"},
@@ -220,6 +2289,9 @@ func TestBasicQueries(t *testing.T) {
 		{"foo,bar\n1,2020-01-30 12:34:56\n1,2020-02-20 00:00:00\n1,1979-12-31 19:01:57", "SELECT foo, min(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,1979-12-31 19:01:57\n"},
 		{"foo,bar\n1,2020-01-30 12:34:56\n1,1979-12-31 19:01:57.001\n1,1979-12-31 19:01:57.002", "SELECT foo, min(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,1979-12-31 19:01:57.001\n"},
 		{"foo,bar\n1,2020-01-30 12:34:56\n1,1979-12-31 19:01:57.001\n1,1979-12-31 19:01:57.0001", "SELECT foo, min(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,1979-12-31 19:01:57.0001\n"},
+		{"foo,bar\n1,2020-01-30 12:34:56\n2,\n1,1979-12-31 19:01:57", "SELECT max(bar), min(bar) FROM dataset", "max(bar),min(bar)\n2020-01-30 12:34:56,1979-12-31 19:01:57\n"},
+		{"foo,bar\n1,2020-01-30\n2,\n1,1979-12-31", "SELECT max(bar) FROM dataset WHERE foo = 1", "max(bar)\n2020-01-30\n"},
+		{"foo,bar\n1,foo\n13,bar\n13,baz\n", "SELECT max(bar), min(bar) FROM dataset", "max(bar),min(bar)\nfoo,bar"},
 		// case insensitivity
 		{"foo,bar\n1,\n,\n1,10\n,4\n,\n", "SELECT foo, COUNT() FROM dataset GROUP BY foo", "foo,count()\n1,2\n,3\n"},
 		{"foo,bar\n1,\n13,2\n1,\n", "SELECT foo, MIN(bar) FROM dataset GROUP BY foo", "foo,min(bar)\n1,\n13,2"},
@@ -252,13 +2324,16 @@ func TestBasicQueries(t *testing.T) {
 		{"foo,bar\n1,2\n3,4\n1,2", "SELECT max(distinct foo) FROM dataset", "max(distinct foo)\n3"},
 		{"foo,bar\n1,2\n3,4\n1,2", "SELECT bar, count(distinct foo) FROM dataset GROUP BY bar", "bar,count(distinct foo)\n2,1\n4,1"},
 		{"foo\n2.0\n3.0\n2\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n2\n"},
-		// TODO: why don't we have an adderFactory for bools?
-		// {"foo\ntrue\nfalse\ntrue\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n2\n"},
-		// {"foo\ntrue\ntrue\ntrue\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n1\n"},
-		// {"foo\ntrue\n\ntrue\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n1\n"},
+		{"foo\ntrue\nfalse\ntrue\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n2\n"},
+		{"foo\ntrue\ntrue\ntrue\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n1\n"},
+		{"foo\ntrue\n\ntrue\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n1\n"},
 		{"foo\nahoy\nworld\nahoy\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n2\n"},
 		{"foo\nahoy\nworld\nahoy2\n", "SELECT count(distinct foo) FROM dataset", "count(distinct foo)\n3\n"},
 		// TODO(next): dates, datetimes, groupings (i.e. GROUP BY in string count distincts etc.)
+		// casting
+		{"foo,bar\n1,a\nx,b", "SELECT toint(foo), bar FROM dataset", "toint(foo),bar\n1,a\n,b"},
+		{"foo\n1\n2", "SELECT CAST(foo AS float) / 4 FROM dataset", "CAST(foo AS float)/4\n0.25\n0.5"},
+		{"foo\n2020-01-01 10:00:00\n2021-02-03 04:05:06", "SELECT CAST(foo AS date) FROM dataset GROUP BY CAST(foo AS date)", "CAST(foo AS date)\n2020-01-01\n2021-02-03"},
 	}
 
 	for testNo, test := range tests {
@@ -288,7 +2363,7 @@ func TestBasicQueries(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		res, err := RunSQL(db, test.query)
+		res, err := RunSQL(context.Background(), db, test.query)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -363,7 +2438,7 @@ func TestProjections(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		res, err := RunSQL(db, test.query)
+		res, err := RunSQL(context.Background(), db, test.query)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -420,7 +2495,7 @@ func TestQuerySetup(t *testing.T) {
 		{"SELECT * FROM dataset GROUP BY 1, 4", errInvalidGroupbyClause},        // overflow
 
 		// relabeling can be tricky, especially when looking up columns across parts of the query - these are all legal
-		// BUT this doesn't work the same for WHERE clauses - we cannot filter on relabeled fields
+		// (see TestAliasesInFiltersAndGroups for how labels and columns shadow each other)
 		{"SELECT foo AS bar FROM dataset GROUP BY foo", nil},
 		{"SELECT foo AS bar FROM dataset GROUP BY bar", nil},
 		{"SELECT foo AS bar FROM dataset ORDER BY foo", nil},
@@ -446,8 +2521,380 @@ func TestQuerySetup(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if _, err := RunSQL(db, test.query); !errors.Is(err, test.err) {
+		if _, err := RunSQL(context.Background(), db, test.query); !errors.Is(err, test.err) {
 			t.Errorf("expecting query %v to result in %v, got %+v instead", test.query, test.err, err)
 		}
 	}
 }
+
+func TestUnknownIdentifiers(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("dataset", strings.NewReader("foo,bar,baz\n1,2,3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query      string
+		name       string
+		suggestion string
+	}{
+		{"SELECT fooo FROM dataset", "fooo", "foo"},
+		{"SELECT foo FROM dataset WHERE bax > 1", "bax", "bar"},
+		{"SELECT foo, sum(bar) FROM dataset GROUP BY foo, quux", "quux", ""},
+		{"SELECT * FROM dataset UNION ALL SELECT foo, barr, baz FROM dataset", "barr", "bar"},
+		{"SELECT foo FROM dataset WHERE foo IN (SELECT bazz FROM dataset)", "bazz", "baz"},
+	}
+	for _, test := range tests {
+		_, err := RunSQL(context.Background(), db, test.query)
+		var unknown *expr.UnknownIdentifierError
+		if !errors.As(err, &unknown) {
+			t.Errorf("expecting %v to fail with an unknown identifier, got %v", test.query, err)
+			continue
+		}
+		if unknown.Name != test.name || unknown.Suggestion != test.suggestion {
+			t.Errorf("expecting %v to report %v (suggesting %q), got %+v", test.query, test.name, test.suggestion, unknown)
+		}
+	}
+}
+
+func TestAliasesInFiltersAndGroups(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("dataset", strings.NewReader("a,b\n1,2\n3,4\n5,6\n1,8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+		err      error
+	}{
+		{"SELECT a+b AS total FROM dataset WHERE total > 5", "[[7] [11] [9]]", nil},
+		{"SELECT a+b AS total FROM dataset WHERE total > 5 AND a < 5", "[[7] [9]]", nil},
+		{`SELECT a+b AS "Total" FROM dataset WHERE "Total" < 5`, "[[3]]", nil},
+		{"SELECT a+b AS Total FROM dataset WHERE TOTAL < 5", "[[3]]", nil},
+		// columns shadow labels in filters, but not in groupings
+		{"SELECT a AS b FROM dataset WHERE b > 5", "[[5] [1]]", nil},
+		{"SELECT a*2 AS double, count() FROM dataset GROUP BY double ORDER BY double", "[[2 2] [6 1] [10 1]]", nil},
+		{"SELECT a AS b, count() FROM dataset GROUP BY b ORDER BY 1", "[[1 2] [3 1] [5 1]]", nil},
+		{"SELECT a+b AS total FROM dataset WHERE total > 5 ORDER BY total DESC LIMIT 1", "[[11]]", nil},
+		{"SELECT sum(a) AS s FROM dataset WHERE s > 1", "", errAggregateInFilter},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if !errors.Is(err, test.err) {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if rows := resultRows(t, res); rows != test.expected {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.expected, rows)
+		}
+	}
+}
+
+func TestParallelGlobalAggregations(t *testing.T) {
+	var raw strings.Builder
+	raw.WriteString("a,b,c,d,e,f\n")
+	for j := 0; j < 500; j++ {
+		b := strconv.Itoa(j % 37)
+		if j%11 == 0 {
+			b = ""
+		}
+		d := fmt.Sprintf("2020-%02d-%02d", j%12+1, j%28+1)
+		e := fmt.Sprintf("%v %02d:%02d:00", d, j%24, j%60)
+		if j%7 == 0 {
+			d, e = "", ""
+		}
+		fmt.Fprintf(&raw, "%v,%v,%v.5,%v,%v,s%v\n", j, b, j%13, d, e, j%41)
+	}
+	queries := []string{
+		"SELECT count(), sum(a), min(b), max(b), avg(a) FROM dataset",
+		"SELECT count(b), count(distinct b), min(distinct b), sum(c), max(c) FROM dataset",
+		"SELECT sum(distinct b), count() FROM dataset", // not mergeable, aggregated sequentially
+		"SELECT var_pop(a), stddev(b) FROM dataset",
+		"SELECT sum(a) / count() AS ratio FROM dataset WHERE b > 10",
+		"SELECT count(), sum(a) FROM dataset WHERE a > 1000",
+		"SELECT count(), min(b) FROM dataset WHERE a = 123",
+		"SELECT min(d), max(d), min(e), max(e), min(f), max(f) FROM dataset",
+		"SELECT max(distinct f), min(e) FROM dataset WHERE b > 30",
+	}
+	// a single stripe always gets aggregated sequentially, so we compare our results against that
+	expected := make([]string, len(queries))
+	for _, rowsPerStripe := range []int{1000, 7, 1} {
+		db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: rowsPerStripe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		ds, err := db.LoadDatasetFromReaderAuto("dataset", strings.NewReader(raw.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		for j, query := range queries {
+			res, err := RunSQL(context.Background(), db, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := resultRows(t, res)
+			if rowsPerStripe == 1000 {
+				expected[j] = got
+				continue
+			}
+			if got != expected[j] {
+				t.Errorf("expecting %v to result in %v with %v rows per stripe, got %v", query, expected[j], rowsPerStripe, got)
+			}
+		}
+	}
+}
+
+func TestParallelAggregationPanics(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n,y\n3,z\n4,w"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// coalescing multiple arguments is not implemented (it panics), workers need to report it
+	// as an error rather than crashing
+	if _, err := RunSQL(context.Background(), db, "SELECT sum(coalesce(a, 1)) FROM foo"); !errors.Is(err, errWorkerPanicked) {
+		t.Errorf("expecting a panicking worker to fail with %v, got %v", errWorkerPanicked, err)
+	}
+}
+
+func TestChunkCacheHits(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,x\n2,y\n3,z\n4,w"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	// repeated reads of the same columns hit the cache, columns not read before miss it
+	tests := []struct {
+		query          string
+		hits, misses   int
+		touchesStorage bool
+	}{
+		{"SELECT a FROM foo WHERE a > 1", 0, 2, true},
+		{"SELECT a FROM foo WHERE a > 1", 2, 0, false},
+		{"SELECT a, b FROM foo ORDER BY b", 2, 2, true},
+		{"SELECT b, sum(a) FROM foo GROUP BY b", 4, 0, false},
+	}
+	// profiled queries don't get served from our query cache, so they all get to read stripes
+	cache := NewCache(10)
+	for _, test := range tests {
+		res, err := cache.RunSQLWithSettings(context.Background(), db, test.query, Settings{Profile: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// cache hits and misses are reported by timers of reads
+		var hits, misses int
+		for _, timer := range res.Profile.Timers() {
+			if timer.Name != stageRead && (timer.CacheHits > 0 || timer.CacheMisses > 0) {
+				t.Errorf("expecting only reads to report chunk cache hits, got %+v", timer)
+			}
+			hits += timer.CacheHits
+			misses += timer.CacheMisses
+		}
+		if hits != test.hits || misses != test.misses || (res.bytesRead > 0) != test.touchesStorage {
+			t.Errorf("expecting %v to hit our chunk cache %v times and miss it %v times, got %v and %v (%v bytes read)", test.query, test.hits, test.misses, hits, misses, res.bytesRead)
+		}
+		data, err := json.Marshal(res.Profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.hits > 0 && !bytes.Contains(data, []byte(`"cacheHits":`)) {
+			t.Errorf("expecting cache hits to be serialised in profiles, got %s", data)
+		}
+	}
+}
+
+func TestCountingRowsFromMetadata(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,\n2,3\n3,\n4,5\n5,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		data     string
+		metadata bool // answered without reading any data
+	}{
+		{"SELECT count() FROM foo", "[[5]]", true},
+		{"SELECT count(*) AS n, count() FROM foo ORDER BY n", "[[5 5]]", true},
+		{"SELECT count() FROM foo LIMIT 1", "[[5]]", true},
+		{"SELECT count() FROM foo LIMIT 0", "[]", false},
+		{"SELECT count(b) FROM foo", "[[2]]", false},
+		{"SELECT count(), sum(a) FROM foo", "[[5 15]]", false},
+		{"SELECT count() FILTER (WHERE a > 2) FROM foo", "[[3]]", false},
+		{"SELECT count() FROM foo WHERE a > 2", "[[3]]", false},
+		{"SELECT count() FROM foo GROUP BY a > 2", "[[2] [3]]", false},
+		{"WITH bar AS (SELECT a FROM foo WHERE a > 1) SELECT count() FROM bar", "[[4]]", true},
+	}
+	for _, test := range tests {
+		// profiles tell us if any stripes got read (bytes read don't, stripes may be cached)
+		ctx := Settings{Profile: true}.withLimits(context.Background())
+		res, err := RunSQL(ctx, db, test.query)
+		if err != nil {
+			t.Errorf("failed to run %v: %v", test.query, err)
+			continue
+		}
+		if data := resultRows(t, res); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+		reads := 0
+		for _, timer := range res.Profile.Timers() {
+			if timer.Name == stageRead {
+				reads++
+			}
+		}
+		// the common table gets read, but not the query on top of it
+		if metadata := reads == 0 || (strings.HasPrefix(test.query, "WITH") && reads == len(ds.Stripes)); metadata != test.metadata {
+			t.Errorf("expecting %v to be answered from metadata: %v, got %v stripes read", test.query, test.metadata, reads)
+		}
+
+		plan, err := RunSQL(context.Background(), db, "EXPLAIN "+test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanned := plan.Plan.StripesScanned == 0; test.metadata && !scanned {
+			t.Errorf("expecting a plan of %v not to scan any stripes, got %+v", test.query, plan.Plan)
+		}
+	}
+}
+
+func TestComputedColumns(t *testing.T) {
+	// multiple stripes, so that each of them gets its computed columns
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	var hints database.SchemaHints
+	if err := json.Unmarshal([]byte(`{
+		"qty": {"default": "1"},
+		"currency": {"default": "EUR"},
+		"total": {"expression": "price * qty"},
+		"label": {"expression": "upper(name)"},
+		"one": {"expression": "1 + 0"}
+	}`), &hints); err != nil {
+		t.Fatal(err)
+	}
+	raw := "name,price,qty\nfoo,1.5,2\nbar,2,\n,3,3"
+	ds, err := db.LoadDatasetFromReaderAutoWithOptions("orders", strings.NewReader(raw), database.LoadOptions{SchemaHints: hints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(ds.Schema))
+	for _, col := range ds.Schema {
+		names = append(names, col.Name)
+	}
+	if cols := strings.Join(names, ","); cols != "name,price,qty,currency,label,one,total" {
+		t.Errorf("unexpected columns of a dataset with computed columns: %v", cols)
+	}
+
+	tests := []struct {
+		query string
+		data  string
+	}{
+		{"SELECT total, qty FROM orders", "[[3 2] [2 1] [9 3]]"},
+		{"SELECT label, one FROM orders", "[[FOO 1] [BAR 1] [ 1]]"},
+		{"SELECT sum(total) FROM orders WHERE currency = 'EUR'", "[[14]]"},
+	}
+	for _, test := range tests {
+		res, err := RunSQL(context.Background(), db, test.query)
+		if err != nil {
+			t.Errorf("failed to run %v: %v", test.query, err)
+			continue
+		}
+		if data := resultRows(t, res); data != test.data {
+			t.Errorf("expecting %v to result in %v, got %v", test.query, test.data, data)
+		}
+	}
+
+	for _, hint := range []string{
+		`{"total": {"expression": "price * quantity"}}`,
+		`{"total": {"expression": "sum(price)"}}`,
+		`{"total": {"expression": "price * qty", "dtype": "int"}}`,
+		`{"total": {"expression": "price *"}}`,
+	} {
+		var hints database.SchemaHints
+		if err := json.Unmarshal([]byte(hint), &hints); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.LoadDatasetFromReaderAutoWithOptions("invalid", strings.NewReader(raw), database.LoadOptions{SchemaHints: hints}); !errors.Is(err, errs.ErrBadRequest) {
+			t.Errorf("expecting %v to be an invalid computed column, got %v", hint, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package query
+
+import (
+	"math/rand"
+
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// sampler decides which stripes and rows make it into TABLESAMPLE queries, a nil sampler
+// samples everything (so that callers don't need to check whether there's sampling at all)
+type sampler struct {
+	method expr.SampleMethod
+	rate   float64
+	rng    *rand.Rand
+}
+
+func newSampler(sample *expr.Sample) *sampler {
+	if sample == nil {
+		return nil
+	}
+	// the global source gets seeded upon database creation
+	seed := rand.Int63()
+	if sample.Seed != nil {
+		seed = *sample.Seed
+	}
+	return &sampler{
+		method: sample.Method,
+		rate:   sample.Percent / 100,
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// skipStripe determines if a whole stripe is to be skipped (we don't even have to read it)
+func (s *sampler) skipStripe() bool {
+	if s == nil || s.method != expr.SampleSystem {
+		return false
+	}
+	return s.rng.Float64() >= s.rate
+}
+
+// sampleRows unsets rows not selected for a given sample, it works on top of an existing filter
+// (which gets modified), if there is one - matching `matched` rows. It returns the sampled rows
+// and their number.
+// OPTIM: we could skip ahead using geometric gaps instead of drawing a number for each row
+func (s *sampler) sampleRows(filter *bitmap.Bitmap, matched, length int) (*bitmap.Bitmap, int) {
+	if s == nil || s.method != expr.SampleBernoulli {
+		return filter, matched
+	}
+	if filter == nil {
+		filter = bitmap.NewBitmap(length)
+		filter.Invert()
+	}
+	// unsetting bits doesn't interfere with the iteration (we're past them already)
+	it := filter.Iterator()
+	for j := it.Next(); j != -1; j = it.Next() {
+		if s.rng.Float64() >= s.rate {
+			filter.Set(j, false)
+			matched--
+		}
+	}
+	return filter, matched
+}
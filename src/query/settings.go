@@ -0,0 +1,92 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/errs"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+var errUnknownSetting = errs.New(errs.ErrBadRequest, "unknown setting")
+var errInvalidSettingValue = errs.New(errs.ErrBadRequest, "invalid value of a setting")
+
+// Settings change how queries get evaluated, the zero value gives us the defaults. They apply either
+// to single queries (see Cache.RunSQLWithSettings) or to batches, where they can be changed by
+// SET statements (see Cache.RunBatch)
+type Settings struct {
+	// timezone datetimes get evaluated and rendered in (an IANA name, e.g. `Europe/Prague`),
+	// datetimes are stored in UTC, which is also the default
+	Timezone string `json:"timezone,omitempty"`
+	// queries get aborted once they read more than this many bytes from storage, zero means the
+	// database's default applies (see database.Config.MaxBytesScanned), negative values mean no limit
+	MaxBytesScanned int `json:"max_bytes_scanned,omitempty"`
+	// queries get aborted once they run for longer than this (in milliseconds), zero means the
+	// database's default applies (see database.Config.QueryTimeout), negative values mean no timeout
+	Timeout int `json:"timeout,omitempty"`
+	// profiled queries time all the stages of their execution and return these timings along with
+	// their results (see Result.Profile), they never get served from a cache
+	Profile bool `json:"profile,omitempty"`
+}
+
+// set changes a setting as per a SET statement
+func (s *Settings) set(setting expr.Setting) error {
+	switch setting.Name {
+	case "timezone":
+		if _, err := column.LoadTimezone(setting.Value); err != nil {
+			return err
+		}
+		s.Timezone = setting.Value
+	case "max_bytes_scanned":
+		limit, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSettingValue, err)
+		}
+		s.MaxBytesScanned = limit
+	case "timeout":
+		timeout, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSettingValue, err)
+		}
+		s.Timeout = timeout
+	case "profile":
+		profile, err := strconv.ParseBool(setting.Value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSettingValue, err)
+		}
+		s.Profile = profile
+	default:
+		return fmt.Errorf("%w: %v", errUnknownSetting, setting.Name)
+	}
+	return nil
+}
+
+// withLimits puts limits given by our settings into a query's context (see Run), along with
+// a profile to be filled in, if one was asked for
+func (s Settings) withLimits(ctx context.Context) context.Context {
+	if s.Profile {
+		ctx = context.WithValue(ctx, profileKey{}, newProfile())
+	}
+	if s.MaxBytesScanned != 0 {
+		ctx = context.WithValue(ctx, scanBudgetKey{}, &scanBudget{limit: s.MaxBytesScanned})
+	}
+	if s.Timeout != 0 {
+		ctx = context.WithValue(ctx, timeoutKey{}, time.Duration(s.Timeout)*time.Millisecond)
+	}
+	return ctx
+}
+
+func (s Settings) apply(q *expr.Query) error {
+	if s.Timezone == "" {
+		return nil
+	}
+	loc, err := column.LoadTimezone(s.Timezone)
+	if err != nil {
+		return err
+	}
+	q.SetTimezone(loc)
+	return nil
+}
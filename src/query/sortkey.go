@@ -0,0 +1,155 @@
+package query
+
+import (
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// presorted determines if a query's ordering is already satisfied by its dataset's sort key, that's
+// the case for ascending orderings (nulls last) of a prefix of the sort key, e.g. data sorted by
+// (a, b) don't need to be sorted for ORDER BY a or ORDER BY a, b
+func presorted(ds *database.Dataset, q expr.Query) bool {
+	if q.Order == nil || len(q.Order) > len(ds.SortKey) {
+		return false
+	}
+	for j, clause := range q.Order {
+		needle := clause
+		if oby, ok := clause.(*expr.Ordering); ok {
+			if !oby.Asc || oby.NullsFirst {
+				return false
+			}
+			needle = oby.Children()[0]
+		}
+		if idx, ok := needle.(*expr.Integer); ok {
+			needle = q.Select[idx.Value()-1]
+		}
+		pos := lookupExpr(needle, q.Select)
+		if pos == -1 {
+			return false
+		}
+		proj := q.Select[pos]
+		if rel, ok := proj.(*expr.Relabel); ok {
+			proj = rel.Children()[0]
+		}
+		idn, ok := proj.(*expr.Identifier)
+		if !ok {
+			return false
+		}
+		if cols := expr.ColumnsUsed(idn, ds.Schema); len(cols) != 1 || cols[0] != ds.SortKey[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// keyRange is a range of values of a dataset's (first) sort key column, as implied by a filter,
+// values within each stripe are sorted, so we can binary search for this range instead of
+// evaluating the filter (if the filter only consists of this range)
+type keyRange struct {
+	column string
+	exact  bool
+	lower  []*column.Chunk
+	upper  []*column.Chunk
+	// if bounds are inclusive
+	lowerInclusive []bool
+	upperInclusive []bool
+}
+
+// newKeyRange prepares a range for a given filter, it returns nil if there's no (sorted) dataset or
+// if there are no usable bounds in the filter
+// OPTIM: we could keep key bounds of each stripe in the manifest, so that we could skip reading
+// stripes before our range (we only stop reading once we're past it)
+func newKeyRange(ds *database.Dataset, filter expr.Expression) (*keyRange, error) {
+	if ds == nil || filter == nil || len(ds.SortKey) == 0 {
+		return nil, nil
+	}
+	_, col, err := ds.Schema.LocateColumn(ds.SortKey[0])
+	if err != nil {
+		return nil, err
+	}
+	// NaNs sort after all the other values, but they don't compare as such
+	if col.Dtype == column.DtypeFloat && ds.FloatPolicy == column.FloatSpecialsPreserved {
+		return nil, nil
+	}
+	rng := expr.ColumnRange(filter, ds.Schema, col.Name)
+	kr := &keyRange{column: col.Name, exact: rng.Exact}
+	bound := func(b expr.Bound) (*column.Chunk, bool, error) {
+		value, err := expr.Evaluate(b.Value, 1, nil, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		if value.Dtype() != col.Dtype {
+			// e.g. ints compared to floats
+			value, err = value.Widen(col.Dtype)
+			if err != nil {
+				return nil, false, nil
+			}
+		}
+		return value, true, nil
+	}
+	for _, b := range rng.Lower {
+		value, ok, err := bound(b)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			kr.exact = false
+			continue
+		}
+		kr.lower = append(kr.lower, value)
+		kr.lowerInclusive = append(kr.lowerInclusive, b.Inclusive)
+	}
+	for _, b := range rng.Upper {
+		value, ok, err := bound(b)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			kr.exact = false
+			continue
+		}
+		kr.upper = append(kr.upper, value)
+		kr.upperInclusive = append(kr.upperInclusive, b.Inclusive)
+	}
+	if kr.lower == nil && kr.upper == nil {
+		return nil, nil
+	}
+	return kr, nil
+}
+
+// filter finds the rows within our range (and their number), and it also reports if any values in
+// this stripe exceed our range - if so, all the subsequent stripes will exceed it as well
+func (kr *keyRange) filter(data *column.Chunk) (*bitmap.Bitmap, int, bool, error) {
+	nonNull := data.Len()
+	if data.Nullability != nil {
+		nonNull -= data.Nullability.Count()
+	}
+	start, end := 0, nonNull
+	for j, value := range kr.lower {
+		pos, err := column.SearchSorted(data, value, !kr.lowerInclusive[j])
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if pos > start {
+			start = pos
+		}
+	}
+	for j, value := range kr.upper {
+		pos, err := column.SearchSorted(data, value, kr.upperInclusive[j])
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if pos < end {
+			end = pos
+		}
+	}
+	bm := bitmap.NewBitmap(data.Len())
+	bm.SetRange(start, end)
+	matched := 0
+	if end > start {
+		matched = end - start
+	}
+	return bm, matched, end < nonNull, nil
+}
@@ -0,0 +1,471 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kokes/smda/src/bitmap"
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// GROUP BY queries keep their groups in a hash map, along with the state of their aggregators. Once
+// there are too many groups (see database.Config.MaxGroupsInMemory), rows of groups we haven't seen
+// yet get written to temporary files instead - partitioned by their hashes, so that all the rows of
+// a given group end up in the same partition. Groups already in memory keep getting aggregated
+// there, so the two sets of groups are disjoint. Once all the stripes are read, we resolve the groups
+// in memory and then aggregate each partition on its own, one by one, appending their results.
+// Partitions with too many groups spill the same way (using different bits of their hashes), up to
+// `maxSpillDepth` levels deep, the last level is kept in memory no matter how large it is.
+// ARCH: temporary files live in our working directory, in-memory databases never spill
+// TODO: temporary directories left behind by crashed processes don't get cleaned up
+const (
+	spillFanout   = 16 // partitions per level, determined by four bits of group hashes
+	maxSpillDepth = 4
+)
+
+// grouping is the state of a hash aggregation - groups seen so far, their values and aggregators
+type grouping struct {
+	ctx      context.Context
+	schema   column.TableSchema
+	q        expr.Query
+	aggexprs []*expr.Function
+	budget   *memoryBudget
+	groups   map[uint64]uint64
+	values   []*column.Chunk // values of all the groups, one chunk per GROUP BY expression
+	spill    *spill          // nil if all the groups are kept in memory
+	spilled  int             // number of rows spilled, including those spilled by partitions
+	// queries ordered by and limited to the top N groups only keep those upon resolution, -1 if
+	// all the groups are to be kept (see keepTopGroups)
+	topN int
+}
+
+func newGrouping(ctx context.Context, schema column.TableSchema, q expr.Query, aggexprs []*expr.Function, budget *memoryBudget, sp *spill) *grouping {
+	return &grouping{
+		ctx:      ctx,
+		schema:   schema,
+		q:        q,
+		aggexprs: aggexprs,
+		budget:   budget,
+		groups:   make(map[uint64]uint64),
+		values:   make([]*column.Chunk, len(q.Aggregate)),
+		spill:    sp,
+		topN:     topGroups(q),
+	}
+}
+
+// topGroups determines how many groups a query needs, if it's ordered and limited (e.g. `GROUP BY
+// user_id ORDER BY count() DESC LIMIT 100`), -1 otherwise
+func topGroups(q expr.Query) int {
+	if q.Order == nil || q.Limit == nil || *q.Limit < 0 {
+		return -1
+	}
+	return *q.Limit
+}
+
+// add aggregates a batch of rows, usually a stripe, `length` is the number of rows past the filter
+func (gr *grouping) add(columnData map[string]*column.Chunk, filter *bitmap.Bitmap, length int) error {
+	// 1) evaluate all the aggregation expressions (those expressions that determine groups, e.g. `country`)
+	rcs := make([]*column.Chunk, len(gr.q.Aggregate))
+	for j, expression := range gr.q.Aggregate {
+		rc, err := expr.Evaluate(expression, length, columnData, filter)
+		if err != nil {
+			return err
+		}
+		rcs[j] = rc
+	}
+	if err := gr.budget.check(chunksHeld(columnData, gr.values, rcs)...); err != nil {
+		return err
+	}
+	hashes := make([]uint64, length) // preserves unique rows (their hashes); OPTIM: preallocate some place
+	bm := bitmap.NewBitmap(length)   // denotes which rows are the unique ones
+	for j, rc := range rcs {
+		rc.Hash(j, hashes)
+	}
+	var spilled *bitmap.Bitmap // rows of new groups that don't fit in memory
+	for row, hash := range hashes {
+		if _, ok := gr.groups[hash]; !ok {
+			if gr.spill != nil && len(gr.groups) >= gr.spill.maxGroups {
+				if spilled == nil {
+					spilled = bitmap.NewBitmap(length)
+				}
+				spilled.Set(row, true)
+				continue
+			}
+			gr.groups[hash] = uint64(len(gr.groups))
+			// it's a new value, set our bitmap, so that we can prune it later
+			bm.Set(row, true)
+		}
+	}
+	if spilled != nil {
+		// from now on, we only work with rows that stay in memory, so we get rid of the filter
+		// and everything else gets pruned to the remaining rows
+		if filter != nil {
+			columnData = pruneColumns(columnData, filter)
+			filter = nil
+		}
+		if err := gr.spill.write(columnData, hashes, spilled); err != nil {
+			return err
+		}
+		nspilled := spilled.Count()
+		gr.spilled += nspilled
+		kept := spilled // no longer needed, so we can flip it
+		kept.Invert()
+		columnData = pruneColumns(columnData, kept)
+		for j, rc := range rcs {
+			rcs[j] = rc.Prune(kept)
+		}
+		keptHashes := make([]uint64, 0, length-nspilled)
+		keptNew := bitmap.NewBitmap(length - nspilled)
+		for row, hash := range hashes {
+			if !kept.Get(row) {
+				continue
+			}
+			if bm.Get(row) {
+				keptNew.Set(len(keptHashes), true)
+			}
+			keptHashes = append(keptHashes, hash)
+		}
+		hashes, bm = keptHashes, keptNew
+	}
+
+	// we have identified new rows in our stripe, add it to our existing columns
+	for j, rc := range rcs {
+		if gr.values[j] == nil {
+			// pruning may return the chunk itself, which may be shared (see database.ReadColumnsFromStripe)
+			// and we'll be appending to it
+			pruned := rc.Prune(bm)
+			if pruned == rc {
+				pruned = rc.Clone()
+			}
+			// literals (e.g. constant columns read from storage) cannot be appended to
+			if pruned.IsLiteral {
+				pruned = pruned.Reorder(make([]int, pruned.Len()))
+			}
+			gr.values[j] = pruned
+			continue
+		}
+		// TODO: this is untested, because we have large stripes in testing
+		if err := gr.values[j].Append(rc.Prune(bm)); err != nil {
+			return err
+		}
+	}
+
+	// 2) update our aggregating expressions (e.g. `sum(a)`)
+	// we no longer need the `hashes` for this stripe, so we'll repurpose it
+	// to get information on groups (buckets)
+	for j, el := range hashes {
+		hashes[j] = gr.groups[el]
+	}
+	for _, aggexpr := range gr.aggexprs {
+		if err := expr.UpdateAggregator(aggexpr, hashes, len(gr.groups), columnData, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve materialises all the groups and their aggregates, in the order of the SELECT clause,
+// spilled partitions get aggregated at this point and their results appended
+func (gr *grouping) resolve() ([]*column.Chunk, error) {
+	// 3) resolve aggregating expressions
+	ret := make([]*column.Chunk, len(gr.q.Select))
+	for j, group := range gr.q.Aggregate {
+		// OPTIM: we did this once already
+		pos := lookupExpr(group, gr.q.Select)
+		if pos == -1 {
+			continue
+		}
+		ret[pos] = gr.values[j]
+	}
+	for j, proj := range gr.q.Select {
+		if ret[j] != nil {
+			// this is an aggregating expression, skip it
+			continue
+		}
+		// we can pass in a nil map, because agg exprs get evaluated first
+		// TODO/ARCH: shouldn't this call Resolve directly (if we exporter the aggregator)? It's kind
+		// of funky to hide the Resolver under Evaluate
+		agg, err := expr.Evaluate(proj, len(gr.groups), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret[j] = agg
+	}
+	ret, err := gr.keepTopGroups(ret)
+	if err != nil || gr.spill == nil {
+		return ret, err
+	}
+
+	for p := range gr.spill.partitions {
+		part, err := gr.resolvePartition(p)
+		if err != nil {
+			return nil, err
+		}
+		if part == nil {
+			continue
+		}
+		for j, col := range part {
+			if err := ret[j].Append(col); err != nil {
+				return nil, err
+			}
+		}
+		if ret, err = gr.keepTopGroups(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// keepTopGroups prunes resolved groups to the top N (see topGroups), this happens for groups kept
+// in memory and then again after each spilled partition gets appended, so we never hold more than
+// N groups on top of those of a partition being resolved. The final sort then only sorts N rows.
+// Pruned groups retain their order, so ties get broken the same way as in a full sort.
+// ARCH: this is exact, because groups in memory and in each partition are disjoint - but it also
+// means we cannot prune groups while still aggregating (a group's aggregates may change in any
+// stripe), so we still hold all the groups (and their aggregators) of a partition at once
+func (gr *grouping) keepTopGroups(groups []*column.Chunk) ([]*column.Chunk, error) {
+	if gr.topN < 0 || groups[0].Len() <= gr.topN {
+		return groups, nil
+	}
+	res := &Result{Data: groups, Length: groups[0].Len()}
+	if err := topK(res, gr.q, gr.topN); err != nil {
+		return nil, err
+	}
+	return res.Data, nil
+}
+
+// resolvePartition aggregates a single spilled partition, nil is returned for empty partitions
+func (gr *grouping) resolvePartition(p int) ([]*column.Chunk, error) {
+	r, err := gr.spill.reader(p)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	// aggregators are part of our expressions, so they need to start afresh for each partition
+	// (our groups in memory have already been resolved at this point)
+	for _, aggexpr := range gr.aggexprs {
+		if err := expr.InitAggregator(aggexpr, gr.schema); err != nil {
+			return nil, err
+		}
+	}
+	part := newGrouping(gr.ctx, gr.schema, gr.q, gr.aggexprs, gr.budget, gr.spill.child(p))
+	if part.spill != nil {
+		defer part.spill.close()
+	}
+	// OPTIM: batches are often small (just the rows of one stripe that ended up in this partition),
+	// we could coalesce them before aggregating them
+	for {
+		if err := gr.ctx.Err(); err != nil {
+			return nil, err
+		}
+		columnData, length, err := gr.spill.readBatch(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := part.add(columnData, nil, length); err != nil {
+			return nil, err
+		}
+	}
+	if err := gr.spill.remove(p); err != nil {
+		return nil, err
+	}
+	ret, err := part.resolve()
+	gr.spilled += part.spilled
+	return ret, err
+}
+
+func pruneColumns(columnData map[string]*column.Chunk, bm *bitmap.Bitmap) map[string]*column.Chunk {
+	ret := make(map[string]*column.Chunk, len(columnData))
+	for name, col := range columnData {
+		ret[name] = col.Prune(bm)
+	}
+	return ret
+}
+
+// spill manages temporary files of one level of partitions, each file holds a series of batches
+// of rows - these consist of a row count and all the columns needed, in the order of `columns`
+type spill struct {
+	wdir      string
+	dir       *string // shared by all the levels, created upon the first write
+	prefix    string  // identifies the partition this level belongs to
+	depth     int
+	maxGroups int
+
+	columns    []string
+	dtypes     []column.Dtype
+	partitions [spillFanout]*os.File
+	writers    [spillFanout]*bufio.Writer
+}
+
+// newSpill allows a GROUP BY to spill its groups to a working directory, if there is one
+func newSpill(wdir string, maxGroups int) *spill {
+	if wdir == "" || maxGroups <= 0 {
+		return nil
+	}
+	return &spill{wdir: wdir, dir: new(string), maxGroups: maxGroups}
+}
+
+// child prepares a spill for groups of a given partition, unless we're too deep already
+func (sp *spill) child(p int) *spill {
+	if sp.depth+1 >= maxSpillDepth {
+		return nil
+	}
+	return &spill{
+		wdir:      sp.wdir,
+		dir:       sp.dir,
+		prefix:    fmt.Sprintf("%v%x-", sp.prefix, p),
+		depth:     sp.depth + 1,
+		maxGroups: sp.maxGroups,
+	}
+}
+
+func (sp *spill) partition(hash uint64) int {
+	return int(hash>>(4*sp.depth)) & (spillFanout - 1)
+}
+
+// write appends rows to their partitions, columns and hashes need to be of the same length
+func (sp *spill) write(columnData map[string]*column.Chunk, hashes []uint64, rows *bitmap.Bitmap) error {
+	if sp.columns == nil {
+		sp.columns = make([]string, 0, len(columnData))
+		for name := range columnData {
+			sp.columns = append(sp.columns, name)
+		}
+		sort.Strings(sp.columns)
+		for _, name := range sp.columns {
+			sp.dtypes = append(sp.dtypes, columnData[name].Dtype())
+		}
+	}
+	var parts [spillFanout]*bitmap.Bitmap
+	for row, hash := range hashes {
+		if !rows.Get(row) {
+			continue
+		}
+		p := sp.partition(hash)
+		if parts[p] == nil {
+			parts[p] = bitmap.NewBitmap(len(hashes))
+		}
+		parts[p].Set(row, true)
+	}
+	for p, bm := range parts {
+		if bm == nil {
+			continue
+		}
+		w, err := sp.writer(p)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(bm.Count())); err != nil {
+			return err
+		}
+		for _, name := range sp.columns {
+			chunk := columnData[name].Prune(bm)
+			// string columns only needed for their lengths stay that way
+			offsetsOnly := chunk.OffsetsOnly()
+			if err := binary.Write(w, binary.LittleEndian, offsetsOnly); err != nil {
+				return err
+			}
+			write := chunk.WriteTo
+			if offsetsOnly {
+				write = chunk.WriteOffsetsTo
+			}
+			if _, err := write(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sp *spill) writer(p int) (*bufio.Writer, error) {
+	if sp.writers[p] != nil {
+		return sp.writers[p], nil
+	}
+	if *sp.dir == "" {
+		dir, err := os.MkdirTemp(sp.wdir, "groupby-")
+		if err != nil {
+			return nil, err
+		}
+		*sp.dir = dir
+	}
+	f, err := os.Create(filepath.Join(*sp.dir, fmt.Sprintf("%v%x", sp.prefix, p)))
+	if err != nil {
+		return nil, err
+	}
+	sp.partitions[p] = f
+	sp.writers[p] = bufio.NewWriter(f)
+	return sp.writers[p], nil
+}
+
+// reader flushes a given partition and returns a reader of its contents, nil if it's empty
+func (sp *spill) reader(p int) (*bufio.Reader, error) {
+	f := sp.partitions[p]
+	if f == nil {
+		return nil, nil
+	}
+	if err := sp.writers[p].Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(f), nil
+}
+
+// readBatch reads a batch of rows as written by `write`, io.EOF signals there are no more batches
+func (sp *spill) readBatch(r *bufio.Reader) (map[string]*column.Chunk, int, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, 0, err
+	}
+	columnData := make(map[string]*column.Chunk, len(sp.columns))
+	for j, name := range sp.columns {
+		var offsetsOnly bool
+		if err := binary.Read(r, binary.LittleEndian, &offsetsOnly); err != nil {
+			return nil, 0, err
+		}
+		var chunk *column.Chunk
+		var err error
+		if offsetsOnly {
+			// we only spill offsets of strings with no multi-byte characters (see ReadColumnOffsets)
+			chunk, _, err = column.DeserializeOffsets(r)
+		} else {
+			chunk, err = column.Deserialize(r, sp.dtypes[j])
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		columnData[name] = chunk
+	}
+	return columnData, int(length), nil
+}
+
+func (sp *spill) remove(p int) error {
+	f := sp.partitions[p]
+	sp.partitions[p], sp.writers[p] = nil, nil
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
+
+// close closes all the files still open, the top level spill also removes all the temporary files
+func (sp *spill) close() error {
+	for _, f := range sp.partitions {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if sp.depth > 0 || *sp.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(*sp.dir)
+}
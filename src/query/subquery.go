@@ -0,0 +1,39 @@
+package query
+
+import (
+	"context"
+
+	"github.com/kokes/smda/src/column"
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query/expr"
+)
+
+// resolveSubqueries runs all the subqueries of a given query and stores their results in them, so
+// that they can be evaluated like any other expression (scalar subqueries turn into values, IN
+// subqueries into sets of values we look up in)
+// ARCH: subqueries get run even in EXPLAIN queries, we need their results to validate the outer query
+// OPTIM: we materialise all the results of IN subqueries, we could deduplicate them as they come
+func resolveSubqueries(ctx context.Context, db *database.Database, q expr.Query) error {
+	for _, sq := range q.Subqueries() {
+		inner := sq.Query
+		inner.Explain = false
+		tctx, stop := startTimer(ctx, timerSubquery)
+		res, err := run(tctx, db, inner)
+		stop()
+		if err != nil {
+			return err
+		}
+		data, err := res.orderedData()
+		if err != nil {
+			return err
+		}
+		var col *column.Chunk
+		if len(data) > 0 {
+			col = data[0]
+		}
+		if err := sq.SetResult(res.Schema, col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
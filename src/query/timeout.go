@@ -0,0 +1,78 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kokes/smda/src/errs"
+)
+
+// TimeoutError is returned by queries running for longer than their timeout (see Run), it reports
+// how far along they got, so that it's easier to tell why they took so long
+type TimeoutError struct {
+	TimeoutMs    float64 `json:"timeout_ms"`
+	ElapsedMs    float64 `json:"elapsed_ms"`
+	StripesRead  int     `json:"stripes_read"`
+	BytesScanned int     `json:"bytes_scanned"`
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("query timed out after %vms (the timeout is %vms), having read %v stripes (%v bytes)", te.ElapsedMs, te.TimeoutMs, te.StripesRead, te.BytesScanned)
+}
+
+// Unwrap categorises timeouts (see errs.Category)
+func (te *TimeoutError) Unwrap() error {
+	return errs.ErrTimeout
+}
+
+// queryClock keeps track of how long a query (including all of its parts) has been running
+type queryClock struct {
+	started time.Time
+	timeout time.Duration // non-positive values mean no timeout
+}
+
+type queryClockKey struct{}
+
+// timeoutKey holds a timeout overriding the database's default (see Settings.Timeout)
+type timeoutKey struct{}
+
+// withTimeout starts a query's clock, unless it's already running (e.g. for subqueries), the query
+// gets cancelled once its timeout passes - we check for cancellations before reading each stripe
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Value(queryClockKey{}).(*queryClock); ok {
+		return ctx, func() {}
+	}
+	if override, ok := ctx.Value(timeoutKey{}).(time.Duration); ok {
+		timeout = override
+	}
+	ctx = context.WithValue(ctx, queryClockKey{}, &queryClock{started: time.Now(), timeout: timeout})
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timedOut turns a cancellation caused by our timeout (see withTimeout) into a TimeoutError, other
+// errors are returned as they are (including cancellations by our callers)
+func timedOut(ctx context.Context, err error) error {
+	clock, ok := ctx.Value(queryClockKey{}).(*queryClock)
+	if !ok || clock.timeout <= 0 || !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	elapsed := time.Since(clock.started)
+	if elapsed < clock.timeout {
+		return err
+	}
+	te := &TimeoutError{
+		TimeoutMs: float64(clock.timeout.Microseconds()) / 1000,
+		ElapsedMs: float64(elapsed.Microseconds()) / 1000,
+	}
+	if sb := scanBudgetFrom(ctx); sb != nil {
+		sb.Lock()
+		te.StripesRead, te.BytesScanned = sb.stripes, sb.scanned
+		sb.Unlock()
+	}
+	return te
+}
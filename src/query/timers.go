@@ -0,0 +1,263 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
+)
+
+var errNoProfile = errs.New(errs.ErrBadRequest, "query was not profiled (see the profile setting)")
+
+// Timer measures a single part of a query's execution. Timers nest - e.g. stripes get read and
+// filtered within a query, which itself may be a part of a union. Times are relative to the start
+// of the whole query. Timers of reads (stageRead) also report how many columns were served from
+// (or missing in) the database's chunk cache (see database.ReadStats).
+type Timer struct {
+	ID          int           `json:"id"`
+	Parent      int           `json:"parent"` // -1 for top level timers
+	Name        string        `json:"name"`
+	Start       time.Duration `json:"start"`
+	Duration    time.Duration `json:"duration"`
+	CacheHits   int           `json:"cache_hits,omitempty"`
+	CacheMisses int           `json:"cache_misses,omitempty"`
+}
+
+// Profile collects timers of a single query (including all of its parts), it's only collected when
+// asked for (see Settings.Profile). Stripes may be processed concurrently, hence the lock.
+// ARCH: stages get timed per stripe (see stageRead etc.), we don't time individual expressions, so
+// e.g. an expensive projection only shows up as a slow `project` stage
+type Profile struct {
+	mu      sync.Mutex
+	started time.Time
+	timers  []Timer
+}
+
+// parts of queries we time on top of the stages reported in plans
+const (
+	timerQuery       = "query"
+	timerSubquery    = "subquery"
+	timerUnionPart   = "union part"
+	timerCommonTable = "common table"
+)
+
+type profileKey struct{}
+
+// timerKey holds the ID of the timer currently running in a context, it's the parent of all the
+// timers started within that context
+type timerKey struct{}
+
+func newProfile() *Profile {
+	return &Profile{started: time.Now()}
+}
+
+func profileFrom(ctx context.Context) *Profile {
+	p, _ := ctx.Value(profileKey{}).(*Profile)
+	return p
+}
+
+// startTimer starts timing a part of a query, the returned context is to be used by nested parts
+// (it can be discarded if there are none), the returned function stops the timer. This is a no-op
+// for queries not being profiled.
+func startTimer(ctx context.Context, name string) (context.Context, func()) {
+	p := profileFrom(ctx)
+	if p == nil {
+		return ctx, func() {}
+	}
+	parent, ok := ctx.Value(timerKey{}).(int)
+	if !ok {
+		parent = -1
+	}
+	p.mu.Lock()
+	id := len(p.timers)
+	p.timers = append(p.timers, Timer{ID: id, Parent: parent, Name: name, Start: time.Since(p.started)})
+	p.mu.Unlock()
+
+	return context.WithValue(ctx, timerKey{}, id), func() {
+		p.mu.Lock()
+		p.timers[id].Duration = time.Since(p.started) - p.timers[id].Start
+		p.mu.Unlock()
+	}
+}
+
+// recordReads notes chunk cache hits and misses of a read on the timer running in a given context
+// (see startTimer), this is a no-op for queries not being profiled
+func recordReads(ctx context.Context, stats database.ReadStats) {
+	p := profileFrom(ctx)
+	if p == nil {
+		return
+	}
+	id, ok := ctx.Value(timerKey{}).(int)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	p.timers[id].CacheHits += stats.CacheHits
+	p.timers[id].CacheMisses += stats.CacheMisses
+	p.mu.Unlock()
+}
+
+// Timers returns all the timers of a profile, in the order they were started
+func (p *Profile) Timers() []Timer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Timer(nil), p.timers...)
+}
+
+// the following mirrors speedscope's file format, see https://www.speedscope.app/file-format-schema.json
+type speedscopeFile struct {
+	Schema   string              `json:"$schema"`
+	Shared   speedscopeShared    `json:"shared"`
+	Profiles []speedscopeProfile `json:"profiles"`
+	Exporter string              `json:"exporter"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+}
+
+type speedscopeProfile struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Unit       string            `json:"unit"`
+	StartValue float64           `json:"startValue"`
+	EndValue   float64           `json:"endValue"`
+	Events     []speedscopeEvent `json:"events"`
+}
+
+// cache hits and misses are not part of speedscope's format (it ignores them), we report them
+// when opening timers of reads (see Timer)
+type speedscopeEvent struct {
+	Type        string  `json:"type"` // O(pen) or C(lose)
+	Frame       int     `json:"frame"`
+	At          float64 `json:"at"`
+	CacheHits   int     `json:"cacheHits,omitempty"`
+	CacheMisses int     `json:"cacheMisses,omitempty"`
+}
+
+func microseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000
+}
+
+// timerLane is a sequence of properly nested timers, i.e. a single speedscope profile
+type timerLane struct {
+	profile speedscopeProfile
+	stack   []Timer
+	lastAt  time.Duration
+}
+
+func (tl *timerLane) event(typ string, frame int, at time.Duration) {
+	// events cannot go back in time, but the start of a timer can be (very slightly) before its
+	// parent's end gets recorded
+	if at < tl.lastAt {
+		at = tl.lastAt
+	}
+	tl.lastAt = at
+	tl.profile.Events = append(tl.profile.Events, speedscopeEvent{Type: typ, Frame: frame, At: microseconds(at)})
+	tl.profile.EndValue = microseconds(at)
+}
+
+// MarshalJSON serialises a profile as an evented speedscope profile, so that it can be explored as
+// a flamegraph (e.g. at https://www.speedscope.app). Events in a speedscope profile need to be
+// nested, but parts of queries may run concurrently (e.g. parallel aggregations), so overlapping
+// timers get placed in separate profiles (lanes), along with (copies of) their parents.
+func (p *Profile) MarshalJSON() ([]byte, error) {
+	timers := p.Timers()
+	ret := speedscopeFile{
+		Schema:   "https://www.speedscope.app/file-format-schema.json",
+		Exporter: "smda",
+		Shared:   speedscopeShared{Frames: []speedscopeFrame{}},
+		Profiles: []speedscopeProfile{},
+	}
+	frames := make(map[string]int)
+	frame := func(name string) int {
+		if idx, ok := frames[name]; ok {
+			return idx
+		}
+		frames[name] = len(ret.Shared.Frames)
+		ret.Shared.Frames = append(ret.Shared.Frames, speedscopeFrame{Name: name})
+		return frames[name]
+	}
+	end := func(t Timer) time.Duration { return t.Start + t.Duration }
+	// parents always start before their children (and get lower IDs)
+	sort.SliceStable(timers, func(i, j int) bool {
+		if timers[i].Start != timers[j].Start {
+			return timers[i].Start < timers[j].Start
+		}
+		return timers[i].ID < timers[j].ID
+	})
+	byID := make(map[int]Timer, len(timers))
+	for _, t := range timers {
+		byID[t.ID] = t
+	}
+
+	var lanes []*timerLane
+	for _, t := range timers {
+		var ancestors []Timer // from the top level one down to t's parent
+		isAncestor := make(map[int]bool)
+		for parent := t.Parent; parent >= 0; parent = byID[parent].Parent {
+			ancestors = append([]Timer{byID[parent]}, ancestors...)
+			isAncestor[parent] = true
+		}
+		var lane *timerLane
+		for _, tl := range lanes {
+			// close timers that have ended (unless we're nested in them)
+			for len(tl.stack) > 0 {
+				top := tl.stack[len(tl.stack)-1]
+				if isAncestor[top.ID] || end(top) > t.Start {
+					break
+				}
+				tl.event("C", frame(top.Name), end(top))
+				tl.stack = tl.stack[:len(tl.stack)-1]
+			}
+			fits := len(tl.stack) <= len(ancestors)
+			for _, open := range tl.stack {
+				fits = fits && isAncestor[open.ID]
+			}
+			if fits {
+				lane = tl
+				break
+			}
+		}
+		if lane == nil {
+			lane = &timerLane{profile: speedscopeProfile{Type: "evented", Unit: "microseconds", Events: []speedscopeEvent{}}}
+			lanes = append(lanes, lane)
+		}
+		for _, anc := range ancestors[len(lane.stack):] {
+			lane.event("O", frame(anc.Name), t.Start)
+			lane.stack = append(lane.stack, anc)
+		}
+		lane.event("O", frame(t.Name), t.Start)
+		opened := &lane.profile.Events[len(lane.profile.Events)-1]
+		opened.CacheHits, opened.CacheMisses = t.CacheHits, t.CacheMisses
+		lane.stack = append(lane.stack, t)
+	}
+	for j, tl := range lanes {
+		for k := len(tl.stack) - 1; k >= 0; k-- {
+			tl.event("C", frame(tl.stack[k].Name), end(tl.stack[k]))
+		}
+		tl.profile.Name = "query"
+		if j > 0 {
+			tl.profile.Name = "concurrent part"
+		}
+		ret.Profiles = append(ret.Profiles, tl.profile)
+	}
+	return json.Marshal(ret)
+}
+
+// WriteProfile writes the profile of a query (see Settings.Profile) in speedscope's format
+func (res *Result) WriteProfile(w io.Writer) error {
+	if res.Profile == nil {
+		return errNoProfile
+	}
+	return json.NewEncoder(w).Encode(res.Profile)
+}
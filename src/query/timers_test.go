@@ -0,0 +1,183 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
+)
+
+// checkSpeedscope verifies that all events of a speedscope file are properly nested and that they
+// don't go back in time, it returns the names of all the frames opened
+func checkSpeedscope(t *testing.T, data []byte) []string {
+	t.Helper()
+	var file speedscopeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	var opened []string
+	for _, profile := range file.Profiles {
+		var stack []int
+		last := profile.StartValue
+		for _, event := range profile.Events {
+			if event.At < last || event.At > profile.EndValue {
+				t.Errorf("event %+v out of order (or out of bounds) in %+v", event, profile)
+			}
+			last = event.At
+			switch event.Type {
+			case "O":
+				stack = append(stack, event.Frame)
+				opened = append(opened, file.Shared.Frames[event.Frame].Name)
+			case "C":
+				if len(stack) == 0 || stack[len(stack)-1] != event.Frame {
+					t.Fatalf("closing a frame that's not open: %+v (open: %v)", event, stack)
+				}
+				stack = stack[:len(stack)-1]
+			default:
+				t.Errorf("unexpected event type: %v", event.Type)
+			}
+		}
+		if len(stack) > 0 {
+			t.Errorf("frames left open: %v", stack)
+		}
+	}
+	return opened
+}
+
+func TestProfilingQueries(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a,b\n1,2\n3,4\n5,6\n7,8\n9,10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		stages []string // stages we expect to be timed (at least once)
+	}{
+		{"SELECT a FROM foo", []string{timerQuery, stageRead, stageProject}},
+		{"SELECT a FROM foo WHERE b > 4 ORDER BY a DESC LIMIT 2", []string{timerQuery, stageRead, stageFilter, stageProject, stageSort}},
+		{"SELECT b, count() FROM foo GROUP BY b ORDER BY b", []string{timerQuery, stageRead, stageAggregate, stageSort}},
+		// global aggregations run in parallel
+		{"SELECT sum(a), max(b) FROM foo WHERE a > 1", []string{timerQuery, stageRead, stageFilter, stageAggregate}},
+		{"SELECT a FROM foo WHERE a > (SELECT min(a) FROM foo) UNION ALL SELECT b FROM foo", []string{timerQuery, timerUnionPart, timerSubquery, stageRead}},
+		{"WITH bar AS (SELECT a FROM foo) SELECT a FROM bar", []string{timerQuery, timerCommonTable, stageRead, stageProject}},
+	}
+	cache := NewCache(10)
+	for _, test := range tests {
+		// profiled queries don't get cached, so repeated runs get profiled as well
+		for j := 0; j < 2; j++ {
+			res, err := cache.RunSQLWithSettings(context.Background(), db, test.query, Settings{Profile: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Profile == nil {
+				t.Fatalf("expecting %v to be profiled", test.query)
+			}
+			timers := res.Profile.Timers()
+			seen := make(map[string]bool)
+			for _, timer := range timers {
+				seen[timer.Name] = true
+				if timer.Parent < 0 {
+					if timer.Name != timerQuery {
+						t.Errorf("expecting only the whole query to have no parent, got %+v", timer)
+					}
+					continue
+				}
+				parent := timers[timer.Parent]
+				if timer.Start < parent.Start || timer.Start+timer.Duration > parent.Start+parent.Duration {
+					t.Errorf("expecting timers to be nested in their parents, got %+v within %+v", timer, parent)
+				}
+			}
+			for _, stage := range test.stages {
+				if !seen[stage] {
+					t.Errorf("expecting %v to time %v, got %+v", test.query, stage, timers)
+				}
+			}
+
+			data, err := json.Marshal(res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var payload struct {
+				Profile json.RawMessage `json:"profile"`
+			}
+			if err := json.Unmarshal(data, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if opened := checkSpeedscope(t, payload.Profile); len(opened) < len(timers) {
+				t.Errorf("expecting all %v timers to be in the speedscope profile, got %v", len(timers), opened)
+			}
+		}
+	}
+
+	res, err := cache.RunSQLWithSettings(context.Background(), db, "SELECT a FROM foo", Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Profile != nil {
+		t.Errorf("expecting queries not to be profiled by default, got %+v", res.Profile.Timers())
+	}
+	if err := res.WriteProfile(new(strings.Builder)); !errors.Is(err, errs.ErrBadRequest) {
+		t.Errorf("expecting unprofiled queries not to have profiles to write, got %v", err)
+	}
+}
+
+func TestSpeedscopeLanes(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		timers []Timer
+		lanes  int
+	}{
+		{nil, 0},
+		{[]Timer{{ID: 0, Parent: -1, Name: "query", Duration: 10 * ms}}, 1},
+		// sequential children
+		{[]Timer{
+			{ID: 0, Parent: -1, Name: "query", Duration: 10 * ms},
+			{ID: 1, Parent: 0, Name: "read", Start: 1 * ms, Duration: 2 * ms},
+			{ID: 2, Parent: 1, Name: "filter", Start: 2 * ms, Duration: 1 * ms},
+			{ID: 3, Parent: 0, Name: "read", Start: 3 * ms, Duration: 2 * ms},
+			{ID: 4, Parent: 0, Name: "sort", Start: 5 * ms, Duration: 5 * ms},
+		}, 1},
+		// two workers reading concurrently
+		{[]Timer{
+			{ID: 0, Parent: -1, Name: "query", Duration: 10 * ms},
+			{ID: 1, Parent: 0, Name: "read", Start: 1 * ms, Duration: 4 * ms},
+			{ID: 2, Parent: 0, Name: "read", Start: 2 * ms, Duration: 4 * ms},
+			{ID: 3, Parent: 2, Name: "filter", Start: 3 * ms, Duration: 1 * ms},
+			{ID: 4, Parent: 0, Name: "read", Start: 5 * ms, Duration: 1 * ms},
+			{ID: 5, Parent: 0, Name: "aggregate", Start: 7 * ms, Duration: 1 * ms},
+		}, 2},
+	}
+	for _, test := range tests {
+		p := &Profile{timers: test.timers}
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var file speedscopeFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatal(err)
+		}
+		if len(file.Profiles) != test.lanes {
+			t.Errorf("expecting %v timers to result in %v lanes, got %v", len(test.timers), test.lanes, len(file.Profiles))
+		}
+		checkSpeedscope(t, data)
+	}
+}
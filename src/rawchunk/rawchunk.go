@@ -0,0 +1,229 @@
+// Package rawchunk reads column chunks as served by smda's API, so that external tools can
+// consume smda data without running queries. A chunk holds one column of one stripe of a dataset
+// (`GET /api/datasets/foo@v<version>/stripes/<stripe>/<column>`, stripe IDs are listed in dataset
+// metadata). The package doesn't depend on any other part of smda, it can be vendored as is.
+//
+// The format is fixed for a given Version, all integers are little endian. A chunk starts with a
+// header:
+//
+//	magic    4 bytes, "SMDA"
+//	version  uint8, see Version
+//	dtype    uint8 length + that many bytes of the type's name, e.g. "int", see Chunk.Dtype
+//
+// followed by a nullability bitmap and the values of the chunk. Bitmaps are stored as a uint32
+// number of bits (zero for no bitmap at all, i.e. no nulls), and, if there are any bits, a uint32
+// number of words and that many uint64 words, bit j being the (j%64)th lowest bit of word j/64.
+// Values differ by dtype:
+//
+//	null                 uint32 length (there are no values, all of them are null)
+//	int                  uint32 length + length*int64
+//	float                uint32 length + length*float64 (IEEE 754)
+//	bool                 uint32 length + a bitmap of values (true for set bits)
+//	date                 uint32 length + length*uint32, year<<14 | month<<10 | day<<5
+//	datetime             uint32 length + length*uint64, a date (as above) with the hour in its
+//	                     lowest five bits, shifted by 32 bits, plus microseconds within that hour
+//	decimal              uint32 length + length*int64, mantissa<<4 | scale (number of decimal
+//	                     places), e.g. 12.30 is (1230<<4 | 2)
+//	string, json         uint32 number of offsets (length+1) + that many uint32 offsets, uint32
+//	                     number of bytes + that many bytes, value j is bytes[offsets[j]:offsets[j+1]]
+//
+// Values of nulls are undefined.
+package rawchunk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Magic starts every chunk
+const Magic = "SMDA"
+
+// Version of the chunk format described in the package documentation
+const Version = 1
+
+// ErrInvalidChunk is returned for data not in our chunk format (or in a newer version of it)
+var ErrInvalidChunk = errors.New("invalid chunk")
+
+// Chunk is a decoded column chunk, only the values of its dtype are populated
+type Chunk struct {
+	Dtype    string
+	Length   int
+	Ints     []int64     // int
+	Floats   []float64   // float
+	Bools    []bool      // bool
+	Times    []time.Time // date and datetime, in UTC
+	Decimals []Decimal   // decimal
+	Strings  []string    // string and json
+	nulls    []uint64
+}
+
+// Decimal is a fixed point number, Mantissa / 10^Scale
+type Decimal struct {
+	Mantissa int64
+	Scale    int
+}
+
+// Float64 approximates a decimal as a float
+func (d Decimal) Float64() float64 {
+	div := 1.0
+	for j := 0; j < d.Scale; j++ {
+		div *= 10
+	}
+	return float64(d.Mantissa) / div
+}
+
+// IsNull reports whether the jth value of a chunk is null (all values of null chunks are)
+func (ch *Chunk) IsNull(j int) bool {
+	if ch.Dtype == "null" {
+		return true
+	}
+	if j/64 >= len(ch.nulls) {
+		return false
+	}
+	return ch.nulls[j/64]&(1<<(j%64)) > 0
+}
+
+// WriteHeader writes the header of a chunk of a given dtype, it's to be followed by its contents
+func WriteHeader(w io.Writer, dtype string) error {
+	if len(dtype) > 255 {
+		return fmt.Errorf("%w: dtype too long", ErrInvalidChunk)
+	}
+	header := append([]byte(Magic), Version, byte(len(dtype)))
+	_, err := w.Write(append(header, dtype...))
+	return err
+}
+
+func readLength(r io.Reader) (int, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, err
+	}
+	return int(length), nil
+}
+
+// readBitmap returns a bitmap's words and its number of bits
+func readBitmap(r io.Reader) ([]uint64, int, error) {
+	nbits, err := readLength(r)
+	if err != nil || nbits == 0 {
+		return nil, 0, err
+	}
+	nwords, err := readLength(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if nwords < (nbits+63)/64 {
+		return nil, 0, fmt.Errorf("%w: bitmap of %v bits only has %v words", ErrInvalidChunk, nbits, nwords)
+	}
+	words := make([]uint64, nwords)
+	if err := binary.Read(r, binary.LittleEndian, words); err != nil {
+		return nil, 0, err
+	}
+	return words, nbits, nil
+}
+
+func toDate(d uint32) time.Time {
+	return time.Date(int(d>>14), time.Month(d>>10&15), int(d>>5&31), 0, 0, 0, 0, time.UTC)
+}
+
+// Read reads and decodes a single chunk (including its header)
+func Read(r io.Reader) (*Chunk, error) {
+	header := make([]byte, len(Magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("%w: not a chunk", ErrInvalidChunk)
+	}
+	if header[len(Magic)] != Version {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrInvalidChunk, header[len(Magic)])
+	}
+	dtype := make([]byte, header[len(Magic)+1])
+	if _, err := io.ReadFull(r, dtype); err != nil {
+		return nil, err
+	}
+	ch := &Chunk{Dtype: string(dtype)}
+	nulls, _, err := readBitmap(r)
+	if err != nil {
+		return nil, err
+	}
+	ch.nulls = nulls
+
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	switch ch.Dtype {
+	case "null":
+	case "int":
+		ch.Ints = make([]int64, length)
+		err = binary.Read(r, binary.LittleEndian, ch.Ints)
+	case "float":
+		ch.Floats = make([]float64, length)
+		err = binary.Read(r, binary.LittleEndian, ch.Floats)
+	case "bool":
+		var words []uint64
+		words, _, err = readBitmap(r)
+		ch.Bools = make([]bool, length)
+		for j := 0; j < length && j/64 < len(words); j++ {
+			ch.Bools[j] = words[j/64]&(1<<(j%64)) > 0
+		}
+	case "date":
+		raw := make([]uint32, length)
+		err = binary.Read(r, binary.LittleEndian, raw)
+		ch.Times = make([]time.Time, length)
+		for j, d := range raw {
+			ch.Times[j] = toDate(d)
+		}
+	case "datetime":
+		raw := make([]uint64, length)
+		err = binary.Read(r, binary.LittleEndian, raw)
+		ch.Times = make([]time.Time, length)
+		for j, dt := range raw {
+			hour := time.Duration(dt>>32&31) * time.Hour
+			micros := time.Duration(dt&(1<<32-1)) * time.Microsecond
+			ch.Times[j] = toDate(uint32(dt >> 32)).Add(hour + micros)
+		}
+	case "decimal":
+		raw := make([]int64, length)
+		err = binary.Read(r, binary.LittleEndian, raw)
+		ch.Decimals = make([]Decimal, length)
+		for j, d := range raw {
+			ch.Decimals[j] = Decimal{Mantissa: d >> 4, Scale: int(d & 15)}
+		}
+	case "string", "json":
+		if length == 0 {
+			return nil, fmt.Errorf("%w: no string offsets", ErrInvalidChunk)
+		}
+		offsets := make([]uint32, length)
+		if err := binary.Read(r, binary.LittleEndian, offsets); err != nil {
+			return nil, err
+		}
+		var nbytes int
+		if nbytes, err = readLength(r); err != nil {
+			return nil, err
+		}
+		data := make([]byte, nbytes)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		length--
+		ch.Strings = make([]string, length)
+		for j := range ch.Strings {
+			start, end := offsets[j], offsets[j+1]
+			if start > end || int(end) > len(data) {
+				return nil, fmt.Errorf("%w: string offsets out of bounds", ErrInvalidChunk)
+			}
+			ch.Strings[j] = string(data[start:end])
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown dtype %q", ErrInvalidChunk, ch.Dtype)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ch.Length = length
+	return ch, nil
+}
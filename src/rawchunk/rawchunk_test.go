@@ -0,0 +1,82 @@
+package rawchunk
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kokes/smda/src/column"
+)
+
+// chunks get written by the column package, this makes sure we keep up with it
+func TestReadingChunks(t *testing.T) {
+	date := func(y, m, d int) time.Time { return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		dtype    column.Dtype
+		values   []string
+		nulls    []bool
+		expected Chunk
+	}{
+		{column.DtypeNull, []string{"", ""}, []bool{true, true}, Chunk{Dtype: "null", Length: 2}},
+		{column.DtypeInt, []string{"1", "", "-300"}, []bool{false, true, false}, Chunk{Dtype: "int", Length: 3, Ints: []int64{1, 0, -300}}},
+		{column.DtypeInt, []string{}, nil, Chunk{Dtype: "int", Ints: []int64{}}},
+		{column.DtypeFloat, []string{"1.5", "-2"}, []bool{false, false}, Chunk{Dtype: "float", Length: 2, Floats: []float64{1.5, -2}}},
+		{column.DtypeBool, []string{"true", "false", "", "t"}, []bool{false, false, true, false}, Chunk{Dtype: "bool", Length: 4, Bools: []bool{true, false, false, true}}},
+		{column.DtypeDate, []string{"2020-02-29", "1999-12-31"}, []bool{false, false}, Chunk{Dtype: "date", Length: 2, Times: []time.Time{date(2020, 2, 29), date(1999, 12, 31)}}},
+		{column.DtypeDatetime, []string{"2020-02-29 23:59:58.123456"}, []bool{false}, Chunk{Dtype: "datetime", Length: 1, Times: []time.Time{time.Date(2020, 2, 29, 23, 59, 58, 123456000, time.UTC)}}},
+		{column.DtypeDecimal, []string{"12.30", "-0.5"}, []bool{false, false}, Chunk{Dtype: "decimal", Length: 2, Decimals: []Decimal{{1230, 2}, {-5, 1}}}},
+		{column.DtypeString, []string{"foo", "", "čau"}, []bool{false, false, false}, Chunk{Dtype: "string", Length: 3, Strings: []string{"foo", "", "čau"}}},
+	}
+	for _, test := range tests {
+		rc := column.NewChunk(test.dtype)
+		if err := rc.AddValues(test.values); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := WriteHeader(&buf, test.dtype.String()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rc.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		ch, err := Read(&buf)
+		if err != nil {
+			t.Errorf("failed to read a %v chunk: %v", test.dtype, err)
+			continue
+		}
+		for j, null := range test.nulls {
+			if ch.IsNull(j) != null {
+				t.Errorf("expecting value %v of %v to be null: %v", j, test.values, null)
+			}
+		}
+		ch.nulls = nil
+		if !reflect.DeepEqual(*ch, test.expected) {
+			t.Errorf("expecting %v to be read as %+v, got %+v", test.values, test.expected, *ch)
+		}
+		if buf.Len() > 0 {
+			t.Errorf("expecting a %v chunk to be read in full, %v bytes left", test.dtype, buf.Len())
+		}
+	}
+}
+
+func TestReadingInvalidChunks(t *testing.T) {
+	tests := [][]byte{
+		[]byte("PAR1\x01\x03int"),
+		[]byte("SMDA\x02\x03int"),
+		[]byte("SMDA\x01\x03foo\x00\x00\x00\x00\x00\x00\x00\x00"),
+		[]byte("SMDA\x01\x06string\x00\x00\x00\x00\x00\x00\x00\x00"),
+	}
+	for _, test := range tests {
+		if _, err := Read(bytes.NewReader(test)); !errors.Is(err, ErrInvalidChunk) {
+			t.Errorf("expecting %q not to be a valid chunk, got %v", test, err)
+		}
+	}
+}
+
+func TestDecimalsToFloats(t *testing.T) {
+	if got := (Decimal{Mantissa: -1230, Scale: 2}).Float64(); got != -12.3 {
+		t.Errorf("expecting -12.30 to be -12.3, got %v", got)
+	}
+}
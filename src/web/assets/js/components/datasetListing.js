@@ -1,5 +1,5 @@
 import { node } from "../dom.js";
-import { formatTimestamp, formatBytes } from "../formatters.js";
+import { formatTimestamp, formatBytes, formatFloat } from "../formatters.js";
 
 function queryFromStructured(data) {
     if (Object.entries(data).length === 0) {
@@ -15,6 +15,82 @@ function queryFromStructured(data) {
     ].filter(x => x.trim() !== "").join("\n");
 }
 
+// a short profile of a column (if we have stats for it), e.g. `foo (int): 12.5% nulls, 40 distinct, 1 to 99`
+function describeColumn(col, stats) {
+    const desc = `${col.name} (${col.dtype})`;
+    if (stats === undefined) {
+        return desc;
+    }
+    const profile = [
+        `${formatFloat(100 * stats.null_fraction)}% nulls`,
+        `${stats.distinct.toLocaleString()} distinct`,
+    ];
+    if (stats.min !== undefined) {
+        profile.push(`${stats.min} to ${stats.max}`);
+    }
+    if (stats.avg_length !== undefined) {
+        profile.push(`${formatFloat(stats.avg_length)} characters on average`);
+    }
+    return `${desc}: ${profile.join(", ")}`;
+}
+
+// previews (see /api/datasets/foo/preview) are only loaded once a schema gets expanded, a few
+// values get listed alongside each column
+async function loadPreview(ds, list) {
+    const name = ds.namespace ? `${ds.namespace}.${ds.name}` : ds.name;
+    const req = await fetch(`/api/datasets/${name}@v${ds.id}/preview`);
+    if (req.ok === false) {
+        return;
+    }
+    const preview = await req.json();
+    preview.head.forEach((values, j) => {
+        const examples = values.slice(0, 3).map(val => JSON.stringify(val)).join(", ");
+        list.children[j].append(node("small", {}, ` (e.g. ${examples})`));
+    });
+}
+
+// string columns can get their types inferred anew (see /api/datasets/foo/infer), values that
+// don't fit the inferred type are listed and, upon confirmation, they become nulls in a new version
+async function retypeColumn(ds, col) {
+    const name = ds.namespace ? `${ds.namespace}.${ds.name}` : ds.name;
+    const req = await fetch(`/api/datasets/${name}@v${ds.id}/infer?columns=${encodeURIComponent(col.name)}`);
+    if (req.ok === false) {
+        document.querySelector("err-dialog").addError(`cannot infer type of ${col.name}`, (await req.json()).error);
+        return;
+    }
+    const [inferred] = await req.json();
+    if (inferred.after.dtype === col.dtype) {
+        alert(`${col.name} cannot be retyped, most of its values are strings`);
+        return;
+    }
+    const examples = inferred.conflicts.slice(0, 10).map(c => `row ${c.row + 1}: ${JSON.stringify(c.value)}`);
+    const message = [
+        `${col.name} looks like ${inferred.after.dtype}, ${inferred.nconflicts.toLocaleString()} values would become nulls:`,
+        ...examples,
+        "Create a new version of this dataset?",
+    ].join("\n");
+    if (!confirm(message)) {
+        return;
+    }
+    const edit = [{column: col.name, dtype: inferred.after.dtype, null_invalid: true}];
+    const resp = await fetch(`/api/datasets/${name}@v${ds.id}/schema`, {method: "POST", body: JSON.stringify(edit)});
+    if (resp.ok === false) {
+        document.querySelector("err-dialog").addError(`cannot retype ${col.name}`, (await resp.json()).error);
+        return;
+    }
+    window.location.reload();
+}
+
+function describeColumnNode(ds, col, stats) {
+    const item = node("li", {}, describeColumn(col, stats));
+    if (col.dtype === "string") {
+        const retype = node("button", {"title": "infer the type of this column anew"}, "retype");
+        retype.addEventListener("click", () => retypeColumn(ds, col));
+        item.append(" ", retype);
+    }
+    return item;
+}
+
 class DatasetListing extends HTMLElement {
     constructor() {
         super();
@@ -41,6 +117,11 @@ class DatasetListing extends HTMLElement {
         for (const ds of datasets) {
             // ARCH: this foo@vbar should be a function or something
             const query = queryFromStructured({dataset: `${ds.name}@v${ds.id}`, limit: 100});
+            const columns = node("ul", {}, ds.schema.map(
+                (col, j) => describeColumnNode(ds, col, ds.stats && ds.stats[j])
+            ));
+            const schema = node("details", {}, [node("summary", {}, `${ds.schema.length} columns`), columns]);
+            schema.addEventListener("toggle", () => loadPreview(ds, columns), { once: true });
             const cols = [
                 node("a", {"href": `/query?sql=${encodeURIComponent(query)}`}, ds.id),
                 ds.name,
@@ -51,13 +132,7 @@ class DatasetListing extends HTMLElement {
                 formatBytes(ds.size_raw),
                 formatBytes(ds.size_on_disk),
                 ds.nrows.toLocaleString(),
-                node("details", {},
-                    [
-                        node("summary", {}, `${ds.schema.length} columns`),
-                        node("ul", {}, ds.schema.map(
-                            col => node("li", {}, `${col.name} (${col.dtype})`)
-                        ))
-                    ]),
+                schema,
             ];
             rows.push(cols);
         }
@@ -17,7 +17,7 @@ class FileUploader extends HTMLElement {
                     body: file,
                 })
                 if (request.ok !== true) {
-                    document.querySelector("err-dialog").addError(`failed to upload ${file.name}`, await request.text());
+                    document.querySelector("err-dialog").addError(`failed to upload ${file.name}`, (await request.json()).error);
                     continue;
                 }
                 // ARCH/TODO: we're fetching dataset listings from the API... but we already have it in the
@@ -7,8 +7,8 @@ async function runQuery(query) {
         body: JSON.stringify({"sql": query}),
     })
     if (req.ok === false) {
-        const error = await req.text();
-        throw new Error(error);
+        const error = await req.json();
+        throw new Error(error.error);
     }
     return await req.json();
 }
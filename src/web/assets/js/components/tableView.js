@@ -39,6 +39,10 @@ class TableView extends HTMLElement {
                 if (typeof(val) === "number" && !Number.isInteger(val)) {
                     val = formatFloat(val);
                 }
+                // JSON columns come as nested values
+                if (typeof(val) === "object") {
+                    val = JSON.stringify(val);
+                }
                 return node("td", props, val)
             }));
             return row;
@@ -65,7 +69,7 @@ class TableView extends HTMLElement {
 function makeSortable(th) {
     th.addEventListener("click", e => {
         const dtype = e.target.getAttribute("data-dtype");
-        const isNumeric = dtype === "float" || dtype === "int"; // TODO: isNumeric as a function?
+        const isNumeric = dtype === "float" || dtype === "int" || dtype === "decimal"; // TODO: isNumeric as a function?
         const existing = e.target.getAttribute("data-ordering");
         let newOrder = "asc";
         if (existing === "asc") {
@@ -1,18 +1,27 @@
 package web
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/kokes/smda/src/column"
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/errs"
 	"github.com/kokes/smda/src/query"
+	"github.com/kokes/smda/src/rawchunk"
 )
 
 //go:embed assets
@@ -46,52 +55,1004 @@ func handleStatus(db *database.Database) http.HandlerFunc {
 	}
 }
 
+// HTTP statuses of our error categories, uncategorised errors are internal (see errs.Category)
+var categoryStatuses = map[error]int{
+	errs.ErrBadRequest:        http.StatusBadRequest,
+	errs.ErrNotFound:          http.StatusNotFound,
+	errs.ErrResourceExhausted: http.StatusTooManyRequests,
+	errs.ErrTimeout:           http.StatusGatewayTimeout,
+	errs.ErrInternal:          http.StatusInternalServerError,
+}
+
+// apiError is the body of all failed API requests, its code is machine readable, so that clients
+// don't need to parse our messages (e.g. `not_found` or `method_not_allowed`)
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	// how far along a query got before it timed out
+	Timeout *query.TimeoutError `json:"timeout,omitempty"`
+}
+
+// failure describes an error returned by our packages (see writeFailure)
+func failure(message string, err error) apiError {
+	if message != "" {
+		err = fmt.Errorf("%v: %w", message, err)
+	}
+	ae := apiError{Code: errs.Code(err), Message: err.Error()}
+	errors.As(err, &ae.Timeout)
+	return ae
+}
+
+// errorCode returns our error code of a given HTTP status (e.g. 404 -> `not_found`)
+func errorCode(status int) string {
+	for category, cstatus := range categoryStatuses {
+		if cstatus == status {
+			return errs.Code(category)
+		}
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// writeError is like http.Error, but it reports the error as an apiError
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeAPIError(w, apiError{Code: errorCode(status), Message: message}, status)
+}
+
+func writeAPIError(w http.ResponseWriter, ae apiError, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(ae); err != nil {
+		panic(err)
+	}
+}
+
+// writeFailure reports an error returned by our packages, its category determines whether it's
+// the client's fault (e.g. an invalid query or a missing dataset) or ours
+func writeFailure(w http.ResponseWriter, message string, err error) {
+	writeAPIError(w, failure(message, err), categoryStatuses[errs.Category(err)])
+}
+
+// handleDatasets lists all datasets, `?namespace=foo` only lists those in a given namespace
 func handleDatasets(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		// might be a bottleneck to indent it, but what the heck at this point
-		// this is quite dangerous as there may be new fields that get automatically marshalled here
-		if err := json.NewEncoder(w).Encode(db.Datasets); err != nil {
+		if err := db.LoadManifests(); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		datasets := db.Datasets
+		if ns, ok := r.URL.Query()["namespace"]; ok {
+			datasets = make([]*database.Dataset, 0)
+			for _, ds := range db.Datasets {
+				if ds.Namespace == ns[0] {
+					datasets = append(datasets, ds)
+				}
+			}
+		}
+		// might be a bottleneck to indent it, but what the heck at this point
+		// this is quite dangerous as there may be new fields that get automatically marshalled here
+		if err := json.NewEncoder(w).Encode(datasets); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleDiskUsage reports storage taken up by each dataset version and its columns (see database.DiskUsage)
+func handleDiskUsage(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for /api/usage", http.StatusMethodNotAllowed)
+			return
+		}
+		usage, err := db.DiskUsage()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(usage); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleDataset drops datasets, either all versions (`DELETE /api/datasets/foo`) or just
+// a given one (`DELETE /api/datasets/foo@v<version>`), namespaced datasets are referred to
+// by their qualified names (`DELETE /api/datasets/sales.orders`)
+// Schemas get edited via `/api/datasets/foo/schema` (see handleSchemaEdit) and their types inferred
+// anew via `/api/datasets/foo/infer` (see handleInference), datasets get
+// exported via `/api/datasets/foo/export` (see handleExport) and previewed via
+// `/api/datasets/foo/preview` (see handlePreview)
+func handleDataset(db *database.Database) http.HandlerFunc {
+	editSchema := handleSchemaEdit(db)
+	infer := handleInference(db)
+	compact := handleCompact(db)
+	export := handleExport(db)
+	preview := handlePreview(db)
+	insert := handleInsert(db)
+	chunks := handleStripeChunk(db)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// column names are arbitrary, so they could clash with the suffixes below
+		if strings.Contains(r.URL.Path, "/stripes/") {
+			chunks(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/rows") {
+			insert(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/preview") {
+			preview(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/export") {
+			export(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/schema") {
+			editSchema(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/infer") {
+			infer(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/compact") {
+			compact(w, r)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			writeError(w, "only DELETE requests allowed for /api/datasets/", http.StatusMethodNotAllowed)
+			return
+		}
+		name, version, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "@v")
+		if name == "" {
+			writeError(w, "need to specify a dataset to drop", http.StatusBadRequest)
+			return
+		}
+		if _, err := db.GetDataset(name, version, version == ""); err != nil {
+			writeFailure(w, "cannot drop dataset", err)
+			return
+		}
+		if err := db.DropDataset(name, version); err != nil {
+			writeFailure(w, "failed to drop dataset", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAliases lists all dataset aliases (GET) or it creates (or repoints) one (POST), e.g.
+// `{"name": "orders", "dataset": "sales.orders", "version": "<version>"}`, aliases without a
+// version follow the latest version of their dataset (see database.Alias)
+func handleAliases(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var alias database.Alias
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+				writeError(w, fmt.Sprintf("invalid alias: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := db.SetAlias(alias); err != nil {
+				writeFailure(w, "failed to set alias", err)
+				return
+			}
+		default:
+			writeError(w, "only GET and POST requests allowed for /api/aliases", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(db.Aliases()); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleAlias removes an alias (`DELETE /api/aliases/orders`), not the dataset it points to
+func handleAlias(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, "only DELETE requests allowed for /api/aliases/", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := db.RemoveAlias(strings.TrimPrefix(r.URL.Path, "/api/aliases/")); err != nil {
+			writeFailure(w, "failed to remove alias", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleSchemaEdit renames or retypes columns of a dataset (its latest version or a given one, e.g.
+// `POST /api/datasets/foo@v<version>/schema`), the body is a list of edits, e.g.
+// `[{"column": "zip", "dtype": "string"}, {"column": "foo", "rename": "bar"}]`, and it results
+// in a new version of the dataset (see database.EditSchema)
+func handleSchemaEdit(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for schema edits", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/schema")
+		name, version, _ := strings.Cut(path, "@v")
+		if name == "" {
+			writeError(w, "need to specify a dataset to edit", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDataset(name, version, version == "")
+		if err != nil {
+			writeFailure(w, "cannot edit schema", err)
+			return
+		}
+		var edits []database.SchemaEdit
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&edits); err != nil {
+			writeError(w, fmt.Sprintf("invalid schema edits: %v", err), http.StatusBadRequest)
+			return
+		}
+		edited, err := db.EditSchema(ds, edits)
+		if err != nil {
+			writeFailure(w, "failed to edit schema", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(edited); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleInference infers types of some columns of a dataset anew, tolerating a few values of other
+// types, e.g. `GET /api/datasets/foo/infer?columns=price,zip` (see database.InferColumnTypes), it
+// lists the inferred types and values that don't conform to them. Nothing gets changed, an inferred
+// type can be applied via `/api/datasets/foo/schema`, e.g. `[{"column": "price", "dtype": "int",
+// "null_invalid": true}]`, so that these values become nulls.
+func handleInference(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for type inference", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/infer")
+		name, version, _ := strings.Cut(path, "@v")
+		if name == "" {
+			writeError(w, "need to specify a dataset to infer types of", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDataset(name, version, version == "")
+		if err != nil {
+			writeFailure(w, "cannot infer types", err)
+			return
+		}
+		var columns []string
+		for _, col := range strings.Split(r.URL.Query().Get("columns"), ",") {
+			if col = strings.TrimSpace(col); col != "" {
+				columns = append(columns, col)
+			}
+		}
+		inferences, err := db.InferColumnTypes(ds, columns)
+		if err != nil {
+			writeFailure(w, "failed to infer types", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(inferences); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleCompact rewrites a dataset (its latest version or a given one, e.g.
+// `POST /api/datasets/foo@v<version>/compact`) into stripes of a target size, resulting in a new
+// version of the dataset (see database.Compact). The body is optional, it may override the target
+// size, e.g. `{"max_rows": 1000000, "max_bytes": 50000000}`
+func handleCompact(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for compaction", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/compact")
+		name, version, _ := strings.Cut(path, "@v")
+		if name == "" {
+			writeError(w, "need to specify a dataset to compact", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDataset(name, version, version == "")
+		if err != nil {
+			writeFailure(w, "cannot compact dataset", err)
+			return
+		}
+		var opts database.CompactOptions
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			writeError(w, fmt.Sprintf("invalid compaction options: %v", err), http.StatusBadRequest)
+			return
+		}
+		if opts.MaxRows < 0 || opts.MaxBytes < 0 {
+			writeError(w, "invalid compaction options: stripe sizes cannot be negative", http.StatusBadRequest)
+			return
+		}
+		compacted, err := db.Compact(ds, opts)
+		if err != nil {
+			writeFailure(w, "failed to compact dataset", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(compacted); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleInsert buffers rows to be added to the latest version of a dataset, e.g.
+// `POST /api/datasets/foo/rows` with `[[1, "foo", null], [2, "bar", true]]` (see database.InsertRows).
+// Buffered rows get written periodically, `?flush=true` writes them right away and responds with
+// the resulting version of the dataset.
+func handleInsert(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for inserts", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/rows")
+		if name == "" {
+			writeError(w, "need to specify a dataset to insert into", http.StatusBadRequest)
+			return
+		}
+		var values [][]interface{}
+		defer r.Body.Close()
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber() // so that large ints don't get mangled by floats
+		if err := dec.Decode(&values); err != nil {
+			writeError(w, fmt.Sprintf("invalid rows: %v", err), http.StatusBadRequest)
+			return
+		}
+		rows := make([][]string, len(values))
+		for j, row := range values {
+			rows[j] = make([]string, len(row))
+			for k, val := range row {
+				text, err := jsonValueText(val)
+				if err != nil {
+					writeError(w, fmt.Sprintf("invalid rows: %v", err), http.StatusBadRequest)
+					return
+				}
+				rows[j][k] = text
+			}
+		}
+		buffered, err := db.InsertRows(name, rows)
+		if err != nil {
+			writeFailure(w, "failed to insert rows", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("flush") != "true" {
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(map[string]int{"buffered": buffered}); err != nil {
+				panic(err)
+			}
+			return
+		}
+		// rows may have been flushed by the insert itself (or by a periodic flush)
+		ds, err := db.FlushInserts(name)
+		if err == nil && ds == nil {
+			ds, err = db.GetDatasetLatest(name)
+		}
+		if err != nil {
+			writeFailure(w, "failed to flush inserted rows", err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(ds); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// jsonValueText converts a JSON value into its textual form, the way it would appear in a CSV
+// (nulls are empty, nested values stay JSON)
+func jsonValueText(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(raw), nil
+	}
+}
+
+// handleExport downloads a bundle of a dataset (its latest version or a given one, e.g.
+// `GET /api/datasets/foo@v<version>/export`), which can be imported into another database
+// via `/upload/bundle` (see database.ExportDataset)
+func handleExport(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for exports", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/export")
+		name, version, _ := strings.Cut(path, "@v")
+		if name == "" {
+			writeError(w, "need to specify a dataset to export", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDataset(name, version, version == "")
+		if err != nil {
+			writeFailure(w, "cannot export dataset", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v@v%v.tar\"", ds.QualifiedName(), ds.ID))
+		// ARCH: the response has already started by the time stripes are read, so failures (e.g.
+		// missing stripes) only result in a truncated bundle, which fails to import
+		if _, err := io.Copy(w, db.ExportDataset(ds)); err != nil {
+			log.Printf("failed to export dataset %v@v%v: %v", ds.QualifiedName(), ds.ID, err)
+		}
+	}
+}
+
+// handleStripeChunk serves a single column of a single stripe of a dataset (its latest version or
+// a given one), e.g. `GET /api/datasets/foo@v<version>/stripes/<stripe>/bar`, in a binary format
+// that external tools can read without smda's query engine (see the rawchunk package)
+func handleStripeChunk(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for stripe chunks", http.StatusMethodNotAllowed)
+			return
+		}
+		path, location, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/stripes/")
+		name, version, _ := strings.Cut(path, "@v")
+		stripeID, colName, _ := strings.Cut(location, "/")
+		if name == "" || stripeID == "" || colName == "" {
+			writeError(w, "need to specify a dataset, a stripe and a column", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDataset(name, version, version == "")
+		if err != nil {
+			writeFailure(w, "cannot read stripe", err)
+			return
+		}
+		stripe, err := ds.Stripe(stripeID)
+		if err != nil {
+			writeFailure(w, "cannot read stripe", err)
+			return
+		}
+		cols, _, err := db.ReadColumnsFromStripeByNames(ds, stripe, []string{colName})
+		if err != nil {
+			writeFailure(w, "failed to read stripe", err)
+			return
+		}
+		chunk := cols[colName]
+		// constant chunks may be read as literals, these cannot be serialised
+		if chunk.IsLiteral {
+			chunk = chunk.Reorder(make([]int, chunk.Len()))
+		}
+		// chunks are serialised upfront, so that failures can still be reported properly
+		var buf bytes.Buffer
+		if err := rawchunk.WriteHeader(&buf, chunk.Dtype().String()); err != nil {
+			writeFailure(w, "failed to serialise chunk", err)
+			return
+		}
+		if _, err := chunk.WriteTo(&buf); err != nil {
+			writeFailure(w, "failed to serialise chunk", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		if _, err := buf.WriteTo(w); err != nil {
+			log.Printf("failed to write chunk of %v@v%v: %v", ds.QualifiedName(), ds.ID, err)
+		}
+	}
+}
+
+// handlePreview serves a preview of a dataset (its latest version or a given one, e.g.
+// `GET /api/datasets/foo@v<version>/preview`), see database.Preview
+func handlePreview(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for previews", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/datasets/"), "/preview")
+		name, version, _ := strings.Cut(path, "@v")
+		if name == "" {
+			writeError(w, "need to specify a dataset to preview", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDataset(name, version, version == "")
+		if err != nil {
+			writeFailure(w, "cannot preview dataset", err)
+			return
+		}
+		preview, err := db.Preview(ds)
+		if err != nil {
+			writeFailure(w, "failed to preview dataset", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(preview); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleBundleUpload imports a dataset bundle, as exported by handleExport, the dataset retains
+// its name, namespace and version
+func handleBundleUpload(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/bundle", http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+		ds, err := db.ImportDataset(r.Body)
+		if err != nil {
+			writeFailure(w, "failed to import bundle", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ds); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleMultipartInit starts a multipart upload, its parts are then uploaded one by one
+// (see handleMultipartUpload), this is how large files can be uploaded reliably
+func handleMultipartInit(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/multipart", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := db.InitMultipartUpload()
+		if err != nil {
+			writeFailure(w, "failed to start an upload", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		ret := struct {
+			ID  database.UID `json:"id"`
+			URL string       `json:"url"`
+		}{id, "/upload/multipart/" + id.String()}
+		if err := json.NewEncoder(w).Encode(ret); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleMultipartUpload manages an existing multipart upload:
+//   - PUT /upload/multipart/{id}/{part} uploads a part (numbered from 1), it can be retried
+//   - GET /upload/multipart/{id} lists parts received so far (e.g. to resume an upload)
+//   - POST /upload/multipart/{id} stitches all the parts and loads them as a dataset, it accepts
+//     the same parameters as /upload/auto
+//   - DELETE /upload/multipart/{id} aborts the upload
+func handleMultipartUpload(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/multipart/"), "/")
+		id, err := database.UIDFromHex([]byte(path[0]))
+		if err != nil || id.Otype != database.OtypeUpload || len(path) > 2 {
+			writeError(w, "invalid upload ID", http.StatusBadRequest)
+			return
+		}
+		parts, err := db.UploadParts(id)
+		if err != nil {
+			writeFailure(w, "cannot access upload", err)
+			return
+		}
+		if len(path) == 2 {
+			if r.Method != http.MethodPut {
+				writeError(w, "only PUT requests allowed for upload parts", http.StatusMethodNotAllowed)
+				return
+			}
+			part, err := strconv.Atoi(path[1])
+			if err != nil || part < 1 {
+				writeError(w, fmt.Sprintf("invalid part number: %v", path[1]), http.StatusBadRequest)
+				return
+			}
+			size, err := db.WriteUploadPart(id, part, r.Body)
+			defer r.Body.Close()
+			if err != nil {
+				writeFailure(w, "failed to upload part", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(database.UploadPart{Number: part, Size: size}); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(parts); err != nil {
+				panic(err)
+			}
+		case http.MethodPost:
+			opts, err := loadOptionsFromQuery(r.URL.Query())
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ds, err := db.CompleteMultipartUpload(r.URL.Query().Get("name"), id, opts)
+			if err != nil {
+				writeFailure(w, "failed to load uploaded data", err)
+				return
+			}
+			if err := db.AddDataset(ds); err != nil {
+				writeFailure(w, "could not write dataset to database", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(ds); err != nil {
+				panic(err)
+			}
+		case http.MethodDelete:
+			if err := db.AbortMultipartUpload(id); err != nil {
+				writeFailure(w, "failed to abort upload", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, "unsupported method for /upload/multipart", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// TODO(next)/ARCH: reorg this, move to query.go maybe?
+type queryPayload struct {
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params"`
+	// e.g. `{"timezone": "Europe/Prague"}`
+	query.Settings
+	// if set, only this many rows are returned, along with a cursor for the next page (see query.Cursors)
+	PageSize int `json:"page_size"`
+	// pages past the first one are requested using just a cursor (and optionally a page size)
+	Cursor string `json:"cursor"`
+}
+
+// recordQuery adds a finished query to our query history, failure to persist the history
+// shouldn't fail the query itself, so we only log it
+func recordQuery(history *query.History, r *http.Request, sql string, started time.Time, res *query.Result, err error) {
+	// ARCH: behind a proxy, this is the proxy's address (we don't trust X-Forwarded-For)
+	clientIP, _, serr := net.SplitHostPort(r.RemoteAddr)
+	if serr != nil {
+		clientIP = r.RemoteAddr
+	}
+	if err := history.Record(query.NewQueryRecord(sql, clientIP, started, res, err)); err != nil {
+		log.Printf("failed to persist query history: %v", err)
+	}
+}
+
+func handleQuery(db *database.Database, cache *query.Cache, cursors *query.Cursors, history *query.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /api/query", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var inc queryPayload
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		dec.UseNumber() // so that integer parameters don't get turned into floats
+		if err := dec.Decode(&inc); err != nil {
+			writeError(w, fmt.Sprintf("did not supply correct query parameters: %v", err), http.StatusBadRequest)
+			return
+		}
+		// NewDecoder(r).Decode() can lead to bugs: https://github.com/golang/go/issues/36225
+		if dec.More() {
+			writeError(w, "body can only contain a single JSON object", http.StatusBadRequest)
+			return
+		}
+		if inc.PageSize < 0 {
+			writeError(w, fmt.Sprintf("invalid page size: %v", inc.PageSize), http.StatusBadRequest)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		// profiles can be downloaded as files to be opened in speedscope (or other flamegraph viewers)
+		if format == "speedscope" {
+			if inc.Cursor != "" {
+				writeError(w, "cannot profile pages of results", http.StatusBadRequest)
+				return
+			}
+			inc.Settings.Profile = true
+		}
+		var (
+			res    *query.Result
+			cursor string
+			err    error
+		)
+		if inc.Cursor != "" {
+			if inc.SQL != "" {
+				writeError(w, "cannot supply both a query and a cursor", http.StatusBadRequest)
+				return
+			}
+			res, cursor, err = cursors.NextPage(inc.Cursor, inc.PageSize)
+			if err != nil {
+				writeFailure(w, "cannot page through results", err)
+				return
+			}
+		} else {
+			started := time.Now()
+			res, err = cache.RunSQLWithSettings(r.Context(), db, inc.SQL, inc.Settings, inc.Params...)
+			recordQuery(history, r, inc.SQL, started, res, err)
+			if err != nil {
+				writeFailure(w, "failed this query", err)
+				return
+			}
+			if inc.PageSize > 0 {
+				res, cursor, err = cursors.FirstPage(res, inc.PageSize)
+				if err != nil {
+					writeFailure(w, "cannot page through results", err)
+					return
+				}
+			}
+		}
+		if format != "" && format != "json" {
+			writeFormattedResult(w, res, format, cursor)
+			return
+		}
+		resp, err := json.Marshal(res)
+		if err != nil {
+			writeError(w, fmt.Sprintf("failed to serialise query results: %v", err), http.StatusInternalServerError)
+		}
+		w.Write(resp)
+	}
+}
+
+// at most this many statements can be submitted in a single batch
+const maxBatchStatements = 100
+
+type batchPayload struct {
+	Statements  []query.Statement `json:"statements"`
+	StopOnError bool              `json:"stop_on_error"`
+	// settings of the first statement, SET statements can change them for those that follow
+	query.Settings
+}
+
+// handleQueryBatch runs a batch of statements (see query.Cache.RunBatch), each statement gets its
+// result or error reported, so statements failing doesn't fail the request itself
+func handleQueryBatch(db *database.Database, cache *query.Cache, history *query.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /api/query/batch", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var inc batchPayload
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		dec.UseNumber()
+		if err := dec.Decode(&inc); err != nil {
+			writeError(w, fmt.Sprintf("did not supply correct query parameters: %v", err), http.StatusBadRequest)
+			return
+		}
+		if dec.More() {
+			writeError(w, "body can only contain a single JSON object", http.StatusBadRequest)
+			return
+		}
+		if len(inc.Statements) == 0 || len(inc.Statements) > maxBatchStatements {
+			writeError(w, fmt.Sprintf("a batch needs to have between 1 and %v statements, got %v", maxBatchStatements, len(inc.Statements)), http.StatusBadRequest)
+			return
+		}
+
+		started := time.Now()
+		results := cache.RunBatch(r.Context(), db, inc.Statements, inc.Settings, inc.StopOnError, func(stmt query.Statement, started time.Time, res *query.Result, err error) {
+			recordQuery(history, r, stmt.SQL, started, res, err)
+		})
+		resp, err := json.Marshal(struct {
+			Statements []query.StatementResult `json:"statements"`
+			DurationMs float64                 `json:"duration_ms"`
+		}{results, float64(time.Since(started).Microseconds()) / 1000})
+		if err != nil {
+			writeError(w, fmt.Sprintf("failed to serialise query results: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}
+}
+
+// writeFormattedResult serialises query results in a non-JSON format - an Arrow stream (`arrow`),
+// which is handy for clients that work with data frames, or a file to be downloaded (`csv`, `parquet`,
+// or `speedscope` for a query's profile instead of its data)
+func writeFormattedResult(w http.ResponseWriter, res *query.Result, format string, cursor string) {
+	var write func(io.Writer) error
+	var contentType, filename string
+	switch format {
+	case "arrow":
+		write, contentType = res.WriteArrow, "application/vnd.apache.arrow.stream"
+	case "csv":
+		write, contentType, filename = res.WriteCSV, "text/csv; charset=utf-8", "results.csv"
+	case "parquet":
+		write, contentType, filename = res.WriteParquet, "application/vnd.apache.parquet", "results.parquet"
+	case "speedscope":
+		write, contentType, filename = res.WriteProfile, "application/json", "query.speedscope.json"
+	default:
+		writeError(w, fmt.Sprintf("unsupported format: %v", format), http.StatusBadRequest)
+		return
+	}
+	// ARCH: we buffer the whole response, so that we can still report errors properly
+	buf := new(bytes.Buffer)
+	if err := write(buf); err != nil {
+		writeError(w, fmt.Sprintf("failed to serialise query results: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if filename != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	}
+	// none of these formats have a place for our cursors, so they go in a header
+	if cursor != "" {
+		w.Header().Set("X-Cursor", cursor)
+	}
+	w.Write(buf.Bytes())
+}
+
+// writeEvent writes a single server-sent event, its payload needs to fit on a single line
+func writeEvent(w http.ResponseWriter, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	w.(http.Flusher).Flush()
+}
+
+// handleQueryProgress runs queries just like handleQuery, but it streams server-sent events - a `progress`
+// event after each stripe is read, followed by either a `result` or an `error` event (we can no longer
+// report errors using status codes once we start streaming)
+func handleQueryProgress(db *database.Database, cache *query.Cache, history *query.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /api/query/progress", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := w.(http.Flusher); !ok {
+			writeError(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		var inc queryPayload
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		dec.UseNumber()
+		if err := dec.Decode(&inc); err != nil {
+			writeError(w, fmt.Sprintf("did not supply correct query parameters: %v", err), http.StatusBadRequest)
+			return
+		}
+		if dec.More() {
+			writeError(w, "body can only contain a single JSON object", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ctx := query.WithProgress(r.Context(), func(progress query.Progress) {
+			data, err := json.Marshal(progress)
+			if err != nil {
+				panic(err)
+			}
+			writeEvent(w, "progress", data)
+		})
+		started := time.Now()
+		res, err := cache.RunSQLWithSettings(ctx, db, inc.SQL, inc.Settings, inc.Params...)
+		recordQuery(history, r, inc.SQL, started, res, err)
+		if err != nil {
+			msg, _ := json.Marshal(failure("failed this query", err))
+			writeEvent(w, "error", msg)
+			return
+		}
+		resp, err := json.Marshal(res)
+		if err != nil {
+			msg, _ := json.Marshal(apiError{Code: errs.Code(errs.ErrInternal), Message: fmt.Sprintf("failed to serialise query results: %v", err)})
+			writeEvent(w, "error", msg)
+			return
+		}
+		// our results contain newlines, which are not allowed in event data
+		buf := new(bytes.Buffer)
+		if err := json.Compact(buf, resp); err != nil {
 			panic(err)
 		}
+		writeEvent(w, "result", buf.Bytes())
 	}
 }
 
-// TODO(next)/ARCH: reorg this, move to query.go maybe?
-type queryPayload struct {
-	SQL string `json:"sql"`
+// handleQueryCache reports query cache statistics (hits, misses etc.)
+func handleQueryCache(cache *query.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cache.Stats()); err != nil {
+			panic(err)
+		}
+	}
 }
 
-func handleQuery(db *database.Database) http.HandlerFunc {
+// handleRecentQueries lists the most recent queries (up to `limit`, the newest first), these are
+// kept in memory, the full history can be queried in smda.queries
+func handleRecentQueries(history *query.History) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for /queries/recent", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 0
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			var err error
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 0 {
+				writeError(w, fmt.Sprintf("invalid limit: %v", raw), http.StatusBadRequest)
+				return
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(history.Recent(limit)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type materializePayload struct {
+	Name string `json:"name"`
+	SQL  string `json:"sql"`
+}
+
+// handleQueryMaterialize runs a query and stores its results as a new dataset (akin to CREATE TABLE AS)
+func handleQueryMaterialize(db *database.Database, history *query.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "only POST requests allowed for /api/query", http.StatusMethodNotAllowed)
+			writeError(w, "only POST requests allowed for /api/query/materialize", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var inc queryPayload
+		var inc materializePayload
 		dec := json.NewDecoder(r.Body)
 		dec.DisallowUnknownFields()
 		if err := dec.Decode(&inc); err != nil {
-			http.Error(w, fmt.Sprintf("did not supply correct query parameters: %v", err), http.StatusBadRequest)
+			writeError(w, fmt.Sprintf("did not supply correct query parameters: %v", err), http.StatusBadRequest)
 			return
 		}
 		// NewDecoder(r).Decode() can lead to bugs: https://github.com/golang/go/issues/36225
 		if dec.More() {
-			http.Error(w, "body can only contain a single JSON object", http.StatusBadRequest)
+			writeError(w, "body can only contain a single JSON object", http.StatusBadRequest)
 			return
 		}
-		res, err := query.RunSQL(db, inc.SQL)
+		started := time.Now()
+		res, err := query.RunSQL(r.Context(), db, inc.SQL)
+		recordQuery(history, r, inc.SQL, started, res, err)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed this query: %v", err), http.StatusInternalServerError)
+			writeFailure(w, "failed this query", err)
 			return
 		}
-		resp, err := json.Marshal(res)
+		res.Materialise()
+		// TODO(namespaces): allow for results to be stored in a namespace
+		ds, err := db.StoreResult(inc.Name, res.Schema, res.Data)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to serialise query results: %v", err), http.StatusInternalServerError)
+			writeFailure(w, "could not store query results", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ds); err != nil {
+			panic(err)
 		}
-		w.Write(resp)
 	}
 }
 
@@ -99,44 +1060,108 @@ func handleUpload(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodPost {
-			http.Error(w, "only POST requests allowed for /upload/raw", http.StatusMethodNotAllowed)
+			writeError(w, "only POST requests allowed for /upload/raw", http.StatusMethodNotAllowed)
 			return
 		}
 		// there are two reasons we don't operate on r.Body directly:
 		// 1) we don't want to block the body read by our parser - we want to save the incoming
 		// data as quickly as possible
 		// 2) we want to have a local copy if we need to reprocess it
+		// in-memory databases have nowhere to cache raw files
+		if db.Config.WorkingDirectory == "" {
+			writeError(w, "raw uploads are not supported by in-memory databases", http.StatusBadRequest)
+			return
+		}
 		name := r.URL.Query().Get("name")
-		ds := database.NewDataset(name)
+		ds := database.NewDatasetInNamespace(r.URL.Query().Get("namespace"), name)
 
 		if err := database.CacheIncomingFile(r.Body, db.DatasetPath(ds)); err != nil {
-			http.Error(w, "could not upload file", http.StatusInternalServerError)
+			writeError(w, "could not upload file", http.StatusInternalServerError)
 			return
 		}
 		defer r.Body.Close()
 
 		if err := json.NewEncoder(w).Encode(ds); err != nil {
-			http.Error(w, fmt.Sprintf("failed to cache data: %v", err), http.StatusInternalServerError)
+			writeError(w, fmt.Sprintf("failed to cache data: %v", err), http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
+// loadOptionsFromQuery reads loading options from URL parameters - `namespace`, `floats=preserve`
+// (keeps NaNs and infinities instead of loading them as nulls) and CSV dialect overrides,
+// i.e. `delimiter` (e.g. `semicolon` or `|`), `quote` (a character or `none`), `has_header`
+// and `null` (can be repeated, e.g. `null=NA&null=\N`). Numbers can be formatted according to
+// a locale, `decimal=,&thousands=.` loads e.g. `1.234,56`. Inferred types can be overridden by
+// `schema`, a JSON document of column hints (e.g. `{"id": "string", "price": {"nullable": true}}`),
+// which also declare formats of dates we don't detect (e.g. `{"born": {"format": "DD/MM/YYYY"}}`)
+func loadOptionsFromQuery(query url.Values) (database.LoadOptions, error) {
+	opts := database.LoadOptions{
+		Namespace:  query.Get("namespace"),
+		Delimiter:  query.Get("delimiter"),
+		Quote:      query.Get("quote"),
+		NullTokens: query["null"],
+		Decimal:    query.Get("decimal"),
+		Thousands:  query.Get("thousands"),
+		SortKey:    query["sort_key"],
+	}
+	if query.Get("floats") == "preserve" {
+		opts.Floats = column.FloatSpecialsPreserved
+	}
+	if hh := query.Get("has_header"); hh != "" {
+		hasHeader, err := strconv.ParseBool(hh)
+		if err != nil {
+			return opts, fmt.Errorf("invalid has_header value: %v", hh)
+		}
+		opts.NoHeader = !hasHeader
+	}
+	if hints := query.Get("schema"); hints != "" {
+		if err := json.Unmarshal([]byte(hints), &opts.SchemaHints); err != nil {
+			return opts, fmt.Errorf("invalid schema hints: %v", err)
+		}
+	}
+	return opts, nil
+}
+
 // this will load the data, but also infer the schema and automatically load it with it
-// the part with `loadDatasetFromLocalFileAuto` is potentially slow - do we want to make this asynchronous?
-//   that is - we load the raw data and return a jobID - and let the requester ping the server backend for status
+// the part with `loadDatasetFromLocalFileAuto` is potentially slow, so clients can opt for it
+// to happen asynchronously (`?async=true`) - we then only cache the raw data and return a job,
+// which can be polled via /jobs/{id}
 func handleAutoUpload(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "only POST requests allowed for /upload/auto", http.StatusMethodNotAllowed)
+			writeError(w, "only POST requests allowed for /upload/auto", http.StatusMethodNotAllowed)
 			return
 		}
 
 		name := r.URL.Query().Get("name")
-		ds, err := db.LoadDatasetFromReaderAuto(name, r.Body)
+		opts, err := loadOptionsFromQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var tx *database.Transaction
+		if txid := r.URL.Query().Get("transaction"); txid != "" {
+			tx, err = getTransaction(db, txid)
+			if err != nil {
+				writeFailure(w, "", err)
+				return
+			}
+		}
+		if r.URL.Query().Get("async") == "true" {
+			if tx != nil {
+				writeError(w, "asynchronous loads cannot be part of a transaction", http.StatusBadRequest)
+				return
+			}
+			job, err := db.SubmitLoad(name, r.Body, opts)
+			defer r.Body.Close()
+			writeJob(w, job, err)
+			return
+		}
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions(name, r.Body, opts)
 		defer r.Body.Close()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to parse a given file: %v", err), http.StatusInternalServerError)
+			writeFailure(w, "failed to parse a given file", err)
 			return
 		}
 		clength, err := strconv.Atoi(r.Header.Get("Content-Length"))
@@ -146,8 +1171,279 @@ func handleAutoUpload(db *database.Database) http.HandlerFunc {
 		// ARCH: maybe do this in loader.go, will then work for all entrypoints (and for compressed data as well)
 		ds.SizeRaw = int64(clength)
 
+		if tx != nil {
+			// only becomes visible once the transaction gets committed
+			if err := tx.Add(ds); err != nil {
+				writeFailure(w, "could not add dataset to transaction", err)
+				return
+			}
+		} else if err := db.AddDataset(ds); err != nil {
+			writeFailure(w, "could not write dataset to database", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ds); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// previews read at most this many megabytes of data, clients can ask for less via `?max_mb=`
+const maxPreviewMegabytes = 64
+
+// handleLoadPreview infers what uploading a file to /upload/auto would result in - its dialect,
+// schema, null tokens it may need and rows that would fail to load (see database.LoadPreview) - so
+// that these can be fixed (via the same URL parameters) before the file gets uploaded. Only the
+// beginning of the file is needed, nothing gets stored.
+func handleLoadPreview(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/infer-schema", http.StatusMethodNotAllowed)
+			return
+		}
+		opts, err := loadOptionsFromQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		maxMegabytes := maxPreviewMegabytes
+		if mmb := r.URL.Query().Get("max_mb"); mmb != "" {
+			maxMegabytes, err = strconv.Atoi(mmb)
+			if err != nil || maxMegabytes < 1 || maxMegabytes > maxPreviewMegabytes {
+				writeError(w, fmt.Sprintf("max_mb needs to be between 1 and %v", maxPreviewMegabytes), http.StatusBadRequest)
+				return
+			}
+		}
+		defer r.Body.Close()
+		preview, err := db.PreviewLoad(r.Body, maxMegabytes<<20, opts)
+		if err != nil {
+			writeFailure(w, "failed to infer schema", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(preview); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleAppendUpload loads data into an existing dataset (its latest version), creating a new version
+// (in the same namespace as the original), this can happen asynchronously, just like in handleAutoUpload
+func handleAppendUpload(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/append", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/upload/append/")
+		if name == "" {
+			writeError(w, "need to specify a dataset to append to", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.GetDatasetLatest(name)
+		if err != nil {
+			writeFailure(w, "cannot append data", err)
+			return
+		}
+
+		// `?widen=true` allows for column types to be widened (e.g. ints to floats) if need be
+		policy := database.WideningNone
+		if r.URL.Query().Get("widen") == "true" {
+			policy = database.WideningAllowed
+		}
+		// appended data can have their own dialect and schema hints, see handleAutoUpload
+		opts, err := loadOptionsFromQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("async") == "true" {
+			job, err := db.SubmitAppend(ds, r.Body, policy, opts)
+			defer r.Body.Close()
+			writeJob(w, job, err)
+			return
+		}
+		appended, err := db.AppendToDatasetWithOptions(ds, r.Body, policy, opts)
+		defer r.Body.Close()
+		if err != nil {
+			writeFailure(w, "failed to append a given file", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(appended); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// writeJob reports a newly submitted ingestion job
+func writeJob(w http.ResponseWriter, job database.Job, err error) {
+	if err != nil {
+		writeFailure(w, "failed to cache incoming data", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		panic(err)
+	}
+}
+
+// getTransaction looks up an open transaction by its ID as passed in requests (in paths or as
+// `?transaction=`), malformed IDs are the client's fault
+func getTransaction(db *database.Database, txid string) (*database.Transaction, error) {
+	id, err := database.UIDFromHex([]byte(txid))
+	if err != nil || id.Otype != database.OtypeTransaction {
+		return nil, fmt.Errorf("%w: invalid transaction ID: %v", errs.ErrBadRequest, txid)
+	}
+	return db.GetTransaction(id)
+}
+
+// handleTransactions opens new transactions (POST), datasets get staged in them by passing their
+// IDs to /upload/auto (as `transaction`), see handleTransaction for committing them
+func handleTransactions(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /api/transactions", http.StatusMethodNotAllowed)
+			return
+		}
+		tx := db.Begin()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tx); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleTransaction manages an open transaction:
+//   - GET /api/transactions/{id} lists datasets staged so far
+//   - POST /api/transactions/{id}/commit makes all of them visible at once
+//   - DELETE /api/transactions/{id} rolls the transaction back, discarding all staged data
+func handleTransaction(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/transactions/"), "/")
+		if len(path) > 2 || (len(path) == 2 && path[1] != "commit") {
+			writeError(w, "unknown transaction endpoint", http.StatusNotFound)
+			return
+		}
+		tx, err := getTransaction(db, path[0])
+		if err != nil {
+			writeFailure(w, "", err)
+			return
+		}
+		if len(path) == 2 {
+			if r.Method != http.MethodPost {
+				writeError(w, "only POST requests allowed for commits", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				writeFailure(w, "failed to commit transaction", err)
+				return
+			}
+		} else {
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodDelete:
+				if err := tx.Rollback(); err != nil {
+					writeFailure(w, "failed to roll back transaction", err)
+					return
+				}
+			default:
+				writeError(w, "only GET and DELETE requests allowed for transactions", http.StatusMethodNotAllowed)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tx); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleJob reports the state of an ingestion job (see handleAutoUpload), clients are expected
+// to poll this until the job is either finished or failed
+func handleJob(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET requests allowed for /jobs", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := database.UIDFromHex([]byte(strings.TrimPrefix(r.URL.Path, "/jobs/")))
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid job id: %v", err), http.StatusBadRequest)
+			return
+		}
+		job, err := db.GetJob(id)
+		if err != nil {
+			writeFailure(w, "", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handlePresignedUpload returns a pre-signed URL the client can upload data to directly (bypassing
+// our server), along with a callback to be POSTed once the upload completes
+func handlePresignedUpload(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/presigned", http.StatusMethodNotAllowed)
+			return
+		}
+		if db.Config.UploadBucket == "" {
+			writeError(w, "pre-signed uploads are not configured", http.StatusNotImplemented)
+			return
+		}
+		upload, err := db.PresignUpload(r.Context())
+		if err != nil {
+			writeFailure(w, "failed to pre-sign an upload", err)
+			return
+		}
+		callback := url.URL{Path: "/upload/presigned/" + upload.ID.String()}
+		if name := r.URL.Query().Get("name"); name != "" {
+			callback.RawQuery = url.Values{"name": []string{name}}.Encode()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		ret := struct {
+			*database.PresignedUpload
+			Callback string `json:"callback"`
+		}{upload, callback.String()}
+		if err := json.NewEncoder(w).Encode(ret); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handlePresignedCallback ingests data uploaded via a pre-signed URL (see handlePresignedUpload)
+func handlePresignedCallback(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/presigned", http.StatusMethodNotAllowed)
+			return
+		}
+		if db.Config.UploadBucket == "" {
+			writeError(w, "pre-signed uploads are not configured", http.StatusNotImplemented)
+			return
+		}
+		id, err := database.UIDFromHex([]byte(strings.TrimPrefix(r.URL.Path, "/upload/presigned/")))
+		if err != nil || id.Otype != database.OtypeUpload {
+			writeError(w, "invalid upload ID", http.StatusBadRequest)
+			return
+		}
+		ds, err := db.LoadDatasetFromUpload(r.Context(), r.URL.Query().Get("name"), id)
+		if err != nil {
+			writeFailure(w, "failed to load uploaded data", err)
+			return
+		}
 		if err := db.AddDataset(ds); err != nil {
-			http.Error(w, fmt.Sprintf("could not write dataset to database: %v", err), http.StatusInternalServerError)
+			writeFailure(w, "could not write dataset to database", err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -163,8 +1459,9 @@ type remotePayload struct {
 	// TODO: add auth
 	// TODO: headers (e.g. accept encoding - maybe set that by default)
 	// TODO: TLS settings? (e.g. insecure skip verify)
-	Name string `json:"name"`
-	URL  string `json:"url"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	URL       string `json:"url"`
 	// TODO: schema?
 	// TODO: compression? (NOT content-type, just plain old .csv.gz files)
 }
@@ -172,7 +1469,7 @@ type remotePayload struct {
 func handleRemoteUpload(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "only POST requests allowed for /upload/remote", http.StatusMethodNotAllowed)
+			writeError(w, "only POST requests allowed for /upload/remote", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -180,18 +1477,18 @@ func handleRemoteUpload(db *database.Database) http.HandlerFunc {
 		dec := json.NewDecoder(r.Body)
 		dec.DisallowUnknownFields()
 		if err := dec.Decode(&payl); err != nil {
-			http.Error(w, fmt.Sprintf("did not supply correct information about a remote dataset: %v", err), http.StatusBadRequest)
+			writeError(w, fmt.Sprintf("did not supply correct information about a remote dataset: %v", err), http.StatusBadRequest)
 			return
 		}
 		// NewDecoder(r).Decode() can lead to bugs: https://github.com/golang/go/issues/36225
 		if dec.More() {
-			http.Error(w, "body can only contain a single JSON object", http.StatusBadRequest)
+			writeError(w, "body can only contain a single JSON object", http.StatusBadRequest)
 			return
 		}
 
 		remote, err := url.Parse(payl.URL)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("invalid URL supplied: %v (%v)", payl.URL, err), http.StatusBadRequest)
+			writeError(w, fmt.Sprintf("invalid URL supplied: %v (%v)", payl.URL, err), http.StatusBadRequest)
 			return
 		}
 
@@ -203,7 +1500,7 @@ func handleRemoteUpload(db *database.Database) http.HandlerFunc {
 			// TODO: NewRequest once we start faffing around with headers and such
 			req, err := http.Get(remote.String())
 			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to remote to connect dataset: %v", err), http.StatusInternalServerError)
+				writeFailure(w, "failed to remote to connect dataset", err)
 				return
 			}
 			// TODO: check status... just < 400? Or be more picky?
@@ -211,18 +1508,18 @@ func handleRemoteUpload(db *database.Database) http.HandlerFunc {
 			headers = req.Header
 		} else if remote.Scheme == "s3" {
 			// TODO(next)
-			http.Error(w, "s3 not supported just yet", http.StatusInternalServerError)
+			writeError(w, "s3 not supported just yet", http.StatusInternalServerError)
 			return
 		} else {
-			http.Error(w, fmt.Sprintf("unsupported scheme: %v", remote.Scheme), http.StatusInternalServerError)
+			writeError(w, fmt.Sprintf("unsupported scheme: %v", remote.Scheme), http.StatusInternalServerError)
 			return
 		}
 
 		defer remoteBody.Close()
 
-		ds, err := db.LoadDatasetFromReaderAuto(payl.Name, remoteBody)
+		ds, err := db.LoadDatasetFromReaderAutoWithOptions(payl.Name, remoteBody, database.LoadOptions{Namespace: payl.Namespace})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to parse a given file: %v", err), http.StatusInternalServerError)
+			writeFailure(w, "failed to parse a given file", err)
 			return
 		}
 		clength, err := strconv.Atoi(headers.Get("Content-Length"))
@@ -233,7 +1530,41 @@ func handleRemoteUpload(db *database.Database) http.HandlerFunc {
 		ds.SizeRaw = int64(clength)
 
 		if err := db.AddDataset(ds); err != nil {
-			http.Error(w, fmt.Sprintf("could not write dataset to database: %v", err), http.StatusInternalServerError)
+			writeFailure(w, "could not write dataset to database", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ds); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// handleExternal registers external data (local files or S3 objects) as a dataset, these don't
+// get loaded, they are read as they get queried (see database.RegisterExternal), e.g.
+// `POST /upload/external?name=trips&uri=s3://bucket/trips/*.parquet`. CSV data accept the same
+// options as /upload/auto, the format is inferred from extensions, unless given (`format=csv`).
+func handleExternal(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST requests allowed for /upload/external", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		lopts, err := loadOptionsFromQuery(query)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts := database.ExternalOptions{LoadOptions: lopts, Format: query.Get("format")}
+		ds, err := db.RegisterExternal(query.Get("name"), query.Get("uri"), opts)
+		if err != nil {
+			writeFailure(w, "failed to register external data", err)
+			return
+		}
+		if err := db.AddDataset(ds); err != nil {
+			writeFailure(w, "could not write dataset to database", err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -8,13 +8,18 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kokes/smda/src/column"
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query"
+	"github.com/kokes/smda/src/rawchunk"
 )
 
 func newDatabaseWithRoutes() (*database.Database, error) {
@@ -155,10 +160,13 @@ func TestDatasetListing(t *testing.T) {
 	dsets := []string{"foo,bar,baz\n1,2,3\n4,5,6", "foo,bar\ntrue,false\nfalse,true"}
 	for j, dset := range dsets {
 		name := fmt.Sprintf("dataset%02d", j)
-		_, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(dset))
+		ds, err := db.LoadDatasetFromReaderAuto(name, strings.NewReader(dset))
 		if err != nil {
 			t.Fatal(err)
 		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	srv := httptest.NewServer(db.ServerHTTP.Handler)
@@ -186,6 +194,11 @@ func TestDatasetListing(t *testing.T) {
 			Dtype    string
 			Nullable bool
 		}
+		Stats []struct {
+			NullFraction float64 `json:"null_fraction"`
+			Distinct     int
+			Min, Max     string
+		}
 	}
 	dec := json.NewDecoder(resp.Body)
 	if err := dec.Decode(&body); err != nil {
@@ -194,10 +207,22 @@ func TestDatasetListing(t *testing.T) {
 	if dec.More() {
 		t.Fatal("body cannot contain multiple JSON objects")
 	}
+	if len(body) != len(dsets) {
+		t.Fatalf("expecting %v datasets, got %v", len(dsets), len(body))
+	}
 	for _, ds := range body {
 		if len(ds.ID) != 18 {
 			t.Errorf("unexpected dataset ID: %+v", ds.ID)
 		}
+		// column profiles are part of the listing
+		if len(ds.Stats) != len(ds.Schema) {
+			t.Fatalf("expecting stats for all %v columns, got %+v", len(ds.Schema), ds.Stats)
+		}
+		for _, stats := range ds.Stats {
+			if stats.NullFraction != 0 || stats.Distinct != 2 || stats.Min == stats.Max {
+				t.Errorf("unexpected column stats: %+v", stats)
+			}
+		}
 		for _, col := range ds.Schema {
 			if !(col.Dtype == "int" || col.Dtype == "float" || col.Dtype == "bool" || col.Dtype == "string") {
 				t.Errorf("unexpected column type: %+v", col.Dtype)
@@ -262,6 +287,7 @@ func TestQueryMethods(t *testing.T) {
 		method string
 	}{
 		{"api/query", http.MethodGet},
+		{"api/query/materialize", http.MethodGet},
 		{"upload/raw", http.MethodGet},
 		{"upload/auto", http.MethodGet},
 	}
@@ -361,8 +387,7 @@ func TestHandlingQueries(t *testing.T) {
 	}
 }
 
-// At this point we only test that when passed an unexpected parameter, the query fails
-func TestInvalidQueries(t *testing.T) {
+func TestQueriesWithParams(t *testing.T) {
 	db, err := newDatabaseWithRoutes()
 	if err != nil {
 		t.Fatal(err)
@@ -373,33 +398,61 @@ func TestInvalidQueries(t *testing.T) {
 		}
 	}()
 
-	srv := httptest.NewServer(db.ServerHTTP.Handler)
-	defer srv.Close()
-
-	url := fmt.Sprintf("%s/api/query", srv.URL)
-	body := `{"sql": "select 1", "foo": "bar"}`
-	// _ = ds
-	// body := `{"foobar": 123}`
-	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("id,name\n1,foo\n2,bar\n3,baz"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Fatalf("unexpected status: %+v", resp.Status)
-	}
-	expErr := `did not supply correct query parameters: json: unknown field "foo"`
-	defer resp.Body.Close()
-	ret, err := io.ReadAll(resp.Body)
-	if err != nil {
+	if err := db.AddDataset(ds); err != nil {
 		t.Fatal(err)
 	}
-	if strings.TrimSpace(string(ret)) != expErr {
-		t.Errorf("expected the query endpoint to result in %s, got %s instead", expErr, ret)
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+	url := fmt.Sprintf("%s/api/query", srv.URL)
+
+	tests := []struct {
+		body     string
+		status   int
+		expected [][]interface{}
+	}{
+		{`{"sql": "SELECT id, name FROM foo WHERE id > ? LIMIT 10", "params": [1]}`, http.StatusOK, [][]interface{}{{2.0, "bar"}, {3.0, "baz"}}},
+		{`{"sql": "SELECT id, name FROM foo WHERE name = ? OR id = ? LIMIT 10", "params": ["foo", 3]}`, http.StatusOK, [][]interface{}{{1.0, "foo"}, {3.0, "baz"}}},
+		{`{"sql": "SELECT id + ? FROM foo LIMIT 1", "params": [1.5]}`, http.StatusOK, [][]interface{}{{2.5}}},
+		{`{"sql": "SELECT id FROM foo WHERE id = ? LIMIT 10"}`, http.StatusBadRequest, nil},
+		{`{"sql": "SELECT id FROM foo WHERE id = ? LIMIT 10", "params": [1, 2]}`, http.StatusBadRequest, nil},
+		{`{"sql": "SELECT id FROM foo WHERE id = ? LIMIT 10", "params": [[1]]}`, http.StatusBadRequest, nil},
+		// datetime literals are local times in a given timezone
+		{`{"sql": "SELECT extract(epoch FROM cast(? AS datetime))", "params": ["2020-01-01 12:00:00"]}`, http.StatusOK, [][]interface{}{{1577880000.0}}},
+		{`{"sql": "SELECT extract(epoch FROM cast(? AS datetime))", "params": ["2020-01-01 12:00:00"], "timezone": "Europe/Prague"}`, http.StatusOK, [][]interface{}{{1577876400.0}}},
+		{`{"sql": "SELECT 1", "timezone": "Europe/Atlantis"}`, http.StatusBadRequest, nil},
+		{`{"sql": "SELECT names FROM foo"}`, http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(url, "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v to result in %v, got %v", test.body, test.status, resp.StatusCode)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var respBody struct {
+			Data [][]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(respBody.Data, test.expected) {
+			t.Errorf("expecting %v to result in %v, got %v", test.body, test.expected, respBody.Data)
+		}
 	}
 }
 
-func TestBasicRawUpload(t *testing.T) {
+func TestPaginatedQueries(t *testing.T) {
 	db, err := newDatabaseWithRoutes()
 	if err != nil {
 		t.Fatal(err)
@@ -410,44 +463,151 @@ func TestBasicRawUpload(t *testing.T) {
 		}
 	}()
 
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("id\n1\n2\n3\n4\n5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
 	srv := httptest.NewServer(db.ServerHTTP.Handler)
 	defer srv.Close()
+	url := fmt.Sprintf("%s/api/query", srv.URL)
 
-	url := fmt.Sprintf("%s/upload/raw?name=test_file", srv.URL)
-	body := strings.NewReader("foo,bar,baz\n1,2,3\n4,5,6")
-	resp, err := http.Post(url, "text/csv", body)
+	type page struct {
+		Nrows  int             `json:"nrows"`
+		Cursor string          `json:"cursor"`
+		Data   [][]interface{} `json:"data"`
+	}
+	fetch := func(body string, status int) page {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("expecting %v to result in %v, got %v", body, status, resp.StatusCode)
+		}
+		var ret page
+		if status == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ret
+	}
+
+	first := fetch(`{"sql": "SELECT id FROM foo ORDER BY id DESC", "page_size": 2}`, http.StatusOK)
+	if first.Nrows != 2 || first.Cursor == "" || !reflect.DeepEqual(first.Data, [][]interface{}{{5.0}, {4.0}}) {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	second := fetch(fmt.Sprintf(`{"cursor": "%v"}`, first.Cursor), http.StatusOK)
+	if second.Cursor == "" || !reflect.DeepEqual(second.Data, [][]interface{}{{3.0}, {2.0}}) {
+		t.Fatalf("unexpected second page: %+v", second)
+	}
+	last := fetch(fmt.Sprintf(`{"cursor": "%v", "page_size": 10}`, second.Cursor), http.StatusOK)
+	if last.Cursor != "" || !reflect.DeepEqual(last.Data, [][]interface{}{{1.0}}) {
+		t.Fatalf("unexpected last page: %+v", last)
+	}
+	// OFFSET in SQL works regardless
+	offset := fetch(`{"sql": "SELECT id FROM foo LIMIT 2 OFFSET 3"}`, http.StatusOK)
+	if offset.Cursor != "" || !reflect.DeepEqual(offset.Data, [][]interface{}{{4.0}, {5.0}}) {
+		t.Errorf("unexpected results with an offset: %+v", offset)
+	}
+
+	fetch(fmt.Sprintf(`{"cursor": "%v"}`, first.Cursor), http.StatusNotFound)
+	fetch(`{"cursor": "abc"}`, http.StatusNotFound)
+	fetch(`{"sql": "SELECT id FROM foo", "cursor": "abc"}`, http.StatusBadRequest)
+	fetch(`{"sql": "SELECT id FROM foo", "page_size": -1}`, http.StatusBadRequest)
+}
+
+func TestQueryBatches(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode != 200 {
-		t.Fatalf("unexpected status: %+v", resp.Status)
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("id,name\n1,foo\n2,bar\n3,baz"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	ct := resp.Header.Get("Content-Type")
-	if ct != "application/json" {
-		t.Errorf("unexpected content type: %+v", ct)
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	var dec database.Dataset
 
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&dec); err != nil {
-		t.Fatal(err)
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+	url := fmt.Sprintf("%s/api/query/batch", srv.URL)
+
+	type statement struct {
+		Result *struct {
+			Data [][]interface{} `json:"data"`
+		} `json:"result"`
+		Error   string `json:"error"`
+		Skipped bool   `json:"skipped"`
 	}
-	if decoder.More() {
-		t.Fatal("body cannot contain multiple JSON objects")
+	tests := []struct {
+		body     string
+		status   int
+		expected []string // data of each statement, its error, or "skipped"
+	}{
+		{`{"statements": [{"sql": "SELECT count() FROM foo"}, {"sql": "SELECT max(id) FROM foo WHERE name = ?", "params": ["bar"]}]}`, http.StatusOK, []string{"[[3]]", "[[2]]"}},
+		{`{"statements": [{"sql": "SELECT nope FROM foo"}, {"sql": "SELECT 1"}]}`, http.StatusOK, []string{"error", "[[1]]"}},
+		{`{"statements": [{"sql": "SELECT nope FROM foo"}, {"sql": "SELECT 1"}], "stop_on_error": true}`, http.StatusOK, []string{"error", "skipped"}},
+		{`{"statements": []}`, http.StatusBadRequest, nil},
+		{`{"sql": "SELECT 1"}`, http.StatusBadRequest, nil},
 	}
-	if dec.ID.Otype != database.OtypeDataset {
-		t.Errorf("expecting an ID for a dataset")
+	for _, test := range tests {
+		resp, err := http.Post(url, "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v to result in %v, got %v", test.body, test.status, resp.StatusCode)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var respBody struct {
+			Statements []statement `json:"statements"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, stmt := range respBody.Statements {
+			switch {
+			case stmt.Skipped:
+				got = append(got, "skipped")
+			case stmt.Error != "":
+				got = append(got, "error")
+			default:
+				got = append(got, fmt.Sprint(stmt.Result.Data))
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expecting %v to result in %v, got %v", test.body, test.expected, got)
+		}
 	}
-	if dec.Name != "test_file" {
-		t.Errorf("expected the name to be %+v, got %+v", "test_file", dec.Name)
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/query/batch", srv.URL))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if dec.Schema != nil {
-		t.Errorf("not expecting a schema to be present, got: %+v", dec.Schema)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting batches to only be submitted via POST, got %v", resp.Status)
 	}
 }
 
-func TestBasicAutoUpload(t *testing.T) {
+func TestQueryCacheStats(t *testing.T) {
 	db, err := newDatabaseWithRoutes()
 	if err != nil {
 		t.Fatal(err)
@@ -457,63 +617,86 @@ func TestBasicAutoUpload(t *testing.T) {
 			panic(err)
 		}
 	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
 
 	srv := httptest.NewServer(db.ServerHTTP.Handler)
 	defer srv.Close()
 
-	dsName := "auto_file"
-	dsContents := "foo,bar,baz\n1,2,true\n4,,false"
+	for j := 0; j < 3; j++ {
+		body := strings.NewReader(`{"sql": "SELECT foo FROM foo LIMIT 10"}`)
+		resp, err := http.Post(fmt.Sprintf("%s/api/query", srv.URL), "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %v", resp.Status)
+		}
+	}
 
-	url := fmt.Sprintf("%s/upload/auto?name=%s", srv.URL, dsName)
-	body := strings.NewReader(dsContents)
-	resp, err := http.Post(url, "text/csv", body)
+	resp, err := http.Get(fmt.Sprintf("%s/api/query/cache", srv.URL))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode != 200 {
-		t.Fatalf("unexpected status: %+v", resp.Status)
+	defer resp.Body.Close()
+	var stats query.CacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
 	}
-	ct := resp.Header.Get("Content-Type")
-	if ct != "application/json" {
-		t.Errorf("unexpected content type: %+v", ct)
+	expected := query.CacheStats{Capacity: db.Config.QueryCacheSize, Entries: 1, Hits: 2, Misses: 1}
+	if stats != expected {
+		t.Errorf("expecting cache stats to be %+v, got %+v", expected, stats)
 	}
-	defer resp.Body.Close()
-	var dec database.Dataset
+}
 
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&dec); err != nil {
+func TestDiskUsageReport(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
 		t.Fatal(err)
 	}
-	if decoder.More() {
-		t.Fatal("body cannot contain multiple JSON objects")
-	}
-	if dec.Name != dsName {
-		t.Errorf("expected the name to be %+v, got %+v", dsName, dec.Name)
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if dec.ID.Otype != database.OtypeDataset {
-		t.Errorf("expecting an ID for a dataset")
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
 	}
-	if dec.Schema == nil {
-		t.Error("expecting a schema to be present, got a nil")
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/usage", srv.URL))
+	if err != nil {
+		t.Fatal(err)
 	}
-	es := column.TableSchema{{Name: "foo", Dtype: column.DtypeInt, Nullable: false}, {Name: "bar", Dtype: column.DtypeInt, Nullable: true}, {Name: "baz", Dtype: column.DtypeBool, Nullable: false}}
-	if !reflect.DeepEqual(dec.Schema, es) {
-		t.Errorf("expecting the schema to be inferred as %+v, got %+v", es, dec.Schema)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.Status)
 	}
-
-	if int(dec.SizeRaw) != len(dsContents) {
-		t.Errorf("unexpected size of uploaded content: got %v, expected %v", dec.SizeRaw, dsContents)
+	var usage database.DiskUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
 	}
-
-	if _, err := db.GetDataset(dsName, dec.ID.String(), false); err != nil {
-		t.Error(err)
+	if len(usage.Datasets) != 1 || usage.Datasets[0].ID != ds.ID || len(usage.Datasets[0].Columns) != 2 {
+		t.Fatalf("expecting usage of a single dataset with two columns, got %+v", usage.Datasets)
 	}
-	if _, err := db.GetDataset(dsName, "", true); err != nil {
-		t.Error(err)
+	if usage.Bytes != ds.SizeOnDisk || usage.Datasets[0].Stripes != len(ds.Stripes) {
+		t.Errorf("expecting %v bytes in %v stripes, got %+v", ds.SizeOnDisk, len(ds.Stripes), usage)
 	}
 }
 
-func TestHttpUpload(t *testing.T) {
+func TestRecentQueries(t *testing.T) {
 	db, err := newDatabaseWithRoutes()
 	if err != nil {
 		t.Fatal(err)
@@ -523,67 +706,84 @@ func TestHttpUpload(t *testing.T) {
 			panic(err)
 		}
 	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
 
 	srv := httptest.NewServer(db.ServerHTTP.Handler)
 	defer srv.Close()
 
-	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO(PR)
-		// - compression (incl. content-type if we get accept-encoding to work)
-		// - redirect?
-		// - non-200 response
-		w.Write([]byte("abc,def\n1,2\n"))
-	}))
+	queries := []string{"SELECT foo FROM foo", "SELECT nope FROM foo"}
+	for _, sql := range queries {
+		body := strings.NewReader(fmt.Sprintf(`{"sql": "%s"}`, sql))
+		resp, err := http.Post(fmt.Sprintf("%s/api/query", srv.URL), "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
 
 	tests := []struct {
-		originPath     string
-		expectedStatus int
+		query   string
+		status  int
+		queries []string
 	}{
-		{
-			originPath:     "sample/csv",
-			expectedStatus: http.StatusOK,
-		},
+		{"", http.StatusOK, []string{queries[1], queries[0]}},
+		{"?limit=1", http.StatusOK, []string{queries[1]}},
+		{"?limit=100", http.StatusOK, []string{queries[1], queries[0]}},
+		{"?limit=foo", http.StatusBadRequest, nil},
+		{"?limit=-1", http.StatusBadRequest, nil},
 	}
-
 	for _, test := range tests {
-		payload := fmt.Sprintf(`{"url": "%v/%v"}`, origin.URL, test.originPath)
-		reqBody := strings.NewReader(payload)
-		req, err := http.Post(fmt.Sprintf("%v/upload/remote", srv.URL), "application/json", reqBody)
+		resp, err := http.Get(fmt.Sprintf("%s/queries/recent%s", srv.URL, test.query))
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
 		}
-		if req.StatusCode != test.expectedStatus {
-			// io.Copy(os.Stdout, req.Body)
-			t.Errorf("expecting query to result in %v, got %v instead", test.expectedStatus, req.StatusCode)
-			return
+		defer resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting /queries/recent%v to result in %v, got %v", test.query, test.status, resp.StatusCode)
+			continue
 		}
-	}
-}
-
-func randomStringFuncer(n int) func() []byte {
-	return func() []byte {
-		ret := make([]byte, 0, n)
-		for j := 0; j < n; j++ {
-			char := byte('a') + byte(rand.Intn(26))
-			ret = append(ret, char)
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		var recent []query.QueryRecord
+		if err := json.NewDecoder(resp.Body).Decode(&recent); err != nil {
+			t.Fatal(err)
+		}
+		var sqls []string
+		for _, rec := range recent {
+			sqls = append(sqls, rec.SQL)
+			if rec.Dataset != "foo" || rec.ClientIP != "127.0.0.1" {
+				t.Errorf("unexpected query record: %+v", rec)
+			}
+		}
+		if !reflect.DeepEqual(sqls, test.queries) {
+			t.Errorf("expecting /queries/recent%v to list %v, got %v", test.query, test.queries, sqls)
+		}
+		if len(recent) > 0 && recent[0].Error == "" {
+			t.Errorf("expecting the failed query to have its error recorded, got %+v", recent[0])
 		}
-		return ret
 	}
-}
 
-func randomIntFuncer(n int) func() []byte {
-	return func() []byte {
-		rnd := rand.Intn(n)
-		rnds := strconv.Itoa(rnd)
-		return []byte(rnds)
+	resp, err := http.Post(fmt.Sprintf("%s/queries/recent", srv.URL), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting POST to /queries/recent to be disallowed, got %v", resp.StatusCode)
 	}
 }
 
-func BenchmarkAutoUpload(b *testing.B) {
+func TestArrowQueries(t *testing.T) {
 	db, err := newDatabaseWithRoutes()
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
 	defer func() {
 		if err := db.Drop(); err != nil {
@@ -591,67 +791,1851 @@ func BenchmarkAutoUpload(b *testing.B) {
 		}
 	}()
 
-	srv := httptest.NewServer(db.ServerHTTP.Handler)
-	defer srv.Close()
-	url := fmt.Sprintf("%s/upload/auto", srv.URL)
+	ds, err := db.LoadDatasetFromReaderAuto("source", strings.NewReader("foo,bar\n1,3\n4,6\n1,2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	url := fmt.Sprintf("%s/api/query?format=arrow", srv.URL)
+	body, err := json.Marshal(queryPayload{SQL: "SELECT foo, bar FROM source ORDER BY bar LIMIT 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %+v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/vnd.apache.arrow.stream" {
+		t.Errorf("unexpected content type: %+v", ct)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stream starts with a continuation marker
+	if !bytes.HasPrefix(data, []byte{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("expecting an Arrow IPC stream, got %v", data)
+	}
+}
+
+func TestExportingQueryResults(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("source", strings.NewReader("foo,bar\n1,\"a,b\"\n4,\n,c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
 
 	tests := []struct {
-		name       string
-		ncols      int
-		nrows      int
-		randomData func() []byte
+		format      string
+		status      int
+		contentType string
+		filename    string
 	}{
-		{"short strings", 10, 300_000, randomStringFuncer(3)},
-		{"medium strings", 10, 300_000, randomStringFuncer(15)},
-		{"small ints", 10, 300_000, randomIntFuncer(128)},
-		{"medium ints", 10, 300_000, randomIntFuncer(100_000)},
-		{"large ints", 10, 300_000, randomIntFuncer(10_000_000_000)},
+		{"csv", http.StatusOK, "text/csv; charset=utf-8", "results.csv"},
+		{"parquet", http.StatusOK, "application/vnd.apache.parquet", "results.parquet"},
+		{"speedscope", http.StatusOK, "application/json", "query.speedscope.json"},
+		{"json", http.StatusOK, "application/json", ""},
+		{"xlsx", http.StatusBadRequest, "application/json", ""},
 	}
-
 	for _, test := range tests {
-		b.Run(test.name, func(b *testing.B) {
-			bf := new(bytes.Buffer)
+		url := fmt.Sprintf("%s/api/query?format=%s", srv.URL, test.format)
+		body, err := json.Marshal(queryPayload{SQL: "SELECT foo, bar FROM source ORDER BY foo DESC NULLS LAST"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v exports to result in %v, got %v", test.format, test.status, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("expecting %v exports to be of type %v, got %v", test.format, test.contentType, ct)
+		}
+		if cd := resp.Header.Get("Content-Disposition"); test.filename != "" && cd != fmt.Sprintf("attachment; filename=%q", test.filename) {
+			t.Errorf("expecting %v exports to be downloaded as %v, got %v", test.format, test.filename, cd)
+		}
+		switch test.format {
+		case "csv":
+			// ordered and quoted, nulls are empty
+			if expected := "foo,bar\n4,\n1,\"a,b\"\n,c\n"; string(data) != expected {
+				t.Errorf("expecting a CSV export to be %q, got %q", expected, data)
+			}
+		case "parquet":
+			if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+				t.Errorf("expecting a Parquet file, got %v", data)
+			}
+		case "speedscope":
+			var profile struct {
+				Schema   string            `json:"$schema"`
+				Profiles []json.RawMessage `json:"profiles"`
+			}
+			if err := json.Unmarshal(data, &profile); err != nil || profile.Schema == "" || len(profile.Profiles) == 0 {
+				t.Errorf("expecting a speedscope profile, got %s (%v)", data, err)
+			}
+		}
+	}
+}
 
-			for nr := 0; nr < test.nrows; nr++ {
-				for nc := 0; nc < test.ncols; nc++ {
-					if nr == 0 {
-						if _, err := fmt.Fprintf(bf, "col%v", nc+1); err != nil {
-							b.Fatal(err)
-						}
-						sep := byte(',')
-						if nc == test.ncols-1 {
-							sep = '\n'
-						}
-						if err := bf.WriteByte(sep); err != nil {
-							b.Fatal(err)
-						}
-						continue
-					}
+func TestQueryProgress(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
 
-					if _, err := bf.Write(test.randomData()); err != nil {
-						b.Fatal(err)
-					}
-					sep := byte(',')
-					if nc == test.ncols-1 {
-						sep = '\n'
-					}
-					if err := bf.WriteByte(sep); err != nil {
-						b.Fatal(err)
-					}
-				}
+	ds, err := db.LoadDatasetFromReaderAuto("source", strings.NewReader("foo,bar\n1,3\n4,6\n1,2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		query  string
+		events []string
+	}{
+		{"SELECT foo, bar FROM source", []string{"progress", "result"}},
+		{"SELECT foo, sum(bar) FROM source GROUP BY foo", []string{"progress", "result"}},
+		{"SELECT 1", []string{"result"}},
+		{"SELECT nonexistent FROM source", []string{"error"}},
+	}
+	for _, test := range tests {
+		url := fmt.Sprintf("%s/api/query/progress", srv.URL)
+		body, err := json.Marshal(queryPayload{SQL: test.query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %+v", resp.Status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("unexpected content type: %+v", ct)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for _, raw := range strings.Split(strings.TrimSpace(string(data)), "\n\n") {
+			event, payload, ok := strings.Cut(raw, "\n")
+			if !(ok && strings.HasPrefix(event, "event: ") && strings.HasPrefix(payload, "data: ")) {
+				t.Fatalf("malformed event in %v: %v", test.query, raw)
 			}
-			b.ResetTimer()
-			len := bf.Len()
-			for j := 0; j < b.N; j++ {
-				resp, err := http.Post(url, "text/csv", bytes.NewReader(bf.Bytes()))
-				if err != nil {
-					b.Fatal(err)
-				}
-				if resp.StatusCode != 200 {
-					b.Fatalf("unexpected status: %v", resp.Status)
-				}
+			if !json.Valid([]byte(strings.TrimPrefix(payload, "data: "))) {
+				t.Errorf("expecting event data to be JSON, got %v", payload)
 			}
-			b.SetBytes(int64(len))
-		})
+			events = append(events, strings.TrimPrefix(event, "event: "))
+		}
+		if !reflect.DeepEqual(events, test.events) {
+			t.Errorf("expecting %v to emit %v, got %v", test.query, test.events, events)
+		}
+	}
+}
+
+func TestMaterializingQueries(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("source", strings.NewReader("foo,bar\n1,3\n4,6\n1,2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	url := fmt.Sprintf("%s/api/query/materialize", srv.URL)
+	body, err := json.Marshal(materializePayload{Name: "derived", SQL: "SELECT foo, sum(bar) FROM source GROUP BY foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %+v", resp.Status)
+	}
+	var derived database.Dataset
+	if err := json.NewDecoder(resp.Body).Decode(&derived); err != nil {
+		t.Fatal(err)
+	}
+	expSchema := column.TableSchema{
+		column.Schema{Name: "foo", Dtype: column.DtypeInt, Nullable: false},
+		column.Schema{Name: "sum_bar", Dtype: column.DtypeInt, Nullable: false},
+	}
+	if !(derived.Name == "derived" && derived.NRows == 2 && reflect.DeepEqual(derived.Schema, expSchema)) {
+		t.Errorf("unexpected dataset created: %+v", derived)
+	}
+	if _, err := db.GetDatasetLatest("derived"); err != nil {
+		t.Errorf("expecting the derived dataset to be present in the database: %v", err)
+	}
+}
+
+// At this point we only test that when passed an unexpected parameter, the query fails
+func TestInvalidQueries(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	url := fmt.Sprintf("%s/api/query", srv.URL)
+	body := `{"sql": "select 1", "foo": "bar"}`
+	// _ = ds
+	// body := `{"foobar": 123}`
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %+v", resp.Status)
+	}
+	expErr := apiError{Code: "bad_request", Message: `did not supply correct query parameters: json: unknown field "foo"`}
+	var ret apiError
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret != expErr {
+		t.Errorf("expected the query endpoint to result in %+v, got %+v instead", expErr, ret)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{MaxQueryMemory: 100_000, MaxRowsPerStripe: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	db.ServerHTTP = &http.Server{Handler: SetupRoutes(db)}
+	var large strings.Builder
+	large.WriteString("a\n")
+	for j := 0; j < 50_000; j++ {
+		large.WriteString(fmt.Sprintf("%v\n", j))
+	}
+	ds, err := db.LoadDatasetFromReaderAuto("large", strings.NewReader(large.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodPost, "/api/query", `{"sql": "SELECT a FROM large LIMIT 10"}`, http.StatusOK, ""},
+		{http.MethodPost, "/api/query", `{"sql": "SELECT a FROM"}`, http.StatusBadRequest, "bad_request"},
+		{http.MethodPost, "/api/query", `{"sql": "SELECT b FROM large"}`, http.StatusBadRequest, "bad_request"},
+		{http.MethodPost, "/api/query", `{"sql": "SELECT a/0 FROM large"}`, http.StatusBadRequest, "bad_request"},
+		{http.MethodPost, "/api/query", `{"sql": "SELECT a FROM nonexistent"}`, http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/api/query", `{"sql": "SELECT a FROM large LIMIT 100000"}`, http.StatusTooManyRequests, "resource_exhausted"},
+		{http.MethodPost, "/api/query", `{"cursor": "foo"}`, http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/api/query", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodDelete, "/api/datasets/nonexistent", "", http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/upload/auto?name=foo", "a,b\n\"1,2", http.StatusBadRequest, "bad_request"},
+		{http.MethodPost, "/upload/append/large", "a\nfoo", http.StatusBadRequest, "bad_request"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v %v (%v) to result in %v, got %v", test.method, test.path, test.body, test.status, resp.StatusCode)
+			continue
+		}
+		if test.status == http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expecting errors to be reported as JSON, got %v", ct)
+		}
+		var ret apiError
+		if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+			t.Fatal(err)
+		}
+		if ret.Code != test.code || ret.Message == "" {
+			t.Errorf("expecting %v %v (%v) to fail with a code %v, got %+v", test.method, test.path, test.body, test.code, ret)
+		}
+	}
+}
+
+func TestTimeoutResponses(t *testing.T) {
+	w := httptest.NewRecorder()
+	te := &query.TimeoutError{TimeoutMs: 100, ElapsedMs: 101.5, StripesRead: 3, BytesScanned: 1234}
+	writeFailure(w, "failed this query", fmt.Errorf("cannot aggregate: %w", te))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expecting timeouts to result in %v, got %v", http.StatusGatewayTimeout, w.Code)
+	}
+	var ret apiError
+	if err := json.NewDecoder(w.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.Code != "timeout" || ret.Timeout == nil || *ret.Timeout != *te {
+		t.Errorf("expecting a timeout with its diagnostics, got %+v", ret)
+	}
+}
+func TestBasicRawUpload(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	url := fmt.Sprintf("%s/upload/raw?name=test_file", srv.URL)
+	body := strings.NewReader("foo,bar,baz\n1,2,3\n4,5,6")
+	resp, err := http.Post(url, "text/csv", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status: %+v", resp.Status)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if ct != "application/json" {
+		t.Errorf("unexpected content type: %+v", ct)
+	}
+	defer resp.Body.Close()
+	var dec database.Dataset
+
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&dec); err != nil {
+		t.Fatal(err)
+	}
+	if decoder.More() {
+		t.Fatal("body cannot contain multiple JSON objects")
+	}
+	if dec.ID.Otype != database.OtypeDataset {
+		t.Errorf("expecting an ID for a dataset")
+	}
+	if dec.Name != "test_file" {
+		t.Errorf("expected the name to be %+v, got %+v", "test_file", dec.Name)
+	}
+	if dec.Schema != nil {
+		t.Errorf("not expecting a schema to be present, got: %+v", dec.Schema)
+	}
+}
+
+func TestBasicAutoUpload(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	dsName := "auto_file"
+	dsContents := "foo,bar,baz\n1,2,true\n4,,false"
+
+	url := fmt.Sprintf("%s/upload/auto?name=%s", srv.URL, dsName)
+	body := strings.NewReader(dsContents)
+	resp, err := http.Post(url, "text/csv", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status: %+v", resp.Status)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if ct != "application/json" {
+		t.Errorf("unexpected content type: %+v", ct)
+	}
+	defer resp.Body.Close()
+	var dec database.Dataset
+
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&dec); err != nil {
+		t.Fatal(err)
+	}
+	if decoder.More() {
+		t.Fatal("body cannot contain multiple JSON objects")
+	}
+	if dec.Name != dsName {
+		t.Errorf("expected the name to be %+v, got %+v", dsName, dec.Name)
+	}
+	if dec.ID.Otype != database.OtypeDataset {
+		t.Errorf("expecting an ID for a dataset")
+	}
+	if dec.Schema == nil {
+		t.Error("expecting a schema to be present, got a nil")
+	}
+	es := column.TableSchema{{Name: "foo", Dtype: column.DtypeInt, Nullable: false}, {Name: "bar", Dtype: column.DtypeInt, Nullable: true}, {Name: "baz", Dtype: column.DtypeBool, Nullable: false}}
+	if !reflect.DeepEqual(dec.Schema, es) {
+		t.Errorf("expecting the schema to be inferred as %+v, got %+v", es, dec.Schema)
+	}
+
+	if int(dec.SizeRaw) != len(dsContents) {
+		t.Errorf("unexpected size of uploaded content: got %v, expected %v", dec.SizeRaw, dsContents)
+	}
+
+	if _, err := db.GetDataset(dsName, dec.ID.String(), false); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.GetDataset(dsName, "", true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAsyncUploads(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	// submits data and polls the resulting job until it's done
+	ingest := func(url, contents string) database.Job {
+		resp, err := http.Post(url, "text/csv", strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("unexpected status: %+v", resp.Status)
+		}
+		var job database.Job
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 500; j++ {
+			resp, err := http.Get(fmt.Sprintf("%s/jobs/%s", srv.URL, job.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status: %+v", resp.Status)
+			}
+			err = json.NewDecoder(resp.Body).Decode(&job)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status == database.JobFinished || job.Status == database.JobFailed {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %v did not finish in time", job.ID)
+		return job
+	}
+
+	job := ingest(fmt.Sprintf("%s/upload/auto?name=foo&async=true", srv.URL), "foo,bar\n1,2\n4,")
+	if job.Status != database.JobFinished || job.Rows != 2 || job.Dataset == nil || job.Dataset.Name != "foo" {
+		t.Fatalf("unexpected job finished: %+v", job)
+	}
+	job = ingest(fmt.Sprintf("%s/upload/append/foo?async=true", srv.URL), "foo,bar\n5,6\n")
+	if job.Status != database.JobFinished || job.Dataset.NRows != 3 {
+		t.Errorf("unexpected append job finished: %+v", job)
+	}
+	job = ingest(fmt.Sprintf("%s/upload/append/foo?async=true", srv.URL), "foo,bar,baz\n5,6,7\n")
+	if job.Status != database.JobFailed || job.Error == "" {
+		t.Errorf("expecting an append of different data to fail, got %+v", job)
+	}
+
+	for _, path := range []string{"/jobs/nope", "/jobs/" + database.Dataset{}.ID.String()} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("expecting %v not to be found", path)
+		}
+	}
+}
+
+func TestAutoUploadWithDialects(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		params string
+		body   string
+		status int
+		schema column.TableSchema
+	}{
+		{"delimiter=semicolon", "foo;bar\n1;2", http.StatusOK, column.TableSchema{{Name: "foo", Dtype: column.DtypeInt}, {Name: "bar", Dtype: column.DtypeInt}}},
+		{"delimiter=semicolon&has_header=false&null=NA&null=-", "1;NA\n-;x", http.StatusOK, column.TableSchema{{Name: "column_01", Dtype: column.DtypeInt, Nullable: true}, {Name: "column_02", Dtype: column.DtypeString, Nullable: true}}},
+		{"quote=%27", "foo,bar\n'a,b',c", http.StatusOK, column.TableSchema{{Name: "foo", Dtype: column.DtypeString}, {Name: "bar", Dtype: column.DtypeString}}},
+		{"has_header=maybe", "foo,bar\n1,2", http.StatusBadRequest, nil},
+		{"delimiter=semicolon&decimal=%2C&thousands=.&null=N%2FA", "foo;bar\n1.234,5;N/A\n2;1.000", http.StatusOK, column.TableSchema{{Name: "foo", Dtype: column.DtypeFloat}, {Name: "bar", Dtype: column.DtypeInt, Nullable: true}}},
+		{"decimal=%3B", "foo,bar\n1,2", http.StatusBadRequest, nil},
+		{"quote=%27%27", "foo,bar\n1,2", http.StatusBadRequest, nil},
+		// sort keys get verified as data get loaded
+		{"sort_key=foo&sort_key=bar", "foo,bar\n1,2\n1,3", http.StatusOK, column.TableSchema{{Name: "foo", Dtype: column.DtypeInt}, {Name: "bar", Dtype: column.DtypeInt}}},
+		{"sort_key=bar", "foo,bar\n1,3\n2,2", http.StatusBadRequest, nil},
+		// schema hints override inferred types
+		{"schema=%7B%22foo%22%3A%22string%22%7D", "foo,bar\n1,2", http.StatusOK, column.TableSchema{{Name: "foo", Dtype: column.DtypeString}, {Name: "bar", Dtype: column.DtypeInt}}},
+		{"schema=%7Bfoo", "foo,bar\n1,2", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(fmt.Sprintf("%s/upload/auto?name=dialects&%s", srv.URL, test.params), "text/csv", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v to result in %v, got %v", test.params, test.status, resp.StatusCode)
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		var ds database.Dataset
+		if err := json.NewDecoder(resp.Body).Decode(&ds); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if !reflect.DeepEqual(ds.Schema, test.schema) {
+			t.Errorf("expecting %v to result in schema %v, got %v", test.params, test.schema, ds.Schema)
+		}
+	}
+}
+
+func TestAppendUpload(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		dataset string
+		body    string
+		status  int
+		nrows   int64
+	}{
+		{"foo", "foo,bar\n5,6", http.StatusOK, 3},
+		{"foo", "foo,bar\n7,8\n9,10", http.StatusOK, 5}, // appends to the latest version
+		{"foo", "foo\n5", http.StatusBadRequest, 0},
+		{"foo", "foo,bar\n1.5,2", http.StatusBadRequest, 0},
+		{"foo?widen=true", "foo,bar\n1.5,2", http.StatusOK, 6},
+		{"bar", "foo,bar\n5,6", http.StatusNotFound, 0},
+		{"", "foo,bar\n5,6", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		url := fmt.Sprintf("%s/upload/append/%s", srv.URL, test.dataset)
+		resp, err := http.Post(url, "text/csv", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting appending to %v to result in %v, got %v", test.dataset, test.status, resp.StatusCode)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var appended database.Dataset
+		if err := json.NewDecoder(resp.Body).Decode(&appended); err != nil {
+			t.Fatal(err)
+		}
+		if appended.NRows != test.nrows || appended.ID == ds.ID {
+			t.Errorf("expecting a new version with %v rows, got %v rows (%v)", test.nrows, appended.NRows, appended.ID)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/upload/append/foo", srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting GET requests to be rejected, got %v", resp.StatusCode)
+	}
+}
+
+func TestHttpUpload(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// TODO(PR)
+		// - compression (incl. content-type if we get accept-encoding to work)
+		// - redirect?
+		// - non-200 response
+		w.Write([]byte("abc,def\n1,2\n"))
+	}))
+
+	tests := []struct {
+		originPath     string
+		expectedStatus int
+	}{
+		{
+			originPath:     "sample/csv",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		payload := fmt.Sprintf(`{"url": "%v/%v"}`, origin.URL, test.originPath)
+		reqBody := strings.NewReader(payload)
+		req, err := http.Post(fmt.Sprintf("%v/upload/remote", srv.URL), "application/json", reqBody)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.StatusCode != test.expectedStatus {
+			// io.Copy(os.Stdout, req.Body)
+			t.Errorf("expecting query to result in %v, got %v instead", test.expectedStatus, req.StatusCode)
+			return
+		}
+	}
+}
+
+func randomStringFuncer(n int) func() []byte {
+	return func() []byte {
+		ret := make([]byte, 0, n)
+		for j := 0; j < n; j++ {
+			char := byte('a') + byte(rand.Intn(26))
+			ret = append(ret, char)
+		}
+		return ret
+	}
+}
+
+func randomIntFuncer(n int) func() []byte {
+	return func() []byte {
+		rnd := rand.Intn(n)
+		rnds := strconv.Itoa(rnd)
+		return []byte(rnds)
+	}
+}
+
+func BenchmarkAutoUpload(b *testing.B) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+	url := fmt.Sprintf("%s/upload/auto", srv.URL)
+
+	tests := []struct {
+		name       string
+		ncols      int
+		nrows      int
+		randomData func() []byte
+	}{
+		{"short strings", 10, 300_000, randomStringFuncer(3)},
+		{"medium strings", 10, 300_000, randomStringFuncer(15)},
+		{"small ints", 10, 300_000, randomIntFuncer(128)},
+		{"medium ints", 10, 300_000, randomIntFuncer(100_000)},
+		{"large ints", 10, 300_000, randomIntFuncer(10_000_000_000)},
+	}
+
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			bf := new(bytes.Buffer)
+
+			for nr := 0; nr < test.nrows; nr++ {
+				for nc := 0; nc < test.ncols; nc++ {
+					if nr == 0 {
+						if _, err := fmt.Fprintf(bf, "col%v", nc+1); err != nil {
+							b.Fatal(err)
+						}
+						sep := byte(',')
+						if nc == test.ncols-1 {
+							sep = '\n'
+						}
+						if err := bf.WriteByte(sep); err != nil {
+							b.Fatal(err)
+						}
+						continue
+					}
+
+					if _, err := bf.Write(test.randomData()); err != nil {
+						b.Fatal(err)
+					}
+					sep := byte(',')
+					if nc == test.ncols-1 {
+						sep = '\n'
+					}
+					if err := bf.WriteByte(sep); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ResetTimer()
+			len := bf.Len()
+			for j := 0; j < b.N; j++ {
+				resp, err := http.Post(url, "text/csv", bytes.NewReader(bf.Bytes()))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if resp.StatusCode != 200 {
+					b.Fatalf("unexpected status: %v", resp.Status)
+				}
+			}
+			b.SetBytes(int64(len))
+		})
+	}
+}
+
+func TestDroppingDatasetsViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var versions []*database.Dataset
+	for j := 0; j < 2; j++ {
+		ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddDataset(ds); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, ds)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		path      string
+		status    int
+		remaining int
+	}{
+		{fmt.Sprintf("foo@v%v", versions[0].ID), http.StatusNoContent, 1},
+		{fmt.Sprintf("foo@v%v", versions[0].ID), http.StatusNotFound, 1},
+		{"bar", http.StatusNotFound, 1},
+		{"", http.StatusBadRequest, 1},
+		{"foo", http.StatusNoContent, 0},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting dropping %v to result in %v, got %v", test.path, test.status, resp.StatusCode)
+		}
+		if len(db.Datasets) != test.remaining {
+			t.Errorf("expecting %v datasets to remain after dropping %v, got %v", test.remaining, test.path, len(db.Datasets))
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/datasets/foo", srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting GET requests not to be allowed, got %v", resp.StatusCode)
+	}
+}
+
+func TestAliasesViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{fmt.Sprintf(`{"name": "pinned", "dataset": "foo", "version": "%v"}`, ds.ID), http.StatusOK},
+		{`{"name": "current", "dataset": "foo"}`, http.StatusOK},
+		{`{"name": "other", "dataset": "bar"}`, http.StatusNotFound},
+		{`{"name": "foo", "dataset": "foo"}`, http.StatusBadRequest},
+		{`{"name": "current"`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(srv.URL+"/api/aliases", "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting setting an alias %v to result in %v, got %v", test.body, test.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/api/aliases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aliases []database.Alias
+	if err := json.NewDecoder(resp.Body).Decode(&aliases); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(aliases) != 2 || aliases[0].Name != "current" || aliases[1].Version != ds.ID.String() {
+		t.Errorf("expecting two aliases to be listed, got %+v", aliases)
+	}
+
+	body, err := json.Marshal(queryPayload{SQL: "SELECT count() FROM pinned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(srv.URL+"/api/query", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expecting aliases to be queryable, got %v", resp.StatusCode)
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, err := http.NewRequest(http.MethodDelete, srv.URL+"/api/aliases/pinned", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expecting removing an alias to result in %v, got %v", status, resp.StatusCode)
+		}
+	}
+	if len(db.Aliases()) != 1 || len(db.Datasets) != 1 {
+		t.Errorf("expecting an alias to be removed, but not its dataset, got %+v", db.Aliases())
+	}
+}
+
+func TestEditingSchemasViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("zip,bar\n01234,2\n56789,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"foo/schema", `[{"column": "zip", "dtype": "string"}, {"column": "bar", "rename": "baz"}]`, http.StatusOK},
+		{fmt.Sprintf("foo@v%v/schema", ds.ID), `[{"column": "bar", "dtype": "float"}]`, http.StatusOK},
+		{"bar/schema", `[{"column": "zip", "dtype": "string"}]`, http.StatusNotFound},
+		{"foo@vabc/schema", `[{"column": "zip", "dtype": "string"}]`, http.StatusNotFound},
+		{"foo/schema", `{"column": "zip"}`, http.StatusBadRequest},
+		{"foo/schema", `[{"column": "zip", "dtype": "foo"}]`, http.StatusBadRequest},
+		{"foo/schema", `[{"column": "nope", "rename": "foo"}]`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path), "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting editing %v with %v to result in %v, got %v", test.path, test.body, test.status, resp.StatusCode)
+		}
+	}
+	if len(db.Datasets) != 3 {
+		t.Fatalf("expecting two new versions, got %v datasets", len(db.Datasets))
+	}
+	es := column.TableSchema{
+		{Name: "zip", Dtype: column.DtypeString},
+		{Name: "baz", Dtype: column.DtypeInt},
+	}
+	if !reflect.DeepEqual(db.Datasets[1].Schema, es) {
+		t.Errorf("expecting the edited schema to be %+v, got %+v", es, db.Datasets[1].Schema)
+	}
+	// the second edit was based on the original version
+	if db.Datasets[2].Schema[0].Dtype != column.DtypeInt || db.Datasets[2].Schema[1].Dtype != column.DtypeFloat {
+		t.Errorf("expecting a version-based edit to start from that version, got %+v", db.Datasets[2].Schema)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/datasets/foo/schema", srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting GET requests not to be allowed, got %v", resp.StatusCode)
+	}
+}
+
+func TestInferringTypesViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("price,bar\n12,a\n-,b\n30,c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"foo/infer?columns=price,bar", http.StatusOK},
+		{fmt.Sprintf("foo@v%v/infer?columns=price", ds.ID), http.StatusOK},
+		{"bar/infer?columns=price", http.StatusNotFound},
+		{"foo/infer", http.StatusBadRequest},
+		{"foo/infer?columns=nope", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting inference via %v to result in %v, got %v", test.path, test.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/datasets/foo/infer?columns=price", srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var inferences []database.ColumnInference
+	if err := json.NewDecoder(resp.Body).Decode(&inferences); err != nil {
+		t.Fatal(err)
+	}
+	if len(inferences) != 1 || inferences[0].After.Dtype != column.DtypeInt || inferences[0].NConflicts != 1 || inferences[0].Conflicts[0].Value != "-" {
+		t.Errorf("expecting price to be inferred as ints with a single conflict, got %+v", inferences)
+	}
+	if len(db.Datasets) != 1 {
+		t.Errorf("expecting inference not to create new versions, got %v datasets", len(db.Datasets))
+	}
+}
+
+func TestPreviewingLoadsViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		query  string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "", "price,bar\n12,a\n-,b\n30,c", http.StatusOK},
+		{http.MethodPost, "max_mb=1&null=-", "price,bar\n12,a\n-,b\n30,c", http.StatusOK},
+		{http.MethodPost, "max_mb=0", "price,bar\n12,a", http.StatusBadRequest},
+		{http.MethodPost, "delimiter=foo", "price,bar\n12,a", http.StatusBadRequest},
+		{http.MethodPost, "", "", http.StatusBadRequest},
+		{http.MethodGet, "", "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+"/upload/infer-schema?"+test.query, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting a preview of %q (with %v) to result in %v, got %v", test.body, test.query, test.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/upload/infer-schema", "text/csv", strings.NewReader("price,bar\n12,a\n-,b\n30,c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var preview database.LoadPreview
+	if err := json.NewDecoder(resp.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Suggestions) != 1 || preview.Suggestions[0].After.Dtype != column.DtypeInt || len(preview.NullTokens) != 1 || preview.NullTokens[0].Value != "-" {
+		t.Errorf("expecting price to be suggested as ints with - as a null, got %+v", preview)
+	}
+	if len(db.Datasets) != 0 {
+		t.Errorf("expecting previews not to create datasets, got %v datasets", len(db.Datasets))
+	}
+}
+
+func TestCompactingViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AppendToDataset(ds, strings.NewReader("foo,bar\n5,6"), database.WideningNone); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		path    string
+		body    string
+		status  int
+		stripes int
+	}{
+		{"foo/compact", "", http.StatusOK, 1},
+		{fmt.Sprintf("foo@v%v/compact", ds.ID), `{"max_rows": 1}`, http.StatusOK, 2},
+		{"bar/compact", "", http.StatusNotFound, 0},
+		{"foo/compact", `{"max_rows": "foo"}`, http.StatusBadRequest, 0},
+		{"foo/compact", `{"max_bytes": -1}`, http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path), "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting compacting %v with %v to result in %v, got %v", test.path, test.body, test.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			var compacted database.Dataset
+			if err := json.NewDecoder(resp.Body).Decode(&compacted); err != nil {
+				t.Fatal(err)
+			}
+			if len(compacted.Stripes) != test.stripes {
+				t.Errorf("expecting compacting %v to result in %v stripes, got %v", test.path, test.stripes, len(compacted.Stripes))
+			}
+		}
+		resp.Body.Close()
+	}
+	if len(db.Datasets) != 4 {
+		t.Errorf("expecting two new versions, got %v datasets", len(db.Datasets))
+	}
+}
+
+func TestInsertingRowsViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("id,name,ok,meta\n1,foo,t,{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		body   string
+		status int
+		rows   int64 // rows in the latest version
+	}{
+		{"foo/rows", `[[12345678901234567, "bar", true, {"a": [1, 2]}]]`, http.StatusAccepted, 1},
+		{"foo/rows", `[[3, null, false, null]]`, http.StatusAccepted, 1},
+		{"foo/rows?flush=true", `[[4, "baz", null, "{}"]]`, http.StatusOK, 4},
+		{"foo/rows?flush=true", `[]`, http.StatusBadRequest, 4},
+		{"foo/rows", `[[5, "baz"]]`, http.StatusBadRequest, 4},
+		{"foo/rows", `[["bar", "baz", true, null]]`, http.StatusBadRequest, 4},
+		{"foo/rows", `{"id": 5}`, http.StatusBadRequest, 4},
+		{"bar/rows", `[[1]]`, http.StatusNotFound, 4},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path), "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting inserting %v into %v to result in %v, got %v", test.body, test.path, test.status, resp.StatusCode)
+		}
+		resp.Body.Close()
+		latest, err := db.GetDatasetLatest("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.NRows != test.rows {
+			t.Errorf("expecting %v rows after inserting %v, got %v", test.rows, test.body, latest.NRows)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/datasets/foo/rows", srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting only POST requests to be allowed for inserts, got %v", resp.StatusCode)
+	}
+}
+
+func TestExportingAndImportingViaAPI(t *testing.T) {
+	var dbs []*database.Database
+	for j := 0; j < 2; j++ {
+		db, err := newDatabaseWithRoutes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Drop(); err != nil {
+				panic(err)
+			}
+		}()
+		dbs = append(dbs, db)
+	}
+	ds, err := dbs[0].LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,2\n3,4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbs[0].AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	src := httptest.NewServer(dbs[0].ServerHTTP.Handler)
+	defer src.Close()
+	dst := httptest.NewServer(dbs[1].ServerHTTP.Handler)
+	defer dst.Close()
+
+	for _, path := range []string{"bar/export", "foo@vabc/export"} {
+		resp, err := http.Get(fmt.Sprintf("%s/api/datasets/%s", src.URL, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expecting exporting %v to result in %v, got %v", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/datasets/foo@v%v/export", src.URL, ds.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("unexpected export response: %v (%v)", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	tests := []struct {
+		body   []byte
+		status int
+	}{
+		{bundle, http.StatusOK},
+		{bundle, http.StatusBadRequest}, // already imported
+		{[]byte("foo,bar\n1,2"), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(fmt.Sprintf("%s/upload/bundle", dst.URL), "application/x-tar", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting an import to result in %v, got %v", test.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			var imported database.Dataset
+			if err := json.NewDecoder(resp.Body).Decode(&imported); err != nil {
+				t.Fatal(err)
+			}
+			if imported.ID != ds.ID || imported.Name != "foo" || imported.NRows != 2 {
+				t.Errorf("expecting %+v to be imported, got %+v", ds, imported)
+			}
+		}
+		resp.Body.Close()
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%s/api/query", dst.URL), "application/json", strings.NewReader(`{"sql": "SELECT sum(bar) FROM foo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expecting imported data to be queryable, got %v", resp.Status)
+	}
+}
+
+func TestDatasetPreviews(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,bar\n1,a\n3,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"foo/preview", http.StatusOK},
+		{fmt.Sprintf("foo@v%v/preview", ds.ID), http.StatusOK},
+		{"bar/preview", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting previewing %v to result in %v, got %v", test.path, test.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			var preview database.Preview
+			if err := json.NewDecoder(resp.Body).Decode(&preview); err != nil {
+				t.Fatal(err)
+			}
+			if preview.ID != ds.ID || len(preview.Head) != 2 || string(preview.Head[1][1]) != `"b"` {
+				t.Errorf("unexpected preview of %v: %+v", test.path, preview)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestStripeChunksViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("foo,rows\n1,a\n,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	stripe := ds.Stripes[0].Id
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{fmt.Sprintf("foo/stripes/%v/foo", stripe), http.StatusOK},
+		{fmt.Sprintf("foo@v%v/stripes/%v/rows", ds.ID, stripe), http.StatusOK},
+		{fmt.Sprintf("foo/stripes/%v/baz", stripe), http.StatusNotFound},
+		{fmt.Sprintf("foo/stripes/%v", stripe), http.StatusBadRequest},
+		{"foo/stripes/abc/foo", http.StatusNotFound},
+		{fmt.Sprintf("bar/stripes/%v/foo", stripe), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/api/datasets/%s", srv.URL, test.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting reading %v to result in %v, got %v", test.path, test.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			ch, err := rawchunk.Read(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ch.Length != 2 {
+				t.Errorf("expecting %v to be a chunk of two values, got %+v", test.path, ch)
+			}
+			if ch.Dtype == "int" && (ch.Ints[0] != 1 || !ch.IsNull(1)) {
+				t.Errorf("unexpected chunk of %v: %+v", test.path, ch)
+			}
+			if ch.Dtype == "string" && !reflect.DeepEqual(ch.Strings, []string{"a", "b"}) {
+				t.Errorf("unexpected chunk of %v: %+v", test.path, ch)
+			}
+		}
+		resp.Body.Close()
+	}
+	if resp, err := http.Post(fmt.Sprintf("%s/api/datasets/foo/stripes/%v/foo", srv.URL, stripe), "", nil); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expecting stripe chunks to be read-only, got %v (%v)", resp, err)
+	}
+}
+
+func TestNamespacedDatasetsViaAPI(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	for _, namespace := range []string{"", "sales", "sales", "hr"} {
+		resp, err := http.Post(fmt.Sprintf("%s/upload/auto?name=orders&namespace=%s", srv.URL, namespace), "text/csv", strings.NewReader("foo,bar\n1,2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %+v", resp.Status)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"", 4},
+		{"?namespace=", 1},
+		{"?namespace=sales", 2},
+		{"?namespace=hr", 1},
+		{"?namespace=marketing", 0},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/api/datasets%s", srv.URL, test.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var datasets []database.Dataset
+		if err := json.NewDecoder(resp.Body).Decode(&datasets); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if len(datasets) != test.expected {
+			t.Errorf("expecting %v to list %v datasets, got %v", test.query, test.expected, len(datasets))
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/datasets/sales.orders", srv.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expecting a namespaced dataset to be dropped, got %v", resp.StatusCode)
+	}
+	for _, ds := range db.Datasets {
+		if ds.Namespace == "sales" {
+			t.Errorf("expecting all versions of sales.orders to be dropped, found %v", ds.ID)
+		}
+	}
+	if len(db.Datasets) != 2 {
+		t.Errorf("expecting datasets in other namespaces to remain, got %v datasets", len(db.Datasets))
+	}
+}
+
+func TestPresignedUploadsNotConfigured(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/upload/presigned?name=foo", http.StatusNotImplemented},
+		{http.MethodPost, "/upload/presigned/04c552ec8c5535772c?name=foo", http.StatusNotImplemented},
+		{http.MethodGet, "/upload/presigned", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/upload/presigned/04c552ec8c5535772c", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v %v to result in %v, got %v", test.method, test.path, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	db, err := newDatabaseWithRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	do := func(method, path string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/upload/multipart", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expecting an upload to be initialised, got %v", resp.StatusCode)
+	}
+	var upload struct {
+		ID  database.UID `json:"id"`
+		URL string       `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	parts := []string{"foo,bar\n1,", "2\n3,4\n", "5,6\n"}
+	for j, part := range parts {
+		resp := do(http.MethodPut, fmt.Sprintf("%v/%v", upload.URL, j+1), strings.NewReader(part))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expecting part %v to be uploaded, got %v", j+1, resp.StatusCode)
+		}
+	}
+	resp = do(http.MethodGet, upload.URL, nil)
+	var received []database.UploadPart
+	if err := json.NewDecoder(resp.Body).Decode(&received); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(received) != len(parts) {
+		t.Errorf("expecting %v parts, got %+v", len(parts), received)
+	}
+
+	resp = do(http.MethodPost, upload.URL+"?name=stitched&namespace=big", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expecting an upload to be completed, got %v", resp.StatusCode)
+	}
+	var ds database.Dataset
+	if err := json.NewDecoder(resp.Body).Decode(&ds); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ds.Name != "stitched" || ds.Namespace != "big" || ds.NRows != 3 {
+		t.Errorf("unexpected dataset loaded: %+v", ds)
+	}
+	if _, err := db.GetDatasetLatest("big.stitched"); err != nil {
+		t.Errorf("expecting the dataset to be added to the database: %v", err)
+	}
+
+	aborted := do(http.MethodPost, "/upload/multipart", nil)
+	if err := json.NewDecoder(aborted.Body).Decode(&upload); err != nil {
+		t.Fatal(err)
+	}
+	aborted.Body.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/upload/multipart", http.StatusMethodNotAllowed},
+		{http.MethodPut, upload.URL + "/0", http.StatusBadRequest},
+		{http.MethodPut, upload.URL + "/foo", http.StatusBadRequest},
+		{http.MethodPost, upload.URL + "/1", http.StatusMethodNotAllowed},
+		{http.MethodPost, upload.URL + "?name=empty", http.StatusBadRequest},
+		{http.MethodPatch, upload.URL, http.StatusMethodNotAllowed},
+		{http.MethodDelete, upload.URL, http.StatusNoContent},
+		{http.MethodGet, upload.URL, http.StatusNotFound},
+		{http.MethodPut, upload.URL + "/1", http.StatusNotFound},
+		{http.MethodGet, "/upload/multipart/foo", http.StatusBadRequest},
+		{http.MethodGet, "/upload/multipart/" + ds.ID.String(), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp := do(test.method, test.path, strings.NewReader("foo"))
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("expecting %v %v to result in %v, got %v", test.method, test.path, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestExternalDatasets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data.csv"), []byte("a,b\n1,foo\n2,bar\n3,baz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.NewDatabase("", &database.Config{ExternalDirectory: dir, MaxRowsPerStripe: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	db.ServerHTTP = &http.Server{Handler: SetupRoutes(db)}
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/upload/external?name=foo&uri=data.csv", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expecting external data to be registered, got %v", resp.Status)
+	}
+	resp, err = http.Post(srv.URL+"/upload/external?name=bar&uri=missing.csv", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expecting missing data to result in a 404, got %v", resp.Status)
+	}
+
+	resp, err = http.Post(srv.URL+"/api/query", "application/json", strings.NewReader(`{"sql": "SELECT sum(a) FROM foo WHERE b != 'bar'"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expecting external data to be queryable, got %v", resp.Status)
+	}
+	var respBody struct {
+		Data [][]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(respBody.Data, [][]interface{}{{4.0}}) {
+		t.Errorf("unexpected query result: %v", respBody.Data)
+	}
+
+	resp, err = http.Post(srv.URL+"/upload/append/foo", "text/csv", strings.NewReader("a,b\n4,x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expecting appends to external datasets to be rejected, got %v", resp.Status)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	db, err := database.NewDatabase("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	db.ServerHTTP = &http.Server{Handler: SetupRoutes(db)}
+	srv := httptest.NewServer(db.ServerHTTP.Handler)
+	defer srv.Close()
+
+	begin := func() string {
+		resp, err := http.Post(srv.URL+"/api/transactions", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var tx struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tx); err != nil {
+			t.Fatal(err)
+		}
+		return tx.ID
+	}
+	request := func(method, path string, body string) int {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	txid := begin()
+	for _, name := range []string{"foo", "bar"} {
+		if status := request(http.MethodPost, "/upload/auto?name="+name+"&transaction="+txid, "a\n1\n2"); status != http.StatusOK {
+			t.Fatalf("expecting a dataset to be staged, got %v", status)
+		}
+	}
+	if len(db.Datasets) != 0 {
+		t.Errorf("not expecting staged datasets to be visible, got %v", len(db.Datasets))
+	}
+	if status := request(http.MethodPost, "/upload/auto?name=baz&async=true&transaction="+txid, "a\n1"); status != http.StatusBadRequest {
+		t.Errorf("expecting asynchronous loads in transactions to be rejected, got %v", status)
+	}
+	if status := request(http.MethodPost, "/api/transactions/"+txid+"/commit", ""); status != http.StatusOK {
+		t.Fatalf("expecting a transaction to be committed, got %v", status)
+	}
+	if len(db.Datasets) != 2 {
+		t.Errorf("expecting committed datasets to be visible, got %v", len(db.Datasets))
+	}
+	if status := request(http.MethodPost, "/api/transactions/"+txid+"/commit", ""); status != http.StatusNotFound {
+		t.Errorf("expecting committed transactions to be gone, got %v", status)
+	}
+
+	txid = begin()
+	if status := request(http.MethodPost, "/upload/auto?name=baz&transaction="+txid, "a\n1"); status != http.StatusOK {
+		t.Fatalf("expecting a dataset to be staged, got %v", status)
+	}
+	if status := request(http.MethodDelete, "/api/transactions/"+txid, ""); status != http.StatusOK {
+		t.Fatalf("expecting a transaction to be rolled back, got %v", status)
+	}
+	if len(db.Datasets) != 2 {
+		t.Errorf("not expecting rolled back datasets to be visible, got %v", len(db.Datasets))
+	}
+	for _, path := range []string{"/api/transactions/foo", "/upload/auto?name=baz&transaction=foo"} {
+		if status := request(http.MethodPost, path, "a\n1"); status != http.StatusBadRequest {
+			t.Errorf("expecting invalid transaction IDs in %v to be rejected, got %v", path, status)
+		}
 	}
 }
@@ -7,26 +7,64 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query"
 )
 
 func SetupRoutes(db *database.Database) http.Handler {
+	handler, _ := setupRoutes(db)
+	return handler
+}
+
+// setupRoutes also returns our query history, so that we can flush it when shutting down
+// ARCH: SetupRoutes is used by our lambda handler, which doesn't flush it, so queries only get
+// persisted there in batches (see query.History)
+func setupRoutes(db *database.Database) (http.Handler, *query.History) {
 	mux := http.NewServeMux()
+	cache := query.NewCache(db.Config.QueryCacheSize)
+	db.OnReload(func(config database.Config) {
+		cache.Resize(config.QueryCacheSize)
+	})
+	history := query.NewHistory(db, db.Config.QueryHistorySize)
+	cursors := query.NewCursors(db.Config.MaxCursors)
 	// there is a great Mat Ryer talk about not building all the handle* funcs as taking
 	// (w, r) as arguments, but rather returning handlefuncs themselves - this allows for
 	// passing in arguments, setup before the closure and other nice things
 	mux.HandleFunc("/", handleRoot(db))
 	mux.HandleFunc("/status", handleStatus(db))
 	mux.HandleFunc("/api/datasets", handleDatasets(db))
-	mux.HandleFunc("/api/query", handleQuery(db))
+	mux.HandleFunc("/api/datasets/", handleDataset(db))
+	mux.HandleFunc("/api/aliases", handleAliases(db))
+	mux.HandleFunc("/api/aliases/", handleAlias(db))
+	mux.HandleFunc("/api/usage", handleDiskUsage(db))
+	mux.HandleFunc("/api/transactions", handleTransactions(db))
+	mux.HandleFunc("/api/transactions/", handleTransaction(db))
+	mux.HandleFunc("/api/query", handleQuery(db, cache, cursors, history))
+	mux.HandleFunc("/api/query/batch", handleQueryBatch(db, cache, history))
+	mux.HandleFunc("/api/query/cache", handleQueryCache(cache))
+	mux.HandleFunc("/api/query/progress", handleQueryProgress(db, cache, history))
+	mux.HandleFunc("/api/query/materialize", handleQueryMaterialize(db, history))
+	mux.HandleFunc("/queries/recent", handleRecentQueries(history))
 	mux.HandleFunc("/upload/raw", handleUpload(db))
 	mux.HandleFunc("/upload/auto", handleAutoUpload(db))
+	mux.HandleFunc("/upload/infer-schema", handleLoadPreview(db))
+	mux.HandleFunc("/upload/append/", handleAppendUpload(db))
+	mux.HandleFunc("/upload/bundle", handleBundleUpload(db))
 	mux.HandleFunc("/upload/remote", handleRemoteUpload(db))
-	// mux.HandleFunc("/upload/infer-schema", handleTypeInference(db))
+	mux.HandleFunc("/upload/external", handleExternal(db))
+	mux.HandleFunc("/upload/presigned", handlePresignedUpload(db))
+	mux.HandleFunc("/upload/presigned/", handlePresignedCallback(db))
+	mux.HandleFunc("/upload/multipart", handleMultipartInit(db))
+	mux.HandleFunc("/upload/multipart/", handleMultipartUpload(db))
+	mux.HandleFunc("/jobs/", handleJob(db))
+	handler := authenticate(db, mux)
 
 	if !db.Config.UseTLS {
-		return mux
+		return handler, history
 	}
 	// if we have https enabled, we need to redirect all http traffic - we could have used HSTS or something,
 	// but if https is there, let's use it unconditionally
@@ -34,7 +72,7 @@ func SetupRoutes(db *database.Database) http.Handler {
 		if r.TLS == nil {
 			host, _, err := net.SplitHostPort(r.Host)
 			if err != nil {
-				http.Error(w, "failed to parse URL", http.StatusInternalServerError)
+				writeError(w, "failed to parse URL", http.StatusInternalServerError)
 				return
 			}
 			newURL := r.URL
@@ -51,27 +89,94 @@ func SetupRoutes(db *database.Database) http.Handler {
 			http.Redirect(w, r, newURL.String(), http.StatusMovedPermanently)
 			return
 		}
-		mux.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r)
+	}), history
+}
+
+// authenticate only lets through requests with a valid bearer token (see Config.AuthTokens),
+// tokens can also be passed as passwords using basic auth, so that browsers can prompt for them
+// (/status is always available, so that it can be used for health checks). Requests with read-only
+// access (see Database.ReadOnly) only get through if they don't modify any data (see readOnlyRequest).
+func authenticate(db *database.Database, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if r.URL.Path != "/status" && !db.Authorise(token) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="smda"`)
+			writeError(w, "missing or invalid auth token", http.StatusUnauthorized)
+			return
+		}
+		if !readOnlyRequest(r) && db.ReadOnly(token) {
+			writeError(w, "read-only access, data cannot be modified", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
 	})
 }
 
-// RunWebserver sets up all the necessities for a server to run (namely routes) and launches one
+// queries don't modify any data, even though they get POSTed
+var readOnlyPosts = map[string]bool{
+	"/api/query":          true,
+	"/api/query/batch":    true,
+	"/api/query/progress": true,
+	// previews don't store anything
+	"/upload/infer-schema": true,
+}
+
+// readOnlyRequest tells whether a request only reads data - uploads, drops, materialisations and
+// other requests modifying data are all POSTs, PUTs or DELETEs, so we can tell them apart at the router
+// level, without each handler having to check for read-only access
+func readOnlyRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		return readOnlyPosts[r.URL.Path]
+	}
+	return false
+}
+
+// inFlight keeps track of requests being handled, so that we can wait for them when shutting down
+func inFlight(wg *sync.WaitGroup, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RunWebserver sets up all the necessities for a server to run (namely routes) and launches one.
+// Once the context is cancelled, the server stops accepting new connections and waits for in-flight
+// requests (up to Config.ShutdownGracePeriod), requests still running after that get their contexts
+// cancelled and their connections closed, we wait for them to wind down (loaders remove stripes
+// of partially loaded datasets) before returning.
 func RunWebserver(ctx context.Context, db *database.Database, expose bool, tlsCert, tlsKey string) error {
-	mux := SetupRoutes(db)
+	routes, history := setupRoutes(db)
+	var requests sync.WaitGroup
+	mux := inFlight(&requests, routes)
+	// requests don't inherit our context, so that they can outlive its cancellation (for the duration
+	// of our grace period), they get aborted by cancelling this context instead
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	baseContext := func(net.Listener) context.Context { return abortCtx }
 	host := "localhost"
 	if expose {
 		host = ""
 	}
 
-	errs := make(chan error)
+	// buffered, so that servers we shut down don't block on reporting they have been closed
+	errs := make(chan error, 2)
 
 	// http handling
 	address := net.JoinHostPort(host, strconv.Itoa(db.Config.PortHTTP))
 
 	db.Lock()
 	db.ServerHTTP = &http.Server{
-		Addr:    address,
-		Handler: mux,
+		Addr:        address,
+		Handler:     mux,
+		BaseContext: baseContext,
 	}
 	db.Unlock()
 	log.Printf("listening on http://%v", address)
@@ -88,8 +193,9 @@ func RunWebserver(ctx context.Context, db *database.Database, expose bool, tlsCe
 		log.Printf("listening on https://%v", address)
 		db.Lock()
 		db.ServerHTTPS = &http.Server{
-			Addr:    address,
-			Handler: mux,
+			Addr:        address,
+			Handler:     mux,
+			BaseContext: baseContext,
 		}
 		db.Unlock()
 
@@ -103,18 +209,35 @@ func RunWebserver(ctx context.Context, db *database.Database, expose bool, tlsCe
 	case <-ctx.Done():
 		// ARCH(next): what errors should be returned in case of cancellation?
 		var rval error
-		if db.ServerHTTP != nil {
-			log.Println("http webserver shutting down")
-			if err := db.ServerHTTP.Shutdown(ctx); err != nil && err != context.Canceled {
-				rval = err
+		grace := time.Duration(db.Config.ShutdownGracePeriod) * time.Millisecond
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		servers := []*http.Server{db.ServerHTTP, db.ServerHTTPS}
+		for _, server := range servers {
+			if server == nil {
+				continue
 			}
-		}
-		if db.ServerHTTPS != nil {
-			log.Println("https webserver shutting down")
-			if err := db.ServerHTTPS.Shutdown(ctx); err != nil && err != context.Canceled {
-				rval = err
+			log.Printf("webserver on %v shutting down", server.Addr)
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				if err != context.DeadlineExceeded {
+					rval = err
+				}
+				// Shutdown doesn't close active connections, so we need to do it ourselves
+				log.Printf("grace period for webserver on %v expired, aborting in-flight requests", server.Addr)
+				abort()
+				if err := server.Close(); err != nil {
+					rval = err
+				}
 			}
 		}
+		abort()
+		requests.Wait()
+		if err := history.Flush(); err != nil {
+			log.Printf("failed to persist query history: %v", err)
+		}
+		if err := db.FlushAllInserts(); err != nil {
+			log.Printf("failed to write inserted rows: %v", err)
+		}
 		return rval
 	}
 }
@@ -2,16 +2,21 @@ package web
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/kokes/smda/src/database"
+	"github.com/kokes/smda/src/query"
 )
 
 func TestServerHappyPath(t *testing.T) {
@@ -77,6 +82,119 @@ func TestServerClosing(t *testing.T) {
 	}
 }
 
+// startSlowUpload starts an upload, whose body only gets sent once we write into (and close) the returned pipe
+func startSlowUpload(t *testing.T, port int) (*io.PipeWriter, chan *http.Response) {
+	body, pw := io.Pipe()
+	resps := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%v/upload/auto?name=foo", port), "text/csv", body)
+		if err != nil {
+			resps <- nil
+			return
+		}
+		resp.Body.Close()
+		resps <- resp
+	}()
+	if _, err := pw.Write([]byte("foo,bar\n")); err != nil {
+		t.Fatal(err)
+	}
+	return pw, resps
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	port := 10000 + rand.Intn(1000)
+	db, err := database.NewDatabase("", &database.Config{
+		PortHTTP: port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- RunWebserver(ctx, db, false, "", "")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	pw, resps := startSlowUpload(t, port)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	// the server waits for our upload to finish
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("server shut down with a request in flight: %v", err)
+	default:
+	}
+	if _, err := pw.Write([]byte("1,2\n3,4\n")); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if resp := <-resps; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expecting an in-flight upload to succeed, got %+v", resp)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expecting a clean shutdown, got %v", err)
+	}
+	if _, err := db.GetDatasetLatest("foo"); err != nil {
+		t.Errorf("expecting uploaded data to be loaded, got %v", err)
+	}
+
+	// no new requests get accepted
+	if _, err := http.Get(fmt.Sprintf("http://localhost:%v/status", port)); err == nil {
+		t.Error("expecting a shut down server not to accept connections")
+	}
+}
+
+func TestShutdownAbortingRequests(t *testing.T) {
+	port := 10000 + rand.Intn(1000)
+	db, err := database.NewDatabase("", &database.Config{
+		PortHTTP:            port,
+		ShutdownGracePeriod: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- RunWebserver(ctx, db, false, "", "")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	pw, resps := startSlowUpload(t, port)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expecting a shutdown without errors, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expecting the server to abort in-flight requests after its grace period")
+	}
+	// our client only gives up once it's done sending the body
+	pw.Close()
+	if resp := <-resps; resp != nil {
+		t.Errorf("expecting an aborted upload not to get a response, got %v", resp.Status)
+	}
+	if len(db.Datasets) != 0 {
+		t.Errorf("expecting an aborted upload not to load anything, got %v datasets", len(db.Datasets))
+	}
+}
+
 func TestBusyPort(t *testing.T) {
 	port := 10000 + rand.Intn(1000)
 	db, err := database.NewDatabase("", &database.Config{
@@ -107,3 +225,142 @@ func TestBusyPort(t *testing.T) {
 }
 
 // func (db *Database) setupRoutes() {
+
+func TestReadOnlyAccess(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{AuthTokens: []string{"admin"}, ReadOnlyTokens: []string{"demo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	ds, err := db.LoadDatasetFromReaderAuto("foo", strings.NewReader("a\n1\n2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDataset(ds); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(SetupRoutes(db))
+	defer srv.Close()
+
+	request := func(method, path, body, token string) int {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, "/api/datasets", "", http.StatusOK},
+		{http.MethodGet, "/api/datasets/foo/preview", "", http.StatusOK},
+		{http.MethodPost, "/api/query", `{"sql": "SELECT a FROM foo"}`, http.StatusOK},
+		{http.MethodPost, "/upload/auto?name=bar", "a\n1", http.StatusForbidden},
+		{http.MethodPost, "/api/query/materialize", `{"sql": "SELECT a FROM foo", "dataset": "bar"}`, http.StatusForbidden},
+		{http.MethodPost, "/api/transactions", "", http.StatusForbidden},
+		{http.MethodDelete, "/api/datasets/foo", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := request(test.method, test.path, test.body, "demo"); status != test.status {
+			t.Errorf("expecting %v %v with a read-only token to result in %v, got %v", test.method, test.path, test.status, status)
+		}
+	}
+	if status := request(http.MethodDelete, "/api/datasets/foo", "", "admin"); status != http.StatusNoContent {
+		t.Errorf("expecting full access tokens to modify data, got %v", status)
+	}
+
+	// the whole server can be read only
+	if err := db.Reload(database.Config{AuthTokens: []string{"admin"}, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if status := request(http.MethodPost, "/upload/auto?name=bar", "a\n1", "admin"); status != http.StatusForbidden {
+		t.Errorf("expecting a read-only server to reject uploads, got %v", status)
+	}
+}
+
+func TestAuthTokens(t *testing.T) {
+	db, err := database.NewDatabase("", &database.Config{AuthTokens: []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Drop(); err != nil {
+			panic(err)
+		}
+	}()
+	srv := httptest.NewServer(SetupRoutes(db))
+	defer srv.Close()
+
+	request := func(path string, auth func(*http.Request)) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	if status := request("/api/datasets", nil); status != http.StatusUnauthorized {
+		t.Errorf("expecting requests without tokens to be rejected, got %v", status)
+	}
+	if status := request("/api/datasets", bearer("foo")); status != http.StatusUnauthorized {
+		t.Errorf("expecting requests with invalid tokens to be rejected, got %v", status)
+	}
+	if status := request("/status", nil); status != http.StatusOK {
+		t.Errorf("expecting status checks not to need tokens, got %v", status)
+	}
+	if status := request("/api/datasets", bearer("secret")); status != http.StatusOK {
+		t.Errorf("expecting requests with valid tokens to succeed, got %v", status)
+	}
+	if status := request("/api/datasets", func(r *http.Request) { r.SetBasicAuth("", "secret") }); status != http.StatusOK {
+		t.Errorf("expecting tokens passed via basic auth to work, got %v", status)
+	}
+
+	// tokens (and the query cache size) can be reloaded
+	if err := db.Reload(database.Config{AuthTokens: []string{"other"}, QueryCacheSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if status := request("/api/datasets", bearer("secret")); status != http.StatusUnauthorized {
+		t.Errorf("expecting reloaded tokens to replace the original ones, got %v", status)
+	}
+	if status := request("/api/datasets", bearer("other")); status != http.StatusOK {
+		t.Errorf("expecting reloaded tokens to be accepted, got %v", status)
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/query/cache", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bearer("other")(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats query.CacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Capacity != -1 {
+		t.Errorf("expecting the query cache to be resized upon reload, got %+v", stats)
+	}
+}